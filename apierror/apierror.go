@@ -0,0 +1,318 @@
+// Package apierror defines the stable, machine-readable codes of the errors
+// returned by the API, and the envelope they're returned in:
+//
+//	{
+//		"code" : "TRIP_NOT_FOUND",
+//		"message" : "<human readable message, which may change>",
+//		"details" : <depends on the code, omitted if none>
+//	}
+//
+// The clients branch on the code rather than on the message. A code is
+// never renamed nor reused once published, new codes may be added. The
+// code of an error is told by CodeOf(): the errors of the data model map
+// to their own code, the other ones to the generic code of their status.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+	"github.com/go-playground/validator/v10"
+)
+
+// Code is the machine-readable code of an error
+type Code string
+
+// The generic codes, by status
+const (
+	BadRequest         Code = "BAD_REQUEST"
+	Unauthorized       Code = "UNAUTHORIZED"
+	Forbidden          Code = "FORBIDDEN"
+	NotFound           Code = "NOT_FOUND"
+	RequestTimeout     Code = "REQUEST_TIMEOUT"
+	Conflict           Code = "CONFLICT"
+	PreconditionFailed Code = "PRECONDITION_FAILED"
+	PayloadTooLarge    Code = "PAYLOAD_TOO_LARGE"
+	UnsupportedMedia   Code = "UNSUPPORTED_MEDIA_TYPE"
+	RateLimited        Code = "RATE_LIMITED"
+	Internal           Code = "INTERNAL"
+	Unavailable        Code = "UNAVAILABLE"
+)
+
+// The specific codes
+const (
+	// ValidationFailed is a malformed payload, or one breaking the rules
+	// of its fields, the details list the fields at fault
+	ValidationFailed Code = "VALIDATION_FAILED"
+	// UnsupportedVersion is a version of the API not served
+	UnsupportedVersion Code = "UNSUPPORTED_VERSION"
+
+	TripNotFound       Code = "TRIP_NOT_FOUND"
+	ExpenseNotFound    Code = "EXPENSE_NOT_FOUND"
+	ReceiptNotFound    Code = "RECEIPT_NOT_FOUND"
+	VoiceNoteNotFound  Code = "VOICE_NOTE_NOT_FOUND"
+	UserNotFound       Code = "USER_NOT_FOUND"
+	TokenNotFound      Code = "TOKEN_NOT_FOUND"
+	WebhookNotFound    Code = "WEBHOOK_NOT_FOUND"
+	JobNotFound        Code = "JOB_NOT_FOUND"
+	QuarantineNotFound Code = "QUARANTINE_NOT_FOUND"
+	MessageNotFound    Code = "MESSAGE_NOT_FOUND"
+	RecurrenceNotFound Code = "RECURRENCE_NOT_FOUND"
+	SuggestionNotFound Code = "SUGGESTION_NOT_FOUND"
+	FeatureNotFound    Code = "FEATURE_NOT_FOUND"
+	AvatarNotFound     Code = "AVATAR_NOT_FOUND"
+	SheetNotFound      Code = "SHEET_NOT_FOUND"
+	PaymentNotFound    Code = "PAYMENT_NOT_FOUND"
+	ReviewNotFound     Code = "REVIEW_NOT_FOUND"
+	GroupNotFound      Code = "GROUP_NOT_FOUND"
+	FederationNotFound Code = "FEDERATION_NOT_FOUND"
+
+	TripModified Code = "TRIP_MODIFIED"
+	TripArchived Code = "TRIP_ARCHIVED"
+	TripActive   Code = "TRIP_ACTIVE"
+	PastTrip     Code = "PAST_TRIP"
+
+	// ParticipantUnknown is a user who isn't a participant of the trip
+	ParticipantUnknown   Code = "PARTICIPANT_UNKNOWN"
+	ParticipantInExpense Code = "PARTICIPANT_IN_EXPENSE"
+	ParticipantPaid      Code = "PARTICIPANT_PAID"
+	ExpenseReplaced      Code = "EXPENSE_REPLACED"
+	EmailDomainRejected  Code = "EMAIL_DOMAIN_REJECTED"
+	OwnsActiveTrips      Code = "OWNS_ACTIVE_TRIPS"
+
+	SettlementInfeasible Code = "SETTLEMENT_INFEASIBLE"
+	// PatchFailed is an operation of a JSON Patch failing, the details
+	// tell which one
+	PatchFailed         Code = "PATCH_FAILED"
+	PatchTestFailed     Code = "PATCH_TEST_FAILED"
+	EmptySearch         Code = "EMPTY_SEARCH"
+	OCRUnavailable      Code = "OCR_UNAVAILABLE"
+	SpeechUnavailable   Code = "SPEECH_UNAVAILABLE"
+	PurgeChanged        Code = "PURGE_CHANGED"
+	TokenExpired        Code = "TOKEN_EXPIRED"
+	TokenRevoked        Code = "TOKEN_REVOKED"
+	AlreadyVerified     Code = "ALREADY_VERIFIED"
+	VerificationExpired Code = "VERIFICATION_EXPIRED"
+	SessionInvalid      Code = "SESSION_INVALID"
+	ApprovalDelegated   Code = "APPROVAL_DELEGATED"
+	DelegationNotFound  Code = "DELEGATION_NOT_FOUND"
+	InviteInvalid       Code = "INVITE_INVALID"
+	TripCompleted       Code = "TRIP_COMPLETED"
+	SignatureInvalid    Code = "SIGNATURE_INVALID"
+	InviteAddressed     Code = "INVITE_ADDRESSED"
+	// PaidLinkInvalid is a "mark as paid" link which isn't one signed by
+	// the server, and AlreadyPaid the transfer of one paid already
+	PaidLinkInvalid Code = "PAID_LINK_INVALID"
+	AlreadyPaid     Code = "ALREADY_PAID"
+	// InboundStale is an inbound request of an integration signed too
+	// long ago, and InboundReplayed one already received
+	InboundStale    Code = "INBOUND_STALE"
+	InboundReplayed Code = "INBOUND_REPLAYED"
+	// GoogleNotConnected is a user who didn't connect their Google
+	// account, and GoogleAPIFailed a failure of the Google APIs
+	GoogleNotConnected Code = "GOOGLE_NOT_CONNECTED"
+	GoogleAPIFailed    Code = "GOOGLE_API_FAILED"
+	// ExpensesFrozen is an expense added while the expense entry of the
+	// trip is frozen, the details tell until when
+	ExpensesFrozen Code = "EXPENSES_FROZEN"
+	FreezeNotFound Code = "FREEZE_NOT_FOUND"
+	// FederationOff is a server not set up to federate its trips, and
+	// PeerFailed a failure of the other instance of a sync
+	FederationOff Code = "FEDERATION_OFF"
+	PeerFailed    Code = "PEER_FAILED"
+)
+
+// statusCodes are the generic codes of the statuses
+var statusCodes = map[int]Code{
+	http.StatusBadRequest:            BadRequest,
+	http.StatusUnauthorized:          Unauthorized,
+	http.StatusForbidden:             Forbidden,
+	http.StatusNotFound:              NotFound,
+	http.StatusRequestTimeout:        RequestTimeout,
+	http.StatusConflict:              Conflict,
+	http.StatusPreconditionFailed:    PreconditionFailed,
+	http.StatusRequestEntityTooLarge: PayloadTooLarge,
+	http.StatusUnsupportedMediaType:  UnsupportedMedia,
+	http.StatusTooManyRequests:       RateLimited,
+	http.StatusInternalServerError:   Internal,
+	http.StatusServiceUnavailable:    Unavailable,
+}
+
+// sentinelCodes are the codes of the errors of the data model, the first
+// one matching is taken
+var sentinelCodes = []struct {
+	err  error
+	code Code
+}{
+	{trip.ErrTripModified, TripModified},
+	{trip.ErrTripArchived, TripArchived},
+	{trip.ErrTripActive, TripActive},
+	{trip.ErrPastTrip, PastTrip},
+	{trip.ErrUnknownParticipant, ParticipantUnknown},
+	{trip.ErrParticipantInExpense, ParticipantInExpense},
+	{trip.ErrReassignPaid, ParticipantPaid},
+	{trip.ErrExpenseReplaced, ExpenseReplaced},
+	{trip.ErrEmailDomain, EmailDomainRejected},
+	{trip.ErrOwnsActiveTrips, OwnsActiveTrips},
+	{trip.ErrInfeasibleSettlement, SettlementInfeasible},
+	{trip.ErrPatchTest, PatchTestFailed},
+	{trip.ErrEmptySearch, EmptySearch},
+	{trip.ErrNoOCR, OCRUnavailable},
+	{trip.ErrNoSpeech, SpeechUnavailable},
+	{trip.ErrPurgeChanged, PurgeChanged},
+	{trip.ErrTokenExpired, TokenExpired},
+	{trip.ErrTokenRevoked, TokenRevoked},
+	{trip.ErrAlreadyVerified, AlreadyVerified},
+	{trip.ErrVerificationExpired, VerificationExpired},
+	{trip.ErrInvalidSession, SessionInvalid},
+	{trip.ErrApprovalDelegated, ApprovalDelegated},
+	{trip.ErrNoDelegation, DelegationNotFound},
+	{trip.ErrInvalidInvite, InviteInvalid},
+	{trip.ErrTripCompleted, TripCompleted},
+	{trip.ErrInvalidSignature, SignatureInvalid},
+	{trip.ErrInviteAddressed, InviteAddressed},
+	{trip.ErrInvalidPaidLink, PaidLinkInvalid},
+	{trip.ErrAlreadyPaid, AlreadyPaid},
+	{trip.ErrInboundSignature, SignatureInvalid},
+	{trip.ErrInboundStale, InboundStale},
+	{trip.ErrInboundReplay, InboundReplayed},
+	{trip.ErrNoSheet, SheetNotFound},
+	{trip.ErrNoGoogleAccount, GoogleNotConnected},
+	{trip.ErrGoogleAPI, GoogleAPIFailed},
+	{trip.ErrExpensesFrozen, ExpensesFrozen},
+	{trip.ErrNoFreeze, FreezeNotFound},
+	{trip.ErrNoGroup, GroupNotFound},
+	{trip.ErrNoFederation, FederationNotFound},
+	{trip.ErrFederationOff, FederationOff},
+	{trip.ErrPeerFailed, PeerFailed},
+}
+
+// Error is an error given its code by the handler, when it can't be told
+// from the error itself
+type Error struct {
+	Code Code
+	Err  error
+}
+
+// New returns the error with the given code
+func New(code Code, err error) error {
+	return &Error{code, err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is a field of the payload at fault, in the details of
+// ValidationFailed
+type FieldError struct {
+	// Field is the path of the field in the payload, e.g.
+	// "participants[0]"
+	Field string `json:"field"`
+	// Rule is the rule broken, e.g. "required" or "email_address"
+	Rule string `json:"rule"`
+	// Param is the parameter of the rule, e.g. the minimum of "min"
+	Param string `json:"param,omitempty"`
+}
+
+// PatchDetails are the details of PatchFailed
+type PatchDetails struct {
+	// Index is the position of the operation in the patch
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+}
+
+// FreezeDetails are the details of ExpensesFrozen
+type FreezeDetails struct {
+	// Until is when the expense entry is open again
+	Until time.Time `json:"until"`
+}
+
+// Envelope is the body of the error responses
+type Envelope struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+// CodeOf returns the code of an error returned with the status
+func CodeOf(status int, err error) Code {
+	var coded *Error
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	for _, s := range sentinelCodes {
+		if errors.Is(err, s.err) {
+			return s.code
+		}
+	}
+	var patchErr *trip.PatchError
+	var validationErrs validator.ValidationErrors
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &patchErr):
+		return PatchFailed
+	case errors.As(err, &validationErrs) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr):
+		return ValidationFailed
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status >= 500 {
+		return Internal
+	}
+	return BadRequest
+}
+
+// detailsOf returns the details of an error, nil if it has none
+func detailsOf(err error) any {
+	var patchErr *trip.PatchError
+	var freezeErr *trip.FreezeError
+	var validationErrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &patchErr):
+		return PatchDetails{patchErr.Index, patchErr.Op.Op, patchErr.Op.Path}
+	case errors.As(err, &freezeErr):
+		return FreezeDetails{freezeErr.Until}
+	case errors.As(err, &validationErrs):
+		fields := make([]FieldError, len(validationErrs))
+		for i, fe := range validationErrs {
+			fields[i] = FieldError{Field: fieldPath(fe.Namespace()), Rule: fe.Tag(), Param: fe.Param()}
+		}
+		return fields
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return []FieldError{{Field: typeErr.Field, Rule: "type", Param: typeErr.Type.String()}}
+	}
+	return nil
+}
+
+// fieldPath drops the name of the Go type from the namespace of a field,
+// e.g. "tripJSON.Owner"
+func fieldPath(namespace string) string {
+	for i := 0; i < len(namespace); i++ {
+		if namespace[i] == '.' {
+			return namespace[i+1:]
+		}
+	}
+	return namespace
+}
+
+// Wrap returns the envelope of an error returned with the status, with the
+// code given when the one of the error is generic
+func Wrap(status int, err error, fallback Code) Envelope {
+	code := CodeOf(status, err)
+	if fallback != "" && code == statusCodes[status] {
+		code = fallback
+	}
+	return Envelope{Code: code, Message: err.Error(), Details: detailsOf(err)}
+}
@@ -0,0 +1,75 @@
+package apierror
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+	"github.com/go-playground/validator/v10"
+)
+
+// TestCodeOf checks the codes of some errors
+func TestCodeOf(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		err    error
+		want   Code
+	}{
+		{http.StatusPreconditionFailed, trip.ErrTripModified, TripModified},
+		{http.StatusBadRequest, fmt.Errorf("Expense participant 'x' %w", trip.ErrUnknownParticipant), ParticipantUnknown},
+		{http.StatusBadRequest, fmt.Errorf("%w: gmail.com is blocked", trip.ErrEmailDomain), EmailDomainRejected},
+		{http.StatusNotFound, New(ParticipantUnknown, sql.ErrNoRows), ParticipantUnknown},
+		{http.StatusNotFound, sql.ErrNoRows, NotFound},
+		{http.StatusBadRequest, &json.SyntaxError{}, ValidationFailed},
+		{http.StatusBadRequest, &trip.PatchError{Err: errors.New("bad path")}, PatchFailed},
+		{http.StatusBadRequest, errors.New("oops"), BadRequest},
+		{http.StatusTeapot, errors.New("oops"), BadRequest},
+		{http.StatusBadGateway, errors.New("oops"), Internal},
+		{http.StatusBadGateway, fmt.Errorf("%w: invalid_grant", trip.ErrGoogleAPI), GoogleAPIFailed},
+	} {
+		if got := CodeOf(c.status, c.err); got != c.want {
+			t.Errorf("CodeOf(%d, %v) = %s, want %s", c.status, c.err, got, c.want)
+		}
+	}
+}
+
+// TestWrap checks the envelopes, with their details and the fallback code
+func TestWrap(t *testing.T) {
+	env := Wrap(http.StatusNotFound, sql.ErrNoRows, TripNotFound)
+	if env.Code != TripNotFound || env.Message != sql.ErrNoRows.Error() || env.Details != nil {
+		t.Errorf("Unexpected envelope %+v", env)
+	}
+	env = Wrap(http.StatusNotFound, New(ParticipantUnknown, sql.ErrNoRows), TripNotFound)
+	if env.Code != ParticipantUnknown {
+		t.Errorf("expected the code of the error to win, got %+v", env)
+	}
+
+	type payload struct {
+		Owner  string `validate:"required"`
+		Amount int    `validate:"min=0"`
+	}
+	err := validator.New().Struct(payload{Amount: -1})
+	env = Wrap(http.StatusBadRequest, err, "")
+	want := []FieldError{{"Owner", "required", ""}, {"Amount", "min", "0"}}
+	if env.Code != ValidationFailed || !reflect.DeepEqual(env.Details, want) {
+		t.Errorf("Unexpected envelope %+v", env)
+	}
+
+	patchErr := &trip.PatchError{Index: 2, Op: trip.PatchOp{Op: "replace", Path: "/nope"}, Err: errors.New("bad path")}
+	env = Wrap(http.StatusBadRequest, patchErr, "")
+	if env.Code != PatchFailed || env.Details != (PatchDetails{2, "replace", "/nope"}) {
+		t.Errorf("Unexpected envelope %+v", env)
+	}
+
+	until := time.Date(2024, 5, 3, 9, 0, 0, 0, time.UTC)
+	env = Wrap(http.StatusConflict, &trip.FreezeError{Until: until}, TripNotFound)
+	if env.Code != ExpensesFrozen || env.Details != (FreezeDetails{until}) {
+		t.Errorf("Unexpected envelope %+v", env)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// avatarsDir is the directory the avatar files are stored in
+	avatarsDir = "/srv/trip-accountant/data/avatars"
+	// maxAvatarSize is the maximum size, in bytes, of the upload of an
+	// avatar, instead of maxBodySize
+	maxAvatarSize int64 = 2 << 20
+)
+
+// avatarTypes are the content types of the avatars accepted, as detected
+// from the content
+var avatarTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// putAvatar sets the avatar of a user to the picture of the "file" field
+// of a multipart upload, for the user only, without creating them
+func putAvatar(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can set their avatar", email))
+		return
+	}
+	u, status, err := openUpload(r, avatarTypes)
+	if err != nil {
+		jsonBail(w, r, status, err)
+		return
+	}
+	defer u.Close()
+	p, err := trip.SetAvatar(requestContext(r), db, email, u)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// deleteAvatar removes the avatar of a user, for the user only
+func deleteAvatar(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can remove their avatar", email))
+		return
+	}
+	p, err := trip.DeleteAvatar(requestContext(r), db, email)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// getAvatar returns the file of an avatar, by its hash, the one of the
+// avatar_url of the users
+func getAvatar(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	sum := r.PathValue("avatar")
+	a, err := trip.OpenAvatar(requestContext(r), db, sum)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer a.Close()
+	// the avatars are immutable, they're named by their content, a new
+	// one gets a new URL
+	w.Header().Set("ETag", strconv.Quote(sum))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", a.ModTime, a)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// instanceName is the name of the instance shown to the people, e.g.
+	// the club hosting it, in the emails, the reports and the pages
+	instanceName = "Trip Accountant"
+	// logoURL is the URL of the logo of the instance, none if empty
+	logoURL string
+	// primaryColor and accentColor are the color scheme of the pages and
+	// the HTML emails, as CSS hex colors
+	primaryColor = "#1f6feb"
+	accentColor  = "#f0f4fa"
+)
+
+// hexColor matches a CSS hex color, e.g. #1f6feb or #fff
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// colorsJSON is the color scheme of the instance
+type colorsJSON struct {
+	Primary string `json:"primary"`
+	Accent  string `json:"accent"`
+}
+
+// metaJSON is the branding of the instance, for the clients to show
+type metaJSON struct {
+	Name    string     `json:"name"`
+	LogoURL string     `json:"logo_url,omitempty"`
+	Colors  colorsJSON `json:"colors"`
+}
+
+// branding returns the branding of the instance, as configured
+func branding() metaJSON {
+	return metaJSON{
+		Name:    instanceName,
+		LogoURL: logoURL,
+		Colors:  colorsJSON{Primary: primaryColor, Accent: accentColor},
+	}
+}
+
+// setupBranding checks the branding of the instance, and sets the name
+// heading the reports
+func setupBranding() error {
+	if instanceName == "" {
+		return fmt.Errorf("--instance-name can't be empty")
+	}
+	if logoURL != "" {
+		u, err := url.Parse(logoURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid --logo-url %q, expecting an http(s) URL", logoURL)
+		}
+	}
+	for flag, color := range map[string]string{"primary-color": primaryColor, "accent-color": accentColor} {
+		if !hexColor.MatchString(color) {
+			return fmt.Errorf("invalid --%s %q, expecting a hex color, e.g. #1f6feb", flag, color)
+		}
+	}
+	trip.SetInstanceName(instanceName)
+	return nil
+}
+
+// getMeta returns the branding of the instance
+func getMeta(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, branding())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// bulkJSON is used for POST of the bulk operations on trips, it's the
+// filter selecting the trips
+type bulkJSON struct {
+	// Status is active, completed or archived
+	Status string `json:"status"`
+	// Owner is the email address of the owner of the trips
+	Owner string `json:"owner" binding:"omitempty,email_address"`
+	// StartedBefore is a date in YYYY-MM-DD format
+	StartedBefore string `json:"started_before"`
+	// EndedBefore is a date in YYYY-MM-DD format
+	EndedBefore string `json:"ended_before"`
+}
+
+// Translate maps a bulkJSON into TripFilter
+func (b bulkJSON) Translate() (f trip.TripFilter, err error) {
+	f.Status = trip.TripStatus(b.Status)
+	f.Owner = b.Owner
+	if b.StartedBefore != "" {
+		f.StartedBefore, err = time.Parse(time.DateOnly, b.StartedBefore)
+		if err != nil {
+			return f, err
+		}
+	}
+	if b.EndedBefore != "" {
+		f.EndedBefore, err = time.Parse(time.DateOnly, b.EndedBefore)
+		if err != nil {
+			return f, err
+		}
+	}
+	if f.IsEmpty() {
+		return f, errors.New("the filter must have at least one criterion")
+	}
+	return f, nil
+}
+
+// bulkOperations are the operations applied to each trip by the bulk
+// jobs, the export has its own job
+var bulkOperations = map[string]func(ctx context.Context, db *sql.DB, tripID int64) error{
+	"complete": func(ctx context.Context, db *sql.DB, tripID int64) error {
+		// the settlement of a completed trip is only read
+		_, err := trip.SettleTrip(ctx, db, tripID)
+		return err
+	},
+	"archive": trip.ArchiveTrip,
+}
+
+// bulkJobs runs the bulk operations in the background
+var bulkJobs = newJobQueue()
+
+// bulkTrips returns the handler queuing the given bulk operation (complete,
+// archive or export) on the trips matching the filter of the payload
+func bulkTrips(operation string) func(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	return func(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+		var bj bulkJSON
+		err := decodeJSON(r, &bj)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		filter, err := bj.Translate()
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		ids, err := trip.FindTripIDs(requestContext(r), db, filter)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		run := func(ctx context.Context, q *jobQueue, j *job) ([]byte, error) {
+			q.setTotal(j, len(ids))
+			op := bulkOperations[operation]
+			for _, id := range ids {
+				err := op(ctx, db, id)
+				if err != nil {
+					err = fmt.Errorf("trip %d: %w", id, err)
+				}
+				q.step(j, err)
+			}
+			return nil, nil
+		}
+		if operation == "export" {
+			run = func(ctx context.Context, q *jobQueue, j *job) ([]byte, error) {
+				q.setTotal(j, len(ids))
+				trips := []*trip.Trip{}
+				for _, id := range ids {
+					t, err := trip.LoadTripByID(ctx, db, id)
+					if err != nil {
+						err = fmt.Errorf("trip %d: %w", id, err)
+					} else {
+						trips = append(trips, t)
+					}
+					q.step(j, err)
+				}
+				return json.Marshal(trips)
+			}
+		}
+		j, err := bulkJobs.submit(requestContext(r), operation, run)
+		if err != nil {
+			jsonBail(w, r, http.StatusServiceUnavailable, err)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v1/admin/jobs/%d", j.ID))
+		writeJSON(w, http.StatusAccepted, j)
+	}
+}
+
+// getJob returns the status and progress of a bulk job
+func getJob(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	jobID, err := strconv.ParseInt(r.PathValue("job_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	j, ok := bulkJobs.get(jobID)
+	if !ok {
+		jsonBail(w, r, http.StatusNotFound, fmt.Errorf("unknown job %d", jobID))
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
+}
+
+// getJobResult returns the result of a finished job, e.g. the trips of a
+// bulk export
+func getJobResult(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	jobID, err := strconv.ParseInt(r.PathValue("job_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	j, ok := bulkJobs.get(jobID)
+	if !ok || !j.HasResult {
+		jsonBail(w, r, http.StatusNotFound, fmt.Errorf("no result for job %d", jobID))
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=job-%d.json", jobID))
+	writeData(w, http.StatusOK, "application/json", j.result)
+}
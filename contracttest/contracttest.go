@@ -0,0 +1,349 @@
+// Package contracttest implements the conformance tests of the REST API:
+// golden requests and responses, runnable against any running instance of
+// the service, so that the authors of clients can check their assumptions
+// against a given version.
+//
+// The fixtures are JSON documents, embedded in the package, each a
+// scenario of steps run in order:
+//
+//	{
+//		"name" : "<name of the scenario>",
+//		"steps" : [
+//			{
+//				"name" : "<name of the step>",
+//				"request" : { "method" : "POST", "path" : "/v1/trips", "body" : { ... } },
+//				"response" : { "status" : 201, "headers" : { ... }, "body" : { ... } }
+//			},
+//			...
+//		]
+//	}
+//
+// In the requests and the responses, "${name}" is replaced by the value of
+// a variable. "${run}" is unique to each run, to keep the email addresses
+// of the users apart between runs. In a response, a string that is a
+// variable not set yet, e.g. "${trip_id}", captures the value instead, for
+// the next steps. A "*" string matches any value, present. The members of
+// the objects of a response are a subset of the returned ones, so that the
+// members added by later versions don't break the contract, while the
+// arrays must match element by element.
+package contracttest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//go:embed fixtures/*.json
+var fixtureFS embed.FS
+
+// variableRef matches the references to the variables in the strings
+var variableRef = regexp.MustCompile(`\$\{([a-z_][a-z0-9_]*)\}`)
+
+// Request is the golden request of a step
+type Request struct {
+	// Method is the HTTP method
+	Method string `json:"method"`
+	// Path is the path of the URL, with the query if any
+	Path string `json:"path"`
+	// Headers are the headers to send besides Content-Type
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is the JSON payload, if any
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// Response is the golden response of a step
+type Response struct {
+	// Status is the expected status code
+	Status int `json:"status"`
+	// Headers are the expected headers, matched like the strings of Body
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is the expected JSON document, not checked if missing
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// Step is a request of a scenario and its expected response
+type Step struct {
+	// Name describes the step
+	Name     string   `json:"name"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Fixture is a scenario of the contract
+type Fixture struct {
+	// Name describes the scenario
+	Name string `json:"name"`
+	// Steps are run in order, they can use the variables captured by the
+	// previous ones
+	Steps []Step `json:"steps"`
+}
+
+// Config tells how to reach the instance under test
+type Config struct {
+	// BaseURL is the URL of the instance, e.g. http://localhost:8081
+	BaseURL string
+	// Client makes the requests, http.DefaultClient if nil
+	Client *http.Client
+	// Token is sent as a bearer token if set. An admin token is needed
+	// when the instance requires the tokens, as the scenarios act for
+	// users of their own.
+	Token string
+}
+
+// Fixtures returns the scenarios of the contract, in the order of their
+// file names
+func Fixtures() ([]Fixture, error) {
+	names, err := fixtureNames()
+	if err != nil {
+		return nil, err
+	}
+	rslt := make([]Fixture, 0, len(names))
+	for _, name := range names {
+		data, err := fixtureFS.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var f Fixture
+		err = json.Unmarshal(data, &f)
+		if err != nil {
+			return nil, fmt.Errorf("fixture %s: %w", path.Base(name), err)
+		}
+		rslt = append(rslt, f)
+	}
+	return rslt, nil
+}
+
+// fixtureNames lists the embedded fixture files, sorted
+func fixtureNames() ([]string, error) {
+	entries, err := fixtureFS.ReadDir("fixtures")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, path.Join("fixtures", e.Name()))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Run runs all the scenarios of the contract against the instance, each
+// as a subtest
+func Run(t *testing.T, cfg Config) {
+	fixtures, err := Fixtures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			cfg.RunFixture(t, f)
+		})
+	}
+}
+
+// RunFixture runs the steps of a scenario in order, it stops at the first
+// step failing as the next ones depend on it
+func (cfg Config) RunFixture(t *testing.T, f Fixture) {
+	t.Helper()
+	vars := map[string]any{"run": newRunID()}
+	for i, step := range f.Steps {
+		err := cfg.runStep(step, vars)
+		if err != nil {
+			t.Fatalf("step %d (%s): %v", i+1, step.Name, err)
+		}
+	}
+}
+
+// newRunID returns a random identifier of a run
+func newRunID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// runStep makes the request of a step and checks its response
+func (cfg Config) runStep(step Step, vars map[string]any) error {
+	var body io.Reader
+	if len(step.Request.Body) > 0 {
+		payload, err := decode(step.Request.Body)
+		if err != nil {
+			return fmt.Errorf("request body: %w", err)
+		}
+		data, err := json.Marshal(expand(payload, vars))
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	url := strings.TrimSuffix(cfg.BaseURL, "/") + expandString(step.Request.Path, vars)
+	req, err := http.NewRequest(step.Request.Method, url, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+	for k, v := range step.Request.Headers {
+		req.Header.Set(k, expandString(v, vars))
+	}
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != step.Response.Status {
+		return fmt.Errorf("expected status %d, got %d: %s", step.Response.Status, resp.StatusCode, data)
+	}
+	for k, want := range step.Response.Headers {
+		got := resp.Header.Get(k)
+		if got == "" {
+			return fmt.Errorf("missing header %s", k)
+		}
+		err = match(want, got, k, vars)
+		if err != nil {
+			return err
+		}
+	}
+	if len(step.Response.Body) == 0 {
+		return nil
+	}
+	want, err := decode(step.Response.Body)
+	if err != nil {
+		return fmt.Errorf("response fixture: %w", err)
+	}
+	got, err := decode(data)
+	if err != nil {
+		return fmt.Errorf("response body %q: %w", data, err)
+	}
+	return match(want, got, "$", vars)
+}
+
+// decode decodes a JSON document, keeping the numbers as json.Number
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// expand replaces the references to the variables in a decoded JSON
+// document. A string made of a single reference is replaced by the value
+// of the variable, so that the numbers stay numbers.
+func expand(v any, vars map[string]any) any {
+	switch v := v.(type) {
+	case string:
+		if m := variableRef.FindStringSubmatch(v); m != nil && m[0] == v {
+			if value, ok := vars[m[1]]; ok {
+				return value
+			}
+		}
+		return expandString(v, vars)
+	case map[string]any:
+		rslt := make(map[string]any, len(v))
+		for k, e := range v {
+			rslt[expandString(k, vars)] = expand(e, vars)
+		}
+		return rslt
+	case []any:
+		rslt := make([]any, len(v))
+		for i, e := range v {
+			rslt[i] = expand(e, vars)
+		}
+		return rslt
+	default:
+		return v
+	}
+}
+
+// expandString replaces the references to the variables set in a string,
+// the others are left as is
+func expandString(s string, vars map[string]any) string {
+	return variableRef.ReplaceAllStringFunc(s, func(ref string) string {
+		value, ok := vars[ref[2:len(ref)-1]]
+		if !ok {
+			return ref
+		}
+		return fmt.Sprint(value)
+	})
+}
+
+// match checks the returned value against the expected one, at the given
+// JSON path, capturing the variables not set yet
+func match(want, got any, at string, vars map[string]any) error {
+	switch w := want.(type) {
+	case string:
+		if w == "*" {
+			return nil
+		}
+		if m := variableRef.FindStringSubmatch(w); m != nil && m[0] == w {
+			if _, ok := vars[m[1]]; !ok {
+				vars[m[1]] = got
+				return nil
+			}
+		}
+		want = expand(w, vars)
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %v", at, got)
+		}
+		keys := make([]string, 0, len(w))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			key := expandString(k, vars)
+			v, ok := g[key]
+			if !ok {
+				return fmt.Errorf("%s: missing member %q", at, key)
+			}
+			err := match(w[k], v, at+"."+key, vars)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		g, ok := got.([]any)
+		if !ok || len(g) != len(w) {
+			return fmt.Errorf("%s: expected an array of %d elements, got %v", at, len(w), got)
+		}
+		for i := range w {
+			err := match(w[i], g[i], fmt.Sprintf("%s[%d]", at, i), vars)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !reflect.DeepEqual(want, got) {
+		return fmt.Errorf("%s: expected %v, got %v", at, want, got)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package contracttest
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// TestFixtures checks the embedded fixtures are well-formed
+func TestFixtures(t *testing.T) {
+	fixtures, err := Fixtures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("expected some fixtures")
+	}
+	for _, f := range fixtures {
+		if f.Name == "" || len(f.Steps) == 0 {
+			t.Errorf("fixture %q has no name or no steps", f.Name)
+		}
+		for i, step := range f.Steps {
+			if step.Request.Method == "" || step.Request.Path == "" || step.Response.Status == 0 {
+				t.Errorf("fixture %q: step %d is incomplete", f.Name, i+1)
+			}
+		}
+	}
+}
+
+// TestMatch checks the matching of the responses, and the capture of the
+// variables
+func TestMatch(t *testing.T) {
+	vars := map[string]any{"run": "r1"}
+	want, _ := decode([]byte(`{"id": "${id}", "user": "a-${run}@example.com", "at": "*", "list": [1, 2]}`))
+	got, _ := decode([]byte(`{"id": 7, "user": "a-r1@example.com", "at": "now", "list": [1, 2], "extra": true}`))
+	err := match(want, got, "$", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(vars["id"]) != "7" {
+		t.Errorf("expected id to be captured, got %v", vars["id"])
+	}
+	if expandString("/trips/${id}/${unknown}", vars) != "/trips/7/${unknown}" {
+		t.Errorf("unexpected expansion %s", expandString("/trips/${id}/${unknown}", vars))
+	}
+	for _, doc := range []string{
+		`{"id": 8, "user": "a-r1@example.com", "at": "now", "list": [1, 2]}`,
+		`{"id": 7, "user": "a-r1@example.com", "list": [1, 2]}`,
+		`{"id": 7, "user": "a-r1@example.com", "at": "now", "list": [1]}`,
+	} {
+		got, _ = decode([]byte(doc))
+		if match(want, got, "$", vars) == nil {
+			t.Errorf("expected %s not to match", doc)
+		}
+	}
+}
+
+// TestContract runs the contract against the instance at
+// TRIP_ACCOUNTANT_URL, with the token in TRIP_ACCOUNTANT_TOKEN if any
+func TestContract(t *testing.T) {
+	baseURL := os.Getenv("TRIP_ACCOUNTANT_URL")
+	if baseURL == "" {
+		t.Skip("TRIP_ACCOUNTANT_URL isn't set")
+	}
+	Run(t, Config{BaseURL: baseURL, Token: os.Getenv("TRIP_ACCOUNTANT_TOKEN")})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// digestInterval is the period of the digests of the active trips sent to
+// the webhooks, 0 disables them
+var digestInterval = 7 * 24 * time.Hour
+
+// scheduleDigests queues the trip.digest events every digestInterval,
+// until the process ends
+func scheduleDigests(db *sql.DB) {
+	if digestInterval <= 0 || webhookInterval <= 0 {
+		return
+	}
+	log.Printf("Sending the digests of the active trips every %v\n", digestInterval)
+	go func() {
+		for range time.Tick(digestInterval) {
+			ctx := trip.WithRequestID(context.Background(), "digests")
+			_, err := trip.QueueDigests(ctx, db)
+			if err != nil {
+				trip.Logf(ctx, "ERROR: failed to queue the digests: %v\n", err)
+			}
+		}
+	}()
+}
+
+// getDigest returns the digest of the active trips of an owner
+func getDigest(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can get the digest of their trips", email))
+		return
+	}
+	digests, err := trip.LoadDigest(requestContext(r), db, email)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, digests)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// normalizer is implemented by the payloads normalizing their email
+// addresses once bound, see bindJSON()
+type normalizer interface {
+	normalize() error
+}
+
+// init registers the "email_address" validation of the binding tags, and
+// names the fields of the validation errors after their JSON names
+func init() {
+	payloadValidator.RegisterValidation("email_address", validEmailAddress)
+	payloadValidator.RegisterTagNameFunc(func(f reflect.StructField) string {
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			return f.Name
+		}
+		return name
+	})
+}
+
+// validEmailAddress tells whether the field is a bare email address in
+// RFC 5322 syntax, once trimmed. A display name, e.g. "Bob <bob@x.com>", is
+// refused.
+func validEmailAddress(fl validator.FieldLevel) bool {
+	email := strings.TrimSpace(fl.Field().String())
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Name == "" && addr.Address == email
+}
+
+// normalizeEmail trims and lowercases an email address, so the variants
+// of an address are the same user
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizeEmails normalizes the email addresses of the field in place, an
+// address listed twice once normalized is an error
+func normalizeEmails(field string, emails []string) error {
+	seen := make(map[string]int, len(emails))
+	for i, email := range emails {
+		email = normalizeEmail(email)
+		if j, ok := seen[email]; ok {
+			return fmt.Errorf("%s[%d]: %q is the same address as %s[%d]", field, i, emails[i], field, j)
+		}
+		seen[email] = i
+		emails[i] = email
+	}
+	return nil
+}
+
+// bindJSON binds the JSON body, and validates it, see decodeJSON(),
+// then normalizes the email addresses of the payload
+func bindJSON(r *http.Request, obj any) error {
+	err := decodeJSON(r, obj)
+	if err != nil {
+		return err
+	}
+	if n, ok := obj.(normalizer); ok {
+		return n.normalize()
+	}
+	return nil
+}
+
+// normalize normalizes the email addresses of the owner and the
+// participants
+func (t *tripJSON) normalize() error {
+	t.Owner = normalizeEmail(t.Owner)
+	return normalizeEmails("participants", t.Participants)
+}
+
+// normalize normalizes the email addresses of the participants
+func (p *participantsJSON) normalize() error {
+	return normalizeEmails("participants", p.Participants)
+}
+
+// normalize normalizes the email addresses of the participants and of the
+// single payer shortcut
+func (e *expenseJSON) normalize() error {
+	if e.Participants != nil {
+		participants := make(map[string]int, len(e.Participants))
+		for email, paid := range e.Participants {
+			norm := normalizeEmail(email)
+			if _, ok := participants[norm]; ok {
+				return fmt.Errorf("participants[%s]: %s is listed more than once", email, norm)
+			}
+			participants[norm] = paid
+		}
+		e.Participants = participants
+	}
+	e.PaidBy = normalizeEmail(e.PaidBy)
+	return normalizeEmails("split_among", e.SplitAmong)
+}
@@ -11,25 +11,34 @@
 APP=/srv/trip-accountant/bin/trip-accountant
 DBFILE=/srv/trip-accountant/data/trips.db
 
-# If --db is in the argument list, extract the DB path
-_get_dbpath() {
-    local chk_next val opt path scheme
+# Extract the value of an option, the first argument, from the rest of the
+# argument list, either as "--opt value" or as "--opt=value"
+_get_opt() {
+    local name=$1 chk_next opt
+    shift
 
     for opt; do
 	if [ -n "$chk_next" ]; then
-	    val=$opt
-	    break
+	    echo "$opt"
+	    return
 	fi
 	case "$opt" in
-	    --db)
+	    "$name")
 		chk_next=1
 		;;
-	    --db=*)
-		val=$(expr "x$opt" : 'x[^=]*=\(.*\)')
-		break
+	    "$name"=*)
+		expr "x$opt" : 'x[^=]*=\(.*\)'
+		return
 		;;
 	esac
     done
+}
+
+# If --db is in the argument list, extract the DB path
+_get_dbpath() {
+    local val scheme
+
+    val=$(_get_opt --db "$@")
     if [ -n "$val" ]; then
 	# --db option exists and value is in $val
 	scheme=$(echo "$val" | awk -F: '{ print $1 }')
@@ -39,20 +48,46 @@ _get_dbpath() {
     fi
 }
 
-# If necessary, create the SQLite DB file and then the schema for the app
+# Prefix the names of the tables, indices and constraints of the schema on
+# stdin with --table-prefix, like the server does in its statements
+_prefix_schema() {
+    local prefix=$1 schema names
+
+    schema=$(cat)
+    if [ -z "$prefix" ]; then
+	echo "$schema"
+	return
+    fi
+    names=$(echo "$schema" | grep -o -E '(CREATE (TABLE|INDEX) IF NOT EXISTS|CONSTRAINT) [a-z0-9_]+' \
+	| awk '{ print $NF }' | paste -s -d '|')
+    echo "$schema" | sed -E "s/\<($names)\>/${prefix}\1/g"
+}
+
+# If necessary, create the SQLite DB file, then the schema for the app.
+# All the statements are idempotent, so the schema is applied on every
+# start, to add the tables introduced since the DB file was created. It
+# leaves the tables already there as they are: the columns added to them
+# since are added by the server when it starts, see trip/upgrade.go.
 check_db() {
     local dbpath=$(_get_dbpath "$@")
+    local prefix=$(_get_opt --table-prefix "$@")
 
     if [ -z "$dbpath" ]; then
 	dbpath=$DBFILE
     fi
 
-    [ -f "$dbpath" ] || {
-	cat <<EOF | sqlite3 "$dbpath"
+    # The schema is also created by the server in --dev mode, keep it in
+    # sync with devSchema in trip/dev.go
+    cat <<EOF | _prefix_schema "$prefix" | sqlite3 "$dbpath"
 CREATE TABLE IF NOT EXISTS tuser (
 user_id INTEGER CONSTRAINT user_pkey PRIMARY KEY AUTOINCREMENT,
 email VARCHAR(256) NOT NULL UNIQUE,
-verified BOOLEAN DEFAULT FALSE);
+verified BOOLEAN DEFAULT FALSE,
+display_name VARCHAR(128) NOT NULL DEFAULT '',
+avatar VARCHAR(64) NOT NULL DEFAULT '',
+venmo VARCHAR(30) NOT NULL DEFAULT '',
+paypal_me VARCHAR(64) NOT NULL DEFAULT '',
+iban VARCHAR(34) NOT NULL DEFAULT '');
 
 CREATE TABLE IF NOT EXISTS trip (
 trip_id INTEGER CONSTRAINT trip_pkey PRIMARY KEY AUTOINCREMENT,
@@ -61,12 +96,18 @@ name_lower VARCHAR(128) NOT NULL,
 created_at INTEGER NOT NULL,
 start_date INTEGER NOT NULL,
 end_date INTEGER DEFAULT 0,
-description VARCHAR(512));
+description VARCHAR(512),
+version INTEGER NOT NULL DEFAULT 1,
+archived_at INTEGER DEFAULT 0,
+organizer_fee INTEGER NOT NULL DEFAULT 0,
+approval_required BOOLEAN NOT NULL DEFAULT FALSE,
+deleted_at INTEGER NOT NULL DEFAULT 0);
 
 CREATE TABLE IF NOT EXISTS participant (
 trip_id INTEGER NOT NULL,
 user_id INTEGER NOT NULL,
 is_owner BOOLEAN NOT NULL DEFAULT FALSE,
+rsvp VARCHAR(16) NOT NULL DEFAULT 'invited',
 CONSTRAINT participant_pkey PRIMARY KEY (trip_id, user_id));
 
 CREATE TABLE IF NOT EXISTS expense (
@@ -82,8 +123,312 @@ expense_id INTEGER NOT NULL,
 user_id INTEGER NOT NULL,
 amount INTEGER NOT NULL,
 CONSTRAINT expense_participant_pkey PRIMARY KEY (expense_id, user_id));
+
+CREATE TABLE IF NOT EXISTS spend_cap (
+user_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL DEFAULT 0,
+amount INTEGER NOT NULL,
+CONSTRAINT spend_cap_pkey PRIMARY KEY (user_id, trip_id));
+
+CREATE TABLE IF NOT EXISTS trip_snapshot (
+snapshot_id INTEGER CONSTRAINT trip_snapshot_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+json BLOB NOT NULL,
+csv BLOB NOT NULL,
+pdf BLOB NOT NULL);
+CREATE INDEX IF NOT EXISTS trip_snapshot_trip_index ON trip_snapshot(trip_id);
+
+CREATE TABLE IF NOT EXISTS expense_note (
+expense_id INTEGER CONSTRAINT expense_note_pkey PRIMARY KEY,
+notes TEXT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS expense_metadata (
+expense_id INTEGER CONSTRAINT expense_metadata_pkey PRIMARY KEY,
+metadata TEXT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS expense_reassignment (
+expense_id INTEGER CONSTRAINT expense_reassignment_pkey PRIMARY KEY,
+trip_id INTEGER NOT NULL,
+replaced_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+target_id INTEGER NOT NULL DEFAULT 0,
+created_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS receipt (
+receipt_id INTEGER CONSTRAINT receipt_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+expense_id INTEGER NOT NULL,
+sha256 CHAR(64) NOT NULL,
+content_type VARCHAR(128) NOT NULL,
+filename VARCHAR(256) NOT NULL,
+size INTEGER NOT NULL,
+uploaded_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS receipt_expense_index ON receipt(trip_id, expense_id);
+CREATE INDEX IF NOT EXISTS receipt_sha256_index ON receipt(sha256);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+audit_id INTEGER CONSTRAINT audit_log_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL DEFAULT 0,
+action VARCHAR(32) NOT NULL,
+expense_id INTEGER NOT NULL DEFAULT 0,
+before_state TEXT NOT NULL DEFAULT '',
+after_state TEXT NOT NULL DEFAULT '',
+recorded_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS audit_log_trip_index ON audit_log(trip_id, audit_id);
+
+CREATE TABLE IF NOT EXISTS voice_note (
+voice_note_id INTEGER CONSTRAINT voice_note_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+expense_id INTEGER NOT NULL,
+sha256 CHAR(64) NOT NULL,
+content_type VARCHAR(128) NOT NULL,
+filename VARCHAR(256) NOT NULL,
+size INTEGER NOT NULL,
+transcript TEXT NOT NULL DEFAULT '',
+uploaded_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS voice_note_expense_index ON voice_note(trip_id, expense_id);
+CREATE INDEX IF NOT EXISTS voice_note_sha256_index ON voice_note(sha256);
+
+CREATE TABLE IF NOT EXISTS webhook (
+webhook_id INTEGER CONSTRAINT webhook_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL DEFAULT 0,
+url VARCHAR(2048) NOT NULL,
+events VARCHAR(256) NOT NULL,
+secret CHAR(64) NOT NULL,
+created_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+delivery_id INTEGER CONSTRAINT webhook_delivery_pkey PRIMARY KEY AUTOINCREMENT,
+webhook_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL,
+event VARCHAR(32) NOT NULL,
+payload TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+attempts INTEGER NOT NULL DEFAULT 0,
+next_attempt_at INTEGER NOT NULL,
+last_error VARCHAR(512) NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS webhook_delivery_next_index ON webhook_delivery(next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS api_token (
+token_id INTEGER CONSTRAINT api_token_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL DEFAULT 0,
+scope TEXT NOT NULL,
+token_hash TEXT NOT NULL CONSTRAINT api_token_hash_unique UNIQUE,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL,
+revoked_at INTEGER NOT NULL DEFAULT 0);
+CREATE INDEX IF NOT EXISTS api_token_user_index ON api_token(user_id);
+
+CREATE TABLE IF NOT EXISTS trip_settlement (
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+CONSTRAINT trip_settlement_pkey PRIMARY KEY (trip_id, payer, payee));
+
+CREATE TABLE IF NOT EXISTS expense_deleted (
+expense_id INTEGER CONSTRAINT expense_deleted_pkey PRIMARY KEY,
+trip_id INTEGER NOT NULL,
+txn_date INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+deleted_at INTEGER NOT NULL,
+description VARCHAR(512),
+notes TEXT NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS expense_deleted_trip_index ON expense_deleted(trip_id);
+
+CREATE TABLE IF NOT EXISTS expense_participant_deleted (
+expense_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+CONSTRAINT expense_participant_deleted_pkey PRIMARY KEY (expense_id, user_id));
+
+CREATE TABLE IF NOT EXISTS forbidden_transfer (
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+CONSTRAINT forbidden_transfer_pkey PRIMARY KEY (trip_id, payer, payee));
+
+CREATE TABLE IF NOT EXISTS cost_preference (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+budget INTEGER NOT NULL DEFAULT 0,
+categories TEXT NOT NULL DEFAULT '',
+updated_at INTEGER NOT NULL,
+CONSTRAINT cost_preference_pkey PRIMARY KEY (trip_id, user_id));
+
+CREATE TABLE IF NOT EXISTS trip_envelope (
+trip_id INTEGER NOT NULL,
+category VARCHAR(16) NOT NULL,
+amount INTEGER NOT NULL,
+daily BOOLEAN NOT NULL DEFAULT FALSE,
+rollover BOOLEAN NOT NULL DEFAULT FALSE,
+updated_at INTEGER NOT NULL,
+CONSTRAINT trip_envelope_pkey PRIMARY KEY (trip_id, category));
+
+CREATE TABLE IF NOT EXISTS expense_approval (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+version INTEGER NOT NULL,
+approved_at INTEGER NOT NULL,
+CONSTRAINT expense_approval_pkey PRIMARY KEY (trip_id, user_id));
+
+CREATE TABLE IF NOT EXISTS expense_quarantine (
+quarantine_id INTEGER CONSTRAINT expense_quarantine_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+source VARCHAR(64) NOT NULL,
+payload TEXT NOT NULL,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS expense_quarantine_trip_index ON expense_quarantine(trip_id);
+
+CREATE TABLE IF NOT EXISTS email_verification (
+token_hash CHAR(64) CONSTRAINT email_verification_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS email_verification_user_index ON email_verification(user_id);
+
+CREATE TABLE IF NOT EXISTS approval_delegation (
+trip_id INTEGER CONSTRAINT approval_delegation_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+threshold INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS trip_message (
+message_id INTEGER CONSTRAINT trip_message_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+body TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+edited_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS trip_message_trip_index ON trip_message(trip_id);
+
+CREATE TABLE IF NOT EXISTS household_member (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+household VARCHAR(64) NOT NULL,
+CONSTRAINT household_member_pkey PRIMARY KEY (trip_id, user_id));
+
+CREATE TABLE IF NOT EXISTS trip_setting (
+trip_id INTEGER CONSTRAINT trip_setting_pkey PRIMARY KEY,
+slack_webhook_url VARCHAR(512) NOT NULL,
+telegram_chat_id VARCHAR(64) NOT NULL,
+updated_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS push_device (
+device_id INTEGER CONSTRAINT push_device_pkey PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER NOT NULL,
+platform VARCHAR(8) NOT NULL,
+token VARCHAR(512) NOT NULL CONSTRAINT push_device_token_unique UNIQUE,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS push_device_user_index ON push_device(user_id);
+
+CREATE TABLE IF NOT EXISTS push_delivery (
+push_id INTEGER CONSTRAINT push_delivery_pkey PRIMARY KEY AUTOINCREMENT,
+device_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL,
+event VARCHAR(32) NOT NULL,
+title VARCHAR(256) NOT NULL,
+body TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+attempts INTEGER NOT NULL DEFAULT 0,
+next_attempt_at INTEGER NOT NULL,
+last_error VARCHAR(512) NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS push_delivery_next_index ON push_delivery(next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS recurring_expense (
+recurrence_id INTEGER CONSTRAINT recurring_expense_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+description VARCHAR(512) NOT NULL,
+split TEXT NOT NULL,
+every_days INTEGER NOT NULL,
+next_date INTEGER NOT NULL,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS recurring_expense_trip_index ON recurring_expense(trip_id);
+
+CREATE TABLE IF NOT EXISTS feature_flag (
+name VARCHAR(64) CONSTRAINT feature_flag_pkey PRIMARY KEY,
+enabled BOOLEAN NOT NULL DEFAULT FALSE,
+percent INTEGER NOT NULL DEFAULT 0,
+trips TEXT NOT NULL,
+updated_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS feature_user (
+name VARCHAR(64) NOT NULL,
+user_id INTEGER NOT NULL,
+CONSTRAINT feature_user_pkey PRIMARY KEY (name, user_id));
+
+CREATE TABLE IF NOT EXISTS google_account (
+user_id INTEGER CONSTRAINT google_account_pkey PRIMARY KEY,
+refresh_token VARCHAR(512) NOT NULL,
+connected_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS trip_sheet (
+trip_id INTEGER CONSTRAINT trip_sheet_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+template_id VARCHAR(128) NOT NULL DEFAULT '',
+refresh_on_completion BOOLEAN NOT NULL DEFAULT FALSE,
+spreadsheet_id VARCHAR(128) NOT NULL DEFAULT '',
+created_at INTEGER NOT NULL,
+refreshed_at INTEGER NOT NULL DEFAULT 0,
+last_error VARCHAR(512) NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS trip_sheet_user_index ON trip_sheet(user_id);
+
+CREATE TABLE IF NOT EXISTS settlement_payment (
+payment_id INTEGER CONSTRAINT settlement_payment_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+paid_on INTEGER NOT NULL,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS settlement_payment_trip_index ON settlement_payment(trip_id);
+
+CREATE TABLE IF NOT EXISTS expense_freeze (
+trip_id INTEGER CONSTRAINT expense_freeze_pkey PRIMARY KEY,
+frozen_from INTEGER NOT NULL,
+frozen_until INTEGER NOT NULL,
+created_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS expense_review (
+review_id INTEGER CONSTRAINT expense_review_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+source VARCHAR(64) NOT NULL,
+payload TEXT NOT NULL,
+confidence INTEGER NOT NULL,
+corrected BOOLEAN NOT NULL DEFAULT FALSE,
+created_at INTEGER NOT NULL,
+updated_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS expense_review_trip_index ON expense_review(trip_id);
+
+CREATE TABLE IF NOT EXISTS friend_group (
+group_id INTEGER CONSTRAINT friend_group_pkey PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER NOT NULL,
+name VARCHAR(128) NOT NULL,
+created_at INTEGER NOT NULL,
+updated_at INTEGER NOT NULL,
+CONSTRAINT friend_group_name_unique UNIQUE (user_id, name));
+
+CREATE TABLE IF NOT EXISTS friend_group_member (
+group_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+CONSTRAINT friend_group_member_pkey PRIMARY KEY (group_id, user_id));
+
+CREATE TABLE IF NOT EXISTS trip_federation (
+federation_id INTEGER CONSTRAINT trip_federation_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+peer VARCHAR(256) NOT NULL,
+remote_trip_id INTEGER NOT NULL,
+sent_until INTEGER NOT NULL DEFAULT 0,
+received_until INTEGER NOT NULL DEFAULT 0,
+synced_at INTEGER NOT NULL DEFAULT 0,
+last_error VARCHAR(512) NOT NULL DEFAULT '',
+created_at INTEGER NOT NULL,
+CONSTRAINT trip_federation_peer_unique UNIQUE (trip_id, peer));
 EOF
-    }
 }
 
 # Returns 0 if the file is source as in "source entrypoint.sh"
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// envelopeJSON is used for PUT to set the budget envelopes of a trip
+type envelopeJSON struct {
+	// Category is one of the categories of the cost questionnaire
+	Category string `json:"category"`
+	// Amount is the allocation in cent, for each day if Daily is set
+	Amount int `json:"amount"`
+	// Daily is set if the allocation is for each day of the trip
+	Daily bool `json:"daily"`
+	// Rollover carries what's left of a day to the next one
+	Rollover bool `json:"rollover"`
+}
+
+// getEnvelopes returns the budget envelopes of the trip
+func getEnvelopes(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	envelopes, err := t.LoadEnvelopes(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, envelopes)
+}
+
+// putEnvelopes replaces the budget envelopes of the trip, an empty list
+// removes them, only the owner can set them
+func putEnvelopes(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var ej []envelopeJSON
+	err := decodeJSON(r, &ej)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "set its envelopes")
+	if !ok {
+		return
+	}
+	envelopes := make([]trip.Envelope, 0, len(ej))
+	for _, e := range ej {
+		envelopes = append(envelopes, trip.Envelope{
+			Category: e.Category,
+			Amount:   e.Amount,
+			Daily:    e.Daily,
+			Rollover: e.Rollover,
+		})
+	}
+	envelopes, err = t.SaveEnvelopes(requestContext(r), db, envelopes)
+	switch {
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, envelopes)
+}
+
+// getEnvelopeStatus returns how much of each budget envelope of the trip
+// has been spent, and which are blown
+func getEnvelopeStatus(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	envelopes, err := t.LoadEnvelopes(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.EnvelopeStatus(envelopes))
+}
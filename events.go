@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/apierror"
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// eventsHeartbeat is the interval of the comments sent on an idle stream
+// of events, so that the proxies don't close it
+var eventsHeartbeat = 30 * time.Second
+
+// getTripEvents streams the activity of a trip as Server-Sent Events: the
+// settlement first, then each change, followed by the settlement it leads
+// to, until the client goes away
+func getTripEvents(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	// subscribed before reading the settlement, so that no change is
+	// missed in between
+	activity, unsubscribe := trip.SubscribeActivity(tripID)
+	defer unsubscribe()
+	settlement, err := trip.PreviewSettlement(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, trip.ErrInfeasibleSettlement):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// the stream outlives the write timeout of the server
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		trip.Logf(ctx, "WARNING: the stream of events is cut by the write timeout: %v\n", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	err = writeEvent(w, "settlement", settlement)
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for err == nil {
+		select {
+		case a, ok := <-activity:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, a.Kind, a)
+			if err != nil {
+				return
+			}
+			settlement, serr := trip.PreviewSettlement(ctx, db, tripID)
+			if serr != nil {
+				err = writeEvent(w, "error", apierror.Wrap(http.StatusConflict, serr, ""))
+				if errors.Is(serr, sql.ErrNoRows) {
+					return
+				}
+				continue
+			}
+			err = writeEvent(w, "settlement", settlement)
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+			if err == nil {
+				err = http.NewResponseController(w).Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent sends an event of the stream, its data as JSON, and flushes
+// it to the client
+func writeEvent(w http.ResponseWriter, event string, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event:%s\ndata:%s\n\n", event, body)
+	if err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// featuresJSON is the feature flags on for a trip, for the clients to
+// show the features gated
+type featuresJSON struct {
+	Features []string `json:"features"`
+}
+
+// loadFeatures caches the feature flags set at startup
+func loadFeatures(db *sql.DB) {
+	flags, err := trip.LoadFeatures(trip.WithRequestID(context.Background(), "features"), db)
+	if err != nil {
+		log.Fatalf("ERROR: failed to load the feature flags: %v", err)
+	}
+	for _, f := range flags {
+		log.Printf("Feature flag %s: enabled %t, %d%% of the trips, %d users, %d trips\n",
+			f.Name, f.Enabled, f.Percent, len(f.Users), len(f.Trips))
+	}
+}
+
+// getFeatures lists the feature flags known, as they're set
+func getFeatures(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	flags, err := trip.LoadFeatures(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for _, name := range trip.Features {
+		if !slices.ContainsFunc(flags, func(f *trip.Feature) bool { return f.Name == name }) {
+			flags = append(flags, &trip.Feature{Name: name, Users: []string{}, Trips: []int64{}})
+		}
+	}
+	writeJSON(w, http.StatusOK, flags)
+}
+
+// putFeature sets a feature flag
+func putFeature(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var f trip.Feature
+	err := decodeJSON(r, &f)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	f.Name = r.PathValue("feature")
+	err = trip.SaveFeature(requestContext(r), db, &f)
+	switch {
+	case errors.Is(err, trip.ErrUnknownFeature):
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// deleteFeature turns a feature flag off for everyone
+func deleteFeature(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	err := trip.DeleteFeature(requestContext(r), db, r.PathValue("feature"))
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTripFeatures lists the feature flags on for a trip
+func getTripFeatures(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	rslt := featuresJSON{Features: []string{}}
+	for _, name := range trip.Features {
+		if trip.FeatureEnabled(name, t.ID, t.Owner.Email) {
+			rslt.Features = append(rslt.Features, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, rslt)
+}
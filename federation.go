@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// federationKey is the key the instances federating their trips share,
+	// the federation is off without it
+	federationKey string
+	// federationInterval is the period of the syncs of the federated
+	// trips, 0 leaves them to their owners
+	federationInterval = 15 * time.Minute
+	// federation is the instance federating its trips, set up from the
+	// flags at startup, nil if the federation is off
+	federation *trip.Federation
+)
+
+// federationJSON is used for POST to federate a trip with its copy on
+// another instance
+type federationJSON struct {
+	// Peer is the public URL of the other instance
+	Peer         string `json:"peer" binding:"required,url,max=256"`
+	RemoteTripID int64  `json:"remote_trip_id" binding:"required,min=1"`
+}
+
+// setupFederation sets up the federation of the trips from the flags, and
+// syncs the federated trips every federationInterval, in the background
+func setupFederation(db *sql.DB) {
+	if federationKey == "" {
+		return
+	}
+	if publicURL == "" {
+		log.Fatal("--federation-key requires --public-url, the instance is known to its peers by it")
+	}
+	federation = &trip.Federation{
+		Self:   strings.TrimRight(publicURL, "/"),
+		Key:    []byte(federationKey),
+		Client: &http.Client{Timeout: webhookTimeout},
+	}
+	log.Printf("Federating the trips as %s\n", federation.Self)
+	if federationInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(federationInterval) {
+			ctx := trip.WithRequestID(context.Background(), "federation")
+			links, err := trip.LoadActiveFederationLinks(ctx, db)
+			if err != nil {
+				trip.Logf(ctx, "ERROR: failed to load the federated trips: %v\n", err)
+				continue
+			}
+			for _, l := range links {
+				// the failure is recorded with the federation, and logged
+				_, err = federation.Sync(ctx, db, l)
+				if err != nil {
+					trip.Logf(ctx, "ERROR: failed to sync trip %d with %s: %v\n", l.TripID, l.Peer, err)
+				}
+			}
+		}
+	}()
+}
+
+// federationGuard returns the middleware verifying the sync requests of
+// the peers, bailing out if the federation is off
+func federationGuard() func(http.Handler) http.Handler {
+	if federation == nil {
+		return func(http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				jsonBail(w, r, http.StatusServiceUnavailable, trip.ErrFederationOff)
+			})
+		}
+	}
+	return verifyInbound("federation", trip.FederationVerifier{Key: federation.Key})
+}
+
+// federationOn tells whether the federation is on, bailing out with the
+// error if it's off
+func federationOn(w http.ResponseWriter, r *http.Request) bool {
+	if federation == nil {
+		jsonBail(w, r, http.StatusServiceUnavailable, trip.ErrFederationOff)
+		return false
+	}
+	return true
+}
+
+// loadFederationLink returns the federation of the path, of the trip,
+// bailing out with the error if it can't be loaded
+func loadFederationLink(w http.ResponseWriter, r *http.Request, db *sql.DB, t *trip.Trip) (*trip.FederationLink, bool) {
+	federationID, err := strconv.ParseInt(r.PathValue("federation_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	l, err := trip.LoadFederationLink(requestContext(r), db, t.ID, federationID)
+	switch {
+	case err == trip.ErrNoFederation:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return nil, false
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return l, true
+}
+
+// getFederation returns the federations of a trip, with the outcome of
+// their last sync
+func getFederation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !federationOn(w, r) {
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "federate it")
+	if !ok {
+		return
+	}
+	links, err := trip.LoadFederationLinks(requestContext(r), db, t.ID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+// postFederation federates a trip with its copy on another instance, whose
+// owner federates it back. Their first sync sends all the expenses.
+func postFederation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var fj federationJSON
+	err := bindJSON(r, &fj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !federationOn(w, r) {
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "federate it")
+	if !ok {
+		return
+	}
+	l, err := federation.Link(requestContext(r), db, t.ID, fj.Peer, fj.RemoteTripID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, l)
+}
+
+// deleteFederation ends a federation of a trip, the expenses received are
+// kept
+func deleteFederation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !federationOn(w, r) {
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "federate it")
+	if !ok {
+		return
+	}
+	l, ok := loadFederationLink(w, r, db, t)
+	if !ok {
+		return
+	}
+	err := trip.UnlinkFederation(requestContext(r), db, t.ID, l.ID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postFederationSync syncs a trip with its copy on the peer now, rather
+// than at the next scheduled sync
+func postFederationSync(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !federationOn(w, r) {
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "federate it")
+	if !ok {
+		return
+	}
+	l, ok := loadFederationLink(w, r, db, t)
+	if !ok {
+		return
+	}
+	rslt, err := federation.Sync(requestContext(r), db, l)
+	switch {
+	case errors.Is(err, trip.ErrPeerFailed):
+		jsonBail(w, r, http.StatusBadGateway, err)
+		return
+	case err == trip.ErrTripArchived || errors.Is(err, trip.ErrExpensesFrozen):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rslt)
+}
+
+// postFederationInbound applies the sync request of a peer, verified by
+// federationGuard(), and replies with the changes of the trip, signed
+func postFederationInbound(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var batch trip.FederationBatch
+	err = decodeJSON(r, &batch)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	reply, err := federation.Receive(requestContext(r), db, tripID, &batch)
+	switch {
+	case err == trip.ErrNoFederation || err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripArchived || errors.Is(err, trip.ErrExpensesFrozen):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set(trip.FederationSignatureHeader, trip.SignFederation(federation.Key, data, trip.Now()))
+	writeData(w, http.StatusOK, "application/json; charset=utf-8", data)
+}
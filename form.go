@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// expenseFormTmpl is the page served at /trips/:trip_id/add. It posts the
+// expense to the API with the token of the link, so it works in any
+// browser without the app.
+var expenseFormTmpl = template.Must(template.New("add").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Add an expense to {{.Trip.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 30em; padding: 1em; }
+label, input, select, button { display: block; width: 100%; box-sizing: border-box; font-size: 1.1em; }
+input, select { margin: 0.2em 0 0.8em; padding: 0.4em; }
+fieldset label { display: flex; gap: 0.5em; align-items: center; }
+fieldset input { width: auto; margin: 0.3em 0; }
+button { padding: 0.6em; margin-top: 1em; background: {{.Brand.Colors.Primary}}; color: #fff; border: none; }
+header { display: flex; gap: 0.5em; align-items: center; background: {{.Brand.Colors.Accent}}; padding: 0.5em; }
+header img { height: 2em; }
+#result { margin-top: 1em; }
+</style>
+</head>
+<body>
+<header>
+{{- if .Brand.LogoURL}}
+<img src="{{.Brand.LogoURL}}" alt="">
+{{- end}}
+<span>{{.Brand.Name}}</span>
+</header>
+<h1>{{.Trip.Name}}</h1>
+<form id="expense">
+<label for="date">Date</label>
+<input id="date" type="date" required value="{{.Date}}">
+<label for="description">Description</label>
+<input id="description" type="text" required maxlength="{{.MaxDescription}}" value="{{.Description}}">
+<label for="amount">Amount</label>
+<input id="amount" type="number" required min="0" step="0.01" inputmode="decimal" value="{{.Amount}}">
+<label for="payer">Paid by</label>
+<select id="payer">
+{{- range .Emails}}
+<option{{if eq . $.Payer}} selected{{end}}>{{.}}</option>
+{{- end}}
+</select>
+<fieldset>
+<legend>Split between</legend>
+{{- range .Emails}}
+<label><input type="checkbox" name="split" value="{{.}}"{{if index $.Sharers .}} checked{{end}}>{{.}}</label>
+{{- end}}
+</fieldset>
+<button type="submit">Add expense</button>
+</form>
+<p id="result" role="status"></p>
+<script>
+const form = document.getElementById("expense");
+const result = document.getElementById("result");
+form.addEventListener("submit", async (ev) => {
+	ev.preventDefault();
+	const payer = document.getElementById("payer").value;
+	const participants = {};
+	for (const cb of form.querySelectorAll("input[name=split]:checked")) {
+		participants[cb.value] = 0;
+	}
+	participants[payer] = Math.round(parseFloat(document.getElementById("amount").value) * 100);
+	const headers = {"Content-Type": "application/json"};
+	{{- if .Token}}
+	headers["Authorization"] = "Bearer " + {{.Token}};
+	{{- end}}
+	const resp = await fetch({{.Action}}, {
+		method: "POST",
+		headers: headers,
+		body: JSON.stringify({
+			date: document.getElementById("date").value,
+			description: document.getElementById("description").value,
+			participants: participants,
+		}),
+	});
+	const body = await resp.json();
+	if (resp.ok) {
+		result.textContent = "Expense added.";
+		form.reset();
+	} else {
+		result.textContent = "Failed: " + JSON.stringify(body);
+	}
+});
+</script>
+</body>
+</html>
+`))
+
+// expenseForm is the data of expenseFormTmpl
+type expenseForm struct {
+	Trip   *trip.Trip
+	Emails []string
+	// Sharers are checked in the split, the participants who declined
+	// the trip aren't
+	Sharers        map[string]bool
+	Action         string
+	Token          string
+	MaxDescription int
+	// Date, Description, Amount and Payer prefill the form, from the
+	// query of the link
+	Date        string
+	Description string
+	Amount      string
+	Payer       string
+	// Brand is the branding of the instance
+	Brand metaJSON
+}
+
+// linkToken lets the token of a shared link be passed as "?token=", as a
+// browser following the link can't set the Authorization header. It's to
+// be placed before requireScope().
+func linkToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tok := r.URL.Query().Get("token"); tok != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getExpenseForm serves the HTML form to add an expense to a trip
+func getExpenseForm(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+
+	form := expenseForm{
+		Trip:           t,
+		Emails:         []string{t.Owner.Email},
+		Action:         "/v1/trips/" + strconv.FormatInt(t.ID, 10) + "/expenses",
+		Token:          bearerToken(r),
+		MaxDescription: maxDescription,
+		Date:           defaultQuery(r, "date", trip.Now().Format(time.DateOnly)),
+		Description:    r.URL.Query().Get("description"),
+		Amount:         r.URL.Query().Get("amount"),
+		Payer:          r.URL.Query().Get("payer"),
+		Brand:          branding(),
+	}
+	for _, p := range t.Participants {
+		form.Emails = append(form.Emails, p.Email)
+	}
+	form.Sharers = make(map[string]bool, len(form.Emails))
+	for _, email := range t.Sharers() {
+		form.Sharers[email] = true
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(http.StatusOK)
+	err := expenseFormTmpl.Execute(w, form)
+	if err != nil {
+		trip.Logf(r.Context(), "ERROR: failed to render the expense form: %v\n", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// freezeJSON is used for PUT to freeze the expense entry of a trip
+type freezeJSON struct {
+	// From is when the freeze starts, now if omitted
+	From  time.Time `json:"from"`
+	Until time.Time `json:"until" binding:"required"`
+}
+
+// getFreeze returns the freeze of the expense entry of a trip, over or not
+func getFreeze(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	f, err := t.LoadFreeze(requestContext(r), db)
+	switch {
+	case err == trip.ErrNoFreeze:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// putFreeze freezes the expense entry of a trip, replacing its freeze if
+// any, for the owner only
+func putFreeze(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var fj freezeJSON
+	err := bindJSON(r, &fj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "freeze its expense entry")
+	if !ok {
+		return
+	}
+	f, err := t.FreezeExpenses(requestContext(r), db, fj.From, fj.Until)
+	switch {
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// deleteFreeze lifts the freeze of the expense entry of a trip, for the
+// owner only
+func deleteFreeze(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "freeze its expense entry")
+	if !ok {
+		return
+	}
+	err := t.LiftFreeze(requestContext(r), db)
+	switch {
+	case err == trip.ErrNoFreeze:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
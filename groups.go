@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// maxGroupName is the maximum length, in characters, of the name of a
+// friend group, as of the name of a trip
+const maxGroupName = 127
+
+// groupJSON is used for PUT to save a friend group
+type groupJSON struct {
+	Members []string `json:"members" binding:"required,dive,email_address"`
+}
+
+// normalize normalizes the email addresses of the members
+func (g *groupJSON) normalize() error {
+	return normalizeEmails("members", g.Members)
+}
+
+// groupOwner returns the user of the path, bailing out if the request
+// doesn't act for them
+func groupOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can manage their groups", email))
+		return "", false
+	}
+	return email, true
+}
+
+// getGroups returns the friend groups of a user, by name
+func getGroups(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email, ok := groupOwner(w, r)
+	if !ok {
+		return
+	}
+	groups, err := trip.LoadGroups(requestContext(r), db, email)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// getGroup returns a friend group of a user
+func getGroup(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email, ok := groupOwner(w, r)
+	if !ok {
+		return
+	}
+	g, err := trip.LoadGroup(requestContext(r), db, email, r.PathValue("name"))
+	switch {
+	case err == trip.ErrNoGroup:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+// putGroup creates a friend group of a user, or replaces its members
+func putGroup(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email, ok := groupOwner(w, r)
+	if !ok {
+		return
+	}
+	var gj groupJSON
+	err := bindJSON(r, &gj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	name := r.PathValue("name")
+	if utf8.RuneCountInString(name) > maxGroupName {
+		jsonBail(w, r, http.StatusBadRequest, fmt.Errorf("the name of the group is longer than %d characters", maxGroupName))
+		return
+	}
+	g, err := trip.SaveGroup(requestContext(r), db, email, name, gj.Members)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+// deleteGroup deletes a friend group of a user
+func deleteGroup(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email, ok := groupOwner(w, r)
+	if !ok {
+		return
+	}
+	err := trip.DeleteGroup(requestContext(r), db, email, r.PathValue("name"))
+	switch {
+	case err == trip.ErrNoGroup:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
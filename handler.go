@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// The handlers and the middlewares of the API are net/http ones, they
+// don't depend on the router: the parameters of the path are read with
+// r.PathValue(), and what the middlewares pass on, e.g. the token of the
+// request, is in the context of the request. The router is gin, adapted by
+// handlerWrapper() and middlewareWrapper(), and ginRoutes() lists its
+// routes; another router is adapted as long as it fills the path values
+// and the pattern of the route, e.g. http.ServeMux with patterns like
+// /trips/{trip_id}.
+
+// handlerFunc is our http.HandlerFunc that takes an additional DB handler
+// argument.
+type handlerFunc func(http.ResponseWriter, *http.Request, *sql.DB)
+
+// contextKey is the type of the keys of the values set in the context of
+// the requests by the middlewares and the router adapter
+type contextKey string
+
+// routeKey is the key of the pattern of the route matched by the router,
+// see routePattern()
+const routeKey contextKey = "route"
+
+// ginRequest returns the request of the gin.Context, with the parameters
+// of its route as path values, and the pattern of its route in its context
+func ginRequest(c *gin.Context) *http.Request {
+	for _, p := range c.Params {
+		c.Request.SetPathValue(p.Key, p.Value)
+	}
+	if _, ok := c.Request.Context().Value(routeKey).(string); !ok {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), routeKey, c.FullPath()))
+	}
+	return c.Request
+}
+
+// handlerWrapper wraps our handlerFunc into gin.HandlerFunc
+func handlerWrapper(db *sql.DB, f handlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f(c.Writer, ginRequest(c), db)
+	}
+}
+
+// middlewareWrapper wraps a net/http middleware into gin.HandlerFunc: the
+// chain goes on with the request the middleware passes to the next
+// handler, and stops if it doesn't call it, having responded
+func middlewareWrapper(mw func(http.Handler) http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		next := false
+		mw(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			next = true
+			c.Request = r
+			c.Next()
+		})).ServeHTTP(c.Writer, ginRequest(c))
+		if !next {
+			c.Abort()
+		}
+	}
+}
+
+// ginRoutes returns the routes registered with the gin router so far
+func ginRoutes(router *gin.Engine) []apiRoute {
+	var rslt []apiRoute
+	for _, r := range router.Routes() {
+		rslt = append(rslt, apiRoute{Method: r.Method, Path: r.Path})
+	}
+	return rslt
+}
+
+// routePattern returns the pattern of the route the request matched, with
+// its version prefix and the parameters like :trip_id, e.g.
+// /v1/trips/:trip_id, "" if it matched none
+func routePattern(r *http.Request) string {
+	pattern, _ := r.Context().Value(routeKey).(string)
+	return pattern
+}
+
+var (
+	// forwardedHeaders carry the IP address of the client, set by the
+	// proxies in front of the server
+	forwardedHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	// trustedProxies are the networks of the proxies whose forwarded
+	// headers are trusted, none by default
+	trustedProxies []net.IPNet
+)
+
+// clientIP returns the IP address of the client of the request: the first
+// one of the forwarded headers if the request comes from a trusted proxy,
+// or the remote address of the connection. Otherwise, a client could set
+// the headers itself, e.g. to dodge the quarantine of its bursts.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil || !slices.ContainsFunc(trustedProxies, func(n net.IPNet) bool { return n.Contains(remote) }) {
+		return host
+	}
+	for _, h := range forwardedHeaders {
+		v := r.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		ips := strings.Split(v, ",")
+		if !slices.ContainsFunc(ips, func(ip string) bool { return net.ParseIP(strings.TrimSpace(ip)) == nil }) {
+			return strings.TrimSpace(ips[0])
+		}
+	}
+	return host
+}
+
+// writeJSON sends the status and the JSON document of obj
+func writeJSON(w http.ResponseWriter, status int, obj any) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeData(w, status, "application/json; charset=utf-8", data)
+}
+
+// writeData sends the status and the data of the content type
+func writeData(w http.ResponseWriter, status int, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// defaultQuery returns the value of the parameter of the query, value if
+// it isn't given
+func defaultQuery(r *http.Request, key, value string) string {
+	if v, ok := r.URL.Query()[key]; ok {
+		return v[0]
+	}
+	return value
+}
+
+// negotiateFormat returns the first of the offered content types the
+// Accept header of the request accepts, the first one without the header,
+// "" if none is accepted
+func negotiateFormat(r *http.Request, offered ...string) string {
+	var accepted []string
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		part, _, _ = strings.Cut(part, ";")
+		if part = strings.TrimSpace(part); part != "" {
+			accepted = append(accepted, part)
+		}
+	}
+	if len(accepted) == 0 {
+		return offered[0]
+	}
+	for _, a := range accepted {
+		for _, o := range offered {
+			// a wildcard matches the rest, e.g. text/* or */*
+			i := 0
+			for ; i < len(a) && i < len(o); i++ {
+				if a[i] == '*' || o[i] == '*' {
+					return o
+				}
+				if a[i] != o[i] {
+					break
+				}
+			}
+			if i == len(a) {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+// payloadValidator validates the payloads by the "binding" tags of their
+// fields, see emails.go for the validations added
+var payloadValidator = func() *validator.Validate {
+	v := validator.New()
+	v.SetTagName("binding")
+	return v
+}()
+
+// decodeJSON decodes the JSON body into obj, the numbers of the untyped
+// fields as json.Number, and validates it
+func decodeJSON(r *http.Request, obj any) error {
+	if r.Body == nil {
+		return errors.New("invalid request")
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	err := dec.Decode(obj)
+	if err != nil {
+		return err
+	}
+	return validatePayload(obj)
+}
+
+// validatePayload validates a payload, a struct or the structs of a slice
+func validatePayload(obj any) error {
+	v := reflect.ValueOf(obj)
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Elem().Kind() != reflect.Struct {
+			return validatePayload(v.Elem().Interface())
+		}
+		return payloadValidator.Struct(obj)
+	case reflect.Struct:
+		return payloadValidator.Struct(obj)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			err := validatePayload(v.Index(i).Interface())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
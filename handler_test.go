@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/apierror"
+	"github.com/dvusboy/trip-accountant/trip"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The handlers and the middlewares are tested with http.ServeMux, as
+// plain net/http ones, without gin.
+
+const (
+	alice = "alice@test.com"
+	bob   = "bob@test.com"
+	eve   = "eve@test.com"
+)
+
+// openTestDB returns a database with the schema, closed with the test
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = trip.CreateSchema(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Failed to create the schema: %v", err)
+	}
+	return db
+}
+
+// withRootToken requires the tokens, as --root-token does, for the test
+func withRootToken(t *testing.T, secret string) {
+	old := rootToken
+	rootToken = secret
+	t.Cleanup(func() { rootToken = old })
+}
+
+// issueToken returns the secret of a token of the user, on the trip if
+// not 0, with the scope
+func issueToken(t *testing.T, db *sql.DB, email string, tripID int64, scope trip.Scope) string {
+	t.Helper()
+	ctx := context.Background()
+	usr, err := trip.LoadOrCreateUser(ctx, db, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := trip.IssueToken(ctx, db, usr, tripID, scope, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok.Secret
+}
+
+// handle adapts the handler to net/http
+func handle(db *sql.DB, f handlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f(w, r, db)
+	})
+}
+
+// withRoute sets the pattern of the route in the context of the requests,
+// as the router adapter does, see routePattern()
+func withRoute(pattern string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey, pattern)))
+	})
+}
+
+// do sends the request to the handler, with the bearer token if not empty,
+// and returns the response
+func do(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// errorCode returns the code of the error envelope of the response
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) apierror.Code {
+	t.Helper()
+	var env apierror.Envelope
+	err := json.Unmarshal(w.Body.Bytes(), &env)
+	if err != nil {
+		t.Fatalf("Failed to decode the error %q: %v", w.Body.String(), err)
+	}
+	return env.Code
+}
+
+// TestRequireScope checks the tokens are required with --root-token, and
+// grant their scope on the trips of their user only
+func TestRequireScope(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	tr := trip.NewTrip("Lisbon", alice, "", trip.NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := trip.NewTrip("Porto", eve, "", trip.NewDate(time.Now()), nil)
+	err = other.Save(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/trips/{trip_id}", requireScope(db, trip.ScopeRead)(handle(db, getTrip)))
+	mux.Handle("DELETE /v1/trips/{trip_id}", requireScope(db, trip.ScopeWrite)(handle(db, deleteTrip)))
+	path := "/v1/trips/" + strconv.FormatInt(tr.ID, 10)
+
+	// without --root-token, no token is required
+	w := do(mux, http.MethodGet, path, "", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("GET without tokens required = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	withRootToken(t, "root secret")
+	bobRead := issueToken(t, db, bob, 0, trip.ScopeRead)
+	bobOther := issueToken(t, db, bob, other.ID, trip.ScopeWrite)
+	eveWrite := issueToken(t, db, eve, 0, trip.ScopeWrite)
+	for _, c := range []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"no token", http.MethodGet, "", http.StatusUnauthorized},
+		{"unknown token", http.MethodGet, "not a token", http.StatusUnauthorized},
+		{"root token", http.MethodGet, "root secret", http.StatusOK},
+		{"participant reading", http.MethodGet, bobRead, http.StatusOK},
+		{"read token writing", http.MethodDelete, bobRead, http.StatusForbidden},
+		{"token of another trip", http.MethodGet, bobOther, http.StatusForbidden},
+		{"token of a stranger", http.MethodGet, eveWrite, http.StatusForbidden},
+	} {
+		w := do(mux, c.method, path, c.token, "")
+		if w.Code != c.status {
+			t.Errorf("%s: %s = %d, want %d: %s", c.name, c.method, w.Code, c.status, w.Body)
+		}
+	}
+}
+
+// TestActsFor checks a request acts for the user of its token only, unless
+// it's an admin one or the tokens aren't required
+func TestActsFor(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		tok   *trip.Token
+		email string
+		want  bool
+	}{
+		{"no token", nil, bob, true},
+		{"admin", &trip.Token{Scope: trip.ScopeAdmin}, bob, true},
+		{"own token", &trip.Token{Email: bob, Scope: trip.ScopeRead}, "Bob@Test.com", true},
+		{"other user", &trip.Token{Email: eve, Scope: trip.ScopeWrite}, bob, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/v1/users/"+c.email, nil)
+		if c.tok != nil {
+			r = r.WithContext(context.WithValue(r.Context(), tokenKey, c.tok))
+		}
+		if got := actsFor(r, c.email); got != c.want {
+			t.Errorf("%s: actsFor(%s) = %v, want %v", c.name, c.email, got, c.want)
+		}
+	}
+
+	// the spend caps of a user are theirs only
+	db := openTestDB(t)
+	withRootToken(t, "root secret")
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/users/{email}/caps", requireScope(db, trip.ScopeRead)(handle(db, getSpendCaps)))
+	bobRead := issueToken(t, db, bob, 0, trip.ScopeRead)
+	eveRead := issueToken(t, db, eve, 0, trip.ScopeRead)
+	w := do(mux, http.MethodGet, "/v1/users/"+bob+"/caps", bobRead, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("GET of the own caps = %d, want 200: %s", w.Code, w.Body)
+	}
+	w = do(mux, http.MethodGet, "/v1/users/"+bob+"/caps", eveRead, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("GET of the caps of another user = %d, want 403: %s", w.Code, w.Body)
+	}
+}
+
+// TestBodyLimit checks the bodies larger than the limit of their route are
+// refused, announced or not
+func TestBodyLimit(t *testing.T) {
+	oldMax, oldAvatar := maxBodySize, maxAvatarSize
+	maxBodySize, maxAvatarSize = 16, 64
+	t.Cleanup(func() { maxBodySize, maxAvatarSize = oldMax, oldAvatar })
+
+	called := false
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		var v map[string]any
+		err := decodeJSON(r, &v)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	small := `{"a":"b"}`
+	large := `{"a":"` + strings.Repeat("b", 32) + `"}`
+	for _, c := range []struct {
+		name    string
+		route   string
+		body    string
+		chunked bool
+		status  int
+		called  bool
+	}{
+		{"small", "/v1/trips", small, false, http.StatusNoContent, true},
+		{"announced larger", "/v1/trips", large, false, http.StatusRequestEntityTooLarge, false},
+		{"read past the limit", "/v1/trips", large, true, http.StatusRequestEntityTooLarge, true},
+		{"larger limit of the route", "/v1/users/:email/avatar", large, false, http.StatusNoContent, true},
+	} {
+		called = false
+		method := http.MethodPost
+		if strings.HasSuffix(c.route, "/avatar") {
+			method = http.MethodPut
+		}
+		r := httptest.NewRequest(method, "/", strings.NewReader(c.body))
+		if c.chunked {
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		withRoute(c.route, bodyLimit(echo)).ServeHTTP(w, r)
+		if w.Code != c.status || called != c.called {
+			t.Errorf("%s: status %d, handler called %v, want %d, %v: %s", c.name, w.Code, called, c.status, c.called, w.Body)
+		}
+	}
+}
+
+// TestVersionNegotiation checks the requests without a version are routed
+// to the one of Accept-Version, v1 by default
+func TestVersionNegotiation(t *testing.T) {
+	var path string
+	h := versionNegotiation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, c := range []struct {
+		name    string
+		path    string
+		accept  string
+		status  int
+		routed  string
+		version string
+	}{
+		{"prefixed", "/v1/trips/1", "", http.StatusNoContent, "/v1/trips/1", "v1"},
+		{"prefix over the header", "/v1/trips/1", "v9", http.StatusNoContent, "/v1/trips/1", "v1"},
+		{"default", "/trips/1", "", http.StatusNoContent, "/v1/trips/1", "v1"},
+		{"header", "/trips/1", "v1", http.StatusNoContent, "/v1/trips/1", "v1"},
+		{"unsupported", "/trips/1", "v9", http.StatusBadRequest, "", ""},
+	} {
+		path = ""
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.accept != "" {
+			r.Header.Set(acceptVersionHeader, c.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.status || path != c.routed || w.Header().Get(apiVersionHeader) != c.version {
+			t.Errorf("%s: status %d, routed to %q, version %q, want %d, %q, %q",
+				c.name, w.Code, path, w.Header().Get(apiVersionHeader), c.status, c.routed, c.version)
+		}
+		if c.status == http.StatusBadRequest && errorCode(t, w) != apierror.UnsupportedVersion {
+			t.Errorf("%s: expected the code %s, got %s", c.name, apierror.UnsupportedVersion, w.Body)
+		}
+	}
+}
+
+// TestPatchTripContentType checks a trip is only patched with a JSON Patch
+// document sent as such
+func TestPatchTripContentType(t *testing.T) {
+	db := openTestDB(t)
+	tr := trip.NewTrip("Lisbon", alice, "", trip.NewDate(time.Now()), []string{bob})
+	err := tr.Save(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("PATCH /v1/trips/{trip_id}", handle(db, patchTrip))
+	path := "/v1/trips/" + strconv.FormatInt(tr.ID, 10)
+	for _, c := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"application/merge-patch+json", `{"name":"Porto"}`, http.StatusUnsupportedMediaType},
+		{"application/json", `[{"op":"replace","path":"/name","value":"Porto"}]`, http.StatusUnsupportedMediaType},
+		{"", `[{"op":"replace","path":"/name","value":"Porto"}]`, http.StatusUnsupportedMediaType},
+		{"application/json-patch+json; charset=utf-8", `[{"op":"replace","path":"/name","value":"Porto"}]`, http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPatch, path, strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("PATCH as %q = %d, want %d: %s", c.contentType, w.Code, c.status, w.Body)
+		}
+		if c.status == http.StatusUnsupportedMediaType && errorCode(t, w) != apierror.UnsupportedMedia {
+			t.Errorf("PATCH as %q: expected the code %s, got %s", c.contentType, apierror.UnsupportedMedia, w.Body)
+		}
+	}
+}
+
+// TestGetReviews checks the review queue of a trip missing or deleted
+// isn't served as an empty one
+func TestGetReviews(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	tr := trip.NewTrip("Lisbon", alice, "", trip.NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/trips/{trip_id}/reviews", handle(db, getReviews))
+	path := "/v1/trips/" + strconv.FormatInt(tr.ID, 10) + "/reviews"
+	w := do(mux, http.MethodGet, path, "", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("GET of an empty queue = %d %s, want 200 []", w.Code, w.Body)
+	}
+	w = do(mux, http.MethodGet, "/v1/trips/999/reviews", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of the queue of a missing trip = %d, want 404: %s", w.Code, w.Body)
+	}
+	err = trip.DeleteTrip(ctx, db, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = do(mux, http.MethodGet, path, "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of the queue of a deleted trip = %d, want 404: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// inboundNonces are the nonces of the requests of all the inbound
+// integrations, each keyed by its source
+var inboundNonces = trip.NewNonceCache()
+
+// verifyInbound returns the middleware guarding the routes of an inbound
+// integration, e.g. the commands of Slack, before their handler: the
+// signature of the request is verified with the verifier, its timestamp
+// must be within the tolerance, and it must not have been received
+// already. The connectors mount it rather than verifying the requests
+// themselves, e.g.
+//
+//	v1.POST("/inbound/slack", middlewareWrapper(verifyInbound("slack", trip.SlackVerifier{SigningSecret: secret})), ...)
+//
+// The body is read for the signature, and restored for the handler.
+func verifyInbound(source string, v trip.InboundVerifier) func(http.Handler) http.Handler {
+	g := &trip.InboundGuard{Source: source, Verifier: v, Nonces: inboundNonces}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				jsonBail(w, r, http.StatusBadRequest, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			err = g.Check(r.Header, body)
+			switch {
+			case err == trip.ErrInboundReplay:
+				jsonBail(w, r, http.StatusConflict, err)
+				return
+			case err != nil:
+				jsonBail(w, r, http.StatusUnauthorized, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
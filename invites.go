@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/apierror"
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// inviteTTL is how long an invite to join a trip is valid by default
+var inviteTTL = 7 * 24 * time.Hour
+
+// errNoInvites is returned when inviting without --jwt-key
+var errNoInvites = errors.New("invites aren't enabled on this server")
+
+// inviteJSON is used for POST to invite to join a trip
+type inviteJSON struct {
+	// ExpiresIn is the lifetime of the invite in seconds, --invite-ttl if 0
+	ExpiresIn int64 `json:"expires_in" binding:"min=0"`
+}
+
+// joinJSON is used for POST to join a trip with an invite
+type joinJSON struct {
+	// Email is the user joining, the one of the token if empty
+	Email string `json:"email" binding:"omitempty,email_address"`
+}
+
+// inviteLinkJSON is the invite returned, with the URL to join with
+type inviteLinkJSON struct {
+	*trip.Invite
+	JoinURL string `json:"join_url"`
+}
+
+// postInvite returns a signed invite to join a trip, for the owner only
+func postInvite(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errNoInvites)
+		return
+	}
+	var ij inviteJSON
+	// the payload is optional
+	if r.ContentLength != 0 {
+		err := bindJSON(r, &ij)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	t, ok := loadOwnedTrip(w, r, db, "invite to join it")
+	if !ok {
+		return
+	}
+	ttl := inviteTTL
+	if ij.ExpiresIn > 0 {
+		ttl = time.Duration(ij.ExpiresIn) * time.Second
+	}
+	inv, err := t.IssueInvite(requestContext(r), "", ttl)
+	switch {
+	case err == trip.ErrTripCompleted:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, inviteLinkJSON{inv, serverURL(r) + "/v1/join/" + inv.Token})
+}
+
+// postJoin adds the authenticated user, or the one given by an admin, to
+// the trip of the invite
+func postJoin(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errNoInvites)
+		return
+	}
+	var jj joinJSON
+	if r.ContentLength != 0 {
+		err := bindJSON(r, &jj)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	email := jj.Email
+	if tok := requestToken(r); tok != nil && email == "" {
+		email = tok.Email
+	}
+	if email != "" && !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("the invite can only be used for yourself"))
+		return
+	}
+	joinTrip(w, r, db, email)
+}
+
+// getJoin adds the user an invite is addressed to, to its trip, the link
+// mailed to them being the proof
+func getJoin(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errNoInvites)
+		return
+	}
+	inv, err := trip.ParseInvite(r.PathValue("token"))
+	if err == nil && inv.Email == "" {
+		jsonBail(w, r, http.StatusUnauthorized, errors.New("the invite isn't addressed to a user, it's used with a POST and a token"))
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	joinTrip(w, r, db, "")
+}
+
+// joinTrip adds the user of the email address, the one the invite of the
+// path is addressed to if empty, to its trip
+func joinTrip(w http.ResponseWriter, r *http.Request, db *sql.DB, email string) {
+	t, err := trip.JoinTrip(requestContext(r), db, r.PathValue("token"), email)
+	switch {
+	case err == trip.ErrInvalidInvite:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	case err == trip.ErrInviteAddressed:
+		jsonBail(w, r, http.StatusForbidden, err)
+		return
+	case err == trip.ErrTokenExpired:
+		jsonBail(w, r, http.StatusGone, err)
+		return
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, apierror.New(apierror.TripNotFound, err))
+		return
+	case err == trip.ErrTripCompleted || err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, t)
+}
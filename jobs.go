@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+const (
+	// jobQueueSize is the number of jobs that can wait for the worker
+	jobQueueSize = 16
+	// jobsKept is the number of finished jobs kept for their status
+	jobsKept = 100
+	// jobErrorsKept is the number of errors kept in the status of a job
+	jobErrorsKept = 20
+)
+
+// The status of a job
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// errJobQueueFull is returned when submitting a job to a full queue
+var errJobQueueFull = errors.New("too many jobs queued, retry later")
+
+// job is a long running task, run in the background by the jobQueue
+type job struct {
+	ID     int64  `json:"job_id"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	// Total is the number of items to process, once known
+	Total int `json:"total"`
+	// Processed is the number of items processed, including the failed
+	// ones
+	Processed int `json:"processed"`
+	Failed    int `json:"failed"`
+	// Errors are the first errors of the items, and the error of the job
+	// if it failed
+	Errors     []string   `json:"errors"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// HasResult is set if the job produced a result to download
+	HasResult bool `json:"has_result"`
+	// ctx is the context of the job, carrying the ID of the request
+	// submitting it
+	ctx context.Context
+	// run does the work, reporting its progress to the jobQueue
+	run func(ctx context.Context, q *jobQueue, j *job) ([]byte, error)
+	// result is the output of the job, if any
+	result []byte
+}
+
+// jobQueue runs the jobs one at a time, in the order they were
+// submitted, and keeps their status. The jobs are only kept in memory, a
+// restart of the server loses them.
+type jobQueue struct {
+	mu       sync.Mutex
+	lastID   int64
+	jobs     map[int64]*job
+	finished []int64
+	pending  chan *job
+}
+
+// newJobQueue returns a jobQueue with its worker running
+func newJobQueue() *jobQueue {
+	q := &jobQueue{
+		jobs:    make(map[int64]*job),
+		pending: make(chan *job, jobQueueSize),
+	}
+	go q.work()
+	return q
+}
+
+// submit queues a job, errJobQueueFull is returned if the queue is full
+func (q *jobQueue) submit(ctx context.Context, kind string, run func(ctx context.Context, q *jobQueue, j *job) ([]byte, error)) (job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.lastID++
+	j := &job{
+		ID:        q.lastID,
+		Kind:      kind,
+		Status:    jobQueued,
+		Errors:    []string{},
+		CreatedAt: trip.Now().UTC(),
+		ctx:       ctx,
+		run:       run,
+	}
+	select {
+	case q.pending <- j:
+	default:
+		return job{}, errJobQueueFull
+	}
+	q.jobs[j.ID] = j
+	return *j, nil
+}
+
+// get returns a copy of the job, false if it's unknown
+func (q *jobQueue) get(id int64) (job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	rslt := *j
+	rslt.Errors = append([]string{}, j.Errors...)
+	return rslt, true
+}
+
+// setTotal reports the number of items the job is processing
+func (q *jobQueue) setTotal(j *job, total int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j.Total = total
+}
+
+// step reports an item processed by the job, err is the failure of the
+// item, if any
+func (q *jobQueue) step(j *job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j.Processed++
+	if err != nil {
+		j.Failed++
+		if len(j.Errors) < jobErrorsKept {
+			j.Errors = append(j.Errors, err.Error())
+		}
+	}
+}
+
+// work runs the queued jobs until the process ends
+func (q *jobQueue) work() {
+	for j := range q.pending {
+		q.mu.Lock()
+		now := trip.Now().UTC()
+		j.Status = jobRunning
+		j.StartedAt = &now
+		q.mu.Unlock()
+
+		result, err := j.run(j.ctx, q, j)
+
+		q.mu.Lock()
+		now = trip.Now().UTC()
+		j.FinishedAt = &now
+		j.Status = jobDone
+		if err != nil {
+			j.Status = jobFailed
+			j.Errors = append(j.Errors, err.Error())
+		}
+		j.result = result
+		j.HasResult = result != nil
+		j.ctx, j.run = nil, nil
+		q.finished = append(q.finished, j.ID)
+		if len(q.finished) > jobsKept {
+			delete(q.jobs, q.finished[0])
+			q.finished = q.finished[1:]
+		}
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// getUserBalances returns what remains to be paid between a user and the
+// other people across all their trips, netted by person
+func getUserBalances(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can get the balances of their trips", email))
+		return
+	}
+	ledger, err := trip.LoadLedger(requestContext(r), db, email)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ledger)
+}
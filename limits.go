@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// maxBodySize is the maximum size, in bytes, of a request body
+	maxBodySize int64 = 1 << 20
+	// readTimeout is the time allowed to read a request, body included
+	readTimeout = 30 * time.Second
+	// writeTimeout is the time allowed to handle a request and write the
+	// response, from the end of its headers
+	writeTimeout = 60 * time.Second
+	// idleTimeout is how long an idle keep-alive connection is kept
+	idleTimeout = 120 * time.Second
+)
+
+// bodyLimits are the maximum sizes of the bodies of the routes taking
+// larger ones than maxBodySize, by route as in apiDocs
+var bodyLimits = map[string]*int64{
+	"POST /trips/:trip_id/expenses/:expense_id/receipts":    &maxReceiptSize,
+	"POST /trips/:trip_id/expenses/draft":                   &maxReceiptSize,
+	"POST /trips/:trip_id/expenses/:expense_id/voice-notes": &maxVoiceNoteSize,
+	"POST /trips/:trip_id/expenses/draft/voice":             &maxVoiceNoteSize,
+	"PUT /users/:email/avatar":                              &maxAvatarSize,
+}
+
+// newServer returns the HTTP server of the handler, with the timeouts
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// bodyLimit is the middleware limiting the size of the request bodies to
+// maxBodySize, or to the one of the route in bodyLimits. A body announced
+// larger is refused straight away, the others fail to be read past the
+// limit, see limitStatus().
+func bodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := maxBodySize
+		// the route is keyed without its version prefix
+		_, route, _ := strings.Cut(strings.TrimPrefix(routePattern(r), "/"), "/")
+		if l, ok := bodyLimits[r.Method+" /"+route]; ok {
+			limit = *l
+		}
+		if r.ContentLength > limit {
+			jsonBail(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", limit))
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitStatus returns the status, and the error reported, of an error
+// reading the request body: 413 past the maximum size and 408 past the
+// read timeout. The other errors are returned with the given status.
+func limitStatus(status int, err error) (int, error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", tooLarge.Limit)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return http.StatusRequestTimeout, fmt.Errorf("request not received within %v", readTimeout)
+	}
+	return status, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// jwtKey signs the session tokens, the users can't log in if empty
+	jwtKey string
+	// sessionTTL is how long a session token is valid
+	sessionTTL = 24 * time.Hour
+)
+
+// errNoSessions is returned when logging in without --jwt-key
+var errNoSessions = errors.New("logging in isn't enabled on this server")
+
+// loginJSON is used for POST to log in
+type loginJSON struct {
+	Email string `json:"email" binding:"required,email_address"`
+}
+
+// sessionJSON is the session token returned when logging in
+type sessionJSON struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	User        string    `json:"user"`
+}
+
+// postLogin mails a link to log in to the user of the email address,
+// creating them if unknown
+func postLogin(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errNoSessions)
+		return
+	}
+	var l loginJSON
+	err := bindJSON(r, &l)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	v, err := trip.IssueLogin(ctx, db, l.Email, verificationTTL)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	link := serverURL(r) + "/v1/login?token=" + url.QueryEscape(v.Secret)
+	body := fmt.Sprintf("Please follow this link to log in to %s:\r\n\r\n%s\r\n\r\nThe link expires at %s.\r\n",
+		instanceName, link, v.ExpiresAt.Format(time.RFC1123))
+	err = sendMail(ctx, v.Email, "Log in to "+instanceName, body)
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to mail the login of %s: %v\n", v.Email, err)
+		jsonBail(w, r, http.StatusServiceUnavailable, errors.New("failed to send the login email"))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, v)
+}
+
+// getLogin returns a session token for the user the link was mailed to,
+// the secret of the link being the proof
+func getLogin(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errNoSessions)
+		return
+	}
+	secret := r.URL.Query().Get("token")
+	if secret == "" {
+		jsonBail(w, r, http.StatusBadRequest, errors.New("missing token"))
+		return
+	}
+	token, s, err := trip.Login(requestContext(r), db, secret, sessionTTL)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, errors.New("unknown login link"))
+		return
+	case err == trip.ErrVerificationExpired:
+		jsonBail(w, r, http.StatusGone, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	writeJSON(w, http.StatusOK, sessionJSON{AccessToken: token, TokenType: "Bearer", ExpiresAt: s.ExpiresAt, User: s.Email})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// smtpAddr is the host:port of the SMTP server sending the emails, the
+	// emails are only logged if empty
+	smtpAddr string
+	// smtpUser and smtpPassword authenticate to the SMTP server, with PLAIN,
+	// if smtpUser is set
+	smtpUser     string
+	smtpPassword string
+	// smtpFrom is the sender of the emails
+	smtpFrom = "trip-accountant@localhost"
+	// mailInvitations is for flag --mail-invitations, to mail the
+	// participants added to a trip an invitation to join it
+	mailInvitations = true
+)
+
+// invitationData is what the invitation emails are rendered with
+type invitationData struct {
+	TripName    string
+	Owner       string
+	StartDate   string
+	Description string
+	JoinURL     string
+	ExpiresAt   string
+	Brand       metaJSON
+}
+
+// invitationSubjectTmpl, invitationTextTmpl and invitationHTMLTmpl are the
+// subject, plain text and HTML bodies of the invitation emails
+var (
+	invitationSubjectTmpl = template.Must(template.New("subject").Parse(
+		`{{.Owner}} invited you to {{.TripName}}`))
+	invitationTextTmpl = template.Must(template.New("text").Parse(`{{.Owner}} invited you to the trip "{{.TripName}}", starting on {{.StartDate}}.
+{{- if .Description}}
+
+{{.Description}}
+{{- end}}
+
+Please follow this link to join the trip, and share its expenses:
+
+{{.JoinURL}}
+
+The link expires at {{.ExpiresAt}}.
+
+-- 
+{{.Brand.Name}}
+`))
+	invitationHTMLTmpl = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Owner}} invited you to {{.TripName}}</title>
+</head>
+<body style="font-family: sans-serif; max-width: 36em;">
+<div style="background: {{.Brand.Colors.Accent}}; padding: 0.5em 1em;">
+{{- if .Brand.LogoURL}}
+<img src="{{.Brand.LogoURL}}" alt="" height="32" style="vertical-align: middle;">
+{{- end}}
+<strong style="color: {{.Brand.Colors.Primary}};">{{.Brand.Name}}</strong>
+</div>
+<p>{{.Owner}} invited you to the trip <strong>{{.TripName}}</strong>, starting on {{.StartDate}}.</p>
+{{- if .Description}}
+<blockquote>{{.Description}}</blockquote>
+{{- end}}
+<p><a href="{{.JoinURL}}" style="color: {{.Brand.Colors.Primary}};">Join the trip</a> to share its expenses.</p>
+<p style="color: #666; font-size: 0.9em;">The link expires at {{.ExpiresAt}}.</p>
+</body>
+</html>
+`))
+)
+
+// sendMail sends a plain text email with the SMTP server of smtpAddr, or
+// logs it if there's none, e.g. in development
+func sendMail(ctx context.Context, to, subject, body string) error {
+	return sendAlternativeMail(ctx, to, subject, body, "")
+}
+
+// sendAlternativeMail sends an email with both a plain text and an HTML
+// body, the HTML one being left out if empty, with the SMTP server of
+// smtpAddr, or logs its plain text if there's none
+func sendAlternativeMail(ctx context.Context, to, subject, text, html string) error {
+	if smtpAddr == "" {
+		trip.Logf(ctx, "No SMTP server, email to %s: %s\n%s\n", to, subject, text)
+		return nil
+	}
+	var auth smtp.Auth
+	if smtpUser != "" {
+		host, _, err := net.SplitHostPort(smtpAddr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", smtpUser, smtpPassword, host)
+	}
+	headers := []string{
+		"From: " + smtpFrom,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + trip.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+	}
+	var body string
+	if html == "" {
+		headers = append(headers, "Content-Type: text/plain; charset=utf-8", "Content-Transfer-Encoding: quoted-printable")
+		body = quotedPrintable(text)
+	} else {
+		b := make([]byte, 12)
+		_, err := rand.Read(b)
+		if err != nil {
+			return err
+		}
+		boundary := "trip-accountant-" + hex.EncodeToString(b)
+		headers = append(headers, `Content-Type: multipart/alternative; boundary="`+boundary+`"`)
+		// the last part is the preferred one
+		body = strings.Join([]string{
+			"--" + boundary,
+			"Content-Type: text/plain; charset=utf-8",
+			"Content-Transfer-Encoding: quoted-printable",
+			"",
+			quotedPrintable(text),
+			"--" + boundary,
+			"Content-Type: text/html; charset=utf-8",
+			"Content-Transfer-Encoding: quoted-printable",
+			"",
+			quotedPrintable(html),
+			"--" + boundary + "--",
+		}, "\r\n")
+	}
+	msg := strings.Join(headers, "\r\n") + "\r\n\r\n" + body
+	return smtp.SendMail(smtpAddr, auth, smtpFrom, []string{to}, []byte(msg))
+}
+
+// quotedPrintable returns the text encoded in quoted-printable, with CRLF
+// line endings, so that no line is too long for SMTP
+func quotedPrintable(text string) string {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(text))
+	w.Close()
+	return buf.String()
+}
+
+// mailInvitation mails the participants of the email addresses, added to
+// the trip, an invitation with a link to join it. The invitations are sent
+// in the background, and the failures only logged, so that they don't hold
+// the request. They're only sent when the invites are enabled, see
+// postInvite().
+func mailInvitation(r *http.Request, t *trip.Trip, emails []string) {
+	if !mailInvitations || !trip.SessionsEnabled() || len(emails) == 0 {
+		return
+	}
+	ctx := context.WithoutCancel(requestContext(r))
+	base := serverURL(r)
+	owner := t.Owner.Email
+	if t.Owner.DisplayName != "" {
+		owner = t.Owner.DisplayName
+	}
+	go func() {
+		for _, email := range emails {
+			if email == t.Owner.Email {
+				continue
+			}
+			inv, err := t.IssueInvite(ctx, email, inviteTTL)
+			if err != nil {
+				trip.Logf(ctx, "ERROR: failed to invite %s to trip %d: %v\n", email, t.ID, err)
+				continue
+			}
+			data := invitationData{
+				TripName:    t.Name,
+				Owner:       owner,
+				StartDate:   t.StartDate.Format(time.DateOnly),
+				Description: t.Description,
+				JoinURL:     base + "/v1/join/" + inv.Token,
+				ExpiresAt:   inv.ExpiresAt.Format(time.RFC1123),
+				Brand:       branding(),
+			}
+			var subject, text, html strings.Builder
+			err = invitationSubjectTmpl.Execute(&subject, data)
+			if err == nil {
+				err = invitationTextTmpl.Execute(&text, data)
+			}
+			if err == nil {
+				err = invitationHTMLTmpl.Execute(&html, data)
+			}
+			if err == nil {
+				err = sendAlternativeMail(ctx, email, subject.String(), text.String(), html.String())
+			}
+			if err != nil {
+				trip.Logf(ctx, "ERROR: failed to mail the invitation of %s to trip %d: %v\n", email, t.ID, err)
+			}
+		}
+	}()
+}
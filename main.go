@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/dvusboy/trip-accountant/apierror"
 	"github.com/dvusboy/trip-accountant/trip"
 	"github.com/gin-gonic/gin"
 	_ "github.com/mattn/go-sqlite3"
@@ -26,6 +35,53 @@ var (
 	dbURL = "sqlite3:///srv/trip-accountant/data/trips.db"
 	// port is the listening port, defaults to 8081
 	port = 8081
+	// auditKey is the key used to sign the audit exports
+	auditKey string
+	// instanceKey is the key of the instance signing the settlements of
+	// the completed trips
+	instanceKey string
+	// rootToken is a static token with the admin scope on all trips, API
+	// tokens are only required when it's set
+	rootToken string
+	// slowQuery is the duration above which the queries are logged, 0 disables the log
+	slowQuery time.Duration
+	// tablePrefix is for storing flag --table-prefix, the prefix of the
+	// names of the tables
+	tablePrefix string
+	// rebuildBalances is for flag --rebuild-balances, to recompute the
+	// running balances of all trips at startup
+	rebuildBalances bool
+	// devMode is for flag --dev, see setupDev()
+	devMode bool
+	// allowDomains are the only email domains new users can have, if set
+	allowDomains []string
+	// blockDomains are the email domains new users can't have
+	blockDomains []string
+	// blockDomainsFile is a file listing more domains to block, one per
+	// line, e.g. a list of disposable email domains
+	blockDomainsFile string
+	// maxDescription is the maximum length, in characters, of an expense description
+	maxDescription = 511
+	// maxNotes is the maximum length, in characters, of the notes of an expense
+	maxNotes = 8192
+	// maxMetadata is the maximum size, in bytes, of the metadata of an
+	// expense in JSON
+	maxMetadata = 2048
+)
+
+const (
+	// auditPageSize is the default number of events in a page of the audit export
+	auditPageSize = 100
+	// auditMaxPageSize is the maximum number of events in a page of the audit export
+	auditMaxPageSize = 1000
+	// listMaxPageSize is the maximum number of items in a page of the trip
+	// and expense listings
+	listMaxPageSize = 1000
+	// devClockStart is the time the fake clock of the development mode
+	// starts at
+	devClockStart = "2023-03-01T09:00:00Z"
+	// mimeXLSX is the content type of the XLSX workbooks
+	mimeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
 )
 
 // tripJSON is used for POST to create trips
@@ -33,10 +89,32 @@ var (
 // to handle them.
 type tripJSON struct {
 	Name         string   `json:"name" binding:"required,max=127"`
-	Owner        string   `json:"owner" binding:"required"`
+	Owner        string   `json:"owner" binding:"required,email_address"`
 	StartDate    string   `json:"start_date" binding:"required"`
 	Description  string   `json:"description" binding:"required,max=511"`
-	Participants []string `json:"participants" binding:"required"`
+	Participants []string `json:"participants" binding:"required_without=Group,dive,email_address"`
+	// Group is the name of a friend group of the owner, whose members are
+	// added to the participants
+	Group string `json:"group" binding:"max=127"`
+}
+
+// addGroup adds the members of the friend group of the owner to the
+// participants, ErrNoGroup is returned if the owner has no such group
+func (t *tripJSON) addGroup(ctx context.Context, db *sql.DB) error {
+	g, err := trip.LoadGroup(ctx, db, t.Owner, t.Group)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(t.Participants))
+	for _, email := range t.Participants {
+		listed[email] = true
+	}
+	for _, email := range g.Members {
+		if !listed[email] && email != t.Owner {
+			t.Participants = append(t.Participants, email)
+		}
+	}
+	return nil
 }
 
 // Translate maps a tripJSON instance into Trip instance
@@ -49,10 +127,29 @@ func (t tripJSON) Translate() (*trip.Trip, error) {
 }
 
 // expenseJSON is used for POST to create expense of a trip
+// The participants are either given with what each paid, or with PaidBy,
+// Amount and SplitAmong for the common case of a single payer.
 type expenseJSON struct {
 	Date         string         `json:"date" binding:"required"`
 	Description  string         `json:"description" binding:"required"`
-	Participants map[string]int `json:"participants" binding:"required"`
+	Participants map[string]int `json:"participants" binding:"dive,keys,email_address,endkeys"`
+	// PaidBy is the email address of the single payer of the expense
+	PaidBy string `json:"paid_by" binding:"omitempty,email_address"`
+	// Amount is the amount paid by PaidBy, in cent
+	Amount int `json:"amount" binding:"min=0"`
+	// SplitAmong are the email addresses of the participants sharing the
+	// expense, including PaidBy
+	SplitAmong []string `json:"split_among" binding:"dive,email_address"`
+	// Category replaces SplitAmong with the participants sharing the
+	// category according to the cost questionnaire, see defaultSplit()
+	Category string `json:"category"`
+	// Notes is a longer text about the expense, in markdown
+	Notes string `json:"notes"`
+	// Metadata are key/value pairs of an integration, passed through
+	Metadata map[string]string `json:"metadata"`
+	// AddToTrip adds participants not yet part of the trip, creating
+	// (unverified) users if necessary
+	AddToTrip bool `json:"add_to_trip"`
 }
 
 // Translate maps a expenseJSON into Expense
@@ -61,11 +158,46 @@ func (e expenseJSON) Translate() (*trip.Expense, error) {
 	if err != nil {
 		return nil, err
 	}
+	if utf8.RuneCountInString(e.Description) > maxDescription {
+		return nil, fmt.Errorf("description is longer than %d characters", maxDescription)
+	}
+	if utf8.RuneCountInString(e.Notes) > maxNotes {
+		return nil, fmt.Errorf("notes are longer than %d characters", maxNotes)
+	}
+	if _, ok := e.Metadata[""]; ok {
+		return nil, errors.New("metadata keys can't be empty")
+	}
+	if md, _ := json.Marshal(e.Metadata); len(e.Metadata) > 0 && len(md) > maxMetadata {
+		return nil, fmt.Errorf("metadata is larger than %d bytes", maxMetadata)
+	}
 	r := new(trip.Expense)
 	r.Date = trip.NewDate(sd)
 	r.Description = e.Description
+	r.SetNotes(e.Notes)
+	r.Metadata = e.Metadata
+	if _, ok := e.Metadata[trip.CategoryKey]; e.Category != "" && !ok {
+		// the category is kept for the summaries of the webhook events
+		r.Metadata = make(map[string]string, len(e.Metadata)+1)
+		for k, v := range e.Metadata {
+			r.Metadata[k] = v
+		}
+		r.Metadata[trip.CategoryKey] = strings.ToLower(e.Category)
+	}
+	participants := e.Participants
+	switch {
+	case e.PaidBy != "":
+		if len(e.Participants) > 0 {
+			return nil, errors.New("participants can't be given with paid_by")
+		}
+		participants, err = e.expand()
+		if err != nil {
+			return nil, err
+		}
+	case len(e.Participants) == 0:
+		return nil, errors.New("either participants or paid_by is required")
+	}
 	r.Participants = []trip.Participant{}
-	for email, paid := range e.Participants {
+	for email, paid := range participants {
 		p := trip.Participant{
 			Email:  email,
 			UserID: 0,
@@ -76,188 +208,2481 @@ func (e expenseJSON) Translate() (*trip.Expense, error) {
 	return r, nil
 }
 
+// expand maps PaidBy, Amount and SplitAmong into the participants of the
+// expense with what each paid
+func (e expenseJSON) expand() (map[string]int, error) {
+	if e.Amount <= 0 {
+		return nil, errors.New("amount is required with paid_by")
+	}
+	rslt := make(map[string]int, len(e.SplitAmong))
+	for _, email := range e.SplitAmong {
+		rslt[strings.ToLower(email)] = 0
+	}
+	payer := strings.ToLower(e.PaidBy)
+	if _, ok := rslt[payer]; !ok {
+		// the expenses are split equally among all their participants
+		return nil, fmt.Errorf("paid_by %s must be one of split_among", e.PaidBy)
+	}
+	rslt[payer] = e.Amount
+	return rslt, nil
+}
+
+// participantsJSON is used for POST to add participants to a trip
+type participantsJSON struct {
+	Participants []string `json:"participants" binding:"required,min=1,dive,email_address"`
+}
+
+// rsvpJSON is used for PUT to answer the invitation to a trip
+type rsvpJSON struct {
+	RSVP string `json:"rsvp" binding:"required,oneof=invited accepted declined"`
+}
+
+// reassignJSON is used for POST to reassign the shares of a participant
+// removed, to the other participants of each expense without a target
+type reassignJSON struct {
+	To string `json:"to" binding:"omitempty,email_address"`
+}
+
+// forbiddenJSON is used for PUT to set the forbidden transfers of a trip
+type forbiddenJSON struct {
+	Transfers []trip.TransferPair `json:"transfers" binding:"required,dive"`
+}
+
+// householdsJSON is used for PUT to set the households of the people of a
+// trip, by email address
+type householdsJSON struct {
+	Households map[string]string `json:"households" binding:"required"`
+}
+
+// organizerFeeJSON is used for PUT to set the organizer fee of a trip
+type organizerFeeJSON struct {
+	Amount *int `json:"amount" binding:"required,min=0"`
+}
+
+// approvalRequiredJSON is used for PUT to require the approval of the
+// expenses of a trip before its settlement is final
+type approvalRequiredJSON struct {
+	Required *bool `json:"required" binding:"required"`
+}
+
+// delegationJSON is used for PUT to delegate the approvals of the owner of
+// a trip to a co-treasurer
+type delegationJSON struct {
+	Delegate  string `json:"delegate" binding:"required,email_address"`
+	Threshold *int   `json:"threshold" binding:"required,min=0"`
+	// ExpiresIn is the lifetime of the delegation in seconds
+	ExpiresIn int64 `json:"expires_in" binding:"required,min=1"`
+}
+
+// userPatchJSON is used for PATCH to update the profile of a user
+type userPatchJSON struct {
+	DisplayName *string `json:"display_name" binding:"required"`
+}
+
+// spendCapJSON is used for PUT to set a spend cap of a user
+type spendCapJSON struct {
+	TripID int64 `json:"trip_id"`
+	Amount *int  `json:"amount" binding:"required,min=0"`
+}
+
 // init sets up the CLI flags
 func init() {
 	flag.IntVar(&port, "port", port, "bind port")
 	flag.StringVar(&dbURL, "db", dbURL, "database URL")
+	flag.IntVar(&maxDescription, "max-description", maxDescription, "maximum length of an expense description")
+	flag.IntVar(&maxNotes, "max-notes", maxNotes, "maximum length of the notes of an expense")
+	flag.StringVar(&receiptsDir, "receipts-dir", receiptsDir, "directory the receipt files are stored in")
+	flag.Int64Var(&maxReceiptSize, "max-receipt-size", maxReceiptSize, "maximum size of the upload of a receipt in bytes")
+	flag.StringVar(&avatarsDir, "avatars-dir", avatarsDir, "directory the avatar files are stored in")
+	flag.Int64Var(&maxAvatarSize, "max-avatar-size", maxAvatarSize, "maximum size of the upload of an avatar in bytes")
+	flag.StringVar(&ocrCommand, "ocr-command", "", "command reading the text of a picture on stdin, e.g. \"tesseract stdin stdout\", for the drafts of expenses")
+	flag.Int64Var(&maxVoiceNoteSize, "max-voice-note-size", maxVoiceNoteSize, "maximum size of the upload of a voice note in bytes")
+	flag.StringVar(&speechCommand, "speech-command", "", "command transcribing the audio of a voice note on stdin, for the transcripts and the dictated drafts of expenses")
+	flag.IntVar(&maxMetadata, "max-metadata", maxMetadata, "maximum size in bytes of the metadata of an expense, in JSON")
+	flag.StringVar(&auditKey, "audit-key", auditKey, "key for signing audit exports, the export is disabled if empty")
+	flag.StringVar(&instanceKey, "instance-key", instanceKey, "key of the instance signing the settlements of the completed trips, defaults to $INSTANCE_KEY, none signed if empty")
+	flag.DurationVar(&slowQuery, "slow-query", slowQuery, "log the queries taking longer than this, e.g. 200ms, disabled if 0")
+	flag.StringVar(&tablePrefix, "table-prefix", tablePrefix, "prefix of the names of the tables, e.g. ta_, or a PostgreSQL schema ending with a dot, to share the database with other apps")
+	flag.BoolVar(&rebuildBalances, "rebuild-balances", rebuildBalances, "recompute the running balances of all trips at startup")
+	flag.StringVar(&rootToken, "root-token", rootToken, "static admin token, API tokens are required on all requests if set")
+	flag.BoolVar(&devMode, "dev", devMode, "development mode: fake clock, schema created and demo trips seeded at startup")
+	flag.StringSliceVar(&allowDomains, "allow-domains", allowDomains, "comma separated email domains new users are restricted to, all if empty")
+	flag.StringSliceVar(&blockDomains, "block-domains", blockDomains, "comma separated email domains new users can't have")
+	flag.StringVar(&blockDomainsFile, "block-domains-file", blockDomainsFile, "file listing more email domains to block, one per line")
+	flag.IntVar(&retention.TripYears, "retention-trip-years", retention.TripYears, "delete the trips completed more than this many years ago, kept forever if 0")
+	flag.IntVar(&retention.HistoryMonths, "retention-history-months", retention.HistoryMonths, "delete the history of the expenses deleted more than this many months ago, kept forever if 0")
+	flag.IntVar(&retention.AnonymizeMonths, "retention-anonymize-months", retention.AnonymizeMonths, "anonymize the users whose trips were all completed more than this many months ago, kept forever if 0")
+	flag.IntVar(&retention.DeletedDays, "retention-deleted-days", retention.DeletedDays, "purge the trips deleted more than this many days ago, restorable forever if 0")
+	flag.DurationVar(&purgeInterval, "purge-interval", purgeInterval, "period of the scheduled purge of the data past the retention, disabled if 0")
+	flag.DurationVar(&webhookInterval, "webhook-interval", webhookInterval, "period of the retries of the deliveries to the webhooks, no delivery if 0")
+	flag.DurationVar(&digestInterval, "digest-interval", digestInterval, "period of the digests of the active trips sent to the webhooks, none if 0")
+	flag.DurationVar(&recurrenceInterval, "recurrence-interval", recurrenceInterval, "period the recurring expenses due are added to their trips, none if 0")
+	flag.IntVar(&burstExpenses, "burst-expenses", burstExpenses, "quarantine the expenses of a token posting more than this many within --burst-window, disabled if 0")
+	flag.DurationVar(&burstWindow, "burst-window", burstWindow, "window of time of --burst-expenses")
+	flag.DurationVar(&burstQuarantine, "burst-quarantine", burstQuarantine, "how long the expenses of a token posting a burst are quarantined")
+	flag.IPNetSliceVar(&trustedProxies, "trusted-proxies", trustedProxies, "comma separated networks of the proxies trusted with X-Forwarded-For and X-Real-IP, e.g. 10.0.0.0/8, none if empty")
+	flag.StringVar(&smtpAddr, "smtp-addr", smtpAddr, "host:port of the SMTP server sending the emails, they're only logged if empty")
+	flag.StringVar(&smtpUser, "smtp-user", smtpUser, "user authenticating to the SMTP server, with PLAIN, none if empty")
+	flag.StringVar(&smtpPassword, "smtp-password", smtpPassword, "password of --smtp-user, defaults to $SMTP_PASSWORD")
+	flag.StringVar(&smtpFrom, "smtp-from", smtpFrom, "sender of the emails")
+	flag.BoolVar(&mailInvitations, "mail-invitations", mailInvitations, "mail the participants added to a trip an invitation to join it, with --jwt-key")
+	flag.StringVar(&notifyChannel, "notify", notifyChannel, "channel notifying the people of their share of the settlement of a completed trip: email, webhook or none")
+	flag.StringVar(&notifyURL, "notify-url", notifyURL, "URL the webhook channel of --notify POSTs the notifications to")
+	flag.StringVar(&notifySecret, "notify-secret", notifySecret, "secret signing the notifications POSTed to --notify-url, defaults to $NOTIFY_SECRET, unsigned if empty")
+	flag.StringVar(&fcmCredentials, "fcm-credentials", fcmCredentials, "JSON key of the Firebase service account pushing to the Android devices, none if empty")
+	flag.StringVar(&apnsKeyFile, "apns-key", apnsKeyFile, ".p8 signing key pushing to the Apple devices, none if empty")
+	flag.StringVar(&apnsKeyID, "apns-key-id", apnsKeyID, "ID of the APNs signing key")
+	flag.StringVar(&apnsTeamID, "apns-team-id", apnsTeamID, "ID of the Apple team of the app")
+	flag.StringVar(&apnsTopic, "apns-topic", apnsTopic, "bundle ID of the app, the topic of the pushes to the Apple devices")
+	flag.BoolVar(&apnsSandbox, "apns-sandbox", apnsSandbox, "push to the development builds of the app")
+	flag.StringVar(&telegramBotToken, "telegram-bot-token", telegramBotToken, "token of the Telegram bot posting to the chats of the trips, defaults to $TELEGRAM_BOT_TOKEN, none if empty")
+	flag.StringVar(&instanceName, "instance-name", instanceName, "name of the instance in the emails, the reports and the pages, e.g. the club hosting it")
+	flag.StringVar(&logoURL, "logo-url", logoURL, "URL of the logo of the instance in the HTML emails and the pages, none if empty")
+	flag.StringVar(&primaryColor, "primary-color", primaryColor, "primary color of the HTML emails and the pages, as a hex color")
+	flag.StringVar(&accentColor, "accent-color", accentColor, "accent color of the HTML emails and the pages, as a hex color")
+	flag.StringVar(&publicURL, "public-url", publicURL, "URL the server is reached at, for the links in the emails, e.g. https://trips.example.com, the one of the request if empty")
+	flag.DurationVar(&verificationTTL, "verification-ttl", verificationTTL, "how long the link to verify an email address is valid")
+	flag.StringVar(&jwtKey, "jwt-key", jwtKey, "key signing the session tokens of the users logging in, defaults to $JWT_KEY, no login if empty")
+	flag.DurationVar(&sessionTTL, "session-ttl", sessionTTL, "how long a session token is valid")
+	flag.DurationVar(&inviteTTL, "invite-ttl", inviteTTL, "how long an invite to join a trip is valid by default")
+	flag.DurationVar(&paidLinkTTL, "paid-link-ttl", paidLinkTTL, "how long a mark as paid link mailed with the settlement of a trip is valid, with --jwt-key and --public-url")
+	flag.StringVar(&oidcProviderName, "oidc-provider", oidcProviderName, "identity provider the users log in with: google, github or generic, none if empty")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", oidcIssuer, "issuer URL of the generic OpenID Connect provider, e.g. https://auth.example.com/realms/trips")
+	flag.StringVar(&oidcClientID, "oidc-client-id", oidcClientID, "client ID of the server registered with the identity provider")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", oidcClientSecret, "client secret of the server registered with the identity provider, defaults to $OIDC_CLIENT_SECRET")
+	flag.StringVar(&sheetsClientID, "sheets-client-id", sheetsClientID, "client ID of the server registered with Google, to export the trips to Google Sheets, none if empty")
+	flag.StringVar(&sheetsClientSecret, "sheets-client-secret", sheetsClientSecret, "client secret of the server registered with Google, defaults to $SHEETS_CLIENT_SECRET")
+	flag.StringVar(&federationKey, "federation-key", federationKey, "key shared with the instances the trips are federated with, requires --public-url, defaults to $FEDERATION_KEY, no federation if empty")
+	flag.DurationVar(&federationInterval, "federation-interval", federationInterval, "period of the syncs of the federated trips, only on demand if 0")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", webhookTimeout, "time a webhook has to answer a delivery")
+	flag.BoolVar(&purgeConfirm, "purge-confirm", purgeConfirm, "let the scheduled purge delete the data, it only logs what it would delete otherwise")
+	flag.Int64Var(&maxBodySize, "max-body-size", maxBodySize, "maximum size of a request body in bytes")
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout, "time allowed to read a request, body included")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "time allowed to handle a request and write the response")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "how long an idle keep-alive connection is kept")
+	flag.StringVar(&tlsCert, "tls-cert", tlsCert, "certificate file, PEM encoded, to serve over HTTPS")
+	flag.StringVar(&tlsKey, "tls-key", tlsKey, "key file of --tls-cert, PEM encoded")
+	flag.StringSliceVar(&acmeDomains, "acme-domains", acmeDomains, "comma separated domains to get certificates for from Let's Encrypt, to serve over HTTPS")
+	flag.StringVar(&acmeCache, "acme-cache", acmeCache, "directory keeping the certificates from Let's Encrypt")
+	flag.StringVar(&acmeEmail, "acme-email", acmeEmail, "contact email address given to Let's Encrypt")
+	flag.IntVar(&acmeHTTPPort, "acme-http-port", acmeHTTPPort, "port answering the ACME challenges and redirecting to HTTPS, disabled if 0")
+}
+
+// setupDev prepares the development mode: the clock of the data model
+// starts at devClockStart and moves 1s per reading, the schema is created,
+// and a few trips are seeded in an empty database
+func setupDev(db *sql.DB) {
+	start, _ := time.Parse(time.RFC3339, devClockStart)
+	trip.SetClock(trip.NewFakeClock(start, time.Second).Now)
+	ctx := context.Background()
+	err := trip.CreateSchema(ctx, db)
+	if err != nil {
+		log.Fatalf("ERROR: failed to create the schema: %v", err)
+	}
+	seeded, err := trip.SeedFixtures(ctx, db)
+	if err != nil {
+		log.Fatalf("ERROR: failed to seed the demo trips: %v", err)
+	}
+	if seeded {
+		log.Printf("Seeded the demo trips\n")
+	}
+	log.Printf("Development mode, the clock starts at %s\n", devClockStart)
+}
+
+// readDomainsFile returns the domains listed in a file, one per line,
+// skipping the empty lines and the comments starting with #
+func readDomainsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rslt []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			rslt = append(rslt, line)
+		}
+	}
+	return rslt, nil
+}
+
+// jsonBail sends an error status and a JSON payload, the envelope of
+// apierror with the code of the error.
+// A failure to read the request body past the limits is reported as such,
+// whatever the status given, see limitStatus().
+func jsonBail(w http.ResponseWriter, r *http.Request, status int, err error) {
+	status, err = limitStatus(status, err)
+	trip.Logf(r.Context(), "ERROR: jsonBail(status=%d, error=%v", status, err)
+	writeJSON(w, status, apierror.Wrap(status, err, notFoundCode(r, status)))
 }
 
-// handlerFunc is our HandlerFunc that takes an additional DB handler argument.
-type handlerFunc func(*gin.Context, *sql.DB)
+// notFoundParams are the codes of the resources not found, by the
+// parameter of the route naming them, the innermost first
+var notFoundParams = []struct {
+	param string
+	code  apierror.Code
+}{
+	{"receipt_id", apierror.ReceiptNotFound},
+	{"voice_note_id", apierror.VoiceNoteNotFound},
+	{"expense_id", apierror.ExpenseNotFound},
+	{"webhook_id", apierror.WebhookNotFound},
+	{"job_id", apierror.JobNotFound},
+	{"quarantine_id", apierror.QuarantineNotFound},
+	{"review_id", apierror.ReviewNotFound},
+	{"name", apierror.GroupNotFound},
+	{"federation_id", apierror.FederationNotFound},
+	{"message_id", apierror.MessageNotFound},
+	{"payment_id", apierror.PaymentNotFound},
+	{"recurrence_id", apierror.RecurrenceNotFound},
+	{"suggestion_id", apierror.SuggestionNotFound},
+	{"feature", apierror.FeatureNotFound},
+	{"avatar", apierror.AvatarNotFound},
+	{"token_id", apierror.TokenNotFound},
+	{"trip_id", apierror.TripNotFound},
+	{"email", apierror.UserNotFound},
+}
 
-// handlerWrapper wraps our handlerFunc into gin.HandlerFunc
-func handlerWrapper(db *sql.DB, f handlerFunc) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		f(c, db)
+// notFoundCode returns the code of a 404 status after the resource of the
+// route, the handlers give the code of the participants not found
+// themselves, see unknownParticipant()
+func notFoundCode(r *http.Request, status int) apierror.Code {
+	if status != http.StatusNotFound {
+		return ""
+	}
+	for _, p := range notFoundParams {
+		if r.PathValue(p.param) != "" {
+			return p.code
+		}
 	}
+	return ""
 }
 
-// jsonBail sends an error status and a JSON message payload
-func jsonBail(c *gin.Context, status int, err error) {
-	log.Printf("ERROR: jsonBail(status=%d, error=%v", status, err)
-	c.Error(err)
-	c.JSON(status, c.Errors.JSON())
-	c.Abort()
+// unknownParticipant gives its code to the sql.ErrNoRows returned for the
+// participant of a route, within a trip found
+func unknownParticipant(err error) error {
+	if err == sql.ErrNoRows {
+		return apierror.New(apierror.ParticipantUnknown, err)
+	}
+	return err
 }
 
 // postTrip creates a new trip
-func postTrip(c *gin.Context, db *sql.DB) {
+func postTrip(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	var t tripJSON
 
-	err := c.ShouldBindJSON(&t)
+	err := bindJSON(r, &t)
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
 
+	if !actsFor(r, t.Owner) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can create a trip they own", t.Owner))
+		return
+	}
+	ctx := requestContext(r)
+	if t.Group != "" {
+		err = t.addGroup(ctx, db)
+		switch {
+		case err == trip.ErrNoGroup:
+			jsonBail(w, r, http.StatusNotFound, err)
+			return
+		case err != nil:
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
 	trip, err := t.Translate()
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	ctx := context.Background()
 	err = trip.Save(ctx, db)
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	mailInvitation(r, trip, t.Participants)
+	w.Header().Set("ETag", trip.ETag())
+	writeJSON(w, http.StatusCreated, map[string]any{"trip_id": trip.ID})
+}
+
+// cloneJSON is used for POST to clone a trip
+type cloneJSON struct {
+	// Name is the name of the new trip, the one of the trip if empty
+	Name string `json:"name" binding:"max=127"`
+	// StartDate is the start date of the new trip, YYYY-MM-DD, the one of
+	// the trip if empty
+	StartDate string `json:"start_date"`
+}
+
+// postTripClone creates a new open trip with the name, the description
+// and the participants of a trip, for its owner only. The participants are
+// invited to the new trip, as when creating one.
+func postTripClone(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var cj cloneJSON
+	// the payload is optional
+	if r.ContentLength != 0 {
+		err := bindJSON(r, &cj)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	src, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	if !actsFor(r, src.Owner.Email) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the owner of the trip can clone it"))
+		return
+	}
+	startDate := src.StartDate
+	if cj.StartDate != "" {
+		sd, err := time.Parse(time.DateOnly, cj.StartDate)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		startDate = trip.NewDate(sd)
+	}
+	t := src.Clone(cj.Name, startDate)
+	err := t.Save(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	participants := make([]string, 0, len(t.Participants))
+	for _, p := range t.Participants {
+		participants = append(participants, p.Email)
+	}
+	mailInvitation(r, t, participants)
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusCreated, map[string]any{"trip_id": t.ID})
+}
+
+// postTripArchive archives a completed trip, for its owner only. The
+// trip is kept for the reports, but it's read-only and left out of the
+// listings.
+func postTripArchive(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "archive it")
+	if !ok {
+		return
+	}
+	ctx := requestContext(r)
+	err := trip.ArchiveTrip(ctx, db, t.ID)
+	switch {
+	case err == trip.ErrTripActive:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, err = trip.LoadTripByID(ctx, db, t.ID)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, t)
+}
+
+// deleteTrip deletes a trip, for its owner only. The trip is only marked
+// as deleted, it can be restored until it's purged.
+func deleteTrip(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "delete it")
+	if !ok {
+		return
+	}
+	err := trip.DeleteTrip(requestContext(r), db, t.ID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postTripRestore restores a deleted trip, for its owner only
+func postTripRestore(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.LoadDeletedTrip(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !actsFor(r, t.Owner.Email) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the owner of the trip can restore it"))
+		return
+	}
+	t, err = trip.RestoreTrip(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	c.JSON(http.StatusCreated, gin.H{"trip_id": trip.ID})
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, t)
+}
+
+// listPage parses the "limit" and "offset" query parameters of the
+// listings, without "limit" the whole listing is returned
+func listPage(r *http.Request) (p trip.Page, err error) {
+	if v := r.URL.Query().Get("limit"); v != "" {
+		p.Limit, err = strconv.Atoi(v)
+		if err != nil {
+			return p, err
+		}
+		if p.Limit <= 0 || p.Limit > listMaxPageSize {
+			return p, fmt.Errorf("limit must be between 1 and %d", listMaxPageSize)
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		p.Offset, err = strconv.Atoi(v)
+		if err != nil {
+			return p, err
+		}
+		if p.Offset < 0 {
+			return p, fmt.Errorf("offset must not be negative")
+		}
+	}
+	return p, nil
+}
+
+// setNextOffset sets the X-Next-Offset header if the page is full, as
+// there may be more items
+func setNextOffset(w http.ResponseWriter, r *http.Request, p trip.Page, n int) {
+	if p.Limit > 0 && n == p.Limit {
+		w.Header().Set("X-Next-Offset", strconv.Itoa(p.Offset+n))
+	}
 }
 
 // getTrips returns the active trips owned by a user
-func getTrips(c *gin.Context, db *sql.DB) {
-	owner := c.Params.ByName("owner")
-	ctx := context.Background()
-	trips, err := trip.LoadTripsByOwner(ctx, db, owner)
+// With "?sort=", a list of trips in the given order (name, start_date or
+// activity) is returned instead of a map keyed by the trip name.
+func getTrips(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	owner := r.PathValue("owner")
+	if !actsFor(r, owner) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can list their trips", owner))
+		return
+	}
+	page, err := listPage(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	if sort := r.URL.Query().Get("sort"); sort != "" {
+		trips, err := trip.LoadTripsByOwnerSorted(ctx, db, owner, trip.TripSort(sort), page)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		setNextOffset(w, r, page, len(trips))
+		writeJSON(w, http.StatusOK, trips)
+		return
+	}
+	trips, err := trip.LoadTripsByOwner(ctx, db, owner, page)
 	switch {
 	case err == sql.ErrNoRows:
-		jsonBail(c, http.StatusNotFound, err)
+		jsonBail(w, r, http.StatusNotFound, err)
 		return
 	case err != nil:
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	c.JSON(http.StatusOK, trips)
+	setNextOffset(w, r, page, len(trips))
+	writeJSON(w, http.StatusOK, trips)
 }
 
-// postExpense add an expenditure even to a trip
-func postExpense(c *gin.Context, db *sql.DB) {
-	tripID, err := strconv.ParseInt(c.Params.ByName("trip_id"), 10, 64)
+// searchTrips returns the trips whose name or description contain all the
+// words of "?q=", optionally restricted to the trips of "?owner=". Only the
+// trips the caller takes part in are searched, unless it's an admin.
+func searchTrips(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	owner := r.URL.Query().Get("owner")
+	if owner != "" && !actsFor(r, owner) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can search their trips", owner))
+		return
+	}
+	page, err := listPage(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	member := ""
+	if tok := requestToken(r); tok != nil && tok.Scope != trip.ScopeAdmin {
+		member = tok.Email
+	}
+	trips, err := trip.SearchTrips(requestContext(r), db, r.URL.Query().Get("q"), owner, member, page)
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
+	setNextOffset(w, r, page, len(trips))
+	writeJSON(w, http.StatusOK, trips)
+}
 
-	ctx := context.Background()
-	t, err := trip.LoadTripByID(ctx, db, tripID)
+// jsonPatchType is the media type of the JSON Patch documents
+const jsonPatchType = "application/json-patch+json"
+
+// patchTrip applies a JSON Patch (RFC 6902) document to a trip, for partial
+// updates of its name, description, start date, and participants. The
+// document must be sent as such, with its media type, as a JSON merge
+// patch or a plain JSON body would be misread as one.
+func patchTrip(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != jsonPatchType {
+		jsonBail(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q, expecting %s", contentType, jsonPatchType))
+		return
+	}
+	var ops []trip.PatchOp
+	err = decodeJSON(r, &ops)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		return t.ApplyPatch(ops)
+	})
 	switch {
 	case err == sql.ErrNoRows:
-		jsonBail(c, http.StatusNotFound, err)
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case errors.Is(err, trip.ErrPatchTest) || errors.Is(err, trip.ErrParticipantInExpense):
+		jsonBail(w, r, http.StatusConflict, err)
 		return
 	case err != nil:
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, t)
+}
+
+// postExpense add an expenditure even to a trip
+func postExpense(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	var expense expenseJSON
-	err = c.ShouldBindJSON(&expense)
+	err = bindJSON(r, &expense)
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	err = expense.defaultSplit(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	e, err := expense.Translate()
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	err = t.AddExpense(e.Date, e.Description, e.Participants)
-	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+	if source := burstSource(r); expenseBursts.Record(ctx, source) {
+		quarantineExpense(w, r, db, tripID, source, expense)
 		return
 	}
-	err = t.Save(ctx, db)
-	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+
+	t := addExpense(w, r, db, tripID, expense, e, 0)
+	if t == nil {
 		return
 	}
+	w.Header().Set("ETag", t.ETag())
 	e = t.Expenses[len(t.Expenses)-1]
-	c.JSON(http.StatusAccepted, gin.H{"expense_id": e.ID})
+	writeJSON(w, http.StatusAccepted, map[string]any{"expense_id": e.ID})
+}
+
+// addExpense adds the translated expense to the trip, as of the version in
+// If-Match if given, and returns the trip. The expense released from the
+// quarantine, if not 0, is deleted from it along. Errors are reported to
+// the client, nil is returned then.
+func addExpense(w http.ResponseWriter, r *http.Request, db *sql.DB, tripID int64, expense expenseJSON, e *trip.Expense, quarantineID int64) *trip.Trip {
+	// the expense is added while holding the write lock of the trip, so
+	// that concurrent posts to the same trip don't work from stale copies
+	t, err := trip.UpdateTripIfMatch(requestContext(r), db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		if expense.AddToTrip {
+			for _, p := range e.Participants {
+				if !t.IsParticipant(p.Email) {
+					err := t.AddParticipant(p.Email)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		err := t.AddExpense(e.Date, e.Description, e.Participants)
+		if err != nil {
+			return err
+		}
+		t.Expenses[len(t.Expenses)-1].Notes = e.Notes
+		t.Expenses[len(t.Expenses)-1].Metadata = e.Metadata
+		if quarantineID != 0 {
+			t.ReleaseQuarantined(quarantineID)
+		}
+		return nil
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return nil
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return nil
+	case err == trip.ErrTripArchived || err == trip.ErrQuarantineReleased || errors.Is(err, trip.ErrExpensesFrozen):
+		jsonBail(w, r, http.StatusConflict, err)
+		return nil
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil
+	}
+	return t
 }
 
-// getExpenses returns the list of expenses incurred during the trip
-func getExpenses(c *gin.Context, db *sql.DB) {
-	tripID, err := strconv.ParseInt(c.Params.ByName("trip_id"), 10, 64)
+// previewExpense returns what an expense would mean for its participants,
+// their shares and who will owe whom, without adding it to the trip
+func previewExpense(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	ctx := context.Background()
-	trip, err := trip.LoadTripByID(ctx, db, tripID)
+
+	var expense expenseJSON
+	err = bindJSON(r, &expense)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = expense.defaultSplit(requestContext(r), db, tripID)
 	switch {
 	case err == sql.ErrNoRows:
-		jsonBail(c, http.StatusNotFound, err)
+		jsonBail(w, r, http.StatusNotFound, err)
 		return
 	case err != nil:
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	c.JSON(http.StatusOK, trip.Expenses)
-}
 
-// getSettlement returns a settlement object for the trip
-func getSettlement(c *gin.Context, db *sql.DB) {
-	tripID, err := strconv.ParseInt(c.Params.ByName("trip_id"), 10, 64)
+	e, err := expense.Translate()
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	ctx := context.Background()
-	trip, err := trip.LoadTripByID(ctx, db, tripID)
+
+	t, err := trip.LoadTripByID(requestContext(r), db, tripID)
 	switch {
 	case err == sql.ErrNoRows:
-		jsonBail(c, http.StatusNotFound, err)
+		jsonBail(w, r, http.StatusNotFound, err)
 		return
 	case err != nil:
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	settlement, err := trip.Complete(ctx, db)
+	if expense.AddToTrip {
+		// only added to the copy of the trip, which isn't saved
+		for _, p := range e.Participants {
+			if !t.IsParticipant(p.Email) {
+				err = t.AddParticipant(p.Email)
+				if err != nil {
+					jsonBail(w, r, http.StatusBadRequest, err)
+					return
+				}
+			}
+		}
+	}
+	preview, err := t.PreviewExpense(e.Date, e.Description, e.Participants)
 	if err != nil {
-		jsonBail(c, http.StatusBadRequest, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
 		return
 	}
-	c.JSON(http.StatusOK, settlement)
+	if category := e.Metadata[trip.CategoryKey]; category != "" {
+		envelopes, err := t.LoadEnvelopes(requestContext(r), db)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		preview.EnvelopeWarnings = t.EnvelopeWarnings(envelopes, e.Date, category, preview.Total)
+	}
+	writeJSON(w, http.StatusOK, preview)
 }
 
-func main() {
-	flag.Parse()
-	dbU, err := url.Parse(dbURL)
+// getExpenses returns the list of expenses incurred during the trip,
+// in the order given by "?sort=" (created or date), in CSV if the Accept
+// header prefers it
+func getExpenses(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	listExpenses(w, r, db, negotiateFormat(r, "application/json", "text/csv") == "text/csv")
+}
+
+// getExpensesCSV returns the list of expenses of the trip in CSV, with one
+// row per participant of each expense
+func getExpensesCSV(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	listExpenses(w, r, db, true)
+}
+
+// listExpenses returns the list of expenses of the trip in JSON, or
+// streamed in CSV
+func listExpenses(w http.ResponseWriter, r *http.Request, db *sql.DB, asCSV bool) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
 	if err != nil {
-		log.Fatalf("ERROR: failed to parse database URL: %q: %v", dbURL, err)
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
 	}
-	if dbU.Scheme != "sqlite3" {
-		log.Fatalf("ERROR: unsupported database: %s", dbU.Scheme)
+	page, err := listPage(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
 	}
-
-	db, err := sql.Open(dbU.Scheme, dbU.Path)
+	sort := trip.ExpenseSort(defaultQuery(r, "sort", string(trip.ExpensesByCreation)))
+	ctx := requestContext(r)
+	expenses, err := trip.LoadExpenses(ctx, db, tripID, sort, page)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	setNextOffset(w, r, page, len(expenses))
+	if !asCSV {
+		writeJSON(w, http.StatusOK, expenses)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=trip-%d-expenses.csv", tripID))
+	w.Header().Set("Content-Type", "text/csv")
+	w.WriteHeader(http.StatusOK)
+	err = trip.WriteExpensesCSV(w, expenses)
 	if err != nil {
-		log.Fatalf("ERROR: failed to open DB file %q: %v", dbU.Path, err)
+		trip.Logf(ctx, "ERROR: failed to write the expenses of trip %d: %v\n", tripID, err)
 	}
-	log.Printf("Opened DB file at %s\n", dbU.Path)
-	defer db.Close()
-
-	// we don't really use floating point numbers in any JSON doc
-	gin.EnableJsonDecoderUseNumber()
+}
 
-	router := gin.Default()
-	router.POST("/trips", handlerWrapper(db, postTrip))
-	router.GET("/:owner/trips", handlerWrapper(db, getTrips))
-	router.POST("/trips/:trip_id/expenses", handlerWrapper(db, postExpense))
-	router.GET("/trips/:trip_id/expenses", handlerWrapper(db, getExpenses))
-	router.GET("/trips/:trip_id/settlement", handlerWrapper(db, getSettlement))
+// deleteExpense removes an expenditure event from a trip
+func deleteExpense(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	expenseID, err := strconv.ParseInt(r.PathValue("expense_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		return t.RemoveExpense(expenseID)
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	bindAddr := fmt.Sprintf(":%d", port)
-	router.Run(bindAddr)
+// postExpenseRestore restores a deleted expense of a trip, with its ID,
+// its receipts and its voice notes
+func postExpenseRestore(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, expenseID, err := expenseParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	var e *trip.Expense
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		var err error
+		e, err = t.RestoreExpense(ctx, db, expenseID)
+		return err
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived || err == trip.ErrExpenseReplaced || err == trip.ErrUnknownParticipant ||
+		errors.Is(err, trip.ErrExpensesFrozen):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, e)
+}
+
+// postParticipants adds participants to an existing trip
+func postParticipants(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var pj participantsJSON
+	err = bindJSON(r, &pj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	status := http.StatusBadRequest
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		for _, email := range pj.Participants {
+			err := t.AddParticipant(email)
+			if err != nil {
+				status = http.StatusConflict
+				return err
+			}
+		}
+		return nil
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, status, err)
+		return
+	}
+	mailInvitation(r, t, pj.Participants)
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusCreated, t.Participants)
+}
+
+// deleteParticipant removes a participant from a trip
+func deleteParticipant(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		return unknownParticipant(t.RemoveParticipant(r.PathValue("email")))
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err == trip.ErrParticipantInExpense:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postReassign removes a participant from a trip, even if they took part
+// in some expenses, by reassigning their shares. Only the owner of the trip,
+// or an admin, can do it when the tokens are required.
+func postReassign(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var rj reassignJSON
+	err = decodeJSON(r, &rj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	status := http.StatusBadRequest
+	var reassigned []trip.Reassignment
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		if !actsFor(r, t.Owner.Email) {
+			status = http.StatusForbidden
+			return errors.New("only the owner of the trip can reassign the shares of a participant")
+		}
+		var err error
+		reassigned, err = t.ReassignParticipant(ctx, db, r.PathValue("email"), rj.To)
+		return unknownParticipant(err)
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err == trip.ErrReassignPaid || err == trip.ErrParticipantInExpense:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, status, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, reassigned)
+}
+
+// getParticipants returns the roster of a trip, the confirmed members
+// first
+func getParticipants(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, t.Roster())
+}
+
+// putRSVP answers the invitation to a trip, for the participant only
+func putRSVP(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can answer their invitation", email))
+		return
+	}
+	var rj rsvpJSON
+	err = bindJSON(r, &rj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		return unknownParticipant(t.SetRSVP(email, rj.RSVP))
+	})
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, t.Roster())
+}
+
+// asOfQuery parses "?as_of=", the RFC 3339 time of a past view of a trip.
+// The zero time is returned without it.
+func asOfQuery(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get("as_of")
+	if v == "" {
+		return time.Time{}, nil
+	}
+	asOf, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid as_of %q, expecting an RFC 3339 time", v)
+	}
+	return asOf, nil
+}
+
+// loadTripAsOf loads a trip as it is, or as it was at asOf if it's set
+func loadTripAsOf(ctx context.Context, db *sql.DB, tripID int64, asOf time.Time) (*trip.Trip, error) {
+	if asOf.IsZero() {
+		return trip.LoadTripByID(ctx, db, tripID)
+	}
+	return trip.LoadTripAsOf(ctx, db, tripID, asOf)
+}
+
+// loadTrip returns the trip of the request, bailing out with the error if
+// it can't be loaded
+func loadTrip(w http.ResponseWriter, r *http.Request, db *sql.DB) (*trip.Trip, bool) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	t, err := trip.LoadTripByID(requestContext(r), db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return nil, false
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return t, true
+}
+
+// loadOwnedTrip returns the trip of the request, bailing out with the
+// error if it can't be loaded or the request doesn't act for its owner,
+// the only one who can do what the action tells, e.g. "freeze its expense
+// entry"
+func loadOwnedTrip(w http.ResponseWriter, r *http.Request, db *sql.DB, action string) (*trip.Trip, bool) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return nil, false
+	}
+	if !actsFor(r, t.Owner.Email) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the owner of the trip can "+action))
+		return nil, false
+	}
+	return t, true
+}
+
+// getTrip returns a trip with its participants and expenses, as of
+// "?as_of=" if given
+func getTrip(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	asOf, err := asOfQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, err := loadTripAsOf(requestContext(r), db, tripID, asOf)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if asOf.IsZero() {
+		// the version to pass in If-Match to change the trip
+		w.Header().Set("ETag", t.ETag())
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// getSettlement returns a settlement object for the trip, as it stands
+// until the trip is completed, see postSettle()
+func getSettlement(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	serveSettlement(w, r, db, false)
+}
+
+// postSettle completes the trip, once its expenses are approved if it
+// requires it, and returns its settlement
+func postSettle(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	serveSettlement(w, r, db, true)
+}
+
+// serveSettlement returns the settlement of the trip, completing the trip
+// first if complete is set
+func serveSettlement(w http.ResponseWriter, r *http.Request, db *sql.DB, complete bool) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	asOf, err := asOfQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if complete && !asOf.IsZero() {
+		jsonBail(w, r, http.StatusBadRequest, errors.New("as_of is only for getting a past settlement"))
+		return
+	}
+	by := r.URL.Query().Get("by")
+	if by != "" && by != "household" {
+		jsonBail(w, r, http.StatusBadRequest, fmt.Errorf("invalid by %q, expecting household", by))
+		return
+	}
+	var settlement trip.Settlement
+	var pending *trip.PendingSettlement
+	switch {
+	case !asOf.IsZero():
+		settlement, err = trip.SettlementAsOf(requestContext(r), db, tripID, asOf)
+	case complete:
+		settlement, pending, err = trip.SettleApprovedTrip(requestContext(r), db, tripID)
+	default:
+		settlement, pending, err = trip.PreviewApprovedTrip(requestContext(r), db, tripID)
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, trip.ErrInfeasibleSettlement):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// what remains to be paid, less the payments recorded
+	if pending != nil {
+		pending.Settlement, err = trip.RemainingSettlement(requestContext(r), db, tripID, pending.Settlement, asOf)
+	} else {
+		settlement, err = trip.RemainingSettlement(requestContext(r), db, tripID, settlement, asOf)
+	}
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if by == "household" && pending == nil {
+		households, err := trip.LoadHouseholds(requestContext(r), db, tripID)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		settlement = settlement.ByHousehold(households)
+	}
+	names, avatars, err := displayNamesQuery(r, db, tripID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	switch {
+	case pending != nil:
+		pending.DisplayNames = names
+		pending.AvatarURLs = avatars
+		writeJSON(w, http.StatusOK, pending)
+	case names != nil:
+		handles, links, err := payeeHandles(r, db, tripID, settlement)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, trip.NamedSettlement{Settlement: settlement, DisplayNames: names, AvatarURLs: avatars, PaymentHandles: handles, PaymentLinks: links})
+	default:
+		writeJSON(w, http.StatusOK, settlement)
+	}
+}
+
+// signedSettlementJSON is a settlement signed by the server, the JWS with
+// its payload decoded
+type signedSettlementJSON struct {
+	JWS     string                 `json:"jws"`
+	Payload *trip.SignedSettlement `json:"payload"`
+}
+
+// verifySettlementJSON is used for POST to verify a signed settlement
+type verifySettlementJSON struct {
+	JWS string `json:"jws" binding:"required"`
+}
+
+// getSignedSettlement returns the final settlement of a completed trip,
+// signed with the key of the instance
+func getSignedSettlement(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	jws, s, err := trip.SignSettlement(requestContext(r), db, tripID)
+	switch {
+	case err == trip.ErrNoInstanceKey:
+		jsonBail(w, r, http.StatusServiceUnavailable, err)
+		return
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, errors.New("the trip doesn't exist or isn't completed"))
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, signedSettlementJSON{jws, s})
+}
+
+// postSettlementVerify checks the signature of a settlement, and returns
+// its payload if signed by the instance
+func postSettlementVerify(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var vj verifySettlementJSON
+	err := bindJSON(r, &vj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	s, err := trip.VerifySettlement(vj.JWS)
+	switch {
+	case err == trip.ErrNoInstanceKey:
+		jsonBail(w, r, http.StatusServiceUnavailable, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, signedSettlementJSON{strings.TrimSpace(vj.JWS), s})
+}
+
+// displayNamesQuery returns the display names and the avatar URLs of the
+// people of the trip if "?display_names=true", nil otherwise
+func displayNamesQuery(r *http.Request, db *sql.DB, tripID int64) (map[string]string, map[string]string, error) {
+	v := r.URL.Query().Get("display_names")
+	if v == "" {
+		return nil, nil, nil
+	}
+	with, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid display_names %q, expecting true or false", v)
+	}
+	if !with {
+		return nil, nil, nil
+	}
+	names, err := trip.LoadDisplayNames(requestContext(r), db, tripID)
+	if err != nil {
+		return nil, nil, err
+	}
+	avatars, err := trip.LoadAvatarURLs(requestContext(r), db, tripID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, avatars, nil
+}
+
+// payeeHandles returns the payment handles of the people paid in the
+// settlement of the trip, the ones without aside, and the links opening
+// the payments to them, noted with the name of the trip
+func payeeHandles(r *http.Request, db *sql.DB, tripID int64, settlement trip.Settlement) (map[string]trip.PaymentHandles, map[string]map[string]trip.PaymentLinks, error) {
+	all, err := trip.LoadPaymentHandles(requestContext(r), db, tripID)
+	if err != nil {
+		return nil, nil, err
+	}
+	handles := make(map[string]trip.PaymentHandles)
+	for _, payee := range settlement.Payees() {
+		if h, ok := all[payee]; ok {
+			handles[payee] = h
+		}
+	}
+	t, err := trip.LoadTripByID(requestContext(r), db, tripID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return handles, settlement.PaymentLinks(handles, t.Name), nil
+}
+
+// getBalances returns where each participant of the trip stands overall:
+// the total paid, the fair share, and the net position
+func getBalances(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	asOf, err := asOfQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, err := loadTripAsOf(requestContext(r), db, tripID, asOf)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Balances())
+}
+
+// getStatement returns the statement of a participant of the trip, in
+// the format of "?format=" (json, html or pdf)
+func getStatement(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	email := r.PathValue("email")
+	st, err := t.Statement(email)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, apierror.New(apierror.ParticipantUnknown, fmt.Errorf("%s is not a participant of trip %d", email, t.ID)))
+		return
+	case errors.Is(err, trip.ErrInfeasibleSettlement):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	name := fmt.Sprintf("trip-%d-statement", t.ID)
+	switch defaultQuery(r, "format", "json") {
+	case "json":
+		writeJSON(w, http.StatusOK, st)
+	case "html":
+		var buf bytes.Buffer
+		err = st.WriteHTML(&buf)
+		if err != nil {
+			jsonBail(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		writeData(w, http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+	case "pdf":
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", name))
+		writeData(w, http.StatusOK, "application/pdf", st.PDF())
+	default:
+		jsonBail(w, r, http.StatusBadRequest, fmt.Errorf("unsupported format %q", r.URL.Query().Get("format")))
+	}
+}
+
+// getSettlementPreview returns the settlement of the trip as it stands,
+// without completing the trip, nor waiting for the approval of its
+// expenses unlike getSettlement()
+func getSettlementPreview(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	asOf, err := asOfQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var settlement trip.Settlement
+	if asOf.IsZero() {
+		settlement, err = trip.PreviewSettlement(requestContext(r), db, tripID)
+	} else {
+		settlement, err = trip.SettlementAsOf(requestContext(r), db, tripID, asOf)
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, trip.ErrInfeasibleSettlement):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	settlement, err = trip.RemainingSettlement(requestContext(r), db, tripID, settlement, asOf)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	names, avatars, err := displayNamesQuery(r, db, tripID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if names != nil {
+		handles, links, err := payeeHandles(r, db, tripID, settlement)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, trip.NamedSettlement{Settlement: settlement, DisplayNames: names, AvatarURLs: avatars, PaymentHandles: handles, PaymentLinks: links})
+		return
+	}
+	writeJSON(w, http.StatusOK, settlement)
+}
+
+// settledTrip loads the trip of the request, as of "?as_of=" if given,
+// and its settlement as it stands, without completing the trip. The error
+// is reported, and nil returned, if it fails.
+func settledTrip(w http.ResponseWriter, r *http.Request, db *sql.DB) (*trip.Trip, trip.Settlement) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, nil
+	}
+	asOf, err := asOfQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, nil
+	}
+	t, err := loadTripAsOf(requestContext(r), db, tripID, asOf)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return nil, nil
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, nil
+	}
+	settlement, err := t.Settlement()
+	switch {
+	case errors.Is(err, trip.ErrInfeasibleSettlement):
+		jsonBail(w, r, http.StatusConflict, err)
+		return nil, nil
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, nil
+	}
+	return t, settlement
+}
+
+// getSettlementPDF returns the printable report of the trip, its expenses
+// and the settlement as it stands, without completing the trip
+func getSettlementPDF(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, settlement := settledTrip(w, r, db)
+	if t == nil {
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=trip-%d-settlement.pdf", t.ID))
+	writeData(w, http.StatusOK, "application/pdf", t.ReportPDF(settlement))
+}
+
+// getExportXLSX returns the workbook of the trip, with the sheets of the
+// participants, the expenses, and the settlement as it stands
+func getExportXLSX(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, settlement := settledTrip(w, r, db)
+	if t == nil {
+		return
+	}
+	workbook, err := t.WorkbookXLSX(settlement)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=trip-%d.xlsx", t.ID))
+	writeData(w, http.StatusOK, mimeXLSX, workbook)
+}
+
+// getForbiddenTransfers returns the transfers the settlement of the trip
+// routes around
+func getForbiddenTransfers(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, map[string]any{"transfers": t.ForbiddenTransfers})
+}
+
+// putForbiddenTransfers replaces the forbidden transfers of a trip, it's
+// refused if the settlement can't route around them. Only the owner of the
+// trip, or an admin, can set them when the tokens are required.
+func putForbiddenTransfers(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var fj forbiddenJSON
+	err = decodeJSON(r, &fj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	status := http.StatusBadRequest
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		if !actsFor(r, t.Owner.Email) {
+			status = http.StatusForbidden
+			return errors.New("only the owner of the trip can set its forbidden transfers")
+		}
+		err := t.SetForbiddenTransfers(fj.Transfers)
+		if err != nil {
+			return err
+		}
+		_, err = t.Settlement()
+		if err != nil {
+			status = http.StatusConflict
+		}
+		return err
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, status, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, map[string]any{"transfers": t.ForbiddenTransfers})
+}
+
+// getHouseholds returns the households of the people of the trip, the
+// settlement can be netted within
+func getHouseholds(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, householdsJSON{t.Households})
+}
+
+// putHouseholds replaces the households of the people of a trip. Only the
+// owner of the trip, or an admin, can set them when the tokens are
+// required.
+func putHouseholds(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var hj householdsJSON
+	err = decodeJSON(r, &hj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	status := http.StatusBadRequest
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		if !actsFor(r, t.Owner.Email) {
+			status = http.StatusForbidden
+			return errors.New("only the owner of the trip can set its households")
+		}
+		return t.SetHouseholds(hj.Households)
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, status, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, householdsJSON{t.Households})
+}
+
+// putOrganizerFee sets the fee credited to the owner of a trip for
+// organizing it, paid by the other participants in the settlement. Only
+// the owner of the trip, or an admin, can set it when the tokens are
+// required.
+func putOrganizerFee(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var oj organizerFeeJSON
+	err = decodeJSON(r, &oj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	status := http.StatusBadRequest
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		if !actsFor(r, t.Owner.Email) {
+			status = http.StatusForbidden
+			return errors.New("only the owner of the trip can set its organizer fee")
+		}
+		err := t.SetOrganizerFee(*oj.Amount)
+		if err != nil {
+			return err
+		}
+		_, err = t.Settlement()
+		if err != nil {
+			status = http.StatusConflict
+		}
+		return err
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, status, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, map[string]any{"amount": t.OrganizerFee})
+}
+
+// putApprovalRequired sets whether the settlement of a trip waits for the
+// participants to approve its expenses. Only the owner of the trip, or an
+// admin, can set it when the tokens are required.
+func putApprovalRequired(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var aj approvalRequiredJSON
+	err = decodeJSON(r, &aj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	status := http.StatusBadRequest
+	t, err := trip.UpdateTripIfMatch(ctx, db, tripID, r.Header.Get("If-Match"), func(t *trip.Trip) error {
+		if !actsFor(r, t.Owner.Email) {
+			status = http.StatusForbidden
+			return errors.New("only the owner of the trip can require the approval of its expenses")
+		}
+		t.SetApprovalRequired(*aj.Required)
+		return nil
+	})
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, status, err)
+		return
+	}
+	approvals, err := t.LoadApprovals(ctx, db)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, approvals)
+}
+
+// getApprovals returns where the approval of the expenses of a trip stands
+func getApprovals(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.LoadTripByID(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	approvals, err := t.LoadApprovals(ctx, db)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	writeJSON(w, http.StatusOK, approvals)
+}
+
+// putApproval approves the expenses of a trip, as of the version in
+// If-Match if given, for the participant only
+func putApproval(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can approve the expenses on their behalf", email))
+		return
+	}
+	approvals, err := trip.ApproveExpenses(requestContext(r), db, tripID, email, r.Header.Get("If-Match"))
+	switch {
+	case err == sql.ErrNoRows, errors.Is(err, trip.ErrUnknownParticipant):
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripModified:
+		jsonBail(w, r, http.StatusPreconditionFailed, err)
+		return
+	case err == trip.ErrApprovalDelegated:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, approvals)
+}
+
+// getDelegation returns the delegation of the approvals of the owner of a
+// trip, expired or not
+func getDelegation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	d, err := t.LoadDelegation(requestContext(r), db)
+	switch {
+	case err == trip.ErrNoDelegation:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// putDelegation delegates the approvals of the owner of a trip to a
+// co-treasurer, for the owner only
+func putDelegation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var dj delegationJSON
+	err := bindJSON(r, &dj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "delegate their approvals")
+	if !ok {
+		return
+	}
+	expiresAt := trip.Now().Add(time.Duration(dj.ExpiresIn) * time.Second)
+	d, err := t.DelegateApprovals(requestContext(r), db, dj.Delegate, *dj.Threshold, expiresAt)
+	switch {
+	case errors.Is(err, trip.ErrUnknownParticipant):
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, d)
+}
+
+// deleteDelegation revokes the delegation of the approvals of the owner
+// of a trip, for the owner only
+func deleteDelegation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "delegate their approvals")
+	if !ok {
+		return
+	}
+	err := t.RevokeDelegation(requestContext(r), db)
+	switch {
+	case err == trip.ErrNoDelegation:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getUser returns the profile of a user, without creating them. Their
+// payment handles are left out, unless the request acts for them or for
+// someone sharing a trip with them.
+func getUser(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	ctx := requestContext(r)
+	p, err := trip.LoadProfile(ctx, db, email)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !actsFor(r, email) {
+		shared, err := trip.SharesTrip(ctx, db, requestToken(r).Email, email)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !shared {
+			p.PaymentHandles = trip.PaymentHandles{}
+		}
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// patchUser updates the profile of a user, for the user only, without
+// creating them
+func patchUser(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can update their profile", email))
+		return
+	}
+	var uj userPatchJSON
+	err := decodeJSON(r, &uj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	p, err := trip.UpdateDisplayName(requestContext(r), db, email, *uj.DisplayName)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// putPaymentHandles sets where a user wants to be paid, for the user only,
+// replacing the handles they had
+func putPaymentHandles(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can update their payment handles", email))
+		return
+	}
+	var h trip.PaymentHandles
+	err := decodeJSON(r, &h)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	p, err := trip.UpdatePaymentHandles(requestContext(r), db, email, h)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// deleteUser erases a user, for the user only: their email address is
+// replaced by a tombstone in the trips, whose settlements are unchanged.
+// It's refused while they own active trips.
+func deleteUser(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can erase their account", email))
+		return
+	}
+	usr, err := trip.EraseUser(requestContext(r), db, email)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case errors.Is(err, trip.ErrOwnsActiveTrips):
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, usr)
+}
+
+// getSpendCaps returns the spend caps set by a user, for the user only,
+// without creating them
+func getSpendCaps(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can read their spend caps", email))
+		return
+	}
+	ctx := requestContext(r)
+	p, err := trip.LoadProfile(ctx, db, email)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	caps, err := trip.LoadSpendCaps(ctx, db, p.User)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, caps)
+}
+
+// putSpendCap sets, or removes with an amount of 0, a spend cap of a user,
+// for the user only, without creating them
+func putSpendCap(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can set their spend caps", email))
+		return
+	}
+	var sc spendCapJSON
+	err := decodeJSON(r, &sc)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := requestContext(r)
+	if sc.TripID != 0 {
+		_, err = trip.LoadTripByID(ctx, db, sc.TripID)
+		switch {
+		case err == sql.ErrNoRows:
+			jsonBail(w, r, http.StatusNotFound, err)
+			return
+		case err != nil:
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	p, err := trip.LoadProfile(ctx, db, email)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = trip.SaveSpendCap(ctx, db, p.User, trip.SpendCap{TripID: sc.TripID, Amount: *sc.Amount})
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditQuery parses the query parameters shared by the audit export endpoints
+func auditQuery(r *http.Request) (q trip.AuditQuery, err error) {
+	q.Limit = auditPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil {
+			return q, err
+		}
+		if q.Limit <= 0 || q.Limit > auditMaxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", auditMaxPageSize)
+		}
+	}
+	if v := r.URL.Query().Get("after"); v != "" {
+		q.After, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return q, err
+		}
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		d, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return q, err
+		}
+		q.From = trip.NewDate(d)
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		d, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return q, err
+		}
+		q.To = trip.NewDate(d)
+	}
+	return q, nil
+}
+
+// writeAudit sends a page of the audit export as JSON Lines, signed with auditKey
+func writeAudit(w http.ResponseWriter, r *http.Request, db *sql.DB, q trip.AuditQuery) {
+	if auditKey == "" {
+		jsonBail(w, r, http.StatusServiceUnavailable, fmt.Errorf("audit export is not enabled"))
+		return
+	}
+	ctx := requestContext(r)
+	events, err := trip.LoadAuditEvents(ctx, db, q)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var buf bytes.Buffer
+	err = trip.WriteAuditEvents(&buf, events)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Audit-Signature", trip.SignAudit([]byte(auditKey), buf.Bytes()))
+	if len(events) == q.Limit {
+		w.Header().Set("X-Next-Cursor", strconv.FormatInt(events[len(events)-1].Seq, 10))
+	}
+	writeData(w, http.StatusOK, "application/x-ndjson", buf.Bytes())
+}
+
+// getTripAuditExport exports the financial events of a trip
+func getTripAuditExport(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	q, err := auditQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	_, err = trip.LoadTripByID(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	q.TripID = tripID
+	writeAudit(w, r, db, q)
+}
+
+// getTripAuditLog returns a page of the audit log of the changes of a trip
+func getTripAuditLog(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	q, err := auditQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	_, err = trip.LoadTripByID(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	q.TripID = tripID
+	entries, err := trip.LoadAuditLog(ctx, db, q)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if len(entries) == q.Limit {
+		w.Header().Set("X-Next-Cursor", strconv.FormatInt(entries[len(entries)-1].ID, 10))
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// getAuditExport exports the financial events of all trips within a date
+// range
+func getAuditExport(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	q, err := auditQuery(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeAudit(w, r, db, q)
+}
+
+// getSnapshot returns the bundle stored when the trip was completed,
+// in the format given by "?format=" (json, csv or pdf)
+func getSnapshot(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	snap, err := trip.LoadSnapshot(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	name := fmt.Sprintf("trip-%d-snapshot-%d", tripID, snap.ID)
+	switch defaultQuery(r, "format", "json") {
+	case "json":
+		writeData(w, http.StatusOK, "application/json", snap.JSON)
+	case "csv":
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.csv", name))
+		writeData(w, http.StatusOK, "text/csv", snap.CSV)
+	case "pdf":
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", name))
+		writeData(w, http.StatusOK, "application/pdf", snap.PDF)
+	default:
+		jsonBail(w, r, http.StatusBadRequest, fmt.Errorf("unsupported format %q", r.URL.Query().Get("format")))
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-data" {
+		migrateData(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mint-token" {
+		mintToken(os.Args[2:])
+		return
+	}
+	flag.Parse()
+	if devMode && !flag.CommandLine.Changed("db") {
+		dbURL = "sqlite3://" + filepath.Join(os.TempDir(), "trip-accountant-dev.db")
+	}
+	if smtpPassword == "" {
+		// kept out of the command line, visible to the other users
+		smtpPassword = os.Getenv("SMTP_PASSWORD")
+	}
+	if notifySecret == "" {
+		notifySecret = os.Getenv("NOTIFY_SECRET")
+	}
+	if telegramBotToken == "" {
+		telegramBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
+	}
+	if jwtKey == "" {
+		jwtKey = os.Getenv("JWT_KEY")
+	}
+	trip.SetSessionKey([]byte(jwtKey))
+	if instanceKey == "" {
+		instanceKey = os.Getenv("INSTANCE_KEY")
+	}
+	trip.SetInstanceKey([]byte(instanceKey))
+	err := setupBranding()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if oidcClientSecret == "" {
+		oidcClientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	}
+	if oidcProviderName != "" {
+		var err error
+		oidc, err = newOIDCProvider(oidcProviderName, oidcIssuer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if jwtKey == "" {
+			log.Fatal("--oidc-provider requires --jwt-key")
+		}
+	}
+	if sheetsClientSecret == "" {
+		sheetsClientSecret = os.Getenv("SHEETS_CLIENT_SECRET")
+	}
+	if federationKey == "" {
+		federationKey = os.Getenv("FEDERATION_KEY")
+	}
+	if devMode && !flag.CommandLine.Changed("receipts-dir") {
+		receiptsDir = filepath.Join(os.TempDir(), "trip-accountant-dev-receipts")
+	}
+	trip.SetReceiptDir(receiptsDir)
+	if devMode && !flag.CommandLine.Changed("avatars-dir") {
+		avatarsDir = filepath.Join(os.TempDir(), "trip-accountant-dev-avatars")
+	}
+	trip.SetAvatarStore(avatarsDir, strings.TrimSuffix(publicURL, "/")+"/v1/avatars/")
+	if ocrCommand != "" {
+		trip.SetOCREngine(trip.CommandOCR(strings.Fields(ocrCommand)))
+		log.Printf("Scanning the receipts with %q\n", ocrCommand)
+	}
+	if speechCommand != "" {
+		trip.SetSpeechToText(trip.CommandSpeech(strings.Fields(speechCommand)))
+		log.Printf("Transcribing the voice notes with %q\n", speechCommand)
+	}
+	dbU, err := url.Parse(dbURL)
+	if err != nil {
+		log.Fatalf("ERROR: failed to parse database URL: %q: %v", dbURL, err)
+	}
+	if dbU.Scheme != "sqlite3" {
+		log.Fatalf("ERROR: unsupported database: %s", dbU.Scheme)
+	}
+
+	db, err := trip.OpenStore(dbU.Scheme, dbU.Path, tablePrefix, slowQuery)
+	if err != nil {
+		log.Fatalf("ERROR: failed to open DB file %q: %v", dbU.Path, err)
+	}
+	if slowQuery > 0 {
+		log.Printf("Logging the queries taking longer than %v\n", slowQuery)
+	}
+	if tablePrefix != "" {
+		log.Printf("Naming the tables with the prefix %s\n", tablePrefix)
+	}
+	log.Printf("Opened DB file at %s\n", dbU.Path)
+	defer db.Close()
+
+	if devMode {
+		setupDev(db)
+	}
+	added, err := trip.UpgradeSchema(context.Background(), db)
+	if err != nil {
+		log.Fatalf("ERROR: failed to upgrade the schema: %v", err)
+	}
+	if added > 0 {
+		log.Printf("Added %d columns to the tables of the DB\n", added)
+	}
+	loadFeatures(db)
+
+	if blockDomainsFile != "" {
+		domains, err := readDomainsFile(blockDomainsFile)
+		if err != nil {
+			log.Fatalf("ERROR: failed to read the blocked domains: %v", err)
+		}
+		blockDomains = append(blockDomains, domains...)
+	}
+	if len(allowDomains) > 0 || len(blockDomains) > 0 {
+		trip.SetDomainPolicy(allowDomains, blockDomains)
+		log.Printf("New users restricted to %d allowed and %d blocked email domains\n", len(allowDomains), len(blockDomains))
+	}
+	if rebuildBalances {
+		err = trip.RebuildAllBalances(context.Background(), db)
+		if err != nil {
+			log.Fatalf("ERROR: failed to rebuild the running balances: %v", err)
+		}
+		log.Printf("Rebuilt the running balances of all trips\n")
+	}
+	schedulePurge(db)
+	runWebhooks(db)
+	err = setupPush()
+	if err != nil {
+		log.Fatal(err)
+	}
+	runPushes(db)
+	scheduleDigests(db)
+	scheduleRecurrences(db)
+	setupNotifications(db)
+	setupSheets(db)
+	setupFederation(db)
+	expenseBursts = trip.NewBurstDetector(burstExpenses, burstWindow, burstQuarantine)
+
+	// gin.Default() without its logger, replaced by requestLogger()
+	router := gin.New()
+	router.Use(gin.Recovery(), middlewareWrapper(bodyLimit))
+	read := middlewareWrapper(requireScope(db, trip.ScopeRead))
+	write := middlewareWrapper(requireScope(db, trip.ScopeWrite))
+	admin := middlewareWrapper(requireScope(db, trip.ScopeAdmin))
+	link := middlewareWrapper(linkToken)
+	// the routes of each version are under its prefix, see versionNegotiation()
+	v1 := router.Group("/v1")
+	v1.POST("/trips", write, handlerWrapper(db, postTrip))
+	v1.GET("/trips/:trip_id", read, handlerWrapper(db, getTrip))
+	v1.PATCH("/trips/:trip_id", write, handlerWrapper(db, patchTrip))
+	v1.POST("/trips/:trip_id/clone", write, handlerWrapper(db, postTripClone))
+	v1.POST("/trips/:trip_id/archive", write, handlerWrapper(db, postTripArchive))
+	v1.DELETE("/trips/:trip_id", write, handlerWrapper(db, deleteTrip))
+	v1.POST("/trips/:trip_id/restore", write, handlerWrapper(db, postTripRestore))
+	v1.GET("/:owner/trips", read, handlerWrapper(db, getTrips))
+	v1.GET("/trips/search", read, handlerWrapper(db, searchTrips))
+	v1.POST("/trips/:trip_id/expenses", write, handlerWrapper(db, postExpense))
+	v1.POST("/trips/:trip_id/expenses/preview", write, handlerWrapper(db, previewExpense))
+	v1.POST("/trips/:trip_id/expenses/draft", write, handlerWrapper(db, draftExpense))
+	v1.POST("/trips/:trip_id/expenses/draft/voice", write, handlerWrapper(db, draftVoiceExpense))
+	v1.GET("/trips/:trip_id/expenses", read, handlerWrapper(db, getExpenses))
+	v1.POST("/trips/:trip_id/expenses/:expense_id/receipts", write, handlerWrapper(db, postReceipt))
+	v1.GET("/trips/:trip_id/expenses/:expense_id/receipts", read, handlerWrapper(db, getReceipts))
+	v1.GET("/trips/:trip_id/expenses/:expense_id/receipts/:receipt_id", read, handlerWrapper(db, getReceipt))
+	v1.POST("/trips/:trip_id/expenses/:expense_id/voice-notes", write, handlerWrapper(db, postVoiceNote))
+	v1.GET("/trips/:trip_id/expenses/:expense_id/voice-notes", read, handlerWrapper(db, getVoiceNotes))
+	v1.GET("/trips/:trip_id/expenses/:expense_id/voice-notes/:voice_note_id", read, handlerWrapper(db, getVoiceNote))
+	v1.GET("/trips/:trip_id/expenses.csv", read, handlerWrapper(db, getExpensesCSV))
+	v1.DELETE("/trips/:trip_id/expenses/:expense_id", write, handlerWrapper(db, deleteExpense))
+	v1.POST("/trips/:trip_id/expenses/:expense_id/restore", write, handlerWrapper(db, postExpenseRestore))
+	v1.POST("/trips/:trip_id/participants", write, handlerWrapper(db, postParticipants))
+	v1.DELETE("/trips/:trip_id/participants/:email", write, handlerWrapper(db, deleteParticipant))
+	v1.POST("/trips/:trip_id/participants/:email/reassign", write, handlerWrapper(db, postReassign))
+	v1.GET("/trips/:trip_id/participants", read, handlerWrapper(db, getParticipants))
+	v1.PUT("/trips/:trip_id/participants/:email/rsvp", write, handlerWrapper(db, putRSVP))
+	v1.GET("/trips/:trip_id/settlement", read, handlerWrapper(db, getSettlement))
+	v1.POST("/trips/:trip_id/settle", write, handlerWrapper(db, postSettle))
+	v1.GET("/trips/:trip_id/settlement/preview", read, handlerWrapper(db, getSettlementPreview))
+	v1.GET("/trips/:trip_id/settlement/signed", read, handlerWrapper(db, getSignedSettlement))
+	v1.GET("/trips/:trip_id/events", read, handlerWrapper(db, getTripEvents))
+	v1.GET("/trips/:trip_id/ws", link, read, handlerWrapper(db, getTripWS))
+	v1.GET("/trips/:trip_id/settlement.pdf", read, handlerWrapper(db, getSettlementPDF))
+	v1.GET("/trips/:trip_id/export.xlsx", read, handlerWrapper(db, getExportXLSX))
+	v1.GET("/trips/:trip_id/balances", read, handlerWrapper(db, getBalances))
+	v1.GET("/trips/:trip_id/forbidden_transfers", read, handlerWrapper(db, getForbiddenTransfers))
+	v1.PUT("/trips/:trip_id/forbidden_transfers", write, handlerWrapper(db, putForbiddenTransfers))
+	v1.GET("/trips/:trip_id/households", read, handlerWrapper(db, getHouseholds))
+	v1.PUT("/trips/:trip_id/households", write, handlerWrapper(db, putHouseholds))
+	v1.GET("/trips/:trip_id/settings", read, handlerWrapper(db, getSettings))
+	v1.PUT("/trips/:trip_id/settings", write, handlerWrapper(db, putSettings))
+	v1.GET("/trips/:trip_id/sheet", read, handlerWrapper(db, getTripSheet))
+	v1.PUT("/trips/:trip_id/sheet", write, handlerWrapper(db, putTripSheet))
+	v1.DELETE("/trips/:trip_id/sheet", write, handlerWrapper(db, deleteTripSheet))
+	v1.POST("/trips/:trip_id/sheet/refresh", write, handlerWrapper(db, postTripSheetRefresh))
+	v1.GET("/trips/:trip_id/features", read, handlerWrapper(db, getTripFeatures))
+	v1.GET("/trips/:trip_id/recurrences", read, handlerWrapper(db, getRecurrences))
+	v1.DELETE("/trips/:trip_id/recurrences/:recurrence_id", write, handlerWrapper(db, deleteRecurrence))
+	v1.GET("/trips/:trip_id/recurrences/suggestions", read, handlerWrapper(db, getRecurrenceSuggestions))
+	v1.POST("/trips/:trip_id/recurrences/suggestions/:suggestion_id/accept", write, handlerWrapper(db, postSuggestionAccept))
+	v1.PUT("/trips/:trip_id/organizer_fee", write, handlerWrapper(db, putOrganizerFee))
+	v1.PUT("/trips/:trip_id/approval_required", write, handlerWrapper(db, putApprovalRequired))
+	v1.GET("/trips/:trip_id/approvals", read, handlerWrapper(db, getApprovals))
+	v1.PUT("/trips/:trip_id/participants/:email/approval", write, handlerWrapper(db, putApproval))
+	v1.GET("/trips/:trip_id/delegation", read, handlerWrapper(db, getDelegation))
+	v1.PUT("/trips/:trip_id/delegation", write, handlerWrapper(db, putDelegation))
+	v1.DELETE("/trips/:trip_id/delegation", write, handlerWrapper(db, deleteDelegation))
+	v1.GET("/trips/:trip_id/freeze", read, handlerWrapper(db, getFreeze))
+	v1.PUT("/trips/:trip_id/freeze", write, handlerWrapper(db, putFreeze))
+	v1.DELETE("/trips/:trip_id/freeze", write, handlerWrapper(db, deleteFreeze))
+	v1.POST("/trips/:trip_id/invites", write, handlerWrapper(db, postInvite))
+	v1.GET("/trips/:trip_id/messages", read, handlerWrapper(db, getMessages))
+	v1.POST("/trips/:trip_id/messages", write, handlerWrapper(db, postMessage))
+	v1.PATCH("/trips/:trip_id/messages/:message_id", write, handlerWrapper(db, patchMessage))
+	v1.DELETE("/trips/:trip_id/messages/:message_id", write, handlerWrapper(db, deleteMessage))
+	v1.GET("/trips/:trip_id/payments", read, handlerWrapper(db, getPayments))
+	v1.POST("/trips/:trip_id/payments", write, handlerWrapper(db, postPayment))
+	v1.DELETE("/trips/:trip_id/payments/:payment_id", write, handlerWrapper(db, deletePayment))
+	// the link mailed to the payer is the proof
+	v1.GET("/paid/:token", handlerWrapper(db, getPaid))
+	v1.POST("/join/:token", write, handlerWrapper(db, postJoin))
+	// the invite mailed, addressed to the user, is the proof
+	v1.GET("/join/:token", handlerWrapper(db, getJoin))
+	v1.GET("/trips/:trip_id/quarantine", read, handlerWrapper(db, getQuarantine))
+	v1.POST("/trips/:trip_id/quarantine/:quarantine_id/release", write, handlerWrapper(db, postQuarantineRelease))
+	v1.DELETE("/trips/:trip_id/quarantine/:quarantine_id", write, handlerWrapper(db, deleteQuarantined))
+	v1.GET("/trips/:trip_id/reviews", read, handlerWrapper(db, getReviews))
+	v1.POST("/trips/:trip_id/reviews", write, handlerWrapper(db, postReview))
+	v1.PUT("/trips/:trip_id/reviews/:review_id", write, handlerWrapper(db, putReview))
+	v1.POST("/trips/:trip_id/reviews/:review_id/confirm", write, handlerWrapper(db, postReviewConfirm))
+	v1.DELETE("/trips/:trip_id/reviews/:review_id", write, handlerWrapper(db, deleteReview))
+	v1.GET("/trips/:trip_id/federation", read, handlerWrapper(db, getFederation))
+	v1.POST("/trips/:trip_id/federation", write, handlerWrapper(db, postFederation))
+	v1.DELETE("/trips/:trip_id/federation/:federation_id", write, handlerWrapper(db, deleteFederation))
+	v1.POST("/trips/:trip_id/federation/:federation_id/sync", write, handlerWrapper(db, postFederationSync))
+	// the peers sign their requests rather than holding a token
+	v1.POST("/federation/trips/:trip_id/sync", middlewareWrapper(federationGuard()), handlerWrapper(db, postFederationInbound))
+	v1.GET("/trips/:trip_id/preferences/:email", read, handlerWrapper(db, getCostPreference))
+	v1.PUT("/trips/:trip_id/preferences/:email", write, handlerWrapper(db, putCostPreference))
+	v1.GET("/trips/:trip_id/survey", read, handlerWrapper(db, getCostSurvey))
+	v1.GET("/trips/:trip_id/envelopes", read, handlerWrapper(db, getEnvelopes))
+	v1.PUT("/trips/:trip_id/envelopes", write, handlerWrapper(db, putEnvelopes))
+	v1.GET("/trips/:trip_id/envelopes/status", read, handlerWrapper(db, getEnvelopeStatus))
+	v1.GET("/trips/:trip_id/add", link, write, handlerWrapper(db, getExpenseForm))
+	v1.GET("/trips/:trip_id/snapshot", read, handlerWrapper(db, getSnapshot))
+	v1.GET("/trips/:trip_id/statements/:email", read, handlerWrapper(db, getStatement))
+	v1.GET("/trips/:trip_id/audit", read, handlerWrapper(db, getTripAuditLog))
+	v1.GET("/trips/:trip_id/audit/export", read, handlerWrapper(db, getTripAuditExport))
+	v1.GET("/audit/export", admin, handlerWrapper(db, getAuditExport))
+	v1.GET("/users/:email", read, handlerWrapper(db, getUser))
+	v1.GET("/users/:email/caps", read, handlerWrapper(db, getSpendCaps))
+	v1.GET("/users/:email/digest", read, handlerWrapper(db, getDigest))
+	v1.GET("/users/:email/balances", read, handlerWrapper(db, getUserBalances))
+	v1.GET("/users/:email/groups", read, handlerWrapper(db, getGroups))
+	v1.GET("/users/:email/groups/:name", read, handlerWrapper(db, getGroup))
+	v1.PUT("/users/:email/groups/:name", write, handlerWrapper(db, putGroup))
+	v1.DELETE("/users/:email/groups/:name", write, handlerWrapper(db, deleteGroup))
+	v1.GET("/users/:email/devices", read, handlerWrapper(db, getDevices))
+	v1.GET("/admin/stats", admin, handlerWrapper(db, getStats))
+	v1.POST("/admin/trips/complete", admin, handlerWrapper(db, bulkTrips("complete")))
+	v1.POST("/admin/trips/archive", admin, handlerWrapper(db, bulkTrips("archive")))
+	v1.POST("/admin/trips/export", admin, handlerWrapper(db, bulkTrips("export")))
+	v1.GET("/admin/jobs/:job_id", admin, handlerWrapper(db, getJob))
+	v1.GET("/admin/jobs/:job_id/result", admin, handlerWrapper(db, getJobResult))
+	v1.GET("/admin/purge", admin, handlerWrapper(db, getPurge))
+	v1.GET("/admin/bursts", admin, handlerWrapper(db, getBursts))
+	v1.GET("/admin/features", admin, handlerWrapper(db, getFeatures))
+	v1.PUT("/admin/features/:feature", admin, handlerWrapper(db, putFeature))
+	v1.DELETE("/admin/features/:feature", admin, handlerWrapper(db, deleteFeature))
+	v1.POST("/admin/webhooks", admin, handlerWrapper(db, postWebhook))
+	v1.GET("/admin/webhooks", admin, handlerWrapper(db, getWebhooks))
+	v1.DELETE("/admin/webhooks/:webhook_id", admin, handlerWrapper(db, deleteWebhook))
+	v1.POST("/admin/purge", admin, handlerWrapper(db, postPurge))
+	v1.PUT("/users/:email/caps", write, handlerWrapper(db, putSpendCap))
+	v1.POST("/users/:email/devices", write, handlerWrapper(db, postDevice))
+	v1.DELETE("/users/:email/devices/:device_id", write, handlerWrapper(db, deleteDevice))
+	v1.PATCH("/users/:email", write, handlerWrapper(db, patchUser))
+	v1.PUT("/users/:email/avatar", write, handlerWrapper(db, putAvatar))
+	v1.DELETE("/users/:email/avatar", write, handlerWrapper(db, deleteAvatar))
+	v1.PUT("/users/:email/payment_handles", write, handlerWrapper(db, putPaymentHandles))
+	v1.POST("/users/:email/google", write, handlerWrapper(db, postGoogleConnect))
+	v1.DELETE("/users/:email/google", write, handlerWrapper(db, deleteGoogleConnect))
+	v1.DELETE("/users/:email", write, handlerWrapper(db, deleteUser))
+	v1.POST("/users/:email/verification", write, handlerWrapper(db, postVerification))
+	// the secret of the link mailed is the proof, no token is needed
+	v1.GET("/verify", handlerWrapper(db, getVerify))
+	// the branding is public, for the clients to show before any login
+	v1.GET("/meta", handlerWrapper(db, getMeta))
+	// the avatars are public, for the pages to show them without a token
+	v1.GET("/avatars/:avatar", handlerWrapper(db, getAvatar))
+	// the signature is the proof, anyone given a settlement can check it
+	v1.POST("/settlements/verify", handlerWrapper(db, postSettlementVerify))
+	v1.POST("/login", handlerWrapper(db, postLogin))
+	v1.GET("/login", handlerWrapper(db, getLogin))
+	v1.GET("/login/oidc", handlerWrapper(db, getOIDCLogin))
+	v1.GET("/login/oidc/callback", handlerWrapper(db, getOIDCCallback))
+	v1.GET("/google/callback", handlerWrapper(db, getGoogleCallback))
+	v1.POST("/users/:email/tokens", admin, handlerWrapper(db, postToken))
+	v1.GET("/users/:email/tokens", admin, handlerWrapper(db, getTokens))
+	v1.POST("/tokens/:token_id/rotate", admin, handlerWrapper(db, postTokenRotation))
+	v1.DELETE("/tokens/:token_id", admin, handlerWrapper(db, deleteToken))
+	spec, docs := serveAPIDocs(ginRoutes(router), v1.BasePath())
+	v1.GET("/openapi.json", gin.WrapF(spec))
+	v1.GET("/docs", gin.WrapF(docs))
+
+	// the logger and the error rates record the status of the responses,
+	// which middlewareWrapper() doesn't pass on, they wrap the router
+	handler := requestLogger(requestErrors.middleware(router))
+	bindAddr := fmt.Sprintf(":%d", port)
+	err = serve(bindAddr, versionNegotiation(handler))
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
 }
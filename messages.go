@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// messageJSON is used for POST to post a message to the thread of a trip,
+// and for PATCH to edit one
+type messageJSON struct {
+	// Text is at most 4000 characters
+	Text string `json:"text" binding:"required,max=4000"`
+	// Author is the participant posting, the user of the token if empty,
+	// it's ignored by PATCH
+	Author string `json:"author" binding:"omitempty,email_address"`
+}
+
+// getMessages returns a page of the thread of a trip, the oldest message
+// first
+func getMessages(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	page, err := listPage(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	messages, err := trip.LoadMessages(requestContext(r), db, tripID, page)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	setNextOffset(w, r, page, len(messages))
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// postMessage posts a message of a participant to the thread of a trip, as
+// the user of the token
+func postMessage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var mj messageJSON
+	err := bindJSON(r, &mj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	author := mj.Author
+	if tok := requestToken(r); tok != nil && author == "" {
+		author = tok.Email
+	}
+	if author == "" {
+		jsonBail(w, r, http.StatusBadRequest, errors.New("the author of the message is required"))
+		return
+	}
+	if !actsFor(r, author) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("a message can only be posted as yourself"))
+		return
+	}
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	m, err := t.PostMessage(requestContext(r), db, author, mj.Text)
+	switch {
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// loadMessage returns the message of the path, bailing out if it doesn't
+// exist
+func loadMessage(w http.ResponseWriter, r *http.Request, db *sql.DB) (*trip.Message, bool) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	messageID, err := strconv.ParseInt(r.PathValue("message_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	m, err := trip.LoadMessage(requestContext(r), db, tripID, messageID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return nil, false
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return m, true
+}
+
+// patchMessage edits the text of a message, for its author only
+func patchMessage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var mj messageJSON
+	err := bindJSON(r, &mj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	m, ok := loadMessage(w, r, db)
+	if !ok {
+		return
+	}
+	if !actsFor(r, m.Author) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the author can edit their message"))
+		return
+	}
+	err = m.Edit(requestContext(r), db, mj.Text)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// deleteMessage deletes a message, for its author or the owner of the
+// trip only
+func deleteMessage(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	m, ok := loadMessage(w, r, db)
+	if !ok {
+		return
+	}
+	if !actsFor(r, m.Author) {
+		t, ok := loadTrip(w, r, db)
+		if !ok {
+			return
+		}
+		if !actsFor(r, t.Owner.Email) {
+			jsonBail(w, r, http.StatusForbidden, errors.New("only the author or the owner of the trip can delete a message"))
+			return
+		}
+	}
+	err := trip.DeleteMessage(requestContext(r), db, m.TripID, m.ID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+
+	"github.com/dvusboy/trip-accountant/trip"
+	flag "github.com/spf13/pflag"
+)
+
+// openDataURL opens the database of a URL for the commands, sqlite3:// with
+// a file path, or postgres:// which is passed to the driver as is, its
+// tables named with the prefix
+func openDataURL(dataURL, prefix string) (*sql.DB, trip.Dialect, error) {
+	u, err := url.Parse(dataURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse database URL: %q: %w", dataURL, err)
+	}
+	dialect := trip.Dialect(u.Scheme)
+	dsn := dataURL
+	switch dialect {
+	case trip.DialectSQLite3:
+		dsn = u.Path
+	case trip.DialectPostgres:
+	default:
+		return nil, "", fmt.Errorf("unsupported database: %s", u.Scheme)
+	}
+	if !slices.Contains(sql.Drivers(), u.Scheme) {
+		return nil, "", fmt.Errorf("the %s driver isn't built in this server", u.Scheme)
+	}
+	db, err := trip.OpenStore(u.Scheme, dsn, prefix, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return db, dialect, db.Ping()
+}
+
+// migrateData is the migrate-data command, it copies the data of the
+// database of --from into the one of --to, see trip.MigrateData()
+func migrateData(args []string) {
+	fs := flag.NewFlagSet("migrate-data", flag.ExitOnError)
+	from := fs.String("from", "", "URL of the database to copy, e.g. sqlite3:///srv/trip-accountant/data/trips.db")
+	to := fs.String("to", "", "URL of the database to copy into, with the schema created and no data, e.g. postgres://user@host/trips")
+	fromPrefix := fs.String("from-prefix", "", "prefix of the names of the tables of --from, see --table-prefix")
+	toPrefix := fs.String("to-prefix", "", "prefix of the names of the tables of --to, see --table-prefix")
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		log.Fatalf("ERROR: migrate-data needs --from and --to")
+	}
+
+	src, _, err := openDataURL(*from, *fromPrefix)
+	if err != nil {
+		log.Fatalf("ERROR: failed to open the source database: %v", err)
+	}
+	defer src.Close()
+	dst, dialect, err := openDataURL(*to, *toPrefix)
+	if err != nil {
+		log.Fatalf("ERROR: failed to open the destination database: %v", err)
+	}
+	defer dst.Close()
+
+	tables, err := trip.MigrateData(context.Background(), src, dst, dialect)
+	if err != nil {
+		log.Fatalf("ERROR: migration failed: %v", err)
+	}
+	rows := 0
+	for _, t := range tables {
+		rows += t.Rows
+	}
+	log.Printf("Migrated and verified %d rows in %d tables\n", rows, len(tables))
+}
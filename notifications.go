@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/dvusboy/trip-accountant/notify"
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// notifyChannel is the channel the notifications are sent through:
+	// email, webhook or none
+	notifyChannel = "none"
+	// notifyURL is the URL the webhook channel POSTs the notifications to
+	notifyURL string
+	// notifySecret signs the notifications POSTed to notifyURL
+	notifySecret string
+	// telegramBotToken is the token of the Telegram bot posting to the
+	// chats of the trips, none are posted to if empty
+	telegramBotToken string
+)
+
+// setupNotifications notifies the people of the trips, through the channel
+// of notifyChannel, of what they pay and receive once a trip is completed,
+// and of the spend caps their share of the expenses reaches. It posts the
+// expenses and the settlement of a trip to its group chats, set in its
+// settings, and notifies both its owner and its group chats of the budget
+// envelopes blown. The notifications are sent in the background, so that
+// they don't hold the requests.
+func setupNotifications(db *sql.DB) {
+	client := &http.Client{Timeout: webhookTimeout}
+	n, err := notify.New(notifyChannel, sendMail, notifyURL, notifySecret, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := n.(notify.Noop); !ok {
+		log.Printf("Notifying the completion of the trips by %s\n", notifyChannel)
+	}
+	trip.CompletionHook = func(ctx context.Context, t *trip.Trip, s trip.Settlement) {
+		ctx = context.WithoutCancel(ctx)
+		notes := notify.TripCompleted(t, s, paidLinker(ctx, t.ID))
+		summary := notify.SettlementSummary(t, s)
+		go func() {
+			notify.Send(ctx, n, notes)
+			notifyChats(ctx, db, client, summary)
+		}()
+	}
+	trip.SpendAlertHook = func(ctx context.Context, t *trip.Trip, a trip.SpendAlert) {
+		note := notify.SpendCapCrossed(t, a)
+		go notify.Send(context.WithoutCancel(ctx), n, []notify.Notification{note})
+	}
+	trip.EnvelopeAlertHook = func(ctx context.Context, t *trip.Trip, a trip.EnvelopeAlert) {
+		ctx = context.WithoutCancel(ctx)
+		note := notify.EnvelopeBlown(t, a)
+		go func() {
+			notify.Send(ctx, n, []notify.Notification{note})
+			notifyChats(ctx, db, client, note)
+		}()
+	}
+	trip.ExpenseHook = func(ctx context.Context, t *trip.Trip, e *trip.Expense) {
+		note := notify.ExpenseAdded(t, e)
+		go notifyChats(context.WithoutCancel(ctx), db, client, note)
+	}
+}
+
+// notifyChats posts the notification to the group chats of its trip
+func notifyChats(ctx context.Context, db *sql.DB, client *http.Client, note notify.Notification) {
+	s, err := trip.LoadSettings(ctx, db, note.TripID)
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to load the settings of trip %d: %v\n", note.TripID, err)
+		return
+	}
+	notify.Send(ctx, notify.ForTrip(s, telegramBotToken, client), []notify.Notification{note})
+}
+
+// getSettings returns the settings of a trip, for the owner only as they
+// hold the webhook of its Slack channel
+func getSettings(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "see its settings")
+	if !ok {
+		return
+	}
+	s, err := trip.LoadSettings(requestContext(r), db, t.ID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// putSettings replaces the settings of a trip, for the owner only
+func putSettings(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var s trip.Settings
+	err := decodeJSON(r, &s)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "change its settings")
+	if !ok {
+		return
+	}
+	err = t.SaveSettings(requestContext(r), db, &s)
+	switch {
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,407 @@
+// Package notify tells the people of the trips what concerns them, e.g.
+// what they pay and receive once a trip is completed, through a pluggable
+// Notifier:
+//
+//   - Email mails the notifications to the people,
+//   - Webhook POSTs them, in JSON, to a URL relaying them, e.g. to a chat,
+//   - Slack and Telegram post them to the group chat of a trip,
+//   - Noop drops them, the default.
+//
+// FCM and APNs push the events of the trips to the mobile devices of
+// their people, as the trip.PushSender of their platform.
+//
+// The notifications of the people of a trip are built by TripCompleted()
+// and SpendCapCrossed(), the ones of its group chats by ExpenseAdded() and
+// SettlementSummary(), the ones of both by EnvelopeBlown(), and sent by
+// Send(), which only logs the failures: a notification is a
+// courtesy, the data stays available from the API.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// The kinds of Notification
+const (
+	// KindTripCompleted tells a person their share of the settlement of a
+	// completed trip, or a group chat the whole settlement
+	KindTripCompleted = "trip.completed"
+	// KindExpenseAdded tells a group chat an expense was added to the trip
+	KindExpenseAdded = "expense.added"
+	// KindSpendCapCrossed tells a person their share of the expenses
+	// crossed one of their spend caps
+	KindSpendCapCrossed = "spend_cap.crossed"
+	// KindEnvelopeBlown tells the owner and the group chats of a trip an
+	// expense blew one of its budget envelopes
+	KindEnvelopeBlown = "envelope.blown"
+)
+
+// telegramAPI is the URL of the Bot API of Telegram
+const telegramAPI = "https://api.telegram.org"
+
+// Notification is a message to a person about a trip
+type Notification struct {
+	// Kind is one of the Kind* constants
+	Kind     string `json:"kind"`
+	TripID   int64  `json:"trip_id"`
+	TripName string `json:"trip_name"`
+	// Recipient is the email address of the person notified, empty for
+	// the group chats of the trip
+	Recipient string `json:"recipient"`
+	Subject   string `json:"subject"`
+	// Text is the body of the notification, for humans
+	Text string `json:"text"`
+	// Pays are the amounts the recipient pays, by payee (in cent)
+	Pays map[string]int `json:"pays"`
+	// Receives are the amounts the recipient receives, by payer (in cent)
+	Receives map[string]int `json:"receives"`
+	// PaidLinks are the links marking the amounts the recipient pays as
+	// paid, by payee, if any
+	PaidLinks map[string]string `json:"paid_links,omitempty"`
+}
+
+// Notifier is a channel the notifications are sent through
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Noop is the Notifier dropping the notifications
+type Noop struct{}
+
+// Notify does nothing
+func (Noop) Notify(ctx context.Context, n Notification) error {
+	return nil
+}
+
+// Email is the Notifier mailing the notifications to their recipients
+type Email struct {
+	// Send mails a plain text email, e.g. with an SMTP server
+	Send func(ctx context.Context, to, subject, body string) error
+}
+
+// Notify mails the notification to its recipient
+func (e Email) Notify(ctx context.Context, n Notification) error {
+	return e.Send(ctx, n.Recipient, n.Subject, n.Text)
+}
+
+// Webhook is the Notifier POSTing the notifications, in JSON, to a URL
+type Webhook struct {
+	URL string
+	// Secret signs the body in the header X-Trip-Accountant-Signature,
+	// like the deliveries of the webhooks of the events, unsigned if empty
+	Secret string
+	Client *http.Client
+}
+
+// Notify POSTs the notification, a status other than 2xx is an error
+func (w Webhook) Notify(ctx context.Context, n Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"X-Trip-Accountant-Event": n.Kind}
+	if w.Secret != "" {
+		headers["X-Trip-Accountant-Signature"] = "sha256=" + trip.SignAudit([]byte(w.Secret), payload)
+	}
+	return postJSON(ctx, w.Client, w.URL, payload, headers)
+}
+
+// Slack is the Notifier posting the notifications to a Slack channel,
+// with its incoming webhook
+type Slack struct {
+	WebhookURL string
+	Client     *http.Client
+}
+
+// Notify posts the notification to the channel
+func (s Slack) Notify(ctx context.Context, n Notification) error {
+	payload, err := json.Marshal(map[string]string{"text": "*" + n.Subject + "*\n" + n.Text})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.Client, s.WebhookURL, payload, nil)
+}
+
+// Telegram is the Notifier posting the notifications to a Telegram chat,
+// with a bot of the server
+type Telegram struct {
+	// Token is the token of the bot, given by @BotFather
+	Token  string
+	ChatID string
+	Client *http.Client
+	// APIURL is the URL of the Bot API, telegramAPI if empty
+	APIURL string
+}
+
+// Notify posts the notification to the chat
+func (t Telegram) Notify(ctx context.Context, n Notification) error {
+	payload, err := json.Marshal(map[string]string{"chat_id": t.ChatID, "text": n.Subject + "\n\n" + n.Text})
+	if err != nil {
+		return err
+	}
+	api := t.APIURL
+	if api == "" {
+		api = telegramAPI
+	}
+	return postJSON(ctx, t.Client, api+"/bot"+t.Token+"/sendMessage", payload, nil)
+}
+
+// Multi is the Notifier sending the notifications through each of its
+// Notifier
+type Multi []Notifier
+
+// Notify sends the notification through each Notifier, the errors are
+// joined
+func (m Multi) Notify(ctx context.Context, n Notification) error {
+	var errs []error
+	for _, notifier := range m {
+		errs = append(errs, notifier.Notify(ctx, n))
+	}
+	return errors.Join(errs...)
+}
+
+// postJSON POSTs the payload, a status other than 2xx is an error
+func postJSON(ctx context.Context, client *http.Client, target string, payload []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "trip-accountant")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient(client).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// New returns the Notifier of the channel: email, webhook, or none (or
+// empty) for Noop. The webhook channel requires the URL.
+func New(channel string, send func(ctx context.Context, to, subject, body string) error, url, secret string, client *http.Client) (Notifier, error) {
+	switch channel {
+	case "", "none":
+		return Noop{}, nil
+	case "email":
+		return Email{Send: send}, nil
+	case "webhook":
+		if url == "" {
+			return nil, errors.New("the webhook notifications require a URL")
+		}
+		return Webhook{URL: url, Secret: secret, Client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown notification channel %q: email, webhook or none", channel)
+}
+
+// ForTrip returns the Notifier of the group chats set in the settings of a
+// trip, the Telegram chat requiring the token of the bot of the server. It
+// has no Notifier if there's none.
+func ForTrip(s *trip.Settings, telegramToken string, client *http.Client) Multi {
+	var rslt Multi
+	if s.SlackWebhookURL != "" {
+		rslt = append(rslt, Slack{WebhookURL: s.SlackWebhookURL, Client: client})
+	}
+	if s.TelegramChatID != "" && telegramToken != "" {
+		rslt = append(rslt, Telegram{Token: telegramToken, ChatID: s.TelegramChatID, Client: client})
+	}
+	return rslt
+}
+
+// ExpenseAdded returns the notification of the expense added to the trip,
+// for its group chats
+func ExpenseAdded(t *trip.Trip, e *trip.Expense) Notification {
+	var amount int
+	var payers []string
+	for _, p := range e.Participants {
+		amount += p.Paid
+		if p.Paid > 0 {
+			payers = append(payers, p.Email)
+		}
+	}
+	sort.Strings(payers)
+	text := fmt.Sprintf("%s on %s: %s, paid by %s, shared by %d.\nTotal of the trip: %s\n",
+		e.Description, e.Date.Format(time.DateOnly), cents(amount), strings.Join(payers, ", "),
+		len(e.Participants), cents(t.Summary().Total))
+	return Notification{
+		Kind:     KindExpenseAdded,
+		TripID:   t.ID,
+		TripName: t.Name,
+		Subject:  fmt.Sprintf("New expense on %s", t.Name),
+		Text:     text,
+	}
+}
+
+// SettlementSummary returns the notification of the completion of the
+// trip, with its whole settlement, for its group chats
+func SettlementSummary(t *trip.Trip, s trip.Settlement) Notification {
+	var b strings.Builder
+	lines := s.Lines()
+	if len(lines) == 0 {
+		b.WriteString("Nobody has anything to pay.\n")
+	} else {
+		b.WriteString("To settle it:\n")
+	}
+	for _, line := range lines {
+		b.WriteString("  " + line + "\n")
+	}
+	return Notification{
+		Kind:     KindTripCompleted,
+		TripID:   t.ID,
+		TripName: t.Name,
+		Subject:  fmt.Sprintf("The trip %s is completed", t.Name),
+		Text:     b.String(),
+	}
+}
+
+// TripCompleted returns the notifications of the completion of the trip,
+// one for the owner and each participant, with what they pay and receive
+// in its settlement. paidLink, if not nil, returns the link marking what a
+// payer pays a payee as paid, "" if none.
+func TripCompleted(t *trip.Trip, s trip.Settlement, paidLink func(payer, payee string, amount int) string) []Notification {
+	people := []string{t.Owner.Email}
+	for _, p := range t.Participants {
+		people = append(people, p.Email)
+	}
+	rslt := make([]Notification, 0, len(people))
+	for _, email := range people {
+		n := Notification{
+			Kind:      KindTripCompleted,
+			TripID:    t.ID,
+			TripName:  t.Name,
+			Recipient: email,
+			Subject:   fmt.Sprintf("The trip %s is completed", t.Name),
+			Pays:      map[string]int{},
+			Receives:  map[string]int{},
+		}
+		for payee, amount := range s[email] {
+			n.Pays[payee] = amount
+			if paidLink == nil || amount <= 0 {
+				continue
+			}
+			if link := paidLink(email, payee, amount); link != "" {
+				if n.PaidLinks == nil {
+					n.PaidLinks = map[string]string{}
+				}
+				n.PaidLinks[payee] = link
+			}
+		}
+		for payer, payments := range s {
+			if amount, ok := payments[email]; ok {
+				n.Receives[payer] = amount
+			}
+		}
+		n.Text = completedText(t.Name, n.Pays, n.Receives, n.PaidLinks)
+		rslt = append(rslt, n)
+	}
+	return rslt
+}
+
+// SpendCapCrossed returns the notification of the person whose share of
+// the expenses crossed one of their caps, with an expense of the trip
+func SpendCapCrossed(t *trip.Trip, a trip.SpendAlert) Notification {
+	spent := fmt.Sprintf("of the trip %q", t.Name)
+	if a.Cap.TripID == 0 {
+		spent = "of the month, across your trips,"
+	}
+	return Notification{
+		Kind:      KindSpendCapCrossed,
+		TripID:    t.ID,
+		TripName:  t.Name,
+		Recipient: a.Email,
+		Subject:   fmt.Sprintf("Your spend cap is reached on %s", t.Name),
+		Text: fmt.Sprintf("Your share of the expenses %s is %s, reaching your cap of %s.\n",
+			spent, cents(a.Spent), cents(a.Cap.Amount)),
+	}
+}
+
+// EnvelopeBlown returns the notification of the owner of the trip, also
+// posted to its group chats, of an expense blowing one of its envelopes
+func EnvelopeBlown(t *trip.Trip, a trip.EnvelopeAlert) Notification {
+	envelope := fmt.Sprintf("The %s envelope", a.Envelope.Category)
+	if a.Envelope.Daily {
+		envelope = fmt.Sprintf("The %s envelope of %s", a.Envelope.Category, a.Date.Format(time.DateOnly))
+	}
+	return Notification{
+		Kind:      KindEnvelopeBlown,
+		TripID:    t.ID,
+		TripName:  t.Name,
+		Recipient: t.Owner.Email,
+		Subject:   fmt.Sprintf("An envelope of %s is blown", t.Name),
+		Text:      fmt.Sprintf("%s is blown by %s.\n", envelope, cents(a.Over)),
+	}
+}
+
+// completedText lays out what a person pays, with the links marking it as
+// paid, and receives, sorted by email address
+func completedText(name string, pays, receives map[string]int, paidLinks map[string]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "The trip %q is completed, here is your share of its settlement.\n", name)
+	if len(pays) == 0 && len(receives) == 0 {
+		b.WriteString("\nYou have nothing to pay nor to receive.\n")
+	}
+	for _, line := range amountLines("You pay %s: %s", pays, paidLinks) {
+		b.WriteString("\n" + line)
+	}
+	for _, line := range amountLines("%s pays you: %s", receives, nil) {
+		b.WriteString("\n" + line)
+	}
+	if len(pays) > 0 || len(receives) > 0 {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// amountLines formats the amounts, by email address, with the format
+// taking the address and the amount, each followed by its link marking it
+// as paid if any
+func amountLines(format string, amounts map[string]int, paidLinks map[string]string) []string {
+	emails := make([]string, 0, len(amounts))
+	for email := range amounts {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	rslt := make([]string, 0, len(emails))
+	for _, email := range emails {
+		line := fmt.Sprintf(format, email, cents(amounts[email]))
+		if link := paidLinks[email]; link != "" {
+			line += "\n  Once paid, mark it as paid: " + link
+		}
+		rslt = append(rslt, line)
+	}
+	return rslt
+}
+
+// cents formats an amount in cent
+func cents(amount int) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+// Send sends the notifications through the Notifier, logging the failures
+func Send(ctx context.Context, n Notifier, notes []Notification) {
+	for _, note := range notes {
+		err := n.Notify(ctx, note)
+		if err != nil {
+			recipient := note.Recipient
+			if recipient == "" {
+				recipient = "the group chats"
+			}
+			trip.Logf(ctx, "ERROR: failed to notify %s of %s of trip %d: %v\n", recipient, note.Kind, note.TripID, err)
+		}
+	}
+}
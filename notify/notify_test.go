@@ -0,0 +1,210 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// completed returns the notifications of a trip of alice with bob and
+// charlie, bob paying alice 12.50 and charlie nothing
+func completed() []Notification {
+	t := trip.NewTrip("Lisbon", "alice@test.com", "", trip.NewDate(time.Now()), []string{"bob@test.com", "charlie@test.com"})
+	t.ID = 7
+	s := trip.Settlement{"bob@test.com": {"alice@test.com": 1250}}
+	return TripCompleted(t, s, func(payer, payee string, amount int) string {
+		return fmt.Sprintf("https://trips.test/v1/paid/%s-%s-%d", payer, payee, amount)
+	})
+}
+
+// TestTripCompleted checks each person is told their share
+func TestTripCompleted(t *testing.T) {
+	notes := completed()
+	if len(notes) != 3 {
+		t.Fatalf("expected a notification per person, got %+v", notes)
+	}
+	for _, c := range []struct {
+		recipient string
+		pays      map[string]int
+		receives  map[string]int
+		links     map[string]string
+		text      string
+	}{
+		{"alice@test.com", map[string]int{}, map[string]int{"bob@test.com": 1250}, nil, "bob@test.com pays you: 12.50"},
+		{"bob@test.com", map[string]int{"alice@test.com": 1250}, map[string]int{},
+			map[string]string{"alice@test.com": "https://trips.test/v1/paid/bob@test.com-alice@test.com-1250"},
+			"You pay alice@test.com: 12.50\n  Once paid, mark it as paid: https://trips.test/v1/paid/bob@test.com-alice@test.com-1250"},
+		{"charlie@test.com", map[string]int{}, map[string]int{}, nil, "nothing to pay nor to receive"},
+	} {
+		var n *Notification
+		for i := range notes {
+			if notes[i].Recipient == c.recipient {
+				n = &notes[i]
+			}
+		}
+		if n == nil {
+			t.Errorf("expected a notification of %s", c.recipient)
+			continue
+		}
+		if n.Kind != KindTripCompleted || n.TripID != 7 || !reflect.DeepEqual(n.Pays, c.pays) || !reflect.DeepEqual(n.Receives, c.receives) || !reflect.DeepEqual(n.PaidLinks, c.links) {
+			t.Errorf("unexpected notification of %s: %+v", c.recipient, n)
+		}
+		if !strings.Contains(n.Text, c.text) {
+			t.Errorf("expected the text of %s to contain %q, got %q", c.recipient, c.text, n.Text)
+		}
+	}
+}
+
+// TestSpendCapCrossed checks the person is told which cap their share
+// reached
+func TestSpendCapCrossed(t *testing.T) {
+	tr := trip.NewTrip("Lisbon", "alice@test.com", "", trip.NewDate(time.Now()), []string{"bob@test.com"})
+	tr.ID = 7
+	n := SpendCapCrossed(tr, trip.SpendAlert{Email: "bob@test.com", Cap: trip.SpendCap{TripID: 7, Amount: 3000}, Spent: 3500})
+	if n.Kind != KindSpendCapCrossed || n.Recipient != "bob@test.com" || n.TripID != 7 ||
+		!strings.Contains(n.Text, `of the trip "Lisbon" is 35.00, reaching your cap of 30.00`) {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	n = SpendCapCrossed(tr, trip.SpendAlert{Email: "bob@test.com", Cap: trip.SpendCap{Amount: 100000}, Spent: 100500})
+	if !strings.Contains(n.Text, "of the month, across your trips, is 1005.00") {
+		t.Errorf("expected the monthly cap in %q", n.Text)
+	}
+}
+
+// TestEnvelopeBlown checks the owner is told which envelope is blown, on
+// which day for a daily one
+func TestEnvelopeBlown(t *testing.T) {
+	tr := trip.NewTrip("Lisbon", "alice@test.com", "", trip.NewDate(time.Now()), []string{"bob@test.com"})
+	tr.ID = 7
+	day := trip.NewDate(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC))
+	n := EnvelopeBlown(tr, trip.EnvelopeAlert{TripID: 7, Envelope: trip.Envelope{Category: "food", Amount: 5000, Daily: true}, Date: day, Over: 500})
+	if n.Kind != KindEnvelopeBlown || n.Recipient != "alice@test.com" || n.Text != "The food envelope of 2024-05-02 is blown by 5.00.\n" {
+		t.Errorf("unexpected notification %+v", n)
+	}
+	n = EnvelopeBlown(tr, trip.EnvelopeAlert{TripID: 7, Envelope: trip.Envelope{Category: "lodging", Amount: 30000}, Date: day, Over: 1000})
+	if n.Text != "The lodging envelope is blown by 10.00.\n" {
+		t.Errorf("unexpected text %q", n.Text)
+	}
+}
+
+// TestNotifiers sends the notifications through the channels
+func TestNotifiers(t *testing.T) {
+	ctx := context.Background()
+	notes := completed()
+
+	mailed := map[string]string{}
+	n, err := New("email", func(_ context.Context, to, subject, body string) error {
+		mailed[to] = subject
+		return nil
+	}, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Send(ctx, n, notes)
+	if len(mailed) != 3 || mailed["bob@test.com"] != "The trip Lisbon is completed" {
+		t.Errorf("unexpected emails %v", mailed)
+	}
+
+	var posted []Notification
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := Notification{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || r.Header.Get("X-Trip-Accountant-Signature") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		posted = append(posted, body)
+	}))
+	defer srv.Close()
+	n, err = New("webhook", nil, srv.URL, "secret", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, note := range notes {
+		err = n.Notify(ctx, note)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(posted, notes) {
+		t.Errorf("expected %+v posted, got %+v", notes, posted)
+	}
+	err = Webhook{URL: srv.URL + "/missing", Client: srv.Client()}.Notify(ctx, notes[0])
+	if err == nil {
+		t.Error("expected an error for a bad request")
+	}
+
+	for _, channel := range []string{"", "none"} {
+		n, err = New(channel, nil, "", "", nil)
+		if err != nil || n.Notify(ctx, notes[0]) != nil {
+			t.Errorf("expected the %q channel to drop the notifications, got %v", channel, err)
+		}
+	}
+	_, err = New("webhook", nil, "", "", nil)
+	if err == nil {
+		t.Error("expected an error for the webhook channel without a URL")
+	}
+	_, err = New("pigeon", nil, "", "", nil)
+	if err == nil {
+		t.Error("expected an error for an unknown channel")
+	}
+}
+
+// TestGroupChats posts the summaries of a trip to its Slack channel and
+// Telegram chat
+func TestGroupChats(t *testing.T) {
+	ctx := context.Background()
+	tr := trip.NewTrip("Lisbon", "alice@test.com", "", trip.NewDate(time.Now()), []string{"bob@test.com"})
+	tr.ID = 7
+	e := &trip.Expense{
+		Date:         trip.NewDate(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)),
+		Description:  "dinner",
+		Participants: []trip.Participant{{Email: "alice@test.com", Paid: 2500}, {Email: "bob@test.com"}},
+	}
+	added := ExpenseAdded(tr, e)
+	if added.Kind != KindExpenseAdded || !strings.Contains(added.Text, "dinner on 2024-05-01: 25.00, paid by alice@test.com, shared by 2") {
+		t.Errorf("unexpected notification %+v", added)
+	}
+	summary := SettlementSummary(tr, trip.Settlement{"bob@test.com": {"alice@test.com": 1250}})
+	if !strings.Contains(summary.Text, "bob@test.com pays alice@test.com: 12.50") {
+		t.Errorf("expected the settlement in %q", summary.Text)
+	}
+	if got := SettlementSummary(tr, trip.Settlement{}).Text; !strings.Contains(got, "Nobody") {
+		t.Errorf("expected nobody to pay, got %q", got)
+	}
+
+	posted := map[string]map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&body)
+		posted[r.URL.Path] = body
+	}))
+	defer srv.Close()
+	settings := &trip.Settings{SlackWebhookURL: srv.URL + "/slack", TelegramChatID: "@lisbon_trip"}
+	if n := ForTrip(settings, "", srv.Client()); len(n) != 1 {
+		t.Errorf("expected only Slack without the token of the bot, got %v", n)
+	}
+	chats := ForTrip(settings, "123:abc", srv.Client())
+	chats[1] = Telegram{Token: "123:abc", ChatID: settings.TelegramChatID, Client: srv.Client(), APIURL: srv.URL}
+	err := chats.Notify(ctx, summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := posted["/slack"]["text"]; !strings.HasPrefix(got, "*The trip Lisbon is completed*\n") {
+		t.Errorf("unexpected Slack message %q", got)
+	}
+	if got := posted["/bot123:abc/sendMessage"]; got["chat_id"] != "@lisbon_trip" || !strings.Contains(got["text"], "12.50") {
+		t.Errorf("unexpected Telegram message %v", got)
+	}
+	if len(ForTrip(&trip.Settings{}, "123:abc", nil)) != 0 {
+		t.Error("expected no group chat without settings")
+	}
+}
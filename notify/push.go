@@ -0,0 +1,339 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+const (
+	// fcmAPI is the URL of Firebase Cloud Messaging
+	fcmAPI = "https://fcm.googleapis.com"
+	// fcmScope is the OAuth 2.0 scope of the messages sent with FCM
+	fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+	// apnsAPI and apnsSandboxAPI are the URLs of the Apple Push
+	// Notification service, for the apps of the stores and the development
+	// builds
+	apnsAPI        = "https://api.push.apple.com"
+	apnsSandboxAPI = "https://api.sandbox.push.apple.com"
+	// apnsTokenTTL is how long the provider token of APNs is reused, Apple
+	// refusing tokens older than an hour, or renewed more than every 20
+	// minutes
+	apnsTokenTTL = 50 * time.Minute
+)
+
+// FCM is the trip.PushSender of Firebase Cloud Messaging, with the HTTP v1
+// API authorized by a service account of the Firebase project
+type FCM struct {
+	ProjectID   string
+	ClientEmail string
+	PrivateKey  *rsa.PrivateKey
+	// TokenURI is where the access tokens are issued
+	TokenURI string
+	Client   *http.Client
+	// APIURL is the URL of FCM, fcmAPI if empty
+	APIURL string
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// NewFCM returns the FCM sender of the service account, from the JSON key
+// file downloaded from the console of Firebase
+func NewFCM(credentials []byte, client *http.Client) (*FCM, error) {
+	var sa struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	err := json.Unmarshal(credentials, &sa)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FCM credentials: %v", err)
+	}
+	if sa.ProjectID == "" || sa.ClientEmail == "" || sa.TokenURI == "" {
+		return nil, errors.New("invalid FCM credentials, expecting the key of a service account")
+	}
+	key, err := parsePrivateKey([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid FCM credentials, expecting an RSA private key")
+	}
+	return &FCM{ProjectID: sa.ProjectID, ClientEmail: sa.ClientEmail, PrivateKey: rsaKey, TokenURI: sa.TokenURI, Client: client}, nil
+}
+
+// Push sends the notification to the device, trip.ErrDeviceGone is
+// returned if FCM reports it unregistered
+func (f *FCM) Push(ctx context.Context, token string, p trip.Push) error {
+	access, err := f.token(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"token":        token,
+			"notification": map[string]string{"title": p.Title, "body": p.Body},
+			"data":         map[string]string{"event": p.Event, "trip_id": strconv.FormatInt(p.TripID, 10)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	api := f.APIURL
+	if api == "" {
+		api = fcmAPI
+	}
+	target := api + "/v1/projects/" + url.PathEscape(f.ProjectID) + "/messages:send"
+	status, body, err := postPush(ctx, f.Client, target, payload, map[string]string{"Authorization": "Bearer " + access})
+	switch {
+	case err != nil:
+		return err
+	case status == http.StatusNotFound && strings.Contains(body, "UNREGISTERED"):
+		return trip.ErrDeviceGone
+	case status < 200 || status > 299:
+		return fmt.Errorf("FCM answered %d: %s", status, body)
+	}
+	return nil
+}
+
+// token returns the access token of the service account, issued again
+// once it expires
+func (f *FCM) token(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.accessToken != "" && now.Before(f.expiresAt) {
+		return f.accessToken, nil
+	}
+	assertion, err := signJWT(map[string]string{"alg": "RS256", "typ": "JWT"}, map[string]any{
+		"iss":   f.ClientEmail,
+		"scope": fcmScope,
+		"aud":   f.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}, func(digest []byte) ([]byte, error) {
+		return rsa.SignPKCS1v15(rand.Reader, f.PrivateKey, crypto.SHA256, digest)
+	})
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient(f.Client).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get the access token of FCM: %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tok)
+	if err != nil {
+		return "", err
+	}
+	f.accessToken = tok.AccessToken
+	// renewed a minute early, not to be refused on the way
+	f.expiresAt = now.Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return f.accessToken, nil
+}
+
+// APNs is the trip.PushSender of the Apple Push Notification service,
+// authorized by a signing key of the team of the app
+type APNs struct {
+	// KeyID is the ID of the signing key, and TeamID the one of the team
+	// of the app
+	KeyID  string
+	TeamID string
+	Key    *ecdsa.PrivateKey
+	// Topic is the bundle ID of the app
+	Topic  string
+	Client *http.Client
+	// APIURL is the URL of APNs, apnsAPI if empty
+	APIURL string
+
+	mu       sync.Mutex
+	jwt      string
+	issuedAt time.Time
+}
+
+// NewAPNs returns the APNs sender of the signing key, the .p8 file from
+// the Apple developer account, for the app of the topic. The sandbox is
+// for the development builds of the app.
+func NewAPNs(key []byte, keyID, teamID, topic string, sandbox bool, client *http.Client) (*APNs, error) {
+	if keyID == "" || teamID == "" || topic == "" {
+		return nil, errors.New("APNs requires the ID of the key, the ID of the team and the topic")
+	}
+	k, err := parsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := k.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid APNs key, expecting an EC private key")
+	}
+	a := &APNs{KeyID: keyID, TeamID: teamID, Key: ecKey, Topic: topic, Client: client}
+	if sandbox {
+		a.APIURL = apnsSandboxAPI
+	}
+	return a, nil
+}
+
+// Push sends the notification to the device, trip.ErrDeviceGone is
+// returned if APNs reports its token invalid or inactive
+func (a *APNs) Push(ctx context.Context, token string, p trip.Push) error {
+	jwt, err := a.token()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]any{
+		"aps":     map[string]any{"alert": map[string]string{"title": p.Title, "body": p.Body}},
+		"event":   p.Event,
+		"trip_id": p.TripID,
+	})
+	if err != nil {
+		return err
+	}
+	api := a.APIURL
+	if api == "" {
+		api = apnsAPI
+	}
+	status, body, err := postPush(ctx, a.Client, api+"/3/device/"+url.PathEscape(token), payload, map[string]string{
+		"Authorization":   "bearer " + jwt,
+		"apns-topic":      a.Topic,
+		"apns-push-type":  "alert",
+		"apns-expiration": "0",
+	})
+	switch {
+	case err != nil:
+		return err
+	case status == http.StatusGone, status == http.StatusBadRequest && strings.Contains(body, "BadDeviceToken"):
+		return trip.ErrDeviceGone
+	case status < 200 || status > 299:
+		return fmt.Errorf("APNs answered %d: %s", status, body)
+	}
+	return nil
+}
+
+// token returns the provider token, signed again every apnsTokenTTL
+func (a *APNs) token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.jwt != "" && now.Sub(a.issuedAt) < apnsTokenTTL {
+		return a.jwt, nil
+	}
+	jwt, err := signJWT(map[string]string{"alg": "ES256", "kid": a.KeyID}, map[string]any{
+		"iss": a.TeamID,
+		"iat": now.Unix(),
+	}, func(digest []byte) ([]byte, error) {
+		r, s, err := ecdsa.Sign(rand.Reader, a.Key, digest)
+		if err != nil {
+			return nil, err
+		}
+		// JWS wants r and s, 32 bytes each, not the ASN.1 of ecdsa
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	a.jwt, a.issuedAt = jwt, now
+	return jwt, nil
+}
+
+// signJWT returns the JWT of the header and the claims, signed by sign
+// from the SHA-256 digest of its first 2 parts
+func signJWT(header map[string]string, claims map[string]any, sign func(digest []byte) ([]byte, error)) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parsePrivateKey parses the PEM encoded PKCS #8 private key
+func parsePrivateKey(key []byte) (any, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("invalid private key, expecting PEM")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// postPush POSTs the payload, and returns the status and the body of the
+// answer, for the reason of a failure
+func postPush(ctx context.Context, client *http.Client, target string, payload []byte, headers map[string]string) (int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "trip-accountant")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient(client).Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return 0, "", err
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// httpClient returns the client, http.DefaultClient if nil
+func httpClient(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
@@ -0,0 +1,172 @@
+package notify
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// pemKey returns the PEM encoded PKCS #8 private key
+func pemKey(t *testing.T, key any) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// TestFCM pushes with the access token of a service account
+func TestFCM(t *testing.T) {
+	ctx := context.Background()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issued int
+	var sent []map[string]map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || strings.Count(r.FormValue("assertion"), ".") != 2 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			issued++
+			w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+		case "/v1/projects/lisbon/messages:send":
+			if r.Header.Get("Authorization") != "Bearer access" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			var body map[string]map[string]any
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["message"]["token"] == "gone" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`))
+				return
+			}
+			sent = append(sent, body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	creds, _ := json.Marshal(map[string]string{
+		"project_id":   "lisbon",
+		"client_email": "push@lisbon.iam.gserviceaccount.com",
+		"private_key":  string(pemKey(t, key)),
+		"token_uri":    srv.URL + "/token",
+	})
+	f, err := NewFCM(creds, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.APIURL = srv.URL
+	p := trip.Push{Event: trip.EventExpenseAdded, TripID: 7, Title: "New expense on Lisbon", Body: "dinner: 25.00"}
+	for i := 0; i < 2; i++ {
+		err = f.Push(ctx, "device", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if issued != 1 || len(sent) != 2 {
+		t.Errorf("expected 2 pushes with the same access token, got %d issued, %v", issued, sent)
+	}
+	if n := sent[0]["message"]["notification"].(map[string]any); n["title"] != p.Title || n["body"] != p.Body {
+		t.Errorf("unexpected notification %v", n)
+	}
+	if d := sent[0]["message"]["data"].(map[string]any); d["trip_id"] != "7" || d["event"] != p.Event {
+		t.Errorf("unexpected data %v", d)
+	}
+	err = f.Push(ctx, "gone", p)
+	if !errors.Is(err, trip.ErrDeviceGone) {
+		t.Errorf("expected trip.ErrDeviceGone, got %v", err)
+	}
+	_, err = NewFCM([]byte(`{"project_id":"lisbon"}`), nil)
+	if err == nil {
+		t.Error("expected an error for incomplete credentials")
+	}
+}
+
+// TestAPNs pushes with a provider token
+func TestAPNs(t *testing.T) {
+	ctx := context.Background()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var auths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case r.Header.Get("apns-topic") != "com.example.trips":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"TopicDisallowed"}`))
+		case r.URL.Path == "/3/device/gone":
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+		case r.URL.Path == "/3/device/bad":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		case body["aps"] == nil:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"PayloadEmpty"}`))
+		default:
+			auths = append(auths, r.Header.Get("Authorization"))
+		}
+	}))
+	defer srv.Close()
+
+	_, err = NewAPNs(pemKey(t, key), "", "TEAM", "com.example.trips", false, nil)
+	if err == nil {
+		t.Error("expected an error without the ID of the key")
+	}
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, err = NewAPNs(pemKey(t, rsaKey), "KEY", "TEAM", "com.example.trips", false, nil)
+	if err == nil {
+		t.Error("expected an error for an RSA key")
+	}
+	a, err := NewAPNs(pemKey(t, key), "KEY", "TEAM", "com.example.trips", true, srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.APIURL != apnsSandboxAPI {
+		t.Errorf("expected the sandbox, got %q", a.APIURL)
+	}
+	a.APIURL = srv.URL
+	p := trip.Push{Event: trip.EventTripCompleted, TripID: 7, Title: "The trip Lisbon is completed", Body: "You pay 12.50 in total to settle it."}
+	for i := 0; i < 2; i++ {
+		err = a.Push(ctx, "device", p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(auths) != 2 || auths[0] != auths[1] || !strings.HasPrefix(auths[0], "bearer ") {
+		t.Errorf("expected 2 pushes with the same provider token, got %v", auths)
+	}
+	for _, token := range []string{"gone", "bad"} {
+		err = a.Push(ctx, token, p)
+		if !errors.Is(err, trip.ErrDeviceGone) {
+			t.Errorf("expected trip.ErrDeviceGone for %s, got %v", token, err)
+		}
+	}
+	a.Topic = "com.example.other"
+	err = a.Push(ctx, "device", p)
+	if err == nil || errors.Is(err, trip.ErrDeviceGone) || !strings.Contains(err.Error(), "TopicDisallowed") {
+		t.Errorf("expected the reason of the failure, got %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// oidcProviderName is the identity provider the users log in with:
+	// google, github or generic, none if empty
+	oidcProviderName string
+	// oidcIssuer is the issuer of the generic OpenID Connect provider, its
+	// configuration is discovered from it
+	oidcIssuer string
+	// oidcClientID and oidcClientSecret are the credentials of the server
+	// registered with the provider
+	oidcClientID     string
+	oidcClientSecret string
+	// oidc is the provider set up from the flags at startup, nil if none
+	oidc *oidcProvider
+)
+
+// errUnverifiedEmail is returned when the identity provider doesn't give a
+// verified email address
+var errUnverifiedEmail = errors.New("the identity provider didn't give a verified email address")
+
+const (
+	// oidcStateTTL is how long the user has to log in with the provider
+	oidcStateTTL = 10 * time.Minute
+	// oidcTimeout is the time the provider has to answer a request
+	oidcTimeout = 10 * time.Second
+)
+
+// oidcProvider is an OAuth 2.0 identity provider the users log in with,
+// the server only asks it for the verified email address of the user
+type oidcProvider struct {
+	name   string
+	issuer string
+	scopes string
+	// verifiedEmail returns the verified email address of the user the
+	// access token was issued to
+	verifiedEmail func(ctx context.Context, p *oidcProvider, accessToken string) (string, error)
+
+	mu sync.Mutex
+	// the endpoints, discovered from the issuer on first use if empty
+	authURL     string
+	tokenURL    string
+	userInfoURL string
+	// states are the pending logins, with their expiry
+	states map[string]time.Time
+}
+
+// newOIDCProvider returns the identity provider of the name, configured
+// with --oidc-issuer for the generic one
+func newOIDCProvider(name, issuer string) (*oidcProvider, error) {
+	p := &oidcProvider{name: name, states: make(map[string]time.Time)}
+	switch name {
+	case "google":
+		p.issuer = "https://accounts.google.com"
+		p.scopes = "openid email"
+		p.verifiedEmail = userInfoEmail
+	case "github":
+		// GitHub isn't an OpenID Connect provider, the email addresses of
+		// the user are listed by its API
+		p.authURL = "https://github.com/login/oauth/authorize"
+		p.tokenURL = "https://github.com/login/oauth/access_token"
+		p.userInfoURL = "https://api.github.com/user/emails"
+		p.scopes = "user:email"
+		p.verifiedEmail = githubEmail
+	case "generic":
+		if issuer == "" {
+			return nil, errors.New("--oidc-issuer is required by the generic provider")
+		}
+		p.issuer = strings.TrimSuffix(issuer, "/")
+		p.scopes = "openid email"
+		p.verifiedEmail = userInfoEmail
+	default:
+		return nil, fmt.Errorf("unknown identity provider %q, expecting google, github or generic", name)
+	}
+	return p, nil
+}
+
+// getJSON decodes the JSON answer of the provider to a GET with the access
+// token, if any
+func (p *oidcProvider) getJSON(ctx context.Context, url, accessToken string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, oidcTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	return p.do(req, v)
+}
+
+// do sends the request to the provider and decodes its JSON answer
+func (p *oidcProvider) do(req *http.Request, v any) error {
+	client := &http.Client{Timeout: oidcTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s: %.200s", req.URL.Host, resp.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// endpoints returns the authorization, token and user info endpoints of
+// the provider, discovering them from its issuer the first time
+func (p *oidcProvider) endpoints(ctx context.Context) (authURL, tokenURL, userInfoURL string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.authURL == "" {
+		var conf struct {
+			AuthURL     string `json:"authorization_endpoint"`
+			TokenURL    string `json:"token_endpoint"`
+			UserInfoURL string `json:"userinfo_endpoint"`
+		}
+		err = p.getJSON(ctx, p.issuer+"/.well-known/openid-configuration", "", &conf)
+		if err != nil {
+			return "", "", "", err
+		}
+		if conf.AuthURL == "" || conf.TokenURL == "" || conf.UserInfoURL == "" {
+			return "", "", "", fmt.Errorf("%s doesn't have the endpoints of an OpenID Connect provider", p.issuer)
+		}
+		p.authURL, p.tokenURL, p.userInfoURL = conf.AuthURL, conf.TokenURL, conf.UserInfoURL
+	}
+	return p.authURL, p.tokenURL, p.userInfoURL, nil
+}
+
+// newState returns the state of a new login, to be given back by the
+// provider, forgetting the expired ones
+func (p *oidcProvider) newState() (string, error) {
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+	now := trip.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for s, expiry := range p.states {
+		if !now.Before(expiry) {
+			delete(p.states, s)
+		}
+	}
+	p.states[state] = now.Add(oidcStateTTL)
+	return state, nil
+}
+
+// checkState tells whether the state is the one of a pending login, which
+// can't be given back again
+func (p *oidcProvider) checkState(state string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expiry, ok := p.states[state]
+	delete(p.states, state)
+	return ok && trip.Now().Before(expiry)
+}
+
+// exchange returns the access token of the authorization code
+func (p *oidcProvider) exchange(ctx context.Context, tokenURL, code, redirectURI string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, oidcTimeout)
+	defer cancel()
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {oidcClientID},
+		"client_secret": {oidcClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	err = p.do(req, &tok)
+	if err != nil {
+		return "", err
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("no access token: %s", tok.Error)
+	}
+	return tok.AccessToken, nil
+}
+
+// userInfoEmail returns the email address of the user info of an OpenID
+// Connect provider, if verified
+func userInfoEmail(ctx context.Context, p *oidcProvider, accessToken string) (string, error) {
+	_, _, userInfoURL, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	var info struct {
+		Email string `json:"email"`
+		// EmailVerified is a string with some providers
+		EmailVerified any `json:"email_verified"`
+	}
+	err = p.getJSON(ctx, userInfoURL, accessToken, &info)
+	if err != nil {
+		return "", err
+	}
+	if info.Email == "" || (info.EmailVerified != true && info.EmailVerified != "true") {
+		return "", errUnverifiedEmail
+	}
+	return info.Email, nil
+}
+
+// githubEmail returns the primary email address of the GitHub user, if
+// verified
+func githubEmail(ctx context.Context, p *oidcProvider, accessToken string) (string, error) {
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	err := p.getJSON(ctx, p.userInfoURL, accessToken, &emails)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
+		}
+	}
+	return "", errUnverifiedEmail
+}
+
+// oidcRedirectURI returns the URL the provider sends the user back to,
+// registered with the provider
+func oidcRedirectURI(r *http.Request) string {
+	return serverURL(r) + "/v1/login/oidc/callback"
+}
+
+// getOIDCLogin redirects the user to the identity provider to log in
+func getOIDCLogin(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if oidc == nil || !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errors.New("logging in with an identity provider isn't enabled on this server"))
+		return
+	}
+	ctx := requestContext(r)
+	authURL, _, _, err := oidc.endpoints(ctx)
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to discover the identity provider: %v\n", err)
+		jsonBail(w, r, http.StatusBadGateway, errors.New("the identity provider can't be reached"))
+		return
+	}
+	state, err := oidc.newState()
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {oidcClientID},
+		"redirect_uri":  {oidcRedirectURI(r)},
+		"scope":         {oidc.scopes},
+		"state":         {state},
+	}
+	sep := "?"
+	if strings.Contains(authURL, "?") {
+		sep = "&"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// getOIDCCallback returns a session token for the user the identity
+// provider sent back, with the verified email address it gives
+func getOIDCCallback(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if oidc == nil || !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errors.New("logging in with an identity provider isn't enabled on this server"))
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		jsonBail(w, r, http.StatusUnauthorized, fmt.Errorf("the identity provider refused the login: %s", e))
+		return
+	}
+	code := r.URL.Query().Get("code")
+	if code == "" || !oidc.checkState(r.URL.Query().Get("state")) {
+		jsonBail(w, r, http.StatusBadRequest, errors.New("missing code, or unknown or expired state"))
+		return
+	}
+	ctx := requestContext(r)
+	_, tokenURL, _, err := oidc.endpoints(ctx)
+	var accessToken, email string
+	if err == nil {
+		accessToken, err = oidc.exchange(ctx, tokenURL, code, oidcRedirectURI(r))
+	}
+	if err == nil {
+		email, err = oidc.verifiedEmail(ctx, oidc, accessToken)
+	}
+	if err == errUnverifiedEmail {
+		jsonBail(w, r, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to log in with %s: %v\n", oidc.name, err)
+		jsonBail(w, r, http.StatusBadGateway, fmt.Errorf("failed to log in with %s: %w", oidc.name, err))
+		return
+	}
+	token, s, err := trip.LoginVerified(ctx, db, email, sessionTTL)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	writeJSON(w, http.StatusOK, sessionJSON{AccessToken: token, TokenType: "Bearer", ExpiresAt: s.ExpiresAt, User: s.Email})
+}
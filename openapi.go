@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// apiParam is a query parameter of a route
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// apiDoc documents a route in the OpenAPI specification. The JSON schemas
+// are derived from the Go types of the request and response values.
+type apiDoc struct {
+	Summary string
+	Query   []apiParam
+	// Request is a value of the type of the JSON body, nil without a body
+	Request any
+	// RequestType is the media type of the body, application/json if empty
+	RequestType string
+	// Status is the status of a successful response
+	Status int
+	// Response is a value of the type of the JSON response, nil without
+	// a body
+	Response any
+	// ContentTypes replaces the JSON response, e.g. for the downloads
+	ContentTypes []string
+}
+
+// Some query parameters used by several routes
+var (
+	pageParams = []apiParam{
+		{"offset", "integer", "number of items to skip"},
+		{"limit", "integer", "maximum number of items, at most 1000"},
+	}
+	asOfParam   = apiParam{"as_of", "string", "RFC 3339 time of a past view of the trip"}
+	namesParam  = apiParam{"display_names", "boolean", "true to wrap the settlement with the display names of the people"}
+	byParam     = apiParam{"by", "string", "household to net the settlement within the households, keyed by their names"}
+	auditParams = []apiParam{
+		{"from", "string", "first transaction date, YYYY-MM-DD"},
+		{"to", "string", "last transaction date, YYYY-MM-DD"},
+		{"after", "integer", "seq of the last event of the previous page"},
+		{"limit", "integer", "maximum number of events, at most 1000"},
+	}
+	auditLogParams = []apiParam{
+		{"from", "string", "first date a change was recorded on, YYYY-MM-DD"},
+		{"to", "string", "last date a change was recorded on, YYYY-MM-DD"},
+		{"after", "integer", "audit_id of the last change of the previous page"},
+		{"limit", "integer", "maximum number of changes, at most 1000"},
+	}
+)
+
+// apiDocs documents the routes, keyed by "<method> <gin path>". The routes
+// missing from it are still listed in the specification.
+var apiDocs = map[string]apiDoc{
+	"POST /trips": {
+		Summary: "Create a trip, with the members of a friend group of the owner if given",
+		Request: tripJSON{},
+		Status:  http.StatusCreated,
+		Response: struct {
+			TripID int64 `json:"trip_id"`
+		}{},
+	},
+	"GET /trips/search": {
+		Summary:  "Search the trips by name and description",
+		Query:    append([]apiParam{{"q", "string", "words to search for"}, {"owner", "string", "email address of the owner"}}, pageParams...),
+		Status:   http.StatusOK,
+		Response: []*trip.Trip{},
+	},
+	"GET /trips/:trip_id": {
+		Summary:  "Get a trip",
+		Query:    []apiParam{asOfParam},
+		Status:   http.StatusOK,
+		Response: &trip.Trip{},
+	},
+	"PATCH /trips/:trip_id": {
+		Summary:     "Update a trip with a JSON Patch document",
+		Request:     []trip.PatchOp{},
+		RequestType: jsonPatchType,
+		Status:      http.StatusOK,
+		Response:    &trip.Trip{},
+	},
+	"POST /trips/:trip_id/archive": {
+		Summary:  "Archive a completed trip, leaving it out of the listings, owner only",
+		Status:   http.StatusOK,
+		Response: &trip.Trip{},
+	},
+	"DELETE /trips/:trip_id": {
+		Summary: "Delete a trip, restorable until purged, owner only",
+		Status:  http.StatusNoContent,
+	},
+	"POST /trips/:trip_id/restore": {
+		Summary:  "Restore a deleted trip, owner only",
+		Status:   http.StatusOK,
+		Response: &trip.Trip{},
+	},
+	"POST /trips/:trip_id/clone": {
+		Summary: "Create a new open trip with the name, the description and the participants of a trip, owner only",
+		Request: cloneJSON{},
+		Status:  http.StatusCreated,
+		Response: struct {
+			TripID int64 `json:"trip_id"`
+		}{},
+	},
+	"GET /:owner/trips": {
+		Summary:  "List the active trips of an owner, keyed by name, or as a list with sort",
+		Query:    append([]apiParam{{"sort", "string", "name, start_date or activity"}}, pageParams...),
+		Status:   http.StatusOK,
+		Response: map[string]*trip.Trip{},
+	},
+	"POST /trips/:trip_id/expenses": {
+		Summary: "Add an expense to a trip, or quarantine it if the token posts a burst of expenses",
+		Request: expenseJSON{},
+		Status:  http.StatusAccepted,
+		Response: struct {
+			ExpenseID    int64 `json:"expense_id,omitempty"`
+			QuarantineID int64 `json:"quarantine_id,omitempty"`
+			Quarantined  bool  `json:"quarantined,omitempty"`
+		}{},
+	},
+	"POST /trips/:trip_id/expenses/preview": {
+		Summary:  "Preview the shares and the settlement of an expense, and the budget envelopes it would blow, without adding it",
+		Request:  expenseJSON{},
+		Status:   http.StatusOK,
+		Response: &trip.ExpensePreview{},
+	},
+	"POST /trips/:trip_id/expenses/draft": {
+		Summary:  "Draft an expense from the picture of a receipt, the \"file\" of a multipart upload, or queue it for review",
+		Query:    []apiParam{{"review", "boolean", "queue the draft for review, with the confidence of the scan"}},
+		Status:   http.StatusOK,
+		Response: expenseJSON{},
+	},
+	"POST /trips/:trip_id/expenses/draft/voice": {
+		Summary:  "Draft an expense from a voice note, the \"file\" of a multipart upload, or queue it for review",
+		Query:    []apiParam{{"review", "boolean", "queue the draft for review, with the confidence of the dictation"}},
+		Status:   http.StatusOK,
+		Response: expenseJSON{},
+	},
+	"GET /trips/:trip_id/expenses": {
+		Summary:      "List the expenses of a trip",
+		Query:        append([]apiParam{{"sort", "string", "created or date"}}, pageParams...),
+		Status:       http.StatusOK,
+		Response:     []*trip.Expense{},
+		ContentTypes: []string{"text/csv"},
+	},
+	"GET /trips/:trip_id/expenses.csv": {
+		Summary:      "Export the expenses of a trip in CSV, one row per participant of each expense",
+		Query:        append([]apiParam{{"sort", "string", "created or date"}}, pageParams...),
+		Status:       http.StatusOK,
+		ContentTypes: []string{"text/csv"},
+	},
+	"POST /trips/:trip_id/expenses/:expense_id/receipts": {
+		Summary:  "Attach a receipt, the \"file\" of a multipart upload, to an expense",
+		Status:   http.StatusCreated,
+		Response: &trip.Receipt{},
+	},
+	"GET /trips/:trip_id/expenses/:expense_id/receipts": {
+		Summary:  "List the receipts of an expense",
+		Status:   http.StatusOK,
+		Response: []*trip.Receipt{},
+	},
+	"GET /trips/:trip_id/expenses/:expense_id/receipts/:receipt_id": {
+		Summary:      "Download the file of a receipt",
+		Status:       http.StatusOK,
+		ContentTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp", "application/pdf"},
+	},
+	"POST /trips/:trip_id/expenses/:expense_id/voice-notes": {
+		Summary:  "Attach a voice note, the \"file\" of a multipart upload, to an expense",
+		Query:    []apiParam{{"transcribe", "boolean", "transcribe the note with the speech to text command"}},
+		Status:   http.StatusCreated,
+		Response: &trip.VoiceNote{},
+	},
+	"GET /trips/:trip_id/expenses/:expense_id/voice-notes": {
+		Summary:  "List the voice notes of an expense, with their transcripts",
+		Status:   http.StatusOK,
+		Response: []*trip.VoiceNote{},
+	},
+	"GET /trips/:trip_id/expenses/:expense_id/voice-notes/:voice_note_id": {
+		Summary:      "Download the audio file of a voice note",
+		Status:       http.StatusOK,
+		ContentTypes: []string{"audio/mpeg", "audio/wave", "audio/aiff", "application/ogg", "video/webm", "video/mp4"},
+	},
+	"DELETE /trips/:trip_id/expenses/:expense_id": {
+		Summary: "Delete an expense",
+		Status:  http.StatusNoContent,
+	},
+	"POST /trips/:trip_id/expenses/:expense_id/restore": {
+		Summary:  "Restore a deleted expense, with its ID, its receipts and its voice notes",
+		Status:   http.StatusOK,
+		Response: &trip.Expense{},
+	},
+	"POST /trips/:trip_id/participants": {
+		Summary:  "Add participants to a trip",
+		Request:  participantsJSON{},
+		Status:   http.StatusCreated,
+		Response: []*trip.User{},
+	},
+	"DELETE /trips/:trip_id/participants/:email": {
+		Summary: "Remove a participant from a trip",
+		Status:  http.StatusNoContent,
+	},
+	"POST /trips/:trip_id/participants/:email/reassign": {
+		Summary:  "Remove a participant from a trip and its expenses, reassigning their shares, owner only",
+		Request:  reassignJSON{},
+		Status:   http.StatusOK,
+		Response: []trip.Reassignment{},
+	},
+	"GET /trips/:trip_id/participants": {
+		Summary:  "Get the roster of a trip, with the answers to the invitation",
+		Status:   http.StatusOK,
+		Response: []trip.RosterEntry{},
+	},
+	"PUT /trips/:trip_id/participants/:email/rsvp": {
+		Summary:  "Accept or decline the invitation to a trip, as the participant",
+		Request:  rsvpJSON{},
+		Status:   http.StatusOK,
+		Response: []trip.RosterEntry{},
+	},
+	"GET /trips/:trip_id/settlement": {
+		Summary:  "Get what remains to be paid of the settlement of a trip, payer to payee to amount, without completing it, or a preview with the pending approvers until the expenses are approved",
+		Query:    []apiParam{asOfParam, namesParam, byParam},
+		Status:   http.StatusOK,
+		Response: trip.Settlement{},
+	},
+	"POST /trips/:trip_id/settle": {
+		Summary:  "Complete a trip and get what remains to be paid of its settlement, or a preview with the pending approvers until the expenses are approved",
+		Query:    []apiParam{namesParam, byParam},
+		Status:   http.StatusOK,
+		Response: trip.Settlement{},
+	},
+	"GET /trips/:trip_id/settlement.pdf": {
+		Summary:      "Get the printable report of a trip and its settlement, without completing it",
+		Query:        []apiParam{asOfParam},
+		Status:       http.StatusOK,
+		ContentTypes: []string{"application/pdf"},
+	},
+	"GET /trips/:trip_id/export.xlsx": {
+		Summary:      "Export a trip in an XLSX workbook: participants, expenses and settlement",
+		Query:        []apiParam{asOfParam},
+		Status:       http.StatusOK,
+		ContentTypes: []string{mimeXLSX},
+	},
+	"GET /trips/:trip_id/settlement/preview": {
+		Summary:  "Get the settlement of a trip as it stands, without completing it, even while the expenses wait for their approval",
+		Query:    []apiParam{asOfParam, namesParam},
+		Status:   http.StatusOK,
+		Response: trip.Settlement{},
+	},
+	"GET /trips/:trip_id/settlement/signed": {
+		Summary:  "Get the final settlement of a completed trip signed (JWS) with the key of the instance",
+		Status:   http.StatusOK,
+		Response: signedSettlementJSON{},
+	},
+	"POST /settlements/verify": {
+		Summary:  "Verify the signature of a settlement, and get its payload, without a token",
+		Request:  verifySettlementJSON{},
+		Status:   http.StatusOK,
+		Response: signedSettlementJSON{},
+	},
+	"GET /trips/:trip_id/events": {
+		Summary:      "Stream the changes of a trip and its settlement as Server-Sent Events",
+		Status:       http.StatusOK,
+		ContentTypes: []string{"text/event-stream"},
+	},
+	"GET /trips/:trip_id/ws": {
+		Summary: "Join the room of a trip over a WebSocket: its changes, and the participants connected",
+		Query: []apiParam{
+			{"user", "string", "email address of the participant joining, defaults to the one of the token"},
+			{"token", "string", "bearer token, as a browser can't set the header of a WebSocket"},
+		},
+		Status: http.StatusSwitchingProtocols,
+	},
+	"GET /trips/:trip_id/balances": {
+		Summary:  "Get the per-person balances of a trip",
+		Query:    []apiParam{asOfParam},
+		Status:   http.StatusOK,
+		Response: []trip.Balance{},
+	},
+	"GET /trips/:trip_id/forbidden_transfers": {
+		Summary:  "Get the transfers the settlement of a trip avoids",
+		Status:   http.StatusOK,
+		Response: forbiddenJSON{},
+	},
+	"PUT /trips/:trip_id/forbidden_transfers": {
+		Summary:  "Replace the transfers the settlement of a trip avoids, owner only",
+		Request:  forbiddenJSON{},
+		Status:   http.StatusOK,
+		Response: forbiddenJSON{},
+	},
+	"GET /meta": {
+		Summary:  "Get the branding of the instance: its name, logo and colors",
+		Status:   http.StatusOK,
+		Response: metaJSON{},
+	},
+	"GET /trips/:trip_id/settings": {
+		Summary:  "Get the settings of a trip, e.g. its group chats, owner only",
+		Status:   http.StatusOK,
+		Response: trip.Settings{},
+	},
+	"PUT /trips/:trip_id/settings": {
+		Summary:  "Replace the settings of a trip, e.g. the Slack channel and Telegram chat its expenses and settlement are posted to, owner only",
+		Request:  trip.Settings{},
+		Status:   http.StatusOK,
+		Response: trip.Settings{},
+	},
+	"GET /trips/:trip_id/sheet": {
+		Summary:  "Get the Google Sheets spreadsheet a trip is exported to, with the outcome of its last refresh",
+		Status:   http.StatusOK,
+		Response: trip.TripSheet{},
+	},
+	"PUT /trips/:trip_id/sheet": {
+		Summary:  "Link a trip to a spreadsheet of the Drive of a participant who connected their Google account, a copy of the template if any",
+		Request:  tripSheetJSON{},
+		Status:   http.StatusOK,
+		Response: trip.TripSheet{},
+	},
+	"DELETE /trips/:trip_id/sheet": {
+		Summary: "Stop exporting a trip, the spreadsheet is kept, the user of the spreadsheet or the owner only",
+		Status:  http.StatusNoContent,
+	},
+	"POST /trips/:trip_id/sheet/refresh": {
+		Summary:  "Write the participants, the expenses and the settlement as it stands to the spreadsheet of a trip, creating it the first time",
+		Status:   http.StatusOK,
+		Response: trip.TripSheet{},
+	},
+	"GET /trips/:trip_id/features": {
+		Summary:  "List the feature flags on for a trip",
+		Status:   http.StatusOK,
+		Response: featuresJSON{},
+	},
+	"GET /trips/:trip_id/recurrences": {
+		Summary:  "List the recurring expenses of a trip",
+		Status:   http.StatusOK,
+		Response: []trip.Recurrence{},
+	},
+	"DELETE /trips/:trip_id/recurrences/:recurrence_id": {
+		Summary: "Stop a recurring expense, keeping the expenses it added, owner only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /trips/:trip_id/recurrences/suggestions": {
+		Summary:  "List the recurring expenses suggested from the expenses entered again and again",
+		Status:   http.StatusOK,
+		Response: []trip.Suggestion{},
+	},
+	"POST /trips/:trip_id/recurrences/suggestions/:suggestion_id/accept": {
+		Summary:  "Create the recurring expense suggested, owner only",
+		Status:   http.StatusCreated,
+		Response: trip.Recurrence{},
+	},
+	"GET /trips/:trip_id/households": {
+		Summary:  "Get the households of the people of a trip, by email address",
+		Status:   http.StatusOK,
+		Response: householdsJSON{},
+	},
+	"PUT /trips/:trip_id/households": {
+		Summary:  "Replace the households of the people of a trip, the settlement can be netted within, owner only",
+		Request:  householdsJSON{},
+		Status:   http.StatusOK,
+		Response: householdsJSON{},
+	},
+	"PUT /trips/:trip_id/organizer_fee": {
+		Summary:  "Set the fee credited to the owner of a trip for organizing it, owner only",
+		Request:  organizerFeeJSON{},
+		Status:   http.StatusOK,
+		Response: organizerFeeJSON{},
+	},
+	"PUT /trips/:trip_id/approval_required": {
+		Summary:  "Require the participants to approve the expenses before the settlement is final, owner only",
+		Request:  approvalRequiredJSON{},
+		Status:   http.StatusOK,
+		Response: trip.Approvals{},
+	},
+	"GET /trips/:trip_id/approvals": {
+		Summary:  "Get the approvals of the expenses of a trip, and the pending approvers",
+		Status:   http.StatusOK,
+		Response: trip.Approvals{},
+	},
+	"PUT /trips/:trip_id/participants/:email/approval": {
+		Summary:  "Approve the expenses of a trip as of the version in If-Match, as the participant",
+		Status:   http.StatusOK,
+		Response: trip.Approvals{},
+	},
+	"GET /trips/:trip_id/delegation": {
+		Summary:  "Get the delegation of the approvals of the owner of a trip to a co-treasurer",
+		Status:   http.StatusOK,
+		Response: trip.Delegation{},
+	},
+	"PUT /trips/:trip_id/delegation": {
+		Summary:  "Delegate the approvals of the owner of a trip over a threshold to a co-treasurer, the owner only",
+		Request:  delegationJSON{},
+		Status:   http.StatusOK,
+		Response: trip.Delegation{},
+	},
+	"DELETE /trips/:trip_id/delegation": {
+		Summary: "Revoke the delegation of the approvals of the owner of a trip, the owner only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /trips/:trip_id/freeze": {
+		Summary:  "Get the freeze of the expense entry of a trip, over or not",
+		Status:   http.StatusOK,
+		Response: trip.Freeze{},
+	},
+	"PUT /trips/:trip_id/freeze": {
+		Summary:  "Freeze the expense entry of a trip until a time, the expenses added meanwhile refused with EXPENSES_FROZEN, the owner only",
+		Request:  freezeJSON{},
+		Status:   http.StatusOK,
+		Response: trip.Freeze{},
+	},
+	"DELETE /trips/:trip_id/freeze": {
+		Summary: "Lift the freeze of the expense entry of a trip, the owner only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /trips/:trip_id/messages": {
+		Summary:  "List the thread of a trip, the oldest message first, paginated with limit and offset",
+		Status:   http.StatusOK,
+		Response: []*trip.Message{},
+	},
+	"POST /trips/:trip_id/messages": {
+		Summary:  "Post a message to the thread of a trip, as a participant",
+		Request:  messageJSON{},
+		Status:   http.StatusCreated,
+		Response: trip.Message{},
+	},
+	"PATCH /trips/:trip_id/messages/:message_id": {
+		Summary:  "Edit the text of a message, the author only",
+		Request:  messageJSON{},
+		Status:   http.StatusOK,
+		Response: trip.Message{},
+	},
+	"DELETE /trips/:trip_id/messages/:message_id": {
+		Summary: "Delete a message, the author or the owner of the trip only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /trips/:trip_id/payments": {
+		Summary:  "List the payments recorded for the settlement of a trip, in the order they were recorded",
+		Status:   http.StatusOK,
+		Response: []*trip.Payment{},
+	},
+	"POST /trips/:trip_id/payments": {
+		Summary:  "Record a payment of the settlement of a trip, in full or in part, the payer or the payee only",
+		Request:  paymentJSON{},
+		Status:   http.StatusCreated,
+		Response: trip.Payment{},
+	},
+	"DELETE /trips/:trip_id/payments/:payment_id": {
+		Summary: "Delete a payment recorded by mistake, the payer or the payee only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /paid/:token": {
+		Summary:  "Record the payment of a mark as paid link mailed with the settlement of a trip, without a token",
+		Status:   http.StatusCreated,
+		Response: trip.Payment{},
+	},
+	"POST /trips/:trip_id/invites": {
+		Summary:  "Issue a signed, expiring invite to join a trip, the owner only",
+		Request:  inviteJSON{},
+		Status:   http.StatusCreated,
+		Response: inviteLinkJSON{},
+	},
+	"GET /join/:token": {
+		Summary:  "Join the trip of an invite as the user it's addressed to, without a token",
+		Status:   http.StatusOK,
+		Response: trip.Trip{},
+	},
+	"POST /join/:token": {
+		Summary:  "Join the trip of an invite as the user of the token, accepting it",
+		Request:  joinJSON{},
+		Status:   http.StatusOK,
+		Response: trip.Trip{},
+	},
+	"GET /trips/:trip_id/quarantine": {
+		Summary:  "List the quarantined expenses of a trip, owner only",
+		Status:   http.StatusOK,
+		Response: []*trip.QuarantinedExpense{},
+	},
+	"POST /trips/:trip_id/quarantine/:quarantine_id/release": {
+		Summary: "Add a quarantined expense to its trip, as of the version in If-Match if given, owner only",
+		Status:  http.StatusAccepted,
+		Response: struct {
+			ExpenseID int64 `json:"expense_id"`
+		}{},
+	},
+	"DELETE /trips/:trip_id/quarantine/:quarantine_id": {
+		Summary: "Discard a quarantined expense, owner only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /trips/:trip_id/reviews": {
+		Summary:  "List the expenses of a trip queued for review, the least confident first",
+		Status:   http.StatusOK,
+		Response: []*trip.ReviewedExpense{},
+	},
+	"POST /trips/:trip_id/reviews": {
+		Summary:  "Queue an imported expense for review, it doesn't count until confirmed",
+		Request:  reviewJSON{},
+		Status:   http.StatusCreated,
+		Response: trip.ReviewedExpense{},
+	},
+	"PUT /trips/:trip_id/reviews/:review_id": {
+		Summary:  "Correct an expense queued for review",
+		Request:  expenseJSON{},
+		Status:   http.StatusOK,
+		Response: trip.ReviewedExpense{},
+	},
+	"POST /trips/:trip_id/reviews/:review_id/confirm": {
+		Summary: "Add an expense queued for review to its trip, as of the version in If-Match if given",
+		Status:  http.StatusAccepted,
+		Response: struct {
+			ExpenseID int64 `json:"expense_id"`
+		}{},
+	},
+	"DELETE /trips/:trip_id/reviews/:review_id": {
+		Summary: "Discard an expense queued for review",
+		Status:  http.StatusNoContent,
+	},
+	"GET /trips/:trip_id/federation": {
+		Summary:  "List the federations of a trip with its copies on other instances, owner only",
+		Status:   http.StatusOK,
+		Response: []*trip.FederationLink{},
+	},
+	"POST /trips/:trip_id/federation": {
+		Summary:  "Federate a trip with its copy on another instance, owner only",
+		Request:  federationJSON{},
+		Status:   http.StatusCreated,
+		Response: trip.FederationLink{},
+	},
+	"DELETE /trips/:trip_id/federation/:federation_id": {
+		Summary: "End a federation of a trip, the expenses received are kept, owner only",
+		Status:  http.StatusNoContent,
+	},
+	"POST /trips/:trip_id/federation/:federation_id/sync": {
+		Summary:  "Sync a trip with its copy on the peer now, owner only",
+		Status:   http.StatusOK,
+		Response: trip.FederationResult{},
+	},
+	"POST /federation/trips/:trip_id/sync": {
+		Summary:  "Apply the changes of a federated trip sent by a peer, signed in X-Federation-Signature, and reply with the changes of the trip",
+		Request:  trip.FederationBatch{},
+		Status:   http.StatusOK,
+		Response: trip.FederationBatch{},
+	},
+	"GET /trips/:trip_id/preferences/:email": {
+		Summary:  "Get the answer of a participant to the cost questionnaire, participant only",
+		Status:   http.StatusOK,
+		Response: trip.CostPreference{},
+	},
+	"PUT /trips/:trip_id/preferences/:email": {
+		Summary:  "Answer the cost questionnaire of a trip, participant only",
+		Request:  costPreferenceJSON{},
+		Status:   http.StatusOK,
+		Response: trip.CostPreference{},
+	},
+	"GET /trips/:trip_id/survey": {
+		Summary:  "Get the aggregated answers to the cost questionnaire, owner only",
+		Status:   http.StatusOK,
+		Response: trip.CostSurvey{},
+	},
+	"GET /trips/:trip_id/envelopes": {
+		Summary:  "List the budget envelopes of a trip, by category",
+		Status:   http.StatusOK,
+		Response: []trip.Envelope{},
+	},
+	"PUT /trips/:trip_id/envelopes": {
+		Summary:  "Replace the budget envelopes of a trip, an empty list removes them, owner only",
+		Request:  []envelopeJSON{},
+		Status:   http.StatusOK,
+		Response: []trip.Envelope{},
+	},
+	"GET /trips/:trip_id/envelopes/status": {
+		Summary:  "Get what's allocated, spent and available of each budget envelope of a trip",
+		Status:   http.StatusOK,
+		Response: []trip.EnvelopeStatus{},
+	},
+	"GET /trips/:trip_id/add": {
+		Summary: "HTML form adding an expense to a trip",
+		Query: []apiParam{
+			{"token", "string", "write token, for the shared links"},
+			{"date", "string", "prefilled date, YYYY-MM-DD"},
+			{"description", "string", "prefilled description"},
+			{"amount", "string", "prefilled amount, e.g. 12.50"},
+			{"payer", "string", "prefilled email address of the payer"},
+		},
+		Status:       http.StatusOK,
+		ContentTypes: []string{"text/html"},
+	},
+	"GET /trips/:trip_id/snapshot": {
+		Summary:      "Download the snapshot of a completed trip",
+		Query:        []apiParam{{"format", "string", "json, csv or pdf"}},
+		Status:       http.StatusOK,
+		ContentTypes: []string{"application/json", "text/csv", "application/pdf"},
+	},
+	"GET /trips/:trip_id/statements/:email": {
+		Summary:      "Get the statement of a participant of a trip",
+		Query:        []apiParam{{"format", "string", "json, html or pdf"}},
+		Status:       http.StatusOK,
+		Response:     &trip.Statement{},
+		ContentTypes: []string{"text/html", "application/pdf"},
+	},
+	"GET /trips/:trip_id/audit": {
+		Summary:  "List the changes of a trip, who made them, and what was changed before and after",
+		Query:    auditLogParams,
+		Status:   http.StatusOK,
+		Response: []trip.AuditEntry{},
+	},
+	"GET /trips/:trip_id/audit/export": {
+		Summary:      "Export the financial events of a trip, one JSON object per line",
+		Query:        auditParams,
+		Status:       http.StatusOK,
+		ContentTypes: []string{"application/x-ndjson"},
+	},
+	"GET /audit/export": {
+		Summary:      "Export the financial events of all trips, one JSON object per line",
+		Query:        auditParams,
+		Status:       http.StatusOK,
+		ContentTypes: []string{"application/x-ndjson"},
+	},
+	"GET /users/:email": {
+		Summary:  "Get the profile of a user",
+		Status:   http.StatusOK,
+		Response: trip.Profile{},
+	},
+	"PATCH /users/:email": {
+		Summary:  "Update the display name of a user, the user only",
+		Request:  userPatchJSON{},
+		Status:   http.StatusOK,
+		Response: trip.Profile{},
+	},
+	"PUT /users/:email/avatar": {
+		Summary:  "Set the avatar of a user to the picture of the \"file\" of a multipart upload, the user only",
+		Status:   http.StatusOK,
+		Response: trip.Profile{},
+	},
+	"DELETE /users/:email/avatar": {
+		Summary:  "Remove the avatar of a user, the user only",
+		Status:   http.StatusOK,
+		Response: trip.Profile{},
+	},
+	"PUT /users/:email/payment_handles": {
+		Summary:  "Set where a user wants to be paid: Venmo username, PayPal.me link and IBAN, the empty ones removed, the user only",
+		Request:  trip.PaymentHandles{},
+		Status:   http.StatusOK,
+		Response: trip.Profile{},
+	},
+	"GET /avatars/:avatar": {
+		Summary:      "Download the file of an avatar, by the hash of its avatar_url, without a token",
+		Status:       http.StatusOK,
+		ContentTypes: []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+	},
+	"DELETE /users/:email": {
+		Summary:  "Erase a user, replacing their email address by a tombstone in the trips, the user only",
+		Status:   http.StatusOK,
+		Response: trip.User{},
+	},
+	"POST /users/:email/verification": {
+		Summary:  "Mail a link to verify the email address of a user, the user only",
+		Status:   http.StatusAccepted,
+		Response: trip.Verification{},
+	},
+	"GET /verify": {
+		Summary:  "Verify the email address the link was mailed to, without a token",
+		Query:    []apiParam{{"token", "string", "secret of the link mailed"}},
+		Status:   http.StatusOK,
+		Response: trip.Profile{},
+	},
+	"POST /login": {
+		Summary:  "Mail a link to log in to a user, created if unknown, without a token",
+		Request:  loginJSON{},
+		Status:   http.StatusAccepted,
+		Response: trip.Verification{},
+	},
+	"GET /login": {
+		Summary:  "Get a session token for the user the login link was mailed to, without a token",
+		Query:    []apiParam{{"token", "string", "secret of the link mailed"}},
+		Status:   http.StatusOK,
+		Response: sessionJSON{},
+	},
+	"GET /login/oidc": {
+		Summary: "Redirect to the identity provider to log in, without a token",
+		Status:  http.StatusFound,
+	},
+	"GET /login/oidc/callback": {
+		Summary:  "Get a session token for the user the identity provider sent back, without a token",
+		Query:    []apiParam{{"code", "string", "authorization code of the provider"}, {"state", "string", "state of the login"}},
+		Status:   http.StatusOK,
+		Response: sessionJSON{},
+	},
+	"POST /users/:email/google": {
+		Summary:  "Start connecting the Google account of a user, to export the trips to Google Sheets, the user only",
+		Status:   http.StatusOK,
+		Response: googleConnectJSON{},
+	},
+	"DELETE /users/:email/google": {
+		Summary: "Forget the grant of the Google account of a user, the user only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /google/callback": {
+		Summary: "Keep the grant of the Google account of the user Google sent back, without a token",
+		Query:   []apiParam{{"code", "string", "authorization code of Google"}, {"state", "string", "state of the connection"}},
+		Status:  http.StatusOK,
+	},
+	"GET /users/:email/digest": {
+		Summary:  "Get the digest of the active trips of an owner",
+		Status:   http.StatusOK,
+		Response: []trip.TripDigest{},
+	},
+	"GET /users/:email/balances": {
+		Summary:  "Get what remains to be paid between a user and the others across their trips, netted by person",
+		Status:   http.StatusOK,
+		Response: trip.Ledger{},
+	},
+	"GET /users/:email/groups": {
+		Summary:  "List the friend groups of a user, the user only",
+		Status:   http.StatusOK,
+		Response: []*trip.Group{},
+	},
+	"GET /users/:email/groups/:name": {
+		Summary:  "Get a friend group of a user, the user only",
+		Status:   http.StatusOK,
+		Response: trip.Group{},
+	},
+	"PUT /users/:email/groups/:name": {
+		Summary:  "Create a friend group of a user, or replace its members, the user only",
+		Request:  groupJSON{},
+		Status:   http.StatusOK,
+		Response: trip.Group{},
+	},
+	"DELETE /users/:email/groups/:name": {
+		Summary: "Delete a friend group of a user, the user only",
+		Status:  http.StatusNoContent,
+	},
+	"GET /users/:email/devices": {
+		Summary:  "List the devices of a user receiving the push notifications",
+		Status:   http.StatusOK,
+		Response: []trip.Device{},
+	},
+	"POST /users/:email/devices": {
+		Summary:  "Register a device of a user for the push notifications of their trips",
+		Request:  deviceJSON{},
+		Status:   http.StatusCreated,
+		Response: trip.Device{},
+	},
+	"DELETE /users/:email/devices/:device_id": {
+		Summary: "Unregister a device of a user",
+		Status:  http.StatusNoContent,
+	},
+	"GET /users/:email/caps": {
+		Summary:  "List the spend caps of a user",
+		Status:   http.StatusOK,
+		Response: []trip.SpendCap{},
+	},
+	"PUT /users/:email/caps": {
+		Summary: "Set a spend cap of a user",
+		Request: spendCapJSON{},
+		Status:  http.StatusNoContent,
+	},
+	"POST /admin/webhooks": {
+		Summary:  "Subscribe a URL to the events of the trips, the secret of the signatures is only returned here",
+		Request:  webhookJSON{},
+		Status:   http.StatusCreated,
+		Response: &trip.Webhook{},
+	},
+	"GET /admin/webhooks": {
+		Summary:  "List the webhooks",
+		Status:   http.StatusOK,
+		Response: []*trip.Webhook{},
+	},
+	"DELETE /admin/webhooks/:webhook_id": {
+		Summary: "Delete a webhook, and the events not delivered to it yet",
+		Status:  http.StatusNoContent,
+	},
+	"GET /admin/purge": {
+		Summary:  "Get the dry-run report of the purge of the data past the retention policy",
+		Status:   http.StatusOK,
+		Response: trip.PurgePlan{},
+	},
+	"GET /admin/bursts": {
+		Summary:  "List the sources posting bursts of expenses, with the end of their quarantine",
+		Status:   http.StatusOK,
+		Response: map[string]time.Time{},
+	},
+	"GET /admin/features": {
+		Summary:  "List the feature flags, and who they're on for",
+		Status:   http.StatusOK,
+		Response: []trip.Feature{},
+	},
+	"PUT /admin/features/:feature": {
+		Summary:  "Set a feature flag: on for everyone, a share of the trips, some users or some trips",
+		Request:  trip.Feature{},
+		Status:   http.StatusOK,
+		Response: trip.Feature{},
+	},
+	"DELETE /admin/features/:feature": {
+		Summary: "Turn a feature flag off for everyone",
+		Status:  http.StatusNoContent,
+	},
+	"POST /admin/purge": {
+		Summary:  "Purge the data past the retention policy, irreversibly, as confirmed from the dry-run report",
+		Request:  purgeJSON{},
+		Status:   http.StatusOK,
+		Response: trip.PurgePlan{},
+	},
+	"GET /admin/stats": {
+		Summary: "Get the usage statistics",
+		Status:  http.StatusOK,
+		Response: struct {
+			Stats       *trip.Stats   `json:"stats"`
+			ComputedAt  time.Time     `json:"computed_at"`
+			ErrorRates  []errorBucket `json:"error_rates"`
+			SlowQueries int64         `json:"slow_queries"`
+		}{},
+	},
+	"POST /admin/trips/complete": {
+		Summary:  "Complete the trips matching a filter, in a background job",
+		Request:  bulkJSON{},
+		Status:   http.StatusAccepted,
+		Response: job{},
+	},
+	"POST /admin/trips/archive": {
+		Summary:  "Archive the completed trips matching a filter, in a background job",
+		Request:  bulkJSON{},
+		Status:   http.StatusAccepted,
+		Response: job{},
+	},
+	"POST /admin/trips/export": {
+		Summary:  "Export the trips matching a filter, in a background job",
+		Request:  bulkJSON{},
+		Status:   http.StatusAccepted,
+		Response: job{},
+	},
+	"GET /admin/jobs/:job_id": {
+		Summary:  "Get the status and progress of a background job",
+		Status:   http.StatusOK,
+		Response: job{},
+	},
+	"GET /admin/jobs/:job_id/result": {
+		Summary:  "Download the result of a finished job, the trips of an export",
+		Status:   http.StatusOK,
+		Response: []*trip.Trip{},
+	},
+	"POST /users/:email/tokens": {
+		Summary:  "Issue an API token to a user",
+		Request:  tokenJSON{},
+		Status:   http.StatusCreated,
+		Response: &trip.Token{},
+	},
+	"GET /users/:email/tokens": {
+		Summary:  "List the API tokens of a user",
+		Status:   http.StatusOK,
+		Response: []*trip.Token{},
+	},
+	"POST /tokens/:token_id/rotate": {
+		Summary:  "Replace an API token by a new one",
+		Status:   http.StatusCreated,
+		Response: &trip.Token{},
+	},
+	"DELETE /tokens/:token_id": {
+		Summary: "Revoke an API token",
+		Status:  http.StatusNoContent,
+	},
+}
+
+// schemaBuilder derives the JSON schemas of Go types, the named structs
+// are shared as components
+type schemaBuilder struct {
+	components map[string]any
+}
+
+// Types with a custom JSON encoding
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	dateType    = reflect.TypeOf(trip.Date{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// componentName returns the capitalized name of a struct in the
+// specification, the request types such as tripJSON become TripRequest
+func componentName(t reflect.Type) string {
+	name := t.Name()
+	if base, ok := strings.CutSuffix(name, "JSON"); ok {
+		name = base + "Request"
+	}
+	r := []rune(name)
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// schema returns the JSON schema of the type
+func (sb *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case dateType:
+		return map[string]any{"type": "string", "format": "date"}
+	case rawJSONType:
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return sb.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": sb.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": sb.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.structSchema(t)
+		}
+		name := componentName(t)
+		if _, ok := sb.components[name]; !ok {
+			// registered first, for the recursive types
+			sb.components[name] = nil
+			sb.components[name] = sb.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// structSchema returns the object schema of the exported fields of a
+// struct, with the constraints of their binding tags
+func (sb *schemaBuilder) structSchema(t reflect.Type) map[string]any {
+	props := make(map[string]any)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if name == "" && f.Anonymous && ft.Kind() == reflect.Struct {
+			// the fields of an embedded struct are promoted, like by
+			// encoding/json
+			embedded := sb.structSchema(ft)
+			for k, v := range embedded["properties"].(map[string]any) {
+				props[k] = v
+			}
+			if r, ok := embedded["required"].([]string); ok {
+				required = append(required, r...)
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := sb.schema(f.Type)
+		for _, rule := range strings.Split(f.Tag.Get("binding"), ",") {
+			key, val, _ := strings.Cut(rule, "=")
+			n, err := strconv.Atoi(val)
+			switch {
+			case key == "required":
+				required = append(required, name)
+			case key == "email_address" && s["type"] == "string":
+				s["format"] = "email"
+			case err != nil || s["type"] == nil:
+			case s["type"] == "string":
+				s[map[string]string{"min": "minLength", "max": "maxLength"}[key]] = n
+			case s["type"] == "array":
+				s[map[string]string{"min": "minItems", "max": "maxItems"}[key]] = n
+			default:
+				s[map[string]string{"min": "minimum", "max": "maximum"}[key]] = n
+			}
+		}
+		delete(s, "")
+		props[name] = s
+	}
+	rslt := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		rslt["required"] = required
+	}
+	return rslt
+}
+
+// apiRoute is a route registered with the router, e.g. GET
+// /v1/trips/:trip_id, see ginRoutes()
+type apiRoute struct {
+	Method string
+	Path   string
+}
+
+// buildOpenAPI returns the OpenAPI 3 specification of the routes
+func buildOpenAPI(routes []apiRoute, basePath string) map[string]any {
+	sb := &schemaBuilder{components: make(map[string]any)}
+	errorSchema := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"code":    map[string]any{"type": "string"},
+			"message": map[string]any{"type": "string"},
+			"details": map[string]any{},
+		},
+		"required": []string{"code", "message"},
+	}
+	paths := make(map[string]any)
+	var versioned []apiRoute
+	for _, r := range routes {
+		if strings.HasPrefix(r.Path, basePath+"/") {
+			r.Path = strings.TrimPrefix(r.Path, basePath)
+			versioned = append(versioned, r)
+		}
+	}
+	routes = versioned
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	for _, r := range routes {
+		doc := apiDocs[r.Method+" "+r.Path]
+		var params []any
+		segments := strings.Split(r.Path, "/")
+		for i, seg := range segments {
+			if name, ok := strings.CutPrefix(seg, ":"); ok {
+				segments[i] = "{" + name + "}"
+				typ := "string"
+				if strings.HasSuffix(name, "_id") {
+					typ = "integer"
+				}
+				params = append(params, map[string]any{
+					"name": name, "in": "path", "required": true,
+					"schema": map[string]any{"type": typ},
+				})
+			}
+		}
+		for _, q := range doc.Query {
+			params = append(params, map[string]any{
+				"name": q.Name, "in": "query", "description": q.Description,
+				"schema": map[string]any{"type": q.Type},
+			})
+		}
+
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		ok := map[string]any{"description": http.StatusText(status)}
+		content := make(map[string]any)
+		if doc.Response != nil {
+			content["application/json"] = map[string]any{"schema": sb.schema(reflect.TypeOf(doc.Response))}
+		}
+		for _, ct := range doc.ContentTypes {
+			content[ct] = map[string]any{}
+		}
+		if len(content) > 0 {
+			ok["content"] = content
+		}
+		op := map[string]any{
+			"summary": doc.Summary,
+			"responses": map[string]any{
+				strconv.Itoa(status): ok,
+				"default": map[string]any{
+					"description": "Error",
+					"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+				},
+			},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if doc.Request != nil {
+			requestType := doc.RequestType
+			if requestType == "" {
+				requestType = "application/json"
+			}
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					requestType: map[string]any{"schema": sb.schema(reflect.TypeOf(doc.Request))},
+				},
+			}
+		}
+
+		path := strings.Join(segments, "/")
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[path] = item
+		}
+		item[strings.ToLower(r.Method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   instanceName + " API",
+			"version": "1",
+		},
+		"servers": []any{map[string]any{"url": basePath}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": sb.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		// the tokens are only required with --root-token
+		"security": []any{map[string]any{"bearerAuth": []string{}}, map[string]any{}},
+	}
+}
+
+// apiDocsPage is the page of the docs UI, Swagger UI loaded from a CDN,
+// titled with the name of the instance
+var apiDocsPage = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.}} API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`))
+
+// serveAPIDocs returns the handlers of openapi.json and of the docs UI of
+// the version of the API at basePath, documenting the routes of the version
+func serveAPIDocs(routes []apiRoute, basePath string) (spec, docs http.HandlerFunc) {
+	doc := buildOpenAPI(routes, basePath)
+	var page bytes.Buffer
+	apiDocsPage.Execute(&page, instanceName)
+	spec = func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, doc)
+	}
+	docs = func(w http.ResponseWriter, _ *http.Request) {
+		writeData(w, http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+	}
+	return spec, docs
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/apierror"
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// paidLinkTTL is how long a "mark as paid" link mailed with the settlement
+// of a trip is valid
+var paidLinkTTL = 30 * 24 * time.Hour
+
+// errNoPaidLinks is returned when following a "mark as paid" link while
+// the server has no key to sign them
+var errNoPaidLinks = errors.New("the mark as paid links require --jwt-key")
+
+// paymentJSON is used for POST to record a payment of the settlement of a
+// trip
+type paymentJSON struct {
+	// Payer is the participant who paid, the user of the token if empty
+	Payer string `json:"payer" binding:"omitempty,email_address"`
+	Payee string `json:"payee" binding:"required,email_address"`
+	// Amount is in cent
+	Amount int `json:"amount" binding:"required,gt=0"`
+	// PaidOn is YYYY-MM-DD, today if empty
+	PaidOn string `json:"paid_on"`
+}
+
+// getPayments returns the payments recorded for the settlement of a trip,
+// in the order they were recorded
+func getPayments(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	payments, err := trip.LoadPayments(requestContext(r), db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, payments)
+}
+
+// postPayment records a payment of the settlement of a trip, by the payer
+// or the payee
+func postPayment(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var pj paymentJSON
+	err := bindJSON(r, &pj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	payer := pj.Payer
+	if tok := requestToken(r); tok != nil && payer == "" {
+		payer = tok.Email
+	}
+	if payer == "" {
+		jsonBail(w, r, http.StatusBadRequest, errors.New("the payer of the payment is required"))
+		return
+	}
+	if !actsFor(r, payer) && !actsFor(r, pj.Payee) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("a payment can only be recorded by its payer or its payee"))
+		return
+	}
+	paidOn := trip.NewDate(trip.Now().UTC())
+	if pj.PaidOn != "" {
+		d, err := time.Parse(time.DateOnly, pj.PaidOn)
+		if err != nil {
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		paidOn = trip.NewDate(d)
+	}
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	p, err := t.RecordPayment(requestContext(r), db, payer, pj.Payee, pj.Amount, paidOn)
+	switch {
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, p)
+}
+
+// deletePayment deletes a payment recorded by mistake, for its payer or
+// its payee only
+func deletePayment(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	paymentID, err := strconv.ParseInt(r.PathValue("payment_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	p, err := trip.LoadPayment(ctx, db, tripID, paymentID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !actsFor(r, p.Payer) && !actsFor(r, p.Payee) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the payer or the payee can delete a payment"))
+		return
+	}
+	err = trip.DeletePayment(ctx, db, tripID, paymentID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// paidLinker returns the function issuing the "mark as paid" links of the
+// settlement of the trip, for its notifications. The notifications being
+// sent outside of a request, the links are only issued with --public-url,
+// and with --jwt-key to sign them: the function returns "" otherwise.
+func paidLinker(ctx context.Context, tripID int64) func(payer, payee string, amount int) string {
+	return func(payer, payee string, amount int) string {
+		if publicURL == "" || !trip.SessionsEnabled() {
+			return ""
+		}
+		l, err := trip.IssuePaidLink(tripID, payer, payee, amount, paidLinkTTL)
+		if err != nil {
+			trip.Logf(ctx, "ERROR: failed to issue the mark as paid link of %s to %s on trip %d: %v\n", payer, payee, tripID, err)
+			return ""
+		}
+		return strings.TrimSuffix(publicURL, "/") + "/v1/paid/" + l.Token
+	}
+}
+
+// getPaid records the payment of the link mailed to the payer with the
+// settlement of a trip, the signed link being the proof. Only what remains
+// to be paid of its transfer is recorded, so following it twice doesn't pay
+// twice.
+func getPaid(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !trip.SessionsEnabled() {
+		jsonBail(w, r, http.StatusServiceUnavailable, errNoPaidLinks)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	p, err := trip.MarkPaid(requestContext(r), db, r.PathValue("token"))
+	switch {
+	case err == trip.ErrInvalidPaidLink:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	case err == trip.ErrTokenExpired:
+		jsonBail(w, r, http.StatusGone, err)
+		return
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, apierror.New(apierror.TripNotFound, err))
+		return
+	case err == trip.ErrAlreadyPaid || err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, p)
+}
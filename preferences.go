@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// costPreferenceJSON is used for PUT to answer the cost questionnaire of a
+// trip
+type costPreferenceJSON struct {
+	// Budget is the ceiling of the share of the participant in cent, 0
+	// for none
+	Budget int `json:"budget" binding:"min=0"`
+	// Categories are the categories of expenses the participant shares,
+	// all of them if it's empty
+	Categories []string `json:"categories"`
+}
+
+// defaultSplit fills SplitAmong for an expense of a category, with a
+// single payer, from the answers to the cost questionnaire of the trip
+func (e *expenseJSON) defaultSplit(ctx context.Context, db *sql.DB, tripID int64) error {
+	if e.Category == "" {
+		return nil
+	}
+	if e.PaidBy == "" || len(e.SplitAmong) > 0 {
+		return errors.New("category is only used with paid_by, without split_among")
+	}
+	t, err := trip.LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return err
+	}
+	prefs, err := t.LoadCostPreferences(ctx, db)
+	if err != nil {
+		return err
+	}
+	split, err := t.DefaultSplit(prefs, e.Category)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(split, strings.ToLower(e.PaidBy)) {
+		return fmt.Errorf("%s doesn't share the %s expenses", e.PaidBy, e.Category)
+	}
+	e.SplitAmong = split
+	return nil
+}
+
+// getCostPreference returns the answer of a participant to the cost
+// questionnaire of the trip, only to that participant
+func getCostPreference(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := strings.ToLower(r.PathValue("email"))
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the participant can see their answer"))
+		return
+	}
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	prefs, err := t.LoadCostPreferences(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	for _, p := range prefs {
+		if p.Email == email {
+			writeJSON(w, http.StatusOK, p)
+			return
+		}
+	}
+	jsonBail(w, r, http.StatusNotFound, fmt.Errorf("%s hasn't answered the questionnaire of trip %d", email, t.ID))
+}
+
+// putCostPreference records the answer of a participant to the cost
+// questionnaire of the trip, only the participant can answer
+func putCostPreference(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the participant can answer for themselves"))
+		return
+	}
+	var pj costPreferenceJSON
+	err := decodeJSON(r, &pj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	p, err := t.SaveCostPreference(requestContext(r), db, trip.CostPreference{
+		Email:      email,
+		Budget:     pj.Budget,
+		Categories: pj.Categories,
+	})
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// getCostSurvey returns the aggregated answers to the cost questionnaire
+// of the trip, only to its owner
+func getCostSurvey(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "see the answers")
+	if !ok {
+		return
+	}
+	prefs, err := t.LoadCostPreferences(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, t.CostSurvey(prefs))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/notify"
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// fcmCredentials is the JSON key file of the service account pushing
+	// to the Android devices with FCM, none if empty
+	fcmCredentials string
+	// apnsKeyFile is the .p8 signing key pushing to the Apple devices with
+	// APNs, none if empty
+	apnsKeyFile string
+	// apnsKeyID and apnsTeamID are the IDs of the signing key and of the
+	// team of the app
+	apnsKeyID  string
+	apnsTeamID string
+	// apnsTopic is the bundle ID of the app
+	apnsTopic string
+	// apnsSandbox pushes to the development builds of the app
+	apnsSandbox bool
+	// pushSenders are the senders of the platforms configured, see
+	// setupPush()
+	pushSenders = map[string]trip.PushSender{}
+)
+
+// deviceJSON is used for POST to register a device
+type deviceJSON struct {
+	Platform string `json:"platform" binding:"required"`
+	Token    string `json:"token" binding:"required"`
+}
+
+// setupPush creates the senders of the platforms configured
+func setupPush() error {
+	client := &http.Client{Timeout: webhookTimeout}
+	if fcmCredentials != "" {
+		creds, err := os.ReadFile(fcmCredentials)
+		if err != nil {
+			return fmt.Errorf("failed to read --fcm-credentials: %v", err)
+		}
+		f, err := notify.NewFCM(creds, client)
+		if err != nil {
+			return err
+		}
+		pushSenders[trip.PlatformFCM] = f
+		log.Printf("Pushing to the devices of project %s with FCM\n", f.ProjectID)
+	}
+	if apnsKeyFile != "" {
+		key, err := os.ReadFile(apnsKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read --apns-key: %v", err)
+		}
+		a, err := notify.NewAPNs(key, apnsKeyID, apnsTeamID, apnsTopic, apnsSandbox, client)
+		if err != nil {
+			return err
+		}
+		pushSenders[trip.PlatformAPNs] = a
+		log.Printf("Pushing to the devices of app %s with APNs\n", apnsTopic)
+	}
+	return nil
+}
+
+// runPushes pushes the notifications to the devices in the background, as
+// they're queued and every webhookInterval for the retries, until the
+// process ends
+func runPushes(db *sql.DB) {
+	if len(pushSenders) == 0 || webhookInterval <= 0 {
+		return
+	}
+	go func() {
+		tick := time.Tick(webhookInterval)
+		for {
+			select {
+			case <-tick:
+			case <-trip.PushesQueued():
+			}
+			ctx := trip.WithRequestID(context.Background(), "pushes")
+			_, err := trip.DeliverPushes(ctx, db, pushSenders)
+			if err != nil {
+				trip.Logf(ctx, "ERROR: failed to push the notifications: %v\n", err)
+			}
+		}
+	}()
+}
+
+// postDevice registers a device of a user for the push notifications
+func postDevice(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can register their devices", email))
+		return
+	}
+	var dj deviceJSON
+	err := decodeJSON(r, &dj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := pushSenders[dj.Platform]; !ok {
+		jsonBail(w, r, http.StatusBadRequest, fmt.Errorf("the push notifications aren't enabled for '%s'", dj.Platform))
+		return
+	}
+	ctx := requestContext(r)
+	usr, err := trip.LoadOrCreateUser(ctx, db, email)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	d, err := trip.RegisterDevice(ctx, db, usr, dj.Platform, dj.Token)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, d)
+}
+
+// getDevices lists the devices of a user, without their tokens
+func getDevices(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can list their devices", email))
+		return
+	}
+	devices, err := trip.LoadDevices(requestContext(r), db, email)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+// deleteDevice unregisters a device of a user
+func deleteDevice(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can unregister their devices", email))
+		return
+	}
+	deviceID, err := strconv.ParseInt(r.PathValue("device_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = trip.DeleteDevice(requestContext(r), db, email, deviceID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// burstExpenses is the number of expenses a token can post within
+	// burstWindow before its expenses are quarantined, 0 disables it
+	burstExpenses = 100
+	// burstWindow is the window of time of burstExpenses
+	burstWindow = 10 * time.Second
+	// burstQuarantine is how long the expenses of a token posting a burst
+	// are quarantined
+	burstQuarantine = time.Hour
+	// expenseBursts flags the tokens posting bursts of expenses, set up
+	// from the flags at startup
+	expenseBursts *trip.BurstDetector
+)
+
+// burstSource returns what posted the expense of the request, for the
+// detection of the bursts: the user logged in or its token if any, its
+// client IP address otherwise. The root token is never quarantined, "" is returned then.
+func burstSource(r *http.Request) string {
+	if usr := authUser(r); usr != nil {
+		return "user " + usr.Email
+	}
+	if tok := requestToken(r); tok != nil {
+		if tok.ID == 0 {
+			return ""
+		}
+		return "token " + strconv.FormatInt(tok.ID, 10)
+	}
+	return "client " + clientIP(r)
+}
+
+// quarantineExpense sets aside the expense posted by a source flagged for
+// a burst, for the owner of the trip to review
+func quarantineExpense(w http.ResponseWriter, r *http.Request, db *sql.DB, tripID int64, source string, expense expenseJSON) {
+	payload, err := json.Marshal(expense)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	q, err := trip.QuarantineExpense(requestContext(r), db, tripID, source, payload)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{"quarantine_id": q.ID, "quarantined": true})
+}
+
+// getQuarantine returns the quarantined expenses of a trip. Only the owner
+// of the trip, or an admin, can get them when the tokens are required.
+func getQuarantine(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "review its quarantined expenses")
+	if !ok {
+		return
+	}
+	quarantine, err := trip.LoadQuarantine(requestContext(r), db, t.ID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, quarantine)
+}
+
+// postQuarantineRelease adds a quarantined expense to its trip, as of the
+// version in If-Match if given, and removes it from the quarantine in the
+// same transaction, so that it's only added once
+func postQuarantineRelease(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "review its quarantined expenses")
+	if !ok {
+		return
+	}
+	quarantineID, err := strconv.ParseInt(r.PathValue("quarantine_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	q, err := trip.LoadQuarantined(ctx, db, t.ID, quarantineID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var expense expenseJSON
+	err = json.Unmarshal(q.Expense, &expense)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	e, err := expense.Translate()
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t = addExpense(w, r, db, t.ID, expense, e, quarantineID)
+	if t == nil {
+		return
+	}
+	w.Header().Set("ETag", t.ETag())
+	e = t.Expenses[len(t.Expenses)-1]
+	writeJSON(w, http.StatusAccepted, map[string]any{"expense_id": e.ID})
+}
+
+// deleteQuarantined discards a quarantined expense
+func deleteQuarantined(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadOwnedTrip(w, r, db, "review its quarantined expenses")
+	if !ok {
+		return
+	}
+	quarantineID, err := strconv.ParseInt(r.PathValue("quarantine_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = trip.DeleteQuarantined(requestContext(r), db, t.ID, quarantineID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getBursts returns the sources whose expenses are quarantined, with the
+// end of their quarantine
+func getBursts(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	writeJSON(w, http.StatusOK, expenseBursts.Flagged())
+}
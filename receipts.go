@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// receiptsDir is the directory the receipt files are stored in
+	receiptsDir = "/srv/trip-accountant/data/receipts"
+	// maxReceiptSize is the maximum size, in bytes, of the upload of a
+	// receipt, instead of maxBodySize
+	maxReceiptSize int64 = 10 << 20
+	// ocrCommand is the command reading the text of the picture of a
+	// receipt, see trip.CommandOCR, the drafts are off without it
+	ocrCommand string
+)
+
+// receiptTypes are the content types of the receipts accepted, as
+// detected from the content
+var receiptTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// upload is the file of the "file" field of a multipart upload, read
+// through its Reader
+type upload struct {
+	io.Reader
+	file        multipart.File
+	filename    string
+	contentType string
+}
+
+// openUpload opens the file of the "file" field of a multipart upload, its
+// content type, detected from the content, must be one of types. The
+// status of the failure is returned along with the error.
+func openUpload(r *http.Request, types map[string]bool) (*upload, int, error) {
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	// the content type is detected, the one given by the client isn't
+	// trusted
+	br := bufio.NewReaderSize(f, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, http.StatusBadRequest, err
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !types[contentType] {
+		f.Close()
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported file type %s", contentType)
+	}
+	return &upload{Reader: br, file: f, filename: fh.Filename, contentType: contentType}, http.StatusOK, nil
+}
+
+// Close closes the file of the upload
+func (u *upload) Close() error {
+	return u.file.Close()
+}
+
+// ocrTypes are the content types of the pictures scanned for a draft
+var ocrTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// expenseParams parses the trip and expense IDs of the path
+func expenseParams(r *http.Request) (tripID, expenseID int64, err error) {
+	tripID, err = strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	expenseID, err = strconv.ParseInt(r.PathValue("expense_id"), 10, 64)
+	return tripID, expenseID, err
+}
+
+// postReceipt attaches the file of the "file" field of a multipart upload
+// to an expense
+func postReceipt(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, expenseID, err := expenseParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	u, status, err := openUpload(r, receiptTypes)
+	if err != nil {
+		jsonBail(w, r, status, err)
+		return
+	}
+	defer u.Close()
+	rcpt, err := trip.AttachReceipt(requestContext(r), db, tripID, expenseID, u.filename, u.contentType, u)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, rcpt)
+}
+
+// draftExpense scans the picture of a receipt, the "file" of a multipart
+// upload, and returns the payload of an expense pre-filled with its total
+// and its date, for the client to complete. Nothing is written, unless
+// the query has review=true: the draft is then queued for review with the
+// confidence of the scan.
+func draftExpense(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.LoadTripByID(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	u, status, err := openUpload(r, ocrTypes)
+	if err != nil {
+		jsonBail(w, r, status, err)
+		return
+	}
+	defer u.Close()
+	scan, err := trip.ScanReceipt(ctx, u)
+	switch {
+	case err == trip.ErrNoOCR:
+		jsonBail(w, r, http.StatusNotImplemented, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	// like the entry form, the expense is split among everyone who
+	// hasn't declined the trip
+	draft := expenseJSON{
+		Date:       trip.Now().Format(time.DateOnly),
+		Amount:     scan.Amount,
+		SplitAmong: t.Sharers(),
+	}
+	if scan.Date.Unix() != 0 {
+		draft.Date = scan.Date.Format(time.DateOnly)
+	}
+	if r.URL.Query().Get("review") == "true" {
+		queueForReview(w, r, db, t.ID, "ocr", scan.Confidence, draft)
+		return
+	}
+	writeJSON(w, http.StatusOK, draft)
+}
+
+// getReceipts returns the list of receipts of an expense
+func getReceipts(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, expenseID, err := expenseParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	receipts, err := trip.LoadReceipts(requestContext(r), db, tripID, expenseID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, receipts)
+}
+
+// getReceipt returns the file of a receipt
+func getReceipt(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, expenseID, err := expenseParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	receiptID, err := strconv.ParseInt(r.PathValue("receipt_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	rcpt, err := trip.LoadReceipt(requestContext(r), db, tripID, expenseID, receiptID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	f, err := rcpt.Open()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("the file of receipt %d is missing", rcpt.ID)
+		}
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+	// the receipts are immutable, they're named by their content
+	w.Header().Set("ETag", strconv.Quote(rcpt.SHA256))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": rcpt.Filename}))
+	w.Header().Set("Content-Type", rcpt.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(rcpt.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, f)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// recurrenceInterval is the period the recurring expenses due are added,
+// 0 disables them
+var recurrenceInterval = time.Hour
+
+// scheduleRecurrences adds the recurring expenses due at the start, then
+// every recurrenceInterval, until the process ends
+func scheduleRecurrences(db *sql.DB) {
+	if recurrenceInterval <= 0 {
+		return
+	}
+	log.Printf("Adding the recurring expenses due every %v\n", recurrenceInterval)
+	apply := func() {
+		ctx := trip.WithRequestID(context.Background(), "recurrences")
+		_, err := trip.ApplyRecurrences(ctx, db)
+		if err != nil {
+			trip.Logf(ctx, "ERROR: failed to add the recurring expenses: %v\n", err)
+		}
+	}
+	go func() {
+		apply()
+		for range time.Tick(recurrenceInterval) {
+			apply()
+		}
+	}()
+}
+
+// getRecurrenceSuggestions returns the recurrences suggested from the
+// expenses of a trip
+func getRecurrenceSuggestions(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	suggestions, err := t.SuggestRecurrences(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, suggestions)
+}
+
+// postSuggestionAccept creates the recurrence suggested, for the owner only
+func postSuggestionAccept(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	suggestionID, err := strconv.ParseInt(r.PathValue("suggestion_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "accept a recurrence")
+	if !ok {
+		return
+	}
+	rec, err := t.AcceptSuggestion(requestContext(r), db, suggestionID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripArchived || err == trip.ErrTripCompleted:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, rec)
+}
+
+// getRecurrences returns the recurring expenses of a trip
+func getRecurrences(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	recurrences, err := trip.LoadRecurrences(requestContext(r), db, t.ID)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, recurrences)
+}
+
+// deleteRecurrence stops a recurring expense of a trip, for the owner only
+func deleteRecurrence(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	recurrenceID, err := strconv.ParseInt(r.PathValue("recurrence_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadOwnedTrip(w, r, db, "stop a recurrence")
+	if !ok {
+		return
+	}
+	err = trip.DeleteRecurrence(requestContext(r), db, t.ID, recurrenceID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
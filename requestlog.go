@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// requestIDHeader carries the ID of a request, from the client or the
+// proxy in front of the server, and back in the response
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request IDs accepted from the clients, the
+// others are replaced so that they can't mess up the log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// newRequestID returns a random request ID, from the ID source of the data
+// model
+func newRequestID() string {
+	id, _ := trip.NewID(16)
+	return id
+}
+
+// statusWriter records the status and the size of a response, for the
+// middlewares wrapping the router
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+// WriteHeader records the status
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of the body, and the status 200 if none was
+// written
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(data)
+	sw.size += n
+	return n, err
+}
+
+// Flush is for the streams, see events.go, the router calling it directly
+func (sw *statusWriter) Flush() {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	http.NewResponseController(sw.ResponseWriter).Flush()
+}
+
+// Hijack is for the WebSocket connections, see ws.go
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	sw.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(sw.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the ResponseWriter recorded, for http.ResponseController
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// requestLogger is the middleware assigning the request ID, or keeping
+// the one of the X-Request-ID header, and attaching it to the context of
+// the request. Once the request is handled, it's logged as key=value
+// pairs, e.g. for grep or a log collector.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(trip.WithRequestID(r.Context(), id))
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		trip.Logf(r.Context(), "method=%s path=%q status=%d latency=%v client=%s bytes=%d",
+			r.Method, r.URL.Path, sw.status, time.Since(start), clientIP(r), sw.size)
+	})
+}
+
+// requestContext returns the context for the data model operations of a
+// request, carrying the request ID. It isn't cancelled when the client
+// goes away, so that the changes of the request aren't cut halfway.
+func requestContext(r *http.Request) context.Context {
+	return context.WithoutCancel(r.Context())
+}
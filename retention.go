@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// retention is the data retention policy, from --retention-trip-years,
+	// --retention-history-months, --retention-anonymize-months and
+	// --retention-deleted-days
+	retention trip.RetentionPolicy
+	// purgeInterval is the period of the scheduled purge, 0 disables it
+	purgeInterval = 24 * time.Hour
+	// purgeConfirm is for flag --purge-confirm, the scheduled purge only
+	// logs what it would delete without it
+	purgeConfirm bool
+)
+
+// errNoRetention is returned by the purge endpoints without a policy
+var errNoRetention = errors.New("no retention policy, see --retention-trip-years, --retention-history-months, --retention-anonymize-months and --retention-deleted-days")
+
+// purgeJSON is used for POST to carry out a purge
+type purgeJSON struct {
+	// Confirmation is the one of the dry-run report being confirmed
+	Confirmation string `json:"confirmation" binding:"required"`
+}
+
+// schedulePurge runs the purge of the retention policy every
+// purgeInterval, until the process ends
+func schedulePurge(db *sql.DB) {
+	if retention.IsEmpty() || purgeInterval <= 0 {
+		return
+	}
+	mode := "dry run"
+	if purgeConfirm {
+		mode = "deleting"
+	}
+	log.Printf("Purging the data past the retention policy every %v (%s)\n", purgeInterval, mode)
+	go func() {
+		for range time.Tick(purgeInterval) {
+			scheduledPurge(db)
+		}
+	}()
+}
+
+// scheduledPurge carries out the purge if --purge-confirm is set, or logs
+// its dry-run report
+func scheduledPurge(db *sql.DB) {
+	ctx := trip.WithRequestID(context.Background(), "scheduled-purge")
+	plan, err := trip.PlanPurge(ctx, db, retention, trip.Now())
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to plan the purge: %v\n", err)
+		return
+	}
+	if !purgeConfirm {
+		trip.Logf(ctx, "Dry run of the purge: trips %v, deleted trips %v and %d deleted expenses would be deleted, users %v anonymized, --purge-confirm does it\n",
+			plan.Trips, plan.DeletedTrips, plan.DeletedExpenses, plan.Users)
+		return
+	}
+	err = trip.Purge(ctx, db, plan)
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to purge: %v\n", err)
+	}
+}
+
+// getPurge returns the dry-run report of the purge of the retention
+// policy, nothing is deleted
+func getPurge(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if retention.IsEmpty() {
+		jsonBail(w, r, http.StatusConflict, errNoRetention)
+		return
+	}
+	plan, err := trip.PlanPurge(requestContext(r), db, retention, trip.Now())
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// postPurge carries out the purge of the retention policy, if it still
+// deletes what the confirmed dry-run report said. The deletion is
+// irreversible.
+func postPurge(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if retention.IsEmpty() {
+		jsonBail(w, r, http.StatusConflict, errNoRetention)
+		return
+	}
+	var pj purgeJSON
+	err := decodeJSON(r, &pj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	plan, err := trip.PlanPurge(ctx, db, retention, trip.Now())
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if plan.Confirmation != pj.Confirmation {
+		jsonBail(w, r, http.StatusConflict, trip.ErrPurgeChanged)
+		return
+	}
+	err = trip.Purge(ctx, db, plan)
+	switch {
+	case err == trip.ErrPurgeChanged:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
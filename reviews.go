@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+// reviewJSON is used for POST to queue an imported expense for review
+type reviewJSON struct {
+	// Source is where the expense comes from, e.g. the name of an import
+	Source string `json:"source" binding:"required,max=64"`
+	// Confidence is how sure the source is of the expense, in percent
+	Confidence int `json:"confidence" binding:"min=0,max=100"`
+	// Expense is checked once confirmed, the source may leave out what it
+	// couldn't tell, e.g. the description
+	Expense expenseJSON `json:"expense" binding:"-"`
+}
+
+// reviewParams parses the trip and review IDs of the path
+func reviewParams(r *http.Request) (tripID, reviewID int64, err error) {
+	tripID, err = strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	reviewID, err = strconv.ParseInt(r.PathValue("review_id"), 10, 64)
+	return tripID, reviewID, err
+}
+
+// queueForReview queues the expense of the source for the review of the
+// participants of the trip, and returns it with 201
+func queueForReview(w http.ResponseWriter, r *http.Request, db *sql.DB, tripID int64, source string, confidence int, expense expenseJSON) {
+	payload, err := json.Marshal(expense)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	rv, err := trip.QueueForReview(requestContext(r), db, tripID, source, confidence, payload)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, rv)
+}
+
+// postReview queues an imported expense for review, it doesn't count
+// toward the balances until confirmed
+func postReview(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var rj reviewJSON
+	err = bindJSON(r, &rj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	queueForReview(w, r, db, tripID, rj.Source, rj.Confidence, rj.Expense)
+}
+
+// getReviews returns the expenses of a trip queued for review, the least
+// confident first. The trip is loaded first, for a trip missing or deleted
+// not to pass for one with an empty queue.
+func getReviews(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	queue, err := trip.LoadReviewQueue(requestContext(r), db, t.ID)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, queue)
+}
+
+// putReview corrects an expense queued for review, the payload is the
+// whole expense, as when adding one
+func putReview(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, reviewID, err := reviewParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var expense expenseJSON
+	err = bindJSON(r, &expense)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	err = expense.defaultSplit(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	_, err = expense.Translate()
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	payload, err := json.Marshal(expense)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	rv, err := trip.CorrectReviewed(ctx, db, tripID, reviewID, payload)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rv)
+}
+
+// postReviewConfirm adds an expense queued for review to its trip, as of
+// the version in If-Match if given, and removes it from the queue
+func postReviewConfirm(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, reviewID, err := reviewParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	rv, err := trip.LoadReviewed(ctx, db, tripID, reviewID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// the expense is checked as if posted, it may have been queued
+	// incomplete
+	var expense expenseJSON
+	err = json.Unmarshal(rv.Expense, &expense)
+	if err == nil {
+		err = validatePayload(&expense)
+	}
+	if err == nil {
+		err = expense.normalize()
+	}
+	if err == nil {
+		err = expense.defaultSplit(ctx, db, tripID)
+	}
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	e, err := expense.Translate()
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t := addExpense(w, r, db, tripID, expense, e, 0)
+	if t == nil {
+		return
+	}
+	err = trip.DeleteReviewed(ctx, db, t.ID, reviewID)
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to remove the confirmed expense %d from the review queue: %v\n", reviewID, err)
+	}
+	w.Header().Set("ETag", t.ETag())
+	e = t.Expenses[len(t.Expenses)-1]
+	writeJSON(w, http.StatusAccepted, map[string]any{"expense_id": e.ID})
+}
+
+// deleteReview discards an expense queued for review
+func deleteReview(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, reviewID, err := reviewParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = trip.DeleteReviewed(requestContext(r), db, tripID, reviewID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// sheetsClientID and sheetsClientSecret are the OAuth credentials of
+	// the server registered with Google, the export to Google Sheets is
+	// off without them
+	sheetsClientID     string
+	sheetsClientSecret string
+	// googleSheets is the client of the Google APIs set up from the flags
+	// at startup, nil if the export is off
+	googleSheets *trip.GoogleSheets
+)
+
+// sheetsStates are the pending connections of the Google accounts, the
+// email address of the user by state, see sheetsState
+var sheetsStates = struct {
+	mu     sync.Mutex
+	states map[string]sheetsState
+}{states: make(map[string]sheetsState)}
+
+// sheetsState is a pending connection of a Google account
+type sheetsState struct {
+	email  string
+	expiry time.Time
+}
+
+// googleConnectJSON is returned to start connecting a Google account
+type googleConnectJSON struct {
+	// AuthorizationURL is the page of Google the user is sent to, to grant
+	// the server access to the spreadsheets it creates in their Drive
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+// tripSheetJSON is used for PUT to link a trip to a spreadsheet
+type tripSheetJSON struct {
+	// User is the email address of the user in whose Drive the spreadsheet
+	// is, they must have connected their Google account
+	User                string `json:"user" binding:"required,email_address"`
+	TemplateID          string `json:"template_id"`
+	RefreshOnCompletion bool   `json:"refresh_on_completion"`
+}
+
+// setupSheets sets up the export to Google Sheets from the flags, and
+// refreshes the spreadsheets of the trips asking for it once they're
+// completed, in the background, after the notifications
+func setupSheets(db *sql.DB) {
+	if sheetsClientID == "" {
+		return
+	}
+	if sheetsClientSecret == "" {
+		log.Fatal("--sheets-client-id requires --sheets-client-secret")
+	}
+	googleSheets = &trip.GoogleSheets{ClientID: sheetsClientID, ClientSecret: sheetsClientSecret}
+	log.Printf("Exporting the trips to Google Sheets\n")
+	notifyCompletion := trip.CompletionHook
+	trip.CompletionHook = func(ctx context.Context, t *trip.Trip, s trip.Settlement) {
+		notifyCompletion(ctx, t, s)
+		ctx = context.WithoutCancel(ctx)
+		go func() {
+			sheet, err := trip.LoadTripSheet(ctx, db, t.ID)
+			if err != nil || !sheet.RefreshOnCompletion {
+				return
+			}
+			// the failure is recorded with the spreadsheet, and logged
+			googleSheets.RefreshSheet(ctx, db, t, s)
+		}()
+	}
+}
+
+// sheetsRedirectURI returns the URL Google sends the user back to,
+// registered with Google
+func sheetsRedirectURI(r *http.Request) string {
+	return serverURL(r) + "/v1/google/callback"
+}
+
+// sheetsEnabled reports the export to Google Sheets being off, and
+// returns false, if it is
+func sheetsEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if googleSheets == nil {
+		jsonBail(w, r, http.StatusServiceUnavailable, errors.New("the export to Google Sheets isn't enabled on this server"))
+		return false
+	}
+	return true
+}
+
+// postGoogleConnect starts connecting the Google account of a user, for
+// the user only: the client sends them to the authorization URL returned
+func postGoogleConnect(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !sheetsEnabled(w, r) {
+		return
+	}
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can connect their Google account", email))
+		return
+	}
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	state := base64.RawURLEncoding.EncodeToString(b)
+	now := trip.Now()
+	sheetsStates.mu.Lock()
+	for s, pending := range sheetsStates.states {
+		if !now.Before(pending.expiry) {
+			delete(sheetsStates.states, s)
+		}
+	}
+	sheetsStates.states[state] = sheetsState{email: email, expiry: now.Add(oidcStateTTL)}
+	sheetsStates.mu.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, googleConnectJSON{AuthorizationURL: googleSheets.AuthCodeURL(sheetsRedirectURI(r), state)})
+}
+
+// getGoogleCallback keeps the grant of the Google account of the user
+// Google sent back, the state telling who they are
+func getGoogleCallback(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !sheetsEnabled(w, r) {
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		jsonBail(w, r, http.StatusUnauthorized, fmt.Errorf("the access to Google Sheets was refused: %s", e))
+		return
+	}
+	code, state := r.URL.Query().Get("code"), r.URL.Query().Get("state")
+	sheetsStates.mu.Lock()
+	pending, ok := sheetsStates.states[state]
+	delete(sheetsStates.states, state)
+	sheetsStates.mu.Unlock()
+	if code == "" || !ok || !trip.Now().Before(pending.expiry) {
+		jsonBail(w, r, http.StatusBadRequest, errors.New("missing code, or unknown or expired state"))
+		return
+	}
+	err := googleSheets.Connect(requestContext(r), db, pending.email, code, sheetsRedirectURI(r))
+	switch {
+	case errors.Is(err, trip.ErrGoogleAPI):
+		jsonBail(w, r, http.StatusBadGateway, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	writeJSON(w, http.StatusOK, map[string]any{"user": pending.email, "google_connected": true})
+}
+
+// deleteGoogleConnect forgets the grant of the Google account of a user,
+// for the user only
+func deleteGoogleConnect(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can disconnect their Google account", email))
+		return
+	}
+	err := trip.DisconnectGoogle(requestContext(r), db, email)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, trip.ErrNoGoogleAccount)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTripSheet returns the spreadsheet a trip is exported to
+func getTripSheet(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	sheet, err := trip.LoadTripSheet(requestContext(r), db, t.ID)
+	switch {
+	case err == trip.ErrNoSheet:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sheet)
+}
+
+// putTripSheet links a trip to a spreadsheet of the Drive of one of its
+// participants, acting for them
+func putTripSheet(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !sheetsEnabled(w, r) {
+		return
+	}
+	var sj tripSheetJSON
+	err := decodeJSON(r, &sj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	if !t.IsParticipant(sj.User) || !actsFor(r, sj.User) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only a participant of the trip can export it to their Drive"))
+		return
+	}
+	sheet, err := t.LinkSheet(requestContext(r), db, sj.User, sj.TemplateID, sj.RefreshOnCompletion)
+	switch {
+	case err == trip.ErrNoGoogleAccount || err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sheet)
+}
+
+// deleteTripSheet stops exporting a trip, for the participant the
+// spreadsheet is of, or the owner
+func deleteTripSheet(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	t, ok := loadTrip(w, r, db)
+	if !ok {
+		return
+	}
+	ctx := requestContext(r)
+	sheet, err := trip.LoadTripSheet(ctx, db, t.ID)
+	if err == nil && !actsFor(r, sheet.User) && !actsFor(r, t.Owner.Email) {
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the user of the spreadsheet, or the owner of the trip, can stop the export"))
+		return
+	}
+	if err == nil {
+		err = trip.UnlinkSheet(ctx, db, t.ID)
+	}
+	switch {
+	case err == trip.ErrNoSheet:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postTripSheetRefresh writes the trip, with its settlement as it stands,
+// to its spreadsheet, and returns the spreadsheet
+func postTripSheetRefresh(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !sheetsEnabled(w, r) {
+		return
+	}
+	if r.URL.Query().Get("as_of") != "" {
+		jsonBail(w, r, http.StatusBadRequest, trip.ErrPastTrip)
+		return
+	}
+	t, settlement := settledTrip(w, r, db)
+	if t == nil {
+		return
+	}
+	sheet, err := googleSheets.RefreshSheet(requestContext(r), db, t, settlement)
+	switch {
+	case err == trip.ErrNoSheet:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrNoGoogleAccount:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case errors.Is(err, trip.ErrGoogleAPI):
+		jsonBail(w, r, http.StatusBadGateway, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sheet)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+const (
+	// statsTTL is how long the computed statistics are cached
+	statsTTL = time.Minute
+	// statsBusiest is the number of busiest trips reported
+	statsBusiest = 5
+	// errorBuckets is the number of hourly buckets kept for the error rates
+	errorBuckets = 24
+)
+
+// errorBucket counts the responses within an hour
+type errorBucket struct {
+	Start        time.Time `json:"start"`
+	Requests     int       `json:"requests"`
+	ClientErrors int       `json:"client_errors"`
+	ServerErrors int       `json:"server_errors"`
+}
+
+// errorRates keeps the hourly counts of responses, up to errorBuckets hours
+type errorRates struct {
+	mu      sync.Mutex
+	buckets []errorBucket
+}
+
+// record counts a response with the given status
+func (er *errorRates) record(now time.Time, status int) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	start := now.UTC().Truncate(time.Hour)
+	if len(er.buckets) == 0 || !er.buckets[len(er.buckets)-1].Start.Equal(start) {
+		er.buckets = append(er.buckets, errorBucket{Start: start})
+		if len(er.buckets) > errorBuckets {
+			er.buckets = er.buckets[len(er.buckets)-errorBuckets:]
+		}
+	}
+	b := &er.buckets[len(er.buckets)-1]
+	b.Requests++
+	switch {
+	case status >= 500:
+		b.ServerErrors++
+	case status >= 400:
+		b.ClientErrors++
+	}
+}
+
+// snapshot returns a copy of the buckets, oldest first
+func (er *errorRates) snapshot() []errorBucket {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	return append([]errorBucket{}, er.buckets...)
+}
+
+// middleware records the status of every response
+func (er *errorRates) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		er.record(time.Now(), sw.status)
+	})
+}
+
+// statsCache holds the last computed statistics
+type statsCache struct {
+	mu    sync.Mutex
+	at    time.Time
+	stats *trip.Stats
+}
+
+// get returns the cached statistics and when they were computed,
+// recomputing them if they're older than statsTTL
+func (sc *statsCache) get(ctx context.Context, db *sql.DB) (*trip.Stats, time.Time, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.stats == nil || time.Since(sc.at) >= statsTTL {
+		s, err := trip.LoadStats(ctx, db, statsBusiest)
+		if err != nil {
+			return nil, sc.at, err
+		}
+		sc.stats, sc.at = s, time.Now()
+	}
+	return sc.stats, sc.at, nil
+}
+
+var (
+	// requestErrors tracks the error rates of the API
+	requestErrors = new(errorRates)
+	// cachedStats caches the usage statistics
+	cachedStats = new(statsCache)
+)
+
+// getStats returns the instance-wide usage statistics
+func getStats(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	ctx := requestContext(r)
+	s, at, err := cachedStats.get(ctx, db)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"stats":       s,
+		"computed_at": at,
+		"error_rates": requestErrors.snapshot(),
+		// slow_queries is only counted with --slow-query
+		"slow_queries": trip.SlowQueryCount(),
+	})
+}
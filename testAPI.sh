@@ -23,7 +23,7 @@ echo
 curl -v http://127.0.0.1:8081/trips/1/expenses -H "content-type: application/json" -d '{"date":"2025-01-02", "description":"tickets", "participants":{"alice@test.com":6000, "bob@test.com":0, "charlie@test.com":0}}'
 echo
 # Settle
-curl -v http://127.0.0.1:8081/trips/1/settlement
+curl -v -X POST http://127.0.0.1:8081/trips/1/settle
 echo
 # Shutdown container
 docker stop trip-accountant && docker rm -v trip-accountant
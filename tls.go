@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// tlsCert and tlsKey are the files of the certificate, and its key,
+	// served over HTTPS. The server speaks plain HTTP without them.
+	tlsCert string
+	tlsKey  string
+	// acmeDomains are the domains of the certificates obtained from Let's
+	// Encrypt, instead of tlsCert and tlsKey, for --acme-domains
+	acmeDomains []string
+	// acmeCache is the directory keeping the certificates obtained, so
+	// they survive a restart
+	acmeCache = "/srv/trip-accountant/data/acme"
+	// acmeEmail is the contact address given to Let's Encrypt, optional
+	acmeEmail string
+	// acmeHTTPPort is the port answering the HTTP challenges of Let's
+	// Encrypt and redirecting to HTTPS, 0 disables it
+	acmeHTTPPort = 80
+)
+
+// serve listens on bindAddr, over HTTPS with the certificate of
+// --tls-cert/--tls-key or of the ACME mode, or over plain HTTP
+func serve(bindAddr string, handler http.Handler) error {
+	switch {
+	case len(acmeDomains) > 0:
+		if tlsCert != "" || tlsKey != "" {
+			return errors.New("--acme-domains can't be used with --tls-cert and --tls-key")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomains...),
+			Cache:      autocert.DirCache(acmeCache),
+			Email:      acmeEmail,
+		}
+		if acmeHTTPPort > 0 {
+			httpAddr := fmt.Sprintf(":%d", acmeHTTPPort)
+			go func() {
+				log.Printf("Answering the ACME challenges on %s\n", httpAddr)
+				err := newServer(httpAddr, m.HTTPHandler(nil)).ListenAndServe()
+				if err != nil {
+					log.Fatalf("ERROR: %v", err)
+				}
+			}()
+		}
+		srv := newServer(bindAddr, handler)
+		srv.TLSConfig = m.TLSConfig()
+		log.Printf("Listening on %s over HTTPS, certificates from Let's Encrypt for %v\n", bindAddr, acmeDomains)
+		return srv.ListenAndServeTLS("", "")
+	case tlsCert != "" || tlsKey != "":
+		if tlsCert == "" || tlsKey == "" {
+			return errors.New("--tls-cert and --tls-key must be given together")
+		}
+		log.Printf("Listening on %s over HTTPS\n", bindAddr)
+		return newServer(bindAddr, handler).ListenAndServeTLS(tlsCert, tlsKey)
+	default:
+		log.Printf("Listening on %s\n", bindAddr)
+		return newServer(bindAddr, handler).ListenAndServe()
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/apierror"
+	"github.com/dvusboy/trip-accountant/trip"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	// tokenTTL is the default lifetime of an API token
+	tokenTTL = 30 * 24 * time.Hour
+	// tokenMaxTTL is the maximum lifetime of an API token
+	tokenMaxTTL = 365 * 24 * time.Hour
+	// tokenKey is the key of the authenticated token in the context of
+	// the request
+	tokenKey contextKey = "token"
+	// apiKeyHeader carries the secret of an API token, for the clients
+	// which can't set the Authorization header, e.g. some chat bots
+	apiKeyHeader = "X-API-Key"
+	// userKey is the key of the user logged in in the context of the
+	// request, when it carries a session token
+	userKey contextKey = "user"
+)
+
+// tokenJSON is used for POST to issue an API token
+type tokenJSON struct {
+	Scope  string `json:"scope" binding:"required"`
+	TripID int64  `json:"trip_id"`
+	// ExpiresIn is the lifetime of the token in seconds
+	ExpiresIn int64 `json:"expires_in" binding:"min=0"`
+}
+
+// bearerToken extracts the token from the Authorization header, or from
+// the X-API-Key header without it
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return strings.TrimSpace(r.Header.Get(apiKeyHeader))
+}
+
+// requireScope returns a middleware checking the request carries a token
+// granting the scope, on the trip of the request if it's about one.
+// Tokens are only required when the server is started with --root-token,
+// while a session token, see login.go, is always checked, its user being
+// the one the request acts for.
+func requireScope(db *sql.DB, scope trip.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret := bearerToken(r)
+			if trip.SessionsEnabled() && trip.IsSessionToken(secret) {
+				requireSession(w, r, next, db, secret, scope)
+				return
+			}
+			if rootToken == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if secret == "" {
+				jsonBail(w, r, http.StatusUnauthorized, errors.New("missing bearer token"))
+				return
+			}
+
+			var tok *trip.Token
+			if subtle.ConstantTimeCompare([]byte(secret), []byte(rootToken)) == 1 {
+				tok = &trip.Token{Scope: trip.ScopeAdmin}
+			} else {
+				var err error
+				tok, err = trip.LookupToken(requestContext(r), db, secret)
+				switch {
+				case err == sql.ErrNoRows:
+					jsonBail(w, r, http.StatusUnauthorized, errors.New("invalid bearer token"))
+					return
+				case err == trip.ErrTokenExpired || err == trip.ErrTokenRevoked:
+					jsonBail(w, r, http.StatusUnauthorized, err)
+					return
+				case err != nil:
+					jsonBail(w, r, http.StatusInternalServerError, err)
+					return
+				}
+			}
+
+			var tripID int64
+			if v := r.PathValue("trip_id"); v != "" {
+				// An invalid trip ID is reported by the handler, a token
+				// restricted to a trip is refused anyway
+				tripID, _ = strconv.ParseInt(v, 10, 64)
+			}
+			ok, err := tok.Permits(requestContext(r), db, tripID, scope)
+			switch {
+			case err != nil:
+				jsonBail(w, r, http.StatusInternalServerError, err)
+				return
+			case !ok:
+				jsonBail(w, r, http.StatusForbidden, fmt.Errorf("token doesn't grant the %s scope on this resource", scope))
+				return
+			}
+			// the changes are recorded in the audit log as made by the
+			// user of the token
+			ctx := trip.WithActor(r.Context(), tok.Email)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, tokenKey, tok)))
+		})
+	}
+}
+
+// requireSession checks the session token grants the scope, sessions
+// having the write scope on the trips of their user, and passes the
+// request on with its user in the context
+func requireSession(w http.ResponseWriter, r *http.Request, next http.Handler, db *sql.DB, secret string, scope trip.Scope) {
+	s, err := trip.ParseSession(secret)
+	if err != nil {
+		jsonBail(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	usr, err := trip.SessionUser(requestContext(r), db, s)
+	switch {
+	case err == trip.ErrInvalidSession:
+		jsonBail(w, r, http.StatusUnauthorized, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	var tripID int64
+	if v := r.PathValue("trip_id"); v != "" {
+		tripID, _ = strconv.ParseInt(v, 10, 64)
+	}
+	tok := &trip.Token{Email: usr.Email, Scope: trip.ScopeWrite}
+	ok, err := tok.Permits(requestContext(r), db, tripID, scope)
+	switch {
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	case !ok:
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("session doesn't grant the %s scope on this resource", scope))
+		return
+	}
+	ctx := context.WithValue(trip.WithActor(r.Context(), usr.Email), tokenKey, tok)
+	next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, userKey, usr)))
+}
+
+// requestToken returns the token of the request, nil if the tokens aren't
+// required
+func requestToken(r *http.Request) *trip.Token {
+	tok, _ := r.Context().Value(tokenKey).(*trip.Token)
+	return tok
+}
+
+// authUser returns the user logged in, nil if the request doesn't carry a
+// session token
+func authUser(r *http.Request) *trip.User {
+	usr, _ := r.Context().Value(userKey).(*trip.User)
+	return usr
+}
+
+// actsFor tells whether the request can act as the user of the email
+// address: its token was issued to them, or has the admin scope. It's
+// always the case when the tokens aren't required.
+func actsFor(r *http.Request, email string) bool {
+	tok := requestToken(r)
+	if tok == nil {
+		return true
+	}
+	return tok.Scope == trip.ScopeAdmin || strings.EqualFold(tok.Email, email)
+}
+
+// postToken issues an API token to a user
+func postToken(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var tj tokenJSON
+	err := decodeJSON(r, &tj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	scope := trip.Scope(tj.Scope)
+	if !scope.Valid() {
+		jsonBail(w, r, http.StatusBadRequest, fmt.Errorf("invalid scope %q", tj.Scope))
+		return
+	}
+	ttl := tokenTTL
+	if tj.ExpiresIn != 0 {
+		ttl = time.Duration(tj.ExpiresIn) * time.Second
+	}
+	if ttl > tokenMaxTTL {
+		jsonBail(w, r, http.StatusBadRequest, fmt.Errorf("token lifetime is longer than %v", tokenMaxTTL))
+		return
+	}
+
+	ctx := requestContext(r)
+	email := r.PathValue("email")
+	if tj.TripID != 0 {
+		t, err := trip.LoadTripByID(ctx, db, tj.TripID)
+		switch {
+		case err == sql.ErrNoRows:
+			jsonBail(w, r, http.StatusNotFound, err)
+			return
+		case err != nil:
+			jsonBail(w, r, http.StatusBadRequest, err)
+			return
+		}
+		if !t.IsParticipant(email) {
+			jsonBail(w, r, http.StatusBadRequest, apierror.New(apierror.ParticipantUnknown, fmt.Errorf("%s is not a participant of trip %d", email, tj.TripID)))
+			return
+		}
+	}
+	usr, err := trip.LoadOrCreateUser(ctx, db, email)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	tok, err := trip.IssueToken(ctx, db, usr, tj.TripID, scope, ttl)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, tok)
+}
+
+// getTokens lists the API tokens of a user, without their secrets
+func getTokens(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	toks, err := trip.LoadTokensByUser(requestContext(r), db, r.PathValue("email"))
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toks)
+}
+
+// postTokenRotation replaces an API token by a new one with a new secret
+func postTokenRotation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tokenID, err := strconv.ParseInt(r.PathValue("token_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	tok, err := trip.RotateToken(requestContext(r), db, tokenID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTokenRevoked:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, tok)
+}
+
+// deleteToken revokes an API token
+func deleteToken(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tokenID, err := strconv.ParseInt(r.PathValue("token_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = trip.RevokeToken(requestContext(r), db, tokenID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mintToken is the mint-token command, it issues an API token to a user
+// straight in the database, e.g. for the first integration of a server, or
+// one without --root-token. The token is printed with its secret.
+func mintToken(args []string) {
+	fs := flag.NewFlagSet("mint-token", flag.ExitOnError)
+	dbFlag := fs.String("db", dbURL, "URL of the database, see --db")
+	prefix := fs.String("table-prefix", "", "prefix of the names of the tables, see --table-prefix")
+	email := fs.String("user", "", "email address of the user the token is issued to")
+	scopeFlag := fs.String("scope", string(trip.ScopeWrite), "scope of the token: read, write or admin")
+	tripID := fs.Int64("trip-id", 0, "ID of the trip the token is restricted to, all trips if 0")
+	ttl := fs.Duration("expires-in", tokenTTL, "lifetime of the token, at most 8760h")
+	fs.Parse(args)
+	if *email == "" {
+		log.Fatalf("ERROR: mint-token needs --user")
+	}
+	if *ttl > tokenMaxTTL {
+		log.Fatalf("ERROR: the lifetime of a token is at most %v", tokenMaxTTL)
+	}
+
+	db, _, err := openDataURL(*dbFlag, *prefix)
+	if err != nil {
+		log.Fatalf("ERROR: failed to open the database: %v", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if *tripID != 0 {
+		t, err := trip.LoadTripByID(ctx, db, *tripID)
+		if err != nil {
+			log.Fatalf("ERROR: failed to load trip %d: %v", *tripID, err)
+		}
+		if !t.IsParticipant(*email) {
+			log.Fatalf("ERROR: %s is not a participant of trip %d", *email, *tripID)
+		}
+	}
+	usr, err := trip.LoadOrCreateUser(ctx, db, *email)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	tok, err := trip.IssueToken(ctx, db, usr, *tripID, trip.Scope(*scopeFlag), *ttl)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(tok)
+}
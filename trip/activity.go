@@ -0,0 +1,91 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit publishes the activity of the trips to the subscribers within
+// the process, e.g. the clients following a trip live. Unlike the events
+// of the webhooks, nothing is stored: the activity is only published once
+// committed, and a subscriber not keeping up misses some.
+
+package trip
+
+import (
+	"sync"
+)
+
+// The kinds of Activity
+const (
+	// ActivityExpenseAdded carries the Expense added
+	ActivityExpenseAdded = "expense.added"
+	// ActivityExpenseRemoved carries the ID of the expense removed
+	ActivityExpenseRemoved = "expense.removed"
+	// ActivityTripChanged is any other change of the trip, e.g. its
+	// participants, affecting the settlement or not
+	ActivityTripChanged = "trip.changed"
+	// ActivityTripCompleted is the completion of the trip
+	ActivityTripCompleted = "trip.completed"
+)
+
+// activityBuffer is the number of activities a subscriber can be behind
+// before missing some
+const activityBuffer = 16
+
+// Activity is a change of a trip, published once committed
+type Activity struct {
+	// TripID is the primary key of the trip
+	TripID int64 `json:"trip_id"`
+	// Kind is one of the Activity* constants
+	Kind string `json:"kind"`
+	// Version is the version of the trip after the change, see ETag()
+	Version int64 `json:"version"`
+	// Data depends on Kind
+	Data any `json:"data,omitempty"`
+}
+
+// activityHub keeps the subscribers, by trip ID
+type activityHub struct {
+	mu   sync.Mutex
+	subs map[int64]map[chan Activity]bool
+}
+
+// activities are the subscribers of the process
+var activities = activityHub{subs: make(map[int64]map[chan Activity]bool)}
+
+// SubscribeActivity returns the channel receiving the activity of a trip,
+// and the function to call to unsubscribe, which closes the channel
+func SubscribeActivity(tripID int64) (<-chan Activity, func()) {
+	ch := make(chan Activity, activityBuffer)
+	activities.mu.Lock()
+	defer activities.mu.Unlock()
+	if activities.subs[tripID] == nil {
+		activities.subs[tripID] = make(map[chan Activity]bool)
+	}
+	activities.subs[tripID][ch] = true
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			activities.mu.Lock()
+			defer activities.mu.Unlock()
+			delete(activities.subs[tripID], ch)
+			if len(activities.subs[tripID]) == 0 {
+				delete(activities.subs, tripID)
+			}
+			close(ch)
+		})
+	}
+}
+
+// publishActivity sends the activity to the subscribers of the trip,
+// without waiting for the ones not keeping up
+func (trip *Trip) publishActivity(kind string, data any) {
+	a := Activity{TripID: trip.ID, Kind: kind, Version: trip.Version, Data: data}
+	activities.mu.Lock()
+	defer activities.mu.Unlock()
+	for ch := range activities.subs[trip.ID] {
+		select {
+		case ch <- a:
+		default:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the activity of the trips.
+
+package trip
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// kinds returns the kinds of the activities received so far
+func kinds(ch <-chan Activity) []string {
+	rslt := []string{}
+	for {
+		select {
+		case a := <-ch:
+			rslt = append(rslt, a.Kind)
+		default:
+			return rslt
+		}
+	}
+}
+
+// TestActivity follows a trip through its changes, until it's completed
+func TestActivity(t *testing.T) {
+	ctx := context.Background()
+	adb := openTestDB(t)
+	tr := NewTrip("Trip A", alice, "", NewDate(time.Now()), []string{bob, charlie})
+	err := tr.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	completions, expenses := 0, 0
+	defer func(hook func(context.Context, *Trip, Settlement)) { CompletionHook = hook }(CompletionHook)
+	defer func(hook func(context.Context, *Trip, *Expense)) { ExpenseHook = hook }(ExpenseHook)
+	ExpenseHook = func(_ context.Context, _ *Trip, e *Expense) {
+		if e.Description == "lunch" {
+			expenses++
+		}
+	}
+	CompletionHook = func(_ context.Context, completed *Trip, _ Settlement) {
+		if completed.ID == tr.ID {
+			completions++
+		}
+	}
+	ch, unsubscribe := SubscribeActivity(tr.ID)
+	other, unsubscribeOther := SubscribeActivity(tr.ID + 1)
+	defer unsubscribeOther()
+
+	err = tr.AddExpense(NewDate(time.Now()), "lunch", []Participant{{alice, 0, 3000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.SetOrganizerFee(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.RemoveExpense(tr.Expenses[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.RemoveParticipant(charlie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Complete(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ActivityExpenseAdded, ActivityTripChanged, ActivityExpenseRemoved, ActivityTripChanged, ActivityTripCompleted}
+	if got := kinds(ch); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := kinds(other); len(got) != 0 {
+		t.Errorf("expected nothing for another trip, got %v", got)
+	}
+
+	unsubscribe()
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Error("expected the channel to be closed")
+	}
+	tr.publishActivity(ActivityTripChanged, nil)
+
+	// the hook is only called the first time the trip is completed
+	_, err = tr.Complete(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completions != 1 {
+		t.Errorf("expected CompletionHook to be called once, got %d", completions)
+	}
+	if expenses != 1 {
+		t.Errorf("expected ExpenseHook to be called once, got %d", expenses)
+	}
+}
@@ -0,0 +1,217 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the approval of the expenses. The owner of a trip
+// may require each participant to approve the list of expenses before the
+// settlement is final. An approval is of a version of the trip, so any
+// later change of the trip, e.g. a new expense, has to be approved again.
+// Until everyone has approved the current version, the settlement is only
+// previewed and the trip isn't completed. The owner may delegate their
+// approval to a co-treasurer, see DelegateApprovals().
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	approvalUpsert = `INSERT INTO expense_approval (trip_id, user_id, version, approved_at) VALUES (?, ?, ?, ?)
+ON CONFLICT (trip_id, user_id) DO UPDATE SET version = excluded.version, approved_at = excluded.approved_at`
+	approvalSelect = `SELECT u.email, a.version, a.approved_at
+FROM expense_approval AS a, tuser AS u
+WHERE u.user_id = a.user_id
+AND a.trip_id = ?
+ORDER BY u.email`
+)
+
+// Approval is the approval of the expenses of a trip by a participant
+type Approval struct {
+	User string `json:"user"`
+	// Version is the version of the trip approved
+	Version    int64     `json:"version"`
+	ApprovedAt time.Time `json:"approved_at"`
+	// Current is set when the approval is of the current version of the
+	// trip, the other ones are outdated
+	Current bool `json:"current"`
+}
+
+// Approvals are where the approval of the expenses of a trip stands
+type Approvals struct {
+	// Required is set when the settlement waits for the approvals, see
+	// Trip.SetApprovalRequired()
+	Required bool `json:"required"`
+	// Version is the current version of the trip, the one to approve
+	Version  int64      `json:"version"`
+	Approved []Approval `json:"approved"`
+	// Pending are the participants who haven't approved the current
+	// version, the ones who declined the trip aside
+	Pending []string `json:"pending"`
+	// Delegation is set when the approval of the owner is the one of the
+	// co-treasurer, the owner isn't pending then
+	Delegation *Delegation `json:"delegation,omitempty"`
+}
+
+// Final tells whether the settlement of the trip is final: no approval is
+// required, or everyone approved
+func (a *Approvals) Final() bool {
+	return !a.Required || len(a.Pending) == 0
+}
+
+// PendingSettlement is the settlement of a trip still waiting for
+// approvals, a preview which doesn't complete the trip
+type PendingSettlement struct {
+	// Preview is always set, as a watermark of the numbers not being final
+	Preview    bool       `json:"preview"`
+	Pending    []string   `json:"pending_approvers"`
+	Settlement Settlement `json:"settlement"`
+	// DisplayNames are set on request, see NamedSettlement
+	DisplayNames map[string]string `json:"display_names,omitempty"`
+	AvatarURLs   map[string]string `json:"avatar_urls,omitempty"`
+}
+
+// SetApprovalRequired changes whether the settlement of the trip waits for
+// the participants to approve the expenses, written to the DB by Save()
+func (trip *Trip) SetApprovalRequired(required bool) {
+	trip.ApprovalRequired = required
+	trip.detailsChanged = true
+}
+
+// LoadApprovals returns the approvals of the expenses of the trip
+func (trip *Trip) LoadApprovals(ctx context.Context, db *sql.DB) (*Approvals, error) {
+	rows, err := db.QueryContext(ctx, approvalSelect, trip.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := &Approvals{Required: trip.ApprovalRequired, Version: trip.Version, Approved: []Approval{}, Pending: []string{}}
+	current := make(map[string]bool)
+	for rows.Next() {
+		var a Approval
+		var approvedAt int64
+		err = rows.Scan(&a.User, &a.Version, &approvedAt)
+		if err != nil {
+			return nil, err
+		}
+		// the approvals of the removed participants are left over
+		if !trip.IsParticipant(a.User) {
+			continue
+		}
+		a.ApprovedAt = time.UnixMicro(approvedAt).UTC()
+		a.Current = a.Version == trip.Version
+		current[a.User] = a.Current
+		rslt.Approved = append(rslt.Approved, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rslt.Delegation, err = trip.loadAppliedDelegation(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	for _, email := range trip.people() {
+		if rslt.Delegation != nil && email == trip.Owner.Email {
+			continue
+		}
+		if !current[email] && trip.rsvp(email) != RSVPDeclined {
+			rslt.Pending = append(rslt.Pending, email)
+		}
+	}
+	return rslt, nil
+}
+
+// ApproveExpenses records the approval of the expenses of the trip by the
+// participant, as of the current version of the trip. The approval isn't
+// a change of the trip, its version stays the same. If ifMatch is set,
+// it's the entity tag of the version reviewed, and ErrTripModified is
+// returned if the trip changed since. sql.ErrNoRows is returned if the
+// trip doesn't exist, an error wrapping ErrUnknownParticipant if the user
+// isn't a participant, and ErrApprovalDelegated if they're the owner whose
+// approval is delegated.
+func ApproveExpenses(ctx context.Context, db *sql.DB, tripID int64, email, ifMatch string) (*Approvals, error) {
+	unlock := lockTrip(tripID)
+	defer unlock()
+
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return nil, err
+	}
+	if ifMatch != "" && !trip.MatchETag(ifMatch) {
+		return nil, ErrTripModified
+	}
+	email = normalizeEmail(email)
+	userID, ok := trip.emailLookup[email]
+	if !ok {
+		return nil, fmt.Errorf("%s is %w", email, ErrUnknownParticipant)
+	}
+	if email == trip.Owner.Email {
+		d, err := trip.loadAppliedDelegation(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			return nil, ErrApprovalDelegated
+		}
+	}
+	_, err = db.ExecContext(ctx, approvalUpsert, trip.ID, userID, trip.Version, Now().UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "%s approved the expenses of trip %d at version %d\n", email, trip.ID, trip.Version)
+	return trip.LoadApprovals(ctx, db)
+}
+
+// PreviewApprovedTrip is PreviewSettlement() for the trips requiring the
+// approval of the expenses: until everyone approved, the PendingSettlement
+// is returned instead, with a nil Settlement. The trip isn't completed.
+func PreviewApprovedTrip(ctx context.Context, db *sql.DB, tripID int64) (Settlement, *PendingSettlement, error) {
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return nil, nil, err
+	}
+	preview, err := PreviewSettlement(ctx, db, tripID)
+	if err != nil || !trip.ApprovalRequired || !isUnset(trip.EndDate) {
+		return preview, nil, err
+	}
+	approvals, err := trip.LoadApprovals(ctx, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	if approvals.Final() {
+		return preview, nil, nil
+	}
+	return nil, &PendingSettlement{Preview: true, Pending: approvals.Pending, Settlement: preview}, nil
+}
+
+// SettleApprovedTrip is SettleTrip() for the trips requiring the approval
+// of the expenses: until everyone approved, the trip isn't completed and
+// the PendingSettlement is returned instead, with a nil Settlement. The
+// completed trips are settled as they are.
+func SettleApprovedTrip(ctx context.Context, db *sql.DB, tripID int64) (Settlement, *PendingSettlement, error) {
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !trip.ApprovalRequired || !isUnset(trip.EndDate) {
+		settlement, err := SettleTrip(ctx, db, tripID)
+		return settlement, nil, err
+	}
+	approvals, err := trip.LoadApprovals(ctx, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	if approvals.Final() {
+		settlement, err := trip.Complete(ctx, db)
+		return settlement, nil, err
+	}
+	preview, err := PreviewSettlement(ctx, db, tripID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, &PendingSettlement{Preview: true, Pending: approvals.Pending, Settlement: preview}, nil
+}
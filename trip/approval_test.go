@@ -0,0 +1,130 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the approval of the expenses.
+
+package trip
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	expenseApprovalCreate = `CREATE TABLE IF NOT EXISTS expense_approval (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+version INTEGER NOT NULL,
+approved_at INTEGER NOT NULL,
+CONSTRAINT expense_approval_pkey PRIMARY KEY (trip_id, user_id))`
+)
+
+// TestApproveExpenses requires the approvals of a trip, has them given
+// then outdated by a new expense, and checks the settlement waits for them
+func TestApproveExpenses(t *testing.T) {
+	ctx := context.Background()
+	adb := openTestDB(t)
+	tr := NewTrip("Approved", alice, "", NewDate(time.Now()), []string{bob, charlie})
+	err := tr.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.SetRSVP(charlie, RSVPDeclined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "hotel", []Participant{{alice, 0, 2000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.SetApprovalRequired(true)
+	err = tr.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ApproveExpenses(ctx, adb, tr.ID, david, "")
+	if !errors.Is(err, ErrUnknownParticipant) {
+		t.Errorf("expected a non-participant to be refused, got %v", err)
+	}
+	_, err = ApproveExpenses(ctx, adb, tr.ID, bob, `"0.0"`)
+	if err != ErrTripModified {
+		t.Errorf("expected an outdated version to be refused, got %v", err)
+	}
+	approvals, err := ApproveExpenses(ctx, adb, tr.ID, "Bob@test.com", tr.ETag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !approvals.Required || approvals.Version != tr.Version || len(approvals.Approved) != 1 ||
+		!approvals.Approved[0].Current || !reflect.DeepEqual(approvals.Pending, []string{alice}) {
+		t.Errorf("Unexpected approvals %+v", approvals)
+	}
+
+	// the settlement is a preview until everyone approved
+	settlement, pending, err := SettleApprovedTrip(ctx, adb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Settlement{bob: {alice: 1000}}
+	if settlement != nil || pending == nil || !pending.Preview || !reflect.DeepEqual(pending.Pending, []string{alice}) ||
+		!reflect.DeepEqual(pending.Settlement, want) {
+		t.Fatalf("expected a preview waiting for alice, got %v %+v", settlement, pending)
+	}
+
+	// a new expense outdates the approvals
+	tr, err = UpdateTrip(ctx, adb, tr.ID, func(tr *Trip) error {
+		return tr.AddExpense(NewDate(time.Now()), "dinner", []Participant{{bob, 0, 600}, {alice, 0, 0}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ApproveExpenses(ctx, adb, tr.ID, alice, tr.ETag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	approvals, err = tr.LoadApprovals(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approvals.Final() || approvals.Approved[1].Current || !reflect.DeepEqual(approvals.Pending, []string{bob}) {
+		t.Errorf("expected bob's approval to be outdated, got %+v", approvals)
+	}
+	_, pending, err = PreviewApprovedTrip(ctx, adb, tr.ID)
+	if err != nil || pending == nil || !reflect.DeepEqual(pending.Pending, []string{bob}) {
+		t.Errorf("expected a preview waiting for bob, got %+v: %v", pending, err)
+	}
+	_, err = ApproveExpenses(ctx, adb, tr.ID, bob, tr.ETag())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// approved, but only previewed
+	settlement, pending, err = PreviewApprovedTrip(ctx, adb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Settlement{bob: {alice: 700}}
+	if pending != nil || !reflect.DeepEqual(settlement, want) {
+		t.Errorf("expected the settlement %v, got %v %+v", want, settlement, pending)
+	}
+	tr, err = LoadTripByID(ctx, adb, tr.ID)
+	if err != nil || !isUnset(tr.EndDate) {
+		t.Errorf("expected the trip not to be completed by the preview, got %v: %v", tr, err)
+	}
+	settlement, pending, err = SettleApprovedTrip(ctx, adb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != nil || !reflect.DeepEqual(settlement, want) {
+		t.Errorf("expected the final settlement %v, got %v %+v", want, settlement, pending)
+	}
+	tr, err = LoadTripByID(ctx, adb, tr.ID)
+	if err != nil || isUnset(tr.EndDate) || !tr.ApprovalRequired {
+		t.Errorf("expected the trip to be completed, got %v: %v", tr, err)
+	}
+}
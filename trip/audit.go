@@ -0,0 +1,173 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the read-only export of the financial events,
+// in a fixed schema, for handing records to an accountant.
+
+package trip
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	auditExpenseSelect = `SELECT e.expense_id, e.trip_id, e.txn_date, e.created_at, e.description,
+COALESCE(r.replaced_id, 0), COALESCE(ru.email, ''), COALESCE(tu.email, '')
+FROM expense AS e
+LEFT JOIN expense_reassignment AS r ON r.expense_id = e.expense_id
+LEFT JOIN tuser AS ru ON ru.user_id = r.user_id
+LEFT JOIN tuser AS tu ON tu.user_id = r.target_id
+WHERE (? = 0 OR e.trip_id = ?)
+AND (? = 0 OR e.txn_date >= ?)
+AND (? = 0 OR e.txn_date <= ?)
+AND e.expense_id > ?
+ORDER BY e.expense_id
+LIMIT ?`
+)
+
+// Types of AuditEvent
+const (
+	// AuditExpense is an expense entered for a trip
+	AuditExpense = "expense"
+	// AuditReassignment is an expense replacing another, when a
+	// participant is removed from it, see ReassignParticipant()
+	AuditReassignment = "reassignment"
+)
+
+// AuditEvent is a single financial event in the audit export.
+// The schema is fixed, new kinds of events only add to the values of Type.
+type AuditEvent struct {
+	// Seq is the position of the event, and is the cursor for the next page
+	Seq int64 `json:"seq"`
+	// Type is the kind of event, e.g. AuditExpense
+	Type string `json:"type"`
+	// TripID is the trip the event belongs to
+	TripID int64 `json:"trip_id"`
+	// ExpenseID is the expense the event is about
+	ExpenseID int64 `json:"expense_id"`
+	// Date is the transaction date
+	Date Date `json:"date"`
+	// RecordedAt is when the event was entered
+	RecordedAt time.Time `json:"recorded_at"`
+	// Description describes the event
+	Description string `json:"description"`
+	// Amount is the total amount of the event (in cent)
+	Amount int `json:"amount"`
+	// Participants is the list of users involved and the amount they paid
+	Participants []Participant `json:"participants"`
+}
+
+// AuditQuery selects the events to export. Zero values are not used for filtering.
+type AuditQuery struct {
+	// TripID limits the export to a single trip
+	TripID int64
+	// From is the first transaction date to include
+	From Date
+	// To is the last transaction date to include
+	To Date
+	// After is the Seq of the last event of the previous page
+	After int64
+	// Limit is the maximum number of events to return
+	Limit int
+}
+
+// unixOrZero returns the epoch of d, or 0 if d isn't set
+func unixOrZero(d Date) int64 {
+	if isUnset(d.Time) {
+		return 0
+	}
+	return d.Unix()
+}
+
+// LoadAuditEvents returns a page of AuditEvent matching the query, ordered by Seq
+func LoadAuditEvents(ctx context.Context, db *sql.DB, q AuditQuery) ([]AuditEvent, error) {
+	from, to := unixOrZero(q.From), unixOrZero(q.To)
+	rows, err := db.QueryContext(ctx, auditExpenseSelect,
+		q.TripID, q.TripID, from, from, to, to, q.After, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := []AuditEvent{}
+	var txnDate, createdAt, replacedID int64
+	var removed, target string
+	for rows.Next() {
+		ev := AuditEvent{Type: AuditExpense}
+		err = rows.Scan(&ev.ExpenseID, &ev.TripID, &txnDate, &createdAt, &ev.Description, &replacedID, &removed, &target)
+		if err != nil {
+			return nil, err
+		}
+		if replacedID != 0 {
+			if target == "" {
+				target = "the other participants"
+			}
+			ev.Type = AuditReassignment
+			ev.Description = fmt.Sprintf("%s (replaces expense %d, share of %s reassigned to %s)", ev.Description, replacedID, removed, target)
+		}
+		ev.Seq = ev.ExpenseID
+		ev.Date = epochToDate(txnDate)
+		ev.RecordedAt = time.UnixMicro(createdAt).UTC()
+		rslt = append(rslt, ev)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	pStmt, err := db.PrepareContext(ctx, participantSelect)
+	if err != nil {
+		return nil, err
+	}
+	defer pStmt.Close()
+
+	for i := range rslt {
+		pRows, err := pStmt.QueryContext(ctx, rslt[i].ExpenseID)
+		if err != nil {
+			return nil, err
+		}
+		rslt[i].Participants = []Participant{}
+		for pRows.Next() {
+			p := Participant{}
+			err = pRows.Scan(&p.Email, &p.UserID, &p.Paid)
+			if err != nil {
+				pRows.Close()
+				return nil, err
+			}
+			rslt[i].Participants = append(rslt[i].Participants, p)
+			rslt[i].Amount += p.Paid
+		}
+		pRows.Close()
+	}
+	return rslt, nil
+}
+
+// WriteAuditEvents writes the events to w in JSON Lines format
+func WriteAuditEvents(w io.Writer, events []AuditEvent) error {
+	enc := json.NewEncoder(w)
+	for _, ev := range events {
+		err := enc.Encode(ev)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignAudit returns the hex encoded HMAC-SHA256 of data with the given key
+func SignAudit(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
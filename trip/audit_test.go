@@ -0,0 +1,102 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the audit export.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestLoadAuditEvents pages through the expenses of 2 trips,
+// by trip and by date range
+func TestLoadAuditEvents(t *testing.T) {
+	ctx := context.Background()
+	adb := openTestDB(t)
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	ta := NewTrip("Audit A", alice, "", NewDate(day), []string{bob})
+	tb := NewTrip("Audit B", bob, "", NewDate(day), []string{charlie})
+	for _, tr := range []*Trip{ta, tb} {
+		err := tr.Save(ctx, adb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		d := NewDate(day.AddDate(0, 0, i))
+		err := ta.AddExpense(d, "a", []Participant{{alice, 0, 1000}, {bob, 0, 0}})
+		if err != nil {
+			t.Error(err)
+		}
+		err = tb.AddExpense(d, "b", []Participant{{bob, 0, 500}, {charlie, 0, 100}})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for _, tr := range []*Trip{ta, tb} {
+		err := tr.Save(ctx, adb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// By trip, 2 per page
+	events, err := LoadAuditEvents(ctx, adb, AuditQuery{TripID: ta.ID, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expect a page of 2 events, got %d", len(events))
+	}
+	next, err := LoadAuditEvents(ctx, adb, AuditQuery{TripID: ta.ID, After: events[1].Seq, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 1 || next[0].Seq <= events[1].Seq {
+		t.Errorf("Expect the last event of trip A on the 2nd page: %#v", next)
+	}
+	if events[0].Type != AuditExpense || events[0].Amount != 1000 || len(events[0].Participants) != 2 {
+		t.Errorf("Unexpected event: %#v", events[0])
+	}
+
+	// By date range, across both trips
+	events, err = LoadAuditEvents(ctx, adb, AuditQuery{
+		From:  NewDate(day.AddDate(0, 0, 1)),
+		To:    NewDate(day.AddDate(0, 0, 1)),
+		Limit: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].TripID == events[1].TripID {
+		t.Errorf("Expect one event from each trip on the 2nd day: %#v", events)
+	}
+
+	var buf bytes.Buffer
+	err = WriteAuditEvents(&buf, events)
+	if err != nil {
+		t.Error(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Errorf("Expect 2 JSON lines, got %d", len(lines))
+	}
+	var ev map[string]any
+	err = json.Unmarshal([]byte(lines[0]), &ev)
+	if err != nil || ev["seq"] != float64(events[0].Seq) || ev["date"] != "2025-03-02" {
+		t.Errorf("Failed to read back the JSON line %q: %v", lines[0], err)
+	}
+	if SignAudit([]byte("key"), buf.Bytes()) == SignAudit([]byte("other"), buf.Bytes()) {
+		t.Error("Signature should depend on the key")
+	}
+}
@@ -0,0 +1,269 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the audit log of the changes of a trip: who did
+// what, and what it looked like before and after, recorded within the
+// transaction of the change. Unlike the audit export, see audit.go, which
+// lists the expenses as they stand, the log keeps what was deleted or
+// replaced, for the groups to settle who changed the numbers. The server
+// attaches who's acting to the context passed down to the data model.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	auditLogInsert = `INSERT INTO audit_log (trip_id, user_id, action, expense_id, before_state, after_state, recorded_at)
+VALUES (?, COALESCE((SELECT user_id FROM tuser WHERE email = ?), 0), ?, ?, ?, ?, ?)`
+	auditLogSelect = `SELECT a.audit_id, a.trip_id, COALESCE(u.email, ''), a.action, a.expense_id,
+a.before_state, a.after_state, a.recorded_at
+FROM audit_log AS a LEFT JOIN tuser AS u ON u.user_id = a.user_id
+WHERE a.trip_id = ?
+AND (? = 0 OR a.recorded_at >= ?)
+AND (? = 0 OR a.recorded_at < ?)
+AND a.audit_id > ?
+ORDER BY a.audit_id
+LIMIT ?`
+	auditTripSelect = "SELECT name, description, start_date, organizer_fee, approval_required FROM trip WHERE trip_id = ?"
+)
+
+// Actions of AuditEntry
+const (
+	// ActionTripCreated is a new trip, after is the trip
+	ActionTripCreated = "trip.created"
+	// ActionTripChanged is a change of the name, the description, the
+	// start date, the organizer fee or the approval of a trip, before and
+	// after are the trip
+	ActionTripChanged = "trip.changed"
+	// ActionTripCompleted is a trip completed, after is its settlement
+	ActionTripCompleted = "trip.completed"
+	// ActionTripArchived is a completed trip archived
+	ActionTripArchived = "trip.archived"
+	// ActionTripDeleted is a trip deleted, see DeleteTrip()
+	ActionTripDeleted = "trip.deleted"
+	// ActionTripRestored is a deleted trip restored
+	ActionTripRestored = "trip.restored"
+	// ActionParticipantsAdded are participants added to a trip, after is
+	// the list of their email addresses
+	ActionParticipantsAdded = "participants.added"
+	// ActionParticipantRemoved is a participant removed from a trip, before
+	// is the participant
+	ActionParticipantRemoved = "participant.removed"
+	// ActionExpenseAdded is an expense added, after is the expense
+	ActionExpenseAdded = "expense.added"
+	// ActionExpenseRemoved is an expense deleted, before is the expense
+	ActionExpenseRemoved = "expense.removed"
+	// ActionExpenseRestored is a deleted expense restored, after is the
+	// expense
+	ActionExpenseRestored = "expense.restored"
+	// ActionExpenseReassigned is an expense replaced when a participant
+	// is removed from it, see ReassignParticipant(), before is the expense
+	// and after the list of its replacements
+	ActionExpenseReassigned = "expense.reassigned"
+)
+
+// AuditEntry is a change of a trip in its audit log
+type AuditEntry struct {
+	// ID is the primary key and is from a sequence, it's the cursor for
+	// the next page
+	ID int64 `json:"audit_id"`
+	// TripID is the trip changed
+	TripID int64 `json:"trip_id"`
+	// Actor is the email address of who made the change, empty if it's
+	// unknown, e.g. when the tokens aren't required
+	Actor string `json:"actor"`
+	// Action is what was done, e.g. ActionExpenseAdded
+	Action string `json:"action"`
+	// ExpenseID is the expense changed, 0 if the change isn't about an
+	// expense
+	ExpenseID int64 `json:"expense_id"`
+	// Before and After are the snapshots of what was changed, in JSON,
+	// null if there's none, see the actions
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+	// RecordedAt is when the change was made
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// auditTrip is the snapshot of a trip in the audit log
+type auditTrip struct {
+	Name             string `json:"name"`
+	Description      string `json:"description"`
+	StartDate        Date   `json:"start_date"`
+	OrganizerFee     int    `json:"organizer_fee"`
+	ApprovalRequired bool   `json:"approval_required"`
+	// Owner and Participants are only set for a new trip, they're
+	// changed by their own actions
+	Owner        string   `json:"owner,omitempty"`
+	Participants []string `json:"participants,omitempty"`
+}
+
+// auditParticipant is the snapshot of a participant removed
+type auditParticipant struct {
+	Email string `json:"user"`
+	// ReassignedTo is who took over the shares of the participant, see
+	// ReassignParticipant()
+	ReassignedTo string `json:"reassigned_to,omitempty"`
+}
+
+// actorKey is the context key of the actor
+type actorKey struct{}
+
+// WithActor returns a copy of the context carrying the email address of
+// who's acting, recorded in the audit log
+func WithActor(ctx context.Context, email string) context.Context {
+	return context.WithValue(ctx, actorKey{}, normalizeEmail(email))
+}
+
+// Actor returns the email address of who's acting carried by the context,
+// or "" if none
+func Actor(ctx context.Context) string {
+	email, _ := ctx.Value(actorKey{}).(string)
+	return email
+}
+
+// execer runs the statements of the audit log, within a transaction or not
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// recordAudit adds an entry to the audit log of the trip, by the actor of
+// the context, at the time of the change. before and after are marshaled
+// in JSON, nil for none.
+func recordAudit(ctx context.Context, x execer, tripID int64, at time.Time, action string, expenseID int64, before, after any) error {
+	var snapshots [2]string
+	for i, v := range []any{before, after} {
+		if v == nil {
+			continue
+		}
+		doc, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		snapshots[i] = string(doc)
+	}
+	_, err := x.ExecContext(ctx, auditLogInsert, tripID, Actor(ctx), action, expenseID,
+		snapshots[0], snapshots[1], at.UnixMicro())
+	return err
+}
+
+// auditData returns the snapshot of the trip for the audit log
+func (trip *Trip) auditData() *auditTrip {
+	return &auditTrip{
+		Name:             trip.Name,
+		Description:      trip.Description,
+		StartDate:        trip.StartDate,
+		OrganizerFee:     trip.OrganizerFee,
+		ApprovalRequired: trip.ApprovalRequired,
+	}
+}
+
+// loadAuditTrip returns the snapshot of the trip as it's stored, before a
+// change. It's expected to be executed within a transaction
+func loadAuditTrip(ctx context.Context, txn *sql.Tx, tripID int64) (*auditTrip, error) {
+	var startDate int64
+	rslt := new(auditTrip)
+	err := txn.QueryRowContext(ctx, auditTripSelect, tripID).Scan(&rslt.Name, &rslt.Description,
+		&startDate, &rslt.OrganizerFee, &rslt.ApprovalRequired)
+	if err != nil {
+		return nil, err
+	}
+	rslt.StartDate = NewDate(time.Unix(startDate, 0).UTC())
+	return rslt, nil
+}
+
+// auditSave records the changes written by Save() at now, prev being the
+// snapshot of the trip before its details changed.
+// It's expected to be executed within a transaction
+func (trip *Trip) auditSave(ctx context.Context, txn *sql.Tx, now time.Time, created bool, added []*User, prev *auditTrip, newExpenses []*Expense) error {
+	var err error
+	switch {
+	case created:
+		data := trip.auditData()
+		data.Owner = trip.Owner.Email
+		data.Participants = trip.people()[1:]
+		err = recordAudit(ctx, txn, trip.ID, now, ActionTripCreated, 0, nil, data)
+	case prev != nil:
+		err = recordAudit(ctx, txn, trip.ID, now, ActionTripChanged, 0, prev, trip.auditData())
+	}
+	if err != nil {
+		return err
+	}
+	if len(added) > 0 {
+		emails := make([]string, 0, len(added))
+		for _, usr := range added {
+			emails = append(emails, usr.Email)
+		}
+		err = recordAudit(ctx, txn, trip.ID, now, ActionParticipantsAdded, 0, nil, emails)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range trip.removedExpenses {
+		err = recordAudit(ctx, txn, trip.ID, now, ActionExpenseRemoved, e.ID, e, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, usr := range trip.removed {
+		if usr.ID == 0 {
+			continue
+		}
+		err = recordAudit(ctx, txn, trip.ID, now, ActionParticipantRemoved, 0, auditParticipant{Email: usr.Email}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range newExpenses {
+		err = recordAudit(ctx, txn, trip.ID, now, ActionExpenseAdded, e.ID, nil, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadAuditLog returns a page of the audit log of the trip of the query,
+// in the order of the changes. The dates of the query are the ones the
+// changes were recorded on.
+func LoadAuditLog(ctx context.Context, db *sql.DB, q AuditQuery) ([]AuditEntry, error) {
+	var from, to int64
+	if !isUnset(q.From.Time) {
+		from = q.From.UnixMicro()
+	}
+	if !isUnset(q.To.Time) {
+		to = q.To.AddDate(0, 0, 1).UnixMicro()
+	}
+	rows, err := db.QueryContext(ctx, auditLogSelect, q.TripID, from, from, to, to, q.After, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := []AuditEntry{}
+	for rows.Next() {
+		var a AuditEntry
+		var before, after string
+		var recordedAt int64
+		err = rows.Scan(&a.ID, &a.TripID, &a.Actor, &a.Action, &a.ExpenseID, &before, &after, &recordedAt)
+		if err != nil {
+			return nil, err
+		}
+		if before != "" {
+			a.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			a.After = json.RawMessage(after)
+		}
+		a.RecordedAt = time.UnixMicro(recordedAt).UTC()
+		rslt = append(rslt, a)
+	}
+	return rslt, rows.Err()
+}
@@ -0,0 +1,157 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the audit log of the changes.
+
+package trip
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	auditLogCreate = `CREATE TABLE IF NOT EXISTS audit_log (
+audit_id INTEGER CONSTRAINT audit_log_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL DEFAULT 0,
+action VARCHAR(32) NOT NULL,
+expense_id INTEGER NOT NULL DEFAULT 0,
+before_state TEXT NOT NULL DEFAULT '',
+after_state TEXT NOT NULL DEFAULT '',
+recorded_at INTEGER NOT NULL)`
+	auditLogTripIndex = "CREATE INDEX IF NOT EXISTS audit_log_trip_index ON audit_log(trip_id, audit_id)"
+)
+
+// TestAuditLog has Alice create a trip and Bob change it, then checks who
+// did what, with the snapshots before and after, and the pages of the log
+func TestAuditLog(t *testing.T) {
+	adb := openTestDB(t)
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+	asAlice := WithActor(context.Background(), "Alice@test.com")
+	asBob := WithActor(context.Background(), bob)
+
+	tr := NewTrip("Trip A", alice, "", NewDate(start), []string{bob, charlie})
+	err := tr.Save(asAlice, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(start), "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(asAlice, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(start), "taxi", []Participant{{bob, 0, 2000}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Rename("Trip B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddParticipant(david)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(asBob, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taxi := tr.Expenses[1]
+	err = tr.RemoveExpense(taxi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.RemoveParticipant(david)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(asBob, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.ReassignParticipant(asAlice, adb, charlie, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := LoadAuditLog(context.Background(), adb, AuditQuery{TripID: tr.ID, Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ actor, action string }{
+		{alice, ActionTripCreated},
+		{alice, ActionExpenseAdded},
+		{bob, ActionTripChanged},
+		{bob, ActionParticipantsAdded},
+		{bob, ActionExpenseAdded},
+		{bob, ActionExpenseRemoved},
+		{bob, ActionParticipantRemoved},
+		{alice, ActionExpenseReassigned},
+		{alice, ActionParticipantRemoved},
+	}
+	if len(log) != len(want) {
+		t.Fatalf("expected %d entries, got %d: %+v", len(want), len(log), log)
+	}
+	for i, w := range want {
+		if log[i].Actor != w.actor || log[i].Action != w.action {
+			t.Errorf("entry %d: expected %s by %s, got %s by %s", i, w.action, w.actor, log[i].Action, log[i].Actor)
+		}
+	}
+
+	// the dates of the snapshots are YYYY-MM-DD, which Date doesn't
+	// unmarshal
+	var created, before, after map[string]any
+	err = json.Unmarshal(log[0].After, &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created["name"] != "Trip A" || created["owner"] != alice || created["start_date"] != "2024-05-01" || log[0].Before != nil {
+		t.Errorf("unexpected snapshot of the trip created: %s", log[0].After)
+	}
+	if json.Unmarshal(log[2].Before, &before) != nil || json.Unmarshal(log[2].After, &after) != nil ||
+		before["name"] != "Trip A" || after["name"] != "Trip B" {
+		t.Errorf("expected the trip renamed from Trip A to Trip B, got %s and %s", log[2].Before, log[2].After)
+	}
+	var removed map[string]any
+	err = json.Unmarshal(log[5].Before, &removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log[5].ExpenseID != taxi.ID || removed["description"] != "taxi" || log[5].After != nil {
+		t.Errorf("expected the taxi before its removal, got %s", log[5].Before)
+	}
+	var replacements []map[string]any
+	err = json.Unmarshal(log[7].After, &replacements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replacements) != 1 || len(replacements[0]["participants"].([]any)) != 2 {
+		t.Errorf("expected the hotel split between Alice and Bob, got %s", log[7].After)
+	}
+
+	page, err := LoadAuditLog(context.Background(), adb, AuditQuery{TripID: tr.ID, After: log[3].ID, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].ID != log[4].ID {
+		t.Errorf("expected the 5th and 6th entries, got %+v", page)
+	}
+	page, err = LoadAuditLog(context.Background(), adb, AuditQuery{TripID: tr.ID, From: NewDate(start.AddDate(0, 0, 1)), Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 0 {
+		t.Errorf("expected no change recorded after the first day, got %+v", page)
+	}
+}
@@ -0,0 +1,177 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the avatars of the users, the pictures shown along
+// with their display names. The files are stored on disk by the SHA-256 of
+// their content, like the receipts, and served publicly by their hash, for
+// the clients to show them in the pages without a token.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	avatarSelect     = "SELECT avatar FROM tuser WHERE email = ?"
+	avatarUpdate     = "UPDATE tuser SET avatar = ? WHERE email = ?"
+	avatarHashCount  = "SELECT COUNT(*) FROM tuser WHERE avatar = ?"
+	avatarURLsSelect = `SELECT u.email, u.avatar
+FROM tuser AS u, participant AS p
+WHERE u.user_id = p.user_id
+AND p.trip_id = ?
+AND u.avatar <> ''`
+)
+
+// avatarDir is the directory of the avatar files, and avatarBaseURL the
+// URL they're served under, see SetAvatarStore()
+var avatarDir, avatarBaseURL string
+
+// avatarHash matches the hash naming an avatar file
+var avatarHash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// SetAvatarStore sets the directory the avatar files are stored in, it's
+// created as needed, and the URL they're served under, followed by their
+// hash. It's meant to be called before serving any request.
+func SetAvatarStore(dir, baseURL string) {
+	avatarDir = dir
+	avatarBaseURL = baseURL
+}
+
+// avatarURL returns the URL of the avatar file of the given hash, empty if
+// there's none
+func avatarURL(sum string) string {
+	if sum == "" {
+		return ""
+	}
+	return avatarBaseURL + sum
+}
+
+// SetAvatar stores the picture read from r as the avatar of the user of
+// the email address, replacing theirs if any, and returns their profile.
+// sql.ErrNoRows is returned if there's no such user, they aren't created.
+func SetAvatar(ctx context.Context, db *sql.DB, email string, r io.Reader) (*Profile, error) {
+	if avatarDir == "" {
+		return nil, errors.New("no directory for the avatars, see SetAvatarStore()")
+	}
+	email = normalizeEmail(email)
+	var prev string
+	err := db.QueryRowContext(ctx, avatarSelect, email).Scan(&prev)
+	if err != nil {
+		return nil, err
+	}
+	sum, _, err := storeFile(avatarDir, r)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, avatarUpdate, sum, email)
+	if err != nil {
+		removeAvatarFiles(ctx, db, []string{sum})
+		return nil, err
+	}
+	Logf(ctx, "Set the avatar of %s to %s\n", email, sum)
+	if prev != sum {
+		removeAvatarFiles(ctx, db, []string{prev})
+	}
+	return LoadProfile(ctx, db, email)
+}
+
+// DeleteAvatar removes the avatar of the user of the email address, and
+// returns their profile. sql.ErrNoRows is returned if there's no such
+// user.
+func DeleteAvatar(ctx context.Context, db *sql.DB, email string) (*Profile, error) {
+	email = normalizeEmail(email)
+	var prev string
+	err := db.QueryRowContext(ctx, avatarSelect, email).Scan(&prev)
+	if err != nil {
+		return nil, err
+	}
+	if prev != "" {
+		_, err = db.ExecContext(ctx, avatarUpdate, "", email)
+		if err != nil {
+			return nil, err
+		}
+		Logf(ctx, "Removed the avatar of %s\n", email)
+		removeAvatarFiles(ctx, db, []string{prev})
+	}
+	return LoadProfile(ctx, db, email)
+}
+
+// Avatar is the file of an avatar, to serve
+type Avatar struct {
+	*os.File
+	ModTime time.Time
+}
+
+// OpenAvatar opens the avatar file of the given hash, sql.ErrNoRows is
+// returned if it isn't the avatar of any user
+func OpenAvatar(ctx context.Context, db *sql.DB, sum string) (*Avatar, error) {
+	if avatarDir == "" || !avatarHash.MatchString(sum) {
+		return nil, sql.ErrNoRows
+	}
+	var n int
+	err := db.QueryRowContext(ctx, avatarHashCount, sum).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	f, err := os.Open(storedPath(avatarDir, sum))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Avatar{File: f, ModTime: fi.ModTime()}, nil
+}
+
+// LoadAvatarURLs returns the URLs of the avatars of the owner and the
+// participants of the trip, by email address, the ones without aside
+func LoadAvatarURLs(ctx context.Context, db *sql.DB, tripID int64) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, avatarURLsSelect, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := make(map[string]string)
+	for rows.Next() {
+		var email, sum string
+		err = rows.Scan(&email, &sum)
+		if err != nil {
+			return nil, err
+		}
+		rslt[email] = avatarURL(sum)
+	}
+	return rslt, rows.Err()
+}
+
+// removeAvatarFiles removes the files of the given hashes no user refers
+// to anymore, e.g. once replaced. A failure is only logged, the file is
+// left behind.
+func removeAvatarFiles(ctx context.Context, db *sql.DB, sums []string) {
+	for _, sum := range sums {
+		if sum == "" || avatarDir == "" {
+			continue
+		}
+		var n int
+		err := db.QueryRowContext(ctx, avatarHashCount, sum).Scan(&n)
+		if err == nil && n == 0 {
+			err = os.Remove(storedPath(avatarDir, sum))
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			Logf(ctx, "ERROR: failed to remove the avatar file %s: %v\n", sum, err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit maintains the running balances between the participants of a
+// trip, in the trip_settlement table. They're updated as the expenses are
+// written, so the settlement of a trip is read in O(participants) instead
+// of being computed from all its expenses. It also computes where each
+// participant stands overall.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Some global constants used to store SQL statements
+const (
+	// balanceUpsert adds to the amount owed by the payer to the payee.
+	// Both directions of a pair are kept, they're netted when read.
+	balanceUpsert = `INSERT INTO trip_settlement (trip_id, payer, payee, amount) VALUES (?, ?, ?, ?)
+ON CONFLICT (trip_id, payer, payee) DO UPDATE SET amount = amount + excluded.amount`
+	balanceSelect = `SELECT pu.email, ru.email, s.amount
+FROM trip_settlement AS s, tuser AS pu, tuser AS ru
+WHERE s.payer = pu.user_id
+AND s.payee = ru.user_id
+AND s.trip_id = ?
+AND s.amount != 0`
+	balanceDelete     = "DELETE FROM trip_settlement WHERE trip_id = ?"
+	tripEndDateSelect = "SELECT end_date FROM trip WHERE trip_id = ? AND deleted_at = 0"
+	tripIDSelect      = "SELECT trip_id FROM trip ORDER BY trip_id"
+)
+
+// updateBalances adds the settlement of the expense to the running
+// balances of the trip, or subtracts it with a sign of -1. It's expected
+// to be executed within the transaction writing the expense.
+func (trip *Trip) updateBalances(ctx context.Context, txn *sql.Tx, expense *Expense, sign int) error {
+	ids := make(map[string]int64, len(expense.Participants))
+	for _, p := range expense.Participants {
+		ids[p.Email] = p.UserID
+	}
+	for payer, payments := range expense.Settle() {
+		for payee, amount := range payments {
+			_, err := txn.ExecContext(ctx, balanceUpsert, trip.ID, ids[payer], ids[payee], sign*amount)
+			if err != nil {
+				Logf(ctx, "ERROR: balance upsert failed: %v\n", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Position tells whether a participant is owed money, or owes money
+type Position string
+
+const (
+	// Creditor is owed money by the others
+	Creditor Position = "creditor"
+	// Debtor owes money to the others
+	Debtor Position = "debtor"
+	// Settled neither owes nor is owed anything
+	Settled Position = "settled"
+)
+
+// Balance is where a participant stands overall in a trip
+type Balance struct {
+	// Email is the email address of the participant
+	Email string `json:"user"`
+	// Paid is the total paid by the participant (in cent)
+	Paid int `json:"paid"`
+	// Share is the total of the shares of the participant in the expenses (in cent)
+	Share int `json:"share"`
+	// Fee is the organizer fee credited to the owner, or paid by the
+	// participant when negative (in cent)
+	Fee int `json:"fee"`
+	// Net is Paid minus Share plus Fee, positive when the participant is
+	// owed money
+	Net int `json:"net"`
+	// Position is derived from Net
+	Position Position `json:"position"`
+}
+
+// Balances returns the Balance of the owner, then of each participant of
+// the trip. The shares are rounded the same way as in Settle().
+func (trip *Trip) Balances() []Balance {
+	rslt := []Balance{{Email: trip.Owner.Email}}
+	idx := map[string]int{trip.Owner.Email: 0}
+	for _, p := range trip.Participants {
+		idx[p.Email] = len(rslt)
+		rslt = append(rslt, Balance{Email: p.Email})
+	}
+	for _, e := range trip.Expenses {
+		share := e.share()
+		for _, p := range e.Participants {
+			email := normalizeEmail(p.Email)
+			i, ok := idx[email]
+			if !ok {
+				// a participant no longer part of the trip
+				idx[email] = len(rslt)
+				i = len(rslt)
+				rslt = append(rslt, Balance{Email: email})
+			}
+			rslt[i].Paid += p.Paid
+			rslt[i].Share += share
+		}
+	}
+	rslt[0].Fee = trip.OrganizerFee
+	for payer, amount := range feeShares(trip.OrganizerFee, trip.feePayers()) {
+		rslt[idx[payer]].Fee = -amount
+	}
+	for i := range rslt {
+		b := &rslt[i]
+		b.Net = b.Paid - b.Share + b.Fee
+		b.Position = positionOf(b.Net)
+	}
+	return rslt
+}
+
+// positionOf returns the Position of a net amount
+func positionOf(net int) Position {
+	switch {
+	case net > 0:
+		return Creditor
+	case net < 0:
+		return Debtor
+	default:
+		return Settled
+	}
+}
+
+// NamedSettlement is a Settlement along with the display names and the
+// avatars of the people in it, by email address, for the clients to show
+// them instead of the email addresses
+type NamedSettlement struct {
+	Settlement   Settlement        `json:"settlement"`
+	DisplayNames map[string]string `json:"display_names"`
+	// AvatarURLs are the ones of the people with an avatar only
+	AvatarURLs map[string]string `json:"avatar_urls"`
+	// PaymentHandles are the ones of the people paid with a handle only,
+	// for the debtors to know where to send the money
+	PaymentHandles map[string]PaymentHandles `json:"payment_handles"`
+	// PaymentLinks open the payments of the transfers to the people with
+	// a handle, by payer then payee, see Settlement.PaymentLinks()
+	PaymentLinks map[string]map[string]PaymentLinks `json:"payment_links"`
+}
+
+// LoadSettlement returns the Settlement of a trip from its running
+// balances, netting what A owes B against what B owes A, then adds the
+// organizer fee, simplifies and routes around the forbidden transfers like
+// Trip.Settlement()
+func LoadSettlement(ctx context.Context, db *sql.DB, tripID int64) (Settlement, error) {
+	rows, err := db.QueryContext(ctx, balanceSelect, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owed := make(Settlement)
+	for rows.Next() {
+		var payer, payee string
+		var amount int
+		err = rows.Scan(&payer, &payee, &amount)
+		if err != nil {
+			return nil, err
+		}
+		if owed[payer] == nil {
+			owed[payer] = make(Payments)
+		}
+		owed[payer][payee] = amount
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	rslt := make(Settlement)
+	for payer, payments := range owed {
+		for payee, amount := range payments {
+			net := amount - owed[payee][payer]
+			if net <= 0 {
+				continue
+			}
+			if rslt[payer] == nil {
+				rslt[payer] = make(Payments)
+			}
+			rslt[payer][payee] = net
+		}
+	}
+	err = loadOrganizerFee(ctx, db, tripID, rslt)
+	if err != nil {
+		return nil, err
+	}
+	simplified, err := tripFeatureEnabled(ctx, db, FeatureSimplifiedSettlement, tripID)
+	if err != nil {
+		return nil, err
+	}
+	if simplified {
+		rslt = rslt.simplify()
+	}
+	return routeLoaded(ctx, db, tripID, rslt)
+}
+
+// SettleTrip returns the Settlement of a trip, completing it first if it's
+// still active. Completing a trip loads all its expenses for the snapshot,
+// afterwards the settlement is read from the running balances only.
+// sql.ErrNoRows is returned if the trip doesn't exist, or is deleted.
+func SettleTrip(ctx context.Context, db *sql.DB, tripID int64) (Settlement, error) {
+	var endDate int64
+	err := db.QueryRowContext(ctx, tripEndDateSelect, tripID).Scan(&endDate)
+	if err != nil {
+		return nil, err
+	}
+	if endDate != 0 {
+		return LoadSettlement(ctx, db, tripID)
+	}
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return nil, err
+	}
+	return trip.Complete(ctx, db)
+}
+
+// PreviewSettlement returns the Settlement of a trip as it stands, from
+// its running balances, without completing it. sql.ErrNoRows is returned
+// if the trip doesn't exist, or is deleted.
+func PreviewSettlement(ctx context.Context, db *sql.DB, tripID int64) (Settlement, error) {
+	var endDate int64
+	err := db.QueryRowContext(ctx, tripEndDateSelect, tripID).Scan(&endDate)
+	if err != nil {
+		return nil, err
+	}
+	return LoadSettlement(ctx, db, tripID)
+}
+
+// RebuildBalances recomputes the running balances of a trip from all its
+// expenses, e.g. for the trips created before the balances were kept
+func RebuildBalances(ctx context.Context, db *sql.DB, tripID int64) error {
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return err
+	}
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, balanceDelete, tripID)
+	if err != nil {
+		goto Rollback
+	}
+	for _, e := range trip.Expenses {
+		err = trip.updateBalances(ctx, txn, e, 1)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	return txn.Commit()
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		fatalf(ctx, "ERROR: RebuildBalances() failed to rollback transaction on trip %d: '%v'\n", tripID, rollbackErr)
+	}
+	return err
+}
+
+// RebuildAllBalances recomputes the running balances of every trip
+func RebuildAllBalances(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, tripIDSelect)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = RebuildBalances(ctx, db, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
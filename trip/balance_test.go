@@ -0,0 +1,175 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the running balances.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	tripSettlementCreate = `CREATE TABLE IF NOT EXISTS trip_settlement (
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+CONSTRAINT trip_settlement_pkey PRIMARY KEY (trip_id, payer, payee))`
+	tripSettlementDrop = "DROP TABLE IF EXISTS trip_settlement"
+)
+
+// TestRunningBalances checks the settlement read from the running
+// balances is the same as the one computed from the expenses, as
+// expenses are added and removed
+func TestRunningBalances(t *testing.T) {
+	ctx := context.Background()
+	bdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip B", alice, "", today, []string{bob, charlie})
+	err := tr.Save(ctx, bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(step string) {
+		t.Helper()
+		s, err := LoadSettlement(ctx, bdb, tr.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tr.Settle(); !reflect.DeepEqual(s, want) {
+			t.Errorf("%s: settlement from the balances %v, want %v", step, s, want)
+		}
+	}
+
+	// Bob owes Alice 2000c, then Alice owes Bob 500c: Bob pays Alice 1500c
+	err = tr.AddExpense(today, "hotel", []Participant{{alice, 0, 6000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.AddExpense(today, "taxi", []Participant{{bob, 0, 1000}, {alice, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("added")
+
+	// Alice then owes Bob more than he owes her
+	err = tr.AddExpense(today, "boat", []Participant{{bob, 0, 8000}, {alice, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("reversed")
+
+	err = tr.RemoveExpense(tr.Expenses[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("removed")
+
+	_, err = bdb.ExecContext(ctx, "DELETE FROM trip_settlement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RebuildAllBalances(ctx, bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("rebuilt")
+
+	s, err := SettleTrip(ctx, bdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s[bob][alice] != 1500 || s[charlie][alice] != 2000 {
+		t.Errorf("Unexpected settlement when completing: %v", s)
+	}
+	s2, err := SettleTrip(ctx, bdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, s2) {
+		t.Errorf("The settlement of the completed trip changed: %v, %v", s, s2)
+	}
+}
+
+// TestPreviewSettlement checks the preview leaves the trip active
+func TestPreviewSettlement(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip P", alice, "", today, []string{bob})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(today, "lunch", []Participant{{alice, 0, 2000}, {bob, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := PreviewSettlement(ctx, pdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 1 || s[bob][alice] != 1000 {
+		t.Errorf("Unexpected preview: %v", s)
+	}
+	tr2, err := LoadTripByID(ctx, pdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isUnset(tr2.EndDate) {
+		t.Errorf("The preview completed the trip on %v", tr2.EndDate)
+	}
+	_, err = PreviewSettlement(ctx, pdb, 4242)
+	if err != sql.ErrNoRows {
+		t.Errorf("Expect sql.ErrNoRows for an unknown trip, got %v", err)
+	}
+}
+
+// TestBalances checks the paid, share and net of each participant
+func TestBalances(t *testing.T) {
+	tr := NewTrip("Trip N", alice, "", epochToDate(time.Now().Unix()), []string{bob, charlie, david})
+	tr.emailLookup = map[string]int64{alice: 1, bob: 2, charlie: 3, david: 4}
+	today := epochToDate(time.Now().Unix())
+	err := tr.AddExpense(today, "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.AddExpense(today, "taxi", []Participant{{bob, 0, 1000}, {alice, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	want := []Balance{
+		{alice, 9000, 3500, 0, 5500, Creditor},
+		{bob, 1000, 3500, 0, -2500, Debtor},
+		{charlie, 0, 3000, 0, -3000, Debtor},
+		{david, 0, 0, 0, 0, Settled},
+	}
+	if got := tr.Balances(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Balances() = %v, want %v", got, want)
+	}
+}
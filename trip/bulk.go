@@ -0,0 +1,144 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit selects the trips of the bulk operations of the admins, e.g.
+// all the trips completed more than a year ago, and archives trips. An
+// archived trip is completed and can't be changed anymore.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	tripFilterSelect = `SELECT t.trip_id
+FROM trip AS t
+WHERE t.deleted_at = 0`
+	tripFilterActive        = "\nAND t.end_date = 0"
+	tripFilterCompleted     = "\nAND t.end_date != 0 AND t.archived_at = 0"
+	tripFilterArchived      = "\nAND t.archived_at != 0"
+	tripFilterStartedBefore = "\nAND t.start_date < ?"
+	tripFilterEndedBefore   = "\nAND t.end_date != 0 AND t.end_date < ?"
+	tripFilterOrder         = "\nORDER BY t.trip_id"
+
+	tripArchiveSelect = "SELECT end_date, archived_at FROM trip WHERE trip_id = ? AND deleted_at = 0"
+	tripArchive       = `UPDATE trip SET archived_at = ?, version = version + 1
+WHERE trip_id = ?`
+)
+
+var (
+	// ErrTripArchived is returned when changing an archived trip
+	ErrTripArchived = errors.New("the trip is archived")
+	// ErrTripActive is returned when archiving a trip not completed yet
+	ErrTripActive = errors.New("the trip isn't completed")
+)
+
+// TripStatus is the stage of a trip in its life cycle
+type TripStatus string
+
+const (
+	// TripActive is a trip not completed yet
+	TripActive TripStatus = "active"
+	// TripCompleted is a completed trip, not archived
+	TripCompleted TripStatus = "completed"
+	// TripArchived is an archived trip
+	TripArchived TripStatus = "archived"
+)
+
+// tripStatusFilter maps the TripStatus to their conditions
+var tripStatusFilter = map[TripStatus]string{
+	TripActive:    tripFilterActive,
+	TripCompleted: tripFilterCompleted,
+	TripArchived:  tripFilterArchived,
+}
+
+// TripFilter selects trips, the unset criteria match all the trips
+type TripFilter struct {
+	// Status is the stage of the trips
+	Status TripStatus
+	// Owner is the email address of the owner of the trips
+	Owner string
+	// StartedBefore selects the trips started before that date
+	StartedBefore time.Time
+	// EndedBefore selects the trips completed before that time
+	EndedBefore time.Time
+}
+
+// IsEmpty returns true if the filter has no criteria
+func (f TripFilter) IsEmpty() bool {
+	return f.Status == "" && f.Owner == "" && f.StartedBefore.IsZero() && f.EndedBefore.IsZero()
+}
+
+// FindTripIDs returns the IDs of the trips matching the filter, in the
+// order they were created
+func FindTripIDs(ctx context.Context, db *sql.DB, f TripFilter) ([]int64, error) {
+	query := tripFilterSelect
+	var args []any
+	if f.Status != "" {
+		cond, ok := tripStatusFilter[f.Status]
+		if !ok {
+			return nil, fmt.Errorf("unsupported trip status %q", f.Status)
+		}
+		query += cond
+	}
+	if f.Owner != "" {
+		query += tripSearchOwner
+		args = append(args, normalizeEmail(f.Owner))
+	}
+	if !f.StartedBefore.IsZero() {
+		query += tripFilterStartedBefore
+		args = append(args, f.StartedBefore.Unix())
+	}
+	if !f.EndedBefore.IsZero() {
+		query += tripFilterEndedBefore
+		args = append(args, f.EndedBefore.Unix())
+	}
+	rows, err := db.QueryContext(ctx, query+tripFilterOrder, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := []int64{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, id)
+	}
+	return rslt, rows.Err()
+}
+
+// ArchiveTrip archives a completed trip, archiving an archived trip does
+// nothing. sql.ErrNoRows is returned if the trip doesn't exist, or is
+// deleted, and ErrTripActive if it isn't completed.
+func ArchiveTrip(ctx context.Context, db *sql.DB, tripID int64) error {
+	unlock := lockTrip(tripID)
+	defer unlock()
+
+	var endDate, archivedAt int64
+	err := db.QueryRowContext(ctx, tripArchiveSelect, tripID).Scan(&endDate, &archivedAt)
+	switch {
+	case err != nil:
+		return err
+	case archivedAt != 0:
+		return nil
+	case endDate == 0:
+		return ErrTripActive
+	}
+	now := Now()
+	_, err = db.ExecContext(ctx, tripArchive, now.UnixMicro(), tripID)
+	if err != nil {
+		return err
+	}
+	return recordAudit(ctx, db, tripID, now, ActionTripArchived, 0, nil, nil)
+}
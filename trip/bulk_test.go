@@ -0,0 +1,116 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the trip filters and archiving.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestBulkTrips selects trips by status and dates, then archives them
+func TestBulkTrips(t *testing.T) {
+	ctx := context.Background()
+	bdb := openTestDB(t)
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	// old is completed a year before recent, active isn't completed
+	var trips []*Trip
+	for i, name := range []string{"Old", "Recent", "Active"} {
+		tr := NewTrip(name, alice, "", NewDate(start.AddDate(i, 0, 0)), []string{bob})
+		err := tr.Save(ctx, bdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trips = append(trips, tr)
+	}
+	old, recent, active := trips[0], trips[1], trips[2]
+	_, err := old.Complete(ctx, bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(365 * 24 * time.Hour)
+	_, err = recent.Complete(ctx, bdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		filter   TripFilter
+		expected []int64
+	}{
+		{TripFilter{Status: TripActive}, []int64{active.ID}},
+		{TripFilter{Status: TripCompleted}, []int64{old.ID, recent.ID}},
+		{TripFilter{EndedBefore: start.AddDate(0, 6, 0)}, []int64{old.ID}},
+		{TripFilter{StartedBefore: start.AddDate(2, 0, 0)}, []int64{old.ID, recent.ID}},
+		{TripFilter{Owner: bob}, []int64{}},
+		{TripFilter{Owner: alice, Status: TripArchived}, []int64{}},
+	}
+	for _, c := range cases {
+		ids, err := FindTripIDs(ctx, bdb, c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != len(c.expected) {
+			t.Errorf("%+v: expected %v, got %v", c.filter, c.expected, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != c.expected[i] {
+				t.Errorf("%+v: expected %v, got %v", c.filter, c.expected, ids)
+				break
+			}
+		}
+	}
+	_, err = FindTripIDs(ctx, bdb, TripFilter{Status: "lost"})
+	if err == nil {
+		t.Error("expected an error for an unknown status")
+	}
+
+	err = ArchiveTrip(ctx, bdb, active.ID)
+	if err != ErrTripActive {
+		t.Errorf("archiving an active trip: expected ErrTripActive, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		err = ArchiveTrip(ctx, bdb, old.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := FindTripIDs(ctx, bdb, TripFilter{Status: TripArchived})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != old.ID {
+		t.Errorf("expected the archived trip %d, got %v", old.ID, ids)
+	}
+	tr, err := LoadTripByID(ctx, bdb, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.Archived || tr.Version != old.Version+1 {
+		t.Errorf("expected an archived trip at version %d, got %v at %d", old.Version+1, tr.Archived, tr.Version)
+	}
+	_, err = UpdateTrip(ctx, bdb, old.ID, func(t *Trip) error {
+		return t.Rename("Older")
+	})
+	if err != ErrTripArchived {
+		t.Errorf("changing an archived trip: expected ErrTripArchived, got %v", err)
+	}
+	found, err := SearchTrips(ctx, bdb, "old", alice, "", Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf("expected the archived trip not to be found, got %v", found)
+	}
+}
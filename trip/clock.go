@@ -0,0 +1,111 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the clock of the data model, and the source of its
+// random identifiers. They can be replaced by fakes, for deterministic
+// timestamps and identifiers in tests and in the development mode.
+
+package trip
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// clock returns the current time for the creation times, the end dates of
+// the completed trips, and the lifetime of the API tokens
+var clock = time.Now
+
+// Now returns the current time of the clock of the data model
+func Now() time.Time {
+	return clock()
+}
+
+// SetClock replaces the clock of the data model, nil restores the system
+// clock. It's meant to be called before serving any request.
+func SetClock(now func() time.Time) {
+	if now == nil {
+		now = time.Now
+	}
+	clock = now
+}
+
+// FakeClock is a clock starting at a given time, and moving forward by a
+// fixed step every time it's read, so that the timestamps are predictable
+// and still distinct
+type FakeClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+// NewFakeClock returns a FakeClock starting at start
+func NewFakeClock(start time.Time, step time.Duration) *FakeClock {
+	return &FakeClock{now: start, step: step}
+}
+
+// Now returns the time of the clock, then moves it forward by the step
+func (fc *FakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	rslt := fc.now
+	fc.now = fc.now.Add(fc.step)
+	return rslt
+}
+
+// Advance moves the clock forward by d, e.g. to expire tokens
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+// idSource is read for the random identifiers, the token secrets and the
+// request IDs
+var idSource io.Reader = rand.Reader
+
+// NewID returns a random identifier of n bytes, hex encoded, read from the
+// ID source
+func NewID(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(idSource, buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SetIDSource replaces the source of the random identifiers, nil restores
+// crypto/rand. It's meant to be called before serving any request.
+func SetIDSource(r io.Reader) {
+	if r == nil {
+		r = rand.Reader
+	}
+	idSource = r
+}
+
+// FakeIDSource is an ID source counting up from 1, every identifier is its
+// count repeated, so that the identifiers are predictable and still
+// distinct
+type FakeIDSource struct {
+	mu    sync.Mutex
+	count uint64
+}
+
+// Read fills p with the next count, repeated from the end of p
+func (fs *FakeIDSource) Read(p []byte) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.count++
+	var word [8]byte
+	binary.BigEndian.PutUint64(word[:], fs.count)
+	for i := range p {
+		p[len(p)-1-i] = word[7-i%8]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,146 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the delegation of the approvals of the owner of a
+// trip to a co-treasurer, another participant. While the delegation is in
+// force, and the trip has an expense over its threshold, the approval of
+// the owner is the one of the co-treasurer: the owner can't approve, and
+// isn't waited for.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	delegationUpsert = `INSERT INTO approval_delegation (trip_id, user_id, threshold, created_at, expires_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (trip_id) DO UPDATE SET user_id = excluded.user_id, threshold = excluded.threshold,
+created_at = excluded.created_at, expires_at = excluded.expires_at`
+	delegationSelect = `SELECT u.email, d.threshold, d.created_at, d.expires_at
+FROM approval_delegation AS d, tuser AS u
+WHERE u.user_id = d.user_id AND d.trip_id = ?`
+	delegationDelete = "DELETE FROM approval_delegation WHERE trip_id = ?"
+)
+
+var (
+	// ErrApprovalDelegated is returned when the owner approves the expenses
+	// of a trip while their approval is delegated
+	ErrApprovalDelegated = errors.New("the approval of the owner is delegated to the co-treasurer")
+	// ErrNoDelegation is returned for a trip whose owner hasn't delegated
+	// their approvals
+	ErrNoDelegation = errors.New("no delegation of the approvals")
+)
+
+// Delegation is the delegation of the approvals of the owner of a trip to
+// a co-treasurer
+type Delegation struct {
+	// Delegate is the co-treasurer, a participant of the trip
+	Delegate string `json:"delegate"`
+	// Threshold is the amount, in cent, over which an expense has to be
+	// approved by the co-treasurer
+	Threshold int       `json:"threshold"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DelegateApprovals delegates the approvals of the owner of the trip to
+// the participant, for the trip versions with an expense over the
+// threshold, until the expiry. It replaces the delegation in force if any.
+// An error wrapping ErrUnknownParticipant is returned if the delegate
+// isn't a participant, the owner aside.
+func (trip *Trip) DelegateApprovals(ctx context.Context, db *sql.DB, delegate string, threshold int, expiresAt time.Time) (*Delegation, error) {
+	delegate = normalizeEmail(delegate)
+	if delegate == trip.Owner.Email {
+		return nil, errors.New("the owner can't delegate their approvals to themselves")
+	}
+	userID, ok := trip.emailLookup[delegate]
+	if !ok {
+		return nil, fmt.Errorf("%s is %w", delegate, ErrUnknownParticipant)
+	}
+	if threshold < 0 {
+		return nil, errors.New("the threshold can't be negative")
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	if !now.Before(expiresAt) {
+		return nil, errors.New("the delegation must expire in the future")
+	}
+	d := &Delegation{Delegate: delegate, Threshold: threshold, CreatedAt: now, ExpiresAt: expiresAt.UTC().Truncate(time.Microsecond)}
+	_, err := db.ExecContext(ctx, delegationUpsert, trip.ID, userID, d.Threshold, d.CreatedAt.UnixMicro(), d.ExpiresAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "%s delegated the approvals of trip %d over %d to %s until %s\n",
+		trip.Owner.Email, trip.ID, d.Threshold, d.Delegate, d.ExpiresAt.Format(time.RFC3339))
+	return d, nil
+}
+
+// LoadDelegation returns the delegation of the approvals of the owner of
+// the trip, expired or not, ErrNoDelegation if there's none
+func (trip *Trip) LoadDelegation(ctx context.Context, db *sql.DB) (*Delegation, error) {
+	d := new(Delegation)
+	var createdAt, expiresAt int64
+	err := db.QueryRowContext(ctx, delegationSelect, trip.ID).Scan(&d.Delegate, &d.Threshold, &createdAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoDelegation
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.CreatedAt = time.UnixMicro(createdAt).UTC()
+	d.ExpiresAt = time.UnixMicro(expiresAt).UTC()
+	return d, nil
+}
+
+// RevokeDelegation ends the delegation of the approvals of the owner of
+// the trip, ErrNoDelegation is returned if there's none
+func (trip *Trip) RevokeDelegation(ctx context.Context, db *sql.DB) error {
+	res, err := db.ExecContext(ctx, delegationDelete, trip.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoDelegation
+	}
+	Logf(ctx, "Revoked the delegation of the approvals of trip %d\n", trip.ID)
+	return nil
+}
+
+// delegationApplies tells whether the approval of the owner is the one of
+// the co-treasurer: the delegation hasn't expired, the co-treasurer is
+// still a participant, and an expense is over the threshold
+func (trip *Trip) delegationApplies(d *Delegation) bool {
+	if d == nil || !Now().Before(d.ExpiresAt) || !trip.IsParticipant(d.Delegate) {
+		return false
+	}
+	for _, e := range trip.Expenses {
+		if e.amount > d.Threshold {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAppliedDelegation returns the delegation of the approvals of the
+// owner of the trip if it applies to the current version, nil otherwise
+func (trip *Trip) loadAppliedDelegation(ctx context.Context, db *sql.DB) (*Delegation, error) {
+	d, err := trip.LoadDelegation(ctx, db)
+	if err == ErrNoDelegation {
+		return nil, nil
+	}
+	if err != nil || !trip.delegationApplies(d) {
+		return nil, err
+	}
+	return d, nil
+}
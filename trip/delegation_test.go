@@ -0,0 +1,132 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the delegation of the approvals.
+
+package trip
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	approvalDelegationCreate = `CREATE TABLE IF NOT EXISTS approval_delegation (
+trip_id INTEGER CONSTRAINT approval_delegation_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+threshold INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL)`
+)
+
+// TestDelegateApprovals delegates the approvals of the owner to bob over
+// 50.00, and checks they apply from the first expense over it until the
+// delegation expires
+func TestDelegateApprovals(t *testing.T) {
+	ctx := context.Background()
+	ddb := openTestDB(t)
+	clock := NewFakeClock(time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC), time.Second)
+	SetClock(clock.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Delegated", alice, "", NewDate(Now()), []string{bob, charlie})
+	err := tr.Save(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(Now()), "taxi", []Participant{{alice, 0, 3000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.SetApprovalRequired(true)
+	err = tr.Save(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tr.LoadDelegation(ctx, ddb)
+	if err != ErrNoDelegation {
+		t.Errorf("expected ErrNoDelegation, got %v", err)
+	}
+	_, err = tr.DelegateApprovals(ctx, ddb, david, 5000, Now().Add(time.Hour))
+	if !errors.Is(err, ErrUnknownParticipant) {
+		t.Errorf("expected a non-participant to be refused, got %v", err)
+	}
+	_, err = tr.DelegateApprovals(ctx, ddb, alice, 5000, Now().Add(time.Hour))
+	if err == nil {
+		t.Errorf("expected the owner to be refused as their delegate")
+	}
+	_, err = tr.DelegateApprovals(ctx, ddb, bob, 5000, Now())
+	if err == nil {
+		t.Errorf("expected a delegation already expired to be refused")
+	}
+	d, err := tr.DelegateApprovals(ctx, ddb, "Bob@test.com", 5000, Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := tr.LoadDelegation(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, d) || d.Delegate != bob {
+		t.Errorf("expected the delegation %+v, got %+v", d, loaded)
+	}
+
+	// no expense over the threshold, the owner approves
+	approvals, err := tr.LoadApprovals(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approvals.Delegation != nil || !reflect.DeepEqual(approvals.Pending, []string{alice, bob, charlie}) {
+		t.Errorf("expected the delegation not to apply, got %+v", approvals)
+	}
+
+	tr, err = UpdateTrip(ctx, ddb, tr.ID, func(tr *Trip) error {
+		return tr.AddExpense(NewDate(Now()), "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}, {charlie, 0, 0}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ApproveExpenses(ctx, ddb, tr.ID, alice, tr.ETag())
+	if err != ErrApprovalDelegated {
+		t.Errorf("expected the owner to be refused, got %v", err)
+	}
+	for _, email := range []string{bob, charlie} {
+		approvals, err = ApproveExpenses(ctx, ddb, tr.ID, email, tr.ETag())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !approvals.Final() || approvals.Delegation == nil || approvals.Delegation.Delegate != bob {
+		t.Errorf("expected the approvals to be final with the co-treasurer's, got %+v", approvals)
+	}
+
+	// once expired, the owner is waited for again
+	clock.Advance(time.Hour)
+	approvals, err = tr.LoadApprovals(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approvals.Final() || approvals.Delegation != nil || !reflect.DeepEqual(approvals.Pending, []string{alice}) {
+		t.Errorf("expected the expired delegation not to apply, got %+v", approvals)
+	}
+	_, err = ApproveExpenses(ctx, ddb, tr.ID, alice, tr.ETag())
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	err = tr.RevokeDelegation(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.RevokeDelegation(ctx, ddb)
+	if err != ErrNoDelegation {
+		t.Errorf("expected ErrNoDelegation revoking again, got %v", err)
+	}
+}
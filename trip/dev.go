@@ -0,0 +1,462 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit supports the development mode: the schema is created by the
+// server itself instead of entrypoint.sh, and a few trips are seeded so
+// there's something to look at.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Some global constants used to store SQL statements
+const (
+	// devSchema is the schema of entrypoint.sh, keep them in sync
+	devSchema = `CREATE TABLE IF NOT EXISTS tuser (
+user_id INTEGER CONSTRAINT user_pkey PRIMARY KEY AUTOINCREMENT,
+email VARCHAR(256) NOT NULL UNIQUE,
+verified BOOLEAN DEFAULT FALSE,
+display_name VARCHAR(128) NOT NULL DEFAULT '',
+avatar VARCHAR(64) NOT NULL DEFAULT '',
+venmo VARCHAR(30) NOT NULL DEFAULT '',
+paypal_me VARCHAR(64) NOT NULL DEFAULT '',
+iban VARCHAR(34) NOT NULL DEFAULT '');
+
+CREATE TABLE IF NOT EXISTS trip (
+trip_id INTEGER CONSTRAINT trip_pkey PRIMARY KEY AUTOINCREMENT,
+name VARCHAR(128) NOT NULL,
+name_lower VARCHAR(128) NOT NULL,
+created_at INTEGER NOT NULL,
+start_date INTEGER NOT NULL,
+end_date INTEGER DEFAULT 0,
+description VARCHAR(512),
+version INTEGER NOT NULL DEFAULT 1,
+archived_at INTEGER DEFAULT 0,
+organizer_fee INTEGER NOT NULL DEFAULT 0,
+approval_required BOOLEAN NOT NULL DEFAULT FALSE,
+deleted_at INTEGER NOT NULL DEFAULT 0);
+
+CREATE TABLE IF NOT EXISTS participant (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+is_owner BOOLEAN NOT NULL DEFAULT FALSE,
+rsvp VARCHAR(16) NOT NULL DEFAULT 'invited',
+CONSTRAINT participant_pkey PRIMARY KEY (trip_id, user_id));
+
+CREATE TABLE IF NOT EXISTS expense (
+expense_id INTEGER CONSTRAINT expense_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+txn_date INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+description VARCHAR(512));
+CREATE INDEX IF NOT EXISTS expense_trip_index ON expense(trip_id);
+
+CREATE TABLE IF NOT EXISTS expense_participant (
+expense_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+CONSTRAINT expense_participant_pkey PRIMARY KEY (expense_id, user_id));
+
+CREATE TABLE IF NOT EXISTS spend_cap (
+user_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL DEFAULT 0,
+amount INTEGER NOT NULL,
+CONSTRAINT spend_cap_pkey PRIMARY KEY (user_id, trip_id));
+
+CREATE TABLE IF NOT EXISTS trip_snapshot (
+snapshot_id INTEGER CONSTRAINT trip_snapshot_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+json BLOB NOT NULL,
+csv BLOB NOT NULL,
+pdf BLOB NOT NULL);
+CREATE INDEX IF NOT EXISTS trip_snapshot_trip_index ON trip_snapshot(trip_id);
+
+CREATE TABLE IF NOT EXISTS expense_note (
+expense_id INTEGER CONSTRAINT expense_note_pkey PRIMARY KEY,
+notes TEXT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS expense_metadata (
+expense_id INTEGER CONSTRAINT expense_metadata_pkey PRIMARY KEY,
+metadata TEXT NOT NULL);
+
+CREATE TABLE IF NOT EXISTS expense_reassignment (
+expense_id INTEGER CONSTRAINT expense_reassignment_pkey PRIMARY KEY,
+trip_id INTEGER NOT NULL,
+replaced_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+target_id INTEGER NOT NULL DEFAULT 0,
+created_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS receipt (
+receipt_id INTEGER CONSTRAINT receipt_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+expense_id INTEGER NOT NULL,
+sha256 CHAR(64) NOT NULL,
+content_type VARCHAR(128) NOT NULL,
+filename VARCHAR(256) NOT NULL,
+size INTEGER NOT NULL,
+uploaded_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS receipt_expense_index ON receipt(trip_id, expense_id);
+CREATE INDEX IF NOT EXISTS receipt_sha256_index ON receipt(sha256);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+audit_id INTEGER CONSTRAINT audit_log_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL DEFAULT 0,
+action VARCHAR(32) NOT NULL,
+expense_id INTEGER NOT NULL DEFAULT 0,
+before_state TEXT NOT NULL DEFAULT '',
+after_state TEXT NOT NULL DEFAULT '',
+recorded_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS audit_log_trip_index ON audit_log(trip_id, audit_id);
+
+CREATE TABLE IF NOT EXISTS voice_note (
+voice_note_id INTEGER CONSTRAINT voice_note_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+expense_id INTEGER NOT NULL,
+sha256 CHAR(64) NOT NULL,
+content_type VARCHAR(128) NOT NULL,
+filename VARCHAR(256) NOT NULL,
+size INTEGER NOT NULL,
+transcript TEXT NOT NULL DEFAULT '',
+uploaded_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS voice_note_expense_index ON voice_note(trip_id, expense_id);
+CREATE INDEX IF NOT EXISTS voice_note_sha256_index ON voice_note(sha256);
+
+CREATE TABLE IF NOT EXISTS webhook (
+webhook_id INTEGER CONSTRAINT webhook_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL DEFAULT 0,
+url VARCHAR(2048) NOT NULL,
+events VARCHAR(256) NOT NULL,
+secret CHAR(64) NOT NULL,
+created_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+delivery_id INTEGER CONSTRAINT webhook_delivery_pkey PRIMARY KEY AUTOINCREMENT,
+webhook_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL,
+event VARCHAR(32) NOT NULL,
+payload TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+attempts INTEGER NOT NULL DEFAULT 0,
+next_attempt_at INTEGER NOT NULL,
+last_error VARCHAR(512) NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS webhook_delivery_next_index ON webhook_delivery(next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS api_token (
+token_id INTEGER CONSTRAINT api_token_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL DEFAULT 0,
+scope TEXT NOT NULL,
+token_hash TEXT NOT NULL CONSTRAINT api_token_hash_unique UNIQUE,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL,
+revoked_at INTEGER NOT NULL DEFAULT 0);
+CREATE INDEX IF NOT EXISTS api_token_user_index ON api_token(user_id);
+
+CREATE TABLE IF NOT EXISTS trip_settlement (
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+CONSTRAINT trip_settlement_pkey PRIMARY KEY (trip_id, payer, payee));
+
+CREATE TABLE IF NOT EXISTS expense_deleted (
+expense_id INTEGER CONSTRAINT expense_deleted_pkey PRIMARY KEY,
+trip_id INTEGER NOT NULL,
+txn_date INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+deleted_at INTEGER NOT NULL,
+description VARCHAR(512),
+notes TEXT NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS expense_deleted_trip_index ON expense_deleted(trip_id);
+
+CREATE TABLE IF NOT EXISTS expense_participant_deleted (
+expense_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+CONSTRAINT expense_participant_deleted_pkey PRIMARY KEY (expense_id, user_id));
+
+CREATE TABLE IF NOT EXISTS forbidden_transfer (
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+CONSTRAINT forbidden_transfer_pkey PRIMARY KEY (trip_id, payer, payee));
+
+CREATE TABLE IF NOT EXISTS cost_preference (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+budget INTEGER NOT NULL DEFAULT 0,
+categories TEXT NOT NULL DEFAULT '',
+updated_at INTEGER NOT NULL,
+CONSTRAINT cost_preference_pkey PRIMARY KEY (trip_id, user_id));
+
+CREATE TABLE IF NOT EXISTS trip_envelope (
+trip_id INTEGER NOT NULL,
+category VARCHAR(16) NOT NULL,
+amount INTEGER NOT NULL,
+daily BOOLEAN NOT NULL DEFAULT FALSE,
+rollover BOOLEAN NOT NULL DEFAULT FALSE,
+updated_at INTEGER NOT NULL,
+CONSTRAINT trip_envelope_pkey PRIMARY KEY (trip_id, category));
+
+CREATE TABLE IF NOT EXISTS expense_approval (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+version INTEGER NOT NULL,
+approved_at INTEGER NOT NULL,
+CONSTRAINT expense_approval_pkey PRIMARY KEY (trip_id, user_id));
+
+CREATE TABLE IF NOT EXISTS expense_quarantine (
+quarantine_id INTEGER CONSTRAINT expense_quarantine_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+source VARCHAR(64) NOT NULL,
+payload TEXT NOT NULL,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS expense_quarantine_trip_index ON expense_quarantine(trip_id);
+
+CREATE TABLE IF NOT EXISTS email_verification (
+token_hash CHAR(64) CONSTRAINT email_verification_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS email_verification_user_index ON email_verification(user_id);
+
+CREATE TABLE IF NOT EXISTS approval_delegation (
+trip_id INTEGER CONSTRAINT approval_delegation_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+threshold INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS trip_message (
+message_id INTEGER CONSTRAINT trip_message_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+body TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+edited_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS trip_message_trip_index ON trip_message(trip_id);
+
+CREATE TABLE IF NOT EXISTS household_member (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+household VARCHAR(64) NOT NULL,
+CONSTRAINT household_member_pkey PRIMARY KEY (trip_id, user_id));
+
+CREATE TABLE IF NOT EXISTS trip_setting (
+trip_id INTEGER CONSTRAINT trip_setting_pkey PRIMARY KEY,
+slack_webhook_url VARCHAR(512) NOT NULL,
+telegram_chat_id VARCHAR(64) NOT NULL,
+updated_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS push_device (
+device_id INTEGER CONSTRAINT push_device_pkey PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER NOT NULL,
+platform VARCHAR(8) NOT NULL,
+token VARCHAR(512) NOT NULL CONSTRAINT push_device_token_unique UNIQUE,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS push_device_user_index ON push_device(user_id);
+
+CREATE TABLE IF NOT EXISTS push_delivery (
+push_id INTEGER CONSTRAINT push_delivery_pkey PRIMARY KEY AUTOINCREMENT,
+device_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL,
+event VARCHAR(32) NOT NULL,
+title VARCHAR(256) NOT NULL,
+body TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+attempts INTEGER NOT NULL DEFAULT 0,
+next_attempt_at INTEGER NOT NULL,
+last_error VARCHAR(512) NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS push_delivery_next_index ON push_delivery(next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS recurring_expense (
+recurrence_id INTEGER CONSTRAINT recurring_expense_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+description VARCHAR(512) NOT NULL,
+split TEXT NOT NULL,
+every_days INTEGER NOT NULL,
+next_date INTEGER NOT NULL,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS recurring_expense_trip_index ON recurring_expense(trip_id);
+
+CREATE TABLE IF NOT EXISTS feature_flag (
+name VARCHAR(64) CONSTRAINT feature_flag_pkey PRIMARY KEY,
+enabled BOOLEAN NOT NULL DEFAULT FALSE,
+percent INTEGER NOT NULL DEFAULT 0,
+trips TEXT NOT NULL,
+updated_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS feature_user (
+name VARCHAR(64) NOT NULL,
+user_id INTEGER NOT NULL,
+CONSTRAINT feature_user_pkey PRIMARY KEY (name, user_id));
+
+CREATE TABLE IF NOT EXISTS google_account (
+user_id INTEGER CONSTRAINT google_account_pkey PRIMARY KEY,
+refresh_token VARCHAR(512) NOT NULL,
+connected_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS trip_sheet (
+trip_id INTEGER CONSTRAINT trip_sheet_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+template_id VARCHAR(128) NOT NULL DEFAULT '',
+refresh_on_completion BOOLEAN NOT NULL DEFAULT FALSE,
+spreadsheet_id VARCHAR(128) NOT NULL DEFAULT '',
+created_at INTEGER NOT NULL,
+refreshed_at INTEGER NOT NULL DEFAULT 0,
+last_error VARCHAR(512) NOT NULL DEFAULT '');
+CREATE INDEX IF NOT EXISTS trip_sheet_user_index ON trip_sheet(user_id);
+
+CREATE TABLE IF NOT EXISTS settlement_payment (
+payment_id INTEGER CONSTRAINT settlement_payment_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+paid_on INTEGER NOT NULL,
+created_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS settlement_payment_trip_index ON settlement_payment(trip_id);
+
+CREATE TABLE IF NOT EXISTS expense_freeze (
+trip_id INTEGER CONSTRAINT expense_freeze_pkey PRIMARY KEY,
+frozen_from INTEGER NOT NULL,
+frozen_until INTEGER NOT NULL,
+created_at INTEGER NOT NULL);
+
+CREATE TABLE IF NOT EXISTS expense_review (
+review_id INTEGER CONSTRAINT expense_review_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+source VARCHAR(64) NOT NULL,
+payload TEXT NOT NULL,
+confidence INTEGER NOT NULL,
+corrected BOOLEAN NOT NULL DEFAULT FALSE,
+created_at INTEGER NOT NULL,
+updated_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS expense_review_trip_index ON expense_review(trip_id);
+
+CREATE TABLE IF NOT EXISTS friend_group (
+group_id INTEGER CONSTRAINT friend_group_pkey PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER NOT NULL,
+name VARCHAR(128) NOT NULL,
+created_at INTEGER NOT NULL,
+updated_at INTEGER NOT NULL,
+CONSTRAINT friend_group_name_unique UNIQUE (user_id, name));
+
+CREATE TABLE IF NOT EXISTS friend_group_member (
+group_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+CONSTRAINT friend_group_member_pkey PRIMARY KEY (group_id, user_id));
+
+CREATE TABLE IF NOT EXISTS trip_federation (
+federation_id INTEGER CONSTRAINT trip_federation_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+peer VARCHAR(256) NOT NULL,
+remote_trip_id INTEGER NOT NULL,
+sent_until INTEGER NOT NULL DEFAULT 0,
+received_until INTEGER NOT NULL DEFAULT 0,
+synced_at INTEGER NOT NULL DEFAULT 0,
+last_error VARCHAR(512) NOT NULL DEFAULT '',
+created_at INTEGER NOT NULL,
+CONSTRAINT trip_federation_peer_unique UNIQUE (trip_id, peer));`
+	tripCountSelect = "SELECT COUNT(*) FROM trip"
+)
+
+// CreateSchema creates the tables and indices missing from the database
+func CreateSchema(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, devSchema)
+	if err != nil {
+		Logf(ctx, "ERROR: failed to create the schema: %v\n", err)
+	}
+	return err
+}
+
+// devUsers are the participants of the seeded trips
+var devUsers = []string{"alice@example.com", "bob@example.com", "charlie@example.com", "david@example.com"}
+
+// devExpense is an expense of a seeded trip, the first participant pays
+type devExpense struct {
+	day         int
+	description string
+	amount      int
+	users       []int
+}
+
+// devTrip is a seeded trip, the first user is the owner
+type devTrip struct {
+	name        string
+	description string
+	users       []int
+	expenses    []devExpense
+	complete    bool
+}
+
+// devTrips are the seeded trips
+var devTrips = []devTrip{
+	{"Lake Tahoe 2023", "Ski week in February", []int{0, 1, 2, 3}, []devExpense{
+		{0, "Cabin", 180000, []int{0, 1, 2, 3}},
+		{0, "Groceries", 23450, []int{1, 0, 2, 3}},
+		{1, "Lift passes", 67600, []int{2, 0, 1, 3}},
+		{2, "Dinner at the lodge", 15875, []int{3, 0, 1}},
+	}, true},
+	{"Paris", "Long weekend", []int{1, 0, 2}, []devExpense{
+		{0, "Train tickets", 42000, []int{1, 0, 2}},
+		{1, "Museum passes", 9000, []int{0, 1, 2}},
+	}, false},
+	{"Team offsite", "", []int{2, 0, 3}, nil, false},
+}
+
+// SeedFixtures creates a few trips, with their participants and expenses,
+// when the database has no trip yet. It tells whether the trips were
+// created. The dates are taken from the clock, see SetClock().
+func SeedFixtures(ctx context.Context, db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, tripCountSelect).Scan(&count)
+	if err != nil || count > 0 {
+		return false, err
+	}
+
+	start := Now().UTC().AddDate(0, 0, -14)
+	for _, dt := range devTrips {
+		var participants []string
+		for _, u := range dt.users[1:] {
+			participants = append(participants, devUsers[u])
+		}
+		trip := NewTrip(dt.name, devUsers[dt.users[0]], dt.description, NewDate(start), participants)
+		err = trip.Save(ctx, db)
+		if err != nil {
+			return false, err
+		}
+		for _, de := range dt.expenses {
+			var ps []Participant
+			for i, u := range de.users {
+				p := Participant{Email: devUsers[u]}
+				if i == 0 {
+					p.Paid = de.amount
+				}
+				ps = append(ps, p)
+			}
+			err = trip.AddExpense(NewDate(start.AddDate(0, 0, de.day)), de.description, ps)
+			if err != nil {
+				return false, err
+			}
+		}
+		err = trip.Save(ctx, db)
+		if err != nil {
+			return false, err
+		}
+		if dt.complete {
+			_, err = trip.Complete(ctx, db)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,106 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the unit tests of the fake clock and of the
+// development mode.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFakeClock checks the timestamps written are taken from the clock
+func TestFakeClock(t *testing.T) {
+	ctx := context.Background()
+	fdb := openTestDB(t)
+	start := time.Date(2023, 2, 1, 12, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Clocked", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTripByID(ctx, fdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.createdAt.Equal(start) {
+		t.Errorf("Expect the trip created at %v, got %v", start, loaded.createdAt)
+	}
+	_, err = loaded.Complete(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := start.Add(time.Second); !loaded.EndDate.Equal(want) {
+		t.Errorf("Expect the trip completed at %v, got %v", want, loaded.EndDate)
+	}
+
+	usr, err := LoadOrCreateUser(ctx, fdb, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := IssueToken(ctx, fdb, usr, 0, ScopeRead, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(time.Hour)
+	_, err = LookupToken(ctx, fdb, tok.Secret)
+	if err != ErrTokenExpired {
+		t.Errorf("Expect the token to expire with the clock, got %v", err)
+	}
+}
+
+// TestSeedFixtures checks the schema is created and the trips seeded once
+func TestSeedFixtures(t *testing.T) {
+	ctx := context.Background()
+	sdb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "dev.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sdb.Close() })
+	SetClock(NewFakeClock(time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC), time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	for i := 0; i < 2; i++ {
+		// the schema is created over an existing one as well
+		err = CreateSchema(ctx, sdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seeded, err := SeedFixtures(ctx, sdb)
+	if err != nil || !seeded {
+		t.Fatalf("Expect the fixtures to be seeded: %v", err)
+	}
+	seeded, err = SeedFixtures(ctx, sdb)
+	if err != nil || seeded {
+		t.Errorf("Expect the fixtures to be seeded only once: %v", err)
+	}
+
+	trips, err := LoadTripsByOwnerSorted(ctx, sdb, devUsers[1], TripsByName, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trips) != 1 || trips[0].Name != "Paris" || len(trips[0].Expenses) != 2 {
+		t.Fatalf("Expect the Paris trip owned by %s: %v", devUsers[1], trips)
+	}
+	if d := trips[0].StartDate.Format(time.DateOnly); d != "2023-02-15" {
+		t.Errorf("Expect the trip to start 2 weeks before the clock, got %s", d)
+	}
+	settlement, err := SettleTrip(ctx, sdb, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settlement) == 0 {
+		t.Error("Expect a settlement of the completed trip")
+	}
+}
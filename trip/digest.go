@@ -0,0 +1,165 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the digest of the active trips of their owners,
+// to nudge them into settling the trips in a timely manner: how long since
+// the last expense, how much is left to settle, and who hasn't paid for
+// anything yet.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	digestSelect = `SELECT t.trip_id, t.name, u.email, t.start_date, COALESCE(MAX(e.txn_date), 0)
+FROM trip AS t
+JOIN participant AS p ON p.trip_id = t.trip_id AND p.is_owner
+JOIN tuser AS u ON u.user_id = p.user_id
+LEFT JOIN expense AS e ON e.trip_id = t.trip_id
+WHERE t.end_date = 0 AND t.archived_at = 0 AND t.deleted_at = 0`
+	digestOwnerWhere = "\nAND u.email = ?"
+	digestGroupBy    = "\nGROUP BY t.trip_id, t.name, u.email, t.start_date\nORDER BY t.trip_id"
+	digestIdleSelect = `SELECT u.email FROM participant AS p, tuser AS u
+WHERE p.trip_id = ? AND u.user_id = p.user_id AND p.rsvp <> 'declined'
+AND NOT EXISTS (SELECT 1 FROM expense AS e, expense_participant AS ep
+WHERE e.trip_id = p.trip_id AND ep.expense_id = e.expense_id
+AND ep.user_id = p.user_id AND ep.amount > 0)
+ORDER BY u.email`
+)
+
+// EventTripDigest is the event of the digest of an active trip, queued by
+// QueueDigests()
+const EventTripDigest = "trip.digest"
+
+// TripDigest is the summary of an active trip for its owner
+type TripDigest struct {
+	TripID int64  `json:"trip_id"`
+	Name   string `json:"name"`
+	Owner  string `json:"owner"`
+	// LastExpense is the date of the last expense, null if there's none
+	LastExpense *Date `json:"last_expense"`
+	// IdleDays is the number of days since the last expense, or since the
+	// start of the trip if there's none
+	IdleDays int `json:"idle_days"`
+	// Unsettled is the total of the transfers of the settlement, in cent
+	Unsettled int `json:"unsettled"`
+	// Idle are the participants who haven't paid for any expense, the ones
+	// who declined the trip aside
+	Idle []string `json:"idle"`
+}
+
+// LoadDigest returns the digest of the active trips of the owner, the
+// archived ones aside
+func LoadDigest(ctx context.Context, db *sql.DB, owner string) ([]*TripDigest, error) {
+	return loadDigests(ctx, db, digestSelect+digestOwnerWhere+digestGroupBy, normalizeEmail(owner))
+}
+
+// loadDigests returns the digests of the trips of the query
+func loadDigests(ctx context.Context, db *sql.DB, query string, args ...any) ([]*TripDigest, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	rslt := []*TripDigest{}
+	today := NewDate(Now().UTC())
+	for rows.Next() {
+		d := new(TripDigest)
+		var startDate, lastExpense int64
+		err = rows.Scan(&d.TripID, &d.Name, &d.Owner, &startDate, &lastExpense)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		since := NewDate(time.Unix(startDate, 0).UTC())
+		if lastExpense != 0 {
+			last := NewDate(time.Unix(lastExpense, 0).UTC())
+			d.LastExpense = &last
+			since = last
+		}
+		d.IdleDays = max(0, int(today.Sub(since.Time).Hours()/24))
+		rslt = append(rslt, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, d := range rslt {
+		err = d.loadBalance(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rslt, nil
+}
+
+// loadBalance fills the unsettled amount and the idle participants of the
+// digest
+func (d *TripDigest) loadBalance(ctx context.Context, db *sql.DB) error {
+	settlement, err := LoadSettlement(ctx, db, d.TripID)
+	if err != nil {
+		return err
+	}
+	for _, payments := range settlement {
+		for _, amount := range payments {
+			d.Unsettled += amount
+		}
+	}
+	rows, err := db.QueryContext(ctx, digestIdleSelect, d.TripID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	d.Idle = []string{}
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			return err
+		}
+		d.Idle = append(d.Idle, email)
+	}
+	return rows.Err()
+}
+
+// QueueDigests queues the trip.digest event of every active trip for the
+// webhooks subscribed to it, and returns the number of deliveries queued
+func QueueDigests(ctx context.Context, db *sql.DB) (int, error) {
+	digests, err := loadDigests(ctx, db, digestSelect+digestGroupBy)
+	if err != nil {
+		return 0, err
+	}
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	queued := 0
+	for _, d := range digests {
+		var n int
+		n, err = queueEvent(ctx, txn, d.TripID, EventTripDigest, d, nil)
+		if err != nil {
+			goto Rollback
+		}
+		queued += n
+	}
+	err = txn.Commit()
+	if err != nil {
+		return 0, err
+	}
+	notifyWebhooks(queued)
+	Logf(ctx, "Queued %d deliveries of the digests of %d trips\n", queued, len(digests))
+	return queued, nil
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		fatalf(ctx, "ERROR: trip.QueueDigests() failed to rollback transaction: '%v'\n", rollbackErr)
+	}
+	return 0, err
+}
@@ -0,0 +1,99 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the digests of the owners.
+
+package trip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestDigest checks the digest of the active trips of an owner, and its
+// delivery to a webhook
+func TestDigest(t *testing.T) {
+	ctx := context.Background()
+	ddb := openTestDB(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(now, time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	active := NewTrip("Active", alice, "", NewDate(now.AddDate(0, 0, -10)), []string{bob, charlie})
+	err := active.Save(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = active.AddExpense(NewDate(now.AddDate(0, 0, -7)), "hotel", []Participant{{alice, 0, 3000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = active.Save(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := NewTrip("Quiet", alice, "", NewDate(now.AddDate(0, 0, -3)), []string{david})
+	err = quiet.Save(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// neither the trips of the other owners, nor the completed ones
+	other := NewTrip("Other", bob, "", NewDate(now), []string{alice})
+	err = other.Save(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := NewTrip("Done", alice, "", NewDate(now), []string{bob})
+	err = done.Save(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = done.Complete(ctx, ddb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digests, err := LoadDigest(ctx, ddb, "Alice@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(digests) != 2 {
+		t.Fatalf("expected the digests of 2 trips, got %d", len(digests))
+	}
+	d := digests[0]
+	if d.TripID != active.ID || d.Owner != alice || d.LastExpense == nil || d.IdleDays != 7 || d.Unsettled != 2000 ||
+		!reflect.DeepEqual(d.Idle, []string{bob, charlie}) {
+		t.Errorf("Unexpected digest of the active trip %+v", d)
+	}
+	d = digests[1]
+	if d.TripID != quiet.ID || d.LastExpense != nil || d.IdleDays != 3 || d.Unsettled != 0 ||
+		!reflect.DeepEqual(d.Idle, []string{alice, david}) {
+		t.Errorf("Unexpected digest of the quiet trip %+v", d)
+	}
+
+	rec := &webhookRecorder{status: http.StatusNoContent}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	_, err = CreateWebhook(ctx, ddb, active.ID, srv.URL, []string{EventTripDigest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := QueueDigests(ctx, ddb)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 digest queued, got %d: %v", n, err)
+	}
+	n, err = DeliverWebhooks(ctx, ddb, srv.Client())
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 digest delivered, got %d: %v", n, err)
+	}
+	if rec.events[0].Event != EventTripDigest || rec.events[0].TripID != active.ID {
+		t.Errorf("Unexpected event %s", rec.bodies[0])
+	}
+}
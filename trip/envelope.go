@@ -0,0 +1,299 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit focuses on the budget envelopes of a trip. The owner
+// allocates an amount to some categories of expenses, for the whole trip
+// or for each of its days, and the expenses of a category, see
+// CategoryKey, are spent against its envelope. A daily envelope may roll
+// over: what's left of a day is carried to the next one, and so is what's
+// overspent.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	envelopeSelect = `SELECT category, amount, daily, rollover, updated_at
+FROM trip_envelope WHERE trip_id = ? ORDER BY category`
+	envelopeInsert = `INSERT INTO trip_envelope (trip_id, category, amount, daily, rollover, updated_at)
+VALUES (?, ?, ?, ?, ?, ?)`
+	envelopeDelete = "DELETE FROM trip_envelope WHERE trip_id = ?"
+)
+
+// Envelope is the amount allocated to a category of expenses of a trip
+type Envelope struct {
+	// Category is one of Categories
+	Category string `json:"category"`
+	// Amount is the allocation (in cent), for each day if Daily is set,
+	// for the whole trip otherwise
+	Amount int `json:"amount"`
+	// Daily is set if the allocation is for each day of the trip
+	Daily bool `json:"daily"`
+	// Rollover is set if what's left of a day is carried to the next
+	// one, only for a daily envelope
+	Rollover bool `json:"rollover"`
+	// UpdatedAt is when the envelopes of the trip were last set
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// EnvelopeStatus is how much of an Envelope has been spent, as of today,
+// or the end of the trip once it's completed
+type EnvelopeStatus struct {
+	Envelope
+	// Days is the number of days allocated so far, from the start of the
+	// trip, 0 for an envelope of the whole trip
+	Days int `json:"days"`
+	// Allocated is the allocation so far (in cent)
+	Allocated int `json:"allocated"`
+	// Spent is the total of the expenses of the category (in cent)
+	Spent int `json:"spent"`
+	// Available is what can still be spent (in cent): on the last day for
+	// a daily envelope without rollover, on the trip otherwise. It's
+	// negative when the envelope is blown.
+	Available int `json:"available"`
+	// Over is set when the envelope is blown
+	Over bool `json:"over"`
+}
+
+// EnvelopeAlert is raised when an expense blows the envelope of its
+// category
+type EnvelopeAlert struct {
+	// TripID is the trip of the envelope
+	TripID int64 `json:"trip_id"`
+	// Envelope is the envelope blown
+	Envelope Envelope `json:"envelope"`
+	// Date is the date of the expense, the day blown for a daily envelope
+	Date Date `json:"date"`
+	// Over is by how much the envelope is blown (in cent)
+	Over int `json:"over"`
+}
+
+// EnvelopeAlertHook is called for every EnvelopeAlert raised, with the
+// context of the Save() and the trip, after the expenses causing it have
+// been committed. The default only logs a warning, the server notifies the
+// owner and the group chats of the trip.
+var EnvelopeAlertHook = func(ctx context.Context, trip *Trip, alert EnvelopeAlert) {
+	Logf(ctx, "WARNING: the %s envelope of trip %d is blown by %d on %s\n",
+		alert.Envelope.Category, alert.TripID, alert.Over, alert.Date.Format(time.DateOnly))
+}
+
+// categoryOf returns the category of the expense, empty if it has none
+func (expense *Expense) categoryOf() string {
+	return strings.ToLower(expense.Metadata[CategoryKey])
+}
+
+// scanEnvelopes reads the rows of envelopeSelect
+func scanEnvelopes(rows *sql.Rows) ([]Envelope, error) {
+	defer rows.Close()
+	rslt := []Envelope{}
+	for rows.Next() {
+		var env Envelope
+		var updatedAt int64
+		err := rows.Scan(&env.Category, &env.Amount, &env.Daily, &env.Rollover, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		env.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		rslt = append(rslt, env)
+	}
+	return rslt, rows.Err()
+}
+
+// LoadEnvelopes returns the envelopes of the trip, by category
+func (trip *Trip) LoadEnvelopes(ctx context.Context, db *sql.DB) ([]Envelope, error) {
+	rows, err := db.QueryContext(ctx, envelopeSelect, trip.ID)
+	if err != nil {
+		return nil, err
+	}
+	return scanEnvelopes(rows)
+}
+
+// SaveEnvelopes replaces the envelopes of the trip, none removes them all.
+// The saved envelopes are returned, by category.
+func (trip *Trip) SaveEnvelopes(ctx context.Context, db *sql.DB, envelopes []Envelope) ([]Envelope, error) {
+	if trip.Archived {
+		return nil, ErrTripArchived
+	}
+	now := Now().UTC().Truncate(time.Second)
+	rslt := make([]Envelope, 0, len(envelopes))
+	for _, env := range envelopes {
+		env.Category = strings.ToLower(strings.TrimSpace(env.Category))
+		switch {
+		case !slices.Contains(Categories, env.Category):
+			return nil, fmt.Errorf("unknown category '%s', expecting one of %s", env.Category, strings.Join(Categories, ", "))
+		case slices.ContainsFunc(rslt, func(e Envelope) bool { return e.Category == env.Category }):
+			return nil, fmt.Errorf("more than one envelope for category '%s'", env.Category)
+		case env.Amount <= 0:
+			return nil, fmt.Errorf("invalid amount %d for category '%s'", env.Amount, env.Category)
+		case env.Rollover && !env.Daily:
+			return nil, fmt.Errorf("only a daily envelope can roll over, category '%s'", env.Category)
+		}
+		env.UpdatedAt = now
+		rslt = append(rslt, env)
+	}
+	sort.Slice(rslt, func(i, j int) bool { return rslt[i].Category < rslt[j].Category })
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = txn.ExecContext(ctx, envelopeDelete, trip.ID)
+	if err != nil {
+		goto Rollback
+	}
+	for _, env := range rslt {
+		_, err = txn.ExecContext(ctx, envelopeInsert, trip.ID, env.Category, env.Amount,
+			env.Daily, env.Rollover, env.UpdatedAt.Unix())
+		if err != nil {
+			goto Rollback
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Set %d envelopes on trip %d\n", len(rslt), trip.ID)
+	return rslt, nil
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		fatalf(ctx, "ERROR: trip.SaveEnvelopes() failed to rollback transaction on trip '%v': '%v'\n", trip, rollbackErr)
+	}
+	return nil, err
+}
+
+// envelopeDay returns the day of the envelopes the date falls on, counted
+// from the start of the trip, the expenses before the start being on its
+// first day
+func (trip *Trip) envelopeDay(d Date) int {
+	if !d.After(trip.StartDate.Time) {
+		return 0
+	}
+	return int(d.Sub(trip.StartDate.Time) / (24 * time.Hour))
+}
+
+// available returns what's left of the envelope on the given day of the
+// trip, with the given expenses
+func (trip *Trip) available(env Envelope, expenses []*Expense, day int) int {
+	rslt := env.Amount
+	if env.Rollover {
+		rslt = env.Amount * (day + 1)
+	}
+	for _, e := range expenses {
+		if e.categoryOf() != env.Category {
+			continue
+		}
+		d := trip.envelopeDay(e.Date)
+		if !env.Daily || d == day || (env.Rollover && d < day) {
+			rslt -= e.amount
+		}
+	}
+	return rslt
+}
+
+// EnvelopeStatus returns the status of each envelope of the trip, as of
+// today, or the end of the trip once it's completed. The days of the
+// expenses dated later are allocated too.
+func (trip *Trip) EnvelopeStatus(envelopes []Envelope) []EnvelopeStatus {
+	asOf := NewDate(Now().UTC())
+	if !isUnset(trip.EndDate) {
+		asOf = NewDate(trip.EndDate)
+	}
+	last := trip.envelopeDay(asOf)
+	for _, e := range trip.Expenses {
+		last = max(last, trip.envelopeDay(e.Date))
+	}
+
+	rslt := make([]EnvelopeStatus, 0, len(envelopes))
+	for _, env := range envelopes {
+		s := EnvelopeStatus{Envelope: env, Allocated: env.Amount}
+		if env.Daily {
+			s.Days = last + 1
+			s.Allocated = env.Amount * s.Days
+		}
+		for _, e := range trip.Expenses {
+			if e.categoryOf() == env.Category {
+				s.Spent += e.amount
+			}
+		}
+		s.Available = trip.available(env, trip.Expenses, last)
+		s.Over = s.Available < 0
+		rslt = append(rslt, s)
+	}
+	return rslt
+}
+
+// envelopeAlerts returns the envelopes blown by the new expenses, on their
+// day for the daily envelopes. Only the envelopes crossed by these
+// expenses are reported, so that the same alert isn't raised again by
+// later expenses.
+func (trip *Trip) envelopeAlerts(envelopes []Envelope, before, after, added []*Expense) []EnvelopeAlert {
+	var rslt []EnvelopeAlert
+	checked := make(map[string]bool)
+	for _, e := range added {
+		category := e.categoryOf()
+		i := slices.IndexFunc(envelopes, func(env Envelope) bool { return env.Category == category })
+		if i < 0 {
+			continue
+		}
+		env := envelopes[i]
+		day := trip.envelopeDay(e.Date)
+		key := category
+		if env.Daily {
+			key = fmt.Sprintf("%s/%d", category, day)
+		}
+		if checked[key] {
+			continue
+		}
+		checked[key] = true
+		left, now := trip.available(env, before, day), trip.available(env, after, day)
+		if left >= 0 && now < 0 {
+			rslt = append(rslt, EnvelopeAlert{trip.ID, env, e.Date, -now})
+		}
+	}
+	return rslt
+}
+
+// EnvelopeWarnings returns the envelopes an expense of the category, for
+// the amount (in cent) on the date, would blow if it were added to the
+// trip, e.g. to warn before it's added
+func (trip *Trip) EnvelopeWarnings(envelopes []Envelope, date Date, category string, amount int) []EnvelopeAlert {
+	expense := &Expense{Date: date, Metadata: map[string]string{CategoryKey: category}, amount: amount}
+	after := append(slices.Clip(trip.Expenses), expense)
+	return trip.envelopeAlerts(envelopes, trip.Expenses, after, []*Expense{expense})
+}
+
+// checkEnvelopes computes the alerts raised by the newly inserted
+// expenses, already part of the trip.
+// It's expected to be executed within a transaction
+func (trip *Trip) checkEnvelopes(ctx context.Context, txn *sql.Tx, added []*Expense) ([]EnvelopeAlert, error) {
+	if len(added) == 0 {
+		return nil, nil
+	}
+	rows, err := txn.QueryContext(ctx, envelopeSelect, trip.ID)
+	if err != nil {
+		return nil, err
+	}
+	envelopes, err := scanEnvelopes(rows)
+	if err != nil || len(envelopes) == 0 {
+		return nil, err
+	}
+	before := make([]*Expense, 0, len(trip.Expenses))
+	for _, e := range trip.Expenses {
+		if !slices.Contains(added, e) {
+			before = append(before, e)
+		}
+	}
+	return trip.envelopeAlerts(envelopes, before, trip.Expenses, added), nil
+}
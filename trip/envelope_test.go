@@ -0,0 +1,152 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the budget envelopes.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	tripEnvelopeCreate = `CREATE TABLE IF NOT EXISTS trip_envelope (
+trip_id INTEGER NOT NULL,
+category VARCHAR(16) NOT NULL,
+amount INTEGER NOT NULL,
+daily BOOLEAN NOT NULL DEFAULT FALSE,
+rollover BOOLEAN NOT NULL DEFAULT FALSE,
+updated_at INTEGER NOT NULL,
+CONSTRAINT trip_envelope_pkey PRIMARY KEY (trip_id, category))`
+)
+
+// TestEnvelopes allocates the food per day with rollover, the drinks per
+// day without, and the lodging for the whole trip, then checks the status
+// on the third day, and the alerts raised by the expenses blowing them
+func TestEnvelopes(t *testing.T) {
+	ctx := context.Background()
+	edb := openTestDB(t)
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start.AddDate(0, 0, 2).Add(12*time.Hour), time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+	var alerts []EnvelopeAlert
+	defer func(hook func(context.Context, *Trip, EnvelopeAlert)) { EnvelopeAlertHook = hook }(EnvelopeAlertHook)
+	EnvelopeAlertHook = func(_ context.Context, _ *Trip, a EnvelopeAlert) { alerts = append(alerts, a) }
+
+	tr := NewTrip("Trip E", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []Envelope{
+		{Category: "yachts", Amount: 100},
+		{Category: "food", Amount: 0},
+		{Category: "food", Amount: 100, Rollover: true},
+	} {
+		_, err = tr.SaveEnvelopes(ctx, edb, []Envelope{bad})
+		if err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+	_, err = tr.SaveEnvelopes(ctx, edb, []Envelope{{Category: "drinks", Amount: 1}, {Category: "Drinks", Amount: 2}})
+	if err == nil {
+		t.Error("expected an error for a duplicate category")
+	}
+	_, err = tr.SaveEnvelopes(ctx, edb, []Envelope{
+		{Category: "Lodging", Amount: 30000},
+		{Category: "food", Amount: 5000, Daily: true, Rollover: true},
+		{Category: "drinks", Amount: 2000, Daily: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes, err := tr.LoadEnvelopes(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envelopes) != 3 || envelopes[0].Category != "drinks" || envelopes[2].Category != "lodging" {
+		t.Fatalf("expected the drinks, food and lodging envelopes, got %+v", envelopes)
+	}
+
+	add := func(day int, description, category string, amount int) {
+		err := tr.AddExpense(NewDate(start.AddDate(0, 0, day)), description, []Participant{{alice, 0, amount}, {bob, 0, 0}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr.Expenses[len(tr.Expenses)-1].Metadata = map[string]string{CategoryKey: category}
+	}
+	// the booking before the trip counts on its first day
+	add(-10, "hotel", "lodging", 24000)
+	add(0, "lunch", "food", 3000)
+	add(0, "wine", "drinks", 2500)
+	add(1, "dinner", "food", 6000)
+	add(1, "beers", "drinks", 1500)
+	add(1, "museum", "activities", 4000)
+	err = tr.Save(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the wine blows the drinks of the first day, the food has 1000
+	// left with the rollover
+	if len(alerts) != 1 || alerts[0].Envelope.Category != "drinks" || alerts[0].Over != 500 ||
+		!alerts[0].Date.Equal(start) {
+		t.Fatalf("expected the drinks of the first day blown by 500, got %+v", alerts)
+	}
+
+	status := tr.EnvelopeStatus(envelopes)
+	drinks, food, lodging := status[0], status[1], status[2]
+	if drinks.Days != 3 || drinks.Allocated != 6000 || drinks.Spent != 4000 || drinks.Available != 2000 || drinks.Over {
+		t.Errorf("expected 2000 of the drinks available on the third day, got %+v", drinks)
+	}
+	if food.Days != 3 || food.Allocated != 15000 || food.Spent != 9000 || food.Available != 6000 {
+		t.Errorf("expected 6000 of the food available with the rollover, got %+v", food)
+	}
+	if lodging.Days != 0 || lodging.Allocated != 30000 || lodging.Spent != 24000 || lodging.Available != 6000 {
+		t.Errorf("expected 6000 of the lodging available, got %+v", lodging)
+	}
+
+	warnings := tr.EnvelopeWarnings(envelopes, NewDate(start.AddDate(0, 0, 2)), "Food", 6500)
+	if len(warnings) != 1 || warnings[0].Over != 500 {
+		t.Errorf("expected a warning for the food blown by 500, got %+v", warnings)
+	}
+	if warnings = tr.EnvelopeWarnings(envelopes, NewDate(start.AddDate(0, 0, 2)), "other", 100000); len(warnings) != 0 {
+		t.Errorf("expected no warning without an envelope, got %+v", warnings)
+	}
+
+	alerts = nil
+	add(2, "spa hotel", "lodging", 7000)
+	err = tr.Save(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Envelope.Category != "lodging" || alerts[0].Over != 1000 {
+		t.Errorf("expected the lodging blown by 1000, got %+v", alerts)
+	}
+	// already blown, no alert again
+	alerts = nil
+	add(2, "late checkout", "lodging", 500)
+	err = tr.Save(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 0 {
+		t.Errorf("expected no alert for an envelope already blown, got %+v", alerts)
+	}
+
+	_, err = tr.SaveEnvelopes(ctx, edb, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes, err = tr.LoadEnvelopes(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envelopes) != 0 {
+		t.Errorf("expected the envelopes to be removed, got %+v", envelopes)
+	}
+}
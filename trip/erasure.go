@@ -0,0 +1,327 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the erasure of a user. Their email address is
+// replaced by a tombstone everywhere it's kept, while the user stays in the
+// trips as it's referred to by its ID: the expenses, the balances and the
+// settlements don't change. What's only about the user, e.g. their tokens,
+// is deleted.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Some global constants used to store SQL statements
+const (
+	erasureOwnedSelect = `SELECT t.trip_id FROM trip AS t, participant AS p
+WHERE p.trip_id = t.trip_id AND p.is_owner AND p.user_id = ?
+AND t.end_date = 0 AND t.archived_at = 0 AND t.deleted_at = 0
+ORDER BY t.trip_id`
+	erasureAvatarSelect = "SELECT avatar FROM tuser WHERE user_id = ?"
+	erasureUserUpdate   = `UPDATE tuser SET email = ?, verified = ?, display_name = '', avatar = '',
+venmo = '', paypal_me = '', iban = '' WHERE user_id = ?`
+	erasureTripsUpdate    = "UPDATE trip SET version = version + 1 WHERE trip_id IN (SELECT trip_id FROM participant WHERE user_id = ?)"
+	erasureSnapshotSelect = `SELECT s.snapshot_id, s.json, s.csv, s.pdf
+FROM trip_snapshot AS s, participant AS p
+WHERE p.trip_id = s.trip_id AND p.user_id = ?`
+	erasureSnapshotUpdate = "UPDATE trip_snapshot SET json = ?, csv = ?, pdf = ? WHERE snapshot_id = ?"
+)
+
+// erasureDeletes are the statements deleting the data only about the user
+// erased, by user_id
+var erasureDeletes = []string{
+	"DELETE FROM api_token WHERE user_id = ?",
+	"DELETE FROM email_verification WHERE user_id = ?",
+	"DELETE FROM spend_cap WHERE user_id = ?",
+	"DELETE FROM cost_preference WHERE user_id = ?",
+	"DELETE FROM approval_delegation WHERE user_id = ?",
+	"DELETE FROM trip_message WHERE user_id = ?",
+	"DELETE FROM push_delivery WHERE device_id IN (SELECT device_id FROM push_device WHERE user_id = ?)",
+	"DELETE FROM push_device WHERE user_id = ?",
+	"DELETE FROM feature_user WHERE user_id = ?",
+	"DELETE FROM trip_sheet WHERE user_id = ?",
+	"DELETE FROM google_account WHERE user_id = ?",
+	"DELETE FROM friend_group_member WHERE group_id IN (SELECT group_id FROM friend_group WHERE user_id = ?)",
+	"DELETE FROM friend_group WHERE user_id = ?",
+	"DELETE FROM friend_group_member WHERE user_id = ?",
+}
+
+// erasurePayloads are the JSON payloads kept for the trips of the user
+// erased, by the statements selecting them by user_id, and updating them
+var erasurePayloads = []struct {
+	query  string
+	update string
+}{
+	{
+		`SELECT d.delivery_id, d.payload FROM webhook_delivery AS d, participant AS p
+WHERE p.trip_id = d.trip_id AND p.user_id = ?`,
+		"UPDATE webhook_delivery SET payload = ? WHERE delivery_id = ?",
+	},
+	{
+		`SELECT q.quarantine_id, q.payload FROM expense_quarantine AS q, participant AS p
+WHERE p.trip_id = q.trip_id AND p.user_id = ?`,
+		"UPDATE expense_quarantine SET payload = ? WHERE quarantine_id = ?",
+	},
+	{
+		`SELECT q.push_id, q.body FROM push_delivery AS q, participant AS p
+WHERE p.trip_id = q.trip_id AND p.user_id = ?`,
+		"UPDATE push_delivery SET body = ? WHERE push_id = ?",
+	},
+	{
+		`SELECT r.recurrence_id, r.split FROM recurring_expense AS r, participant AS p
+WHERE p.trip_id = r.trip_id AND p.user_id = ?`,
+		"UPDATE recurring_expense SET split = ? WHERE recurrence_id = ?",
+	},
+	{
+		`SELECT a.audit_id, a.before_state FROM audit_log AS a, participant AS p
+WHERE p.trip_id = a.trip_id AND p.user_id = ?`,
+		"UPDATE audit_log SET before_state = ? WHERE audit_id = ?",
+	},
+	{
+		`SELECT a.audit_id, a.after_state FROM audit_log AS a, participant AS p
+WHERE p.trip_id = a.trip_id AND p.user_id = ?`,
+		"UPDATE audit_log SET after_state = ? WHERE audit_id = ?",
+	},
+}
+
+// ErrOwnsActiveTrips is returned when erasing a user who owns trips
+// neither completed nor archived, they have to be handed over or closed
+// first
+var ErrOwnsActiveTrips = errors.New("owns active trips")
+
+// erasedDomain is the domain of the tombstones of the erased users, a
+// reserved one which can't be an actual address
+const erasedDomain = "erased.invalid"
+
+// tombstone returns the email address replacing the one of an erased user
+func tombstone(userID int64) string {
+	return fmt.Sprintf("erased-%d@%s", userID, erasedDomain)
+}
+
+// isErased tells whether the email address is the tombstone of an erased
+// user, no user can be created with one
+func isErased(email string) bool {
+	return strings.HasSuffix(normalizeEmail(email), "@"+erasedDomain)
+}
+
+// EraseUser anonymizes the user of the email address: their address is
+// replaced by a tombstone in the trips and their snapshots, and their
+// tokens, spend caps, friend groups and answers to the cost questionnaires
+// are deleted, as is their membership of the groups of others.
+// The user is returned with the tombstone. sql.ErrNoRows is returned if
+// there's no such user, and an error wrapping ErrOwnsActiveTrips if they
+// own trips still active.
+func EraseUser(ctx context.Context, db *sql.DB, email string) (*User, error) {
+	usr := NewUser(email)
+	err := db.QueryRowContext(ctx, userSelect, usr.Email).Scan(&usr.ID, &usr.Verified, &usr.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	owned, err := erasureOwnedTrips(ctx, db, usr.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(owned) > 0 {
+		return nil, fmt.Errorf("%s %w: %v", usr.Email, ErrOwnsActiveTrips, owned)
+	}
+
+	var erased *User
+	var avatar string
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	erased, avatar, err = eraseUser(ctx, txn, usr)
+	if err != nil {
+		goto Rollback
+	}
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Erased user %d as %s\n", erased.ID, erased.Email)
+	removeAvatarFiles(ctx, db, []string{avatar})
+	return erased, nil
+
+Rollback:
+	if rollbackErr := txn.Rollback(); rollbackErr != nil {
+		fatalf(ctx, "ERROR: EraseUser() failed to rollback transaction: '%v'\n", rollbackErr)
+	}
+	return nil, err
+}
+
+// eraseUser replaces the email address of the user by a tombstone, within
+// the transaction, and returns the user with it, and the hash of the
+// avatar they had, whose file is to be removed once committed
+func eraseUser(ctx context.Context, txn *sql.Tx, usr *User) (*User, string, error) {
+	erased := &User{ID: usr.ID, Email: tombstone(usr.ID)}
+	var avatar string
+	err := txn.QueryRowContext(ctx, erasureAvatarSelect, erased.ID).Scan(&avatar)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = txn.ExecContext(ctx, erasureUserUpdate, erased.Email, erased.Verified, erased.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	_, err = txn.ExecContext(ctx, erasureTripsUpdate, erased.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, stmt := range erasureDeletes {
+		_, err = txn.ExecContext(ctx, stmt, erased.ID)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	err = redactSnapshots(ctx, txn, erased.ID, usr.Email, erased.Email)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, p := range erasurePayloads {
+		err = redactPayloads(ctx, txn, p.query, p.update, erased.ID, usr.Email, erased.Email)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return erased, avatar, nil
+}
+
+// erasureOwnedTrips returns the IDs of the active trips owned by the user
+func erasureOwnedTrips(ctx context.Context, db *sql.DB, userID int64) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, erasureOwnedSelect, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rslt []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, id)
+	}
+	return rslt, rows.Err()
+}
+
+// isEmailByte tells whether the byte can be part of an email address
+func isEmailByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte(".!#$%&'*+/=?^_`{|}~-@", c) >= 0
+}
+
+// redactEmail replaces the email address in the text, where it isn't part
+// of a longer address
+func redactEmail(text, email, replacement string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(text, email)
+		if i < 0 {
+			break
+		}
+		end := i + len(email)
+		if (i == 0 || !isEmailByte(text[i-1])) && (end == len(text) || !isEmailByte(text[end])) {
+			b.WriteString(text[:i])
+			b.WriteString(replacement)
+		} else {
+			b.WriteString(text[:end])
+		}
+		text = text[end:]
+	}
+	b.WriteString(text)
+	return b.String()
+}
+
+// redactJSON replaces the email address in a JSON document, also as it's
+// escaped in the JSON strings
+func redactJSON(doc []byte, email, replacement string) []byte {
+	encoded, _ := json.Marshal(email)
+	rslt := redactEmail(string(doc), strings.Trim(string(encoded), `"`), replacement)
+	return []byte(redactEmail(rslt, email, replacement))
+}
+
+// redactSnapshots replaces the email address in the snapshots of the trips
+// of the user, within the transaction of the erasure. It's the only change
+// made to the snapshots, immutable otherwise: the erasure prevails, and
+// only rewrites the email address, the amounts are the same.
+func redactSnapshots(ctx context.Context, txn *sql.Tx, userID int64, email, replacement string) error {
+	type redacted struct {
+		id             int64
+		json, csv, pdf []byte
+	}
+	rows, err := txn.QueryContext(ctx, erasureSnapshotSelect, userID)
+	if err != nil {
+		return err
+	}
+	var snaps []redacted
+	for rows.Next() {
+		var s redacted
+		err = rows.Scan(&s.id, &s.json, &s.csv, &s.pdf)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		s.json = redactJSON(s.json, email, replacement)
+		s.csv = []byte(redactEmail(string(s.csv), email, replacement))
+		lines := pdfLines(s.pdf)
+		for i := range lines {
+			lines[i] = redactEmail(lines[i], email, replacement)
+		}
+		s.pdf = textPDF(lines)
+		snaps = append(snaps, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range snaps {
+		_, err = txn.ExecContext(ctx, erasureSnapshotUpdate, s.json, s.csv, s.pdf, s.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactPayloads replaces the email address in the JSON payloads returned
+// by the query, with their IDs, and written back by the update
+func redactPayloads(ctx context.Context, txn *sql.Tx, query, update string, userID int64, email, replacement string) error {
+	rows, err := txn.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	payloads := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var payload string
+		err = rows.Scan(&id, &payload)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if redacted := string(redactJSON([]byte(payload), email, replacement)); redacted != payload {
+			payloads[id] = redacted
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for id, payload := range payloads {
+		_, err = txn.ExecContext(ctx, update, payload, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the erasure of the users.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestEraseUser erases a participant of a completed trip, and checks the
+// settlement is the same under the tombstone, with the snapshot redacted
+func TestEraseUser(t *testing.T) {
+	ctx := context.Background()
+	edb := openTestDB(t)
+	// the address of bob is part of the one of jimbob, which must be kept
+	jimbob := "jim" + bob
+	tr := NewTrip("Erased", alice, "", NewDate(time.Now()), []string{bob, jimbob})
+	err := tr.Save(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "hotel", []Participant{{alice, 0, 0}, {bob, 0, 3000}, {jimbob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, edb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := LoadOrCreateUser(ctx, edb, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := IssueToken(ctx, edb, usr, 0, ScopeWrite, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = EraseUser(ctx, edb, alice)
+	if !errors.Is(err, ErrOwnsActiveTrips) {
+		t.Errorf("expected ErrOwnsActiveTrips erasing the owner, got %v", err)
+	}
+	_, err = EraseUser(ctx, edb, "nobody@test.com")
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+
+	before, err := SettleTrip(ctx, edb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	erased, err := EraseUser(ctx, edb, "Bob@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erased.ID != usr.ID || erased.Email != tombstone(usr.ID) {
+		t.Fatalf("Unexpected erased user %+v", erased)
+	}
+
+	after, err := SettleTrip(ctx, edb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Settlement{}
+	for payer, payees := range before {
+		for payee, amount := range payees {
+			if payer == bob {
+				payer = erased.Email
+			}
+			if payee == bob {
+				payee = erased.Email
+			}
+			if expected[payer] == nil {
+				expected[payer] = make(map[string]int)
+			}
+			expected[payer][payee] = amount
+		}
+	}
+	if !reflect.DeepEqual(after, expected) {
+		t.Errorf("expected the settlement %v, got %v", expected, after)
+	}
+
+	reloaded, err := LoadTripByID(ctx, edb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.IsParticipant(erased.Email) || reloaded.IsParticipant(bob) || !reloaded.IsParticipant(jimbob) {
+		t.Errorf("Unexpected participants %v", reloaded.Participants)
+	}
+	if reloaded.Version <= tr.Version {
+		t.Errorf("expected the version of the trip to change, got %d", reloaded.Version)
+	}
+	snap, err := LoadSnapshot(ctx, edb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, doc := range map[string][]byte{"JSON": snap.JSON, "CSV": snap.CSV, "PDF": snap.PDF} {
+		if bytes.Contains(bytes.ReplaceAll(doc, []byte(jimbob), nil), []byte(bob)) {
+			t.Errorf("the %s snapshot still holds %s", name, bob)
+		}
+		if !bytes.Contains(doc, []byte(erased.Email)) || !bytes.Contains(doc, []byte(jimbob)) {
+			t.Errorf("Unexpected %s snapshot %s", name, doc)
+		}
+	}
+	_, err = LoadToken(ctx, edb, tok.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected the token to be deleted, got %v", err)
+	}
+
+	// the tombstones are reserved, the address erased is free again
+	_, err = LoadOrCreateUser(ctx, edb, erased.Email+".x")
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	_, err = LoadOrCreateUser(ctx, edb, "erased-99@erased.invalid")
+	if !errors.Is(err, ErrEmailDomain) {
+		t.Errorf("expected ErrEmailDomain for a tombstone, got %v", err)
+	}
+	again, err := LoadOrCreateUser(ctx, edb, bob)
+	if err != nil || again.ID == usr.ID {
+		t.Errorf("expected a new user for %s, got %+v: %v", bob, again, err)
+	}
+}
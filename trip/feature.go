@@ -0,0 +1,324 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the feature flags, gating the new behaviors that
+// are risky, e.g. another settlement algorithm, for them to roll out
+// gradually on a hosted instance: to some trips or users first, then to a
+// share of the trips, then to all. A flag is off until the admin sets it.
+// The flags are kept in the database, and cached in memory for them to be
+// evaluated along the computations, the instance being a single process.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	featureSelect = "SELECT name, enabled, percent, trips, updated_at FROM feature_flag ORDER BY name"
+	featureUsers  = `SELECT f.name, u.email FROM feature_user AS f, tuser AS u
+WHERE f.user_id = u.user_id ORDER BY f.name, u.email`
+	featureUpsert = `INSERT INTO feature_flag (name, enabled, percent, trips, updated_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (name) DO UPDATE SET enabled = excluded.enabled, percent = excluded.percent,
+trips = excluded.trips, updated_at = excluded.updated_at`
+	featureDelete      = "DELETE FROM feature_flag WHERE name = ?"
+	featureUsersDelete = "DELETE FROM feature_user WHERE name = ?"
+	featureUserInsert  = "INSERT INTO feature_user (name, user_id) VALUES (?, ?)"
+	featureOwnerSelect = `SELECT u.email FROM tuser AS u, participant AS p
+WHERE u.user_id = p.user_id
+AND p.is_owner = true
+AND p.trip_id = ?`
+)
+
+// The feature flags
+const (
+	// FeatureSimplifiedSettlement settles a trip with the fewest transfers,
+	// from the net balances of the people, instead of netting the
+	// payments of each expense
+	FeatureSimplifiedSettlement = "simplified_settlement"
+)
+
+// Features are the feature flags known
+var Features = []string{FeatureSimplifiedSettlement}
+
+// ErrUnknownFeature is returned for a feature flag not known
+var ErrUnknownFeature = errors.New("unknown feature flag")
+
+// Feature is a feature flag, and who it's on for
+type Feature struct {
+	Name string `json:"name"`
+	// Enabled turns the feature on for everyone
+	Enabled bool `json:"enabled"`
+	// Percent is the share of the trips the feature is on for, from 0 to
+	// 100, the same trips as long as it's raised
+	Percent int `json:"percent"`
+	// Users are the email addresses of the people the feature is on for,
+	// for their trips the owners
+	Users []string `json:"users"`
+	// Trips are the IDs of the trips the feature is on for
+	Trips     []int64   `json:"trips"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// on tells whether the feature is on for the trip of the owner
+func (f *Feature) on(tripID int64, email string) bool {
+	if f.Enabled || slices.Contains(f.Trips, tripID) || (email != "" && slices.Contains(f.Users, email)) {
+		return true
+	}
+	if f.Percent <= 0 {
+		return false
+	}
+	// the bucket depends on the name, for the first trips of a flag not
+	// to be the first ones of every flag
+	h := fnv.New32a()
+	h.Write([]byte(f.Name + ":" + strconv.FormatInt(tripID, 10)))
+	return int(h.Sum32()%100) < f.Percent
+}
+
+// features are the feature flags cached, by name, see LoadFeatures()
+var features = struct {
+	sync.RWMutex
+	flags map[string]*Feature
+}{flags: map[string]*Feature{}}
+
+// FeatureEnabled tells whether the feature flag is on for the trip, or for
+// the user, its owner for the behaviors of the whole trip. The flags are
+// the ones cached by LoadFeatures() or SaveFeature().
+func FeatureEnabled(name string, tripID int64, email string) bool {
+	features.RLock()
+	defer features.RUnlock()
+	f, ok := features.flags[name]
+	return ok && f.on(tripID, normalizeEmail(email))
+}
+
+// tripFeatureEnabled tells whether the feature flag is on for the trip,
+// looking up its owner only if the flag is on for some users
+func tripFeatureEnabled(ctx context.Context, db *sql.DB, name string, tripID int64) (bool, error) {
+	features.RLock()
+	f, ok := features.flags[name]
+	byUser := ok && len(f.Users) > 0
+	features.RUnlock()
+	if !byUser {
+		return FeatureEnabled(name, tripID, ""), nil
+	}
+	var owner string
+	err := db.QueryRowContext(ctx, featureOwnerSelect, tripID).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	return FeatureEnabled(name, tripID, owner), nil
+}
+
+// LoadFeatures returns the feature flags set, by name, and caches them for
+// FeatureEnabled()
+func LoadFeatures(ctx context.Context, db *sql.DB) ([]*Feature, error) {
+	rows, err := db.QueryContext(ctx, featureSelect)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*Feature{}
+	byName := make(map[string]*Feature)
+	for rows.Next() {
+		f := &Feature{Users: []string{}}
+		var trips string
+		var updatedAt int64
+		err = rows.Scan(&f.Name, &f.Enabled, &f.Percent, &trips, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(trips), &f.Trips)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trips of feature flag %s: %v", f.Name, err)
+		}
+		f.UpdatedAt = time.UnixMicro(updatedAt).UTC()
+		rslt = append(rslt, f)
+		byName[f.Name] = f
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, featureUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, email string
+		err = rows.Scan(&name, &email)
+		if err != nil {
+			return nil, err
+		}
+		if f, ok := byName[name]; ok {
+			f.Users = append(f.Users, email)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	features.Lock()
+	features.flags = byName
+	features.Unlock()
+	return rslt, nil
+}
+
+// SaveFeature sets a feature flag, and reloads the cache.
+// ErrUnknownFeature is returned if the flag isn't known.
+func SaveFeature(ctx context.Context, db *sql.DB, f *Feature) (err error) {
+	if !slices.Contains(Features, f.Name) {
+		return fmt.Errorf("%w '%s'", ErrUnknownFeature, f.Name)
+	}
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("the percent of the trips of feature flag %s must be from 0 to 100", f.Name)
+	}
+	if f.Trips == nil {
+		f.Trips = []int64{}
+	}
+	sort.Slice(f.Trips, func(i, j int) bool { return f.Trips[i] < f.Trips[j] })
+	f.Trips = slices.Compact(f.Trips)
+	users := make([]*User, 0, len(f.Users))
+	emails := make([]string, 0, len(f.Users))
+	for _, email := range f.Users {
+		usr, err := LoadOrCreateUser(ctx, db, email)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(emails, usr.Email) {
+			users = append(users, usr)
+			emails = append(emails, usr.Email)
+		}
+	}
+	sort.Strings(emails)
+	f.Users = emails
+	trips, err := json.Marshal(f.Trips)
+	if err != nil {
+		return err
+	}
+	f.UpdatedAt = Now().UTC().Truncate(time.Microsecond)
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, featureUpsert, f.Name, f.Enabled, f.Percent, string(trips), f.UpdatedAt.UnixMicro())
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, featureUsersDelete, f.Name)
+	if err != nil {
+		goto Rollback
+	}
+	for _, usr := range users {
+		_, err = txn.ExecContext(ctx, featureUserInsert, f.Name, usr.ID)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	Logf(ctx, "Set feature flag %s: enabled %t, %d%% of the trips, %d users, %d trips\n",
+		f.Name, f.Enabled, f.Percent, len(f.Users), len(f.Trips))
+	_, err = LoadFeatures(ctx, db)
+	return err
+
+Rollback:
+	if rbErr := txn.Rollback(); rbErr != nil {
+		fatalf(ctx, "Failed to rollback setting feature flag %s: %v", f.Name, rbErr)
+	}
+	return err
+}
+
+// DeleteFeature turns a feature flag off for everyone, and reloads the
+// cache. sql.ErrNoRows is returned if the flag isn't set.
+func DeleteFeature(ctx context.Context, db *sql.DB, name string) error {
+	_, err := db.ExecContext(ctx, featureUsersDelete, name)
+	if err != nil {
+		return err
+	}
+	rslt, err := db.ExecContext(ctx, featureDelete, name)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return sql.ErrNoRows
+	}
+	Logf(ctx, "Deleted feature flag %s\n", name)
+	_, err = LoadFeatures(ctx, db)
+	return err
+}
+
+// simplify returns the Settlement paying the net balances of the people
+// with the fewest transfers: the largest debtor pays the largest creditor,
+// the ties by email address, until all are settled
+func (s Settlement) simplify() Settlement {
+	net := make(map[string]int)
+	for payer, payments := range s {
+		for payee, amount := range payments {
+			net[payer] -= amount
+			net[payee] += amount
+		}
+	}
+	type balance struct {
+		email  string
+		amount int
+	}
+	var debtors, creditors []*balance
+	for email, amount := range net {
+		switch {
+		case amount < 0:
+			debtors = append(debtors, &balance{email, -amount})
+		case amount > 0:
+			creditors = append(creditors, &balance{email, amount})
+		}
+	}
+	largest := func(b []*balance) func(i, j int) bool {
+		return func(i, j int) bool {
+			if b[i].amount != b[j].amount {
+				return b[i].amount > b[j].amount
+			}
+			return b[i].email < b[j].email
+		}
+	}
+	sort.Slice(debtors, largest(debtors))
+	sort.Slice(creditors, largest(creditors))
+
+	rslt := make(Settlement)
+	for i, j := 0, 0; i < len(debtors) && j < len(creditors); {
+		d, c := debtors[i], creditors[j]
+		amount := min(d.amount, c.amount)
+		rslt.add(d.email, c.email, amount)
+		d.amount -= amount
+		c.amount -= amount
+		if d.amount == 0 {
+			i++
+		}
+		if c.amount == 0 {
+			j++
+		}
+	}
+	return rslt
+}
@@ -0,0 +1,154 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the feature flags.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	featureFlagCreate = `CREATE TABLE IF NOT EXISTS feature_flag (
+name VARCHAR(64) CONSTRAINT feature_flag_pkey PRIMARY KEY,
+enabled BOOLEAN NOT NULL DEFAULT FALSE,
+percent INTEGER NOT NULL DEFAULT 0,
+trips TEXT NOT NULL,
+updated_at INTEGER NOT NULL)`
+	featureUserCreate = `CREATE TABLE IF NOT EXISTS feature_user (
+name VARCHAR(64) NOT NULL,
+user_id INTEGER NOT NULL,
+CONSTRAINT feature_user_pkey PRIMARY KEY (name, user_id))`
+)
+
+// TestFeatureFlags rolls the simplified settlement out to a trip, to its
+// owner, to a share of the trips, then to all
+func TestFeatureFlags(t *testing.T) {
+	ctx := context.Background()
+	fdb := openTestDB(t)
+	t.Cleanup(func() { LoadFeatures(ctx, fdb) })
+
+	// bob owes alice, charlie owes bob the same
+	newTrip := func(name, owner string, people []string) *Trip {
+		tr := NewTrip(name, owner, "", NewDate(Now()), people)
+		err := tr.Save(ctx, fdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tr.AddExpense(NewDate(Now()), "hotel", []Participant{{alice, 0, 3000}, {bob, 0, 0}})
+		if err == nil {
+			err = tr.AddExpense(NewDate(Now()), "dinner", []Participant{{bob, 0, 3000}, {charlie, 0, 0}})
+		}
+		if err == nil {
+			err = tr.Save(ctx, fdb)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+	tr1 := newTrip("Trip F1", alice, []string{bob, charlie})
+	tr2 := newTrip("Trip F2", bob, []string{alice, charlie})
+	chained := Settlement{bob: {alice: 1500}, charlie: {bob: 1500}}
+	simplified := Settlement{charlie: {alice: 1500}}
+	check := func(what string, tr *Trip, want Settlement) {
+		t.Helper()
+		s, err := tr.Settlement()
+		if err != nil || !reflect.DeepEqual(s, want) {
+			t.Errorf("%s: expected %v, got %v, %v", what, want, s, err)
+		}
+		s, err = LoadSettlement(ctx, fdb, tr.ID)
+		if err != nil || !reflect.DeepEqual(s, want) {
+			t.Errorf("%s: expected %v from the balances, got %v, %v", what, want, s, err)
+		}
+	}
+
+	flags, err := LoadFeatures(ctx, fdb)
+	if err != nil || len(flags) != 0 {
+		t.Fatalf("expected no flags, got %+v, %v", flags, err)
+	}
+	check("off", tr1, chained)
+
+	err = SaveFeature(ctx, fdb, &Feature{Name: "teleport"})
+	if !errors.Is(err, ErrUnknownFeature) {
+		t.Errorf("expected ErrUnknownFeature, got %v", err)
+	}
+	err = SaveFeature(ctx, fdb, &Feature{Name: FeatureSimplifiedSettlement, Percent: 101})
+	if err == nil {
+		t.Error("expected an error for 101%")
+	}
+
+	err = SaveFeature(ctx, fdb, &Feature{Name: FeatureSimplifiedSettlement, Trips: []int64{tr1.ID, tr1.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("on for trip 1", tr1, simplified)
+	check("on for trip 1 only", tr2, chained)
+
+	err = SaveFeature(ctx, fdb, &Feature{Name: FeatureSimplifiedSettlement, Users: []string{"Bob@Test.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("on for bob, not owning trip 1", tr1, chained)
+	check("on for bob, owning trip 2", tr2, simplified)
+	flags, err = LoadFeatures(ctx, fdb)
+	if err != nil || len(flags) != 1 || !reflect.DeepEqual(flags[0].Users, []string{bob}) || len(flags[0].Trips) != 0 {
+		t.Errorf("expected the flag on for bob only, got %+v, %v", flags, err)
+	}
+
+	for _, percent := range []int{0, 100} {
+		err = SaveFeature(ctx, fdb, &Feature{Name: FeatureSimplifiedSettlement, Percent: percent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if on := FeatureEnabled(FeatureSimplifiedSettlement, tr1.ID, ""); on != (percent == 100) {
+			t.Errorf("expected the flag on %t for %d%% of the trips", percent == 100, percent)
+		}
+	}
+	// the share of the trips rolled out grows with the percent
+	err = SaveFeature(ctx, fdb, &Feature{Name: FeatureSimplifiedSettlement, Percent: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rolledOut []int64
+	for id := int64(1); id <= 1000; id++ {
+		if FeatureEnabled(FeatureSimplifiedSettlement, id, "") {
+			rolledOut = append(rolledOut, id)
+		}
+	}
+	if len(rolledOut) < 200 || len(rolledOut) > 400 {
+		t.Errorf("expected about 300 trips of 1000 at 30%%, got %d", len(rolledOut))
+	}
+	err = SaveFeature(ctx, fdb, &Feature{Name: FeatureSimplifiedSettlement, Percent: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range rolledOut {
+		if !FeatureEnabled(FeatureSimplifiedSettlement, id, "") {
+			t.Fatalf("expected trip %d still on at 60%%", id)
+		}
+	}
+
+	err = SaveFeature(ctx, fdb, &Feature{Name: FeatureSimplifiedSettlement, Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("on for all", tr1, simplified)
+	err = DeleteFeature(ctx, fdb, FeatureSimplifiedSettlement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("deleted", tr1, chained)
+	err = DeleteFeature(ctx, fdb, FeatureSimplifiedSettlement)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
@@ -0,0 +1,670 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the federation of the trips: two instances, e.g.
+// the ones self-hosted by two groups of friends, co-own a trip, each
+// keeping its own copy. A sync exchanges the changes of the expenses of
+// the copies since the previous one, read from the change feed of each:
+// the expenses added, and the ones deleted, from their archive. Every
+// expense has an origin, the instance it was entered on and its ID there,
+// so the changes are applied once, and a removal on either side is final.
+//
+// The instances sign their requests, and their replies, with a key they
+// share, see FederationVerifier.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	federationSelect = `SELECT federation_id, trip_id, peer, remote_trip_id, sent_until, received_until, synced_at, last_error, created_at
+FROM trip_federation`
+	federationByTrip    = "\nWHERE trip_id = ?\nORDER BY federation_id"
+	federationByID      = "\nWHERE trip_id = ? AND federation_id = ?"
+	federationByPeer    = "\nWHERE trip_id = ? AND peer = ?"
+	federationActive    = "\nWHERE trip_id IN (SELECT trip_id FROM trip WHERE archived_at = 0 AND deleted_at = 0)\nORDER BY federation_id"
+	federationInsert    = "INSERT INTO trip_federation (trip_id, peer, remote_trip_id, created_at) VALUES (?, ?, ?, ?)"
+	federationDelete    = "DELETE FROM trip_federation WHERE trip_id = ? AND federation_id = ?"
+	federationCursors   = "UPDATE trip_federation SET sent_until = ?, received_until = ?, synced_at = ?, last_error = '' WHERE federation_id = ?"
+	federationOutcome   = "UPDATE trip_federation SET synced_at = ?, last_error = ? WHERE federation_id = ?"
+	federationTombstone = `SELECT e.expense_id, e.deleted_at, COALESCE(m.metadata, '')
+FROM expense_deleted AS e LEFT JOIN expense_metadata AS m ON m.expense_id = e.expense_id
+WHERE e.trip_id = ?`
+)
+
+const (
+	// FederationOriginKey is the key of the metadata of an expense holding
+	// its origin, when it was entered on another instance
+	FederationOriginKey = "federation_origin"
+	// FederationAdded and FederationRemoved are the kinds of the changes
+	FederationAdded   = "expense.added"
+	FederationRemoved = "expense.removed"
+	// federationTimeout is the time a peer has to answer a sync, when the
+	// Federation has no client
+	federationTimeout = 30 * time.Second
+	// federationMaxReply is the largest reply read from a peer
+	federationMaxReply = 16 << 20
+	// maxPeerURL is the longest URL of a peer stored
+	maxPeerURL = 256
+	// maxSyncError is the longest error of a sync recorded
+	maxSyncError = 512
+)
+
+var (
+	// ErrNoFederation is returned for a trip not federated with the peer
+	ErrNoFederation = errors.New("no such federation")
+	// ErrFederationOff is returned when the instance has no public URL or
+	// no key to federate its trips with
+	ErrFederationOff = errors.New("the federation of the trips isn't set up")
+	// ErrPeerFailed wraps the failures of the peer of a sync, e.g. its
+	// refusal or a reply not signed
+	ErrPeerFailed = errors.New("the peer failed the sync")
+)
+
+// Federation is the instance federating its trips: it signs its requests
+// with Key, shared with its peers, and it's known to them by Self
+type Federation struct {
+	// Self is the public URL of the instance, e.g.
+	// https://trips.example.com, it prefixes the origins of the expenses
+	// entered on it
+	Self string
+	Key  []byte
+	// Client sends the requests, one with federationTimeout if nil
+	Client *http.Client
+}
+
+// FederationLink is the federation of a trip with its copy on a peer
+type FederationLink struct {
+	ID     int64 `json:"federation_id"`
+	TripID int64 `json:"trip_id"`
+	// Peer is the public URL of the other instance
+	Peer         string `json:"peer"`
+	RemoteTripID int64  `json:"remote_trip_id"`
+	// SentUntil is the time of the last change of the trip the peer has,
+	// ReceivedUntil the one of the last change of its copy on the peer,
+	// by the clock of the peer
+	SentUntil     time.Time  `json:"sent_until"`
+	ReceivedUntil time.Time  `json:"received_until"`
+	SyncedAt      *time.Time `json:"synced_at,omitempty"`
+	// LastError is why the last sync failed, empty if it succeeded
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FederatedParticipant is a participant of an expense of a change
+type FederatedParticipant struct {
+	Email string `json:"user"`
+	Paid  int    `json:"paid"`
+}
+
+// FederatedExpense is the expense of a change, as added on its origin
+type FederatedExpense struct {
+	// Date is the transaction date in `YYYY-MM-DD` format
+	Date         string                 `json:"date"`
+	Description  string                 `json:"description"`
+	Notes        string                 `json:"notes,omitempty"`
+	Metadata     map[string]string      `json:"metadata,omitempty"`
+	Participants []FederatedParticipant `json:"participants"`
+}
+
+// FederationChange is a change of the expenses of a trip
+type FederationChange struct {
+	// Kind is FederationAdded or FederationRemoved
+	Kind string `json:"kind"`
+	// Origin is the instance the expense was entered on, "#", and its ID
+	// there, e.g. https://trips.example.com#42
+	Origin string `json:"origin"`
+	// At is when the change was made, by the clock of the sender
+	At time.Time `json:"at"`
+	// Expense is the expense added, nil if removed
+	Expense *FederatedExpense `json:"expense,omitempty"`
+}
+
+// FederationBatch is a sync request, or its reply: the changes of the trip
+// of the sender since the time the receiver last got, in order
+type FederationBatch struct {
+	// Peer is the public URL of the sender
+	Peer     string `json:"peer"`
+	TripID   int64  `json:"trip_id"`
+	ToTripID int64  `json:"to_trip_id"`
+	// Since is the time of the last change of the receiver the sender
+	// has, the changes in the reply are the later ones
+	Since time.Time `json:"since"`
+	// Until is the time of the last change of the sender in the batch
+	Until   time.Time          `json:"until"`
+	Changes []FederationChange `json:"changes"`
+}
+
+// FederationResult is the outcome of a sync
+type FederationResult struct {
+	// Sent is the number of changes sent, Received the number of changes
+	// of the peer applied
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+}
+
+// normalizePeer returns the URL of a peer without its trailing slash, an
+// error if it isn't an HTTP(S) URL
+func normalizePeer(peer string) (string, error) {
+	peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+	u, err := url.Parse(peer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("the peer %q isn't the URL of an instance", peer)
+	}
+	if len(peer) > maxPeerURL {
+		return "", fmt.Errorf("the URL of the peer is over %d characters", maxPeerURL)
+	}
+	return peer, nil
+}
+
+// origin returns the origin of an expense of the instance
+func (f *Federation) origin(expenseID int64, metadata map[string]string) string {
+	if o := metadata[FederationOriginKey]; o != "" {
+		return o
+	}
+	return f.Self + "#" + strconv.FormatInt(expenseID, 10)
+}
+
+// Link federates the trip with its copy on the peer, the first sync sends
+// all its expenses
+func (f *Federation) Link(ctx context.Context, db *sql.DB, tripID int64, peer string, remoteTripID int64) (*FederationLink, error) {
+	peer, err := normalizePeer(peer)
+	if err != nil {
+		return nil, err
+	}
+	if peer == f.Self {
+		return nil, errors.New("a trip can't be federated with its own instance")
+	}
+	if remoteTripID <= 0 {
+		return nil, errors.New("the ID of the trip on the peer is required")
+	}
+	_, err = scanFederationLink(db.QueryRowContext(ctx, federationSelect+federationByPeer, tripID, peer))
+	switch {
+	case err == nil:
+		return nil, fmt.Errorf("the trip is already federated with %s", peer)
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	rslt, err := db.ExecContext(ctx, federationInsert, tripID, peer, remoteTripID, now.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	id, err := rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Federated trip %d with trip %d of %s\n", tripID, remoteTripID, peer)
+	return &FederationLink{
+		ID:            id,
+		TripID:        tripID,
+		Peer:          peer,
+		RemoteTripID:  remoteTripID,
+		SentUntil:     time.UnixMicro(0).UTC(),
+		ReceivedUntil: time.UnixMicro(0).UTC(),
+		CreatedAt:     now,
+	}, nil
+}
+
+// LoadFederationLinks returns the federations of a trip
+func LoadFederationLinks(ctx context.Context, db *sql.DB, tripID int64) ([]*FederationLink, error) {
+	return queryFederationLinks(ctx, db, federationSelect+federationByTrip, tripID)
+}
+
+// LoadActiveFederationLinks returns the federations of the trips not
+// archived, for the scheduled syncs
+func LoadActiveFederationLinks(ctx context.Context, db *sql.DB) ([]*FederationLink, error) {
+	return queryFederationLinks(ctx, db, federationSelect+federationActive)
+}
+
+// LoadFederationLink returns a federation of a trip, ErrNoFederation if
+// there's none
+func LoadFederationLink(ctx context.Context, db *sql.DB, tripID, federationID int64) (*FederationLink, error) {
+	l, err := scanFederationLink(db.QueryRowContext(ctx, federationSelect+federationByID, tripID, federationID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNoFederation
+	}
+	return l, err
+}
+
+// UnlinkFederation ends a federation of a trip, ErrNoFederation is returned
+// if there's none. The expenses received from the peer are kept.
+func UnlinkFederation(ctx context.Context, db *sql.DB, tripID, federationID int64) error {
+	rslt, err := db.ExecContext(ctx, federationDelete, tripID, federationID)
+	if err != nil {
+		return err
+	}
+	n, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoFederation
+	}
+	Logf(ctx, "Ended the federation %d of trip %d\n", federationID, tripID)
+	return nil
+}
+
+// queryFederationLinks returns the federations of the query
+func queryFederationLinks(ctx context.Context, db *sql.DB, query string, args ...any) ([]*FederationLink, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*FederationLink{}
+	for rows.Next() {
+		l, err := scanFederationLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, l)
+	}
+	return rslt, rows.Err()
+}
+
+// scanFederationLink reads a federation from a row
+func scanFederationLink(row interface{ Scan(...any) error }) (*FederationLink, error) {
+	l := &FederationLink{}
+	var sentUntil, receivedUntil, syncedAt, createdAt int64
+	err := row.Scan(&l.ID, &l.TripID, &l.Peer, &l.RemoteTripID, &sentUntil, &receivedUntil, &syncedAt, &l.LastError, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	l.SentUntil = time.UnixMicro(sentUntil).UTC()
+	l.ReceivedUntil = time.UnixMicro(receivedUntil).UTC()
+	if syncedAt != 0 {
+		t := time.UnixMicro(syncedAt).UTC()
+		l.SyncedAt = &t
+	}
+	l.CreatedAt = time.UnixMicro(createdAt).UTC()
+	return l, nil
+}
+
+// changes returns the changes of the expenses of the trip made after
+// since, in order, and the time of the last one, since if there's none.
+// The changes of the expenses entered on the peer are left out, it has
+// them already, but they still move the time on.
+func (f *Federation) changes(ctx context.Context, db *sql.DB, trip *Trip, since time.Time, peer string) ([]FederationChange, time.Time, error) {
+	until := since
+	changes := []FederationChange{}
+	fromPeer := func(origin string) bool {
+		return strings.HasPrefix(origin, peer+"#")
+	}
+	for _, e := range trip.Expenses {
+		if !e.createdAt.After(since) {
+			continue
+		}
+		if e.createdAt.After(until) {
+			until = e.createdAt
+		}
+		origin := f.origin(e.ID, e.Metadata)
+		if fromPeer(origin) {
+			continue
+		}
+		fe := &FederatedExpense{
+			Date:         e.Date.Format(time.DateOnly),
+			Description:  e.Description,
+			Notes:        e.Notes,
+			Participants: make([]FederatedParticipant, 0, len(e.Participants)),
+		}
+		if len(e.Metadata) > 0 {
+			fe.Metadata = maps.Clone(e.Metadata)
+			delete(fe.Metadata, FederationOriginKey)
+		}
+		for _, p := range e.Participants {
+			fe.Participants = append(fe.Participants, FederatedParticipant{Email: p.Email, Paid: p.Paid})
+		}
+		changes = append(changes, FederationChange{Kind: FederationAdded, Origin: origin, At: e.createdAt.UTC(), Expense: fe})
+	}
+
+	tombstones, err := f.tombstones(ctx, db, trip.ID)
+	if err != nil {
+		return nil, since, err
+	}
+	for origin, deletedAt := range tombstones {
+		if !deletedAt.After(since) {
+			continue
+		}
+		if deletedAt.After(until) {
+			until = deletedAt
+		}
+		changes = append(changes, FederationChange{Kind: FederationRemoved, Origin: origin, At: deletedAt})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].At.Equal(changes[j].At) {
+			return changes[i].Origin < changes[j].Origin
+		}
+		return changes[i].At.Before(changes[j].At)
+	})
+	return changes, until, nil
+}
+
+// tombstones returns when the deleted expenses of the trip were deleted,
+// by origin
+func (f *Federation) tombstones(ctx context.Context, db *sql.DB, tripID int64) (map[string]time.Time, error) {
+	rows, err := db.QueryContext(ctx, federationTombstone, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := make(map[string]time.Time)
+	for rows.Next() {
+		var expenseID, deletedAt int64
+		var metadata string
+		err = rows.Scan(&expenseID, &deletedAt, &metadata)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]string
+		if metadata != "" {
+			err = json.Unmarshal([]byte(metadata), &m)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rslt[f.origin(expenseID, m)] = time.UnixMicro(deletedAt).UTC()
+	}
+	return rslt, rows.Err()
+}
+
+// apply applies the changes of the peer to the trip, in order, and returns
+// the number applied. An expense is added once, unless it was removed
+// already, the participants of the peer missing from the trip are added.
+// An expense removed is removed, whichever instance it was entered on.
+func (f *Federation) apply(ctx context.Context, db *sql.DB, tripID int64, changes []FederationChange) (int, error) {
+	if len(changes) == 0 {
+		return 0, nil
+	}
+	var applied int
+	_, err := UpdateTrip(ctx, db, tripID, func(trip *Trip) error {
+		applied = 0
+		// known are the expenses of the trip by origin, nil once removed
+		known := make(map[string]*Expense)
+		tombstones, err := f.tombstones(ctx, db, trip.ID)
+		if err != nil {
+			return err
+		}
+		for origin := range tombstones {
+			known[origin] = nil
+		}
+		for _, e := range trip.Expenses {
+			known[f.origin(e.ID, e.Metadata)] = e
+		}
+
+		for _, c := range changes {
+			switch c.Kind {
+			case FederationAdded:
+				if _, ok := known[c.Origin]; ok || c.Expense == nil {
+					continue
+				}
+				participants := make([]Participant, 0, len(c.Expense.Participants))
+				for _, p := range c.Expense.Participants {
+					if !trip.IsParticipant(p.Email) {
+						err = trip.AddParticipant(p.Email)
+						if err != nil {
+							return err
+						}
+					}
+					participants = append(participants, Participant{Email: p.Email, Paid: p.Paid})
+				}
+				date, err := time.Parse(time.DateOnly, c.Expense.Date)
+				if err != nil {
+					return err
+				}
+				e, err := trip.newExpense(NewDate(date), c.Expense.Description, participants)
+				if err != nil {
+					return err
+				}
+				e.SetNotes(c.Expense.Notes)
+				e.Metadata = maps.Clone(c.Expense.Metadata)
+				if e.Metadata == nil {
+					e.Metadata = make(map[string]string)
+				}
+				e.Metadata[FederationOriginKey] = c.Origin
+				trip.Expenses = append(trip.Expenses, e)
+				trip.totalExpense += e.amount
+				known[c.Origin] = e
+			case FederationRemoved:
+				e := known[c.Origin]
+				known[c.Origin] = nil
+				if e == nil {
+					continue
+				}
+				if e.ID != 0 {
+					err = trip.RemoveExpense(e.ID)
+					if err != nil {
+						return err
+					}
+					break
+				}
+				// added by an earlier change of the batch, not saved yet
+				for i, added := range trip.Expenses {
+					if added == e {
+						trip.Expenses = append(trip.Expenses[:i], trip.Expenses[i+1:]...)
+						trip.totalExpense -= e.amount
+						break
+					}
+				}
+			default:
+				// a kind of a later version of the protocol
+				continue
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Sync sends the changes of the trip since the previous sync to the peer,
+// and applies the ones of the peer in its reply. The outcome is recorded
+// with the federation, the cursors moving on success only.
+func (f *Federation) Sync(ctx context.Context, db *sql.DB, link *FederationLink) (*FederationResult, error) {
+	now := Now().UTC().Truncate(time.Microsecond)
+	rslt, sentUntil, receivedUntil, err := f.sync(ctx, db, link)
+	if err != nil {
+		msg := err.Error()
+		if len(msg) > maxSyncError {
+			msg = msg[:maxSyncError]
+		}
+		_, dbErr := db.ExecContext(ctx, federationOutcome, now.UnixMicro(), msg, link.ID)
+		if dbErr != nil {
+			Logf(ctx, "ERROR: failed to record the failed sync of the federation %d: %v\n", link.ID, dbErr)
+		}
+		link.SyncedAt, link.LastError = &now, msg
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, federationCursors, sentUntil.UnixMicro(), receivedUntil.UnixMicro(), now.UnixMicro(), link.ID)
+	if err != nil {
+		return nil, err
+	}
+	link.SentUntil, link.ReceivedUntil, link.SyncedAt, link.LastError = sentUntil, receivedUntil, &now, ""
+	Logf(ctx, "Synced trip %d with %s: %d changes sent, %d received\n", link.TripID, link.Peer, rslt.Sent, rslt.Received)
+	return rslt, nil
+}
+
+// sync exchanges the changes with the peer, it returns the new cursors of
+// the federation
+func (f *Federation) sync(ctx context.Context, db *sql.DB, link *FederationLink) (*FederationResult, time.Time, time.Time, error) {
+	var zero time.Time
+	trip, err := LoadTripByID(ctx, db, link.TripID)
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	changes, until, err := f.changes(ctx, db, trip, link.SentUntil, link.Peer)
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	body, err := json.Marshal(FederationBatch{
+		Peer:     f.Self,
+		TripID:   link.TripID,
+		ToTripID: link.RemoteTripID,
+		Since:    link.ReceivedUntil,
+		Until:    until,
+		Changes:  changes,
+	})
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	target := link.Peer + "/v1/federation/trips/" + strconv.FormatInt(link.RemoteTripID, 10) + "/sync"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "trip-accountant")
+	req.Header.Set(FederationSignatureHeader, SignFederation(f.Key, body, Now()))
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: federationTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, zero, zero, fmt.Errorf("%w: %v", ErrPeerFailed, err)
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, federationMaxReply))
+	if err != nil {
+		return nil, zero, zero, fmt.Errorf("%w: %v", ErrPeerFailed, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, zero, zero, fmt.Errorf("%w: %s answered %s: %.200s", ErrPeerFailed, link.Peer, resp.Status, bytes.TrimSpace(reply))
+	}
+	in, err := FederationVerifier{Key: f.Key}.Verify(resp.Header, reply)
+	if err == nil && (Now().Sub(in.Timestamp) > inboundTolerance || in.Timestamp.Sub(Now()) > inboundTolerance) {
+		err = ErrInboundStale
+	}
+	if err != nil {
+		return nil, zero, zero, fmt.Errorf("%w: its reply: %v", ErrPeerFailed, err)
+	}
+	var batch FederationBatch
+	err = json.Unmarshal(reply, &batch)
+	if err != nil {
+		return nil, zero, zero, fmt.Errorf("%w: its reply: %v", ErrPeerFailed, err)
+	}
+	if batch.Peer != link.Peer || batch.TripID != link.RemoteTripID || batch.ToTripID != link.TripID {
+		return nil, zero, zero, fmt.Errorf("%w: it replied for trip %d of %s", ErrPeerFailed, batch.TripID, batch.Peer)
+	}
+	received, err := f.apply(ctx, db, link.TripID, batch.Changes)
+	if err != nil {
+		return nil, zero, zero, err
+	}
+	return &FederationResult{Sent: len(changes), Received: received}, until, batch.Until, nil
+}
+
+// Receive applies the changes of a sync request of a peer to the trip, and
+// returns the reply: the changes of the trip the peer doesn't have.
+// ErrNoFederation is returned if the trip isn't federated with the trip of
+// the peer.
+func (f *Federation) Receive(ctx context.Context, db *sql.DB, tripID int64, batch *FederationBatch) (*FederationBatch, error) {
+	peer, err := normalizePeer(batch.Peer)
+	if err != nil || batch.ToTripID != tripID {
+		return nil, ErrNoFederation
+	}
+	link, err := scanFederationLink(db.QueryRowContext(ctx, federationSelect+federationByPeer, tripID, peer))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrNoFederation
+	case err != nil:
+		return nil, err
+	case link.RemoteTripID != batch.TripID:
+		return nil, ErrNoFederation
+	}
+	received, err := f.apply(ctx, db, tripID, batch.Changes)
+	if err != nil {
+		return nil, err
+	}
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return nil, err
+	}
+	changes, until, err := f.changes(ctx, db, trip, batch.Since, peer)
+	if err != nil {
+		return nil, err
+	}
+	// the peer acknowledged the changes until Since, the ones of the reply
+	// are sent again by the next sync from here if it doesn't get them
+	now := Now().UTC().Truncate(time.Microsecond)
+	_, err = db.ExecContext(ctx, federationCursors, batch.Since.UnixMicro(), batch.Until.UnixMicro(), now.UnixMicro(), link.ID)
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Received a sync of trip %d from %s: %d changes applied, %d sent back\n", tripID, peer, received, len(changes))
+	return &FederationBatch{
+		Peer:     f.Self,
+		TripID:   tripID,
+		ToTripID: link.RemoteTripID,
+		Since:    batch.Until,
+		Until:    until,
+		Changes:  changes,
+	}, nil
+}
+
+// FederationSignatureHeader is the header of the signature of the sync
+// requests and of their replies
+const FederationSignatureHeader = "X-Federation-Signature"
+
+// SignFederation returns the signature of a sync request, or reply, of the
+// body at the time: "t=", the Unix time, ",v1=" and the HMAC-SHA256 of the
+// time, "." and the body
+func SignFederation(key, body []byte, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// FederationVerifier verifies the sync requests of the peers, with the key
+// the instances share
+type FederationVerifier struct {
+	Key []byte
+}
+
+// Verify checks the header X-Federation-Signature, see SignFederation().
+// The signature is the nonce. Nothing is verified without a key.
+func (v FederationVerifier) Verify(header http.Header, body []byte) (Inbound, error) {
+	if len(v.Key) == 0 {
+		return Inbound{}, ErrInboundSignature
+	}
+	var ts, sig string
+	for _, part := range strings.Split(header.Get(FederationSignatureHeader), ",") {
+		k, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = val
+		case "v1":
+			sig = val
+		}
+	}
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return Inbound{}, ErrInboundSignature
+	}
+	want := SignFederation(v.Key, body, time.Unix(secs, 0))
+	if !hmac.Equal([]byte("t="+ts+",v1="+sig), []byte(want)) {
+		return Inbound{}, ErrInboundSignature
+	}
+	return Inbound{Timestamp: time.Unix(secs, 0), Nonce: sig}, nil
+}
@@ -0,0 +1,186 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the federation of the trips.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const tripFederationCreate = `CREATE TABLE IF NOT EXISTS trip_federation (
+federation_id INTEGER CONSTRAINT trip_federation_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+peer VARCHAR(256) NOT NULL,
+remote_trip_id INTEGER NOT NULL,
+sent_until INTEGER NOT NULL DEFAULT 0,
+received_until INTEGER NOT NULL DEFAULT 0,
+synced_at INTEGER NOT NULL DEFAULT 0,
+last_error VARCHAR(512) NOT NULL DEFAULT '',
+created_at INTEGER NOT NULL,
+CONSTRAINT trip_federation_peer_unique UNIQUE (trip_id, peer))`
+
+// federationPeer serves the sync requests of the federation on the
+// database, as the server does
+func federationPeer(t *testing.T, f *Federation, fdb *sql.DB, tripID int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if _, err := (FederationVerifier{Key: f.Key}).Verify(r.Header, body); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var batch FederationBatch
+		if err := json.Unmarshal(body, &batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reply, err := f.Receive(r.Context(), fdb, tripID, &batch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		out, _ := json.Marshal(reply)
+		w.Header().Set(FederationSignatureHeader, SignFederation(f.Key, out, Now()))
+		w.Write(out)
+	}))
+}
+
+// TestFederation syncs a trip across two instances, both adding and
+// removing expenses
+func TestFederation(t *testing.T) {
+	ctx := context.Background()
+	adb, bdb := openTestDB(t), openTestDB(t)
+	start := time.Date(2024, 8, 1, 9, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+	key := []byte("shared")
+
+	ta := NewTrip("Federated", alice, "", NewDate(start), []string{bob})
+	tb := NewTrip("Federated", charlie, "", NewDate(start), []string{alice})
+	for _, c := range []struct {
+		tr        *Trip
+		db        *sql.DB
+		who, with string
+	}{{ta, adb, alice, bob}, {tb, bdb, charlie, alice}} {
+		err := c.tr.Save(ctx, c.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.tr.AddExpense(NewDate(start), "Dinner of "+c.who, []Participant{{Email: c.who, Paid: 3000}, {Email: c.with}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.tr.Save(ctx, c.db); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fb := &Federation{Self: "http://b.test", Key: key}
+	srv := federationPeer(t, fb, bdb, tb.ID)
+	defer srv.Close()
+	fa := &Federation{Self: "http://a.test", Key: key}
+	fb.Self = srv.URL
+
+	if _, err := fa.Link(ctx, adb, ta.ID, "http://a.test/", tb.ID); err == nil {
+		t.Error("expected a federation with itself to be refused")
+	}
+	link, err := fa.Link(ctx, adb, ta.ID, srv.URL+"/", tb.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Peer != srv.URL {
+		t.Errorf("expected the peer %s, got %s", srv.URL, link.Peer)
+	}
+	if _, err = fa.Sync(ctx, adb, link); err == nil {
+		t.Fatal("expected a sync with a peer not federated back to fail")
+	}
+	if link.LastError == "" {
+		t.Error("expected the failure of the sync recorded")
+	}
+	if _, err = fb.Link(ctx, bdb, tb.ID, fa.Self, ta.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	rslt, err := fa.Sync(ctx, adb, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rslt.Sent != 1 || rslt.Received != 1 || link.LastError != "" {
+		t.Errorf("Unexpected sync %+v of %+v", rslt, link)
+	}
+	a, _ := LoadTripByID(ctx, adb, ta.ID)
+	b, _ := LoadTripByID(ctx, bdb, tb.ID)
+	if len(a.Expenses) != 2 || len(b.Expenses) != 2 || !a.IsParticipant(charlie) || !b.IsParticipant(bob) {
+		t.Fatalf("expected both expenses on both instances, got %d and %d", len(a.Expenses), len(b.Expenses))
+	}
+	if a.Expenses[1].Metadata[FederationOriginKey] != srv.URL+"#1" {
+		t.Errorf("Unexpected origin %v", a.Expenses[1].Metadata)
+	}
+
+	// nothing changed, nothing applied
+	rslt, err = fa.Sync(ctx, adb, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rslt.Sent != 0 || rslt.Received != 0 {
+		t.Errorf("expected nothing to sync, got %+v", rslt)
+	}
+
+	// the expense of alice is removed on b, the one of charlie on a
+	_, err = UpdateTrip(ctx, bdb, tb.ID, func(tr *Trip) error {
+		return tr.RemoveExpense(tr.Expenses[1].ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = UpdateTrip(ctx, adb, ta.ID, func(tr *Trip) error {
+		return tr.RemoveExpense(tr.Expenses[1].ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rslt, err = fa.Sync(ctx, adb, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rslt.Sent != 1 || rslt.Received != 1 {
+		t.Errorf("expected one removal each way, got %+v", rslt)
+	}
+	a, _ = LoadTripByID(ctx, adb, ta.ID)
+	b, _ = LoadTripByID(ctx, bdb, tb.ID)
+	if len(a.Expenses) != 0 || len(b.Expenses) != 0 {
+		t.Errorf("expected the removals applied, got %d and %d expenses", len(a.Expenses), len(b.Expenses))
+	}
+
+	// a removal is final, the expense isn't added back from the start
+	link.SentUntil, link.ReceivedUntil = time.UnixMicro(0), time.UnixMicro(0)
+	if _, err = fa.Sync(ctx, adb, link); err != nil {
+		t.Fatal(err)
+	}
+	b, _ = LoadTripByID(ctx, bdb, tb.ID)
+	if len(b.Expenses) != 0 {
+		t.Errorf("expected no expense back on b, got %d", len(b.Expenses))
+	}
+
+	fa.Key = []byte("wrong")
+	if _, err = fa.Sync(ctx, adb, link); err == nil {
+		t.Error("expected a sync signed with the wrong key to fail")
+	}
+	if err = UnlinkFederation(ctx, adb, ta.ID, link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadFederationLink(ctx, adb, ta.ID, link.ID); err != ErrNoFederation {
+		t.Errorf("expected ErrNoFederation, got %v", err)
+	}
+}
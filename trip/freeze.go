@@ -0,0 +1,148 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the freeze of the expense entry of a trip, e.g. for
+// 48 hours after the trip, while the participants review the expenses.
+// The trip stays open, but no expense is added to it until the freeze is
+// over or lifted by the owner.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	freezeUpsert = `INSERT INTO expense_freeze (trip_id, frozen_from, frozen_until, created_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (trip_id) DO UPDATE SET frozen_from = excluded.frozen_from,
+frozen_until = excluded.frozen_until, created_at = excluded.created_at`
+	freezeSelect = "SELECT frozen_from, frozen_until, created_at FROM expense_freeze WHERE trip_id = ?"
+	freezeDelete = "DELETE FROM expense_freeze WHERE trip_id = ?"
+)
+
+var (
+	// ErrExpensesFrozen is wrapped by the FreezeError returned when adding
+	// an expense to a trip while its expense entry is frozen
+	ErrExpensesFrozen = errors.New("the expense entry of the trip is frozen")
+	// ErrNoFreeze is returned for a trip whose expense entry isn't frozen
+	ErrNoFreeze = errors.New("no freeze of the expense entry")
+)
+
+// FreezeError is returned when adding an expense to a trip while its
+// expense entry is frozen, it tells when it's over
+type FreezeError struct {
+	Until time.Time
+}
+
+func (e *FreezeError) Error() string {
+	return fmt.Sprintf("%v until %s", ErrExpensesFrozen, e.Until.Format(time.RFC3339))
+}
+
+func (e *FreezeError) Unwrap() error {
+	return ErrExpensesFrozen
+}
+
+// Freeze is the freeze of the expense entry of a trip, from a time until
+// another
+type Freeze struct {
+	From      time.Time `json:"from"`
+	Until     time.Time `json:"until"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Active tells whether the expense entry is frozen at the time
+func (f *Freeze) Active(t time.Time) bool {
+	return !t.Before(f.From) && t.Before(f.Until)
+}
+
+// FreezeExpenses freezes the expense entry of the trip from a time, now if
+// it's the zero time, until another, in the future. It replaces the freeze
+// of the trip if any. ErrTripArchived is returned if the trip is archived.
+func (trip *Trip) FreezeExpenses(ctx context.Context, db *sql.DB, from, until time.Time) (*Freeze, error) {
+	if trip.Archived {
+		return nil, ErrTripArchived
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	if from.IsZero() {
+		from = now
+	}
+	f := &Freeze{From: from.UTC().Truncate(time.Microsecond), Until: until.UTC().Truncate(time.Microsecond), CreatedAt: now}
+	if !f.From.Before(f.Until) {
+		return nil, errors.New("the freeze must end after it starts")
+	}
+	if !now.Before(f.Until) {
+		return nil, errors.New("the freeze must end in the future")
+	}
+	_, err := db.ExecContext(ctx, freezeUpsert, trip.ID, f.From.UnixMicro(), f.Until.UnixMicro(), f.CreatedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Froze the expense entry of trip %d from %s until %s\n",
+		trip.ID, f.From.Format(time.RFC3339), f.Until.Format(time.RFC3339))
+	return f, nil
+}
+
+// LoadFreeze returns the freeze of the expense entry of the trip, over or
+// not, ErrNoFreeze if there's none
+func (trip *Trip) LoadFreeze(ctx context.Context, db *sql.DB) (*Freeze, error) {
+	return scanFreeze(db.QueryRowContext(ctx, freezeSelect, trip.ID))
+}
+
+// scanFreeze reads a freeze from a row, ErrNoFreeze if there's none
+func scanFreeze(row *sql.Row) (*Freeze, error) {
+	f := new(Freeze)
+	var from, until, createdAt int64
+	err := row.Scan(&from, &until, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoFreeze
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.From = time.UnixMicro(from).UTC()
+	f.Until = time.UnixMicro(until).UTC()
+	f.CreatedAt = time.UnixMicro(createdAt).UTC()
+	return f, nil
+}
+
+// LiftFreeze ends the freeze of the expense entry of the trip, ErrNoFreeze
+// is returned if there's none
+func (trip *Trip) LiftFreeze(ctx context.Context, db *sql.DB) error {
+	res, err := db.ExecContext(ctx, freezeDelete, trip.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoFreeze
+	}
+	Logf(ctx, "Lifted the freeze of the expense entry of trip %d\n", trip.ID)
+	return nil
+}
+
+// checkFreeze returns a FreezeError if the expense entry of the trip is
+// frozen at the time. It's expected to be executed within the transaction
+// adding the expenses.
+func (trip *Trip) checkFreeze(ctx context.Context, txn *sql.Tx, now time.Time) error {
+	f, err := scanFreeze(txn.QueryRowContext(ctx, freezeSelect, trip.ID))
+	if err == ErrNoFreeze {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if f.Active(now) {
+		return &FreezeError{Until: f.Until}
+	}
+	return nil
+}
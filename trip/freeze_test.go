@@ -0,0 +1,106 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the freeze of the expense entry.
+
+package trip
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	expenseFreezeCreate = `CREATE TABLE IF NOT EXISTS expense_freeze (
+trip_id INTEGER CONSTRAINT expense_freeze_pkey PRIMARY KEY,
+frozen_from INTEGER NOT NULL,
+frozen_until INTEGER NOT NULL,
+created_at INTEGER NOT NULL)`
+)
+
+// TestFreezeExpenses freezes the expense entry of a trip, and checks the
+// expenses are refused until the freeze is over
+func TestFreezeExpenses(t *testing.T) {
+	ctx := context.Background()
+	fdb := openTestDB(t)
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Frozen", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tr.LoadFreeze(ctx, fdb); err != ErrNoFreeze {
+		t.Errorf("expected ErrNoFreeze, got %v", err)
+	}
+	if _, err = tr.FreezeExpenses(ctx, fdb, time.Time{}, start.Add(-time.Hour)); err == nil {
+		t.Error("expected a freeze over already to be refused")
+	}
+	until := start.Add(48 * time.Hour)
+	f, err := tr.FreezeExpenses(ctx, fdb, time.Time{}, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Active(Now()) || !f.Until.Equal(until) {
+		t.Errorf("Unexpected freeze %+v", f)
+	}
+
+	addDinner := func() error {
+		tr, err := LoadTripByID(ctx, fdb, tr.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tr.AddExpense(NewDate(start), "Dinner", []Participant{{Email: alice, Paid: 4000}, {Email: bob}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr.Save(ctx, fdb)
+	}
+	err = addDinner()
+	var fe *FreezeError
+	if !errors.As(err, &fe) || !errors.Is(err, ErrExpensesFrozen) || !fe.Until.Equal(until) {
+		t.Fatalf("expected a FreezeError until %v, got %v", until, err)
+	}
+	loaded, err := LoadTripByID(ctx, fdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Expenses) != 0 {
+		t.Errorf("expected no expense added, got %d", len(loaded.Expenses))
+	}
+	// the rest of the trip can still be changed
+	if err = loaded.SetDescription("Under review"); err != nil {
+		t.Fatal(err)
+	}
+	if err = loaded.Save(ctx, fdb); err != nil {
+		t.Errorf("expected the trip to stay open, got %v", err)
+	}
+
+	fc.Advance(48 * time.Hour)
+	if err = addDinner(); err != nil {
+		t.Errorf("expected the expense added after the freeze, got %v", err)
+	}
+
+	_, err = tr.FreezeExpenses(ctx, fdb, Now().Add(time.Hour), Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = addDinner(); err != nil {
+		t.Errorf("expected the expense added before the freeze, got %v", err)
+	}
+	err = tr.LiftFreeze(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.LiftFreeze(ctx, fdb); err != ErrNoFreeze {
+		t.Errorf("expected ErrNoFreeze lifting again, got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the friend groups: a user names the people they
+// travel with, e.g. "ski crew", to create their trips with the group rather
+// than typing the email addresses again every time.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	groupSelect = `SELECT g.group_id, g.name, g.created_at, g.updated_at
+FROM friend_group AS g, tuser AS u
+WHERE u.user_id = g.user_id AND u.email = ?`
+	groupByName      = "\nAND g.name = ?"
+	groupOrder       = "\nORDER BY g.name"
+	groupIDSelect    = "SELECT group_id, created_at FROM friend_group WHERE user_id = ? AND name = ?"
+	groupInsert      = "INSERT INTO friend_group (user_id, name, created_at, updated_at) VALUES (?, ?, ?, ?)"
+	groupTouch       = "UPDATE friend_group SET updated_at = ? WHERE group_id = ?"
+	groupDelete      = "DELETE FROM friend_group WHERE group_id = ?"
+	groupMemberClear = "DELETE FROM friend_group_member WHERE group_id = ?"
+	groupMemberAdd   = "INSERT INTO friend_group_member (group_id, user_id) VALUES (?, ?)"
+	groupMemberList  = `SELECT u.email FROM friend_group_member AS m, tuser AS u
+WHERE u.user_id = m.user_id AND m.group_id = ?
+ORDER BY u.email`
+)
+
+// ErrNoGroup is returned for a group the user doesn't have
+var ErrNoGroup = errors.New("no such group")
+
+// Group is a named group of people a user travels with
+type Group struct {
+	ID    int64  `json:"group_id"`
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	// Members are the email addresses of the people of the group, the
+	// owner left out
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// LoadGroups returns the groups of the user, by name, none for an unknown
+// user
+func LoadGroups(ctx context.Context, db *sql.DB, owner string) ([]*Group, error) {
+	owner = normalizeEmail(owner)
+	rows, err := db.QueryContext(ctx, groupSelect+groupOrder, owner)
+	if err != nil {
+		return nil, err
+	}
+	rslt := []*Group{}
+	for rows.Next() {
+		g, err := scanGroup(rows, owner)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rslt = append(rslt, g)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, g := range rslt {
+		err = g.loadMembers(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rslt, nil
+}
+
+// LoadGroup returns the group of the user by its name, ErrNoGroup if
+// there's none
+func LoadGroup(ctx context.Context, db *sql.DB, owner, name string) (*Group, error) {
+	owner = normalizeEmail(owner)
+	g, err := scanGroup(db.QueryRowContext(ctx, groupSelect+groupByName, owner, name), owner)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoGroup
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, g.loadMembers(ctx, db)
+}
+
+// scanGroup reads a group of the owner from a row, without its members
+func scanGroup(row interface{ Scan(...any) error }, owner string) (*Group, error) {
+	g := &Group{Owner: owner}
+	var createdAt, updatedAt int64
+	err := row.Scan(&g.ID, &g.Name, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	g.CreatedAt = time.UnixMicro(createdAt).UTC()
+	g.UpdatedAt = time.UnixMicro(updatedAt).UTC()
+	return g, nil
+}
+
+// loadMembers reads the email addresses of the members of the group
+func (g *Group) loadMembers(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, groupMemberList, g.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	g.Members = []string{}
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			return err
+		}
+		g.Members = append(g.Members, email)
+	}
+	return rows.Err()
+}
+
+// SaveGroup creates the group of the user, or replaces its members if it
+// exists. The users of the members are created if need be, the owner is
+// left out of the members.
+func SaveGroup(ctx context.Context, db *sql.DB, owner, name string, members []string) (*Group, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("the name of the group is required")
+	}
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Rollback()
+
+	usr, err := loadOrCreateUserTx(ctx, txn, owner)
+	if err != nil {
+		return nil, err
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	g := &Group{Owner: usr.Email, Name: name, UpdatedAt: now}
+	var createdAt int64
+	err = txn.QueryRowContext(ctx, groupIDSelect, usr.ID, name).Scan(&g.ID, &createdAt)
+	switch {
+	case err == sql.ErrNoRows:
+		g.CreatedAt = now
+		rslt, err := txn.ExecContext(ctx, groupInsert, usr.ID, name, g.CreatedAt.UnixMicro(), g.UpdatedAt.UnixMicro())
+		if err != nil {
+			return nil, err
+		}
+		g.ID, err = rslt.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		g.CreatedAt = time.UnixMicro(createdAt).UTC()
+		_, err = txn.ExecContext(ctx, groupTouch, g.UpdatedAt.UnixMicro(), g.ID)
+		if err != nil {
+			return nil, err
+		}
+		_, err = txn.ExecContext(ctx, groupMemberClear, g.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{usr.Email: true}
+	g.Members = []string{}
+	for _, email := range members {
+		email = normalizeEmail(email)
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		member, err := loadOrCreateUserTx(ctx, txn, email)
+		if err != nil {
+			return nil, err
+		}
+		_, err = txn.ExecContext(ctx, groupMemberAdd, g.ID, member.ID)
+		if err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, member.Email)
+	}
+	sort.Strings(g.Members)
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Saved group %q of %s with %d members\n", g.Name, g.Owner, len(g.Members))
+	return g, nil
+}
+
+// DeleteGroup deletes the group of the user, ErrNoGroup is returned if
+// there's none. The trips created with the group keep their participants.
+func DeleteGroup(ctx context.Context, db *sql.DB, owner, name string) error {
+	g, err := LoadGroup(ctx, db, owner, name)
+	if err != nil {
+		return err
+	}
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	_, err = txn.ExecContext(ctx, groupMemberClear, g.ID)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, groupDelete, g.ID)
+	if err != nil {
+		return err
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	Logf(ctx, "Deleted group %q of %s\n", g.Name, g.Owner)
+	return nil
+}
@@ -0,0 +1,86 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the friend groups.
+
+package trip
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	friendGroupCreate = `CREATE TABLE IF NOT EXISTS friend_group (
+group_id INTEGER CONSTRAINT friend_group_pkey PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER NOT NULL,
+name VARCHAR(128) NOT NULL,
+created_at INTEGER NOT NULL,
+updated_at INTEGER NOT NULL,
+CONSTRAINT friend_group_name_unique UNIQUE (user_id, name))`
+	friendGroupMemberCreate = `CREATE TABLE IF NOT EXISTS friend_group_member (
+group_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+CONSTRAINT friend_group_member_pkey PRIMARY KEY (group_id, user_id))`
+)
+
+// TestGroups saves a group, replaces its members, and deletes it
+func TestGroups(t *testing.T) {
+	ctx := context.Background()
+	gdb := openTestDB(t)
+
+	if _, err := LoadGroup(ctx, gdb, alice, "Ski crew"); err != ErrNoGroup {
+		t.Errorf("expected ErrNoGroup, got %v", err)
+	}
+	if _, err := SaveGroup(ctx, gdb, alice, " ", []string{bob}); err == nil {
+		t.Error("expected a group without a name to be refused")
+	}
+	g, err := SaveGroup(ctx, gdb, alice, "Ski crew", []string{"Charlie@Test.com", bob, alice, bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{bob, charlie}; !reflect.DeepEqual(g.Members, want) {
+		t.Errorf("expected the members %v, got %v", want, g.Members)
+	}
+	loaded, err := LoadGroup(ctx, gdb, alice, "Ski crew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != g.ID || !reflect.DeepEqual(loaded.Members, g.Members) {
+		t.Errorf("Unexpected group %+v", loaded)
+	}
+
+	g, err = SaveGroup(ctx, gdb, alice, "Ski crew", []string{david})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.ID != loaded.ID || !reflect.DeepEqual(g.Members, []string{david}) {
+		t.Errorf("expected the members replaced, got %+v", g)
+	}
+	_, err = SaveGroup(ctx, gdb, alice, "Beach", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups, err := LoadGroups(ctx, gdb, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 || groups[0].Name != "Beach" || len(groups[0].Members) != 0 || groups[1].Name != "Ski crew" {
+		t.Errorf("Unexpected groups %+v", groups)
+	}
+	if groups, err = LoadGroups(ctx, gdb, bob); err != nil || len(groups) != 0 {
+		t.Errorf("expected no group for bob, got %v, %v", groups, err)
+	}
+
+	err = DeleteGroup(ctx, gdb, alice, "Ski crew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteGroup(ctx, gdb, alice, "Ski crew"); err != ErrNoGroup {
+		t.Errorf("expected ErrNoGroup deleting again, got %v", err)
+	}
+}
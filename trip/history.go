@@ -0,0 +1,109 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit reconstructs a trip as it was at a point in time, for
+// resolving disputes about later edits. The expenses record when they
+// were entered, and the deleted ones are archived with when they were
+// deleted, so the expenses of a trip can be replayed up to any time.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	expenseArchive = `INSERT INTO expense_deleted (expense_id, trip_id, txn_date, created_at, deleted_at, description, notes)
+SELECT e.expense_id, e.trip_id, e.txn_date, e.created_at, ?, e.description, COALESCE(n.notes, '')
+FROM expense AS e LEFT JOIN expense_note AS n ON n.expense_id = e.expense_id
+WHERE e.expense_id = ? AND e.trip_id = ?`
+	participantArchive = `INSERT INTO expense_participant_deleted (expense_id, user_id, amount)
+SELECT expense_id, user_id, amount FROM expense_participant WHERE expense_id = ?`
+	deletedExpenseSelect = `SELECT e.expense_id, e.txn_date, e.created_at, e.description, e.notes,
+COALESCE(m.metadata, '')
+FROM expense_deleted AS e LEFT JOIN expense_metadata AS m ON m.expense_id = e.expense_id
+WHERE e.trip_id = ?
+AND e.created_at <= ?
+AND e.deleted_at > ?`
+	deletedParticipantSelect = `SELECT u.email, ep.user_id, ep.amount
+FROM expense_participant_deleted AS ep, tuser AS u
+WHERE ep.user_id = u.user_id
+AND ep.expense_id = ?`
+)
+
+// ErrPastTrip is returned when saving a trip loaded by LoadTripAsOf()
+var ErrPastTrip = errors.New("a past view of a trip can't be saved")
+
+// archiveExpense copies the expense, before it's deleted at now, to the
+// archive read by LoadTripAsOf(). It's expected to be executed within the
+// transaction deleting the expense.
+func (trip *Trip) archiveExpense(ctx context.Context, txn *sql.Tx, expenseID int64, now time.Time) error {
+	_, err := txn.ExecContext(ctx, expenseArchive, now.UnixMicro(), expenseID, trip.ID)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, participantArchive, expenseID)
+	return err
+}
+
+// LoadTripAsOf loads a trip with the expenses it had at the given time:
+// those entered by then, including the ones deleted since. A trip
+// completed since is seen as active. The name, description, start date
+// and participants aren't versioned, they're the current ones.
+// sql.ErrNoRows is returned if the trip didn't exist yet. The trip can't
+// be saved, see ErrPastTrip.
+func LoadTripAsOf(ctx context.Context, db *sql.DB, tripID int64, asOf time.Time) (*Trip, error) {
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return nil, err
+	}
+	if trip.createdAt.After(asOf) {
+		return nil, sql.ErrNoRows
+	}
+	if trip.EndDate.After(asOf) {
+		trip.EndDate = time.Unix(0, 0).UTC()
+	}
+
+	expenses := trip.Expenses[:0]
+	for _, e := range trip.Expenses {
+		if !e.createdAt.After(asOf) {
+			expenses = append(expenses, e)
+		}
+	}
+	deleted, err := queryExpensesFrom(ctx, db, deletedParticipantSelect, deletedExpenseSelect,
+		tripID, asOf.UnixMicro(), asOf.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	expenses = append(expenses, deleted...)
+	sort.SliceStable(expenses, func(i, j int) bool {
+		if expenses[i].createdAt.Equal(expenses[j].createdAt) {
+			return expenses[i].ID < expenses[j].ID
+		}
+		return expenses[i].createdAt.Before(expenses[j].createdAt)
+	})
+
+	trip.Expenses = expenses
+	trip.totalExpense = 0
+	for _, e := range expenses {
+		trip.totalExpense += e.amount
+	}
+	trip.asOf = asOf
+	return trip, nil
+}
+
+// SettlementAsOf returns the Settlement of a trip as it stood at the given
+// time, see LoadTripAsOf()
+func SettlementAsOf(ctx context.Context, db *sql.DB, tripID int64, asOf time.Time) (Settlement, error) {
+	trip, err := LoadTripAsOf(ctx, db, tripID, asOf)
+	if err != nil {
+		return nil, err
+	}
+	return trip.Settlement()
+}
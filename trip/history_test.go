@@ -0,0 +1,119 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the unit tests of the past views of the trips.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	expenseDeletedCreate = `CREATE TABLE IF NOT EXISTS expense_deleted (
+expense_id INTEGER CONSTRAINT expense_deleted_pkey PRIMARY KEY,
+trip_id INTEGER NOT NULL,
+txn_date INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+deleted_at INTEGER NOT NULL,
+description VARCHAR(512),
+notes TEXT NOT NULL DEFAULT '')`
+	expenseDeletedTripIndex         = "CREATE INDEX IF NOT EXISTS expense_deleted_trip_index ON expense_deleted(trip_id)"
+	expenseParticipantDeletedCreate = `CREATE TABLE IF NOT EXISTS expense_participant_deleted (
+expense_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+CONSTRAINT expense_participant_deleted_pkey PRIMARY KEY (expense_id, user_id))`
+)
+
+// TestLoadTripAsOf replays the expenses of a trip at different times
+func TestLoadTripAsOf(t *testing.T) {
+	ctx := context.Background()
+	hdb := openTestDB(t)
+	start := time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	// the trip is created at start, then an expense is added every day
+	tr := NewTrip("Time travel", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, hdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	amounts := []int{1000, 3000, 5000}
+	for _, amount := range amounts {
+		fc.Advance(24 * time.Hour)
+		err = tr.AddExpense(NewDate(start), "expense", []Participant{{alice, 0, amount}, {bob, 0, 0}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tr.Save(ctx, hdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// early on the 5th day, the 2nd expense is deleted
+	fc.Advance(48 * time.Hour)
+	_, err = UpdateTrip(ctx, hdb, tr.ID, func(tr *Trip) error {
+		return tr.RemoveExpense(tr.Expenses[1].ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		day  int
+		want []int
+	}{
+		{0, []int{}},
+		{1, []int{1000}},
+		{3, []int{1000, 3000, 5000}},
+		{4, []int{1000, 3000, 5000}},
+		{5, []int{1000, 5000}},
+	}
+	for _, tt := range tests {
+		asOf := start.Add(time.Duration(tt.day)*24*time.Hour + time.Hour)
+		past, err := LoadTripAsOf(ctx, hdb, tr.ID, asOf)
+		if err != nil {
+			t.Fatalf("LoadTripAsOf(day %d) failed: %v", tt.day, err)
+		}
+		var got []int
+		for _, e := range past.Expenses {
+			got = append(got, e.amount)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Expect %v on day %d, got %v", tt.want, tt.day, got)
+			continue
+		}
+		total := 0
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Expect %v on day %d, got %v", tt.want, tt.day, got)
+				break
+			}
+			total += got[i]
+		}
+		if want := total / 2; len(got) > 0 && past.Settle()[bob][alice] != want {
+			t.Errorf("Expect bob to owe alice %d on day %d: %v", want, tt.day, past.Settle())
+		}
+	}
+
+	_, err = LoadTripAsOf(ctx, hdb, tr.ID, start.Add(-time.Hour))
+	if err != sql.ErrNoRows {
+		t.Errorf("Expect sql.ErrNoRows before the trip was created, got %v", err)
+	}
+	past, err := LoadTripAsOf(ctx, hdb, tr.ID, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = past.Save(ctx, hdb)
+	if err != ErrPastTrip {
+		t.Errorf("Expect ErrPastTrip saving a past view, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the households of a trip, e.g. couples or families
+// sharing their money. The people of a household are settled together:
+// their settlement is netted within the household first, leaving only the
+// transfers between households, see ByHousehold().
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Some global constants used to store SQL statements
+const (
+	householdSelect = `SELECT u.email, h.household
+FROM household_member AS h, tuser AS u
+WHERE h.user_id = u.user_id
+AND h.trip_id = ?`
+	householdInsert = "INSERT INTO household_member (trip_id, user_id, household) VALUES (?, ?, ?)"
+	householdDelete = "DELETE FROM household_member WHERE trip_id = ?"
+)
+
+// maxHousehold is the maximum length of the name of a household
+const maxHousehold = 64
+
+// LoadHouseholds returns the households of the people of a trip, by email
+// address, the ones without a household are left out
+func LoadHouseholds(ctx context.Context, db *sql.DB, tripID int64) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, householdSelect, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := make(map[string]string)
+	for rows.Next() {
+		var email, household string
+		err = rows.Scan(&email, &household)
+		if err != nil {
+			return nil, err
+		}
+		rslt[email] = household
+	}
+	return rslt, rows.Err()
+}
+
+// SetHouseholds replaces the households of the people of the trip, by
+// email address, an empty name leaving a person out of any household. The
+// people must be part of the trip, and the names of the households can't
+// be email addresses. They're written to the database by Save().
+func (trip *Trip) SetHouseholds(households map[string]string) error {
+	rslt := make(map[string]string, len(households))
+	for email, household := range households {
+		email = normalizeEmail(email)
+		if !trip.IsParticipant(email) {
+			return fmt.Errorf("'%s' is not part of the trip", email)
+		}
+		household = strings.TrimSpace(household)
+		switch {
+		case household == "":
+			continue
+		case len(household) > maxHousehold:
+			return fmt.Errorf("the name of household '%s' is longer than %d", household, maxHousehold)
+		case strings.Contains(household, "@"):
+			return fmt.Errorf("the name of household '%s' can't be an email address", household)
+		}
+		rslt[email] = household
+	}
+	trip.Households = rslt
+	trip.householdsChanged = true
+	return nil
+}
+
+// dropHousehold removes a user leaving the trip from their household
+func (trip *Trip) dropHousehold(email string) {
+	if _, ok := trip.Households[email]; ok {
+		delete(trip.Households, email)
+		trip.householdsChanged = true
+	}
+}
+
+// saveHouseholds replaces the households in the database
+// It's expected to be executed within a transaction
+func (trip *Trip) saveHouseholds(ctx context.Context, txn *sql.Tx) error {
+	_, err := txn.ExecContext(ctx, householdDelete, trip.ID)
+	if err != nil {
+		return err
+	}
+	for email, household := range trip.Households {
+		_, err = txn.ExecContext(ctx, householdInsert, trip.ID, trip.emailLookup[email], household)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ByHousehold returns the Settlement between the households, keyed by
+// their names, the people without a household standing for themselves,
+// keyed by their email addresses. The payments within a household are
+// dropped, and each household pays or receives its net balance, with as
+// few transfers as the largest debts matched to the largest credits first
+// make. The forbidden transfers aren't considered between households.
+func (s Settlement) ByHousehold(households map[string]string) Settlement {
+	group := func(email string) string {
+		if household, ok := households[email]; ok {
+			return household
+		}
+		return email
+	}
+	net := make(map[string]int)
+	for payer, payments := range s {
+		for payee, amount := range payments {
+			net[group(payer)] -= amount
+			net[group(payee)] += amount
+		}
+	}
+	var debtors, creditors []string
+	for g, amount := range net {
+		switch {
+		case amount < 0:
+			debtors = append(debtors, g)
+		case amount > 0:
+			creditors = append(creditors, g)
+		}
+	}
+	// the largest amounts first, by name on a tie, so that the transfers
+	// don't depend on the map order
+	byAmount := func(groups []string, sign int) {
+		sort.Slice(groups, func(i, j int) bool {
+			if net[groups[i]] != net[groups[j]] {
+				return sign*net[groups[i]] > sign*net[groups[j]]
+			}
+			return groups[i] < groups[j]
+		})
+	}
+	byAmount(debtors, -1)
+	byAmount(creditors, 1)
+
+	rslt := make(Settlement)
+	for i, j := 0, 0; i < len(debtors) && j < len(creditors); {
+		payer, payee := debtors[i], creditors[j]
+		amount := min(-net[payer], net[payee])
+		if rslt[payer] == nil {
+			rslt[payer] = make(Payments)
+		}
+		rslt[payer][payee] = amount
+		net[payer] += amount
+		net[payee] -= amount
+		if net[payer] == 0 {
+			i++
+		}
+		if net[payee] == 0 {
+			j++
+		}
+	}
+	return rslt
+}
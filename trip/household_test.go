@@ -0,0 +1,105 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the households of the trips.
+
+package trip
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	householdMemberCreate = `CREATE TABLE IF NOT EXISTS household_member (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+household VARCHAR(64) NOT NULL,
+CONSTRAINT household_member_pkey PRIMARY KEY (trip_id, user_id))`
+)
+
+// TestByHousehold checks the settlement is netted within the households
+func TestByHousehold(t *testing.T) {
+	// alice and bob, then charlie and david, are couples: only elise is
+	// left to pay them
+	s := Settlement{
+		bob:     {alice: 3000},
+		charlie: {alice: 1000, david: 500},
+		elise:   {david: 2000},
+	}
+	got := s.ByHousehold(map[string]string{alice: "A", bob: "A", charlie: "C", david: "C"})
+	want := Settlement{elise: {"A": 1000, "C": 1000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	// without households, the net balances are still settled
+	got = s.ByHousehold(nil)
+	want = Settlement{bob: {alice: 3000}, elise: {alice: 1000, david: 1000}, charlie: {david: 1500}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	// a household settling within only has nothing to transfer
+	got = Settlement{bob: {alice: 3000}}.ByHousehold(map[string]string{alice: "A", bob: "A"})
+	if len(got) != 0 {
+		t.Errorf("expected no transfer, got %v", got)
+	}
+}
+
+// TestHouseholds saves the households of a trip and reads them back
+func TestHouseholds(t *testing.T) {
+	ctx := context.Background()
+	hdb := openTestDB(t)
+	tr := NewTrip("Families", alice, "", NewDate(time.Now()), []string{bob, charlie, david})
+	err := tr.Save(ctx, hdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, households := range []map[string]string{
+		{elise: "E"},
+		{bob: "bob@smith.com"},
+		{bob: "a very long name of a household which goes on and on and on and on"},
+	} {
+		err = tr.SetHouseholds(households)
+		if err == nil {
+			t.Errorf("expected an error for %v", households)
+		}
+	}
+	err = tr.SetHouseholds(map[string]string{"Alice@test.com": " Smith ", bob: "Smith", charlie: "", david: "Jones"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, hdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{alice: "Smith", bob: "Smith", david: "Jones"}
+	loaded, err := LoadTripByID(ctx, hdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.Households, want) {
+		t.Errorf("expected %v, got %v", want, loaded.Households)
+	}
+
+	err = loaded.RemoveParticipant(david)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loaded.Save(ctx, hdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	households, err := LoadHouseholds(ctx, hdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(want, david)
+	if !reflect.DeepEqual(households, want) {
+		t.Errorf("expected %v once david left, got %v", want, households)
+	}
+}
@@ -0,0 +1,244 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the verification of the requests of the inbound
+// integrations, e.g. the commands of Slack, the emails routed by Mailgun
+// or the updates of a Telegram bot, shared by their connectors: the
+// signature of a request, the age of its timestamp, and its nonce, for a
+// captured request not to be replayed.
+
+package trip
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInboundSignature is returned for an inbound request whose
+	// signature is missing or doesn't match
+	ErrInboundSignature = errors.New("invalid signature of the inbound request")
+	// ErrInboundStale is returned for an inbound request signed too long
+	// ago, or in the future
+	ErrInboundStale = errors.New("the timestamp of the inbound request is out of tolerance")
+	// ErrInboundReplay is returned for an inbound request already received
+	ErrInboundReplay = errors.New("the inbound request was already received")
+)
+
+const (
+	// inboundTolerance is the default difference allowed between the
+	// timestamp of an inbound request and the clock
+	inboundTolerance = 5 * time.Minute
+	// nonceSweep is the number of nonces remembered beyond which the
+	// expired ones are forgotten
+	nonceSweep = 10000
+	// inboundFormMemory is the memory parsing the multipart forms, the
+	// rest going to temporary files
+	inboundFormMemory = 1 << 20
+)
+
+// Inbound is what the signature of an inbound request vouches for
+type Inbound struct {
+	// Timestamp is when the request was signed, the zero time if the
+	// integration doesn't sign one
+	Timestamp time.Time
+	// Nonce identifies the request, e.g. its signature, for it not to be
+	// received twice, empty if there's none
+	Nonce string
+}
+
+// InboundVerifier verifies the signature of the requests of an
+// integration, with their body, and returns what it vouches for.
+// ErrInboundSignature is returned if it doesn't match.
+type InboundVerifier interface {
+	Verify(header http.Header, body []byte) (Inbound, error)
+}
+
+// SlackVerifier verifies the requests of Slack, with the signing secret of
+// the app
+type SlackVerifier struct {
+	SigningSecret string
+}
+
+// Verify checks the header X-Slack-Signature, "v0=" and the HMAC-SHA256 of
+// "v0:", the header X-Slack-Request-Timestamp, ":" and the body
+func (v SlackVerifier) Verify(header http.Header, body []byte) (Inbound, error) {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sig := header.Get("X-Slack-Signature")
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return Inbound{}, ErrInboundSignature
+	}
+	mac := hmac.New(sha256.New, []byte(v.SigningSecret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	if !hmac.Equal([]byte(sig), []byte("v0="+hex.EncodeToString(mac.Sum(nil)))) {
+		return Inbound{}, ErrInboundSignature
+	}
+	return Inbound{Timestamp: time.Unix(secs, 0), Nonce: sig}, nil
+}
+
+// MailgunVerifier verifies the requests of Mailgun, with the webhook
+// signing key of the account
+type MailgunVerifier struct {
+	SigningKey string
+}
+
+// Verify checks the signature, the HMAC-SHA256 of the timestamp and the
+// token, found in the fields of the forms of the routes, or in the
+// signature object of the JSON of the webhooks. The token is the nonce.
+func (v MailgunVerifier) Verify(header http.Header, body []byte) (Inbound, error) {
+	var s struct {
+		Timestamp string `json:"timestamp"`
+		Token     string `json:"token"`
+		Signature string `json:"signature"`
+	}
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		var doc struct {
+			Signature *struct {
+				Timestamp string `json:"timestamp"`
+				Token     string `json:"token"`
+				Signature string `json:"signature"`
+			} `json:"signature"`
+		}
+		if json.Unmarshal(body, &doc) != nil || doc.Signature == nil {
+			return Inbound{}, ErrInboundSignature
+		}
+		s = *doc.Signature
+	case "multipart/form-data":
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(inboundFormMemory)
+		if err != nil {
+			return Inbound{}, ErrInboundSignature
+		}
+		defer form.RemoveAll()
+		get := func(k string) string {
+			if vs := form.Value[k]; len(vs) > 0 {
+				return vs[0]
+			}
+			return ""
+		}
+		s.Timestamp, s.Token, s.Signature = get("timestamp"), get("token"), get("signature")
+	default:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return Inbound{}, ErrInboundSignature
+		}
+		s.Timestamp, s.Token, s.Signature = values.Get("timestamp"), values.Get("token"), values.Get("signature")
+	}
+	secs, err := strconv.ParseInt(s.Timestamp, 10, 64)
+	if err != nil || s.Token == "" || s.Signature == "" {
+		return Inbound{}, ErrInboundSignature
+	}
+	mac := hmac.New(sha256.New, []byte(v.SigningKey))
+	mac.Write([]byte(s.Timestamp + s.Token))
+	if !hmac.Equal([]byte(s.Signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return Inbound{}, ErrInboundSignature
+	}
+	return Inbound{Timestamp: time.Unix(secs, 0), Nonce: s.Token}, nil
+}
+
+// TelegramVerifier verifies the updates of a Telegram bot, with the secret
+// token given to setWebhook
+type TelegramVerifier struct {
+	SecretToken string
+}
+
+// Verify checks the header X-Telegram-Bot-Api-Secret-Token. Telegram
+// doesn't sign a timestamp, the update_id of the update is the nonce.
+func (v TelegramVerifier) Verify(header http.Header, body []byte) (Inbound, error) {
+	secret := header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(v.SecretToken)) != 1 {
+		return Inbound{}, ErrInboundSignature
+	}
+	var update struct {
+		UpdateID *int64 `json:"update_id"`
+	}
+	if json.Unmarshal(body, &update) != nil || update.UpdateID == nil {
+		return Inbound{}, ErrInboundSignature
+	}
+	return Inbound{Nonce: strconv.FormatInt(*update.UpdateID, 10)}, nil
+}
+
+// NonceCache remembers the nonces of the inbound requests, by integration,
+// until they expire. It's kept in memory, the instance being a single
+// process. It's safe for concurrent use.
+type NonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewNonceCache returns an empty NonceCache
+func NewNonceCache() *NonceCache {
+	return &NonceCache{seen: make(map[string]time.Time)}
+}
+
+// Seen records the nonce of the source until the expiry, and tells whether
+// it was already recorded, and not expired
+func (nc *NonceCache) Seen(source, nonce string, expiry time.Time) bool {
+	now := Now()
+	key := source + "\x00" + nonce
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if until, ok := nc.seen[key]; ok && now.Before(until) {
+		return true
+	}
+	if len(nc.seen) > nonceSweep {
+		for k, until := range nc.seen {
+			if !now.Before(until) {
+				delete(nc.seen, k)
+			}
+		}
+	}
+	nc.seen[key] = expiry
+	return false
+}
+
+// InboundGuard guards the requests of an inbound integration
+type InboundGuard struct {
+	// Source names the integration, e.g. slack, keying its nonces
+	Source   string
+	Verifier InboundVerifier
+	// Tolerance is the difference allowed between the timestamp of a
+	// request and the clock, inboundTolerance if 0
+	Tolerance time.Duration
+	Nonces    *NonceCache
+}
+
+// Check verifies the request of its body: its signature, the age of its
+// timestamp, if any, and that its nonce, if any, wasn't received within
+// twice the tolerance, the window of the timestamps accepted.
+// ErrInboundSignature, ErrInboundStale or ErrInboundReplay is returned if
+// the request isn't to be handled.
+func (g *InboundGuard) Check(header http.Header, body []byte) error {
+	in, err := g.Verifier.Verify(header, body)
+	if err != nil {
+		return err
+	}
+	tolerance := g.Tolerance
+	if tolerance <= 0 {
+		tolerance = inboundTolerance
+	}
+	now := Now()
+	if !in.Timestamp.IsZero() && (in.Timestamp.Before(now.Add(-tolerance)) || in.Timestamp.After(now.Add(tolerance))) {
+		return ErrInboundStale
+	}
+	if in.Nonce != "" && g.Nonces.Seen(g.Source, in.Nonce, now.Add(2*tolerance)) {
+		return ErrInboundReplay
+	}
+	return nil
+}
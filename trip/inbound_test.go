@@ -0,0 +1,153 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the verification of the inbound
+// requests.
+
+package trip
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// hmacHex returns the hex encoded HMAC-SHA256 of the message
+func hmacHex(key, msg string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TestInboundSlack checks the signature, the tolerance and the replays of
+// the requests of Slack
+func TestInboundSlack(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, 0)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	g := &InboundGuard{Source: "slack", Verifier: SlackVerifier{SigningSecret: "secret"}, Nonces: NewNonceCache()}
+	body := []byte("command=%2Fsettle&text=lisbon")
+	signed := func(ts time.Time, key string) http.Header {
+		h := http.Header{}
+		secs := strconv.FormatInt(ts.Unix(), 10)
+		h.Set("X-Slack-Request-Timestamp", secs)
+		h.Set("X-Slack-Signature", "v0="+hmacHex(key, "v0:"+secs+":"+string(body)))
+		return h
+	}
+
+	if err := g.Check(signed(start, "secret"), body); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check(signed(start, "secret"), body); err != ErrInboundReplay {
+		t.Errorf("expected ErrInboundReplay, got %v", err)
+	}
+	if err := g.Check(signed(start.Add(time.Second), "other"), body); err != ErrInboundSignature {
+		t.Errorf("expected ErrInboundSignature for another key, got %v", err)
+	}
+	if err := g.Check(http.Header{}, body); err != ErrInboundSignature {
+		t.Errorf("expected ErrInboundSignature without the headers, got %v", err)
+	}
+	for _, ts := range []time.Time{start.Add(-6 * time.Minute), start.Add(6 * time.Minute)} {
+		if err := g.Check(signed(ts, "secret"), body); err != ErrInboundStale {
+			t.Errorf("expected ErrInboundStale at %v, got %v", ts, err)
+		}
+	}
+	// the same nonce of another integration isn't a replay
+	other := &InboundGuard{Source: "slack-2", Verifier: SlackVerifier{SigningSecret: "secret"}, Nonces: g.Nonces}
+	if err := other.Check(signed(start, "secret"), body); err != nil {
+		t.Errorf("expected the request of another integration accepted, got %v", err)
+	}
+}
+
+// TestInboundMailgun checks the signatures of Mailgun, in the forms of the
+// routes and the JSON of the webhooks
+func TestInboundMailgun(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, 0)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	g := &InboundGuard{Source: "mailgun", Verifier: MailgunVerifier{SigningKey: "key"}, Nonces: NewNonceCache()}
+	ts := strconv.FormatInt(start.Unix(), 10)
+
+	form := url.Values{"timestamp": {ts}, "token": {"tok-1"}, "signature": {hmacHex("key", ts+"tok-1")}, "subject": {"Dinner"}}
+	h := http.Header{}
+	h.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := g.Check(h, []byte(form.Encode())); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check(h, []byte(form.Encode())); err != ErrInboundReplay {
+		t.Errorf("expected ErrInboundReplay, got %v", err)
+	}
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	w.WriteField("timestamp", ts)
+	w.WriteField("token", "tok-2")
+	w.WriteField("signature", hmacHex("key", ts+"tok-2"))
+	w.Close()
+	h.Set("Content-Type", w.FormDataContentType())
+	if err := g.Check(h, b.Bytes()); err != nil {
+		t.Errorf("expected the multipart form accepted, got %v", err)
+	}
+
+	h.Set("Content-Type", "application/json")
+	doc := `{"signature":{"timestamp":"` + ts + `","token":"tok-3","signature":"` + hmacHex("key", ts+"tok-3") + `"},"event-data":{}}`
+	if err := g.Check(h, []byte(doc)); err != nil {
+		t.Errorf("expected the JSON accepted, got %v", err)
+	}
+	if err := g.Check(h, []byte(`{"event-data":{}}`)); err != ErrInboundSignature {
+		t.Errorf("expected ErrInboundSignature without the signature, got %v", err)
+	}
+}
+
+// TestInboundTelegram checks the secret token and the replays of the
+// updates of Telegram
+func TestInboundTelegram(t *testing.T) {
+	g := &InboundGuard{Source: "telegram", Verifier: TelegramVerifier{SecretToken: "secret"}, Nonces: NewNonceCache()}
+	h := http.Header{}
+	h.Set("X-Telegram-Bot-Api-Secret-Token", "secret")
+	if err := g.Check(h, []byte(`{"update_id":42,"message":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check(h, []byte(`{"update_id":42,"message":{}}`)); err != ErrInboundReplay {
+		t.Errorf("expected ErrInboundReplay, got %v", err)
+	}
+	if err := g.Check(h, []byte(`{"message":{}}`)); err != ErrInboundSignature {
+		t.Errorf("expected ErrInboundSignature without update_id, got %v", err)
+	}
+	h.Set("X-Telegram-Bot-Api-Secret-Token", "guess")
+	if err := g.Check(h, []byte(`{"update_id":43}`)); err != ErrInboundSignature {
+		t.Errorf("expected ErrInboundSignature for a bad secret, got %v", err)
+	}
+}
+
+// TestNonceCache checks the nonces expire
+func TestNonceCache(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, 0)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	nc := NewNonceCache()
+	if nc.Seen("slack", "n", start.Add(time.Minute)) {
+		t.Error("expected a new nonce")
+	}
+	if !nc.Seen("slack", "n", start.Add(time.Minute)) {
+		t.Error("expected the nonce seen")
+	}
+	fc.Advance(time.Minute)
+	if nc.Seen("slack", "n", start.Add(2*time.Minute)) {
+		t.Error("expected the nonce expired")
+	}
+}
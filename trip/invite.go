@@ -0,0 +1,165 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the invites to join a trip. An invite is a token
+// signed with the key of the sessions, see SetSessionKey(), telling the
+// trip until it expires: nothing is stored, and whoever holds it joins the
+// trip as a participant, see JoinTrip(). An invite addressed to a user, e.g.
+// mailed to them, can only be used by that user.
+
+package trip
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidInvite is returned for a token which isn't an invite signed
+	// with the key of the server
+	ErrInvalidInvite = errors.New("invalid invite token")
+	// ErrTripCompleted is returned when joining a trip completed already
+	ErrTripCompleted = errors.New("the trip is completed")
+	// ErrInviteAddressed is returned when joining with an invite addressed
+	// to another user
+	ErrInviteAddressed = errors.New("the invite is addressed to another user")
+)
+
+// inviteHeader is the encoded header of the invites, distinct from the one
+// of the sessions so that neither token is ever taken for the other
+var inviteHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"invite"}`))
+
+// Invite is an invite to join a trip
+type Invite struct {
+	TripID int64 `json:"trip_id"`
+	// Email is the user the invite is addressed to, anyone if empty
+	Email string `json:"email,omitempty"`
+	// Token is the token to join the trip with
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// inviteClaims are the claims of the token of an Invite
+type inviteClaims struct {
+	Issuer    string `json:"iss"`
+	TripID    int64  `json:"trip"`
+	Subject   string `json:"sub,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// IssueInvite returns an invite to join the trip, valid for the given
+// duration, addressed to the user of the email address unless empty.
+// ErrTripCompleted is returned if the trip is completed.
+func (trip *Trip) IssueInvite(ctx context.Context, email string, ttl time.Duration) (*Invite, error) {
+	if !SessionsEnabled() {
+		return nil, errors.New("sessions aren't enabled")
+	}
+	if !isUnset(trip.EndDate) {
+		return nil, ErrTripCompleted
+	}
+	now := Now().UTC().Truncate(time.Second)
+	inv := &Invite{TripID: trip.ID, ExpiresAt: now.Add(ttl)}
+	if email != "" {
+		inv.Email = normalizeEmail(email)
+	}
+	payload, err := json.Marshal(inviteClaims{
+		Issuer:    sessionIssuer,
+		TripID:    inv.TripID,
+		Subject:   inv.Email,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: inv.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signed := inviteHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	inv.Token = signed + "." + signSession(signed)
+	if inv.Email != "" {
+		Logf(ctx, "Issued an invite to trip %d for %s, expiring at %s\n", inv.TripID, inv.Email, inv.ExpiresAt.Format(time.RFC3339))
+	} else {
+		Logf(ctx, "Issued an invite to trip %d, expiring at %s\n", inv.TripID, inv.ExpiresAt.Format(time.RFC3339))
+	}
+	return inv, nil
+}
+
+// ParseInvite returns the invite of the token, ErrInvalidInvite if it isn't
+// one signed with the key of the server, ErrTokenExpired if it has expired
+func ParseInvite(token string) (*Invite, error) {
+	if !SessionsEnabled() {
+		return nil, ErrInvalidInvite
+	}
+	header, rest, _ := strings.Cut(token, ".")
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || header != inviteHeader ||
+		!hmac.Equal([]byte(signature), []byte(signSession(header+"."+payload))) {
+		return nil, ErrInvalidInvite
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+	var claims inviteClaims
+	err = json.Unmarshal(raw, &claims)
+	if err != nil || claims.Issuer != sessionIssuer || claims.TripID == 0 {
+		return nil, ErrInvalidInvite
+	}
+	inv := &Invite{TripID: claims.TripID, Email: claims.Subject, Token: token, ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC()}
+	if !Now().Before(inv.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return inv, nil
+}
+
+// JoinTrip adds the user of the email address, the one the invite is
+// addressed to if empty, to the trip of the invite, as a participant who
+// accepted it. A participant yet to accept, or who declined, accepts. The
+// trip is returned unchanged if they had accepted already, or are its
+// owner. sql.ErrNoRows is returned if the trip doesn't exist anymore,
+// ErrTripCompleted if it's completed, ErrInviteAddressed if the invite is
+// addressed to another user, and the errors of ParseInvite() for the token.
+func JoinTrip(ctx context.Context, db *sql.DB, token, email string) (*Trip, error) {
+	inv, err := ParseInvite(token)
+	if err != nil {
+		return nil, err
+	}
+	email = normalizeEmail(email)
+	switch {
+	case email == "" && inv.Email == "":
+		return nil, errors.New("the email address of the user joining is required")
+	case email == "":
+		email = inv.Email
+	case inv.Email != "" && email != inv.Email:
+		return nil, ErrInviteAddressed
+	}
+	trip, err := LoadTripByID(ctx, db, inv.TripID)
+	if err != nil || trip.Owner.Email == email || (trip.IsParticipant(email) && trip.rsvp(email) == RSVPAccepted) {
+		return trip, err
+	}
+	trip, err = UpdateTrip(ctx, db, inv.TripID, func(trip *Trip) error {
+		if !isUnset(trip.EndDate) {
+			return ErrTripCompleted
+		}
+		if trip.IsParticipant(email) {
+			return trip.SetRSVP(email, RSVPAccepted)
+		}
+		err := trip.AddParticipant(email)
+		if err != nil {
+			return err
+		}
+		trip.setRSVP(email, RSVPAccepted)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "%s joined trip %d with an invite\n", email, trip.ID)
+	return trip, nil
+}
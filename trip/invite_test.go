@@ -0,0 +1,109 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the invites to join a trip.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestJoinTrip invites to join a trip, and joins it until the invite
+// expires
+func TestJoinTrip(t *testing.T) {
+	ctx := context.Background()
+	idb := openTestDB(t)
+	clock := NewFakeClock(time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC), time.Second)
+	SetClock(clock.Now)
+	SetSessionKey([]byte("test key"))
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetSessionKey(nil)
+	})
+
+	tr := NewTrip("Invited", alice, "", NewDate(Now()), []string{bob})
+	err := tr.Save(ctx, idb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := tr.IssueInvite(ctx, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseSession(inv.Token)
+	if err != ErrInvalidSession {
+		t.Errorf("expected the invite not to be a session, got %v", err)
+	}
+
+	joined, err := JoinTrip(ctx, idb, inv.Token, "Charlie@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !joined.IsParticipant(charlie) || joined.rsvp(charlie) != RSVPAccepted {
+		t.Errorf("expected charlie to have joined, got %+v", joined.Participants)
+	}
+	// joining again doesn't change the trip
+	again, err := JoinTrip(ctx, idb, inv.Token, charlie)
+	if err != nil || again.ETag() != joined.ETag() {
+		t.Errorf("expected the trip unchanged, got %v: %v", again.ETag(), err)
+	}
+
+	_, err = JoinTrip(ctx, idb, inv.Token+"x", david)
+	if err != ErrInvalidInvite {
+		t.Errorf("expected ErrInvalidInvite for a tampered invite, got %v", err)
+	}
+	session, _, err := IssueSession(&User{ID: 1, Email: alice}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = JoinTrip(ctx, idb, session, david)
+	if err != ErrInvalidInvite {
+		t.Errorf("expected ErrInvalidInvite for a session, got %v", err)
+	}
+
+	// an invite addressed to bob, who has yet to accept, is for him only
+	addressed, err := tr.IssueInvite(ctx, "Bob@test.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = JoinTrip(ctx, idb, addressed.Token, david)
+	if err != ErrInviteAddressed {
+		t.Errorf("expected ErrInviteAddressed, got %v", err)
+	}
+	joined, err = JoinTrip(ctx, idb, addressed.Token, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined.rsvp(bob) != RSVPAccepted {
+		t.Errorf("expected bob to have accepted, got %s", joined.rsvp(bob))
+	}
+
+	clock.Advance(time.Hour)
+	_, err = JoinTrip(ctx, idb, inv.Token, david)
+	if err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+
+	inv, err = tr.IssueInvite(ctx, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Complete(ctx, idb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = JoinTrip(ctx, idb, inv.Token, david)
+	if err != ErrTripCompleted {
+		t.Errorf("expected ErrTripCompleted, got %v", err)
+	}
+	_, err = tr.IssueInvite(ctx, "", time.Hour)
+	if err != ErrTripCompleted {
+		t.Errorf("expected ErrTripCompleted inviting to a completed trip, got %v", err)
+	}
+}
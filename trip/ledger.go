@@ -0,0 +1,149 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the running ledger of a user across all their
+// trips: what remains to be paid of the settlements, netted by the other
+// person, so that recurring travel buddies see where they stand overall
+// rather than trip by trip.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	ledgerTripsSelect = `SELECT t.trip_id, t.name
+FROM trip AS t, participant AS p, tuser AS u
+WHERE u.user_id = p.user_id
+AND p.trip_id = t.trip_id
+AND t.deleted_at = 0
+AND u.email = ?
+ORDER BY t.trip_id`
+)
+
+// LedgerTrip is what remains to be paid between two people in a trip
+type LedgerTrip struct {
+	TripID   int64  `json:"trip_id"`
+	TripName string `json:"trip_name"`
+	// Amount is in cent, positive if the other person owes the user,
+	// negative if the user owes them
+	Amount int `json:"amount"`
+}
+
+// LedgerBalance is where the user stands with another person across
+// their trips
+type LedgerBalance struct {
+	// Email is the other person
+	Email string `json:"user"`
+	// Amount is the net of the trips in cent, positive if the other person
+	// owes the user, negative if the user owes them
+	Amount int `json:"amount"`
+	// Trips are the trips with something remaining to be paid between them
+	Trips []LedgerTrip `json:"trips"`
+}
+
+// Ledger is what remains to be paid of the settlements of the trips of a
+// user, netted by the other person
+type Ledger struct {
+	Email string `json:"user"`
+	// Owed is the total owed to the user, and Owes the total the user
+	// owes, both in cent after the netting
+	Owed int `json:"owed"`
+	Owes int `json:"owes"`
+	// Balances are by the email address of the other person, the ones
+	// netting to nothing left out
+	Balances []LedgerBalance `json:"balances"`
+	// Infeasible are the trips left out as their settlement can't avoid
+	// their forbidden transfers
+	Infeasible []int64 `json:"infeasible,omitempty"`
+}
+
+// LoadLedger returns the ledger of the user across all the trips they're
+// part of, completed and archived ones included: their settlements less
+// the payments recorded, netted by the other person. A user without trips
+// has an empty ledger.
+func LoadLedger(ctx context.Context, db *sql.DB, email string) (*Ledger, error) {
+	email = normalizeEmail(email)
+	rows, err := db.QueryContext(ctx, ledgerTripsSelect, email)
+	if err != nil {
+		return nil, err
+	}
+	type tripName struct {
+		id   int64
+		name string
+	}
+	var trips []tripName
+	for rows.Next() {
+		var t tripName
+		err = rows.Scan(&t.id, &t.name)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		trips = append(trips, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	byPerson := make(map[string]*LedgerBalance)
+	ledger := &Ledger{Email: email, Balances: []LedgerBalance{}}
+	for _, t := range trips {
+		s, err := LoadSettlement(ctx, db, t.id)
+		if errors.Is(err, ErrInfeasibleSettlement) {
+			ledger.Infeasible = append(ledger.Infeasible, t.id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s, err = RemainingSettlement(ctx, db, t.id, s, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		net := make(map[string]int)
+		for payee, amount := range s[email] {
+			net[payee] -= amount
+		}
+		for payer, payments := range s {
+			if amount := payments[email]; amount > 0 {
+				net[payer] += amount
+			}
+		}
+		for other, amount := range net {
+			if amount == 0 {
+				continue
+			}
+			b, ok := byPerson[other]
+			if !ok {
+				b = &LedgerBalance{Email: other}
+				byPerson[other] = b
+			}
+			b.Amount += amount
+			b.Trips = append(b.Trips, LedgerTrip{TripID: t.id, TripName: t.name, Amount: amount})
+		}
+	}
+	for _, b := range byPerson {
+		switch {
+		case b.Amount > 0:
+			ledger.Owed += b.Amount
+		case b.Amount < 0:
+			ledger.Owes -= b.Amount
+		default:
+			continue
+		}
+		ledger.Balances = append(ledger.Balances, *b)
+	}
+	sort.Slice(ledger.Balances, func(i, j int) bool {
+		return ledger.Balances[i].Email < ledger.Balances[j].Email
+	})
+	return ledger, nil
+}
@@ -0,0 +1,84 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the ledger of a user across their
+// trips.
+
+package trip
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestLoadLedger settles two trips between the same people, pays a part,
+// and checks the ledger nets the rest by person
+func TestLoadLedger(t *testing.T) {
+	ctx := context.Background()
+	ldb := openTestDB(t)
+	start := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Hour).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	addTrip := func(name, owner string, others []string, participants []Participant) *Trip {
+		tr := NewTrip(name, owner, "", NewDate(start), others)
+		err := tr.Save(ctx, ldb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tr.AddExpense(NewDate(start), "Dinner", participants)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tr.Save(ctx, ldb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr
+	}
+	lake := addTrip("Lake", alice, []string{bob, charlie},
+		[]Participant{{Email: alice, Paid: 9000}, {Email: bob}, {Email: charlie}})
+	city := addTrip("City", bob, []string{alice},
+		[]Participant{{Email: bob, Paid: 4000}, {Email: alice}})
+	_, err := lake.RecordPayment(ctx, ldb, charlie, alice, 3000, NewDate(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := LoadLedger(ctx, ldb, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Ledger{
+		Email: alice,
+		Owed:  1000,
+		Balances: []LedgerBalance{{Email: bob, Amount: 1000, Trips: []LedgerTrip{
+			{TripID: lake.ID, TripName: "Lake", Amount: 3000},
+			{TripID: city.ID, TripName: "City", Amount: -2000},
+		}}},
+	}
+	if !reflect.DeepEqual(ledger, want) {
+		t.Errorf("Unexpected ledger %+v", ledger)
+	}
+
+	ledger, err = LoadLedger(ctx, ldb, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger.Owes != 1000 || ledger.Owed != 0 || len(ledger.Balances) != 1 || ledger.Balances[0].Amount != -1000 {
+		t.Errorf("Unexpected ledger %+v", ledger)
+	}
+
+	ledger, err = LoadLedger(ctx, ldb, "nobody@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ledger.Balances) != 0 || ledger.Owed != 0 || ledger.Owes != 0 {
+		t.Errorf("expected an empty ledger, got %+v", ledger)
+	}
+}
@@ -0,0 +1,48 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit correlates the log entries with the requests. The server
+// attaches the ID of each request to the context passed down to the data
+// model, and every entry logged with that context carries it.
+
+package trip
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// requestIDKey is the context key of the request ID
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of the context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, or "" if none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logPrefix returns the prefix of the log entries of the context
+func logPrefix(ctx context.Context) string {
+	if id := RequestID(ctx); id != "" {
+		return "request_id=" + id + " "
+	}
+	return ""
+}
+
+// Logf logs like log.Printf, prefixed with the request ID of the context,
+// e.g. "request_id=6f1c... ERROR: insert failed: ..."
+func Logf(ctx context.Context, format string, args ...any) {
+	log.Print(logPrefix(ctx) + fmt.Sprintf(format, args...))
+}
+
+// fatalf is Logf followed by the exit of the process, like log.Fatalf
+func fatalf(ctx context.Context, format string, args ...any) {
+	log.Fatal(logPrefix(ctx) + fmt.Sprintf(format, args...))
+}
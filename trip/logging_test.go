@@ -0,0 +1,59 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the request IDs of the log.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestRequestIDLog saves a trip with a request ID, logging every
+// statement, and checks every entry carries the ID
+func TestRequestIDLog(t *testing.T) {
+	if id := RequestID(context.Background()); id != "" {
+		t.Errorf("expected no request ID, got %q", id)
+	}
+	ctx := WithRequestID(context.Background(), "req-42")
+	if id := RequestID(ctx); id != "req-42" {
+		t.Errorf("expected the request ID req-42, got %q", id)
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	rdb, err := OpenWithSlowQueryLog("sqlite3", filepath.Join(t.TempDir(), "request.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	setupSchema(rdb)
+	buf.Reset()
+
+	tr := NewTrip("Trip R", alice, "", epochToDate(time.Now().Unix()), []string{bob})
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("expected the statements in the log, got %q", buf.String())
+	}
+	for _, l := range lines {
+		if !strings.Contains(l, " request_id=req-42 WARNING: slow query") {
+			t.Errorf("expected the request ID in %q", l)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the discussion thread of a trip. The participants
+// post messages about the trip, e.g. the planning of the expenses, kept
+// next to its ledger. The authors edit their messages, which are listed
+// in the order they were posted.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	messageInsert = `INSERT INTO trip_message (trip_id, user_id, body, created_at, edited_at)
+VALUES (?, ?, ?, ?, 0)`
+	messageSelect = `SELECT m.message_id, m.trip_id, u.email, m.body, m.created_at, m.edited_at
+FROM trip_message AS m, tuser AS u
+WHERE u.user_id = m.user_id AND m.trip_id = ?`
+	messageOrder  = "\nORDER BY m.message_id"
+	messageByID   = "\nAND m.message_id = ?"
+	messageUpdate = "UPDATE trip_message SET body = ?, edited_at = ? WHERE message_id = ?"
+	messageDelete = "DELETE FROM trip_message WHERE trip_id = ? AND message_id = ?"
+)
+
+// Message is a message of the discussion thread of a trip
+type Message struct {
+	// ID is the primary key and is from a sequence
+	ID     int64 `json:"message_id"`
+	TripID int64 `json:"trip_id"`
+	// Author is the email address of the participant who posted it
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	// EditedAt is when the text was last edited, nil if never
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+}
+
+// PostMessage adds a message of the author, a participant or the owner,
+// to the thread of the trip. An error wrapping ErrUnknownParticipant is
+// returned if the author isn't part of the trip, ErrTripArchived if the
+// trip is archived.
+func (trip *Trip) PostMessage(ctx context.Context, db *sql.DB, author, text string) (*Message, error) {
+	if trip.Archived {
+		return nil, ErrTripArchived
+	}
+	author = normalizeEmail(author)
+	userID, ok := trip.emailLookup[author]
+	if !ok {
+		return nil, fmt.Errorf("%s is %w", author, ErrUnknownParticipant)
+	}
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, errors.New("the text of a message can't be empty")
+	}
+	m := &Message{TripID: trip.ID, Author: author, Text: text, CreatedAt: Now().UTC().Truncate(time.Microsecond)}
+	rslt, err := db.ExecContext(ctx, messageInsert, m.TripID, userID, m.Text, m.CreatedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	m.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "%s posted message %d to trip %d\n", m.Author, m.ID, m.TripID)
+	return m, nil
+}
+
+// LoadMessages returns a page of the thread of the trip, the oldest
+// message first. sql.ErrNoRows is returned if there's no such trip.
+func LoadMessages(ctx context.Context, db *sql.DB, tripID int64, page Page) ([]*Message, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, tripExistsSelect, tripID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, messageSelect+messageOrder+pageClause, append([]any{tripID}, page.args()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, m)
+	}
+	return rslt, rows.Err()
+}
+
+// LoadMessage returns a message of the thread of the trip, sql.ErrNoRows
+// if there's none
+func LoadMessage(ctx context.Context, db *sql.DB, tripID, messageID int64) (*Message, error) {
+	return scanMessage(db.QueryRowContext(ctx, messageSelect+messageByID, tripID, messageID))
+}
+
+// scanMessage reads a message from a row
+func scanMessage(row interface{ Scan(...any) error }) (*Message, error) {
+	m := new(Message)
+	var createdAt, editedAt int64
+	err := row.Scan(&m.ID, &m.TripID, &m.Author, &m.Text, &createdAt, &editedAt)
+	if err != nil {
+		return nil, err
+	}
+	m.CreatedAt = time.UnixMicro(createdAt).UTC()
+	if editedAt != 0 {
+		t := time.UnixMicro(editedAt).UTC()
+		m.EditedAt = &t
+	}
+	return m, nil
+}
+
+// Edit replaces the text of the message
+func (m *Message) Edit(ctx context.Context, db *sql.DB, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errors.New("the text of a message can't be empty")
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	_, err := db.ExecContext(ctx, messageUpdate, text, now.UnixMicro(), m.ID)
+	if err != nil {
+		return err
+	}
+	m.Text = text
+	m.EditedAt = &now
+	Logf(ctx, "%s edited message %d of trip %d\n", m.Author, m.ID, m.TripID)
+	return nil
+}
+
+// DeleteMessage deletes a message of the thread of the trip,
+// sql.ErrNoRows is returned if there's none
+func DeleteMessage(ctx context.Context, db *sql.DB, tripID, messageID int64) error {
+	res, err := db.ExecContext(ctx, messageDelete, tripID, messageID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	Logf(ctx, "Deleted message %d of trip %d\n", messageID, tripID)
+	return nil
+}
@@ -0,0 +1,96 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the discussion thread of a trip.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	tripMessageCreate = `CREATE TABLE IF NOT EXISTS trip_message (
+message_id INTEGER CONSTRAINT trip_message_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+body TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+edited_at INTEGER NOT NULL)`
+	tripMessageTripIndex = "CREATE INDEX IF NOT EXISTS trip_message_trip_index ON trip_message(trip_id)"
+)
+
+// TestMessages posts to the thread of a trip, pages through it, then edits
+// and deletes a message
+func TestMessages(t *testing.T) {
+	ctx := context.Background()
+	mdb := openTestDB(t)
+	SetClock(NewFakeClock(time.Date(2024, 9, 1, 9, 0, 0, 0, time.UTC), time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Thread", alice, "", NewDate(Now()), []string{bob})
+	err := tr.Save(ctx, mdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.PostMessage(ctx, mdb, charlie, "hello")
+	if !errors.Is(err, ErrUnknownParticipant) {
+		t.Errorf("expected a non-participant to be refused, got %v", err)
+	}
+	_, err = tr.PostMessage(ctx, mdb, bob, "  ")
+	if err == nil {
+		t.Error("expected an empty message to be refused")
+	}
+	for i, author := range []string{alice, "Bob@test.com", alice} {
+		_, err = tr.PostMessage(ctx, mdb, author, string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := LoadMessages(ctx, mdb, tr.ID, Page{Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Author != bob || page[0].Text != "b" || page[0].EditedAt != nil {
+		t.Fatalf("Unexpected page %+v", page)
+	}
+	m := page[0]
+	err = m.Edit(ctx, mdb, "b, edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMessage(ctx, mdb, tr.ID, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Text != "b, edited" || loaded.EditedAt == nil || !loaded.EditedAt.After(loaded.CreatedAt) {
+		t.Errorf("expected the message edited, got %+v", loaded)
+	}
+
+	err = DeleteMessage(ctx, mdb, tr.ID, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteMessage(ctx, mdb, tr.ID, m.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows deleting again, got %v", err)
+	}
+	all, err := LoadMessages(ctx, mdb, tr.ID, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Text != "a" || all[1].Text != "c" {
+		t.Errorf("Unexpected thread %+v", all)
+	}
+	_, err = LoadMessages(ctx, mdb, 999, Page{})
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown trip, got %v", err)
+	}
+}
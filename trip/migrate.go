@@ -0,0 +1,279 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit copies the data of a database into another one, e.g. from
+// SQLite3 to PostgreSQL. The rows keep their IDs, and each table is
+// checked afterwards by comparing its number of rows and a checksum of its
+// content in both databases.
+
+package trip
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Dialect is the flavour of SQL spoken by a database, it's named after the
+// database/sql driver
+type Dialect string
+
+// The supported dialects
+const (
+	DialectSQLite3  Dialect = "sqlite3"
+	DialectPostgres Dialect = "postgres"
+)
+
+// migrationTable is a table copied by MigrateData
+type migrationTable struct {
+	name string
+	// key orders the rows, it's the primary key
+	key string
+	// serial is the column taking its value from a sequence, if any
+	serial string
+	// bools are the BOOLEAN columns, stored as 0 or 1 by SQLite3
+	bools []string
+}
+
+// migrationTables are the tables of the schema, the tables referred to
+// first
+var migrationTables = []migrationTable{
+	{name: "tuser", key: "user_id", serial: "user_id", bools: []string{"verified"}},
+	{name: "trip", key: "trip_id", serial: "trip_id", bools: []string{"approval_required"}},
+	{name: "participant", key: "trip_id, user_id", bools: []string{"is_owner"}},
+	{name: "expense", key: "expense_id", serial: "expense_id"},
+	{name: "expense_participant", key: "expense_id, user_id"},
+	{name: "expense_note", key: "expense_id"},
+	{name: "expense_metadata", key: "expense_id"},
+	{name: "expense_reassignment", key: "expense_id"},
+	{name: "receipt", key: "receipt_id", serial: "receipt_id"},
+	{name: "voice_note", key: "voice_note_id", serial: "voice_note_id"},
+	{name: "audit_log", key: "audit_id", serial: "audit_id"},
+	{name: "webhook", key: "webhook_id", serial: "webhook_id"},
+	{name: "webhook_delivery", key: "delivery_id", serial: "delivery_id"},
+	{name: "expense_deleted", key: "expense_id"},
+	{name: "expense_participant_deleted", key: "expense_id, user_id"},
+	{name: "spend_cap", key: "user_id, trip_id"},
+	{name: "trip_snapshot", key: "snapshot_id", serial: "snapshot_id"},
+	{name: "api_token", key: "token_id", serial: "token_id"},
+	{name: "trip_settlement", key: "trip_id, payer, payee"},
+	{name: "forbidden_transfer", key: "trip_id, payer, payee"},
+	{name: "cost_preference", key: "trip_id, user_id"},
+	{name: "trip_envelope", key: "trip_id, category", bools: []string{"daily", "rollover"}},
+	{name: "expense_approval", key: "trip_id, user_id"},
+	{name: "expense_quarantine", key: "quarantine_id", serial: "quarantine_id"},
+	{name: "email_verification", key: "token_hash"},
+	{name: "approval_delegation", key: "trip_id"},
+	{name: "trip_message", key: "message_id", serial: "message_id"},
+	{name: "household_member", key: "trip_id, user_id"},
+	{name: "trip_setting", key: "trip_id"},
+	{name: "push_device", key: "device_id", serial: "device_id"},
+	{name: "push_delivery", key: "push_id", serial: "push_id"},
+	{name: "recurring_expense", key: "recurrence_id", serial: "recurrence_id"},
+	{name: "feature_flag", key: "name", bools: []string{"enabled"}},
+	{name: "feature_user", key: "name, user_id"},
+	{name: "google_account", key: "user_id"},
+	{name: "trip_sheet", key: "trip_id", bools: []string{"refresh_on_completion"}},
+	{name: "settlement_payment", key: "payment_id", serial: "payment_id"},
+	{name: "expense_freeze", key: "trip_id"},
+	{name: "expense_review", key: "review_id", serial: "review_id", bools: []string{"corrected"}},
+	{name: "friend_group", key: "group_id", serial: "group_id"},
+	{name: "friend_group_member", key: "group_id, user_id"},
+	{name: "trip_federation", key: "federation_id", serial: "federation_id"},
+}
+
+// TableMigration is the outcome of the copy of a table
+type TableMigration struct {
+	Table string `json:"table"`
+	Rows  int    `json:"rows"`
+	// Checksum is the SHA-256 of the rows, the same in both databases
+	Checksum string `json:"checksum"`
+}
+
+// placeholders returns the n placeholders of the parameters of a query
+func (d Dialect) placeholders(n int) string {
+	ph := make([]string, n)
+	for i := range ph {
+		if d == DialectPostgres {
+			ph[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			ph[i] = "?"
+		}
+	}
+	return strings.Join(ph, ", ")
+}
+
+// normalizeValue maps a value read by any driver to the same type, so the
+// checksums of both databases can be compared
+func normalizeValue(v any) any {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	}
+	return v
+}
+
+// MigrateData copies all the tables of the trips from one database into
+// another, keeping the IDs. The schema must exist in the destination, with
+// empty tables. The copy of each table is verified before moving to the
+// next one, the copied tables are returned with the first error.
+func MigrateData(ctx context.Context, from *sql.DB, to *sql.DB, toDialect Dialect) ([]TableMigration, error) {
+	var rslt []TableMigration
+	for _, tbl := range migrationTables {
+		var n int
+		err := to.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+tbl.name).Scan(&n)
+		if err != nil {
+			return rslt, fmt.Errorf("table %s: %w", tbl.name, err)
+		}
+		if n != 0 {
+			return rslt, fmt.Errorf("table %s: the destination already has %d rows", tbl.name, n)
+		}
+	}
+	for _, tbl := range migrationTables {
+		err := copyTable(ctx, from, to, toDialect, tbl)
+		if err != nil {
+			return rslt, fmt.Errorf("table %s: %w", tbl.name, err)
+		}
+		want, err := checksumTable(ctx, from, tbl)
+		if err != nil {
+			return rslt, fmt.Errorf("table %s: %w", tbl.name, err)
+		}
+		got, err := checksumTable(ctx, to, tbl)
+		if err != nil {
+			return rslt, fmt.Errorf("table %s: %w", tbl.name, err)
+		}
+		if got != want {
+			return rslt, fmt.Errorf("table %s: verification failed, %d rows (%s) copied from %d rows (%s)",
+				tbl.name, got.Rows, got.Checksum, want.Rows, want.Checksum)
+		}
+		rslt = append(rslt, want)
+		Logf(ctx, "Migrated %d rows of table %s\n", want.Rows, tbl.name)
+	}
+	return rslt, nil
+}
+
+// copyTable copies the rows of a table within a transaction of the
+// destination
+func copyTable(ctx context.Context, from *sql.DB, to *sql.DB, toDialect Dialect, tbl migrationTable) (err error) {
+	rows, err := from.QueryContext(ctx, "SELECT * FROM "+tbl.name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	isBool := make([]bool, len(cols))
+	for i, col := range cols {
+		for _, b := range tbl.bools {
+			isBool[i] = isBool[i] || col == b
+		}
+	}
+
+	txn, err := to.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var stmt *sql.Stmt
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	stmt, err = txn.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		tbl.name, strings.Join(cols, ", "), toDialect.placeholders(len(cols))))
+	if err != nil {
+		goto Rollback
+	}
+	defer stmt.Close()
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			goto Rollback
+		}
+		for i, v := range values {
+			if n, ok := v.(int64); ok && isBool[i] && toDialect == DialectPostgres {
+				values[i] = n != 0
+			}
+		}
+		_, err = stmt.ExecContext(ctx, values...)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		goto Rollback
+	}
+	// The IDs were copied, the sequence carries on after the last one
+	if tbl.serial != "" && toDialect == DialectPostgres {
+		// the name in the string isn't rewritten for the prefix, see
+		// OpenStore()
+		_, err = txn.ExecContext(ctx, fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%[3]s%[1]s', '%[2]s'), COALESCE(MAX(%[2]s), 0) + 1, false) FROM %[1]s",
+			tbl.name, tbl.serial, TablePrefix(to)))
+		if err != nil {
+			goto Rollback
+		}
+	}
+	return txn.Commit()
+
+Rollback:
+	if rollbackErr := txn.Rollback(); rollbackErr != nil {
+		fatalf(ctx, "ERROR: copyTable() failed to rollback transaction on table '%s': '%v'\n", tbl.name, rollbackErr)
+	}
+	return err
+}
+
+// checksumTable counts the rows of a table and computes the SHA-256 of
+// their values, in the order of the primary key
+func checksumTable(ctx context.Context, db *sql.DB, tbl migrationTable) (TableMigration, error) {
+	rslt := TableMigration{Table: tbl.name}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s ORDER BY %s", tbl.name, tbl.key))
+	if err != nil {
+		return rslt, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return rslt, err
+	}
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	// the columns are hashed by name, their order may differ between the
+	// databases
+	order := make([]int, len(cols))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return cols[order[i]] < cols[order[j]] })
+
+	h := sha256.New()
+	for rows.Next() {
+		err = rows.Scan(ptrs...)
+		if err != nil {
+			return rslt, err
+		}
+		for _, i := range order {
+			fmt.Fprintf(h, "%s=%q;", cols[i], fmt.Sprint(normalizeValue(values[i])))
+		}
+		h.Write([]byte{'\n'})
+		rslt.Rows++
+	}
+	rslt.Checksum = hex.EncodeToString(h.Sum(nil))
+	return rslt, rows.Err()
+}
@@ -0,0 +1,123 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the data migration.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestMigrateData copies a database into an empty one and reads the trip
+// back from the copy
+func TestMigrateData(t *testing.T) {
+	ctx := context.Background()
+	src := openTestDB(t)
+	dst := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip M", alice, "", today, []string{bob, charlie})
+	err := tr.Save(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(today, "hotel", []Participant{{alice, 0, 3000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Expenses[0].SetNotes("Booked *online*")
+	err = tr.SetForbiddenTransfers([]TransferPair{{bob, alice}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables, err := MigrateData(ctx, src, dst, DialectSQLite3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != len(migrationTables) {
+		t.Errorf("expected %d tables, got %d", len(migrationTables), len(tables))
+	}
+	for _, tm := range tables {
+		if tm.Table == "expense_participant" && tm.Rows != 3 {
+			t.Errorf("expected 3 rows of expense_participant, got %d", tm.Rows)
+		}
+	}
+	orig, err := LoadTripByID(ctx, src, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := LoadTripByID(ctx, dst, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := json.Marshal(orig)
+	got, _ := json.Marshal(copied)
+	if !bytes.Equal(got, want) {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	// The IDs carry on after the copied ones
+	tr2 := NewTrip("Trip N", bob, "", today, nil)
+	err = tr2.Save(ctx, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr2.ID != tr.ID+1 {
+		t.Errorf("expected trip ID %d, got %d", tr.ID+1, tr2.ID)
+	}
+
+	_, err = MigrateData(ctx, src, dst, DialectSQLite3)
+	if err == nil {
+		t.Error("expected an error migrating into a database with data")
+	}
+}
+
+// TestChecksumTable checks the checksum doesn't depend on the order of the
+// columns nor on the type of the booleans
+func TestChecksumTable(t *testing.T) {
+	ctx := context.Background()
+	db1 := openTestDB(t)
+	db2 := openTestDB(t)
+	_, err := db1.ExecContext(ctx, "INSERT INTO tuser (user_id, email, verified) VALUES (1, ?, 1)", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db2.ExecContext(ctx, "INSERT INTO tuser (verified, email, user_id) VALUES (?, ?, 1)", true, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := checksumTable(ctx, db1, migrationTables[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := checksumTable(ctx, db2, migrationTables[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 || c1.Rows != 1 {
+		t.Errorf("expected the same checksum of 1 row, got %+v and %+v", c1, c2)
+	}
+	_, err = db2.ExecContext(ctx, "UPDATE tuser SET verified = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err = checksumTable(ctx, db2, migrationTables[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 == c2 {
+		t.Error("expected the checksum to change with the data")
+	}
+}
@@ -0,0 +1,231 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit names the tables of the schema with a prefix, so that the
+// service can share a database with other applications. Like the slow
+// query log, the database/sql driver is wrapped: the names of the tables,
+// their indices and constraints are rewritten in every statement, so the
+// SQL statements of the other units stay as they are. A prefix ending with
+// a dot is a PostgreSQL schema, the indices and constraints are then in
+// the schema of their table and keep their names.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tablePrefixPattern is what a prefix of the tables is made of
+var tablePrefixPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\.?$`)
+
+// schemaTables and schemaNames are the names of the tables of devSchema,
+// and the names of their indices and constraints
+var schemaTables, schemaNames = func() (map[string]bool, map[string]bool) {
+	tables := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, m := range regexp.MustCompile(`CREATE TABLE IF NOT EXISTS (\w+)`).FindAllStringSubmatch(devSchema, -1) {
+		tables[m[1]] = true
+	}
+	for _, m := range regexp.MustCompile(`(?:CREATE INDEX IF NOT EXISTS|CONSTRAINT) (\w+)`).FindAllStringSubmatch(devSchema, -1) {
+		names[m[1]] = true
+	}
+	return tables, names
+}()
+
+// ValidTablePrefix checks the prefix of the tables: an identifier, ending
+// with a dot for a schema
+func ValidTablePrefix(prefix string) error {
+	if prefix != "" && !tablePrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("invalid table prefix %q, letters, digits and underscores, ending with a dot for a schema", prefix)
+	}
+	return nil
+}
+
+// OpenStore opens the database of the trips like sql.Open, except that the
+// tables are named with the prefix, if any, and the statements taking
+// longer than slowQuery are logged, if it's positive
+func OpenStore(driverName, dataSourceName, prefix string, slowQuery time.Duration) (*sql.DB, error) {
+	err := ValidTablePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := openConnector(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if slowQuery > 0 {
+		connector = &slowConnector{connector, slowQuery}
+	}
+	if prefix != "" {
+		connector = &prefixConnector{connector, newTableRewriter(prefix)}
+	}
+	return sql.OpenDB(connector), nil
+}
+
+// TablePrefix returns the prefix of the tables of a database opened by
+// OpenStore
+func TablePrefix(db *sql.DB) string {
+	if pd, ok := db.Driver().(*prefixDriver); ok {
+		return pd.rewriter.prefix
+	}
+	return ""
+}
+
+// tableRewriter rewrites the statements for the prefix of the tables
+type tableRewriter struct {
+	prefix string
+	names  map[string]bool
+	// cache maps the statements to their rewrite, they're mostly constants
+	cache sync.Map
+}
+
+// newTableRewriter returns the rewriter of the prefix
+func newTableRewriter(prefix string) *tableRewriter {
+	names := make(map[string]bool)
+	for n := range schemaTables {
+		names[n] = true
+	}
+	if !strings.HasSuffix(prefix, ".") {
+		for n := range schemaNames {
+			names[n] = true
+		}
+	}
+	return &tableRewriter{prefix: prefix, names: names}
+}
+
+// isIdentByte tells whether the byte can be part of an identifier
+func isIdentByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
+
+// rewrite prefixes the names of the schema in a statement, outside of the
+// quoted strings, identifiers and comments
+func (r *tableRewriter) rewrite(query string) string {
+	if v, ok := r.cache.Load(query); ok {
+		return v.(string)
+	}
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		j := i + 1
+		switch c := query[i]; {
+		case c == '\'' || c == '"':
+			for ; j < len(query); j++ {
+				if query[j] != c {
+					continue
+				}
+				// a doubled quote is escaped
+				if j+1 < len(query) && query[j+1] == c {
+					j++
+					continue
+				}
+				j++
+				break
+			}
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			for j < len(query) && query[j] != '\n' {
+				j++
+			}
+		case isIdentByte(c):
+			for j < len(query) && isIdentByte(query[j]) {
+				j++
+			}
+			if r.names[strings.ToLower(query[i:j])] {
+				b.WriteString(r.prefix)
+			}
+		}
+		b.WriteString(query[i:j])
+		i = j
+	}
+	rslt := b.String()
+	r.cache.Store(query, rslt)
+	return rslt
+}
+
+// prefixConnector opens the wrapped connections
+type prefixConnector struct {
+	connector driver.Connector
+	rewriter  *tableRewriter
+}
+
+func (pc *prefixConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := pc.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &prefixConn{conn, pc.rewriter}, nil
+}
+
+func (pc *prefixConnector) Driver() driver.Driver {
+	return &prefixDriver{pc.connector.Driver(), pc.rewriter}
+}
+
+// prefixDriver is the driver of the databases opened by OpenStore, to find
+// their prefix
+type prefixDriver struct {
+	driver.Driver
+	rewriter *tableRewriter
+}
+
+func (pd *prefixDriver) Open(name string) (driver.Conn, error) {
+	conn, err := pd.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &prefixConn{conn, pd.rewriter}, nil
+}
+
+// prefixConn rewrites the statements run on a connection
+type prefixConn struct {
+	driver.Conn
+	rewriter *tableRewriter
+}
+
+func (c *prefixConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *prefixConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	query = c.rewriter.rewrite(query)
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *prefixConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *prefixConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return e.ExecContext(ctx, c.rewriter.rewrite(query), args)
+}
+
+func (c *prefixConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return q.QueryContext(ctx, c.rewriter.rewrite(query), args)
+}
+
+func (c *prefixConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the prefix of the tables.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestTableRewriter checks the names rewritten in some statements
+func TestTableRewriter(t *testing.T) {
+	for _, c := range []struct {
+		prefix, query, want string
+	}{
+		{"ta_", "SELECT t.name FROM trip AS t JOIN participant AS p ON p.trip_id = t.trip_id",
+			"SELECT t.name FROM ta_trip AS t JOIN ta_participant AS p ON p.trip_id = t.trip_id"},
+		{"ta_", "UPDATE participant SET rsvp = 'trip' WHERE trip_id = ? -- expense\n",
+			"UPDATE ta_participant SET rsvp = 'trip' WHERE trip_id = ? -- expense\n"},
+		{"ta_", `SELECT 'it''s a trip', "expense" FROM Expense`,
+			`SELECT 'it''s a trip', "expense" FROM ta_Expense`},
+		{"ta_", "CREATE INDEX IF NOT EXISTS expense_trip_index ON expense(trip_id)",
+			"CREATE INDEX IF NOT EXISTS ta_expense_trip_index ON ta_expense(trip_id)"},
+		{"trips.", "CREATE INDEX IF NOT EXISTS expense_trip_index ON expense(trip_id)",
+			"CREATE INDEX IF NOT EXISTS expense_trip_index ON trips.expense(trip_id)"},
+	} {
+		got := newTableRewriter(c.prefix).rewrite(c.query)
+		if got != c.want {
+			t.Errorf("rewrite(%q) with %q = %q, want %q", c.query, c.prefix, got, c.want)
+		}
+	}
+}
+
+// TestOpenStore saves a trip in a database with prefixed tables
+func TestOpenStore(t *testing.T) {
+	ctx := context.Background()
+	for _, prefix := range []string{"ta-", "1ta_", "ta.x"} {
+		if _, err := OpenStore("sqlite3", ":memory:", prefix, 0); err == nil {
+			t.Errorf("expected the prefix %q to be refused", prefix)
+		}
+	}
+	dbFile := filepath.Join(t.TempDir(), "shared.db")
+	sdb, err := OpenStore("sqlite3", dbFile, "ta_", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+	if TablePrefix(sdb) != "ta_" {
+		t.Errorf("Unexpected prefix %q", TablePrefix(sdb))
+	}
+	err = CreateSchema(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTrip("Shared", alice, "", NewDate(time.Now()), []string{bob})
+	err = tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := LoadTripByID(ctx, sdb, tr.ID)
+	if err != nil || tr2.Name != "Shared" {
+		t.Fatalf("Failed to load the trip back: %v", err)
+	}
+
+	// the other applications see the tables and indices prefixed
+	plain, err := sql.Open("sqlite3", dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	rows, err := plain.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type IN ('table', 'index') AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(name, "ta_") {
+			t.Errorf("Unexpected name %q", name)
+		}
+		n++
+	}
+	if n != len(schemaTables)+strings.Count(devSchema, "CREATE INDEX") {
+		t.Errorf("Unexpected number of tables and indices %d", n)
+	}
+}
@@ -0,0 +1,193 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the scan of the receipts: an OCR engine turns the
+// picture of a receipt into text, and the total amount and the date are
+// picked from it, to pre-fill an expense, with the confidence in what was
+// picked.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrNoOCR is returned by ScanReceipt() when no OCR engine is set
+var ErrNoOCR = errors.New("no OCR engine to scan the receipts")
+
+// OCREngine extracts the text of the picture of a receipt
+type OCREngine interface {
+	Text(ctx context.Context, r io.Reader) (string, error)
+}
+
+// CommandOCR is an OCR engine running a command, with its arguments,
+// reading the picture on its standard input and writing the text on its
+// standard output, e.g. tesseract:
+//
+//	CommandOCR{"tesseract", "stdin", "stdout"}
+type CommandOCR []string
+
+// Text is part of the OCREngine interface
+func (cmd CommandOCR) Text(ctx context.Context, r io.Reader) (string, error) {
+	if len(cmd) == 0 {
+		return "", errors.New("no OCR command")
+	}
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	c.Stdin = r
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", cmd[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// ocrEngine is the engine of ScanReceipt(), see SetOCREngine()
+var ocrEngine OCREngine
+
+// SetOCREngine sets the engine scanning the receipts, nil turns the scan
+// off. It's meant to be called before serving any request.
+func SetOCREngine(e OCREngine) {
+	ocrEngine = e
+}
+
+// ReceiptScan is what was read from the picture of a receipt
+type ReceiptScan struct {
+	// Text is the whole text of the receipt
+	Text string `json:"text"`
+	// Amount is the total amount, in cent, 0 if not found
+	Amount int `json:"amount"`
+	// Date is the date of the receipt, zeroTime if not found
+	Date Date `json:"date"`
+	// Confidence is how sure the scan is of the amount and the date, in
+	// percent, see scanConfidence()
+	Confidence int `json:"confidence"`
+}
+
+var (
+	// scanAmount matches an amount with 2 decimals, the thousands
+	// separated or not, e.g. 1,234.56, 1.234,56 or 1234.56
+	scanAmount = regexp.MustCompile(`\b(\d{1,3}(?:[,.']\d{3})+|\d+)[.,](\d{2})\b`)
+	// scanTotal matches the label of the total, but not of a subtotal
+	scanTotal = regexp.MustCompile(`(?i)(?:^|[^a-z])(?:grand )?total\b|amount due|balance due`)
+	// scanDates are the date formats looked for, with their layouts. A
+	// date with slashes is read day first, unless it can't be.
+	scanDates = []struct {
+		re      *regexp.Regexp
+		layouts []string
+	}{
+		{regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`), []string{time.DateOnly}},
+		{regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{4}\b`), []string{"2/1/2006", "1/2/2006"}},
+		{regexp.MustCompile(`\b\d{1,2}\.\d{1,2}\.\d{4}\b`), []string{"2.1.2006"}},
+		{regexp.MustCompile(`\b\d{1,2} [A-Z][a-z]{2} \d{4}\b`), []string{"2 Jan 2006"}},
+		{regexp.MustCompile(`\b[A-Z][a-z]{2} \d{1,2}, \d{4}\b`), []string{"Jan 2, 2006"}},
+	}
+)
+
+// parseScanAmount returns the amount in cent of a match of scanAmount
+func parseScanAmount(m []string) int {
+	units := 0
+	for _, r := range m[1] {
+		if r >= '0' && r <= '9' {
+			units = units*10 + int(r-'0')
+		}
+	}
+	return units*100 + int(m[2][0]-'0')*10 + int(m[2][1]-'0')
+}
+
+// scanReceiptAmount returns the total amount of the text of a receipt: the
+// largest amount on the lines of a total, or the largest amount of the
+// text without such a line, and whether a line of a total was found. The
+// dates are left out, 16.10.2026 isn't 16.10.
+func scanReceiptAmount(text string) (int, bool) {
+	for _, sd := range scanDates {
+		text = sd.re.ReplaceAllString(text, " ")
+	}
+	total, largest := 0, 0
+	for _, line := range strings.Split(text, "\n") {
+		isTotal := scanTotal.MatchString(line)
+		for _, m := range scanAmount.FindAllStringSubmatch(line, -1) {
+			amount := parseScanAmount(m)
+			largest = max(largest, amount)
+			if isTotal {
+				total = max(total, amount)
+			}
+		}
+	}
+	if total > 0 {
+		return total, true
+	}
+	return largest, false
+}
+
+// scanConfidence returns the confidence in the amount and the date picked
+// from a receipt, in percent: 70 for an amount on the line of a total, 30
+// for the largest amount otherwise, and 30 more for a date
+func scanConfidence(amount int, isTotal bool, date Date) int {
+	confidence := 0
+	switch {
+	case amount > 0 && isTotal:
+		confidence = 70
+	case amount > 0:
+		confidence = 30
+	}
+	if !date.Equal(zeroTime) {
+		confidence += 30
+	}
+	return confidence
+}
+
+// scanReceiptDate returns the first date of the text of a receipt
+func scanReceiptDate(text string) Date {
+	first, pos := Date{zeroTime}, len(text)
+	for _, sd := range scanDates {
+		for _, loc := range sd.re.FindAllStringIndex(text, -1) {
+			if loc[0] >= pos {
+				break
+			}
+			for _, layout := range sd.layouts {
+				t, err := time.Parse(layout, text[loc[0]:loc[1]])
+				if err == nil {
+					first, pos = NewDate(t), loc[0]
+					break
+				}
+			}
+			if pos == loc[0] {
+				break
+			}
+		}
+	}
+	return first
+}
+
+// ScanReceipt reads the text of the picture of a receipt with the OCR
+// engine, and picks its total amount and its date. ErrNoOCR is returned if
+// no engine is set.
+func ScanReceipt(ctx context.Context, r io.Reader) (*ReceiptScan, error) {
+	if ocrEngine == nil {
+		return nil, ErrNoOCR
+	}
+	text, err := ocrEngine.Text(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	amount, isTotal := scanReceiptAmount(text)
+	date := scanReceiptDate(text)
+	return &ReceiptScan{
+		Text:       text,
+		Amount:     amount,
+		Date:       date,
+		Confidence: scanConfidence(amount, isTotal, date),
+	}, nil
+}
@@ -0,0 +1,77 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the scan of the receipts.
+
+package trip
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOCR is an OCR engine returning its own text, whatever the picture
+type fakeOCR string
+
+// Text is part of the OCREngine interface
+func (f fakeOCR) Text(ctx context.Context, r io.Reader) (string, error) {
+	return string(f), nil
+}
+
+// TestScanReceipt picks the total and the date of some receipts
+func TestScanReceipt(t *testing.T) {
+	cases := []struct {
+		text       string
+		amount     int
+		date       string
+		confidence int
+	}{
+		{"CAFE DU PORT\n16.10.2026 12:31\n2 Espresso 5,00\nTOTAL EUR 12,50\nCB 12,50\n", 1250, "2026-10-16", 100},
+		{"Grill House\nOct 3, 2026\nSubtotal 1,180.00\nTax 94.40\nTotal 1,274.40\nCash 1,300.00\nChange 25.60\n", 127440, "2026-10-03", 100},
+		{"Date: 25/12/2025\nbread 3.20\nmilk 1.10\n", 320, "2025-12-25", 60},
+		{"12/25/2025\nAmount due: 42.00\n", 4200, "2025-12-25", 100},
+		{"no receipt at all", 0, "", 0},
+	}
+	t.Cleanup(func() { SetOCREngine(nil) })
+	for _, tc := range cases {
+		SetOCREngine(fakeOCR(tc.text))
+		scan, err := ScanReceipt(context.Background(), strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		date := ""
+		if !scan.Date.Equal(zeroTime) {
+			date = scan.Date.Format(time.DateOnly)
+		}
+		if scan.Amount != tc.amount || date != tc.date || scan.Text != tc.text {
+			t.Errorf("Scanning %q: expected %d on %q, got %d on %q", tc.text, tc.amount, tc.date, scan.Amount, date)
+		}
+		if scan.Confidence != tc.confidence {
+			t.Errorf("Scanning %q: expected a confidence of %d, got %d", tc.text, tc.confidence, scan.Confidence)
+		}
+	}
+	SetOCREngine(nil)
+	_, err := ScanReceipt(context.Background(), strings.NewReader(""))
+	if err != ErrNoOCR {
+		t.Errorf("expected ErrNoOCR without an engine, got %v", err)
+	}
+}
+
+// TestCommandOCR runs cat as the OCR command, the text is the picture
+func TestCommandOCR(t *testing.T) {
+	text, err := CommandOCR{"cat"}.Text(context.Background(), strings.NewReader("TOTAL 9.99"))
+	if err != nil {
+		t.Skipf("no cat: %v", err)
+	}
+	if text != "TOTAL 9.99" {
+		t.Errorf("Unexpected text %q", text)
+	}
+	_, err = CommandOCR{"false"}.Text(context.Background(), strings.NewReader(""))
+	if err == nil {
+		t.Error("expected the failure of the command")
+	}
+}
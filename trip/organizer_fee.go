@@ -0,0 +1,123 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the organizer fee of a trip: a fixed amount
+// credited to the owner for the effort of organizing it, and paid in equal
+// parts by the other participants who haven't declined. It isn't an
+// expense, it's applied on top of the settlement of the expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// Some global constants used to store SQL statements
+const (
+	organizerFeeSelect = "SELECT organizer_fee FROM trip WHERE trip_id = ? AND deleted_at = 0"
+	feePeopleSelect    = `SELECT u.email, p.is_owner
+FROM tuser AS u, participant AS p
+WHERE u.user_id = p.user_id
+AND p.trip_id = ?
+AND p.rsvp != '` + RSVPDeclined + `'
+ORDER BY u.email`
+)
+
+// SetOrganizerFee changes the organizer fee of the trip (in cent), written
+// to the DB by Save(). 0 removes it.
+func (trip *Trip) SetOrganizerFee(amount int) error {
+	if amount < 0 {
+		return fmt.Errorf("organizer fee must not be negative, got %d", amount)
+	}
+	trip.OrganizerFee = amount
+	trip.detailsChanged = true
+	return nil
+}
+
+// feePayers returns the email addresses of the participants paying the
+// organizer fee, sorted
+func (trip *Trip) feePayers() []string {
+	rslt := []string{}
+	for _, p := range trip.Participants {
+		if trip.rsvp(p.Email) != RSVPDeclined {
+			rslt = append(rslt, p.Email)
+		}
+	}
+	sort.Strings(rslt)
+	return rslt
+}
+
+// feeShares returns what each of the sorted payers pays of the fee. The
+// cents left over by the equal split are paid by the first payers, so that
+// the owner is credited the whole fee.
+func feeShares(fee int, payers []string) map[string]int {
+	rslt := make(map[string]int, len(payers))
+	if fee == 0 || len(payers) == 0 {
+		return rslt
+	}
+	share, left := fee/len(payers), fee%len(payers)
+	for i, payer := range payers {
+		rslt[payer] = share
+		if i < left {
+			rslt[payer]++
+		}
+	}
+	return rslt
+}
+
+// addOrganizerFee adds the payments of the organizer fee to the owner,
+// netted against the payments of the expenses
+func (s Settlement) addOrganizerFee(owner string, fee int, payers []string) {
+	for payer, amount := range feeShares(fee, payers) {
+		s.add(payer, owner, amount)
+	}
+	for payer, payments := range s {
+		if len(payments) == 0 {
+			delete(s, payer)
+		}
+	}
+}
+
+// loadOrganizerFee adds the organizer fee of a trip, read from the DB, to
+// a Settlement read from its running balances
+func loadOrganizerFee(ctx context.Context, db *sql.DB, tripID int64, s Settlement) error {
+	var fee int
+	err := db.QueryRowContext(ctx, organizerFeeSelect, tripID).Scan(&fee)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if fee == 0 {
+		return nil
+	}
+	rows, err := db.QueryContext(ctx, feePeopleSelect, tripID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var owner string
+	payers := []string{}
+	for rows.Next() {
+		var email string
+		var isOwner bool
+		err = rows.Scan(&email, &isOwner)
+		if err != nil {
+			return err
+		}
+		if isOwner {
+			owner = email
+		} else {
+			payers = append(payers, email)
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	s.addOrganizerFee(owner, fee, payers)
+	return nil
+}
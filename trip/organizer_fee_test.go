@@ -0,0 +1,110 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the organizer fee.
+
+package trip
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestOrganizerFee credits the owner with a fee paid by the participants
+// who didn't decline, in the computed and the loaded settlements
+func TestOrganizerFee(t *testing.T) {
+	ctx := context.Background()
+	fdb := openTestDB(t)
+	tr := NewTrip("Trip F", alice, "", NewDate(time.Now()), []string{bob, charlie, david})
+	if tr.SetOrganizerFee(-1) == nil {
+		t.Error("expected a negative fee to be refused")
+	}
+	err := tr.SetOrganizerFee(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.SetRSVP(david, RSVPDeclined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "dinner", []Participant{{alice, 0, 6000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "taxi", []Participant{{alice, 0, 0}, {charlie, 0, 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob pays the cent left over by the split of the fee
+	want := Settlement{bob: {alice: 2501}, charlie: {alice: 2000}}
+	got, err := tr.Settlement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected settlement %v, want %v", got, want)
+	}
+	got, err = LoadSettlement(ctx, fdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected loaded settlement %v, want %v", got, want)
+	}
+
+	tr2, err := LoadTripByID(ctx, fdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr2.OrganizerFee != 1001 {
+		t.Errorf("expected the fee to be loaded, got %d", tr2.OrganizerFee)
+	}
+	wantBalances := []Balance{
+		{alice, 6000, 2500, 1001, 4501, Creditor},
+		{bob, 0, 2000, -501, -2501, Debtor},
+		{charlie, 1000, 2500, -500, -2000, Debtor},
+		{david, 0, 0, 0, 0, Settled},
+	}
+	if got := tr2.Balances(); !reflect.DeepEqual(got, wantBalances) {
+		t.Errorf("Balances() = %v, want %v", got, wantBalances)
+	}
+	st, err := tr2.Statement(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := strings.Join(st.textLines(), "\n"); !strings.Contains(text, "Organizer fee: -5.01") {
+		t.Errorf("expected the fee in the statement, got\n%s", text)
+	}
+
+	// removing the fee updates the trip
+	err = tr2.SetOrganizerFee(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.Save(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = LoadSettlement(ctx, fdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Settlement{bob: {alice: 2000}, charlie: {alice: 1500}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected settlement without the fee %v, want %v", got, want)
+	}
+}
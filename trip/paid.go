@@ -0,0 +1,163 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the "mark as paid" links mailed with the settlement
+// of a completed trip. A link is a token signed with the key of the
+// sessions, see SetSessionKey(), telling a transfer of the settlement, its
+// payer, its payee and its amount, until it expires: nothing is stored, and
+// following it records the payment, see MarkPaid().
+
+package trip
+
+import (
+	"context"
+	"crypto/hmac"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidPaidLink is returned for a token which isn't a "mark as
+	// paid" link signed with the key of the server
+	ErrInvalidPaidLink = errors.New("invalid mark as paid link")
+	// ErrAlreadyPaid is returned when marking as paid a transfer whose
+	// payments are all recorded already
+	ErrAlreadyPaid = errors.New("the transfer is paid already")
+)
+
+// paidHeader is the encoded header of the "mark as paid" links, distinct
+// from the ones of the sessions and of the invites so that no token is
+// ever taken for another
+var paidHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"paid"}`))
+
+// PaidLink is a link marking a transfer of the settlement of a trip as
+// paid
+type PaidLink struct {
+	TripID int64  `json:"trip_id"`
+	Payer  string `json:"payer"`
+	Payee  string `json:"payee"`
+	// Amount is in cent
+	Amount int `json:"amount"`
+	// Token is the token of the link
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// paidClaims are the claims of the token of a PaidLink
+type paidClaims struct {
+	Issuer    string `json:"iss"`
+	TripID    int64  `json:"trip"`
+	Subject   string `json:"sub"`
+	Payee     string `json:"payee"`
+	Amount    int    `json:"amount"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// IssuePaidLink returns the link marking the transfer of the amount, from
+// the payer to the payee of the settlement of the trip, as paid, valid for
+// the given duration
+func IssuePaidLink(tripID int64, payer, payee string, amount int, ttl time.Duration) (*PaidLink, error) {
+	if !SessionsEnabled() {
+		return nil, errors.New("sessions aren't enabled")
+	}
+	now := Now().UTC().Truncate(time.Second)
+	l := &PaidLink{
+		TripID:    tripID,
+		Payer:     normalizeEmail(payer),
+		Payee:     normalizeEmail(payee),
+		Amount:    amount,
+		ExpiresAt: now.Add(ttl),
+	}
+	payload, err := json.Marshal(paidClaims{
+		Issuer:    sessionIssuer,
+		TripID:    l.TripID,
+		Subject:   l.Payer,
+		Payee:     l.Payee,
+		Amount:    l.Amount,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: l.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	signed := paidHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	l.Token = signed + "." + signSession(signed)
+	return l, nil
+}
+
+// ParsePaidLink returns the link of the token, ErrInvalidPaidLink if it
+// isn't one signed with the key of the server, ErrTokenExpired if it has
+// expired
+func ParsePaidLink(token string) (*PaidLink, error) {
+	if !SessionsEnabled() {
+		return nil, ErrInvalidPaidLink
+	}
+	header, rest, _ := strings.Cut(token, ".")
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || header != paidHeader ||
+		!hmac.Equal([]byte(signature), []byte(signSession(header+"."+payload))) {
+		return nil, ErrInvalidPaidLink
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidPaidLink
+	}
+	var claims paidClaims
+	err = json.Unmarshal(raw, &claims)
+	if err != nil || claims.Issuer != sessionIssuer || claims.TripID == 0 || claims.Amount <= 0 {
+		return nil, ErrInvalidPaidLink
+	}
+	l := &PaidLink{
+		TripID:    claims.TripID,
+		Payer:     claims.Subject,
+		Payee:     claims.Payee,
+		Amount:    claims.Amount,
+		Token:     token,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	}
+	if !Now().Before(l.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return l, nil
+}
+
+// MarkPaid records the payment of the transfer of the link, today. Only
+// what remains to be paid of the transfer is recorded, up to the amount of
+// the link, so that following the link twice, or recording the payment
+// otherwise too, doesn't pay it twice: ErrAlreadyPaid is returned then.
+// sql.ErrNoRows is returned if the trip doesn't exist anymore, and the
+// errors of ParsePaidLink() for the token.
+func MarkPaid(ctx context.Context, db *sql.DB, token string) (*Payment, error) {
+	l, err := ParsePaidLink(token)
+	if err != nil {
+		return nil, err
+	}
+	// the remaining amount is read and the payment recorded under the
+	// write lock of the trip, for two clicks not to both record it
+	unlock := lockTrip(l.TripID)
+	defer unlock()
+
+	trip, err := LoadTripByID(ctx, db, l.TripID)
+	if err != nil {
+		return nil, err
+	}
+	s, err := PreviewSettlement(ctx, db, l.TripID)
+	if err != nil {
+		return nil, err
+	}
+	s, err = RemainingSettlement(ctx, db, l.TripID, s, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	amount := min(l.Amount, s[l.Payer][l.Payee])
+	if amount <= 0 {
+		return nil, ErrAlreadyPaid
+	}
+	return trip.RecordPayment(ctx, db, l.Payer, l.Payee, amount, NewDate(Now().UTC()))
+}
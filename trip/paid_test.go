@@ -0,0 +1,93 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the "mark as paid" links.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestMarkPaid marks a transfer of a settlement as paid with its link, only
+// what remains to be paid of it, until the link expires
+func TestMarkPaid(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	clock := NewFakeClock(time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC), time.Second)
+	SetClock(clock.Now)
+	SetSessionKey([]byte("test key"))
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetSessionKey(nil)
+	})
+
+	tr := NewTrip("Paid", alice, "", NewDate(Now()), []string{bob, charlie})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(Now()), "Dinner", []Participant{{Email: alice, Paid: 9000}, {Email: bob}, {Email: charlie}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Complete(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := IssuePaidLink(tr.ID, "Bob@test.com", alice, 3000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Payer != bob || l.Payee != alice {
+		t.Errorf("Unexpected link %+v", l)
+	}
+	_, err = ParseSession(l.Token)
+	if err != ErrInvalidSession {
+		t.Errorf("expected the link not to be a session, got %v", err)
+	}
+	_, err = ParseInvite(l.Token)
+	if err != ErrInvalidInvite {
+		t.Errorf("expected the link not to be an invite, got %v", err)
+	}
+	_, err = MarkPaid(ctx, pdb, l.Token+"x")
+	if err != ErrInvalidPaidLink {
+		t.Errorf("expected ErrInvalidPaidLink for a tampered link, got %v", err)
+	}
+
+	// bob paid a part through the API already, only the rest is recorded
+	_, err = tr.RecordPayment(ctx, pdb, bob, alice, 1000, NewDate(Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := MarkPaid(ctx, pdb, l.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Payer != bob || p.Payee != alice || p.Amount != 2000 {
+		t.Errorf("Unexpected payment %+v", p)
+	}
+	_, err = MarkPaid(ctx, pdb, l.Token)
+	if err != ErrAlreadyPaid {
+		t.Errorf("expected ErrAlreadyPaid following the link twice, got %v", err)
+	}
+
+	l, err = IssuePaidLink(tr.ID, charlie, alice, 3000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	_, err = MarkPaid(ctx, pdb, l.Token)
+	if err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit applies JSON Patch (RFC 6902) documents to a trip, for
+// partial updates. Only the name, description, start date, and the list
+// of participants can be patched.
+
+package trip
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxTripName is the maximum length, in characters, of the name of a trip
+	maxTripName = 127
+	// maxTripDescription is the maximum length, in characters, of the description of a trip
+	maxTripDescription = 511
+)
+
+// ErrPatchTest is returned when a "test" operation of a patch fails
+var ErrPatchTest = errors.New("test operation failed")
+
+// PatchOp is an operation of a JSON Patch document
+type PatchOp struct {
+	// Op is one of "add", "remove", "replace" or "test"
+	Op string `json:"op"`
+	// Path is the JSON Pointer to the patched member of the trip
+	Path string `json:"path"`
+	// Value is the operand of "add", "replace" and "test"
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// PatchError tells which operation of a patch failed, and why
+type PatchError struct {
+	// Index is the position of the operation in the patch
+	Index int
+	// Op is the failed operation
+	Op PatchOp
+	// Err is the cause of the failure
+	Err error
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %v", e.Index, e.Op.Op, e.Op.Path, e.Err)
+}
+
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+// Rename changes the name of the trip, written to the DB by Save()
+func (trip *Trip) Rename(name string) error {
+	if name == "" || utf8.RuneCountInString(name) > maxTripName {
+		return fmt.Errorf("name must be between 1 and %d characters", maxTripName)
+	}
+	trip.Name = name
+	trip.nameLower = normalizeName(name)
+	trip.detailsChanged = true
+	return nil
+}
+
+// SetDescription changes the description of the trip, written to the DB by Save()
+func (trip *Trip) SetDescription(description string) error {
+	if utf8.RuneCountInString(description) > maxTripDescription {
+		return fmt.Errorf("description is longer than %d characters", maxTripDescription)
+	}
+	trip.Description = description
+	trip.detailsChanged = true
+	return nil
+}
+
+// SetStartDate changes the start date of the trip, written to the DB by Save()
+func (trip *Trip) SetStartDate(startDate Date) {
+	trip.StartDate = startDate
+	trip.detailsChanged = true
+}
+
+// dropParticipant removes the participant at the given index, the
+// participation is deleted by Save()
+func (trip *Trip) dropParticipant(idx int) error {
+	usr := trip.Participants[idx]
+	for _, e := range trip.Expenses {
+		if e.hasUser(usr.ID) {
+			return ErrParticipantInExpense
+		}
+	}
+	trip.Participants = append(trip.Participants[:idx], trip.Participants[idx+1:]...)
+	delete(trip.emailLookup, usr.Email)
+	delete(trip.RSVP, usr.Email)
+	trip.removed = append(trip.removed, usr)
+	return nil
+}
+
+// patchString decodes the value of an operation as a string
+func patchString(value json.RawMessage) (string, error) {
+	var s string
+	err := json.Unmarshal(value, &s)
+	if err != nil {
+		return "", fmt.Errorf("value must be a string")
+	}
+	return s, nil
+}
+
+// patchEmail decodes the value of a participant operation, either an
+// email address or a user object
+func patchEmail(value json.RawMessage) (string, error) {
+	email, err := patchString(value)
+	if err == nil {
+		return email, nil
+	}
+	var usr User
+	err = json.Unmarshal(value, &usr)
+	if err != nil || usr.Email == "" {
+		return "", fmt.Errorf("value must be an email address or a user")
+	}
+	return usr.Email, nil
+}
+
+// participantIndex parses the index of a "/participants/<index>" path. For
+// "add", the index can be the end of the list, which "-" also refers to.
+func (trip *Trip) participantIndex(ref string, add bool) (int, error) {
+	end := len(trip.Participants)
+	if add {
+		if ref == "-" {
+			return end, nil
+		}
+		end++
+	}
+	idx, err := strconv.Atoi(ref)
+	if err != nil || idx < 0 || idx >= end || (ref != "0" && strings.HasPrefix(ref, "0")) {
+		return 0, fmt.Errorf("invalid participant index %q", ref)
+	}
+	return idx, nil
+}
+
+// applyPatchOp applies a single operation to the trip
+func (trip *Trip) applyPatchOp(op PatchOp) error {
+	if op.Op != "remove" && op.Value == nil {
+		return fmt.Errorf("missing value")
+	}
+	switch op.Path {
+	case "/name":
+		name, err := patchString(op.Value)
+		if err != nil {
+			return err
+		}
+		switch op.Op {
+		case "add", "replace":
+			return trip.Rename(name)
+		case "test":
+			if name != trip.Name {
+				return ErrPatchTest
+			}
+			return nil
+		}
+	case "/description":
+		if op.Op == "remove" {
+			return trip.SetDescription("")
+		}
+		desc, err := patchString(op.Value)
+		if err != nil {
+			return err
+		}
+		switch op.Op {
+		case "add", "replace":
+			return trip.SetDescription(desc)
+		case "test":
+			if desc != trip.Description {
+				return ErrPatchTest
+			}
+			return nil
+		}
+	case "/start_date":
+		var d time.Time
+		if op.Op != "remove" {
+			v, err := patchString(op.Value)
+			if err == nil {
+				d, err = time.Parse(time.DateOnly, v)
+			}
+			if err != nil {
+				return fmt.Errorf("value must be a date in YYYY-MM-DD format")
+			}
+		}
+		switch op.Op {
+		case "add", "replace":
+			trip.SetStartDate(NewDate(d))
+			return nil
+		case "test":
+			if !NewDate(d).Equal(trip.StartDate.Time) {
+				return ErrPatchTest
+			}
+			return nil
+		}
+	default:
+		ref, ok := strings.CutPrefix(op.Path, "/participants/")
+		if !ok {
+			return fmt.Errorf("path is not patchable")
+		}
+		idx, err := trip.participantIndex(ref, op.Op == "add")
+		if err != nil {
+			return err
+		}
+		switch op.Op {
+		case "add":
+			// the participants are a set, their position doesn't matter
+			email, err := patchEmail(op.Value)
+			if err != nil {
+				return err
+			}
+			return trip.AddParticipant(email)
+		case "remove":
+			return trip.dropParticipant(idx)
+		case "test":
+			email, err := patchEmail(op.Value)
+			if err != nil {
+				return err
+			}
+			if normalizeEmail(email) != trip.Participants[idx].Email {
+				return ErrPatchTest
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported operation")
+}
+
+// ApplyPatch applies the operations of a JSON Patch document, in order, to
+// the trip. The changes are written to the DB by Save(). On error, a
+// *PatchError is returned, and the trip should be discarded as it may be
+// partially patched.
+func (trip *Trip) ApplyPatch(ops []PatchOp) error {
+	for i, op := range ops {
+		err := trip.applyPatchOp(op)
+		if err != nil {
+			return &PatchError{i, op, err}
+		}
+	}
+	return nil
+}
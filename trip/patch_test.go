@@ -0,0 +1,105 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the JSON Patch of trips.
+
+package trip
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// parsePatch decodes a JSON Patch document
+func parsePatch(t *testing.T, doc string) []PatchOp {
+	t.Helper()
+	var ops []PatchOp
+	err := json.Unmarshal([]byte(doc), &ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ops
+}
+
+// TestApplyPatch renames a trip, changes its participants, and checks
+// the changes are saved, and that a failed patch changes nothing
+func TestApplyPatch(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip J", alice, "Trip J", today, []string{bob, charlie})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(today, "ferry", []Participant{{alice, 0, 900}, {charlie, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = UpdateTrip(ctx, pdb, tr.ID, func(p *Trip) error {
+		return p.ApplyPatch(parsePatch(t, `[
+{"op": "test", "path": "/name", "value": "Trip J"},
+{"op": "replace", "path": "/name", "value": "Journey"},
+{"op": "remove", "path": "/description"},
+{"op": "replace", "path": "/start_date", "value": "2024-05-01"},
+{"op": "test", "path": "/participants/0", "value": "Bob@test.com"},
+{"op": "remove", "path": "/participants/0"},
+{"op": "add", "path": "/participants/-", "value": {"email": "david@test.com"}}
+]`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := LoadTripByID(ctx, pdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr2.Name != "Journey" || tr2.nameLower != "journey" || tr2.Description != "" ||
+		tr2.StartDate.Format(time.DateOnly) != "2024-05-01" {
+		t.Errorf("Unexpected details: %q, %q, %q, %v", tr2.Name, tr2.nameLower, tr2.Description, tr2.StartDate)
+	}
+	if len(tr2.Participants) != 2 || tr2.IsParticipant(bob) || !tr2.IsParticipant(charlie) || !tr2.IsParticipant(david) {
+		t.Errorf("Unexpected participants: %v", tr2.Participants)
+	}
+
+	cases := map[string]error{
+		`[{"op": "replace", "path": "/name", "value": "X"}, {"op": "test", "path": "/name", "value": "Y"}]`: ErrPatchTest,
+		`[{"op": "remove", "path": "/participants/0"}]`:                                                     ErrParticipantInExpense,
+		`[{"op": "replace", "path": "/owner", "value": "eve@test.com"}]`:                                    nil,
+		`[{"op": "move", "path": "/name", "from": "/description"}]`:                                         nil,
+		`[{"op": "remove", "path": "/participants/7"}]`:                                                     nil,
+		`[{"op": "replace", "path": "/start_date", "value": "May 1st"}]`:                                    nil,
+		`[{"op": "replace", "path": "/name", "value": ""}]`:                                                 nil,
+	}
+	for doc, want := range cases {
+		_, err = UpdateTrip(ctx, pdb, tr.ID, func(p *Trip) error {
+			return p.ApplyPatch(parsePatch(t, doc))
+		})
+		var perr *PatchError
+		if !errors.As(err, &perr) {
+			t.Errorf("Expect a PatchError for %s, got %v", doc, err)
+			continue
+		}
+		if want != nil && !errors.Is(err, want) {
+			t.Errorf("Expect %v for %s, got %v", want, doc, err)
+		}
+	}
+	tr3, err := LoadTripByID(ctx, pdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr3.Name != "Journey" || len(tr3.Participants) != 2 {
+		t.Errorf("A failed patch changed the trip: %q, %v", tr3.Name, tr3.Participants)
+	}
+}
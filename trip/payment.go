@@ -0,0 +1,194 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit records the payments of the settlement of a trip, in full or
+// in part, e.g. Bob paid Alice $20 on 2024-05-01. They're netted against
+// the settlement, so that it shows what remains to be paid.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	paymentInsert = `INSERT INTO settlement_payment (trip_id, payer, payee, amount, paid_on, created_at)
+VALUES (?, ?, ?, ?, ?, ?)`
+	paymentSelect = `SELECT sp.payment_id, sp.trip_id, pu.email, ru.email, sp.amount, sp.paid_on, sp.created_at
+FROM settlement_payment AS sp, tuser AS pu, tuser AS ru
+WHERE sp.payer = pu.user_id
+AND sp.payee = ru.user_id
+AND sp.trip_id = ?`
+	paymentOrder  = "\nORDER BY sp.payment_id"
+	paymentByID   = "\nAND sp.payment_id = ?"
+	paymentAsOf   = "\nAND sp.created_at <= ?"
+	paymentDelete = "DELETE FROM settlement_payment WHERE trip_id = ? AND payment_id = ?"
+)
+
+// Payment is a payment of the settlement of a trip, from a payer to a
+// payee, the whole amount owed or a part of it
+type Payment struct {
+	// ID is the primary key and is from a sequence
+	ID     int64 `json:"payment_id"`
+	TripID int64 `json:"trip_id"`
+	// Payer is the email address of the participant who paid
+	Payer string `json:"payer"`
+	// Payee is the email address of the participant paid
+	Payee string `json:"payee"`
+	// Amount is in cent
+	Amount int `json:"amount"`
+	// PaidOn is the date of the payment in `YYYY-MM-DD` format
+	PaidOn Date `json:"paid_on"`
+	// CreatedAt is when the payment was recorded
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RecordPayment records that the payer paid the amount to the payee on
+// the date, both part of the trip. An error wrapping ErrUnknownParticipant
+// is returned if either isn't, ErrTripArchived if the trip is archived.
+func (trip *Trip) RecordPayment(ctx context.Context, db *sql.DB, payer, payee string, amount int, paidOn Date) (*Payment, error) {
+	if trip.Archived {
+		return nil, ErrTripArchived
+	}
+	p := &Payment{
+		TripID:    trip.ID,
+		Payer:     normalizeEmail(payer),
+		Payee:     normalizeEmail(payee),
+		Amount:    amount,
+		PaidOn:    NewDate(paidOn.Time),
+		CreatedAt: Now().UTC().Truncate(time.Microsecond),
+	}
+	ids := make([]int64, 2)
+	for i, email := range []string{p.Payer, p.Payee} {
+		id, ok := trip.emailLookup[email]
+		if !ok {
+			return nil, fmt.Errorf("%s is %w", email, ErrUnknownParticipant)
+		}
+		ids[i] = id
+	}
+	if p.Payer == p.Payee {
+		return nil, fmt.Errorf("'%s' can't pay themselves", p.Payer)
+	}
+	if p.Amount <= 0 {
+		return nil, errors.New("the amount of a payment must be positive")
+	}
+	rslt, err := db.ExecContext(ctx, paymentInsert, p.TripID, ids[0], ids[1], p.Amount, p.PaidOn.Unix(), p.CreatedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	p.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "%s paid %d to %s in trip %d\n", p.Payer, p.Amount, p.Payee, p.TripID)
+	return p, nil
+}
+
+// LoadPayments returns the payments recorded for the trip, in the order
+// they were recorded. sql.ErrNoRows is returned if there's no such trip.
+func LoadPayments(ctx context.Context, db *sql.DB, tripID int64) ([]*Payment, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, tripExistsSelect, tripID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	return queryPayments(ctx, db, paymentSelect+paymentOrder, tripID)
+}
+
+// queryPayments returns the payments of the query
+func queryPayments(ctx context.Context, db *sql.DB, query string, args ...any) ([]*Payment, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*Payment{}
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, p)
+	}
+	return rslt, rows.Err()
+}
+
+// LoadPayment returns a payment recorded for the trip, sql.ErrNoRows if
+// there's none
+func LoadPayment(ctx context.Context, db *sql.DB, tripID, paymentID int64) (*Payment, error) {
+	return scanPayment(db.QueryRowContext(ctx, paymentSelect+paymentByID, tripID, paymentID))
+}
+
+// scanPayment reads a payment from a row
+func scanPayment(row interface{ Scan(...any) error }) (*Payment, error) {
+	p := new(Payment)
+	var paidOn, createdAt int64
+	err := row.Scan(&p.ID, &p.TripID, &p.Payer, &p.Payee, &p.Amount, &paidOn, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	p.PaidOn = epochToDate(paidOn)
+	p.CreatedAt = time.UnixMicro(createdAt).UTC()
+	return p, nil
+}
+
+// DeletePayment deletes a payment recorded for the trip, e.g. entered by
+// mistake, sql.ErrNoRows is returned if there's none
+func DeletePayment(ctx context.Context, db *sql.DB, tripID, paymentID int64) error {
+	res, err := db.ExecContext(ctx, paymentDelete, tripID, paymentID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	Logf(ctx, "Deleted payment %d of trip %d\n", paymentID, tripID)
+	return nil
+}
+
+// Remaining returns a copy of the Settlement less the payments, what
+// remains to be paid. A payment larger than what was owed is owed back by
+// the payee.
+func (s Settlement) Remaining(paid []*Payment) Settlement {
+	rslt := make(Settlement, len(s))
+	for payer, payments := range s {
+		rslt[payer] = make(Payments, len(payments))
+		for payee, amount := range payments {
+			rslt[payer][payee] = amount
+		}
+	}
+	for _, p := range paid {
+		rslt.add(p.Payee, p.Payer, p.Amount)
+	}
+	for payer, payments := range rslt {
+		if len(payments) == 0 {
+			delete(rslt, payer)
+		}
+	}
+	return rslt
+}
+
+// RemainingSettlement returns what remains to be paid of the Settlement of
+// the trip, less the payments recorded up to asOf, all of them if it's
+// the zero time
+func RemainingSettlement(ctx context.Context, db *sql.DB, tripID int64, s Settlement, asOf time.Time) (Settlement, error) {
+	query, args := paymentSelect, []any{tripID}
+	if !asOf.IsZero() {
+		query, args = query+paymentAsOf, append(args, asOf.UnixMicro())
+	}
+	payments, err := queryPayments(ctx, db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return s.Remaining(payments), nil
+}
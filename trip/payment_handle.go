@@ -0,0 +1,239 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the payment handles of the users: where they want
+// to be paid, for the settlements to tell the debtors where to send the
+// money, with the links opening the payments. They're validated and
+// normalized here, nothing is paid through them.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Some global constants used to store SQL statements
+const (
+	paymentHandlesUpdate = "UPDATE tuser SET venmo = ?, paypal_me = ?, iban = ? WHERE email = ?"
+	paymentHandlesSelect = `SELECT u.email, u.venmo, u.paypal_me, u.iban
+FROM tuser AS u, participant AS p
+WHERE u.user_id = p.user_id
+AND p.trip_id = ?
+AND (u.venmo <> '' OR u.paypal_me <> '' OR u.iban <> '')`
+	sharedTripSelect = `SELECT COUNT(*)
+FROM participant AS p, participant AS q, tuser AS u, tuser AS v, trip AS t
+WHERE p.trip_id = q.trip_id
+AND t.trip_id = p.trip_id
+AND t.deleted_at = 0
+AND u.user_id = p.user_id
+AND v.user_id = q.user_id
+AND u.email = ?
+AND v.email = ?`
+)
+
+// PaymentHandles are where a user wants to be paid, the empty ones aren't
+// set
+type PaymentHandles struct {
+	// Venmo is the Venmo username, without the @
+	Venmo string `json:"venmo,omitempty"`
+	// PayPalMe is the PayPal.me link, e.g. https://paypal.me/alice
+	PayPalMe string `json:"paypal_me,omitempty"`
+	// IBAN is the International Bank Account Number, without the spaces
+	IBAN string `json:"iban,omitempty"`
+}
+
+var (
+	// venmoUsername matches the Venmo usernames
+	venmoUsername = regexp.MustCompile(`^[A-Za-z0-9_-]{5,30}$`)
+	// paypalMeName matches the names of the PayPal.me links
+	paypalMeName = regexp.MustCompile(`^[A-Za-z0-9]{1,20}$`)
+	// ibanFormat matches the IBANs: the country, the check digits, and up
+	// to 30 characters of account number
+	ibanFormat = regexp.MustCompile(`^[A-Z]{2}[0-9]{2}[A-Z0-9]{11,30}$`)
+)
+
+// normalize validates the handles, and returns them in their canonical
+// form: the Venmo username without the @, the PayPal.me link as
+// https://paypal.me/<name>, the IBAN in upper case without the spaces
+func (h PaymentHandles) normalize() (PaymentHandles, error) {
+	venmo := strings.TrimPrefix(strings.TrimSpace(h.Venmo), "@")
+	if venmo != "" && !venmoUsername.MatchString(venmo) {
+		return h, fmt.Errorf("invalid Venmo username %q", h.Venmo)
+	}
+	paypalMe := strings.TrimSpace(h.PayPalMe)
+	if paypalMe != "" {
+		name := strings.TrimSuffix(paypalMe, "/")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "https://"), "http://")
+		name = strings.TrimPrefix(name, "www.")
+		if base, rest, ok := strings.Cut(name, "/"); ok {
+			if !strings.EqualFold(base, "paypal.me") {
+				return h, fmt.Errorf("invalid PayPal.me link %q", h.PayPalMe)
+			}
+			name = rest
+		}
+		if !paypalMeName.MatchString(name) {
+			return h, fmt.Errorf("invalid PayPal.me link %q", h.PayPalMe)
+		}
+		paypalMe = "https://paypal.me/" + name
+	}
+	iban := strings.ToUpper(strings.Join(strings.Fields(h.IBAN), ""))
+	if iban != "" && (!ibanFormat.MatchString(iban) || !ibanChecksum(iban)) {
+		return h, fmt.Errorf("invalid IBAN %q", h.IBAN)
+	}
+	return PaymentHandles{Venmo: venmo, PayPalMe: paypalMe, IBAN: iban}, nil
+}
+
+// ibanChecksum tells whether the check digits of the IBAN are right: moved
+// to the end with the country, its letters as numbers from 10 for A, the
+// number modulo 97 is 1
+func ibanChecksum(iban string) bool {
+	var digits strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		if c >= 'A' && c <= 'Z' {
+			fmt.Fprintf(&digits, "%d", c-'A'+10)
+		} else {
+			digits.WriteRune(c)
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// UpdatePaymentHandles sets where the user of the email address wants to
+// be paid, replacing the handles they had, the empty ones removed, and
+// returns their profile. sql.ErrNoRows is returned if there's no such user,
+// they aren't created.
+func UpdatePaymentHandles(ctx context.Context, db *sql.DB, email string, h PaymentHandles) (*Profile, error) {
+	h, err := h.normalize()
+	if err != nil {
+		return nil, err
+	}
+	rslt, err := db.ExecContext(ctx, paymentHandlesUpdate, h.Venmo, h.PayPalMe, h.IBAN, normalizeEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return nil, sql.ErrNoRows
+	}
+	Logf(ctx, "Set the payment handles of %s\n", normalizeEmail(email))
+	return LoadProfile(ctx, db, email)
+}
+
+// LoadPaymentHandles returns the payment handles of the owner and the
+// participants of the trip, by email address, the ones without aside
+func LoadPaymentHandles(ctx context.Context, db *sql.DB, tripID int64) (map[string]PaymentHandles, error) {
+	rows, err := db.QueryContext(ctx, paymentHandlesSelect, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := make(map[string]PaymentHandles)
+	for rows.Next() {
+		var email string
+		var h PaymentHandles
+		err = rows.Scan(&email, &h.Venmo, &h.PayPalMe, &h.IBAN)
+		if err != nil {
+			return nil, err
+		}
+		rslt[email] = h
+	}
+	return rslt, rows.Err()
+}
+
+// SharesTrip tells whether the users of the email addresses are the owner
+// or participants of a same trip, not deleted, the one who settles with the
+// other being told their payment handles
+func SharesTrip(ctx context.Context, db *sql.DB, email, other string) (bool, error) {
+	var cnt int
+	err := db.QueryRowContext(ctx, sharedTripSelect, normalizeEmail(email), normalizeEmail(other)).Scan(&cnt)
+	return cnt > 0, err
+}
+
+// Payees returns the people paid in the settlement, in no particular order
+func (s Settlement) Payees() []string {
+	seen := make(map[string]bool)
+	var rslt []string
+	for _, payments := range s {
+		for payee, amount := range payments {
+			if amount > 0 && !seen[payee] {
+				seen[payee] = true
+				rslt = append(rslt, payee)
+			}
+		}
+	}
+	return rslt
+}
+
+// PaymentLinks are the links opening the payment of a transfer of a
+// settlement, one per handle of the payee, the empty ones aren't set
+type PaymentLinks struct {
+	// Venmo opens the payment in the Venmo app, the amount and the note
+	// filled in
+	Venmo string `json:"venmo,omitempty"`
+	// PayPal opens the PayPal.me page of the payee, the amount filled in
+	PayPal string `json:"paypal,omitempty"`
+	// Payto is the RFC 8905 payto URI of the IBAN, opened by the banking
+	// apps. It doesn't carry the amount, which needs a currency.
+	Payto string `json:"payto,omitempty"`
+}
+
+// decimalAmount returns the amount in cent as a decimal number, e.g. 20.50
+func decimalAmount(amount int) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+// linksOf returns the links paying the amount to the handles, with the
+// note, false if the payee has none
+func (h PaymentHandles) linksOf(amount int, note string) (PaymentLinks, bool) {
+	var links PaymentLinks
+	if h.Venmo != "" {
+		q := url.Values{
+			"txn":        {"pay"},
+			"recipients": {h.Venmo},
+			"amount":     {decimalAmount(amount)},
+			"note":       {note},
+		}
+		links.Venmo = "venmo://paycharge?" + q.Encode()
+	}
+	if h.PayPalMe != "" {
+		links.PayPal = h.PayPalMe + "/" + decimalAmount(amount)
+	}
+	if h.IBAN != "" {
+		links.Payto = "payto://iban/" + h.IBAN + "?" + url.Values{"message": {note}}.Encode()
+	}
+	return links, links != PaymentLinks{}
+}
+
+// PaymentLinks returns the links of the transfers of the settlement to
+// the payees with payment handles, by payer then payee, the note being the
+// message of the payments, e.g. the name of the trip
+func (s Settlement) PaymentLinks(handles map[string]PaymentHandles, note string) map[string]map[string]PaymentLinks {
+	rslt := make(map[string]map[string]PaymentLinks)
+	for payer, payments := range s {
+		for payee, amount := range payments {
+			if amount <= 0 {
+				continue
+			}
+			links, ok := handles[payee].linksOf(amount, note)
+			if !ok {
+				continue
+			}
+			if rslt[payer] == nil {
+				rslt[payer] = make(map[string]PaymentLinks)
+			}
+			rslt[payer][payee] = links
+		}
+	}
+	return rslt
+}
@@ -0,0 +1,128 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the payments of the settlements.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	settlementPaymentCreate = `CREATE TABLE IF NOT EXISTS settlement_payment (
+payment_id INTEGER CONSTRAINT settlement_payment_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+amount INTEGER NOT NULL,
+paid_on INTEGER NOT NULL,
+created_at INTEGER NOT NULL)`
+	settlementPaymentTripIndex = "CREATE INDEX IF NOT EXISTS settlement_payment_trip_index ON settlement_payment(trip_id)"
+)
+
+// TestPayments records payments of the settlement of a trip, in part and
+// in full, and checks what remains to be paid
+func TestPayments(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Hour).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Payments", alice, "", NewDate(start), []string{bob, charlie})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(start), "Dinner", []Participant{{Email: alice, Paid: 9000}, {Email: bob}, {Email: charlie}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := PreviewSettlement(ctx, pdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Settlement{bob: {alice: 3000}, charlie: {alice: 3000}}); !reflect.DeepEqual(s, want) {
+		t.Fatalf("Unexpected settlement %v", s)
+	}
+
+	_, err = tr.RecordPayment(ctx, pdb, bob, david, 100, NewDate(start))
+	if !errors.Is(err, ErrUnknownParticipant) {
+		t.Errorf("expected a non-participant to be refused, got %v", err)
+	}
+	for _, amount := range []int{0, -100} {
+		if _, err = tr.RecordPayment(ctx, pdb, bob, alice, amount, NewDate(start)); err == nil {
+			t.Errorf("expected an amount of %d to be refused", amount)
+		}
+	}
+	if _, err = tr.RecordPayment(ctx, pdb, bob, bob, 100, NewDate(start)); err == nil {
+		t.Error("expected a payment to oneself to be refused")
+	}
+
+	first, err := tr.RecordPayment(ctx, pdb, "Bob@test.com", alice, 2000, NewDate(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asOf := Now()
+	_, err = tr.RecordPayment(ctx, pdb, charlie, alice, 3500, NewDate(start.AddDate(0, 0, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := LoadPayments(ctx, pdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].Payer != bob || payments[1].PaidOn != NewDate(start.AddDate(0, 0, 1)) {
+		t.Fatalf("Unexpected payments %+v", payments)
+	}
+
+	remaining, err := RemainingSettlement(ctx, pdb, tr.ID, s, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// charlie paid too much, alice owes the difference back
+	if want := (Settlement{bob: {alice: 1000}, alice: {charlie: 500}}); !reflect.DeepEqual(remaining, want) {
+		t.Errorf("Unexpected remaining settlement %v", remaining)
+	}
+	remaining, err = RemainingSettlement(ctx, pdb, tr.ID, s, asOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Settlement{bob: {alice: 1000}, charlie: {alice: 3000}}); !reflect.DeepEqual(remaining, want) {
+		t.Errorf("Unexpected remaining settlement as of %v: %v", asOf, remaining)
+	}
+	if s[bob][alice] != 3000 {
+		t.Errorf("expected the settlement left unchanged, got %v", s)
+	}
+
+	loaded, err := LoadPayment(ctx, pdb, tr.ID, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, first) {
+		t.Errorf("expected %+v, got %+v", first, loaded)
+	}
+	err = DeletePayment(ctx, pdb, tr.ID, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DeletePayment(ctx, pdb, tr.ID, first.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows deleting again, got %v", err)
+	}
+	if _, err = LoadPayments(ctx, pdb, 999); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown trip, got %v", err)
+	}
+}
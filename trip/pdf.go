@@ -0,0 +1,129 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements a minimal PDF writer, only able to lay out lines
+// of plain text, which is all the reports need.
+
+package trip
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// pdfPageWidth and pdfPageHeight are the size of a US Letter page in points
+	pdfPageWidth  = 612
+	pdfPageHeight = 792
+	// pdfMargin is the margin around the text in points
+	pdfMargin = 54
+	// pdfFontSize is the size of the Helvetica font in points
+	pdfFontSize = 10
+	// pdfLeading is the distance between 2 lines of text in points
+	pdfLeading = 14
+	// pdfLinesPerPage is the number of lines fitting in a page
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLeading
+)
+
+// instanceName heads the printable reports, see SetInstanceName()
+var instanceName = "Trip Accountant"
+
+// SetInstanceName sets the name of the instance heading the printable
+// reports, e.g. the club hosting it. It's meant to be called before serving
+// any request.
+func SetInstanceName(name string) {
+	instanceName = name
+}
+
+// pdfEscape escapes a line of text for a PDF string literal. Characters
+// outside of printable ASCII are replaced by '?', as only the standard
+// encoding of the base fonts is used.
+func pdfEscape(line string) string {
+	var b strings.Builder
+	for _, r := range line {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r < ' ' || r > '~':
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// textPDF renders the lines of text into a PDF document, breaking them
+// into as many pages as needed
+func textPDF(lines []string) []byte {
+	var pages [][]string
+	for len(lines) > pdfLinesPerPage {
+		pages = append(pages, lines[:pdfLinesPerPage])
+		lines = lines[pdfLinesPerPage:]
+	}
+	pages = append(pages, lines)
+
+	// Objects are numbered from 1: the catalog, the page tree, the font,
+	// then a page and its content stream for each page
+	var objs []string
+	kids := []string{}
+	for i := range pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 4+2*i))
+	}
+	objs = append(objs, "<< /Type /Catalog /Pages 2 0 R >>")
+	objs = append(objs, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	objs = append(objs, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLeading, pdfMargin, pdfPageHeight-pdfMargin)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfEscape(line))
+		}
+		content.WriteString("ET")
+		objs = append(objs, fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, 5+2*i))
+		objs = append(objs, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for i, obj := range objs {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return out.Bytes()
+}
+
+// pdfLines returns the lines of text of a PDF document rendered by
+// textPDF(), the tabs expanded
+func pdfLines(pdf []byte) []string {
+	var lines []string
+	for _, l := range strings.Split(string(pdf), "\n") {
+		if !strings.HasPrefix(l, "(") || !strings.HasSuffix(l, ") '") {
+			continue
+		}
+		l = strings.TrimSuffix(strings.TrimPrefix(l, "("), ") '")
+		var b strings.Builder
+		for i := 0; i < len(l); i++ {
+			if l[i] == '\\' && i+1 < len(l) {
+				i++
+			}
+			b.WriteByte(l[i])
+		}
+		lines = append(lines, b.String())
+	}
+	return lines
+}
@@ -0,0 +1,208 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit focuses on the cost questionnaire of a trip. Before the trip,
+// the participants declare the ceiling of their share and the categories
+// of expenses they'll share. The owner gets the aggregated answers, and
+// the expenses of a category are split by default among the participants
+// sharing it.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	preferenceSelect = `SELECT u.email, c.budget, c.categories, c.updated_at
+FROM cost_preference AS c, tuser AS u
+WHERE c.user_id = u.user_id
+AND c.trip_id = ?
+ORDER BY u.email`
+	preferenceUpsert = `INSERT INTO cost_preference (trip_id, user_id, budget, categories, updated_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (trip_id, user_id) DO UPDATE SET budget = excluded.budget,
+categories = excluded.categories, updated_at = excluded.updated_at`
+)
+
+// Categories are the categories of expenses of the questionnaire
+var Categories = []string{"lodging", "food", "drinks", "transport", "activities", "shopping", "other"}
+
+// CostPreference is the answer of a participant to the cost questionnaire
+type CostPreference struct {
+	// Email is the email address of the participant
+	Email string `json:"user"`
+	// Budget is the ceiling of the share of the participant (in cent), 0
+	// if there's none
+	Budget int `json:"budget"`
+	// Categories are the categories of expenses the participant shares,
+	// all of them if it's empty
+	Categories []string `json:"categories"`
+	// UpdatedAt is when the participant last answered
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Shares tells whether the participant shares the expenses of a category
+func (p CostPreference) Shares(category string) bool {
+	return len(p.Categories) == 0 || slices.Contains(p.Categories, category)
+}
+
+// CostSurvey is the aggregate of the answers to the cost questionnaire of
+// a trip. The individual answers aren't part of it.
+type CostSurvey struct {
+	// Participants is the number of participants, including the owner
+	Participants int `json:"participants"`
+	// Responses is the number of participants who answered
+	Responses int `json:"responses"`
+	// Pending are the participants who haven't answered
+	Pending []string `json:"pending"`
+	// LowestBudget is the lowest ceiling declared (in cent), 0 if there's
+	// none
+	LowestBudget int `json:"lowest_budget"`
+	// MedianBudget is the median of the ceilings declared (in cent)
+	MedianBudget int `json:"median_budget"`
+	// Sharing is the number of participants sharing each category, the
+	// participants who haven't answered share all of them
+	Sharing map[string]int `json:"sharing"`
+}
+
+// normalizeCategories checks the categories, and returns them lower-cased,
+// sorted and without duplicates
+func normalizeCategories(categories []string) ([]string, error) {
+	rslt := []string{}
+	for _, c := range categories {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if !slices.Contains(Categories, c) {
+			return nil, fmt.Errorf("unknown category '%s', expecting one of %s", c, strings.Join(Categories, ", "))
+		}
+		if !slices.Contains(rslt, c) {
+			rslt = append(rslt, c)
+		}
+	}
+	sort.Strings(rslt)
+	return rslt, nil
+}
+
+// LoadCostPreferences returns the answers to the cost questionnaire of
+// the trip, by email address
+func (trip *Trip) LoadCostPreferences(ctx context.Context, db *sql.DB) ([]CostPreference, error) {
+	rows, err := db.QueryContext(ctx, preferenceSelect, trip.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := []CostPreference{}
+	for rows.Next() {
+		var p CostPreference
+		var categories string
+		var updatedAt int64
+		err = rows.Scan(&p.Email, &p.Budget, &categories, &updatedAt)
+		if err != nil {
+			return nil, err
+		}
+		p.Categories = []string{}
+		if categories != "" {
+			p.Categories = strings.Split(categories, ",")
+		}
+		p.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		rslt = append(rslt, p)
+	}
+	return rslt, rows.Err()
+}
+
+// SaveCostPreference records the answer of a participant to the cost
+// questionnaire, replacing their previous one. The saved answer is
+// returned.
+func (trip *Trip) SaveCostPreference(ctx context.Context, db *sql.DB, p CostPreference) (CostPreference, error) {
+	p.Email = normalizeEmail(p.Email)
+	userID, ok := trip.emailLookup[p.Email]
+	if !ok {
+		return p, fmt.Errorf("'%s' is not part of the trip", p.Email)
+	}
+	if p.Budget < 0 {
+		return p, fmt.Errorf("invalid budget %d", p.Budget)
+	}
+	categories, err := normalizeCategories(p.Categories)
+	if err != nil {
+		return p, err
+	}
+	p.Categories = categories
+	p.UpdatedAt = Now().UTC().Truncate(time.Second)
+	_, err = db.ExecContext(ctx, preferenceUpsert, trip.ID, userID, p.Budget,
+		strings.Join(p.Categories, ","), p.UpdatedAt.Unix())
+	return p, err
+}
+
+// CostSurvey aggregates the answers to the cost questionnaire of the trip
+func (trip *Trip) CostSurvey(prefs []CostPreference) CostSurvey {
+	people := trip.people()
+	rslt := CostSurvey{
+		Participants: len(people),
+		Pending:      []string{},
+		Sharing:      make(map[string]int, len(Categories)),
+	}
+	byEmail := make(map[string]CostPreference, len(prefs))
+	for _, p := range prefs {
+		byEmail[p.Email] = p
+	}
+
+	var budgets []int
+	for _, email := range people {
+		p, ok := byEmail[email]
+		if ok {
+			rslt.Responses++
+			if p.Budget > 0 {
+				budgets = append(budgets, p.Budget)
+			}
+		} else {
+			rslt.Pending = append(rslt.Pending, email)
+		}
+		for _, c := range Categories {
+			if !ok || p.Shares(c) {
+				rslt.Sharing[c]++
+			}
+		}
+	}
+	if len(budgets) > 0 {
+		sort.Ints(budgets)
+		rslt.LowestBudget = budgets[0]
+		n := len(budgets)
+		rslt.MedianBudget = budgets[n/2]
+		if n%2 == 0 {
+			rslt.MedianBudget = (budgets[n/2-1] + budgets[n/2]) / 2
+		}
+	}
+	sort.Strings(rslt.Pending)
+	return rslt
+}
+
+// DefaultSplit returns the participants sharing the expenses of a
+// category according to their answers, the participants who haven't
+// answered share them all. The participants who declined the trip are
+// left out, see Sharers().
+func (trip *Trip) DefaultSplit(prefs []CostPreference, category string) ([]string, error) {
+	category = strings.ToLower(category)
+	if !slices.Contains(Categories, category) {
+		return nil, fmt.Errorf("unknown category '%s', expecting one of %s", category, strings.Join(Categories, ", "))
+	}
+	byEmail := make(map[string]CostPreference, len(prefs))
+	for _, p := range prefs {
+		byEmail[p.Email] = p
+	}
+	rslt := []string{}
+	for _, email := range trip.Sharers() {
+		if p, ok := byEmail[email]; !ok || p.Shares(category) {
+			rslt = append(rslt, email)
+		}
+	}
+	return rslt, nil
+}
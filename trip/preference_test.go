@@ -0,0 +1,98 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the cost questionnaire.
+
+package trip
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	costPreferenceCreate = `CREATE TABLE IF NOT EXISTS cost_preference (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+budget INTEGER NOT NULL DEFAULT 0,
+categories TEXT NOT NULL DEFAULT '',
+updated_at INTEGER NOT NULL,
+CONSTRAINT cost_preference_pkey PRIMARY KEY (trip_id, user_id))`
+)
+
+// TestCostPreferences has Bob and Charlie answer the questionnaire, then
+// checks the aggregate and the default splits
+func TestCostPreferences(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip Q", alice, "", today, []string{bob, charlie, david})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = tr.SaveCostPreference(ctx, pdb, CostPreference{Email: "nobody@test.com"})
+	if err == nil {
+		t.Error("expected an error for a non-participant")
+	}
+	_, err = tr.SaveCostPreference(ctx, pdb, CostPreference{Email: bob, Categories: []string{"yachts"}})
+	if err == nil {
+		t.Error("expected an error for an unknown category")
+	}
+	// Bob doesn't drink, and changes their mind about the budget
+	for _, budget := range []int{50000, 40000} {
+		_, err = tr.SaveCostPreference(ctx, pdb, CostPreference{Email: "BOB@test.com", Budget: budget,
+			Categories: []string{"Lodging", "food", "transport", "food"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = tr.SaveCostPreference(ctx, pdb, CostPreference{Email: charlie, Budget: 80000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.SaveCostPreference(ctx, pdb, CostPreference{Email: david, Budget: 100000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefs, err := tr.LoadCostPreferences(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prefs) != 3 || prefs[0].Email != bob || prefs[0].Budget != 40000 {
+		t.Fatalf("expected the answers of Bob, Charlie and David, got %+v", prefs)
+	}
+	if want := []string{"food", "lodging", "transport"}; !reflect.DeepEqual(prefs[0].Categories, want) {
+		t.Errorf("expected %v, got %v", want, prefs[0].Categories)
+	}
+
+	survey := tr.CostSurvey(prefs)
+	if survey.Participants != 4 || survey.Responses != 3 || !reflect.DeepEqual(survey.Pending, []string{alice}) {
+		t.Errorf("expected 3 answers out of 4, Alice pending, got %+v", survey)
+	}
+	if survey.LowestBudget != 40000 || survey.MedianBudget != 80000 {
+		t.Errorf("expected the lowest budget 40000 and the median 80000, got %+v", survey)
+	}
+	if survey.Sharing["drinks"] != 3 || survey.Sharing["food"] != 4 {
+		t.Errorf("expected 3 sharing the drinks and 4 the food, got %v", survey.Sharing)
+	}
+
+	split, err := tr.DefaultSplit(prefs, "Drinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{alice, charlie, david}; !reflect.DeepEqual(split, want) {
+		t.Errorf("expected %v, got %v", want, split)
+	}
+	_, err = tr.DefaultSplit(prefs, "yachts")
+	if err == nil {
+		t.Error("expected an error for an unknown category")
+	}
+}
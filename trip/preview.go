@@ -0,0 +1,55 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit previews an expense before it's added to a trip: the share of
+// each participant, and who will owe whom, computed the same way as once
+// the expense is saved.
+
+package trip
+
+import (
+	"sort"
+)
+
+// ExpensePreview is what an expense would mean for its participants
+type ExpensePreview struct {
+	// Total is the amount of the expense (in cent)
+	Total int `json:"total"`
+	// Shares are the amount paid, the share, and the net position of each
+	// participant of the expense, by email address. The expense is split
+	// equally, each share rounded to the nearest cent.
+	Shares []Balance `json:"shares"`
+	// Settlement is the settlement of the expense alone
+	Settlement Settlement `json:"settlement"`
+	// EnvelopeWarnings are the budget envelopes the expense would blow,
+	// see EnvelopeWarnings()
+	EnvelopeWarnings []EnvelopeAlert `json:"envelope_warnings,omitempty"`
+}
+
+// PreviewExpense computes the ExpensePreview of an expense as it would be
+// added by AddExpense(), without changing the trip. The participants must
+// be part of the trip.
+func (trip *Trip) PreviewExpense(date Date, description string, participants []Participant) (*ExpensePreview, error) {
+	expense, err := trip.newExpense(date, description, participants)
+	if err != nil {
+		return nil, err
+	}
+	share := expense.share()
+	rslt := &ExpensePreview{
+		Total:      expense.amount,
+		Shares:     []Balance{},
+		Settlement: expense.Settle(),
+	}
+	for _, p := range expense.Participants {
+		rslt.Shares = append(rslt.Shares, Balance{
+			Email:    p.Email,
+			Paid:     p.Paid,
+			Share:    share,
+			Net:      p.Paid - share,
+			Position: positionOf(p.Paid - share),
+		})
+	}
+	sort.Slice(rslt.Shares, func(i, j int) bool { return rslt.Shares[i].Email < rslt.Shares[j].Email })
+	return rslt, nil
+}
@@ -0,0 +1,60 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the expense previews.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestPreviewExpense checks the shares and settlement of a previewed
+// expense, and that the trip isn't changed
+func TestPreviewExpense(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip P", alice, "", today, []string{bob, charlie})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preview, err := tr.PreviewExpense(today, "taxi", []Participant{{charlie, 0, 0}, {alice, 0, 1000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Total != 1000 {
+		t.Errorf("expected a total of 1000, got %d", preview.Total)
+	}
+	expected := []Balance{
+		{alice, 1000, 333, 0, 667, Creditor},
+		{bob, 0, 333, 0, -333, Debtor},
+		{charlie, 0, 333, 0, -333, Debtor},
+	}
+	if len(preview.Shares) != len(expected) {
+		t.Fatalf("expected %d shares, got %v", len(expected), preview.Shares)
+	}
+	for i, b := range expected {
+		if preview.Shares[i] != b {
+			t.Errorf("share %d: expected %v, got %v", i, b, preview.Shares[i])
+		}
+	}
+	if preview.Settlement[bob][alice] != 333 || preview.Settlement[charlie][alice] != 333 {
+		t.Errorf("unexpected settlement %v", preview.Settlement)
+	}
+	if len(tr.Expenses) != 0 || tr.totalExpense != 0 {
+		t.Errorf("the preview changed the trip: %v", tr.Expenses)
+	}
+
+	_, err = tr.PreviewExpense(today, "taxi", []Participant{{alice, 0, 1000}, {david, 0, 0}})
+	if err == nil {
+		t.Error("expected an error for a participant not part of the trip")
+	}
+}
@@ -0,0 +1,357 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the push notifications of the mobile apps: the
+// users register the tokens of their devices, and the events of the trips
+// are queued for the devices of their people along with the webhooks, see
+// queueEvent(), then pushed by DeliverPushes(), until they're accepted.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	deviceUpsert = `INSERT INTO push_device (user_id, platform, token, created_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (token) DO UPDATE SET user_id = excluded.user_id, platform = excluded.platform,
+created_at = excluded.created_at`
+	deviceColumns = `SELECT d.device_id, u.email, d.platform, d.created_at
+FROM push_device AS d, tuser AS u
+WHERE d.user_id = u.user_id`
+	deviceByTokenSelect = deviceColumns + " AND d.token = ?"
+	devicesByUserSelect = deviceColumns + " AND u.email = ? ORDER BY d.device_id"
+	deviceDelete        = `DELETE FROM push_device WHERE device_id = ?
+AND user_id IN (SELECT user_id FROM tuser WHERE email = ?)`
+	deviceGoneDelete = "DELETE FROM push_device WHERE device_id = ?"
+	devicePushesDel  = "DELETE FROM push_delivery WHERE device_id = ?"
+	devicesOfTrip    = `SELECT d.device_id, u.email FROM push_device AS d, participant AS p, tuser AS u, trip AS t
+WHERE p.user_id = d.user_id AND u.user_id = d.user_id AND t.trip_id = p.trip_id AND p.trip_id = ?
+AND t.deleted_at = 0
+ORDER BY d.device_id`
+	tripNameSelect = "SELECT name FROM trip WHERE trip_id = ? AND deleted_at = 0"
+	pushInsert     = `INSERT INTO push_delivery (device_id, trip_id, event, title, body, created_at, next_attempt_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+	pushesDue = `SELECT q.push_id, q.trip_id, q.event, q.title, q.body, q.attempts, d.device_id, d.platform, d.token
+FROM push_delivery AS q, push_device AS d
+WHERE d.device_id = q.device_id
+AND q.next_attempt_at <= ?
+ORDER BY q.push_id
+LIMIT ?`
+	pushDelete = "DELETE FROM push_delivery WHERE push_id = ?"
+	pushRetry  = `UPDATE push_delivery SET attempts = ?, next_attempt_at = ?, last_error = ?
+WHERE push_id = ?`
+)
+
+// The platforms of the devices
+const (
+	// PlatformFCM is for the devices reached by Firebase Cloud Messaging,
+	// e.g. Android
+	PlatformFCM = "fcm"
+	// PlatformAPNs is for the devices reached by the Apple Push
+	// Notification service
+	PlatformAPNs = "apns"
+)
+
+// Platforms are the platforms a device can be registered for
+var Platforms = []string{PlatformFCM, PlatformAPNs}
+
+// PushEvents are the events pushed to the devices of the people of the
+// trips
+var PushEvents = []string{EventExpenseAdded, EventTripCompleted}
+
+// maxDeviceToken is the maximum length of the token of a device
+const maxDeviceToken = 512
+
+// pushQueued is signaled when pushes are queued, see PushesQueued()
+var pushQueued = make(chan struct{}, 1)
+
+// ErrDeviceGone is returned by a PushSender when the device isn't
+// reachable with its token anymore, e.g. the app was uninstalled: the
+// device is unregistered
+var ErrDeviceGone = errors.New("the device is no longer registered")
+
+// Device is a device of a user receiving the push notifications
+type Device struct {
+	// ID is the primary key and is from a sequence
+	ID int64 `json:"device_id"`
+	// Email is the email address of the user of the device
+	Email string `json:"user"`
+	// Platform is one of Platforms
+	Platform  string    `json:"platform"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Push is a notification pushed to a device
+type Push struct {
+	Event  string
+	TripID int64
+	Title  string
+	Body   string
+}
+
+// PushSender pushes the notifications to the devices of a platform, by
+// the tokens of the devices
+type PushSender interface {
+	Push(ctx context.Context, token string, p Push) error
+}
+
+// RegisterDevice registers the token of a device of the user for the push
+// notifications. A token already registered is handed over to the user,
+// the device having changed hands.
+func RegisterDevice(ctx context.Context, db *sql.DB, usr *User, platform, token string) (*Device, error) {
+	if !slices.Contains(Platforms, platform) {
+		return nil, fmt.Errorf("unknown platform '%s', expecting one of %s", platform, strings.Join(Platforms, ", "))
+	}
+	if token == "" || len(token) > maxDeviceToken {
+		return nil, fmt.Errorf("invalid token of device, expecting 1 to %d characters", maxDeviceToken)
+	}
+	_, err := db.ExecContext(ctx, deviceUpsert, usr.ID, platform, token, Now().UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	d, err := scanDevice(db.QueryRowContext(ctx, deviceByTokenSelect, token))
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Registered device %d of %s for %s\n", d.ID, d.Email, d.Platform)
+	return d, nil
+}
+
+// LoadDevices returns the devices of the user
+func LoadDevices(ctx context.Context, db *sql.DB, email string) ([]*Device, error) {
+	rows, err := db.QueryContext(ctx, devicesByUserSelect, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, d)
+	}
+	return rslt, rows.Err()
+}
+
+// scanDevice reads a Device selected by deviceColumns
+func scanDevice(row interface{ Scan(...any) error }) (*Device, error) {
+	d := new(Device)
+	var createdAt int64
+	err := row.Scan(&d.ID, &d.Email, &d.Platform, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	d.CreatedAt = time.UnixMicro(createdAt).UTC()
+	return d, nil
+}
+
+// DeleteDevice unregisters the device of the user, with its pending
+// pushes. sql.ErrNoRows is returned if the user has no such device.
+func DeleteDevice(ctx context.Context, db *sql.DB, email string, deviceID int64) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var rslt sql.Result
+	var cnt int64
+	rslt, err = txn.ExecContext(ctx, deviceDelete, deviceID, email)
+	if err != nil {
+		goto Rollback
+	}
+	cnt, err = rslt.RowsAffected()
+	if err != nil {
+		goto Rollback
+	}
+	if cnt == 0 {
+		err = sql.ErrNoRows
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, devicePushesDel, deviceID)
+	if err != nil {
+		goto Rollback
+	}
+	return txn.Commit()
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		fatalf(ctx, "ERROR: trip.DeleteDevice() failed to rollback transaction on device %d: '%v'\n", deviceID, rollbackErr)
+	}
+	return err
+}
+
+// queuePushes queues the event of the trip for the devices of its people,
+// if it's one of PushEvents, and returns their number. It's executed by
+// queueEvent(), within the transaction of the change.
+func queuePushes(ctx context.Context, txn *sql.Tx, tripID int64, event string, data any) (int, error) {
+	if !slices.Contains(PushEvents, event) {
+		return 0, nil
+	}
+	rows, err := txn.QueryContext(ctx, devicesOfTrip, tripID)
+	if err != nil {
+		return 0, err
+	}
+	type device struct {
+		id    int64
+		email string
+	}
+	var devices []device
+	for rows.Next() {
+		var d device
+		err = rows.Scan(&d.id, &d.email)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(devices) == 0 {
+		return 0, err
+	}
+	var name string
+	err = txn.QueryRowContext(ctx, tripNameSelect, tripID).Scan(&name)
+	if err != nil {
+		return 0, err
+	}
+	now := Now().UnixMicro()
+	for _, d := range devices {
+		title, body := pushText(name, d.email, data)
+		_, err = txn.ExecContext(ctx, pushInsert, d.id, tripID, event, title, body, now, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(devices), nil
+}
+
+// pushText returns the title and the body of the push of the event data
+// to the device of the person: the expense added, or their share of the
+// settlement of the trip completed
+func pushText(name, email string, data any) (string, string) {
+	switch d := data.(type) {
+	case *Expense:
+		var payers []string
+		for _, p := range d.Participants {
+			if p.Paid > 0 {
+				payers = append(payers, p.Email)
+			}
+		}
+		slices.Sort(payers)
+		return fmt.Sprintf("New expense on %s", name),
+			fmt.Sprintf("%s: %s, paid by %s", d.Description, formatCents(d.amount), strings.Join(payers, ", "))
+	case webhookSettlement:
+		var pays, receives int
+		for payer, payments := range d.Settlement {
+			for payee, amount := range payments {
+				if payer == email {
+					pays += amount
+				}
+				if payee == email {
+					receives += amount
+				}
+			}
+		}
+		title := fmt.Sprintf("The trip %s is completed", name)
+		switch {
+		case pays > 0:
+			return title, fmt.Sprintf("You pay %s in total to settle it.", formatCents(pays))
+		case receives > 0:
+			return title, fmt.Sprintf("You receive %s in total to settle it.", formatCents(receives))
+		}
+		return title, "You have nothing to pay nor to receive."
+	}
+	return name, ""
+}
+
+// PushesQueued returns the channel signaled when pushes are queued, for
+// the worker calling DeliverPushes() to wake up
+func PushesQueued() <-chan struct{} {
+	return pushQueued
+}
+
+// DeliverPushes pushes the notifications due to the devices, with the
+// sender of their platform, and returns the number delivered. A push not
+// accepted is attempted again later, like the events of the webhooks,
+// until it is given up on. A device the sender reports as gone is
+// unregistered, and a push to a platform without a sender is dropped.
+func DeliverPushes(ctx context.Context, db *sql.DB, senders map[string]PushSender) (int, error) {
+	type delivery struct {
+		id, tripID, deviceID  int64
+		event, title, body    string
+		attempts              int
+		platform, deviceToken string
+	}
+	rows, err := db.QueryContext(ctx, pushesDue, Now().UnixMicro(), webhookBatch)
+	if err != nil {
+		return 0, err
+	}
+	var due []delivery
+	for rows.Next() {
+		var d delivery
+		err = rows.Scan(&d.id, &d.tripID, &d.event, &d.title, &d.body, &d.attempts, &d.deviceID, &d.platform, &d.deviceToken)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, d := range due {
+		sender, ok := senders[d.platform]
+		if !ok {
+			Logf(ctx, "WARNING: dropping the push %d of %s, no sender for %s\n", d.id, d.event, d.platform)
+			_, err = db.ExecContext(ctx, pushDelete, d.id)
+			if err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		err = sender.Push(ctx, d.deviceToken, Push{Event: d.event, TripID: d.tripID, Title: d.title, Body: d.body})
+		d.attempts++
+		switch {
+		case err == nil:
+			delivered++
+			_, err = db.ExecContext(ctx, pushDelete, d.id)
+		case errors.Is(err, ErrDeviceGone):
+			Logf(ctx, "Unregistering device %d, gone from %s\n", d.deviceID, d.platform)
+			_, err = db.ExecContext(ctx, devicePushesDel, d.deviceID)
+			if err == nil {
+				_, err = db.ExecContext(ctx, deviceGoneDelete, d.deviceID)
+			}
+		case d.attempts >= webhookAttempts:
+			Logf(ctx, "ERROR: giving up on the push %d of %s to device %d after %d attempts: %v\n",
+				d.id, d.event, d.deviceID, d.attempts, err)
+			_, err = db.ExecContext(ctx, pushDelete, d.id)
+		default:
+			Logf(ctx, "WARNING: push %d of %s to device %d failed, attempt %d: %v\n", d.id, d.event, d.deviceID, d.attempts, err)
+			next := Now().Add(webhookBackoff << (d.attempts - 1))
+			lastErr := err.Error()
+			if len(lastErr) > 512 {
+				lastErr = lastErr[:512]
+			}
+			_, err = db.ExecContext(ctx, pushRetry, d.attempts, next.UnixMicro(), lastErr, d.id)
+		}
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
@@ -0,0 +1,216 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the push notifications.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	pushDeviceCreate = `CREATE TABLE IF NOT EXISTS push_device (
+device_id INTEGER CONSTRAINT push_device_pkey PRIMARY KEY AUTOINCREMENT,
+user_id INTEGER NOT NULL,
+platform VARCHAR(8) NOT NULL,
+token VARCHAR(512) NOT NULL CONSTRAINT push_device_token_unique UNIQUE,
+created_at INTEGER NOT NULL)`
+	pushDeviceIndex    = "CREATE INDEX IF NOT EXISTS push_device_user_index ON push_device(user_id)"
+	pushDeliveryCreate = `CREATE TABLE IF NOT EXISTS push_delivery (
+push_id INTEGER CONSTRAINT push_delivery_pkey PRIMARY KEY AUTOINCREMENT,
+device_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL,
+event VARCHAR(32) NOT NULL,
+title VARCHAR(256) NOT NULL,
+body TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+attempts INTEGER NOT NULL DEFAULT 0,
+next_attempt_at INTEGER NOT NULL,
+last_error VARCHAR(512) NOT NULL DEFAULT '')`
+	pushDeliveryIndex = "CREATE INDEX IF NOT EXISTS push_delivery_next_index ON push_delivery(next_attempt_at)"
+)
+
+// pushRecorder is a PushSender recording the pushes, by token, and
+// failing with err
+type pushRecorder struct {
+	mu     sync.Mutex
+	err    error
+	pushes map[string][]Push
+}
+
+// Push is part of the PushSender interface
+func (pr *pushRecorder) Push(ctx context.Context, token string, p Push) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.pushes == nil {
+		pr.pushes = make(map[string][]Push)
+	}
+	pr.pushes[token] = append(pr.pushes[token], p)
+	return pr.err
+}
+
+// TestPushes registers devices of the people of a trip, and pushes them
+// its expense and its completion
+func TestPushes(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Trip P", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usrA, err := LoadOrCreateUser(ctx, pdb, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usrB, err := LoadOrCreateUser(ctx, pdb, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RegisterDevice(ctx, pdb, usrA, "pigeon", "tok-a")
+	if err == nil {
+		t.Error("expected an unknown platform to be refused")
+	}
+	_, err = RegisterDevice(ctx, pdb, usrA, PlatformFCM, "")
+	if err == nil {
+		t.Error("expected an empty token to be refused")
+	}
+	_, err = RegisterDevice(ctx, pdb, usrA, PlatformFCM, "tok-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the phone of bob was the one of alice
+	devB, err := RegisterDevice(ctx, pdb, usrA, PlatformAPNs, "tok-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := RegisterDevice(ctx, pdb, usrB, PlatformAPNs, "tok-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ID != devB.ID || moved.Email != bob {
+		t.Errorf("expected device %d handed over to bob, got %+v", devB.ID, moved)
+	}
+	devices, err := LoadDevices(ctx, pdb, alice)
+	if err != nil || len(devices) != 1 || devices[0].Platform != PlatformFCM {
+		t.Errorf("expected the FCM device of alice, got %+v, %v", devices, err)
+	}
+
+	err = tr.AddExpense(NewDate(start), "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-PushesQueued():
+	default:
+		t.Error("expected the worker to be woken up")
+	}
+	fcm := &pushRecorder{}
+	apns := &pushRecorder{err: errors.New("503 Service Unavailable")}
+	senders := map[string]PushSender{PlatformFCM: fcm, PlatformAPNs: apns}
+	n, err := DeliverPushes(ctx, pdb, senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Push{{Event: EventExpenseAdded, TripID: tr.ID, Title: "New expense on Trip P", Body: "hotel: 90.00, paid by " + alice}}
+	if n != 1 || !reflect.DeepEqual(fcm.pushes["tok-a"], want) {
+		t.Errorf("expected %+v pushed, got %d: %+v", want, n, fcm.pushes)
+	}
+	if len(apns.pushes["tok-b"]) != 1 {
+		t.Errorf("expected a failed push to bob, got %+v", apns.pushes)
+	}
+
+	// the failed push is retried once the backoff is over, and the
+	// device is unregistered once reported gone
+	apns.err = ErrDeviceGone
+	fc.Advance(webhookBackoff)
+	_, err = DeliverPushes(ctx, pdb, senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apns.pushes["tok-b"]) != 2 {
+		t.Errorf("expected the push to bob retried, got %+v", apns.pushes)
+	}
+	devices, err = LoadDevices(ctx, pdb, bob)
+	if err != nil || len(devices) != 0 {
+		t.Errorf("expected the device of bob unregistered, got %+v, %v", devices, err)
+	}
+
+	_, err = tr.Complete(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = DeliverPushes(ctx, pdb, senders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, Push{Event: EventTripCompleted, TripID: tr.ID, Title: "The trip Trip P is completed", Body: "You receive 45.00 in total to settle it."})
+	if n != 1 || !reflect.DeepEqual(fcm.pushes["tok-a"], want) {
+		t.Errorf("expected %+v pushed, got %d: %+v", want, n, fcm.pushes)
+	}
+
+	// a push to a platform without a sender is dropped
+	_, err = RegisterDevice(ctx, pdb, usrB, PlatformAPNs, "tok-c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2 := NewTrip("Trip Q", alice, "", NewDate(start), []string{bob})
+	err = tr2.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.AddExpense(NewDate(start), "taxi", []Participant{{alice, 0, 0}, {bob, 0, 1000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DeliverPushes(ctx, pdb, map[string]PushSender{PlatformFCM: fcm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pending int
+	err = pdb.QueryRowContext(ctx, "SELECT COUNT(*) FROM push_delivery").Scan(&pending)
+	if err != nil || pending != 0 {
+		t.Errorf("expected no push left, got %d, %v", pending, err)
+	}
+
+	err = DeleteDevice(ctx, pdb, bob, devices0(t, ctx, pdb, alice))
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows deleting the device of another user, got %v", err)
+	}
+	err = DeleteDevice(ctx, pdb, alice, devices0(t, ctx, pdb, alice))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// devices0 returns the ID of the first device of the user
+func devices0(t *testing.T, ctx context.Context, db *sql.DB, email string) int64 {
+	devices, err := LoadDevices(ctx, db, email)
+	if err != nil || len(devices) == 0 {
+		t.Fatalf("expected a device of %s, got %v", email, err)
+	}
+	return devices[0].ID
+}
@@ -0,0 +1,254 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the quarantine of the bursts of expenses. A client
+// entering expenses far faster than a person would, e.g. with a leaked
+// token, is flagged by a BurstDetector for a while, and the expenses it
+// posts meanwhile are set aside instead of being added to the trips, until
+// the owners review them.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	quarantineInsert = `INSERT INTO expense_quarantine (trip_id, source, payload, created_at)
+VALUES (?, ?, ?, ?)`
+	quarantineSelect = `SELECT quarantine_id, trip_id, source, payload, created_at
+FROM expense_quarantine WHERE trip_id = ?`
+	quarantineOrder  = "\nORDER BY quarantine_id"
+	quarantineByID   = "\nAND quarantine_id = ?"
+	quarantineDelete = "DELETE FROM expense_quarantine WHERE trip_id = ? AND quarantine_id = ?"
+)
+
+// ErrQuarantineReleased is returned when an expense released from the
+// quarantine is no longer in it, e.g. released or discarded concurrently
+var ErrQuarantineReleased = errors.New("expense no longer in quarantine")
+
+// burstSweep is the number of sources tracked past which the idle ones are
+// forgotten
+const burstSweep = 10000
+
+// BurstDetector flags the sources, e.g. the tokens, posting more than a
+// number of expenses within a window of time. A flagged source stays
+// flagged for the quarantine period. It's safe for concurrent use.
+type BurstDetector struct {
+	limit      int
+	window     time.Duration
+	quarantine time.Duration
+
+	mu sync.Mutex
+	// posted are the times of the last expenses of each source, at most
+	// limit of them
+	posted map[string][]time.Time
+	// flagged are the ends of the quarantines of the sources
+	flagged map[string]time.Time
+}
+
+// NewBurstDetector returns the detector of more than limit expenses within
+// the window, flagging the sources for the quarantine period. A limit of 0
+// flags nothing.
+func NewBurstDetector(limit int, window, quarantine time.Duration) *BurstDetector {
+	return &BurstDetector{
+		limit:      limit,
+		window:     window,
+		quarantine: quarantine,
+		posted:     make(map[string][]time.Time),
+		flagged:    make(map[string]time.Time),
+	}
+}
+
+// Record records an expense posted by the source, and tells whether it's
+// to be quarantined
+func (d *BurstDetector) Record(ctx context.Context, source string) bool {
+	if d == nil || d.limit <= 0 {
+		return false
+	}
+	now := Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if until, ok := d.flagged[source]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(d.flagged, source)
+	}
+	if len(d.posted) > burstSweep {
+		d.sweep(now)
+	}
+	posted := append(d.posted[source], now)
+	if len(posted) > d.limit {
+		posted = posted[len(posted)-d.limit-1:]
+		if now.Sub(posted[0]) < d.window {
+			delete(d.posted, source)
+			d.flagged[source] = now.Add(d.quarantine)
+			Logf(ctx, "WARNING: %s posted more than %d expenses within %v, quarantining its expenses until %s\n",
+				source, d.limit, d.window, now.Add(d.quarantine).Format(time.RFC3339))
+			return true
+		}
+		posted = posted[1:]
+	}
+	d.posted[source] = posted
+	return false
+}
+
+// Flagged returns the sources flagged, with the ends of their quarantine
+func (d *BurstDetector) Flagged() map[string]time.Time {
+	rslt := make(map[string]time.Time)
+	if d == nil {
+		return rslt
+	}
+	now := Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for source, until := range d.flagged {
+		if now.Before(until) {
+			rslt[source] = until
+		}
+	}
+	return rslt
+}
+
+// sweep forgets the sources idle for longer than the window
+func (d *BurstDetector) sweep(now time.Time) {
+	for source, posted := range d.posted {
+		if now.Sub(posted[len(posted)-1]) >= d.window {
+			delete(d.posted, source)
+		}
+	}
+	for source, until := range d.flagged {
+		if !now.Before(until) {
+			delete(d.flagged, source)
+		}
+	}
+}
+
+// QuarantinedExpense is an expense set aside for the owner of the trip to
+// review
+type QuarantinedExpense struct {
+	// ID is the primary key and is from a sequence
+	ID     int64 `json:"quarantine_id"`
+	TripID int64 `json:"trip_id"`
+	// Source is what posted the expense, e.g. "token 12"
+	Source string `json:"source"`
+	// Expense is the expense as it was posted
+	Expense   json.RawMessage `json:"expense"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// QuarantineExpense sets aside the expense posted by the source for the
+// trip, given as the JSON payload posted. sql.ErrNoRows is returned if
+// there's no such trip.
+func QuarantineExpense(ctx context.Context, db *sql.DB, tripID int64, source string, payload []byte) (*QuarantinedExpense, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, tripExistsSelect, tripID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	q := &QuarantinedExpense{
+		TripID:    tripID,
+		Source:    source,
+		Expense:   json.RawMessage(payload),
+		CreatedAt: Now().UTC().Truncate(time.Microsecond),
+	}
+	rslt, err := db.ExecContext(ctx, quarantineInsert, q.TripID, q.Source, string(payload), q.CreatedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	q.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Quarantined expense %d of trip %d posted by %s\n", q.ID, q.TripID, q.Source)
+	return q, nil
+}
+
+// LoadQuarantine returns the expenses of the trip in quarantine, the
+// oldest first
+func LoadQuarantine(ctx context.Context, db *sql.DB, tripID int64) ([]*QuarantinedExpense, error) {
+	rows, err := db.QueryContext(ctx, quarantineSelect+quarantineOrder, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*QuarantinedExpense{}
+	for rows.Next() {
+		q, err := scanQuarantined(rows)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, q)
+	}
+	return rslt, rows.Err()
+}
+
+// LoadQuarantined returns an expense of the trip in quarantine,
+// sql.ErrNoRows if there's none
+func LoadQuarantined(ctx context.Context, db *sql.DB, tripID, quarantineID int64) (*QuarantinedExpense, error) {
+	return scanQuarantined(db.QueryRowContext(ctx, quarantineSelect+quarantineByID, tripID, quarantineID))
+}
+
+// scanQuarantined reads an expense in quarantine from a row
+func scanQuarantined(row interface{ Scan(...any) error }) (*QuarantinedExpense, error) {
+	q := new(QuarantinedExpense)
+	var payload string
+	var createdAt int64
+	err := row.Scan(&q.ID, &q.TripID, &q.Source, &payload, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	q.Expense = json.RawMessage(payload)
+	q.CreatedAt = time.UnixMicro(createdAt).UTC()
+	return q, nil
+}
+
+// DeleteQuarantined deletes an expense of the trip from the quarantine,
+// once added to the trip or discarded. sql.ErrNoRows is returned if
+// there's none.
+func DeleteQuarantined(ctx context.Context, db *sql.DB, tripID, quarantineID int64) error {
+	rslt, err := db.ExecContext(ctx, quarantineDelete, tripID, quarantineID)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ReleaseQuarantined records that an expense of the quarantine is added to
+// the trip, by the caller, for Save() to delete it from the quarantine in
+// the same transaction. Save() returns ErrQuarantineReleased, and nothing
+// is written, if it's no longer in the quarantine.
+func (trip *Trip) ReleaseQuarantined(quarantineID int64) {
+	trip.released = append(trip.released, quarantineID)
+}
+
+// deleteReleased deletes an expense released from the quarantine
+func (trip *Trip) deleteReleased(ctx context.Context, txn *sql.Tx, quarantineID int64) error {
+	rslt, err := txn.ExecContext(ctx, quarantineDelete, trip.ID, quarantineID)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrQuarantineReleased
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the quarantine of the bursts of
+// expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	expenseQuarantineCreate = `CREATE TABLE IF NOT EXISTS expense_quarantine (
+quarantine_id INTEGER CONSTRAINT expense_quarantine_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+source VARCHAR(64) NOT NULL,
+payload TEXT NOT NULL,
+created_at INTEGER NOT NULL)`
+	expenseQuarantineTripIndex = "CREATE INDEX IF NOT EXISTS expense_quarantine_trip_index ON expense_quarantine(trip_id)"
+)
+
+// TestBurstDetector flags a source past the limit within the window, and
+// checks the quarantine lasts its period
+func TestBurstDetector(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start, time.Second)
+	SetClock(clock.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	// one expense per second: 3 within 5s are fine, the 4th isn't
+	d := NewBurstDetector(3, 5*time.Second, time.Minute)
+	for i := 0; i < 3; i++ {
+		if d.Record(ctx, "token 1") {
+			t.Fatalf("expense %d unexpectedly quarantined", i+1)
+		}
+	}
+	if d.Record(ctx, "token 2") {
+		t.Error("the other sources shouldn't be affected")
+	}
+	if !d.Record(ctx, "token 1") {
+		t.Fatal("the burst wasn't flagged")
+	}
+	if until, ok := d.Flagged()["token 1"]; !ok || !until.After(start) {
+		t.Errorf("Unexpected flagged sources %v", d.Flagged())
+	}
+	if !d.Record(ctx, "token 1") {
+		t.Error("the quarantine should last")
+	}
+	clock.Advance(time.Minute)
+	if d.Record(ctx, "token 1") {
+		t.Error("the quarantine should be over")
+	}
+	if len(d.Flagged()) != 0 {
+		t.Errorf("Unexpected flagged sources %v", d.Flagged())
+	}
+
+	// slower than the window never gets flagged
+	slow := NewBurstDetector(2, 2*time.Second, time.Minute)
+	for i := 0; i < 10; i++ {
+		clock.Advance(time.Second)
+		if slow.Record(ctx, "token 3") {
+			t.Fatalf("slow expense %d unexpectedly quarantined", i+1)
+		}
+	}
+	if NewBurstDetector(0, time.Second, time.Minute).Record(ctx, "token 4") {
+		t.Error("a limit of 0 should flag nothing")
+	}
+}
+
+// TestQuarantineExpense sets aside expenses, lists them, and deletes them
+func TestQuarantineExpense(t *testing.T) {
+	ctx := context.Background()
+	qdb := openTestDB(t)
+	tr := NewTrip("Quarantined", alice, "", NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, qdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = QuarantineExpense(ctx, qdb, tr.ID+1, "token 1", []byte(`{}`))
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown trip, got %v", err)
+	}
+	first, err := QuarantineExpense(ctx, qdb, tr.ID, "token 1", []byte(`{"description":"hotel"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := QuarantineExpense(ctx, qdb, tr.ID, "token 1", []byte(`{"description":"taxi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quarantine, err := LoadQuarantine(ctx, qdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantine) != 2 || quarantine[0].ID != first.ID || quarantine[1].ID != second.ID {
+		t.Fatalf("Unexpected quarantine %+v", quarantine)
+	}
+	if string(quarantine[1].Expense) != `{"description":"taxi"}` || quarantine[1].Source != "token 1" ||
+		!quarantine[1].CreatedAt.Equal(second.CreatedAt) {
+		t.Errorf("Unexpected quarantined expense %+v", quarantine[1])
+	}
+
+	err = DeleteQuarantined(ctx, qdb, tr.ID, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteQuarantined(ctx, qdb, tr.ID, first.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows deleting twice, got %v", err)
+	}
+	_, err = LoadQuarantined(ctx, qdb, tr.ID, first.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a deleted expense, got %v", err)
+	}
+	q, err := LoadQuarantined(ctx, qdb, tr.ID, second.ID)
+	if err != nil || q.ID != second.ID {
+		t.Errorf("Unexpected quarantined expense %+v: %v", q, err)
+	}
+}
+
+// TestReleaseQuarantined adds an expense of the quarantine to its trip, and
+// checks it can't be added twice
+func TestReleaseQuarantined(t *testing.T) {
+	ctx := context.Background()
+	qdb := openTestDB(t)
+	tr := NewTrip("Released", alice, "", NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, qdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := QuarantineExpense(ctx, qdb, tr.ID, "token 1", []byte(`{"description":"hotel"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := func(t *Trip) error {
+		t.ReleaseQuarantined(q.ID)
+		return t.AddExpense(t.StartDate, "hotel", []Participant{{alice, 0, 100}, {bob, 0, 0}})
+	}
+	_, err = UpdateTrip(ctx, qdb, tr.ID, release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = UpdateTrip(ctx, qdb, tr.ID, release)
+	if err != ErrQuarantineReleased {
+		t.Errorf("expected ErrQuarantineReleased releasing twice, got %v", err)
+	}
+	tr, err = LoadTripByID(ctx, qdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Expenses) != 1 {
+		t.Errorf("expected the released expense added once, got %d expenses", len(tr.Expenses))
+	}
+	quarantine, err := LoadQuarantine(ctx, qdb, tr.ID)
+	if err != nil || len(quarantine) != 0 {
+		t.Errorf("expected an empty quarantine, got %+v: %v", quarantine, err)
+	}
+}
@@ -0,0 +1,227 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the slow query log. The database/sql driver is
+// wrapped so that every statement is timed, and the ones exceeding a
+// threshold are logged with their parameters and the calling operation.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// slowQueries counts the statements logged as slow
+var slowQueries atomic.Int64
+
+// SlowQueryCount returns the number of statements logged as slow since
+// the start of the process
+func SlowQueryCount() int64 {
+	return slowQueries.Load()
+}
+
+// OpenWithSlowQueryLog opens a database like sql.Open, except that the
+// statements taking longer than the threshold are logged
+func OpenWithSlowQueryLog(driverName, dataSourceName string, threshold time.Duration) (*sql.DB, error) {
+	connector, err := openConnector(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(&slowConnector{connector, threshold}), nil
+}
+
+// dsnConnector opens the connections of a driver to a data source name
+type dsnConnector struct {
+	drv driver.Driver
+	dsn string
+}
+
+func (dc *dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return dc.drv.Open(dc.dsn)
+}
+
+func (dc *dsnConnector) Driver() driver.Driver {
+	return dc.drv
+}
+
+// openConnector returns the connector of a driver to a data source name,
+// for the wrappers of this package
+func openConnector(driverName, dataSourceName string) (driver.Connector, error) {
+	// sql.Open doesn't connect, it's only used to look up the driver
+	probe, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	drv := probe.Driver()
+	probe.Close()
+	return &dsnConnector{drv, dataSourceName}, nil
+}
+
+// callingOperation returns the name of the first function on the stack,
+// above logIfSlow, outside of database/sql and the wrappers of the driver
+func callingOperation() string {
+	pc := make([]uintptr, 32)
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "database/sql") && !strings.Contains(f.Function, ".(*slow") &&
+			!strings.Contains(f.Function, ".(*prefix") {
+			return f.Function
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// logIfSlow logs the statement if it took longer than the threshold
+func logIfSlow(ctx context.Context, threshold time.Duration, start time.Time, query string, args []driver.NamedValue) {
+	elapsed := time.Since(start)
+	if elapsed < threshold {
+		return
+	}
+	slowQueries.Add(1)
+	values := make([]any, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	Logf(ctx, "WARNING: slow query (%v) in %s: %s %v\n",
+		elapsed, callingOperation(), strings.Join(strings.Fields(query), " "), values)
+}
+
+// namedToValues converts the arguments for the drivers not supporting
+// the context variants
+func namedToValues(args []driver.NamedValue) []driver.Value {
+	rslt := make([]driver.Value, len(args))
+	for i, a := range args {
+		rslt[i] = a.Value
+	}
+	return rslt
+}
+
+// slowConnector opens the wrapped connections
+type slowConnector struct {
+	connector driver.Connector
+	threshold time.Duration
+}
+
+func (sc *slowConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := sc.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &slowConn{conn, sc.threshold}, nil
+}
+
+func (sc *slowConnector) Driver() driver.Driver {
+	return sc.connector.Driver()
+}
+
+// slowConn times the statements run on a connection
+type slowConn struct {
+	driver.Conn
+	threshold time.Duration
+}
+
+func (c *slowConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *slowConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &slowStmt{stmt, query, c.threshold}, nil
+}
+
+func (c *slowConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	var txn driver.Tx
+	var err error
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		txn, err = b.BeginTx(ctx, opts)
+	} else {
+		txn, err = c.Conn.Begin()
+	}
+	logIfSlow(ctx, c.threshold, start, "BEGIN", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &slowTx{txn, c.threshold, ctx}, nil
+}
+
+func (c *slowConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer logIfSlow(ctx, c.threshold, time.Now(), query, args)
+	return e.ExecContext(ctx, query, args)
+}
+
+func (c *slowConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	defer logIfSlow(ctx, c.threshold, time.Now(), query, args)
+	return q.QueryContext(ctx, query, args)
+}
+
+func (c *slowConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// slowTx times the commits, as that's where the writers wait on each other
+type slowTx struct {
+	driver.Tx
+	threshold time.Duration
+	// ctx is the context of the transaction, for the log of the commit
+	ctx context.Context
+}
+
+func (t *slowTx) Commit() error {
+	defer logIfSlow(t.ctx, t.threshold, time.Now(), "COMMIT", nil)
+	return t.Tx.Commit()
+}
+
+// slowStmt times the executions of a prepared statement
+type slowStmt struct {
+	driver.Stmt
+	query     string
+	threshold time.Duration
+}
+
+func (s *slowStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer logIfSlow(ctx, s.threshold, time.Now(), s.query, args)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	return s.Stmt.Exec(namedToValues(args))
+}
+
+func (s *slowStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer logIfSlow(ctx, s.threshold, time.Now(), s.query, args)
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return q.QueryContext(ctx, args)
+	}
+	return s.Stmt.Query(namedToValues(args))
+}
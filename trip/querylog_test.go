@@ -0,0 +1,63 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the slow query log.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestSlowQueryLog logs every statement, with a threshold of 0, and checks
+// the log has the statements, their parameters and the calling operation
+func TestSlowQueryLog(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	qdb, err := OpenWithSlowQueryLog("sqlite3", filepath.Join(t.TempDir(), "slow.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qdb.Close()
+	setupSchema(qdb)
+
+	before := SlowQueryCount()
+	tr := NewTrip("Trip Q", alice, "", epochToDate(time.Now().Unix()), []string{bob})
+	err = tr.Save(ctx, qdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadTripByID(ctx, qdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SlowQueryCount() <= before {
+		t.Error("Expect the slow query counter to go up")
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"slow query",
+		"trip.(*Trip).Save: BEGIN",
+		"trip.(*Trip).Save: COMMIT",
+		"trip.LoadTripByID: SELECT trip_id, name",
+		"FROM trip WHERE trip_id = ? [" + strconv.FormatInt(tr.ID, 10) + "]",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expect %q in the log:\n%s", want, out)
+		}
+	}
+}
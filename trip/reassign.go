@@ -0,0 +1,290 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit removes a participant who took part in some expenses, by
+// reassigning their shares. The expenses are split equally, so an expense
+// can't be edited to give a participant 2 shares: instead, each expense is
+// replaced by a new one without the participant removed, plus an expense
+// correcting the shares when needed. The replaced expenses are archived
+// like the deleted ones, and the new ones are recorded for the audit
+// export.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	reassignmentInsert = `INSERT INTO expense_reassignment (expense_id, trip_id, replaced_id, user_id, target_id, created_at)
+VALUES (?, ?, ?, ?, ?, ?)`
+	receiptMove           = "UPDATE receipt SET expense_id = ? WHERE trip_id = ? AND expense_id = ?"
+	peopleForbiddenDelete = `DELETE FROM forbidden_transfer
+WHERE trip_id = ? AND (payer = ? OR payee = ?)`
+)
+
+// ErrReassignPaid is returned when the shares of a participant who paid
+// for an expense are reassigned to the other participants of the expense,
+// their payments can only be reassigned to a single participant
+var ErrReassignPaid = errors.New("the participant paid for some of the expenses, reassign them to a participant instead")
+
+// Reassignment is the replacement of an expense, when a participant is
+// removed from it
+type Reassignment struct {
+	// ReplacedID is the primary key of the expense replaced
+	ReplacedID int64 `json:"replaced_id"`
+	// Expenses are the expenses replacing it, none if the participant
+	// removed was the only one
+	Expenses []*Expense `json:"expenses"`
+}
+
+// reassignExpense returns the expenses replacing one the participant is
+// removed from. Without a target, the other participants share the expense
+// without them. With a target, the target takes over their payment and
+// share: in place of the participant if the target isn't part of the
+// expense, otherwise with a second expense where the other participants
+// are paid back the part of the share they'd bear otherwise.
+func (trip *Trip) reassignExpense(e *Expense, email, target string, now time.Time) ([]*Expense, error) {
+	var paid int
+	hasTarget := false
+	others := []Participant{}
+	for _, p := range e.Participants {
+		switch normalizeEmail(p.Email) {
+		case email:
+			paid = p.Paid
+		case target:
+			hasTarget = true
+			others = append(others, p)
+		default:
+			others = append(others, p)
+		}
+	}
+	replacement := &Expense{
+		Date:        e.Date,
+		Description: e.Description,
+		Notes:       e.Notes,
+		Metadata:    e.Metadata,
+		createdAt:   now,
+	}
+	switch {
+	case target == "":
+		if paid > 0 {
+			return nil, ErrReassignPaid
+		}
+		if len(others) == 0 {
+			return []*Expense{}, nil
+		}
+		replacement.Participants = others
+	case !hasTarget:
+		for _, p := range e.Participants {
+			if normalizeEmail(p.Email) == email {
+				p = Participant{Email: target, UserID: trip.emailLookup[target], Paid: p.Paid}
+			}
+			replacement.Participants = append(replacement.Participants, p)
+		}
+	default:
+		for _, p := range others {
+			if normalizeEmail(p.Email) == target {
+				p.Paid += paid
+			}
+			replacement.Participants = append(replacement.Participants, p)
+		}
+	}
+	for _, p := range replacement.Participants {
+		replacement.amount += p.Paid
+	}
+	rslt := []*Expense{replacement}
+	if target == "" || !hasTarget || len(others) < 2 {
+		return rslt, nil
+	}
+
+	// Without the participant, each of the others bears 1/(N-1) of the
+	// expense instead of 1/N. Each one paying 1/N in an expense shared
+	// with the target settles it back.
+	refund := e.share()
+	correction := &Expense{
+		Date:         e.Date,
+		Description:  fmt.Sprintf("Share of %s in %s, reassigned to %s", email, e.Description, target),
+		Participants: []Participant{},
+		createdAt:    now,
+	}
+	for _, p := range others {
+		if normalizeEmail(p.Email) != target {
+			p.Paid = refund
+		} else {
+			p.Paid = 0
+		}
+		correction.Participants = append(correction.Participants, p)
+		correction.amount += p.Paid
+	}
+	return append(rslt, correction), nil
+}
+
+// ReassignParticipant removes a participant from the trip, even if they
+// took part in some expenses, by reassigning their shares: to the other
+// participants of each expense without a target, or to the target
+// participant, who also takes over their payments. It's done in a single
+// transaction, and returns the replacements of the expenses.
+// sql.ErrNoRows is returned if the user isn't a participant, and
+// ErrReassignPaid if they paid for an expense and there's no target. The
+// owner cannot be removed.
+func (trip *Trip) ReassignParticipant(ctx context.Context, db *sql.DB, email, target string) ([]Reassignment, error) {
+	email = normalizeEmail(email)
+	if trip.Owner.Email == email {
+		return nil, fmt.Errorf("'%s' is the owner of the trip", email)
+	}
+	idx := -1
+	for i, p := range trip.Participants {
+		if p.Email == email {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, sql.ErrNoRows
+	}
+	usr := trip.Participants[idx]
+	if target != "" {
+		target = normalizeEmail(target)
+		if target == email {
+			return nil, fmt.Errorf("'%s' isn't another participant of the trip", target)
+		}
+		if !trip.IsParticipant(target) {
+			return nil, fmt.Errorf("'%s' %w", target, ErrUnknownParticipant)
+		}
+	}
+
+	now := Now()
+	rslt := []Reassignment{}
+	kept := []*Expense{}
+	for _, e := range trip.Expenses {
+		if usr.ID == 0 || !e.hasUser(usr.ID) {
+			kept = append(kept, e)
+			continue
+		}
+		replacements, err := trip.reassignExpense(e, email, target, now)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, Reassignment{ReplacedID: e.ID, Expenses: replacements})
+	}
+	if usr.ID == 0 {
+		// not saved yet
+		return rslt, trip.RemoveParticipant(email)
+	}
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var cnt int64
+	var res sql.Result
+	var changed bool
+	for _, r := range rslt {
+		replaced := trip.expenseByID(r.ReplacedID)
+		err = trip.deleteExpense(ctx, txn, replaced, now)
+		if err != nil {
+			goto Rollback
+		}
+		for i, e := range r.Expenses {
+			err = trip.insertExpense(ctx, txn, e)
+			if err != nil {
+				goto Rollback
+			}
+			if i == 0 {
+				// the receipts and the voice notes are the ones of the
+				// expense replaced
+				_, err = txn.ExecContext(ctx, receiptMove, e.ID, trip.ID, r.ReplacedID)
+				if err != nil {
+					goto Rollback
+				}
+				_, err = txn.ExecContext(ctx, voiceNoteMove, e.ID, trip.ID, r.ReplacedID)
+				if err != nil {
+					goto Rollback
+				}
+			}
+			_, err = txn.ExecContext(ctx, reassignmentInsert, e.ID, trip.ID, r.ReplacedID, usr.ID, trip.emailLookup[target], now.UnixMicro())
+			if err != nil {
+				goto Rollback
+			}
+		}
+		err = recordAudit(ctx, txn, trip.ID, now, ActionExpenseReassigned, r.ReplacedID, replaced, r.Expenses)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	_, err = txn.ExecContext(ctx, peopleForbiddenDelete, trip.ID, usr.ID, usr.ID)
+	if err != nil {
+		goto Rollback
+	}
+	// The expenses are checked again in the DB, in case one was added since the trip was loaded
+	res, err = txn.ExecContext(ctx, peopleDelete, trip.ID, usr.ID)
+	if err != nil {
+		goto Rollback
+	}
+	cnt, err = res.RowsAffected()
+	if err != nil {
+		goto Rollback
+	}
+	if cnt != 1 {
+		err = ErrParticipantInExpense
+		goto Rollback
+	}
+	err = recordAudit(ctx, txn, trip.ID, now, ActionParticipantRemoved, 0, auditParticipant{Email: email, ReassignedTo: target}, nil)
+	if err != nil {
+		goto Rollback
+	}
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rslt {
+		for _, e := range r.Expenses {
+			kept = append(kept, e)
+		}
+	}
+	trip.Expenses = kept
+	trip.totalExpense = 0
+	for _, e := range kept {
+		trip.totalExpense += e.amount
+	}
+	trip.Participants = append(trip.Participants[:idx], trip.Participants[idx+1:]...)
+	delete(trip.emailLookup, email)
+	delete(trip.RSVP, email)
+	// already deleted in the DB
+	changed = trip.forbiddenChanged
+	trip.dropForbiddenTransfers(email)
+	trip.forbiddenChanged = changed
+	trip.publishActivity(ActivityTripChanged, nil)
+	return rslt, nil
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		fatalf(ctx, "ERROR: trip.ReassignParticipant() failed to rollback transaction on trip '%v': '%v'\n", trip, rollbackErr)
+	}
+	for _, r := range rslt {
+		for _, e := range r.Expenses {
+			e.ID = 0
+		}
+	}
+	return nil, err
+}
+
+// expenseByID returns the expense of the trip with the given ID, nil if
+// there's none
+func (trip *Trip) expenseByID(id int64) *Expense {
+	for _, e := range trip.Expenses {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the reassignment of the shares
+// of the participants removed.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestReassignParticipant removes 2 participants from the expenses they
+// took part in, checking the settlement stays the same for the others
+func TestReassignParticipant(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	today := NewDate(time.Now())
+	tr := NewTrip("Trip R", alice, "", today, []string{bob, charlie, david})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		desc         string
+		participants []Participant
+	}{
+		{"dinner", []Participant{{alice, 0, 9000}, {bob, 0, 0}, {charlie, 0, 0}}},
+		{"taxi", []Participant{{bob, 0, 1200}, {charlie, 0, 0}}},
+		{"snack", []Participant{{alice, 0, 0}, {david, 0, 600}}},
+	} {
+		err = tr.AddExpense(today, e.desc, e.participants)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tr.ReassignParticipant(ctx, rdb, alice, bob); err == nil {
+		t.Error("expected the owner not to be removed")
+	}
+	if _, err = tr.ReassignParticipant(ctx, rdb, "eve@example.com", ""); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a user not in the trip, got %v", err)
+	}
+	if _, err = tr.ReassignParticipant(ctx, rdb, david, ""); err != ErrReassignPaid {
+		t.Errorf("expected ErrReassignPaid, got %v", err)
+	}
+	if _, err = tr.ReassignParticipant(ctx, rdb, david, david); err == nil {
+		t.Error("expected the target to be another participant")
+	}
+
+	// charlie is replaced by david, who wasn't part of the expenses
+	reassigned, err := tr.ReassignParticipant(ctx, rdb, charlie, david)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reassigned) != 2 || len(reassigned[0].Expenses) != 1 || len(reassigned[1].Expenses) != 1 {
+		t.Errorf("expected dinner and taxi replaced, got %+v", reassigned)
+	}
+	want := Settlement{bob: {alice: 3000}, david: {alice: 2700, bob: 600}}
+	if got, _ := tr.Settlement(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected settlement %v, want %v", got, want)
+	}
+
+	// alice takes over the share of david in the dinner, bob is paid back
+	// the part he'd bear otherwise
+	reassigned, err = tr.ReassignParticipant(ctx, rdb, david, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reassigned) != 3 || len(reassigned[0].Expenses) != 1 || len(reassigned[1].Expenses) != 2 {
+		t.Errorf("expected the taxi, then the dinner with a correction, got %+v", reassigned)
+	}
+	want = Settlement{bob: {alice: 2400}}
+	if got, _ := tr.Settlement(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected settlement %v, want %v", got, want)
+	}
+	got, err := LoadSettlement(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected loaded settlement %v, want %v", got, want)
+	}
+
+	tr2, err := LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr2.Participants) != 1 || tr2.Participants[0].Email != bob || len(tr2.Expenses) != 4 {
+		t.Errorf("Unexpected participants %v or expenses %d", tr2.people(), len(tr2.Expenses))
+	}
+	events, err := LoadAuditEvents(ctx, rdb, AuditQuery{TripID: tr.ID, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %+v", events)
+	}
+	for _, ev := range events {
+		if ev.Type != AuditReassignment || !strings.Contains(ev.Description, "replaces expense") {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the receipts attached to the expenses, e.g. the
+// pictures of the proofs of payment. The files are stored on disk by the
+// SHA-256 of their content, so a file uploaded twice is stored once, and
+// the receipt table refers to them.
+
+package trip
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	receiptInsert = `INSERT INTO receipt (trip_id, expense_id, sha256, content_type, filename, size, uploaded_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+	receiptsSelect = `SELECT receipt_id, trip_id, expense_id, sha256, content_type, filename, size, uploaded_at
+FROM receipt WHERE trip_id = ? AND expense_id = ?`
+	receiptOrder              = "\nORDER BY receipt_id"
+	receiptByID               = "\nAND receipt_id = ?"
+	receiptTripArchivedSelect = `SELECT t.archived_at FROM expense AS e, trip AS t
+WHERE e.trip_id = t.trip_id AND e.expense_id = ? AND e.trip_id = ? AND t.deleted_at = 0`
+	receiptExpenseSelect = `SELECT 1 FROM expense WHERE expense_id = ? AND trip_id = ?
+UNION SELECT 1 FROM expense_deleted WHERE expense_id = ? AND trip_id = ?`
+	receiptHashCount = `SELECT (SELECT COUNT(*) FROM receipt WHERE sha256 = ?)
++ (SELECT COUNT(*) FROM voice_note WHERE sha256 = ?)`
+)
+
+// receiptDir is the directory of the receipt files, see SetReceiptDir()
+var receiptDir string
+
+// SetReceiptDir sets the directory the receipt files are stored in, it's
+// created as needed. It's meant to be called before serving any request.
+func SetReceiptDir(dir string) {
+	receiptDir = dir
+}
+
+// Receipt is a file attached to an expense
+type Receipt struct {
+	// ID is the primary key and is from a sequence
+	ID int64 `json:"receipt_id"`
+	// TripID and ExpenseID are the expense the receipt is attached to
+	TripID    int64 `json:"trip_id"`
+	ExpenseID int64 `json:"expense_id"`
+	// SHA256 is the hex encoded hash of the content, which names the file
+	SHA256 string `json:"sha256"`
+	// ContentType is the media type of the content, e.g. image/jpeg
+	ContentType string `json:"content_type"`
+	// Filename is the name of the file uploaded
+	Filename string `json:"filename"`
+	// Size is the size of the content in bytes
+	Size int64 `json:"size"`
+	// UploadedAt is when the receipt was attached
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// receiptPath returns the path of the receipt file of the given hash
+func receiptPath(sum string) string {
+	return storedPath(receiptDir, sum)
+}
+
+// storedPath returns the path of the file of the given hash in the
+// directory, under a directory named by its first 2 characters
+func storedPath(dir, sum string) string {
+	return filepath.Join(dir, sum[:2], sum)
+}
+
+// storeFile writes the content to the directory, e.g. of the receipts, and
+// returns its hash and size. The file is written under a temporary name
+// first, so a partial upload is never seen.
+func storeFile(dir string, r io.Reader) (sum string, size int64, err error) {
+	err = os.MkdirAll(dir, 0o750)
+	if err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	path := storedPath(dir, sum)
+	if _, err = os.Stat(path); err == nil {
+		// the same content is already stored
+		return sum, size, nil
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o750)
+	if err != nil {
+		return "", 0, err
+	}
+	return sum, size, os.Rename(tmp.Name(), path)
+}
+
+// AttachReceipt stores the content read from r, and attaches it to the
+// expense of the trip. sql.ErrNoRows is returned if the expense isn't one
+// of the trip, and ErrTripArchived if the trip is archived.
+func AttachReceipt(ctx context.Context, db *sql.DB, tripID, expenseID int64, filename, contentType string, r io.Reader) (*Receipt, error) {
+	if receiptDir == "" {
+		return nil, errors.New("no directory for the receipts, see SetReceiptDir()")
+	}
+	var archivedAt int64
+	err := db.QueryRowContext(ctx, receiptTripArchivedSelect, expenseID, tripID).Scan(&archivedAt)
+	if err != nil {
+		return nil, err
+	}
+	if archivedAt != 0 {
+		return nil, ErrTripArchived
+	}
+	rcpt := &Receipt{
+		TripID:      tripID,
+		ExpenseID:   expenseID,
+		ContentType: contentType,
+		Filename:    filepath.Base(filename),
+		UploadedAt:  Now().UTC().Truncate(time.Microsecond),
+	}
+	rcpt.SHA256, rcpt.Size, err = storeFile(receiptDir, r)
+	if err != nil {
+		return nil, err
+	}
+	rslt, err := db.ExecContext(ctx, receiptInsert, tripID, expenseID, rcpt.SHA256, rcpt.ContentType,
+		rcpt.Filename, rcpt.Size, rcpt.UploadedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	rcpt.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Attached receipt %d (%s, %d bytes) to expense %d of trip %d\n",
+		rcpt.ID, rcpt.SHA256, rcpt.Size, expenseID, tripID)
+	return rcpt, nil
+}
+
+// queryReceipts runs the given receipt query
+func queryReceipts(ctx context.Context, db *sql.DB, query string, args ...any) ([]*Receipt, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*Receipt{}
+	for rows.Next() {
+		rcpt := new(Receipt)
+		var uploadedAt int64
+		err = rows.Scan(&rcpt.ID, &rcpt.TripID, &rcpt.ExpenseID, &rcpt.SHA256, &rcpt.ContentType,
+			&rcpt.Filename, &rcpt.Size, &uploadedAt)
+		if err != nil {
+			return nil, err
+		}
+		rcpt.UploadedAt = time.UnixMicro(uploadedAt).UTC()
+		rslt = append(rslt, rcpt)
+	}
+	return rslt, rows.Err()
+}
+
+// LoadReceipts returns the receipts of an expense, in the order they were
+// attached. The receipts of a deleted expense are kept for the past views
+// of the trip. sql.ErrNoRows is returned if the expense was never one of
+// the trip.
+func LoadReceipts(ctx context.Context, db *sql.DB, tripID, expenseID int64) ([]*Receipt, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, receiptExpenseSelect, expenseID, tripID, expenseID, tripID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	return queryReceipts(ctx, db, receiptsSelect+receiptOrder, tripID, expenseID)
+}
+
+// LoadReceipt returns a receipt of an expense. sql.ErrNoRows is returned
+// if there's no such receipt.
+func LoadReceipt(ctx context.Context, db *sql.DB, tripID, expenseID, receiptID int64) (*Receipt, error) {
+	rslt, err := queryReceipts(ctx, db, receiptsSelect+receiptByID, tripID, expenseID, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rslt) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return rslt[0], nil
+}
+
+// Open opens the file of the receipt for reading
+func (rcpt *Receipt) Open() (*os.File, error) {
+	return os.Open(receiptPath(rcpt.SHA256))
+}
+
+// removeReceiptFiles removes the files of the given hashes no receipt nor
+// voice note refers to anymore, e.g. once purged. A failure is only logged, the file
+// is left behind.
+func removeReceiptFiles(ctx context.Context, db *sql.DB, sums []string) {
+	for _, sum := range sums {
+		var n int
+		err := db.QueryRowContext(ctx, receiptHashCount, sum, sum).Scan(&n)
+		if err == nil && n == 0 {
+			err = os.Remove(receiptPath(sum))
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			Logf(ctx, "ERROR: failed to remove the receipt file %s: %v\n", sum, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the receipts of the expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestReceipts attaches the same content to 2 expenses, checks it's stored
+// once, and removed once the trip is purged
+func TestReceipts(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	SetReceiptDir(t.TempDir())
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetReceiptDir("")
+	})
+
+	tr := NewTrip("Trip R", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range []string{"hotel", "taxi"} {
+		err = tr.AddExpense(NewDate(start), desc, []Participant{{alice, 0, 2000}, {bob, 0, 0}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const content = "%PDF-1.4 a receipt"
+	var receipts []*Receipt
+	for _, e := range tr.Expenses {
+		rcpt, err := AttachReceipt(ctx, rdb, tr.ID, e.ID, "../receipt.pdf", "application/pdf", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		receipts = append(receipts, rcpt)
+	}
+	if receipts[0].SHA256 != receipts[1].SHA256 || receipts[0].Size != int64(len(content)) || receipts[0].Filename != "receipt.pdf" {
+		t.Errorf("Unexpected receipts: %+v, %+v", receipts[0], receipts[1])
+	}
+	_, err = AttachReceipt(ctx, rdb, tr.ID+1, tr.Expenses[0].ID, "r.pdf", "application/pdf", strings.NewReader(content))
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an expense of another trip, got %v", err)
+	}
+
+	list, err := LoadReceipts(ctx, rdb, tr.ID, tr.Expenses[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || *list[0] != *receipts[0] {
+		t.Errorf("Unexpected receipts of expense %d: %v", tr.Expenses[0].ID, list)
+	}
+	rcpt, err := LoadReceipt(ctx, rdb, tr.ID, tr.Expenses[1].ID, receipts[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := rcpt.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(got) != content {
+		t.Errorf("Unexpected content %q, %v", got, err)
+	}
+	_, err = LoadReceipt(ctx, rdb, tr.ID, tr.Expenses[0].ID, receipts[1].ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for the receipt of another expense, got %v", err)
+	}
+
+	_, err = tr.Complete(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(3 * 365 * 24 * time.Hour)
+	plan, err := PlanPurge(ctx, rdb, RetentionPolicy{TripYears: 2, HistoryMonths: 6}, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Purge(ctx, rdb, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rcpt.Open()
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the receipt file to be removed, got %v", err)
+	}
+}
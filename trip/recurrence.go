@@ -0,0 +1,321 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the recurring expenses of a trip, e.g. the daily
+// parking or the weekly rent. A recurrence adds its expense every number
+// of days until the trip is completed, see ApplyRecurrences(). The
+// recurrences are suggested from the expenses entered by hand again and
+// again, the same description and split at a steady cadence, and created
+// once the owner accepts the suggestion.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	recurrenceInsert = `INSERT INTO recurring_expense (trip_id, description, split, every_days, next_date, created_at)
+VALUES (?, ?, ?, ?, ?, ?)`
+	recurrenceColumns = `SELECT recurrence_id, trip_id, description, split, every_days, next_date, created_at
+FROM recurring_expense`
+	recurrencesOfTrip = recurrenceColumns + " WHERE trip_id = ? ORDER BY recurrence_id"
+	recurrencesDue    = recurrenceColumns + " WHERE next_date <= ? ORDER BY trip_id, recurrence_id"
+	recurrenceNext    = "UPDATE recurring_expense SET next_date = ? WHERE recurrence_id = ?"
+	recurrenceDelete  = "DELETE FROM recurring_expense WHERE trip_id = ? AND recurrence_id = ?"
+)
+
+// minRecurrences is the number of expenses alike it takes to suggest a
+// recurrence
+const minRecurrences = 3
+
+// Recurrence is an expense of a trip added every number of days
+type Recurrence struct {
+	// ID is the primary key and is from a sequence
+	ID          int64  `json:"recurrence_id"`
+	TripID      int64  `json:"trip_id"`
+	Description string `json:"description"`
+	// Participants is the split of each expense added
+	Participants []Participant `json:"participants"`
+	// EveryDays is the number of days between the expenses
+	EveryDays int `json:"every_days"`
+	// NextDate is the date of the next expense added
+	NextDate  Date      `json:"next_date"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Suggestion is a recurrence suggested from expenses alike of a trip
+type Suggestion struct {
+	// ID is the ID of the first of the expenses, identifying the
+	// suggestion as long as they stay in the trip
+	ID          int64  `json:"suggestion_id"`
+	Description string `json:"description"`
+	// Amount is the amount of each expense (in cent)
+	Amount       int           `json:"amount"`
+	Participants []Participant `json:"participants"`
+	EveryDays    int           `json:"every_days"`
+	// ExpenseIDs are the expenses alike, by date
+	ExpenseIDs []int64 `json:"expense_ids"`
+	// NextDate is the date the recurrence would add the next expense
+	NextDate Date `json:"next_date"`
+}
+
+// recurrenceKey returns the key of the expenses alike: the description,
+// regardless of the case, and the split
+func recurrenceKey(description string, participants []Participant) string {
+	split := make([]string, 0, len(participants))
+	for _, p := range participants {
+		split = append(split, p.Email+":"+strconv.Itoa(p.Paid))
+	}
+	sort.Strings(split)
+	return strings.ToLower(strings.TrimSpace(description)) + "\x00" + strings.Join(split, ",")
+}
+
+// daysBetween returns the number of days from a date to another
+func daysBetween(from, to Date) int {
+	return int(math.Round(to.Sub(from.Time).Hours() / 24))
+}
+
+// SuggestRecurrences returns the recurrences suggested from the expenses of
+// the trip: at least minRecurrences of them with the same description and
+// split, at the same number of days from one to the next. The expenses
+// alike of a recurrence of the trip aren't suggested again.
+func (trip *Trip) SuggestRecurrences(ctx context.Context, db *sql.DB) ([]*Suggestion, error) {
+	recurrences, err := LoadRecurrences(ctx, db, trip.ID)
+	if err != nil {
+		return nil, err
+	}
+	covered := make(map[string]bool)
+	for _, r := range recurrences {
+		covered[recurrenceKey(r.Description, r.Participants)] = true
+	}
+	alike := make(map[string][]*Expense)
+	var keys []string
+	for _, e := range trip.Expenses {
+		key := recurrenceKey(e.Description, e.Participants)
+		if covered[key] {
+			continue
+		}
+		if _, ok := alike[key]; !ok {
+			keys = append(keys, key)
+		}
+		alike[key] = append(alike[key], e)
+	}
+	rslt := []*Suggestion{}
+	for _, key := range keys {
+		expenses := alike[key]
+		if len(expenses) < minRecurrences {
+			continue
+		}
+		sort.SliceStable(expenses, func(i, j int) bool { return expenses[i].Date.Before(expenses[j].Date.Time) })
+		every := daysBetween(expenses[0].Date, expenses[1].Date)
+		steady := every > 0
+		for i := 2; steady && i < len(expenses); i++ {
+			steady = daysBetween(expenses[i-1].Date, expenses[i].Date) == every
+		}
+		if !steady {
+			continue
+		}
+		last := expenses[len(expenses)-1]
+		s := &Suggestion{
+			ID:           expenses[0].ID,
+			Description:  last.Description,
+			Amount:       last.amount,
+			Participants: last.Participants,
+			EveryDays:    every,
+			NextDate:     NewDate(last.Date.AddDate(0, 0, every)),
+		}
+		for _, e := range expenses {
+			s.ExpenseIDs = append(s.ExpenseIDs, e.ID)
+		}
+		rslt = append(rslt, s)
+	}
+	sort.Slice(rslt, func(i, j int) bool { return rslt[i].ID < rslt[j].ID })
+	return rslt, nil
+}
+
+// AcceptSuggestion creates the recurrence of the suggestion of the trip,
+// adding its next expense from the date suggested. sql.ErrNoRows is
+// returned if the trip has no such suggestion, ErrTripArchived or
+// ErrTripCompleted if it's over.
+func (trip *Trip) AcceptSuggestion(ctx context.Context, db *sql.DB, suggestionID int64) (*Recurrence, error) {
+	switch {
+	case trip.Archived:
+		return nil, ErrTripArchived
+	case !isUnset(trip.EndDate):
+		return nil, ErrTripCompleted
+	}
+	suggestions, err := trip.SuggestRecurrences(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(suggestions, func(s *Suggestion) bool { return s.ID == suggestionID })
+	if i < 0 {
+		return nil, sql.ErrNoRows
+	}
+	s := suggestions[i]
+	r := &Recurrence{
+		TripID:       trip.ID,
+		Description:  s.Description,
+		Participants: s.Participants,
+		EveryDays:    s.EveryDays,
+		NextDate:     s.NextDate,
+		CreatedAt:    Now().UTC().Truncate(time.Microsecond),
+	}
+	split, err := json.Marshal(r.Participants)
+	if err != nil {
+		return nil, err
+	}
+	rslt, err := db.ExecContext(ctx, recurrenceInsert, r.TripID, r.Description, string(split), r.EveryDays,
+		r.NextDate.Unix(), r.CreatedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	r.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Created recurrence %d of trip %d, %q every %d days\n", r.ID, r.TripID, r.Description, r.EveryDays)
+	return r, nil
+}
+
+// LoadRecurrences returns the recurrences of the trip
+func LoadRecurrences(ctx context.Context, db *sql.DB, tripID int64) ([]*Recurrence, error) {
+	return loadRecurrences(ctx, db, recurrencesOfTrip, tripID)
+}
+
+// loadRecurrences returns the recurrences selected by the query
+func loadRecurrences(ctx context.Context, db *sql.DB, query string, args ...any) ([]*Recurrence, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*Recurrence{}
+	for rows.Next() {
+		r := new(Recurrence)
+		var split string
+		var nextDate, createdAt int64
+		err = rows.Scan(&r.ID, &r.TripID, &r.Description, &split, &r.EveryDays, &nextDate, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(split), &r.Participants)
+		if err != nil {
+			return nil, fmt.Errorf("invalid split of recurrence %d: %v", r.ID, err)
+		}
+		r.NextDate = epochToDate(nextDate)
+		r.CreatedAt = time.UnixMicro(createdAt).UTC()
+		rslt = append(rslt, r)
+	}
+	return rslt, rows.Err()
+}
+
+// DeleteRecurrence stops the recurrence of the trip, the expenses it added
+// are kept. sql.ErrNoRows is returned if the trip has no such recurrence.
+func DeleteRecurrence(ctx context.Context, db *sql.DB, tripID, recurrenceID int64) error {
+	rslt, err := db.ExecContext(ctx, recurrenceDelete, tripID, recurrenceID)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return sql.ErrNoRows
+	}
+	Logf(ctx, "Deleted recurrence %d of trip %d\n", recurrenceID, tripID)
+	return nil
+}
+
+// ApplyRecurrences adds the expenses of the recurrences due by today, the
+// ones missed included, and returns their number. The recurrences of the
+// trips over, or whose participants left, are deleted.
+func ApplyRecurrences(ctx context.Context, db *sql.DB) (int, error) {
+	today := NewDate(Now().UTC())
+	due, err := loadRecurrences(ctx, db, recurrencesDue, today.Unix())
+	if err != nil {
+		return 0, err
+	}
+	byTrip := make(map[int64][]*Recurrence)
+	var tripIDs []int64
+	for _, r := range due {
+		if _, ok := byTrip[r.TripID]; !ok {
+			tripIDs = append(tripIDs, r.TripID)
+		}
+		byTrip[r.TripID] = append(byTrip[r.TripID], r)
+	}
+	added := 0
+	for _, tripID := range tripIDs {
+		n, err := applyTripRecurrences(ctx, db, tripID, byTrip[tripID], today)
+		if err != nil {
+			return added, err
+		}
+		added += n
+	}
+	return added, nil
+}
+
+// applyTripRecurrences adds the expenses of the recurrences of the trip due
+// by today, and returns their number
+func applyTripRecurrences(ctx context.Context, db *sql.DB, tripID int64, due []*Recurrence, today Date) (int, error) {
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	var applied []*Recurrence
+	added := 0
+	for _, r := range due {
+		if trip == nil || trip.Archived || !isUnset(trip.EndDate) {
+			Logf(ctx, "Deleting recurrence %d, trip %d is over\n", r.ID, tripID)
+			_, err = db.ExecContext(ctx, recurrenceDelete, tripID, r.ID)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		for ; !r.NextDate.After(today.Time); r.NextDate = NewDate(r.NextDate.AddDate(0, 0, r.EveryDays)) {
+			err = trip.AddExpense(r.NextDate, r.Description, r.Participants)
+			if err != nil {
+				break
+			}
+			added++
+		}
+		if err != nil {
+			Logf(ctx, "WARNING: deleting recurrence %d of trip %d: %v\n", r.ID, tripID, err)
+			_, err = db.ExecContext(ctx, recurrenceDelete, tripID, r.ID)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		applied = append(applied, r)
+	}
+	if added == 0 {
+		return 0, nil
+	}
+	err = trip.Save(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range applied {
+		_, err = db.ExecContext(ctx, recurrenceNext, r.NextDate.Unix(), r.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	Logf(ctx, "Added %d recurring expenses to trip %d\n", added, tripID)
+	return added, nil
+}
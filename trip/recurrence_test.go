@@ -0,0 +1,154 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the recurring expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	recurringExpenseCreate = `CREATE TABLE IF NOT EXISTS recurring_expense (
+recurrence_id INTEGER CONSTRAINT recurring_expense_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+description VARCHAR(512) NOT NULL,
+split TEXT NOT NULL,
+every_days INTEGER NOT NULL,
+next_date INTEGER NOT NULL,
+created_at INTEGER NOT NULL)`
+	recurringExpenseIndex = "CREATE INDEX IF NOT EXISTS recurring_expense_trip_index ON recurring_expense(trip_id)"
+)
+
+// TestRecurrences suggests the recurrence of the parking paid every day,
+// accepts it and applies it until the trip is completed
+func TestRecurrences(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	day := func(n int) Date { return NewDate(start.AddDate(0, 0, n)) }
+	split := []Participant{{alice, 0, 1500}, {bob, 0, 0}}
+	tr := NewTrip("Trip R", alice, "", day(0), []string{bob})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		day         int
+		description string
+		split       []Participant
+	}{
+		{0, "Parking", split},
+		{0, "Dinner", []Participant{{alice, 0, 0}, {bob, 0, 4000}}},
+		{1, "parking ", split},
+		{1, "Dinner", []Participant{{alice, 0, 0}, {bob, 0, 4000}}},
+		{1, "Taxi", []Participant{{alice, 0, 0}, {bob, 0, 2000}}},
+		{2, "Parking", split},
+		{2, "Parking", []Participant{{alice, 0, 0}, {bob, 0, 1500}}},
+		{4, "Dinner", []Participant{{alice, 0, 0}, {bob, 0, 4000}}},
+		{4, "Taxi", []Participant{{alice, 0, 0}, {bob, 0, 2000}}},
+	} {
+		err = tr.AddExpense(day(e.day), e.description, e.split)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the dinners aren't steady, the taxis not enough, bob paid the
+	// parking once
+	suggestions, err := tr.SuggestRecurrences(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 1 {
+		t.Fatalf("expected the parking suggested, got %+v", suggestions)
+	}
+	s := suggestions[0]
+	want := []int64{tr.Expenses[0].ID, tr.Expenses[2].ID, tr.Expenses[5].ID}
+	if s.ID != want[0] || s.EveryDays != 1 || s.Amount != 1500 || !reflect.DeepEqual(s.ExpenseIDs, want) ||
+		!s.NextDate.Equal(day(3).Time) {
+		t.Errorf("expected the parking every day from %v, expenses %v, got %+v", day(3), want, s)
+	}
+
+	_, err = tr.AcceptSuggestion(ctx, rdb, tr.Expenses[1].ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for the dinner, got %v", err)
+	}
+	r, err := tr.AcceptSuggestion(ctx, rdb, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recurrences, err := LoadRecurrences(ctx, rdb, tr.ID)
+	if err != nil || len(recurrences) != 1 || recurrences[0].ID != r.ID || recurrences[0].Description != "Parking" {
+		t.Errorf("expected recurrence %+v, got %+v, %v", r, recurrences, err)
+	}
+	suggestions, err = tr.SuggestRecurrences(ctx, rdb)
+	if err != nil || len(suggestions) != 0 {
+		t.Errorf("expected the parking no longer suggested, got %+v, %v", suggestions, err)
+	}
+
+	// nothing's due before the date, then the days missed are caught up
+	n, err := ApplyRecurrences(ctx, rdb)
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing due, got %d, %v", n, err)
+	}
+	fc.Advance(5 * 24 * time.Hour)
+	n, err = ApplyRecurrences(ctx, rdb)
+	if err != nil || n != 3 {
+		t.Fatalf("expected the parking of days 3 to 5 added, got %d, %v", n, err)
+	}
+	n, err = ApplyRecurrences(ctx, rdb)
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing due anymore, got %d, %v", n, err)
+	}
+	tr, err = LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Expenses) != 12 || !tr.Expenses[11].Date.Equal(day(5).Time) || tr.Expenses[11].Description != "Parking" {
+		t.Errorf("expected the parking of day 5 last of 12 expenses, got %d: %+v", len(tr.Expenses), tr.Expenses[len(tr.Expenses)-1])
+	}
+	recurrences, _ = LoadRecurrences(ctx, rdb, tr.ID)
+	if len(recurrences) != 1 || !recurrences[0].NextDate.Equal(day(6).Time) {
+		t.Errorf("expected the next parking on %v, got %+v", day(6), recurrences)
+	}
+
+	// the recurrences of a completed trip are deleted
+	_, err = tr.Complete(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.AcceptSuggestion(ctx, rdb, s.ID)
+	if err != ErrTripCompleted {
+		t.Errorf("expected ErrTripCompleted, got %v", err)
+	}
+	fc.Advance(24 * time.Hour)
+	n, err = ApplyRecurrences(ctx, rdb)
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing added to the completed trip, got %d, %v", n, err)
+	}
+	recurrences, _ = LoadRecurrences(ctx, rdb, tr.ID)
+	if len(recurrences) != 0 {
+		t.Errorf("expected the recurrence deleted, got %+v", recurrences)
+	}
+	err = DeleteRecurrence(ctx, rdb, tr.ID, r.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+}
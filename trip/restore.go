@@ -0,0 +1,220 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the deletion of the trips and the restoration of
+// the deleted trips and expenses. A deleted trip is only marked so: it's
+// left out of the loads and the listings until it's restored, or purged
+// past the retention of the deleted trips. The deleted expenses are
+// archived already, see archiveExpense(), they're restored from the
+// archive with their ID, so their receipts and voice notes follow. They
+// have no deleted_at column: the archive keeps them out of the queries of
+// the expenses and of the running balances, which would all have to
+// filter on it, and it keeps when they were deleted for the past views.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	tripSoftDelete = `UPDATE trip SET deleted_at = ?, version = version + 1
+WHERE trip_id = ? AND deleted_at = 0`
+	tripUndelete = `UPDATE trip SET deleted_at = 0, version = version + 1
+WHERE trip_id = ? AND deleted_at != 0`
+	tripDeletedAtSelect  = "SELECT deleted_at FROM trip WHERE trip_id = ?"
+	deletedTripsSelect   = "SELECT trip_id FROM trip WHERE deleted_at != 0 AND deleted_at < ? ORDER BY trip_id"
+	deletedExpenseByID   = "\nAND e.expense_id = ?"
+	expenseReplacedCount = "SELECT COUNT(*) FROM expense_reassignment WHERE trip_id = ? AND replaced_id = ?"
+	expenseRestore       = `INSERT INTO expense (expense_id, trip_id, txn_date, created_at, description)
+SELECT expense_id, trip_id, txn_date, created_at, description FROM expense_deleted
+WHERE expense_id = ? AND trip_id = ?`
+	noteRestore = `INSERT INTO expense_note (expense_id, notes)
+SELECT expense_id, notes FROM expense_deleted WHERE expense_id = ? AND notes != ''`
+	participantRestore = `INSERT INTO expense_participant (expense_id, user_id, amount)
+SELECT expense_id, user_id, amount FROM expense_participant_deleted WHERE expense_id = ?`
+	deletedParticipantDelete = "DELETE FROM expense_participant_deleted WHERE expense_id = ?"
+	deletedExpenseDelete     = "DELETE FROM expense_deleted WHERE expense_id = ? AND trip_id = ?"
+)
+
+// ErrExpenseReplaced is returned when restoring an expense replaced by
+// the expenses of a reassignment, it would be counted twice
+var ErrExpenseReplaced = errors.New("the expense was replaced by a reassignment, it can't be restored")
+
+// DeleteTrip marks a trip as deleted, it can be restored until it's
+// purged. sql.ErrNoRows is returned if the trip doesn't exist or is
+// deleted already.
+func DeleteTrip(ctx context.Context, db *sql.DB, tripID int64) error {
+	unlock := lockTrip(tripID)
+	defer unlock()
+
+	now := Now()
+	rslt, err := db.ExecContext(ctx, tripSoftDelete, now.UnixMicro(), tripID)
+	if err != nil {
+		return err
+	}
+	n, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	Logf(ctx, "Deleted trip %d\n", tripID)
+	return recordAudit(ctx, db, tripID, now, ActionTripDeleted, 0, nil, nil)
+}
+
+// LoadDeletedTrip loads a deleted trip by the primary key, e.g. to check
+// who may restore it. sql.ErrNoRows is returned if there's no such
+// deleted trip. The trip can't be saved until restored.
+func LoadDeletedTrip(ctx context.Context, db *sql.DB, id int64) (*Trip, error) {
+	return scanTripByID(ctx, db, db.QueryRowContext(ctx, tripByIDSelet, id), true)
+}
+
+// RestoreTrip restores a deleted trip, and returns it. sql.ErrNoRows is
+// returned if there's no such deleted trip.
+func RestoreTrip(ctx context.Context, db *sql.DB, tripID int64) (*Trip, error) {
+	unlock := lockTrip(tripID)
+	defer unlock()
+
+	rslt, err := db.ExecContext(ctx, tripUndelete, tripID)
+	if err != nil {
+		return nil, err
+	}
+	n, err := rslt.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	Logf(ctx, "Restored trip %d\n", tripID)
+	err = recordAudit(ctx, db, tripID, Now(), ActionTripRestored, 0, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return LoadTripByID(ctx, db, tripID)
+}
+
+// deletedTrips returns the IDs of the trips deleted before the cutoff
+func deletedTrips(ctx context.Context, db *sql.DB, cutoff time.Time) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, deletedTripsSelect, cutoff.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []int64{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, id)
+	}
+	return rslt, rows.Err()
+}
+
+// RestoreExpense restores a deleted expense of the trip, with its ID, its
+// notes and its participants, and adds it back to the running balances.
+// sql.ErrNoRows is returned if the expense isn't a deleted one of the
+// trip, ErrUnknownParticipant if one of its participants has left the
+// trip since, ErrExpenseReplaced if it was reassigned, and a FreezeError
+// if the expense entry of the trip is frozen.
+func (trip *Trip) RestoreExpense(ctx context.Context, db *sql.DB, expenseID int64) (*Expense, error) {
+	if !trip.asOf.IsZero() {
+		return nil, ErrPastTrip
+	}
+	// any creation and deletion time
+	deleted, err := queryExpensesFrom(ctx, db, deletedParticipantSelect,
+		deletedExpenseSelect+deletedExpenseByID, trip.ID, int64(math.MaxInt64), 0, expenseID)
+	if err != nil {
+		return nil, err
+	}
+	if len(deleted) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	e := deleted[0]
+	for _, p := range e.Participants {
+		if !trip.IsParticipant(p.Email) {
+			return nil, ErrUnknownParticipant
+		}
+	}
+
+	var replaced int
+	now := Now()
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = txn.QueryRowContext(ctx, expenseReplacedCount, trip.ID, expenseID).Scan(&replaced)
+	if err == nil && replaced > 0 {
+		err = ErrExpenseReplaced
+	}
+	if err != nil {
+		goto Rollback
+	}
+	err = trip.checkFreeze(ctx, txn, now)
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, expenseRestore, expenseID, trip.ID)
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, noteRestore, expenseID)
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, participantRestore, expenseID)
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, deletedParticipantDelete, expenseID)
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, deletedExpenseDelete, expenseID, trip.ID)
+	if err != nil {
+		goto Rollback
+	}
+	err = trip.updateBalances(ctx, txn, e, 1)
+	if err != nil {
+		goto Rollback
+	}
+	err = recordAudit(ctx, txn, trip.ID, now, ActionExpenseRestored, expenseID, nil, e)
+	if err != nil {
+		goto Rollback
+	}
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+	trip.totalExpense += e.amount
+	trip.Expenses = append(trip.Expenses, e)
+	// in the order of their creation, as loaded
+	sort.SliceStable(trip.Expenses, func(i, j int) bool {
+		a, b := trip.Expenses[i], trip.Expenses[j]
+		if a.createdAt.Equal(b.createdAt) {
+			return a.ID < b.ID
+		}
+		return a.createdAt.Before(b.createdAt)
+	})
+	Logf(ctx, "Restored expense %d of trip %d\n", expenseID, trip.ID)
+	trip.publishActivity(ActivityExpenseAdded, map[string]int64{"expense_id": expenseID})
+	return e, nil
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		fatalf(ctx, "ERROR: trip.RestoreExpense() failed to rollback transaction on trip '%v': '%v'\n", trip, rollbackErr)
+	}
+	return nil, err
+}
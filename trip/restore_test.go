@@ -0,0 +1,258 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the deletion and the restoration
+// of the trips and the expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestDeleteTrip deletes a trip, restores it, deletes it again and purges
+// it past the retention of the deleted trips
+func TestDeleteTrip(t *testing.T) {
+	ctx := context.Background()
+	ddb := openTestDB(t)
+	start := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Trip D", alice, "", NewDate(start), []string{bob})
+	if err := tr.Save(ctx, ddb); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteTrip(ctx, ddb, tr.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteTrip(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows deleting a deleted trip, got %v", err)
+	}
+	if _, err := LoadTripByID(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected a deleted trip not found, got %v", err)
+	}
+	trips, err := LoadTripsByOwnerSorted(ctx, ddb, alice, TripsByName, Page{})
+	if err != nil || len(trips) != 0 {
+		t.Errorf("expected no trip listed, got %v, %v", trips, err)
+	}
+	deleted, err := LoadDeletedTrip(ctx, ddb, tr.ID)
+	if err != nil || deleted.Owner.Email != alice {
+		t.Fatalf("Unexpected deleted trip %+v, %v", deleted, err)
+	}
+
+	restored, err := RestoreTrip(ctx, ddb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Name != "Trip D" || restored.Version <= tr.Version {
+		t.Errorf("Unexpected restored trip %+v", restored)
+	}
+	if _, err = RestoreTrip(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows restoring a trip not deleted, got %v", err)
+	}
+	if _, err = LoadDeletedTrip(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows loading a trip not deleted, got %v", err)
+	}
+
+	if err = DeleteTrip(ctx, ddb, tr.ID); err != nil {
+		t.Fatal(err)
+	}
+	policy := RetentionPolicy{DeletedDays: 30}
+	plan, err := PlanPurge(ctx, ddb, policy, Now())
+	if err != nil || len(plan.DeletedTrips) != 0 {
+		t.Fatalf("expected nothing to purge yet, got %+v, %v", plan, err)
+	}
+	fc.Advance(31 * 24 * time.Hour)
+	plan, err = PlanPurge(ctx, ddb, policy, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.DeletedTrips) != 1 || plan.DeletedTrips[0] != tr.ID {
+		t.Fatalf("expected trip %d to purge, got %+v", tr.ID, plan)
+	}
+	if err = Purge(ctx, ddb, plan); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadDeletedTrip(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected the trip purged, got %v", err)
+	}
+}
+
+// TestDeletedTripUnreachable completes a trip and deletes it, then checks
+// its settlement, snapshot, archiving, organizer fee, pushes and
+// statistics are out of reach
+func TestDeletedTripUnreachable(t *testing.T) {
+	ctx := context.Background()
+	ddb := openTestDB(t)
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Second).Now)
+	SetInstanceKey([]byte("instance key"))
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetInstanceKey(nil)
+	})
+
+	tr := NewTrip("Trip U", alice, "", NewDate(start), []string{bob})
+	err := tr.SetOrganizerFee(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Save(ctx, ddb); err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(start), "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Save(ctx, ddb); err != nil {
+		t.Fatal(err)
+	}
+	usr, err := LoadOrCreateUser(ctx, ddb, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RegisterDevice(ctx, ddb, usr, PlatformFCM, "tok-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SettleTrip(ctx, ddb, tr.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteTrip(ctx, ddb, tr.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = PreviewSettlement(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows previewing the settlement, got %v", err)
+	}
+	if _, err = SettleTrip(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows settling, got %v", err)
+	}
+	if _, err = LoadSnapshot(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows loading the snapshot, got %v", err)
+	}
+	if _, _, err = SignSettlement(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows signing the settlement, got %v", err)
+	}
+	if err = ArchiveTrip(ctx, ddb, tr.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows archiving, got %v", err)
+	}
+	s := Settlement{}
+	if err = loadOrganizerFee(ctx, ddb, tr.ID, s); err != nil || len(s) != 0 {
+		t.Errorf("expected no organizer fee, got %v, %v", s, err)
+	}
+	txn, err := ddb.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed, err := queuePushes(ctx, txn, tr.ID, EventExpenseAdded, tr.Expenses[0])
+	if rollbackErr := txn.Rollback(); rollbackErr != nil {
+		t.Fatal(rollbackErr)
+	}
+	if err != nil || pushed != 0 {
+		t.Errorf("expected nothing pushed, got %d, %v", pushed, err)
+	}
+	var spent int
+	monthStart, monthEnd := monthOf(NewDate(start))
+	err = ddb.QueryRowContext(ctx, monthlySpentSelect, monthStart, monthEnd, usr.ID).Scan(&spent)
+	if err != nil || spent != 0 {
+		t.Errorf("expected nothing spent this month against the caps, got %d, %v", spent, err)
+	}
+	stats, err := LoadStats(ctx, ddb, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Trips != 0 || stats.ActiveTrips != 0 || stats.Expenses != 0 || len(stats.Busiest) != 0 {
+		t.Errorf("expected the deleted trip left out of the statistics, got %#v", *stats)
+	}
+}
+
+// TestRestoreExpense deletes an expense and restores it, with its ID and
+// its notes, back in the balances
+func TestRestoreExpense(t *testing.T) {
+	ctx := context.Background()
+	edb := openTestDB(t)
+	start := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Trip E", alice, "", NewDate(start), []string{bob, charlie})
+	if err := tr.Save(ctx, edb); err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range []string{"hotel", "taxi"} {
+		err := tr.AddExpense(NewDate(start), desc, []Participant{{Email: alice, Paid: 6000}, {Email: bob}, {Email: charlie}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr.Expenses[0].Notes = "two nights"
+	if err := tr.Save(ctx, edb); err != nil {
+		t.Fatal(err)
+	}
+	hotel := tr.Expenses[0].ID
+	before, err := LoadSettlement(ctx, edb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = UpdateTrip(ctx, edb, tr.ID, func(tr *Trip) error {
+		return tr.RemoveExpense(hotel)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored *Expense
+	tr, err = UpdateTrip(ctx, edb, tr.ID, func(tr *Trip) error {
+		var err error
+		restored, err = tr.RestoreExpense(ctx, edb, hotel)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != hotel || restored.Notes != "two nights" || len(restored.Participants) != 3 {
+		t.Errorf("Unexpected restored expense %+v", restored)
+	}
+	tr, _ = LoadTripByID(ctx, edb, tr.ID)
+	if len(tr.Expenses) != 2 || tr.Expenses[0].ID != hotel || tr.Expenses[0].Notes != "two nights" {
+		t.Errorf("expected the hotel back first, got %+v", tr.Expenses)
+	}
+	after, err := LoadSettlement(ctx, edb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("expected the settlement %v back, got %v", before, after)
+	}
+	if _, err = tr.RestoreExpense(ctx, edb, hotel); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows restoring an expense not deleted, got %v", err)
+	}
+
+	// charlie leaves once the hotel and the taxi are deleted, they can't
+	// be restored
+	_, err = UpdateTrip(ctx, edb, tr.ID, func(tr *Trip) error {
+		for len(tr.Expenses) > 0 {
+			if err := tr.RemoveExpense(tr.Expenses[0].ID); err != nil {
+				return err
+			}
+		}
+		return tr.RemoveParticipant(charlie)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, _ = LoadTripByID(ctx, edb, tr.ID)
+	if _, err = tr.RestoreExpense(ctx, edb, hotel); err != ErrUnknownParticipant {
+		t.Errorf("expected ErrUnknownParticipant, got %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit enforces the data retention policy: the trips completed long
+// ago are deleted with everything about them, and so are the trips deleted
+// by their owners and the history of the deleted expenses past a while.
+// The users of the trips completed a while ago are anonymized, as if
+// erased, unless they take part in a trip that isn't, the deleted trips
+// aside. A purge is planned first, the plan is the dry-run report, then
+// it's carried out as planned.
+
+package trip
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	historyCountSelect = "SELECT COUNT(*) FROM expense_deleted WHERE deleted_at < ?"
+	historyPurge       = `DELETE FROM expense_participant_deleted WHERE expense_id IN (
+SELECT expense_id FROM expense_deleted WHERE deleted_at < ?)`
+	historyPurgeMetadata = `DELETE FROM expense_metadata WHERE expense_id IN (
+SELECT expense_id FROM expense_deleted WHERE deleted_at < ?)`
+	historyPurgeReceipts = `DELETE FROM receipt WHERE expense_id IN (
+SELECT expense_id FROM expense_deleted WHERE deleted_at < ?)`
+	historyPurgeVoiceNotes = `DELETE FROM voice_note WHERE expense_id IN (
+SELECT expense_id FROM expense_deleted WHERE deleted_at < ?)`
+	historyPurgeExpenses = "DELETE FROM expense_deleted WHERE deleted_at < ?"
+	tripEndSelect        = "SELECT end_date FROM trip WHERE trip_id = ?"
+	tripReceiptsSelect   = `SELECT sha256 FROM receipt WHERE trip_id = ?
+UNION SELECT sha256 FROM voice_note WHERE trip_id = ?`
+	historyReceiptsSelect = `SELECT sha256 FROM receipt WHERE expense_id IN (
+SELECT expense_id FROM expense_deleted WHERE deleted_at < ?)
+UNION SELECT sha256 FROM voice_note WHERE expense_id IN (
+SELECT expense_id FROM expense_deleted WHERE deleted_at < ?)`
+	// inactiveUsersSelect picks the users of the trips completed before
+	// the cutoff, less those of the trips open or completed since, the
+	// deleted trips being left out of both
+	inactiveUsersSelect = `SELECT DISTINCT u.user_id FROM tuser AS u, participant AS p, trip AS t
+WHERE u.email NOT LIKE ? AND p.user_id = u.user_id AND t.trip_id = p.trip_id
+AND t.deleted_at = 0 AND t.end_date > 0 AND t.end_date < ?
+AND u.user_id NOT IN (SELECT p.user_id FROM participant AS p, trip AS t
+WHERE t.trip_id = p.trip_id AND t.deleted_at = 0 AND (t.end_date = 0 OR t.end_date >= ?))
+ORDER BY u.user_id`
+	inactiveUserSelect = `SELECT u.email, u.verified, u.display_name,
+(SELECT COUNT(*) FROM participant AS p, trip AS t
+WHERE t.trip_id = p.trip_id AND p.user_id = u.user_id AND t.deleted_at = 0
+AND (t.end_date = 0 OR t.end_date >= ?))
+FROM tuser AS u WHERE u.user_id = ?`
+)
+
+// tripPurges delete all the rows of a trip, the rows referring to the
+// expenses first
+var tripPurges = []string{
+	"DELETE FROM expense_participant WHERE expense_id IN (SELECT expense_id FROM expense WHERE trip_id = ?)",
+	"DELETE FROM expense_note WHERE expense_id IN (SELECT expense_id FROM expense WHERE trip_id = ?)",
+	"DELETE FROM expense_metadata WHERE expense_id IN (SELECT expense_id FROM expense WHERE trip_id = ?)",
+	"DELETE FROM expense_metadata WHERE expense_id IN (SELECT expense_id FROM expense_deleted WHERE trip_id = ?)",
+	"DELETE FROM expense_participant_deleted WHERE expense_id IN (SELECT expense_id FROM expense_deleted WHERE trip_id = ?)",
+	"DELETE FROM expense_deleted WHERE trip_id = ?",
+	"DELETE FROM expense_reassignment WHERE trip_id = ?",
+	"DELETE FROM expense WHERE trip_id = ?",
+	"DELETE FROM trip_settlement WHERE trip_id = ?",
+	"DELETE FROM trip_snapshot WHERE trip_id = ?",
+	"DELETE FROM forbidden_transfer WHERE trip_id = ?",
+	"DELETE FROM cost_preference WHERE trip_id = ?",
+	"DELETE FROM trip_envelope WHERE trip_id = ?",
+	"DELETE FROM expense_approval WHERE trip_id = ?",
+	"DELETE FROM approval_delegation WHERE trip_id = ?",
+	"DELETE FROM trip_message WHERE trip_id = ?",
+	"DELETE FROM household_member WHERE trip_id = ?",
+	"DELETE FROM trip_setting WHERE trip_id = ?",
+	"DELETE FROM expense_quarantine WHERE trip_id = ?",
+	"DELETE FROM receipt WHERE trip_id = ?",
+	"DELETE FROM voice_note WHERE trip_id = ?",
+	"DELETE FROM audit_log WHERE trip_id = ?",
+	"DELETE FROM webhook_delivery WHERE trip_id = ?",
+	"DELETE FROM push_delivery WHERE trip_id = ?",
+	"DELETE FROM recurring_expense WHERE trip_id = ?",
+	"DELETE FROM trip_sheet WHERE trip_id = ?",
+	"DELETE FROM settlement_payment WHERE trip_id = ?",
+	"DELETE FROM expense_freeze WHERE trip_id = ?",
+	"DELETE FROM expense_review WHERE trip_id = ?",
+	"DELETE FROM trip_federation WHERE trip_id = ?",
+	"DELETE FROM webhook_delivery WHERE webhook_id IN (SELECT webhook_id FROM webhook WHERE trip_id = ?)",
+	"DELETE FROM webhook WHERE trip_id = ?",
+	"DELETE FROM spend_cap WHERE trip_id = ?",
+	"DELETE FROM api_token WHERE trip_id = ?",
+	"DELETE FROM participant WHERE trip_id = ?",
+	"DELETE FROM trip WHERE trip_id = ?",
+}
+
+// ErrPurgeChanged is returned when the data to purge isn't the one of the
+// confirmed plan anymore
+var ErrPurgeChanged = errors.New("the data to purge has changed since the plan was confirmed")
+
+// RetentionPolicy is how long the data is kept, the zero values keep it
+// forever
+type RetentionPolicy struct {
+	// TripYears is the number of years the completed trips are kept
+	TripYears int
+	// HistoryMonths is the number of months the deleted expenses are kept
+	// for the past views of the trips
+	HistoryMonths int
+	// AnonymizeMonths is the number of months the email addresses of the
+	// users are kept once all their trips are completed, the deleted ones
+	// aside
+	AnonymizeMonths int
+	// DeletedDays is the number of days the deleted trips can be restored
+	DeletedDays int
+}
+
+// IsEmpty returns true if the policy keeps everything
+func (p RetentionPolicy) IsEmpty() bool {
+	return p.TripYears <= 0 && p.HistoryMonths <= 0 && p.AnonymizeMonths <= 0 && p.DeletedDays <= 0
+}
+
+// PurgePlan is what a purge deletes, it's also the report of the purge
+type PurgePlan struct {
+	// TripsEndedBefore is the cutoff of the completed trips, nil if they're
+	// kept
+	TripsEndedBefore *time.Time `json:"trips_ended_before"`
+	// HistoryDeletedBefore is the cutoff of the deleted expenses, nil if
+	// they're kept
+	HistoryDeletedBefore *time.Time `json:"history_deleted_before"`
+	// UsersInactiveBefore is the cutoff of the completion of the trips of
+	// the users anonymized, nil if they're kept
+	UsersInactiveBefore *time.Time `json:"users_inactive_before"`
+	// TripsDeletedBefore is the cutoff of the deleted trips, nil if
+	// they're kept
+	TripsDeletedBefore *time.Time `json:"trips_deleted_before"`
+	// Trips are the IDs of the trips deleted
+	Trips []int64 `json:"trips"`
+	// DeletedTrips are the IDs of the trips deleted by their owners, and
+	// purged
+	DeletedTrips []int64 `json:"deleted_trips"`
+	// DeletedExpenses is the number of deleted expenses removed from the
+	// history, besides the ones of the trips deleted
+	DeletedExpenses int `json:"deleted_expenses"`
+	// Users are the IDs of the users anonymized
+	Users []int64 `json:"users"`
+	// Confirmation identifies the plan, it's given back to carry it out
+	Confirmation string `json:"confirmation"`
+}
+
+// PlanPurge returns what the policy purges at the given time, nothing is
+// deleted
+func PlanPurge(ctx context.Context, db *sql.DB, p RetentionPolicy, now time.Time) (PurgePlan, error) {
+	rslt := PurgePlan{Trips: []int64{}, DeletedTrips: []int64{}, Users: []int64{}}
+	if p.TripYears > 0 {
+		cutoff := now.AddDate(-p.TripYears, 0, 0).UTC()
+		ids, err := FindTripIDs(ctx, db, TripFilter{EndedBefore: cutoff})
+		if err != nil {
+			return rslt, err
+		}
+		rslt.TripsEndedBefore = &cutoff
+		rslt.Trips = ids
+	}
+	if p.HistoryMonths > 0 {
+		cutoff := now.AddDate(0, -p.HistoryMonths, 0).UTC()
+		err := db.QueryRowContext(ctx, historyCountSelect, cutoff.UnixMicro()).Scan(&rslt.DeletedExpenses)
+		if err != nil {
+			return rslt, err
+		}
+		rslt.HistoryDeletedBefore = &cutoff
+	}
+	if p.AnonymizeMonths > 0 {
+		cutoff := now.AddDate(0, -p.AnonymizeMonths, 0).UTC()
+		ids, err := inactiveUsers(ctx, db, cutoff)
+		if err != nil {
+			return rslt, err
+		}
+		rslt.UsersInactiveBefore = &cutoff
+		rslt.Users = ids
+	}
+	if p.DeletedDays > 0 {
+		cutoff := now.AddDate(0, 0, -p.DeletedDays).UTC()
+		ids, err := deletedTrips(ctx, db, cutoff)
+		if err != nil {
+			return rslt, err
+		}
+		rslt.TripsDeletedBefore = &cutoff
+		rslt.DeletedTrips = ids
+	}
+	// the cutoffs move with the time, only what's deleted is confirmed
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%d|%v|%v", rslt.Trips, rslt.DeletedExpenses, rslt.Users, rslt.DeletedTrips)
+	rslt.Confirmation = hex.EncodeToString(h.Sum(nil))[:16]
+	return rslt, nil
+}
+
+// inactiveUsers returns the IDs of the users not erased of the trips
+// completed before the cutoff, who take part in no trip open or completed
+// since, the deleted trips aside
+func inactiveUsers(ctx context.Context, db *sql.DB, cutoff time.Time) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, inactiveUsersSelect, "%@"+erasedDomain, cutoff.Unix(), cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []int64{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, id)
+	}
+	return rslt, rows.Err()
+}
+
+// Purge carries out a plan of PlanPurge(). The deletions are irreversible.
+// ErrPurgeChanged is returned, and nothing is deleted, if a trip of the
+// plan isn't completed anymore, a deleted trip of the plan was restored,
+// or a user of the plan has joined a trip since. The receipt files no receipt refers to anymore are removed once
+// the rows are deleted.
+func Purge(ctx context.Context, db *sql.DB, plan PurgePlan) (err error) {
+	for _, id := range append(plan.Trips, plan.DeletedTrips...) {
+		unlock := lockTrip(id)
+		defer unlock()
+	}
+
+	var receipts, avatars []string
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, id := range plan.Trips {
+		var endDate int64
+		err = txn.QueryRowContext(ctx, tripEndSelect, id).Scan(&endDate)
+		if err == sql.ErrNoRows || (err == nil && endDate == 0) {
+			err = ErrPurgeChanged
+		}
+		if err != nil {
+			goto Rollback
+		}
+		receipts, err = purgeTrip(ctx, txn, receipts, id)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	for _, id := range plan.DeletedTrips {
+		var deletedAt int64
+		err = txn.QueryRowContext(ctx, tripDeletedAtSelect, id).Scan(&deletedAt)
+		if err == sql.ErrNoRows || (err == nil && (deletedAt == 0 || deletedAt >= plan.TripsDeletedBefore.UnixMicro())) {
+			err = ErrPurgeChanged
+		}
+		if err != nil {
+			goto Rollback
+		}
+		receipts, err = purgeTrip(ctx, txn, receipts, id)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	if plan.UsersInactiveBefore != nil {
+		for _, id := range plan.Users {
+			var avatar string
+			avatar, err = anonymizeUser(ctx, txn, id, *plan.UsersInactiveBefore)
+			if err != nil {
+				goto Rollback
+			}
+			avatars = append(avatars, avatar)
+		}
+	}
+	if plan.HistoryDeletedBefore != nil {
+		cutoff := plan.HistoryDeletedBefore.UnixMicro()
+		receipts, err = appendReceiptSums(ctx, txn, receipts, historyReceiptsSelect, cutoff, cutoff)
+		if err != nil {
+			goto Rollback
+		}
+		_, err = txn.ExecContext(ctx, historyPurgeReceipts, cutoff)
+		if err != nil {
+			goto Rollback
+		}
+		_, err = txn.ExecContext(ctx, historyPurgeVoiceNotes, cutoff)
+		if err != nil {
+			goto Rollback
+		}
+		_, err = txn.ExecContext(ctx, historyPurge, cutoff)
+		if err != nil {
+			goto Rollback
+		}
+		_, err = txn.ExecContext(ctx, historyPurgeMetadata, cutoff)
+		if err != nil {
+			goto Rollback
+		}
+		_, err = txn.ExecContext(ctx, historyPurgeExpenses, cutoff)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	err = txn.Commit()
+	if err == nil {
+		Logf(ctx, "Purged %d trips, %d deleted trips and %d deleted expenses, anonymized %d users\n",
+			len(plan.Trips), len(plan.DeletedTrips), plan.DeletedExpenses, len(plan.Users))
+		removeReceiptFiles(ctx, db, receipts)
+		removeAvatarFiles(ctx, db, avatars)
+	}
+	return err
+
+Rollback:
+	if rollbackErr := txn.Rollback(); rollbackErr != nil {
+		fatalf(ctx, "ERROR: Purge() failed to rollback transaction: '%v'\n", rollbackErr)
+	}
+	return err
+}
+
+// purgeTrip deletes all the rows of a trip, within the transaction of the
+// purge, and appends the hashes of its receipt and voice note files
+func purgeTrip(ctx context.Context, txn *sql.Tx, sums []string, id int64) ([]string, error) {
+	sums, err := appendReceiptSums(ctx, txn, sums, tripReceiptsSelect, id, id)
+	if err != nil {
+		return sums, err
+	}
+	for _, stmt := range tripPurges {
+		_, err = txn.ExecContext(ctx, stmt, id)
+		if err != nil {
+			return sums, err
+		}
+	}
+	return sums, nil
+}
+
+// anonymizeUser erases the user, within the transaction of the purge, and
+// returns the hash of their avatar. ErrPurgeChanged is returned if they're
+// erased already or one of their trips wasn't completed before the cutoff.
+// The settlements don't change, the user keeping their ID.
+func anonymizeUser(ctx context.Context, txn *sql.Tx, id int64, cutoff time.Time) (string, error) {
+	usr := &User{ID: id}
+	var active int
+	err := txn.QueryRowContext(ctx, inactiveUserSelect, cutoff.Unix(), id).Scan(&usr.Email, &usr.Verified, &usr.DisplayName, &active)
+	if err == sql.ErrNoRows || (err == nil && (active > 0 || isErased(usr.Email))) {
+		return "", ErrPurgeChanged
+	}
+	if err != nil {
+		return "", err
+	}
+	_, avatar, err := eraseUser(ctx, txn, usr)
+	return avatar, err
+}
+
+// appendReceiptSums appends the hashes of the receipt and voice note
+// files returned by the query, within the transaction of the purge
+func appendReceiptSums(ctx context.Context, txn *sql.Tx, sums []string, query string, args ...any) ([]string, error) {
+	rows, err := txn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return sums, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sum string
+		err = rows.Scan(&sum)
+		if err != nil {
+			return sums, err
+		}
+		sums = append(sums, sum)
+	}
+	return sums, rows.Err()
+}
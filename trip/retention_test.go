@@ -0,0 +1,227 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the data retention policy.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestPurge completes a trip 3 years ago and deletes an expense of
+// another trip a year ago, then purges with a policy keeping the trips 2
+// years and the history 6 months
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	var trips []*Trip
+	for _, name := range []string{"Old", "Recent"} {
+		tr := NewTrip(name, alice, "", NewDate(start), []string{bob})
+		err := tr.Save(ctx, pdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, desc := range []string{"hotel", "taxi"} {
+			err = tr.AddExpense(NewDate(start), desc, []Participant{{alice, 0, 2000}, {bob, 0, 0}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = tr.Save(ctx, pdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trips = append(trips, tr)
+	}
+	old, recent := trips[0], trips[1]
+	_, err := old.Complete(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(2 * 365 * 24 * time.Hour)
+	err = recent.RemoveExpense(recent.Expenses[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = recent.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(365 * 24 * time.Hour)
+
+	policy := RetentionPolicy{TripYears: 2, HistoryMonths: 6}
+	plan, err := PlanPurge(ctx, pdb, policy, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Trips, []int64{old.ID}) || plan.DeletedExpenses != 1 || plan.Confirmation == "" {
+		t.Errorf("expected to purge trip %d and 1 deleted expense, got %+v", old.ID, plan)
+	}
+	// planning deletes nothing, and the same plan is confirmed again
+	again, err := PlanPurge(ctx, pdb, policy, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Confirmation != plan.Confirmation {
+		t.Errorf("expected the same confirmation, got %s and %s", plan.Confirmation, again.Confirmation)
+	}
+
+	err = Purge(ctx, pdb, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadTripByID(ctx, pdb, old.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected the old trip to be gone, got %v", err)
+	}
+	for _, table := range []string{"expense", "participant", "trip_snapshot", "trip_settlement"} {
+		var n int
+		err = pdb.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE trip_id = ?", old.ID).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("expected no rows of the old trip in %s, got %d", table, n)
+		}
+	}
+	var n int
+	err = pdb.QueryRowContext(ctx, "SELECT COUNT(*) FROM expense_participant").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected the 2 rows of the expense of the recent trip in expense_participant, got %d", n)
+	}
+	tr, err := LoadTripByID(ctx, pdb, recent.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Expenses) != 1 {
+		t.Errorf("expected the recent trip to keep its expense, got %d", len(tr.Expenses))
+	}
+	plan, err = PlanPurge(ctx, pdb, policy, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Trips) != 0 || plan.DeletedExpenses != 0 {
+		t.Errorf("expected nothing left to purge, got %+v", plan)
+	}
+
+	err = Purge(ctx, pdb, PurgePlan{Trips: []int64{recent.ID}})
+	if err != ErrPurgeChanged {
+		t.Errorf("purging an active trip: expected ErrPurgeChanged, got %v", err)
+	}
+}
+
+// TestAnonymize completes a trip a year ago, and anonymizes its
+// participants not taking part in an active trip
+func TestAnonymize(t *testing.T) {
+	ctx := context.Background()
+	adb := openTestDB(t)
+	start := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	old := NewTrip("Old", alice, "", NewDate(start), []string{bob})
+	err := old.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.AddExpense(NewDate(start), "hotel", []Participant{{alice, 0, 0}, {bob, 0, 3000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = old.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Complete(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := NewTrip("Active", alice, "", NewDate(start), []string{charlie})
+	err = active.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a trip left open, then deleted, keeps neither Bob nor David, who
+	// has no completed trip, from being considered
+	dropped := NewTrip("Dropped", david, "", NewDate(start), []string{bob})
+	err = dropped.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DeleteTrip(ctx, adb, dropped.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := SettleTrip(ctx, adb, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := LoadOrCreateUser(ctx, adb, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(400 * 24 * time.Hour)
+
+	policy := RetentionPolicy{AnonymizeMonths: 12}
+	plan, err := PlanPurge(ctx, adb, policy, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.Users, []int64{usr.ID}) || len(plan.Trips) != 0 {
+		t.Fatalf("expected to anonymize user %d only, got %+v", usr.ID, plan)
+	}
+	err = Purge(ctx, adb, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := SettleTrip(ctx, adb, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pseudonym := tombstone(usr.ID)
+	if after[alice][pseudonym] != before[alice][bob] || len(after[alice]) != len(before[alice]) {
+		t.Errorf("expected the settlement %v under %s, got %v", before, pseudonym, after)
+	}
+	reloaded, err := LoadTripByID(ctx, adb, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.IsParticipant(bob) || !reloaded.IsParticipant(pseudonym) {
+		t.Errorf("Unexpected participants %v", reloaded.Participants)
+	}
+	_, err = LoadTripByID(ctx, adb, active.ID)
+	if err != nil {
+		t.Errorf("expected the active trip to be kept, got %v", err)
+	}
+
+	// the users anonymized aren't planned again, nor anonymized twice
+	again, err := PlanPurge(ctx, adb, policy, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Users) != 0 {
+		t.Errorf("expected nothing left to anonymize, got %+v", again)
+	}
+	err = Purge(ctx, adb, plan)
+	if err != ErrPurgeChanged {
+		t.Errorf("anonymizing twice: expected ErrPurgeChanged, got %v", err)
+	}
+}
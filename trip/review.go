@@ -0,0 +1,162 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the review queue of the expenses not entered by a
+// person, e.g. imported from a bank statement or scanned from a receipt.
+// They're queued with the confidence of their source, and don't count
+// toward the balances until a participant corrects them if need be, then
+// confirms them into the trip.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	reviewInsert = `INSERT INTO expense_review (trip_id, source, payload, confidence, corrected, created_at, updated_at)
+VALUES (?, ?, ?, ?, 0, ?, ?)`
+	reviewSelect = `SELECT review_id, trip_id, source, payload, confidence, corrected, created_at, updated_at
+FROM expense_review WHERE trip_id = ?`
+	reviewOrder  = "\nORDER BY confidence, review_id"
+	reviewByID   = "\nAND review_id = ?"
+	reviewUpdate = `UPDATE expense_review SET payload = ?, confidence = 100, corrected = 1, updated_at = ?
+WHERE trip_id = ? AND review_id = ?`
+	reviewDelete = "DELETE FROM expense_review WHERE trip_id = ? AND review_id = ?"
+)
+
+// ReviewedExpense is an expense queued for a participant of the trip to
+// review
+type ReviewedExpense struct {
+	// ID is the primary key and is from a sequence
+	ID     int64 `json:"review_id"`
+	TripID int64 `json:"trip_id"`
+	// Source is where the expense comes from, e.g. "ocr" or the name of an
+	// import
+	Source string `json:"source"`
+	// Confidence is how sure the source is of the expense, in percent, 100
+	// once corrected
+	Confidence int  `json:"confidence"`
+	Corrected  bool `json:"corrected"`
+	// Expense is the payload of the expense, as queued or corrected
+	Expense   json.RawMessage `json:"expense"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// QueueForReview queues the expense of the source for the trip, given as
+// its JSON payload, with the confidence of the source in percent.
+// sql.ErrNoRows is returned if there's no such trip.
+func QueueForReview(ctx context.Context, db *sql.DB, tripID int64, source string, confidence int, payload []byte) (*ReviewedExpense, error) {
+	if confidence < 0 || confidence > 100 {
+		return nil, errors.New("the confidence must be between 0 and 100")
+	}
+	var exists int
+	err := db.QueryRowContext(ctx, tripExistsSelect, tripID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	rv := &ReviewedExpense{
+		TripID:     tripID,
+		Source:     source,
+		Confidence: confidence,
+		Expense:    json.RawMessage(payload),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	rslt, err := db.ExecContext(ctx, reviewInsert, rv.TripID, rv.Source, string(payload), rv.Confidence,
+		rv.CreatedAt.UnixMicro(), rv.UpdatedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	rv.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Queued expense %d of trip %d from %s for review, %d%% confident\n", rv.ID, rv.TripID, rv.Source, rv.Confidence)
+	return rv, nil
+}
+
+// LoadReviewQueue returns the expenses of the trip queued for review, the
+// least confident first
+func LoadReviewQueue(ctx context.Context, db *sql.DB, tripID int64) ([]*ReviewedExpense, error) {
+	rows, err := db.QueryContext(ctx, reviewSelect+reviewOrder, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*ReviewedExpense{}
+	for rows.Next() {
+		rv, err := scanReviewed(rows)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, rv)
+	}
+	return rslt, rows.Err()
+}
+
+// LoadReviewed returns an expense of the trip queued for review,
+// sql.ErrNoRows if there's none
+func LoadReviewed(ctx context.Context, db *sql.DB, tripID, reviewID int64) (*ReviewedExpense, error) {
+	return scanReviewed(db.QueryRowContext(ctx, reviewSelect+reviewByID, tripID, reviewID))
+}
+
+// scanReviewed reads an expense queued for review from a row
+func scanReviewed(row interface{ Scan(...any) error }) (*ReviewedExpense, error) {
+	rv := new(ReviewedExpense)
+	var payload string
+	var createdAt, updatedAt int64
+	err := row.Scan(&rv.ID, &rv.TripID, &rv.Source, &payload, &rv.Confidence, &rv.Corrected, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	rv.Expense = json.RawMessage(payload)
+	rv.CreatedAt = time.UnixMicro(createdAt).UTC()
+	rv.UpdatedAt = time.UnixMicro(updatedAt).UTC()
+	return rv, nil
+}
+
+// CorrectReviewed replaces the payload of an expense of the trip queued
+// for review with the one corrected by a participant, its confidence is
+// then 100. sql.ErrNoRows is returned if there's none.
+func CorrectReviewed(ctx context.Context, db *sql.DB, tripID, reviewID int64, payload []byte) (*ReviewedExpense, error) {
+	rslt, err := db.ExecContext(ctx, reviewUpdate, string(payload), Now().UTC().Truncate(time.Microsecond).UnixMicro(), tripID, reviewID)
+	if err != nil {
+		return nil, err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return nil, sql.ErrNoRows
+	}
+	Logf(ctx, "Corrected expense %d of trip %d under review\n", reviewID, tripID)
+	return LoadReviewed(ctx, db, tripID, reviewID)
+}
+
+// DeleteReviewed deletes an expense of the trip from the review queue,
+// once confirmed into the trip or discarded. sql.ErrNoRows is returned if
+// there's none.
+func DeleteReviewed(ctx context.Context, db *sql.DB, tripID, reviewID int64) error {
+	rslt, err := db.ExecContext(ctx, reviewDelete, tripID, reviewID)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the review queue of the
+// expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	expenseReviewCreate = `CREATE TABLE IF NOT EXISTS expense_review (
+review_id INTEGER CONSTRAINT expense_review_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+source VARCHAR(64) NOT NULL,
+payload TEXT NOT NULL,
+confidence INTEGER NOT NULL,
+corrected BOOLEAN NOT NULL DEFAULT FALSE,
+created_at INTEGER NOT NULL,
+updated_at INTEGER NOT NULL)`
+	expenseReviewTripIndex = "CREATE INDEX IF NOT EXISTS expense_review_trip_index ON expense_review(trip_id)"
+)
+
+// TestReviewQueue queues some expenses, corrects one, and checks the queue
+// lists the least confident first
+func TestReviewQueue(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	start := time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Minute).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Review", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = QueueForReview(ctx, rdb, tr.ID+1000, "ocr", 50, []byte(`{}`)); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a missing trip, got %v", err)
+	}
+	if _, err = QueueForReview(ctx, rdb, tr.ID, "ocr", 101, []byte(`{}`)); err == nil {
+		t.Error("expected a confidence over 100 to be refused")
+	}
+	sure, err := QueueForReview(ctx, rdb, tr.ID, "bank", 90, []byte(`{"amount":1200}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsure, err := QueueForReview(ctx, rdb, tr.ID, "ocr", 30, []byte(`{"amount":320}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := LoadReviewQueue(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].ID != unsure.ID || queue[1].ID != sure.ID {
+		t.Fatalf("expected the least confident first, got %+v", queue)
+	}
+
+	corrected, err := CorrectReviewed(ctx, rdb, tr.ID, unsure.ID, []byte(`{"amount":3200}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !corrected.Corrected || corrected.Confidence != 100 || string(corrected.Expense) != `{"amount":3200}` ||
+		!corrected.UpdatedAt.After(corrected.CreatedAt) {
+		t.Errorf("Unexpected correction %+v", corrected)
+	}
+	if _, err = CorrectReviewed(ctx, rdb, tr.ID, unsure.ID+1000, []byte(`{}`)); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows correcting a missing expense, got %v", err)
+	}
+
+	// the queued expenses don't count toward the balances
+	loaded, err := LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Expenses) != 0 {
+		t.Errorf("expected no expense in the trip, got %d", len(loaded.Expenses))
+	}
+
+	err = DeleteReviewed(ctx, rdb, tr.ID, sure.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteReviewed(ctx, rdb, tr.ID, sure.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows deleting again, got %v", err)
+	}
+	if _, err = LoadReviewed(ctx, rdb, tr.ID, sure.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows loading a deleted expense, got %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit routes the settlement of a trip around its forbidden
+// transfers, e.g. a minor shouldn't pay another participant directly. The
+// amount of a forbidden transfer is passed along the shortest chain of
+// allowed transfers between the same two people instead, through other
+// participants of the trip.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Some global constants used to store SQL statements
+const (
+	forbiddenSelect = `SELECT pu.email, ru.email
+FROM forbidden_transfer AS f, tuser AS pu, tuser AS ru
+WHERE f.payer = pu.user_id
+AND f.payee = ru.user_id
+AND f.trip_id = ?
+ORDER BY pu.email, ru.email`
+	forbiddenInsert   = "INSERT INTO forbidden_transfer (trip_id, payer, payee) VALUES (?, ?, ?)"
+	forbiddenDelete   = "DELETE FROM forbidden_transfer WHERE trip_id = ?"
+	peopleEmailSelect = `SELECT u.email
+FROM tuser AS u, participant AS p
+WHERE u.user_id = p.user_id
+AND p.trip_id = ?`
+)
+
+// ErrInfeasibleSettlement is returned when the settlement of a trip can't
+// avoid its forbidden transfers
+var ErrInfeasibleSettlement = errors.New("no settlement avoids the forbidden transfers")
+
+// TransferPair is a payer and a payee, e.g. of a forbidden transfer
+type TransferPair struct {
+	// Payer is the email address of the participant paying
+	Payer string `json:"payer" binding:"required"`
+	// Payee is the email address of the participant paid
+	Payee string `json:"payee" binding:"required"`
+}
+
+// queryForbiddenTransfers returns the forbidden transfers of a trip
+func queryForbiddenTransfers(ctx context.Context, db *sql.DB, tripID int64) ([]TransferPair, error) {
+	rows, err := db.QueryContext(ctx, forbiddenSelect, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := []TransferPair{}
+	for rows.Next() {
+		var tp TransferPair
+		err = rows.Scan(&tp.Payer, &tp.Payee)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, tp)
+	}
+	return rslt, rows.Err()
+}
+
+// SetForbiddenTransfers replaces the forbidden transfers of the trip, the
+// payers and payees must be part of the trip. They're written to the
+// database by Save().
+func (trip *Trip) SetForbiddenTransfers(pairs []TransferPair) error {
+	seen := make(map[TransferPair]bool)
+	rslt := []TransferPair{}
+	for _, tp := range pairs {
+		tp = TransferPair{normalizeEmail(tp.Payer), normalizeEmail(tp.Payee)}
+		for _, email := range []string{tp.Payer, tp.Payee} {
+			if !trip.IsParticipant(email) {
+				return fmt.Errorf("'%s' is not part of the trip", email)
+			}
+		}
+		if tp.Payer == tp.Payee {
+			return fmt.Errorf("'%s' can't pay themselves", tp.Payer)
+		}
+		if !seen[tp] {
+			seen[tp] = true
+			rslt = append(rslt, tp)
+		}
+	}
+	sort.Slice(rslt, func(i, j int) bool {
+		if rslt[i].Payer == rslt[j].Payer {
+			return rslt[i].Payee < rslt[j].Payee
+		}
+		return rslt[i].Payer < rslt[j].Payer
+	})
+	trip.ForbiddenTransfers = rslt
+	trip.forbiddenChanged = true
+	return nil
+}
+
+// dropForbiddenTransfers removes the forbidden transfers of a user leaving
+// the trip
+func (trip *Trip) dropForbiddenTransfers(email string) {
+	kept := trip.ForbiddenTransfers[:0]
+	for _, tp := range trip.ForbiddenTransfers {
+		if tp.Payer != email && tp.Payee != email {
+			kept = append(kept, tp)
+		}
+	}
+	if len(kept) != len(trip.ForbiddenTransfers) {
+		trip.ForbiddenTransfers = kept
+		trip.forbiddenChanged = true
+	}
+}
+
+// saveForbiddenTransfers replaces the forbidden transfers in the database
+// It's expected to be executed within a transaction
+func (trip *Trip) saveForbiddenTransfers(ctx context.Context, txn *sql.Tx) error {
+	_, err := txn.ExecContext(ctx, forbiddenDelete, trip.ID)
+	if err != nil {
+		return err
+	}
+	for _, tp := range trip.ForbiddenTransfers {
+		_, err = txn.ExecContext(ctx, forbiddenInsert, trip.ID, trip.emailLookup[tp.Payer], trip.emailLookup[tp.Payee])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Settlement returns the Settlement of the trip, see Settle(), with its
+// organizer fee, simplified if FeatureSimplifiedSettlement is on for the
+// trip, routed around its forbidden transfers.
+// ErrInfeasibleSettlement is returned if a forbidden transfer can't be
+// routed through the other participants.
+func (trip *Trip) Settlement() (Settlement, error) {
+	s := trip.Settle()
+	s.addOrganizerFee(trip.Owner.Email, trip.OrganizerFee, trip.feePayers())
+	if FeatureEnabled(FeatureSimplifiedSettlement, trip.ID, trip.Owner.Email) {
+		s = s.simplify()
+	}
+	return s.route(trip.people(), trip.ForbiddenTransfers)
+}
+
+// routeLoaded routes a Settlement read from the running balances of a
+// trip around its forbidden transfers
+func routeLoaded(ctx context.Context, db *sql.DB, tripID int64, s Settlement) (Settlement, error) {
+	forbidden, err := queryForbiddenTransfers(ctx, db, tripID)
+	if err != nil || len(forbidden) == 0 {
+		return s, err
+	}
+	rows, err := db.QueryContext(ctx, peopleEmailSelect, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var people []string
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		if err != nil {
+			return nil, err
+		}
+		people = append(people, email)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return s.route(people, forbidden)
+}
+
+// add adds a payment, netted against a payment in the other direction
+func (s Settlement) add(payer, payee string, amount int) {
+	if back := s[payee][payer]; back > 0 {
+		if back > amount {
+			s[payee][payer] = back - amount
+			return
+		}
+		delete(s[payee], payer)
+		amount -= back
+	}
+	if amount == 0 {
+		return
+	}
+	if s[payer] == nil {
+		s[payer] = make(Payments)
+	}
+	s[payer][payee] += amount
+}
+
+// route returns a copy of the Settlement without the forbidden transfers,
+// their amounts are passed along the shortest chain of allowed transfers
+// between the people instead. Netting the payments never adds a transfer,
+// so the chains don't bring back a forbidden one.
+func (s Settlement) route(people []string, forbidden []TransferPair) (Settlement, error) {
+	rslt := make(Settlement, len(s))
+	for payer, payments := range s {
+		rslt[payer] = make(Payments, len(payments))
+		for payee, amount := range payments {
+			rslt[payer][payee] = amount
+		}
+	}
+	isForbidden := make(map[TransferPair]bool, len(forbidden))
+	for _, tp := range forbidden {
+		isForbidden[tp] = true
+	}
+	people = append([]string{}, people...)
+	sort.Strings(people)
+
+	// forbidden is sorted, so the routing doesn't depend on the map order
+	for _, tp := range forbidden {
+		amount := rslt[tp.Payer][tp.Payee]
+		if amount == 0 {
+			continue
+		}
+		chain := shortestChain(people, isForbidden, tp.Payer, tp.Payee)
+		if chain == nil {
+			return nil, fmt.Errorf("%w: %s to %s", ErrInfeasibleSettlement, tp.Payer, tp.Payee)
+		}
+		delete(rslt[tp.Payer], tp.Payee)
+		for i := 1; i < len(chain); i++ {
+			rslt.add(chain[i-1], chain[i], amount)
+		}
+	}
+	for payer, payments := range rslt {
+		if len(payments) == 0 {
+			delete(rslt, payer)
+		}
+	}
+	return rslt, nil
+}
+
+// shortestChain returns the shortest chain of allowed transfers from the
+// payer to the payee, with a breadth-first search, or nil if there's none
+func shortestChain(people []string, isForbidden map[TransferPair]bool, payer, payee string) []string {
+	prev := map[string]string{payer: ""}
+	queue := []string{payer}
+	for len(queue) > 0 {
+		from := queue[0]
+		queue = queue[1:]
+		for _, to := range people {
+			if _, seen := prev[to]; seen || isForbidden[TransferPair{from, to}] {
+				continue
+			}
+			prev[to] = from
+			if to == payee {
+				chain := []string{payee}
+				for p := from; p != ""; p = prev[p] {
+					chain = append([]string{p}, chain...)
+				}
+				return chain
+			}
+			queue = append(queue, to)
+		}
+	}
+	return nil
+}
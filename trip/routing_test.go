@@ -0,0 +1,149 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the routing of the settlement
+// around the forbidden transfers.
+
+package trip
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	forbiddenTransferCreate = `CREATE TABLE IF NOT EXISTS forbidden_transfer (
+trip_id INTEGER NOT NULL,
+payer INTEGER NOT NULL,
+payee INTEGER NOT NULL,
+CONSTRAINT forbidden_transfer_pkey PRIMARY KEY (trip_id, payer, payee))`
+)
+
+// TestRouteSettlement checks a forbidden transfer is passed along the
+// shortest chain of allowed transfers
+func TestRouteSettlement(t *testing.T) {
+	s := Settlement{
+		bob:     Payments{alice: 1000},
+		charlie: Payments{alice: 1000},
+	}
+	people := []string{alice, bob, charlie}
+
+	routed, err := s.route(people, []TransferPair{{bob, alice}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Settlement{
+		bob:     Payments{charlie: 1000},
+		charlie: Payments{alice: 2000},
+	}
+	if !reflect.DeepEqual(routed, want) {
+		t.Errorf("expected %v, got %v", want, routed)
+	}
+	if s[bob][alice] != 1000 {
+		t.Errorf("expected the settlement to be left unchanged, got %v", s)
+	}
+
+	// Bob can pay neither Alice nor Charlie
+	_, err = s.route(people, []TransferPair{{bob, alice}, {bob, charlie}})
+	if !errors.Is(err, ErrInfeasibleSettlement) {
+		t.Errorf("expected ErrInfeasibleSettlement, got %v", err)
+	}
+
+	// The routed amount is netted against a payment the other way
+	s = Settlement{
+		bob:   Payments{alice: 1000},
+		alice: Payments{charlie: 400},
+	}
+	routed, err = s.route(people, []TransferPair{{bob, alice}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Settlement{
+		bob:     Payments{charlie: 1000},
+		charlie: Payments{alice: 600},
+	}
+	if !reflect.DeepEqual(routed, want) {
+		t.Errorf("expected %v, got %v", want, routed)
+	}
+}
+
+// TestForbiddenTransfers saves the forbidden transfers of a trip and reads
+// its settlement back
+func TestForbiddenTransfers(t *testing.T) {
+	ctx := context.Background()
+	fdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip F", alice, "", today, []string{bob, charlie})
+	err := tr.Save(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(today, "hotel", []Participant{{alice, 0, 3000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tr.SetForbiddenTransfers([]TransferPair{{bob, david}})
+	if err == nil {
+		t.Error("expected an error for a non-participant")
+	}
+	err = tr.SetForbiddenTransfers([]TransferPair{{bob, bob}})
+	if err == nil {
+		t.Error("expected an error for a transfer to oneself")
+	}
+	err = tr.SetForbiddenTransfers([]TransferPair{{"BOB@test.com", alice}, {bob, alice}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, fdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadTripByID(ctx, fdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []TransferPair{{bob, alice}}; !reflect.DeepEqual(loaded.ForbiddenTransfers, want) {
+		t.Errorf("expected %v, got %v", want, loaded.ForbiddenTransfers)
+	}
+	want := Settlement{
+		bob:     Payments{charlie: 1000},
+		charlie: Payments{alice: 2000},
+	}
+	s, err := loaded.Settlement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("expected %v, got %v", want, s)
+	}
+	s, err = LoadSettlement(ctx, fdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("from the balances: expected %v, got %v", want, s)
+	}
+
+	// Charlie leaving the trip makes the transfer from Bob to Alice
+	// infeasible, leaving drops their forbidden transfers too
+	err = loaded.SetForbiddenTransfers([]TransferPair{{bob, alice}, {charlie, bob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.dropForbiddenTransfers(charlie)
+	if want := []TransferPair{{bob, alice}}; !reflect.DeepEqual(loaded.ForbiddenTransfers, want) {
+		t.Errorf("expected %v, got %v", want, loaded.ForbiddenTransfers)
+	}
+	_, err = Settlement{bob: Payments{alice: 1000}}.route([]string{alice, bob}, loaded.ForbiddenTransfers)
+	if !errors.Is(err, ErrInfeasibleSettlement) {
+		t.Errorf("expected ErrInfeasibleSettlement, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the answers of the participants to the invitation
+// to a trip. A participant is invited when added, and accepts or declines;
+// the declined ones are left out of the default splits of the expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Some global constants used to store SQL statements
+const (
+	peopleRSVPUpdate = "UPDATE participant SET rsvp = ? WHERE trip_id = ? AND user_id = ? AND is_owner = false"
+)
+
+// The answers to the invitation to a trip
+const (
+	RSVPInvited  = "invited"
+	RSVPAccepted = "accepted"
+	RSVPDeclined = "declined"
+)
+
+// RSVPs are the valid answers, in the order of the roster
+var RSVPs = []string{RSVPAccepted, RSVPInvited, RSVPDeclined}
+
+// RosterEntry is a member of a trip, with the answer to the invitation
+type RosterEntry struct {
+	Email string `json:"user"`
+	Owner bool   `json:"owner"`
+	RSVP  string `json:"rsvp"`
+	// Confirmed is set for the owner, and the participants who accepted
+	Confirmed bool `json:"confirmed"`
+}
+
+// rsvp returns the answer of a participant, RSVPInvited if unknown
+func (trip *Trip) rsvp(email string) string {
+	if r, ok := trip.RSVP[email]; ok {
+		return r
+	}
+	return RSVPInvited
+}
+
+// setRSVP records the answer of a participant
+func (trip *Trip) setRSVP(email, rsvp string) {
+	if trip.RSVP == nil {
+		trip.RSVP = make(map[string]string)
+	}
+	trip.RSVP[email] = rsvp
+}
+
+// SetRSVP records the answer of a participant to the invitation, written
+// to the DB by Save(). sql.ErrNoRows is returned if the user isn't a
+// participant, the owner has no invitation to answer.
+func (trip *Trip) SetRSVP(email, rsvp string) error {
+	email = normalizeEmail(email)
+	rsvp = strings.ToLower(rsvp)
+	if !slices.Contains(RSVPs, rsvp) {
+		return fmt.Errorf("unknown answer '%s', expecting one of %s", rsvp, strings.Join(RSVPs, ", "))
+	}
+	if trip.Owner.Email == email {
+		return fmt.Errorf("'%s' is the owner of the trip", email)
+	}
+	if !trip.IsParticipant(email) {
+		return sql.ErrNoRows
+	}
+	trip.setRSVP(email, rsvp)
+	if trip.rsvpChanged == nil {
+		trip.rsvpChanged = make(map[string]bool)
+	}
+	trip.rsvpChanged[email] = true
+	return nil
+}
+
+// saveRSVP writes the answers changed by SetRSVP()
+// It's expected to be executed within a transaction
+func (trip *Trip) saveRSVP(ctx context.Context, txn *sql.Tx) error {
+	for email := range trip.rsvpChanged {
+		userID, ok := trip.emailLookup[email]
+		if !ok {
+			// removed since
+			continue
+		}
+		_, err := txn.ExecContext(ctx, peopleRSVPUpdate, trip.rsvp(email), trip.ID, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Roster returns the owner then the participants of the trip, by answer:
+// accepted, invited then declined
+func (trip *Trip) Roster() []RosterEntry {
+	rslt := []RosterEntry{{Email: trip.Owner.Email, Owner: true, RSVP: RSVPAccepted, Confirmed: true}}
+	for _, rsvp := range RSVPs {
+		for _, p := range trip.Participants {
+			if trip.rsvp(p.Email) == rsvp {
+				rslt = append(rslt, RosterEntry{Email: p.Email, RSVP: rsvp, Confirmed: rsvp == RSVPAccepted})
+			}
+		}
+	}
+	return rslt
+}
+
+// Sharers returns the email addresses of the owner and the participants
+// who haven't declined, the ones sharing an expense by default
+func (trip *Trip) Sharers() []string {
+	rslt := []string{trip.Owner.Email}
+	for _, p := range trip.Participants {
+		if trip.rsvp(p.Email) != RSVPDeclined {
+			rslt = append(rslt, p.Email)
+		}
+	}
+	return rslt
+}
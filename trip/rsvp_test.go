@@ -0,0 +1,122 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the answers to the invitations.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestRSVP answers the invitations, and checks the roster and the default
+// split once loaded
+func TestRSVP(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	tr := NewTrip("Trip V", alice, "", NewDate(time.Now()), []string{bob, charlie, david})
+	err := tr.SetRSVP(charlie, "Declined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for email, rsvp := range map[string]string{alice: RSVPAccepted, "eve@example.com": RSVPAccepted, bob: "maybe"} {
+		if tr.SetRSVP(email, rsvp) == nil {
+			t.Errorf("expected %s to fail to answer %s", email, rsvp)
+		}
+	}
+	if err = tr.SetRSVP("eve@example.com", RSVPAccepted); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a user not in the trip, got %v", err)
+	}
+
+	tr2, err := LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.SetRSVP(david, RSVPAccepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr3, err := LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RosterEntry{
+		{alice, true, RSVPAccepted, true},
+		{david, false, RSVPAccepted, true},
+		{bob, false, RSVPInvited, false},
+		{charlie, false, RSVPDeclined, false},
+	}
+	if got := tr3.Roster(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected roster: %+v", got)
+	}
+	split, err := tr3.DefaultSplit(nil, Categories[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(split, []string{alice, bob, david}) {
+		t.Errorf("expected charlie out of the default split, got %v", split)
+	}
+}
+
+// TestRSVPRollback checks an answer is kept to be written again when the
+// save writing it fails, and written once saved
+func TestRSVPRollback(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	tr := NewTrip("Trip W", alice, "", NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.FreezeExpenses(ctx, rdb, time.Time{}, Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.SetRSVP(bob, RSVPAccepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "Lunch", []Participant{{Email: alice, Paid: 2000}, {Email: bob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the freeze fails the save after the answer is written
+	var fe *FreezeError
+	if err = tr.Save(ctx, rdb); !errors.As(err, &fe) {
+		t.Fatalf("expected a FreezeError, got %v", err)
+	}
+	err = tr.LiftFreeze(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.rsvpChanged) != 0 {
+		t.Errorf("expected the answers written to be reset once saved, got %v", tr.rsvpChanged)
+	}
+	tr2, err := LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsvp := tr2.RSVP[bob]; rsvp != RSVPAccepted {
+		t.Errorf("expected the answer of bob saved once retried, got %q", rsvp)
+	}
+}
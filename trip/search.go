@@ -0,0 +1,74 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit searches the trips by their name and description, for owners
+// with too many trips to page through.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+)
+
+// Some global constants used to store SQL statements
+const (
+	tripSearchSelect = `SELECT t.trip_id, t.name, t.name_lower, t.created_at, t.start_date, t.end_date, t.description, t.version, t.archived_at, t.organizer_fee, t.approval_required
+FROM trip AS t
+WHERE t.archived_at = 0 AND t.deleted_at = 0`
+	tripSearchOwner = `
+AND t.trip_id IN (SELECT p.trip_id
+	FROM participant AS p, tuser AS u
+	WHERE u.user_id = p.user_id
+	AND p.is_owner = true
+	AND u.email = ?)`
+	tripSearchMember = `
+AND t.trip_id IN (SELECT p.trip_id
+	FROM participant AS p, tuser AS u
+	WHERE u.user_id = p.user_id
+	AND u.email = ?)`
+	// tripSearchTerm is repeated for each term of the search
+	tripSearchTerm = `
+AND (t.name_lower LIKE ? ESCAPE '\' OR lower(t.description) LIKE ? ESCAPE '\')`
+	tripSearchOrder = "\nORDER BY t.name_lower, t.trip_id"
+)
+
+// ErrEmptySearch is returned when a search has no terms
+var ErrEmptySearch = errors.New("empty search")
+
+// likeEscaper escapes the wildcards of the LIKE operator
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchTrips returns a page of the trips, active or completed but not
+// archived, whose name or description contains every word of the search,
+// case-insensitively. So "tahoe 2023" finds "Lake Tahoe, Feb 2023". The
+// trips are restricted to the given owner, and to the trips the given member
+// takes part in, unless they're empty, and ordered by their name.
+func SearchTrips(ctx context.Context, db *sql.DB, search string, owner string, member string, page Page) ([]*Trip, error) {
+	terms := strings.Fields(normalizeName(search))
+	if len(terms) == 0 {
+		return nil, ErrEmptySearch
+	}
+
+	var query strings.Builder
+	var args []any
+	query.WriteString(tripSearchSelect)
+	if owner != "" {
+		query.WriteString(tripSearchOwner)
+		args = append(args, normalizeEmail(owner))
+	}
+	if member != "" {
+		query.WriteString(tripSearchMember)
+		args = append(args, normalizeEmail(member))
+	}
+	for _, term := range terms {
+		pattern := "%" + likeEscaper.Replace(term) + "%"
+		query.WriteString(tripSearchTerm)
+		args = append(args, pattern, pattern)
+	}
+	query.WriteString(tripSearchOrder + pageClause)
+	return loadTrips(ctx, db, query.String(), append(args, page.args()...)...)
+}
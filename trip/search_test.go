@@ -0,0 +1,70 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the unit tests of the trip search.
+
+package trip
+
+import (
+	"context"
+	"testing"
+)
+
+// TestSearchTrips checks the terms are matched on the name and description,
+// within the trips of the owner and of the member
+func TestSearchTrips(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	trips := []*Trip{
+		NewTrip("Lake Tahoe", alice, "Ski week, Feb 2023", epochToDate(0), []string{bob}),
+		NewTrip("Tahoe 2024", alice, "", epochToDate(86400), []string{bob}),
+		NewTrip("Paris", alice, "100% croissants", epochToDate(2*86400), []string{bob}),
+		NewTrip("Tahoe again", bob, "2023 too", epochToDate(3*86400), []string{alice}),
+		NewTrip("Tahoe with Charlie", david, "", epochToDate(4*86400), []string{charlie}),
+	}
+	for _, tr := range trips {
+		err := tr.Save(ctx, sdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		search string
+		owner  string
+		member string
+		page   Page
+		want   []int
+	}{
+		{"tahoe 2023", "", "", Page{}, []int{0, 3}},
+		{"TAHOE 2023", alice, "", Page{}, []int{0}},
+		{"tahoe", alice, "", Page{}, []int{0, 1}},
+		{"tahoe", "", "", Page{Offset: 1, Limit: 1}, []int{1}},
+		{"100%", "", "", Page{}, []int{2}},
+		{"1_0", "", "", Page{}, nil},
+		{"rome", "", "", Page{}, nil},
+		{"tahoe", "", bob, Page{}, []int{0, 1, 3}},
+		{"tahoe", "", charlie, Page{}, []int{4}},
+		{"tahoe", alice, charlie, Page{}, nil},
+	}
+	for _, tt := range tests {
+		got, err := SearchTrips(ctx, sdb, tt.search, tt.owner, tt.member, tt.page)
+		if err != nil {
+			t.Errorf("SearchTrips(%q) failed: %v", tt.search, err)
+			continue
+		}
+		ok := len(got) == len(tt.want)
+		for i := 0; ok && i < len(got); i++ {
+			ok = got[i].ID == trips[tt.want[i]].ID
+		}
+		if !ok {
+			t.Errorf("SearchTrips(%q, %q, %q) = %v, want trips %v", tt.search, tt.owner, tt.member, got, tt.want)
+		}
+	}
+
+	_, err := SearchTrips(ctx, sdb, "  ", "", "", Page{})
+	if err != ErrEmptySearch {
+		t.Errorf("Expect ErrEmptySearch, got %v", err)
+	}
+}
@@ -0,0 +1,208 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the sessions of the users logged in. A session is
+// a JSON Web Token signed with HMAC-SHA256, so nothing is stored: the
+// token tells who the user is until it expires. The users log in with a
+// link mailed to their address, see IssueLogin(), or with an identity
+// provider, see LoginVerified().
+
+package trip
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// sessionIssuer is the "iss" claim of the sessions
+const sessionIssuer = "trip-accountant"
+
+// ErrInvalidSession is returned for a token which isn't a session signed
+// with the key of the server
+var ErrInvalidSession = errors.New("invalid session token")
+
+// sessionKey signs the sessions, they're disabled if empty
+var sessionKey []byte
+
+// SetSessionKey sets the key signing the sessions, an empty key disables
+// them. It's meant to be called before serving any request.
+func SetSessionKey(key []byte) {
+	sessionKey = key
+}
+
+// SessionsEnabled tells whether the sessions can be issued and accepted
+func SessionsEnabled() bool {
+	return len(sessionKey) > 0
+}
+
+// Session is a user logged in
+type Session struct {
+	UserID    int64     `json:"user_id"`
+	Email     string    `json:"email"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// sessionClaims are the claims of the JSON Web Token of a Session
+type sessionClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	UserID    int64  `json:"uid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// sessionHeader is the encoded header of the JSON Web Tokens
+var sessionHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signSession returns the encoded signature of the header and payload
+func signSession(signed string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// IsSessionToken tells whether the bearer token has the shape of a JSON
+// Web Token, as opposed to the secret of an API token
+func IsSessionToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// IssueSession returns the token of a session of the user, valid for the
+// given duration
+func IssueSession(usr *User, ttl time.Duration) (string, *Session, error) {
+	if !SessionsEnabled() {
+		return "", nil, errors.New("sessions aren't enabled")
+	}
+	now := Now().UTC().Truncate(time.Second)
+	s := &Session{UserID: usr.ID, Email: usr.Email, IssuedAt: now, ExpiresAt: now.Add(ttl)}
+	payload, err := json.Marshal(sessionClaims{
+		Issuer:    sessionIssuer,
+		Subject:   s.Email,
+		UserID:    s.UserID,
+		IssuedAt:  s.IssuedAt.Unix(),
+		ExpiresAt: s.ExpiresAt.Unix(),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	signed := sessionHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signSession(signed), s, nil
+}
+
+// ParseSession returns the session of the token, ErrInvalidSession if it
+// isn't one signed with the key of the server, ErrTokenExpired if it has
+// expired
+func ParseSession(token string) (*Session, error) {
+	if !SessionsEnabled() {
+		return nil, ErrInvalidSession
+	}
+	header, rest, _ := strings.Cut(token, ".")
+	payload, signature, ok := strings.Cut(rest, ".")
+	// the header is compared as a whole, so that no other algorithm, e.g.
+	// "none", is ever accepted
+	if !ok || header != sessionHeader ||
+		!hmac.Equal([]byte(signature), []byte(signSession(header+"."+payload))) {
+		return nil, ErrInvalidSession
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidSession
+	}
+	var claims sessionClaims
+	err = json.Unmarshal(raw, &claims)
+	if err != nil || claims.Issuer != sessionIssuer || claims.Subject == "" {
+		return nil, ErrInvalidSession
+	}
+	s := &Session{
+		UserID:    claims.UserID,
+		Email:     claims.Subject,
+		IssuedAt:  time.Unix(claims.IssuedAt, 0).UTC(),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC(),
+	}
+	if !Now().Before(s.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return s, nil
+}
+
+// IssueLogin starts the login of the user of the email address, creating
+// them if unknown, with a secret valid for the given duration, to be mailed
+// to them. Logging in with it, see Login(), also verifies the address.
+func IssueLogin(ctx context.Context, db *sql.DB, email string, ttl time.Duration) (*Verification, error) {
+	usr, err := LoadOrCreateUser(ctx, db, email)
+	if err != nil {
+		return nil, err
+	}
+	return issueVerification(ctx, db, usr, ttl)
+}
+
+// Login returns the token of a session of the user the secret of a login,
+// or of a verification, was issued to, valid for the given duration. The
+// secret can't be used again. sql.ErrNoRows is returned for an unknown
+// secret, and ErrVerificationExpired for one past its expiry.
+func Login(ctx context.Context, db *sql.DB, secret string, ttl time.Duration) (string, *Session, error) {
+	if !SessionsEnabled() {
+		return "", nil, errors.New("sessions aren't enabled")
+	}
+	p, err := VerifyEmail(ctx, db, secret)
+	if err != nil {
+		return "", nil, err
+	}
+	token, s, err := IssueSession(p.User, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	Logf(ctx, "%s logged in until %s\n", s.Email, s.ExpiresAt.Format(time.RFC3339))
+	return token, s, nil
+}
+
+// LoginVerified returns the token of a session of the user of the email
+// address, valid for the given duration, the address being verified by an
+// identity provider. The user is created if unknown, and their address
+// marked as verified.
+func LoginVerified(ctx context.Context, db *sql.DB, email string, ttl time.Duration) (string, *Session, error) {
+	if !SessionsEnabled() {
+		return "", nil, errors.New("sessions aren't enabled")
+	}
+	usr, err := LoadOrCreateUser(ctx, db, email)
+	if err != nil {
+		return "", nil, err
+	}
+	if !usr.Verified {
+		_, err = db.ExecContext(ctx, userUpdateVerified, true, usr.ID)
+		if err != nil {
+			return "", nil, err
+		}
+		usr.Verified = true
+	}
+	token, s, err := IssueSession(usr, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+	Logf(ctx, "%s logged in with their identity provider until %s\n", s.Email, s.ExpiresAt.Format(time.RFC3339))
+	return token, s, nil
+}
+
+// SessionUser returns the user of the session, ErrInvalidSession if they
+// were erased since, see EraseUser(), their address being possibly given
+// to another user
+func SessionUser(ctx context.Context, db *sql.DB, s *Session) (*User, error) {
+	usr := NewUser(s.Email)
+	err := db.QueryRowContext(ctx, userSelect, usr.Email).Scan(&usr.ID, &usr.Verified, &usr.DisplayName)
+	switch {
+	case err == sql.ErrNoRows || (err == nil && usr.ID != s.UserID):
+		return nil, ErrInvalidSession
+	case err != nil:
+		return nil, err
+	}
+	return usr, nil
+}
@@ -0,0 +1,145 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the sessions of the users.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestLogin logs a new user in with the secret mailed, and checks their
+// session until it expires
+func TestLogin(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	clock := NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), time.Second)
+	SetClock(clock.Now)
+	SetSessionKey([]byte("test key"))
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetSessionKey(nil)
+	})
+
+	v, err := IssueLogin(ctx, sdb, "Session@test.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, s, err := Login(ctx, sdb, v.Secret, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Email != "session@test.com" || !IsSessionToken(token) {
+		t.Fatalf("Unexpected session %+v: %s", s, token)
+	}
+	_, _, err = Login(ctx, sdb, v.Secret, 2*time.Hour)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows logging in again, got %v", err)
+	}
+
+	parsed, err := ParseSession(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *s {
+		t.Errorf("expected the session %+v, got %+v", s, parsed)
+	}
+	usr, err := SessionUser(ctx, sdb, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.ID != s.UserID || !usr.Verified {
+		t.Errorf("Unexpected user %+v", usr)
+	}
+
+	// the sessions of the users erased are refused
+	_, err = EraseUser(ctx, sdb, s.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SessionUser(ctx, sdb, parsed)
+	if err != ErrInvalidSession {
+		t.Errorf("expected ErrInvalidSession for an erased user, got %v", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	_, err = ParseSession(token)
+	if err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+}
+
+// TestParseSession checks the tokens not signed by the server are refused
+func TestParseSession(t *testing.T) {
+	SetSessionKey([]byte("test key"))
+	t.Cleanup(func() { SetSessionKey(nil) })
+	token, _, err := IssueSession(&User{ID: 1, Email: alice}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, rest, _ := strings.Cut(token, ".")
+	payload, _, _ := strings.Cut(rest, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`))
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"trip-accountant","sub":"` + bob + `","uid":2,"iat":0,"exp":9999999999}`))
+
+	for name, tok := range map[string]string{
+		"garbage":   "a.b.c",
+		"tampered":  header + "." + forged + "." + strings.Split(token, ".")[2],
+		"none":      none + "." + payload + ".",
+		"truncated": header + "." + payload,
+	} {
+		_, err = ParseSession(tok)
+		if err != ErrInvalidSession {
+			t.Errorf("expected ErrInvalidSession for the %s token, got %v", name, err)
+		}
+	}
+
+	SetSessionKey([]byte("other key"))
+	_, err = ParseSession(token)
+	if err != ErrInvalidSession {
+		t.Errorf("expected ErrInvalidSession with another key, got %v", err)
+	}
+	SetSessionKey(nil)
+	_, err = ParseSession(token)
+	if err != ErrInvalidSession {
+		t.Errorf("expected ErrInvalidSession without sessions, got %v", err)
+	}
+}
+
+// TestLoginVerified logs in a new user whose address is verified by an
+// identity provider
+func TestLoginVerified(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	SetSessionKey([]byte("test key"))
+	t.Cleanup(func() { SetSessionKey(nil) })
+
+	token, s, err := LoginVerified(ctx, sdb, "Provided@test.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSession(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usr, err := SessionUser(ctx, sdb, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usr.Email != "provided@test.com" || usr.ID != s.UserID || !usr.Verified {
+		t.Errorf("expected a verified user, got %+v", usr)
+	}
+	_, again, err := LoginVerified(ctx, sdb, usr.Email, time.Hour)
+	if err != nil || again.UserID != usr.ID {
+		t.Errorf("expected the same user logging in again, got %+v: %v", again, err)
+	}
+}
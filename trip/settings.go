@@ -0,0 +1,78 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the settings of a trip, e.g. the group chats its
+// expenses and settlement are posted to. A trip without settings has the
+// defaults, none of the chats.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// Some global constants used to store SQL statements
+const (
+	settingsUpsert = `INSERT INTO trip_setting (trip_id, slack_webhook_url, telegram_chat_id, updated_at)
+VALUES (?, ?, ?, ?)
+ON CONFLICT (trip_id) DO UPDATE SET slack_webhook_url = excluded.slack_webhook_url,
+telegram_chat_id = excluded.telegram_chat_id, updated_at = excluded.updated_at`
+	settingsSelect = "SELECT slack_webhook_url, telegram_chat_id FROM trip_setting WHERE trip_id = ?"
+)
+
+// telegramChatID matches the ID of a Telegram chat, or the username of a
+// public channel
+var telegramChatID = regexp.MustCompile(`^(-?[0-9]+|@[A-Za-z0-9_]{5,32})$`)
+
+// Settings are the settings of a trip
+type Settings struct {
+	// SlackWebhookURL is the incoming webhook of the Slack channel the
+	// expenses and the settlement are posted to, none if empty
+	SlackWebhookURL string `json:"slack_webhook_url"`
+	// TelegramChatID is the Telegram chat the bot of the server posts the
+	// expenses and the settlement to, none if empty
+	TelegramChatID string `json:"telegram_chat_id"`
+}
+
+// LoadSettings returns the settings of a trip, the defaults if it has
+// none
+func LoadSettings(ctx context.Context, db *sql.DB, tripID int64) (*Settings, error) {
+	s := new(Settings)
+	err := db.QueryRowContext(ctx, settingsSelect, tripID).Scan(&s.SlackWebhookURL, &s.TelegramChatID)
+	switch {
+	case err == sql.ErrNoRows:
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	return s, nil
+}
+
+// SaveSettings replaces the settings of the trip. The Slack webhook must
+// be an HTTPS URL, and the Telegram chat an ID or a @username.
+// ErrTripArchived is returned if the trip is archived.
+func (trip *Trip) SaveSettings(ctx context.Context, db *sql.DB, s *Settings) error {
+	if trip.Archived {
+		return ErrTripArchived
+	}
+	if s.SlackWebhookURL != "" {
+		u, err := url.Parse(s.SlackWebhookURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid Slack webhook URL %q, expecting an https URL", s.SlackWebhookURL)
+		}
+	}
+	if s.TelegramChatID != "" && !telegramChatID.MatchString(s.TelegramChatID) {
+		return fmt.Errorf("invalid Telegram chat %q, expecting its ID or @username", s.TelegramChatID)
+	}
+	_, err := db.ExecContext(ctx, settingsUpsert, trip.ID, s.SlackWebhookURL, s.TelegramChatID, Now().UnixMicro())
+	if err != nil {
+		return err
+	}
+	Logf(ctx, "Updated the settings of trip %d\n", trip.ID)
+	return nil
+}
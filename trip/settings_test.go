@@ -0,0 +1,71 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the settings of the trips.
+
+package trip
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	tripSettingCreate = `CREATE TABLE IF NOT EXISTS trip_setting (
+trip_id INTEGER CONSTRAINT trip_setting_pkey PRIMARY KEY,
+slack_webhook_url VARCHAR(512) NOT NULL,
+telegram_chat_id VARCHAR(64) NOT NULL,
+updated_at INTEGER NOT NULL)`
+)
+
+// TestSettings saves the settings of a trip and reads them back
+func TestSettings(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	tr := NewTrip("Chatty", alice, "", NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadSettings(ctx, sdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s != (Settings{}) {
+		t.Errorf("expected the defaults, got %+v", s)
+	}
+
+	for _, bad := range []Settings{
+		{SlackWebhookURL: "http://hooks.slack.com/services/T/B/X"},
+		{SlackWebhookURL: "not a URL"},
+		{TelegramChatID: "chat"},
+		{TelegramChatID: "@abc"},
+	} {
+		err = tr.SaveSettings(ctx, sdb, &bad)
+		if err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+	want := Settings{SlackWebhookURL: "https://hooks.slack.com/services/T/B/X", TelegramChatID: "-1001234567"}
+	err = tr.SaveSettings(ctx, sdb, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.TelegramChatID = "@trip_chat"
+	err = tr.SaveSettings(ctx, sdb, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = LoadSettings(ctx, sdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*s, want) {
+		t.Errorf("expected %+v, got %+v", want, s)
+	}
+}
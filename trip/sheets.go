@@ -0,0 +1,458 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the export of the trips to Google Sheets. A user
+// connects their Google account once, the server keeping the refresh
+// token of the OAuth grant, then links a trip to a spreadsheet of their
+// Drive: the sheets of the participants, the expenses and the settlement,
+// the same as the XLSX workbook, are written to it on demand, and once the
+// trip is completed if asked.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	googleAccountUpsert = `INSERT INTO google_account (user_id, refresh_token, connected_at)
+VALUES (?, ?, ?)
+ON CONFLICT (user_id) DO UPDATE SET refresh_token = excluded.refresh_token,
+connected_at = excluded.connected_at`
+	googleAccountSelect = `SELECT g.refresh_token FROM google_account AS g, tuser AS u
+WHERE u.user_id = g.user_id AND u.email = ?`
+	googleAccountDelete = "DELETE FROM google_account WHERE user_id = (SELECT user_id FROM tuser WHERE email = ?)"
+	tripSheetUpsert     = `INSERT INTO trip_sheet (trip_id, user_id, template_id, refresh_on_completion, created_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (trip_id) DO UPDATE SET
+spreadsheet_id = CASE WHEN trip_sheet.user_id = excluded.user_id AND trip_sheet.template_id = excluded.template_id
+THEN trip_sheet.spreadsheet_id ELSE '' END,
+user_id = excluded.user_id, template_id = excluded.template_id,
+refresh_on_completion = excluded.refresh_on_completion`
+	tripSheetSelect = `SELECT u.email, s.template_id, s.refresh_on_completion, s.spreadsheet_id, s.refreshed_at, s.last_error
+FROM trip_sheet AS s, tuser AS u
+WHERE u.user_id = s.user_id AND s.trip_id = ?`
+	tripSheetDelete  = "DELETE FROM trip_sheet WHERE trip_id = ?"
+	tripSheetCreated = "UPDATE trip_sheet SET spreadsheet_id = ? WHERE trip_id = ?"
+	tripSheetOutcome = "UPDATE trip_sheet SET refreshed_at = ?, last_error = ? WHERE trip_id = ?"
+)
+
+var (
+	// ErrNoSheet is returned for a trip not linked to a spreadsheet
+	ErrNoSheet = errors.New("the trip isn't linked to a spreadsheet")
+	// ErrNoGoogleAccount is returned when linking a trip to a spreadsheet
+	// of a user who didn't connect their Google account
+	ErrNoGoogleAccount = errors.New("the user didn't connect their Google account")
+	// ErrGoogleAPI wraps the failures of the Google APIs, e.g. the grant
+	// revoked by the user
+	ErrGoogleAPI = errors.New("the Google API failed")
+)
+
+// googleScopes are the scopes of the grant of the users: the spreadsheets
+// created or copied by the server in their Drive only
+const googleScopes = "https://www.googleapis.com/auth/drive.file"
+
+// googleTimeout is the time the Google APIs have to answer a request
+const googleTimeout = 30 * time.Second
+
+// spreadsheetID matches the IDs of the Google Drive files
+var spreadsheetID = regexp.MustCompile(`^[A-Za-z0-9_-]{10,128}$`)
+
+// GoogleSheets is the client of the Google APIs exporting the trips, with
+// the OAuth credentials of the server
+type GoogleSheets struct {
+	ClientID     string
+	ClientSecret string
+	// AuthURL, TokenURL, SheetsURL and DriveURL are the endpoints of the
+	// APIs, the ones of Google if empty, set by the tests
+	AuthURL   string
+	TokenURL  string
+	SheetsURL string
+	DriveURL  string
+	// Client sends the requests, one with googleTimeout if nil
+	Client *http.Client
+}
+
+// endpoint returns the URL, the one of Google if empty
+func endpoint(u, google string) string {
+	if u == "" {
+		return google
+	}
+	return strings.TrimSuffix(u, "/")
+}
+
+// AuthCodeURL returns the URL the user is sent to, to grant the server
+// access to the spreadsheets of their Drive, coming back to redirectURI
+// with the state
+func (g *GoogleSheets) AuthCodeURL(redirectURI, state string) string {
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {g.ClientID},
+		"redirect_uri":  {redirectURI},
+		"scope":         {googleScopes},
+		"state":         {state},
+		// the refresh token is only given with the consent of the user
+		"access_type": {"offline"},
+		"prompt":      {"consent"},
+	}
+	return endpoint(g.AuthURL, "https://accounts.google.com/o/oauth2/v2/auth") + "?" + q.Encode()
+}
+
+// do sends the request with the access token, if any, and decodes the JSON
+// answer into v, if not nil. The failures are wrapped in ErrGoogleAPI.
+func (g *GoogleSheets) do(ctx context.Context, method, u, accessToken string, body io.Reader, contentType string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, googleTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	client := g.Client
+	if client == nil {
+		client = &http.Client{Timeout: googleTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrGoogleAPI, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrGoogleAPI, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s answered %s: %.200s", ErrGoogleAPI, req.URL.Host, resp.Status, data)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// postJSON POSTs the JSON document of obj with the access token, and
+// decodes the JSON answer into v
+func (g *GoogleSheets) postJSON(ctx context.Context, u, accessToken string, obj, v any) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return g.do(ctx, http.MethodPost, u, accessToken, bytes.NewReader(data), "application/json", v)
+}
+
+// token returns the token answered by the token endpoint for the form
+func (g *GoogleSheets) token(ctx context.Context, form url.Values) (accessToken, refreshToken string, err error) {
+	form.Set("client_id", g.ClientID)
+	form.Set("client_secret", g.ClientSecret)
+	var tok struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	err = g.do(ctx, http.MethodPost, endpoint(g.TokenURL, "https://oauth2.googleapis.com/token"), "",
+		strings.NewReader(form.Encode()), "application/x-www-form-urlencoded", &tok)
+	if err != nil {
+		return "", "", err
+	}
+	if tok.AccessToken == "" {
+		return "", "", fmt.Errorf("%w: no access token", ErrGoogleAPI)
+	}
+	return tok.AccessToken, tok.RefreshToken, nil
+}
+
+// Connect exchanges the authorization code the user came back with for
+// the grant of their Google account, keeping its refresh token, replacing
+// the one they had if any
+func (g *GoogleSheets) Connect(ctx context.Context, db *sql.DB, email, code, redirectURI string) error {
+	_, refreshToken, err := g.token(ctx, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	})
+	if err != nil {
+		return err
+	}
+	if refreshToken == "" {
+		return fmt.Errorf("%w: no refresh token", ErrGoogleAPI)
+	}
+	usr, err := LoadOrCreateUser(ctx, db, email)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, googleAccountUpsert, usr.ID, refreshToken, Now().UnixMicro())
+	if err != nil {
+		return err
+	}
+	Logf(ctx, "Connected the Google account of %s\n", usr.Email)
+	return nil
+}
+
+// DisconnectGoogle forgets the grant of the Google account of the user,
+// the trips linked by them aren't exported anymore. sql.ErrNoRows is
+// returned if they didn't connect one.
+func DisconnectGoogle(ctx context.Context, db *sql.DB, email string) error {
+	rslt, err := db.ExecContext(ctx, googleAccountDelete, normalizeEmail(email))
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return sql.ErrNoRows
+	}
+	Logf(ctx, "Disconnected the Google account of %s\n", normalizeEmail(email))
+	return nil
+}
+
+// TripSheet is the spreadsheet a trip is exported to
+type TripSheet struct {
+	TripID int64 `json:"trip_id"`
+	// User is the email address of the user in whose Drive the
+	// spreadsheet is
+	User string `json:"user"`
+	// TemplateID is the ID of the spreadsheet copied to start with, a
+	// blank one is created if empty. Its sheets named like the ones
+	// exported are overwritten, the others are kept, e.g. the charts.
+	TemplateID string `json:"template_id"`
+	// RefreshOnCompletion refreshes the spreadsheet once the trip is
+	// completed
+	RefreshOnCompletion bool `json:"refresh_on_completion"`
+	// SpreadsheetID is the ID of the spreadsheet, empty until the first
+	// refresh
+	SpreadsheetID string `json:"spreadsheet_id"`
+	// URL opens the spreadsheet, empty until the first refresh
+	URL string `json:"url"`
+	// RefreshedAt is the time of the last successful refresh
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"`
+	// LastError is the failure of the last refresh, empty if it succeeded
+	LastError string `json:"last_error,omitempty"`
+}
+
+// LinkSheet links the trip to a spreadsheet of the Drive of the user, a
+// copy of the template if not empty, replacing its link if any. The
+// spreadsheet is created by the first refresh, the one already created is
+// kept unless the user or the template changes. ErrNoGoogleAccount is
+// returned if the user didn't connect their Google account.
+func (trip *Trip) LinkSheet(ctx context.Context, db *sql.DB, email, templateID string, onCompletion bool) (*TripSheet, error) {
+	if trip.Archived {
+		return nil, ErrTripArchived
+	}
+	templateID = strings.TrimSpace(templateID)
+	if templateID != "" && !spreadsheetID.MatchString(templateID) {
+		return nil, fmt.Errorf("invalid template ID %q", templateID)
+	}
+	var refreshToken string
+	err := db.QueryRowContext(ctx, googleAccountSelect, normalizeEmail(email)).Scan(&refreshToken)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrNoGoogleAccount
+	case err != nil:
+		return nil, err
+	}
+	usr, err := LoadOrCreateUser(ctx, db, email)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.ExecContext(ctx, tripSheetUpsert, trip.ID, usr.ID, templateID, onCompletion, Now().UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Linked trip %d to a spreadsheet of %s\n", trip.ID, usr.Email)
+	return LoadTripSheet(ctx, db, trip.ID)
+}
+
+// LoadTripSheet returns the spreadsheet the trip is exported to,
+// ErrNoSheet if it isn't linked to any
+func LoadTripSheet(ctx context.Context, db *sql.DB, tripID int64) (*TripSheet, error) {
+	s := &TripSheet{TripID: tripID}
+	var refreshedAt int64
+	err := db.QueryRowContext(ctx, tripSheetSelect, tripID).Scan(&s.User, &s.TemplateID, &s.RefreshOnCompletion,
+		&s.SpreadsheetID, &refreshedAt, &s.LastError)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrNoSheet
+	case err != nil:
+		return nil, err
+	}
+	if s.SpreadsheetID != "" {
+		s.URL = "https://docs.google.com/spreadsheets/d/" + s.SpreadsheetID + "/edit"
+	}
+	if refreshedAt != 0 {
+		t := time.UnixMicro(refreshedAt).UTC()
+		s.RefreshedAt = &t
+	}
+	return s, nil
+}
+
+// UnlinkSheet stops exporting the trip, the spreadsheet stays in the Drive
+// of the user. ErrNoSheet is returned if the trip isn't linked.
+func UnlinkSheet(ctx context.Context, db *sql.DB, tripID int64) error {
+	rslt, err := db.ExecContext(ctx, tripSheetDelete, tripID)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return ErrNoSheet
+	}
+	Logf(ctx, "Unlinked trip %d from its spreadsheet\n", tripID)
+	return nil
+}
+
+// sheetValues returns the rows of the sheet as the values of the Sheets
+// API, the amounts in the currency unit
+func sheetValues(sh xlsxSheet) [][]any {
+	values := make([][]any, len(sh.rows))
+	for i, row := range sh.rows {
+		values[i] = make([]any, len(row))
+		for j, cell := range row {
+			if c, ok := cell.(xlsxCents); ok {
+				values[i][j] = float64(c) / 100
+			} else {
+				values[i][j] = cell
+			}
+		}
+	}
+	return values
+}
+
+// RefreshSheet writes the participants, the expenses and the settlement
+// of the trip to its spreadsheet, creating it the first time, and returns
+// the spreadsheet with the outcome, recorded whether it succeeds or not.
+// ErrNoSheet is returned if the trip isn't linked, ErrNoGoogleAccount if
+// its user disconnected their Google account.
+func (g *GoogleSheets) RefreshSheet(ctx context.Context, db *sql.DB, trip *Trip, s Settlement) (*TripSheet, error) {
+	sheet, err := LoadTripSheet(ctx, db, trip.ID)
+	if err != nil {
+		return nil, err
+	}
+	var refreshToken string
+	err = db.QueryRowContext(ctx, googleAccountSelect, sheet.User).Scan(&refreshToken)
+	if err == sql.ErrNoRows {
+		err = ErrNoGoogleAccount
+	}
+	if err == nil {
+		err = g.writeSheet(ctx, db, trip, s, sheet, refreshToken)
+	}
+	if err != nil && !errors.Is(err, ErrGoogleAPI) && err != ErrNoGoogleAccount {
+		return nil, err
+	}
+	refreshedAt, lastError := int64(0), ""
+	if sheet.RefreshedAt != nil {
+		refreshedAt = sheet.RefreshedAt.UnixMicro()
+	}
+	if err != nil {
+		lastError = err.Error()
+		Logf(ctx, "WARNING: failed to refresh the spreadsheet of trip %d: %v\n", trip.ID, err)
+	} else {
+		refreshedAt = Now().UnixMicro()
+		Logf(ctx, "Refreshed the spreadsheet of trip %d\n", trip.ID)
+	}
+	_, dbErr := db.ExecContext(ctx, tripSheetOutcome, refreshedAt, lastError, trip.ID)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	sheet, dbErr = LoadTripSheet(ctx, db, trip.ID)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+	return sheet, err
+}
+
+// writeSheet creates the spreadsheet if it isn't yet, and overwrites its
+// sheets with the ones of the trip
+func (g *GoogleSheets) writeSheet(ctx context.Context, db *sql.DB, trip *Trip, s Settlement, sheet *TripSheet, refreshToken string) error {
+	accessToken, _, err := g.token(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	sheetsURL := endpoint(g.SheetsURL, "https://sheets.googleapis.com") + "/v4/spreadsheets"
+	sheets := trip.workbookSheets(s)
+	title := fmt.Sprintf("%s (trip %d)", trip.Name, trip.ID)
+
+	if sheet.SpreadsheetID == "" {
+		var created struct {
+			SpreadsheetID string `json:"spreadsheetId"`
+			ID            string `json:"id"`
+		}
+		if sheet.TemplateID != "" {
+			u := endpoint(g.DriveURL, "https://www.googleapis.com") + "/drive/v3/files/" + url.PathEscape(sheet.TemplateID) + "/copy"
+			err = g.postJSON(ctx, u, accessToken, map[string]string{"name": title}, &created)
+			created.SpreadsheetID = created.ID
+		} else {
+			type properties struct {
+				Title string `json:"title"`
+			}
+			type sheetJSON struct {
+				Properties properties `json:"properties"`
+			}
+			body := struct {
+				Properties properties  `json:"properties"`
+				Sheets     []sheetJSON `json:"sheets"`
+			}{Properties: properties{Title: title}}
+			for _, sh := range sheets {
+				body.Sheets = append(body.Sheets, sheetJSON{properties{sh.name}})
+			}
+			err = g.postJSON(ctx, sheetsURL, accessToken, body, &created)
+		}
+		if err != nil {
+			return err
+		}
+		if created.SpreadsheetID == "" {
+			return fmt.Errorf("%w: no spreadsheet ID", ErrGoogleAPI)
+		}
+		_, err = db.ExecContext(ctx, tripSheetCreated, created.SpreadsheetID, trip.ID)
+		if err != nil {
+			return err
+		}
+		sheet.SpreadsheetID = created.SpreadsheetID
+	}
+
+	type valueRange struct {
+		Range  string  `json:"range"`
+		Values [][]any `json:"values"`
+	}
+	cleared := struct {
+		Ranges []string `json:"ranges"`
+	}{}
+	update := struct {
+		ValueInputOption string       `json:"valueInputOption"`
+		Data             []valueRange `json:"data"`
+	}{ValueInputOption: "RAW"}
+	for _, sh := range sheets {
+		cleared.Ranges = append(cleared.Ranges, "'"+sh.name+"'")
+		update.Data = append(update.Data, valueRange{"'" + sh.name + "'!A1", sheetValues(sh)})
+	}
+	u := sheetsURL + "/" + url.PathEscape(sheet.SpreadsheetID) + "/values"
+	err = g.postJSON(ctx, u+":batchClear", accessToken, cleared, nil)
+	if err != nil {
+		return err
+	}
+	return g.postJSON(ctx, u+":batchUpdate", accessToken, update, nil)
+}
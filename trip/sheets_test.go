@@ -0,0 +1,237 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the export of the trips to Google
+// Sheets, the Google APIs faked.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	googleAccountCreate = `CREATE TABLE IF NOT EXISTS google_account (
+user_id INTEGER CONSTRAINT google_account_pkey PRIMARY KEY,
+refresh_token VARCHAR(512) NOT NULL,
+connected_at INTEGER NOT NULL)`
+	tripSheetCreate = `CREATE TABLE IF NOT EXISTS trip_sheet (
+trip_id INTEGER CONSTRAINT trip_sheet_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+template_id VARCHAR(128) NOT NULL DEFAULT '',
+refresh_on_completion BOOLEAN NOT NULL DEFAULT FALSE,
+spreadsheet_id VARCHAR(128) NOT NULL DEFAULT '',
+created_at INTEGER NOT NULL,
+refreshed_at INTEGER NOT NULL DEFAULT 0,
+last_error VARCHAR(512) NOT NULL DEFAULT '')`
+	tripSheetIndex = "CREATE INDEX IF NOT EXISTS trip_sheet_user_index ON trip_sheet(user_id)"
+)
+
+// fakeGoogle fakes the token endpoint, and the Sheets and Drive APIs,
+// recording the requests of the APIs
+type fakeGoogle struct {
+	mu sync.Mutex
+	// revoked fails the refresh of the access tokens
+	revoked bool
+	// requests are the paths of the API requests
+	requests []string
+	// values are the sheets written, by name
+	values map[string][][]any
+}
+
+// ServeHTTP is part of the http.Handler interface
+func (g *fakeGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	if r.URL.Path == "/token" {
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		r.ParseForm()
+		switch {
+		case r.PostForm.Get("client_secret") != "secret":
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		case r.PostForm.Get("grant_type") == "authorization_code" && r.PostForm.Get("code") == "code":
+			w.Write([]byte(`{"access_token":"access","refresh_token":"refresh"}`))
+		case r.PostForm.Get("grant_type") == "refresh_token" && r.PostForm.Get("refresh_token") == "refresh" && !g.revoked:
+			w.Write([]byte(`{"access_token":"access"}`))
+		default:
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		}
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer access" {
+		http.Error(w, "{}", http.StatusUnauthorized)
+		return
+	}
+	g.requests = append(g.requests, r.URL.Path)
+	switch {
+	case r.URL.Path == "/v4/spreadsheets":
+		w.Write([]byte(`{"spreadsheetId":"created-spreadsheet"}`))
+	case strings.HasPrefix(r.URL.Path, "/drive/v3/files/") && strings.HasSuffix(r.URL.Path, "/copy"):
+		w.Write([]byte(`{"id":"copied-spreadsheet"}`))
+	case strings.HasSuffix(r.URL.Path, "/values:batchClear"):
+		g.values = make(map[string][][]any)
+		w.Write([]byte(`{}`))
+	case strings.HasSuffix(r.URL.Path, "/values:batchUpdate"):
+		var update struct {
+			Data []struct {
+				Range  string  `json:"range"`
+				Values [][]any `json:"values"`
+			} `json:"data"`
+		}
+		json.Unmarshal(body, &update)
+		for _, d := range update.Data {
+			g.values[d.Range] = d.Values
+		}
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// TestSheets connects the Google account of alice, links a trip to a
+// spreadsheet and refreshes it
+func TestSheets(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	fake := &fakeGoogle{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	g := &GoogleSheets{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		TokenURL:     srv.URL + "/token",
+		SheetsURL:    srv.URL,
+		DriveURL:     srv.URL,
+		Client:       srv.Client(),
+	}
+	if u := g.AuthCodeURL("https://trips.test.com/v1/google/callback", "state"); !strings.Contains(u, "access_type=offline") || !strings.Contains(u, "state=state") {
+		t.Errorf("Unexpected authorization URL %s", u)
+	}
+
+	tr := NewTrip("Trip S", alice, "", NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "dinner", []Participant{{alice, 0, 3000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tr.Settlement()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tr.LinkSheet(ctx, sdb, alice, "", true); err != ErrNoGoogleAccount {
+		t.Errorf("expected ErrNoGoogleAccount before connecting, got %v", err)
+	}
+	if err = g.Connect(ctx, sdb, alice, "wrong", "https://trips.test.com/v1/google/callback"); !errors.Is(err, ErrGoogleAPI) {
+		t.Errorf("expected ErrGoogleAPI for a wrong code, got %v", err)
+	}
+	err = g.Connect(ctx, sdb, alice, "code", "https://trips.test.com/v1/google/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = g.RefreshSheet(ctx, sdb, tr, s); err != ErrNoSheet {
+		t.Errorf("expected ErrNoSheet for a trip not linked, got %v", err)
+	}
+	if _, err = tr.LinkSheet(ctx, sdb, alice, "../template", true); err == nil {
+		t.Error("expected an invalid template ID to be refused")
+	}
+	sheet, err := tr.LinkSheet(ctx, sdb, alice, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheet.User != alice || !sheet.RefreshOnCompletion || sheet.SpreadsheetID != "" || sheet.RefreshedAt != nil {
+		t.Errorf("Unexpected sheet %+v", sheet)
+	}
+
+	// the first refresh creates the spreadsheet, the second one reuses it
+	sheet, err = g.RefreshSheet(ctx, sdb, tr, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheet.SpreadsheetID != "created-spreadsheet" || sheet.RefreshedAt == nil || sheet.LastError != "" ||
+		sheet.URL != "https://docs.google.com/spreadsheets/d/created-spreadsheet/edit" {
+		t.Errorf("Unexpected sheet %+v", sheet)
+	}
+	_, err = g.RefreshSheet(ctx, sdb, tr, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"/v4/spreadsheets",
+		"/v4/spreadsheets/created-spreadsheet/values:batchClear",
+		"/v4/spreadsheets/created-spreadsheet/values:batchUpdate",
+		"/v4/spreadsheets/created-spreadsheet/values:batchClear",
+		"/v4/spreadsheets/created-spreadsheet/values:batchUpdate",
+	}
+	if !reflect.DeepEqual(fake.requests, expected) {
+		t.Errorf("Unexpected requests %v", fake.requests)
+	}
+	settlement := [][]any{{"payer", "payee", "amount"}, {bob, alice, 15.0}}
+	if !reflect.DeepEqual(fake.values["'Settlement'!A1"], settlement) {
+		t.Errorf("Unexpected settlement sheet %v", fake.values["'Settlement'!A1"])
+	}
+	if len(fake.values["'Expenses'!A1"]) != 3 || len(fake.values["'Participants'!A1"]) != 3 {
+		t.Errorf("Unexpected sheets %v", fake.values)
+	}
+
+	// a template starts a new spreadsheet, copied from it
+	fake.requests = nil
+	_, err = tr.LinkSheet(ctx, sdb, alice, "template-spreadsheet", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheet, err = g.RefreshSheet(ctx, sdb, tr, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sheet.SpreadsheetID != "copied-spreadsheet" || fake.requests[0] != "/drive/v3/files/template-spreadsheet/copy" {
+		t.Errorf("Unexpected sheet %+v after %v", sheet, fake.requests)
+	}
+
+	// a revoked grant is recorded, the last refresh kept
+	fake.revoked = true
+	refreshedAt := sheet.RefreshedAt
+	sheet, err = g.RefreshSheet(ctx, sdb, tr, s)
+	if !errors.Is(err, ErrGoogleAPI) {
+		t.Errorf("expected ErrGoogleAPI for a revoked grant, got %v", err)
+	}
+	if sheet == nil || sheet.LastError == "" || !sheet.RefreshedAt.Equal(*refreshedAt) {
+		t.Errorf("Unexpected sheet %+v", sheet)
+	}
+
+	err = DisconnectGoogle(ctx, sdb, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DisconnectGoogle(ctx, sdb, alice); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows disconnecting again, got %v", err)
+	}
+	if _, err = g.RefreshSheet(ctx, sdb, tr, s); err != ErrNoGoogleAccount {
+		t.Errorf("expected ErrNoGoogleAccount once disconnected, got %v", err)
+	}
+	err = UnlinkSheet(ctx, sdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadTripSheet(ctx, sdb, tr.ID); err != ErrNoSheet {
+		t.Errorf("expected ErrNoSheet once unlinked, got %v", err)
+	}
+}
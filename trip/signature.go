@@ -0,0 +1,127 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the settlements signed by the server. The settlement
+// of the snapshot taken when a trip is completed is signed as a JSON Web
+// Signature (JWS) with the key of the instance, so that a participant can
+// later prove what the numbers were, see VerifySettlement().
+
+package trip
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned for a JWS which isn't a settlement
+	// signed with the key of the instance
+	ErrInvalidSignature = errors.New("invalid signature of the settlement")
+	// ErrNoInstanceKey is returned when signing without the key of the
+	// instance
+	ErrNoInstanceKey = errors.New("the settlements aren't signed on this server")
+)
+
+// instanceKey signs the settlements, they aren't signed if empty
+var instanceKey []byte
+
+// SetInstanceKey sets the key signing the settlements, an empty key
+// disables them. It's meant to be called before serving any request.
+func SetInstanceKey(key []byte) {
+	instanceKey = key
+}
+
+// signatureHeader is the encoded protected header of the signed
+// settlements, distinct from the one of the sessions and of the invites
+var signatureHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"settlement"}`))
+
+// SignedSettlement is the payload of a signed settlement
+type SignedSettlement struct {
+	Issuer string `json:"iss"`
+	TripID int64  `json:"trip_id"`
+	// SnapshotID is the snapshot of the trip the settlement is from
+	SnapshotID int64  `json:"snapshot_id"`
+	TripName   string `json:"trip_name"`
+	// CompletedAt is when the trip was completed and its snapshot taken
+	CompletedAt time.Time  `json:"completed_at"`
+	SignedAt    time.Time  `json:"signed_at"`
+	Settlement  Settlement `json:"settlement"`
+}
+
+// signSettlement returns the encoded signature of the header and payload
+func signSettlement(signed string) string {
+	mac := hmac.New(sha256.New, instanceKey)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignSettlement returns the final settlement of the trip, the one of its
+// latest snapshot, signed as a JWS in its compact serialization. The
+// payload is returned along. sql.ErrNoRows is returned if the trip has
+// never been completed, or is deleted.
+func SignSettlement(ctx context.Context, db *sql.DB, tripID int64) (string, *SignedSettlement, error) {
+	if len(instanceKey) == 0 {
+		return "", nil, ErrNoInstanceKey
+	}
+	snap, err := LoadSnapshot(ctx, db, tripID)
+	if err != nil {
+		return "", nil, err
+	}
+	var bundle struct {
+		Trip struct {
+			Name string `json:"name"`
+		} `json:"trip"`
+		Settlement Settlement `json:"settlement"`
+	}
+	err = json.Unmarshal(snap.JSON, &bundle)
+	if err != nil {
+		return "", nil, err
+	}
+	s := &SignedSettlement{
+		Issuer:      sessionIssuer,
+		TripID:      snap.TripID,
+		SnapshotID:  snap.ID,
+		TripName:    bundle.Trip.Name,
+		CompletedAt: snap.CreatedAt,
+		SignedAt:    Now().UTC().Truncate(time.Second),
+		Settlement:  bundle.Settlement,
+	}
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", nil, err
+	}
+	signed := signatureHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signSettlement(signed), s, nil
+}
+
+// VerifySettlement returns the payload of the JWS of a settlement,
+// ErrInvalidSignature if it wasn't signed with the key of the instance
+func VerifySettlement(jws string) (*SignedSettlement, error) {
+	if len(instanceKey) == 0 {
+		return nil, ErrNoInstanceKey
+	}
+	header, rest, _ := strings.Cut(strings.TrimSpace(jws), ".")
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || header != signatureHeader ||
+		!hmac.Equal([]byte(signature), []byte(signSettlement(header+"."+payload))) {
+		return nil, ErrInvalidSignature
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	s := new(SignedSettlement)
+	err = json.Unmarshal(raw, s)
+	if err != nil || s.Issuer != sessionIssuer {
+		return nil, ErrInvalidSignature
+	}
+	return s, nil
+}
@@ -0,0 +1,92 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the signed settlements.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestSignSettlement signs the settlement of a completed trip, and checks
+// only the untampered one signed with the key of the instance verifies
+func TestSignSettlement(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	SetClock(NewFakeClock(time.Date(2024, 8, 1, 9, 0, 0, 0, time.UTC), time.Second).Now)
+	SetInstanceKey([]byte("instance key"))
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetInstanceKey(nil)
+	})
+
+	tr := NewTrip("Signed", alice, "", NewDate(Now()), []string{bob})
+	err := tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(Now()), "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = SignSettlement(ctx, sdb, tr.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an active trip, got %v", err)
+	}
+	settlement, err := tr.Complete(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, s, err := SignSettlement(ctx, sdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.TripID != tr.ID || s.TripName != "Signed" || !reflect.DeepEqual(s.Settlement, settlement) {
+		t.Errorf("Unexpected payload %+v, expected the settlement %v", s, settlement)
+	}
+	verified, err := VerifySettlement(jws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(verified, s) {
+		t.Errorf("expected the payload %+v, got %+v", s, verified)
+	}
+
+	header, rest, _ := strings.Cut(jws, ".")
+	_, signature, _ := strings.Cut(rest, ".")
+	other, _, err := SignSettlement(ctx, sdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherRest, _ := strings.Cut(other, ".")
+	otherPayload, _, _ := strings.Cut(otherRest, ".")
+	for name, tok := range map[string]string{
+		"garbage":  "a.b.c",
+		"swapped":  header + "." + otherPayload + "." + signature,
+		"unsigned": header + "." + otherPayload + ".",
+	} {
+		_, err = VerifySettlement(tok)
+		if err != ErrInvalidSignature {
+			t.Errorf("expected ErrInvalidSignature for the %s JWS, got %v", name, err)
+		}
+	}
+	SetInstanceKey([]byte("other key"))
+	_, err = VerifySettlement(jws)
+	if err != ErrInvalidSignature {
+		t.Errorf("expected ErrInvalidSignature with another key, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the immutable snapshot of a trip taken when it's
+// completed. The bundle holds the trip and its settlement in JSON, the
+// expenses in CSV, and a printable report in PDF. The erasure of a user is
+// the only exception to the immutability: the right to erasure prevails,
+// their email address is replaced in the snapshots, see redactSnapshots(),
+// the numbers being left as they are.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	snapshotInsert = `INSERT INTO trip_snapshot (trip_id, created_at, json, csv, pdf)
+VALUES (?, ?, ?, ?, ?)`
+	snapshotLatestSelect = `SELECT s.snapshot_id, s.trip_id, s.created_at, s.json, s.csv, s.pdf
+FROM trip_snapshot AS s, trip AS t
+WHERE s.trip_id = t.trip_id AND s.trip_id = ? AND t.deleted_at = 0
+ORDER BY s.snapshot_id DESC LIMIT 1`
+)
+
+// Snapshot is the bundle of a trip as it was when completed
+type Snapshot struct {
+	// ID is the primary key and is from a sequence
+	ID int64 `json:"snapshot_id"`
+	// TripID is the trip the snapshot was taken of
+	TripID int64 `json:"trip_id"`
+	// CreatedAt is when the snapshot was taken
+	CreatedAt time.Time `json:"created_at"`
+	// JSON is the trip, with its expenses, and the settlement
+	JSON []byte `json:"-"`
+	// CSV is the list of expenses
+	CSV []byte `json:"-"`
+	// PDF is the printable report of the trip
+	PDF []byte `json:"-"`
+}
+
+// WriteExpensesCSV writes the expenses of the trip in CSV format, with one
+// row per participant of each expense
+func (trip *Trip) WriteExpensesCSV(w io.Writer) error {
+	return WriteExpensesCSV(w, trip.Expenses)
+}
+
+// WriteExpensesCSV writes the expenses in CSV format, with one row per
+// participant of each expense. The rows are flushed to w as they're written.
+func WriteExpensesCSV(w io.Writer, expenses []*Expense) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"expense_id", "date", "description", "user", "paid"})
+	if err != nil {
+		return err
+	}
+	for _, e := range expenses {
+		for _, p := range e.Participants {
+			err = cw.Write([]string{
+				strconv.FormatInt(e.ID, 10),
+				e.Date.Format(time.DateOnly),
+				e.Description,
+				p.Email,
+				strconv.Itoa(p.Paid),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		if err = cw.Error(); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatCents formats an amount in cent as a decimal number
+func formatCents(amount int) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+// Lines returns the settlement as lines of text, sorted by payer then payee
+func (s Settlement) Lines() []string {
+	payers := make([]string, 0, len(s))
+	for payer := range s {
+		payers = append(payers, payer)
+	}
+	sort.Strings(payers)
+	var rslt []string
+	for _, payer := range payers {
+		payees := make([]string, 0, len(s[payer]))
+		for payee := range s[payer] {
+			payees = append(payees, payee)
+		}
+		sort.Strings(payees)
+		for _, payee := range payees {
+			rslt = append(rslt, fmt.Sprintf("%s pays %s: %s", payer, payee, formatCents(s[payer][payee])))
+		}
+	}
+	return rslt
+}
+
+// reportLines lays out the trip, its expenses, and the settlement as lines of text
+func (trip *Trip) reportLines(s Settlement) []string {
+	lines := []string{
+		instanceName,
+		"",
+		fmt.Sprintf("Trip: %s", trip.Name),
+		fmt.Sprintf("Owner: %s", trip.Owner.Email),
+		fmt.Sprintf("Start date: %s", trip.StartDate.Format(time.DateOnly)),
+		fmt.Sprintf("Description: %s", trip.Description),
+		"",
+		"Participants:",
+	}
+	for _, p := range trip.Participants {
+		lines = append(lines, "    "+p.Email)
+	}
+	lines = append(lines, "", "Expenses:")
+	total := 0
+	for _, e := range trip.Expenses {
+		lines = append(lines, fmt.Sprintf("    %s  %s  %s", e.Date.Format(time.DateOnly), e.Description, formatCents(e.amount)))
+		for _, p := range e.Participants {
+			lines = append(lines, fmt.Sprintf("        %s paid %s", p.Email, formatCents(p.Paid)))
+		}
+		total += e.amount
+	}
+	lines = append(lines, fmt.Sprintf("Total: %s", formatCents(total)))
+	if trip.OrganizerFee != 0 {
+		lines = append(lines, "", fmt.Sprintf("Organizer fee: %s, credited to %s", formatCents(trip.OrganizerFee), trip.Owner.Email))
+		for _, b := range trip.Balances()[1:] {
+			if b.Fee != 0 {
+				lines = append(lines, fmt.Sprintf("    %s pays %s", b.Email, formatCents(-b.Fee)))
+			}
+		}
+	}
+	lines = append(lines, "", "Settlement:")
+	for _, l := range s.Lines() {
+		lines = append(lines, "    "+l)
+	}
+	return lines
+}
+
+// ReportPDF renders the trip, its expenses, and the settlement as a
+// printable report, the same as the one of the snapshot
+func (trip *Trip) ReportPDF(s Settlement) []byte {
+	return textPDF(trip.reportLines(s))
+}
+
+// newSnapshot builds the Snapshot of the trip with the given settlement
+func (trip *Trip) newSnapshot(s Settlement, now time.Time) (*Snapshot, error) {
+	snap := &Snapshot{
+		TripID:    trip.ID,
+		CreatedAt: now,
+	}
+	var err error
+	snap.JSON, err = json.Marshal(map[string]any{
+		"trip":       trip,
+		"settlement": s,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = trip.WriteExpensesCSV(&buf)
+	if err != nil {
+		return nil, err
+	}
+	snap.CSV = buf.Bytes()
+	snap.PDF = trip.ReportPDF(s)
+	return snap, nil
+}
+
+// save inserts the Snapshot, it's expected to be executed within a transaction
+func (snap *Snapshot) save(ctx context.Context, txn *sql.Tx) error {
+	rslt, err := txn.ExecContext(ctx, snapshotInsert,
+		snap.TripID, snap.CreatedAt.UnixMicro(), snap.JSON, snap.CSV, snap.PDF)
+	if err != nil {
+		return err
+	}
+	snap.ID, err = rslt.LastInsertId()
+	return err
+}
+
+// LoadSnapshot returns the latest Snapshot of a trip. sql.ErrNoRows is
+// returned if the trip has never been completed, or is deleted.
+func LoadSnapshot(ctx context.Context, db *sql.DB, tripID int64) (*Snapshot, error) {
+	snap := new(Snapshot)
+	var createdAt int64
+	err := db.QueryRowContext(ctx, snapshotLatestSelect, tripID).Scan(
+		&snap.ID, &snap.TripID, &createdAt, &snap.JSON, &snap.CSV, &snap.PDF)
+	if err != nil {
+		return nil, err
+	}
+	snap.CreatedAt = time.UnixMicro(createdAt).UTC()
+	return snap, nil
+}
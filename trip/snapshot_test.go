@@ -0,0 +1,167 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the trip snapshots.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	snapshotCreate = `CREATE TABLE IF NOT EXISTS trip_snapshot (
+snapshot_id INTEGER CONSTRAINT trip_snapshot_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+json BLOB NOT NULL,
+csv BLOB NOT NULL,
+pdf BLOB NOT NULL)`
+	snapshotTripIndex     = "CREATE INDEX IF NOT EXISTS trip_snapshot_trip_index ON trip_snapshot(trip_id)"
+	snapshotDrop          = "DROP TABLE IF EXISTS trip_snapshot"
+	snapshotTripIndexDrop = "DROP INDEX IF EXISTS trip_snapshot_trip_index"
+)
+
+// TestSnapshot completes a trip and checks the bundle stays the same
+// after the trip is modified and settled again
+func TestSnapshot(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	tr := NewTrip("Trip S", alice, "Snapshot (test)", epochToDate(time.Now().Unix()), []string{bob})
+	err := tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadSnapshot(ctx, sdb, tr.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("No snapshot expected before completion, got %v", err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "ferry, return", []Participant{{alice, 0, 2500}, {bob, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Complete(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := LoadSnapshot(ctx, sdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(snap.JSON, []byte(`"settlement":{"bob@test.com":{"alice@test.com":1250}}`)) {
+		t.Errorf("Settlement missing from the JSON: %s", snap.JSON)
+	}
+	csvLines := strings.Split(strings.TrimSpace(string(snap.CSV)), "\n")
+	if len(csvLines) != 3 || !strings.Contains(csvLines[1], `"ferry, return"`) {
+		t.Errorf("Unexpected CSV: %q", snap.CSV)
+	}
+	if !bytes.HasPrefix(snap.PDF, []byte("%PDF-")) || !bytes.Contains(snap.PDF, []byte(`Snapshot \(test\)`)) {
+		t.Errorf("Unexpected PDF: %q", snap.PDF)
+	}
+
+	// Modify the trip, and settle again
+	err = tr.AddExpense(NewDate(time.Now()), "dinner", []Participant{{alice, 0, 0}, {bob, 0, 5000}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Complete(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap2, err := LoadSnapshot(ctx, sdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap2.ID != snap.ID || !bytes.Equal(snap2.JSON, snap.JSON) {
+		t.Error("The snapshot should not change once taken")
+	}
+}
+
+// TestWriteExpensesCSV exports the expenses loaded by page, with one row
+// per participant
+func TestWriteExpensesCSV(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	tr := NewTrip("Trip C", alice, "", epochToDate(time.Now().Unix()), []string{bob})
+	err := tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "ferry, return", []Participant{{alice, 0, 2500}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "dinner", []Participant{{alice, 0, 0}, {bob, 0, 5000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expenses, err := LoadExpenses(ctx, sdb, tr.ID, ExpensesByCreation, Page{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = WriteExpensesCSV(&buf, expenses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 || lines[0] != "expense_id,date,description,user,paid" {
+		t.Fatalf("Unexpected CSV: %q", buf.String())
+	}
+	if !strings.HasSuffix(lines[4], ",dinner,bob@test.com,5000") {
+		t.Errorf("Unexpected last row: %q", lines[4])
+	}
+}
+
+// TestReportPDF renders the report of an active trip, with who pays whom
+func TestReportPDF(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	tr := NewTrip("Trip R", alice, "Report (test)", epochToDate(time.Now().Unix()), []string{bob})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "ferry", []Participant{{alice, 0, 2500}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tr.Settlement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdf := tr.ReportPDF(s)
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.Contains(pdf, []byte("bob@test.com pays alice@test.com: 12.50")) {
+		t.Errorf("Unexpected PDF: %q", pdf)
+	}
+}
+
+// TestPDFLines reads back the lines of a PDF report
+func TestPDFLines(t *testing.T) {
+	lines := []string{"Trip: (test)", "", `back\slash`}
+	if got := pdfLines(textPDF(lines)); !reflect.DeepEqual(got, lines) {
+		t.Errorf("expected %q, got %q", lines, got)
+	}
+}
@@ -0,0 +1,214 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit builds the statement of a single participant of a trip, like
+// an invoice: the expenses they took part in, what they paid and their
+// share of each, and what they owe or are owed in the end. Unlike the
+// report of the snapshot, it's about one person only.
+
+package trip
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// StatementLine is an expense in the statement of a participant
+type StatementLine struct {
+	// ExpenseID is the primary key of the expense
+	ExpenseID int64 `json:"expense_id"`
+	// Date is the transaction date
+	Date Date `json:"date"`
+	// Description describes the expense
+	Description string `json:"description"`
+	// Total is the amount of the whole expense (in cent)
+	Total int `json:"total"`
+	// Paid is the amount paid by the participant (in cent)
+	Paid int `json:"paid"`
+	// Share is the share of the participant (in cent)
+	Share int `json:"share"`
+}
+
+// Transfer is a payment to make, or to receive, to settle a trip
+type Transfer struct {
+	// Email is the other party of the payment
+	Email string `json:"user"`
+	// Amount is the amount of the payment (in cent)
+	Amount int `json:"amount"`
+}
+
+// Statement is the account of a participant of a trip
+type Statement struct {
+	// TripID is the primary key of the trip
+	TripID int64 `json:"trip_id"`
+	// TripName is the name of the trip
+	TripName string `json:"trip_name"`
+	// Email is the participant the statement is for
+	Email string `json:"user"`
+	// Lines are the expenses the participant took part in
+	Lines []StatementLine `json:"lines"`
+	// Balance is the total paid, the total share, and the net position
+	Balance Balance `json:"balance"`
+	// Pays are the payments the participant makes to settle the trip
+	Pays []Transfer `json:"pays"`
+	// Receives are the payments the participant receives
+	Receives []Transfer `json:"receives"`
+	// CreatedAt is when the statement was computed
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Statement returns the statement of the given participant. sql.ErrNoRows
+// is returned if they're not part of the trip, and ErrInfeasibleSettlement
+// if the settlement can't avoid the forbidden transfers.
+func (trip *Trip) Statement(email string) (*Statement, error) {
+	if !trip.IsParticipant(email) {
+		return nil, sql.ErrNoRows
+	}
+	settlement, err := trip.Settlement()
+	if err != nil {
+		return nil, err
+	}
+	email = normalizeEmail(email)
+	st := &Statement{
+		TripID:    trip.ID,
+		TripName:  trip.Name,
+		Email:     email,
+		Lines:     []StatementLine{},
+		Pays:      []Transfer{},
+		Receives:  []Transfer{},
+		CreatedAt: Now().UTC(),
+	}
+	for _, e := range trip.Expenses {
+		for _, p := range e.Participants {
+			if normalizeEmail(p.Email) != email {
+				continue
+			}
+			st.Lines = append(st.Lines, StatementLine{
+				ExpenseID:   e.ID,
+				Date:        e.Date,
+				Description: e.Description,
+				Total:       e.amount,
+				Paid:        p.Paid,
+				Share:       e.share(),
+			})
+		}
+	}
+	for _, b := range trip.Balances() {
+		if b.Email == email {
+			st.Balance = b
+		}
+	}
+	for payer, payments := range settlement {
+		for payee, amount := range payments {
+			switch email {
+			case payer:
+				st.Pays = append(st.Pays, Transfer{payee, amount})
+			case payee:
+				st.Receives = append(st.Receives, Transfer{payer, amount})
+			}
+		}
+	}
+	byEmail := func(ts []Transfer) func(i, j int) bool {
+		return func(i, j int) bool { return ts[i].Email < ts[j].Email }
+	}
+	sort.Slice(st.Pays, byEmail(st.Pays))
+	sort.Slice(st.Receives, byEmail(st.Receives))
+	return st, nil
+}
+
+// textLines lays out the statement as lines of text
+func (st *Statement) textLines() []string {
+	lines := []string{
+		instanceName,
+		"",
+		fmt.Sprintf("Statement of %s", st.Email),
+		fmt.Sprintf("Trip: %s", st.TripName),
+		fmt.Sprintf("Date: %s", st.CreatedAt.Format(time.DateOnly)),
+		"",
+		"Expenses:",
+	}
+	for _, l := range st.Lines {
+		lines = append(lines,
+			fmt.Sprintf("    %s  %s  %s", l.Date.Format(time.DateOnly), l.Description, formatCents(l.Total)),
+			fmt.Sprintf("        paid %s, share %s", formatCents(l.Paid), formatCents(l.Share)))
+	}
+	lines = append(lines, "",
+		fmt.Sprintf("Total paid: %s", formatCents(st.Balance.Paid)),
+		fmt.Sprintf("Total share: %s", formatCents(st.Balance.Share)),
+	)
+	if st.Balance.Fee != 0 {
+		lines = append(lines, fmt.Sprintf("Organizer fee: %s", formatCents(st.Balance.Fee)))
+	}
+	lines = append(lines, fmt.Sprintf("Net: %s (%s)", formatCents(st.Balance.Net), st.Balance.Position))
+	if len(st.Pays) > 0 || len(st.Receives) > 0 {
+		lines = append(lines, "", "To settle the trip:")
+	}
+	for _, t := range st.Pays {
+		lines = append(lines, fmt.Sprintf("    Pay %s: %s", t.Email, formatCents(t.Amount)))
+	}
+	for _, t := range st.Receives {
+		lines = append(lines, fmt.Sprintf("    Receive from %s: %s", t.Email, formatCents(t.Amount)))
+	}
+	return lines
+}
+
+// PDF renders the statement as a PDF document
+func (st *Statement) PDF() []byte {
+	return textPDF(st.textLines())
+}
+
+// statementTmpl is the HTML page of a statement
+var statementTmpl = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"cents": formatCents,
+	"date":  func(d Date) string { return d.Format(time.DateOnly) },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Statement of {{.Email}} for {{.TripName}}</title>
+<style>
+body { font-family: sans-serif; margin: 0 auto; max-width: 45em; padding: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: 0.3em; border-bottom: 1px solid #ccc; text-align: left; }
+.amount { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Statement of {{.Email}}</h1>
+<p>Trip: {{.TripName}}<br>Date: {{.CreatedAt.Format "2006-01-02"}}</p>
+<table>
+<tr><th>Date</th><th>Description</th><th class="amount">Total</th><th class="amount">Paid</th><th class="amount">Share</th></tr>
+{{- range .Lines}}
+<tr><td>{{date .Date}}</td><td>{{.Description}}</td><td class="amount">{{cents .Total}}</td><td class="amount">{{cents .Paid}}</td><td class="amount">{{cents .Share}}</td></tr>
+{{- end}}
+<tr><th colspan="3">Total</th><th class="amount">{{cents .Balance.Paid}}</th><th class="amount">{{cents .Balance.Share}}</th></tr>
+</table>
+{{- if .Balance.Fee}}
+<p>Organizer fee: {{cents .Balance.Fee}}</p>
+{{- end}}
+<p>Net: {{cents .Balance.Net}} ({{.Balance.Position}})</p>
+{{- if or .Pays .Receives}}
+<h2>To settle the trip</h2>
+<ul>
+{{- range .Pays}}
+<li>Pay {{.Email}}: {{cents .Amount}}</li>
+{{- end}}
+{{- range .Receives}}
+<li>Receive from {{.Email}}: {{cents .Amount}}</li>
+{{- end}}
+</ul>
+{{- end}}
+</body>
+</html>
+`))
+
+// WriteHTML renders the statement as an HTML page
+func (st *Statement) WriteHTML(w io.Writer) error {
+	return statementTmpl.Execute(w, st)
+}
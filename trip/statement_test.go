@@ -0,0 +1,82 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the unit tests of the per-person statements.
+
+package trip
+
+import (
+	"bytes"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatement checks the lines and settlement of a statement, and its
+// renderings
+func TestStatement(t *testing.T) {
+	tr := NewTrip("Trip S", alice, "", epochToDate(0), []string{bob, charlie, david})
+	tr.emailLookup = map[string]int64{alice: 1, bob: 2, charlie: 3, david: 4}
+	day := epochToDate(86400)
+	err := tr.AddExpense(day, "hotel <b>", []Participant{{alice, 0, 9000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(day, "taxi", []Participant{{bob, 0, 1000}, {alice, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetClock(NewFakeClock(time.Date(2024, 7, 3, 0, 0, 0, 0, time.UTC), 0).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	if _, err := tr.Statement("nobody@test.com"); err != sql.ErrNoRows {
+		t.Errorf("Expect no statement for a non-participant, got %v", err)
+	}
+	st, err := tr.Statement("BOB@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLines := []StatementLine{
+		{0, day, "hotel <b>", 9000, 0, 3000},
+		{0, day, "taxi", 1000, 1000, 500},
+	}
+	if !reflect.DeepEqual(st.Lines, wantLines) {
+		t.Errorf("Lines = %v, want %v", st.Lines, wantLines)
+	}
+	if want := (Balance{bob, 1000, 3500, 0, -2500, Debtor}); st.Balance != want {
+		t.Errorf("Balance = %v, want %v", st.Balance, want)
+	}
+	if want := []Transfer{{alice, 2500}}; !reflect.DeepEqual(st.Pays, want) || len(st.Receives) != 0 {
+		t.Errorf("Pays = %v, Receives = %v, want to pay %v", st.Pays, st.Receives, want)
+	}
+	if st, _ := tr.Statement(alice); len(st.Receives) != 2 || len(st.Pays) != 0 {
+		t.Errorf("Expect alice to receive from bob and charlie: %v", st)
+	}
+	if st, _ := tr.Statement(david); len(st.Lines) != 0 || st.Balance.Position != Settled {
+		t.Errorf("Expect an empty statement for david: %v", st)
+	}
+
+	var buf bytes.Buffer
+	err = st.WriteHTML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	for _, want := range []string{"hotel &lt;b&gt;", "Pay alice@test.com: 25.00", "-25.00 (debtor)", "2024-07-03"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("Expect %q in the HTML statement", want)
+		}
+	}
+	pdf := st.PDF()
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.Contains(pdf, []byte("Pay alice@test.com: 25.00")) {
+		t.Error("Expect a PDF statement with the payment to alice")
+	}
+	SetInstanceName("Hiking Club")
+	defer SetInstanceName("Trip Accountant")
+	if lines := pdfLines(st.PDF()); len(lines) == 0 || lines[0] != "Hiking Club" {
+		t.Errorf("Expect the PDF statement headed by the name of the instance, got %q", lines)
+	}
+}
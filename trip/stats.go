@@ -0,0 +1,95 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit computes the instance-wide usage statistics, for capacity
+// planning.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Some global constants used to store SQL statements
+const (
+	statsCountSelect = `SELECT
+(SELECT COUNT(*) FROM tuser),
+(SELECT COUNT(*) FROM trip WHERE deleted_at = 0),
+(SELECT COUNT(*) FROM trip WHERE end_date = 0 AND deleted_at = 0),
+(SELECT COUNT(*) FROM expense WHERE trip_id IN (SELECT trip_id FROM trip WHERE deleted_at = 0))`
+	statsBusiestSelect = `SELECT t.trip_id, t.name, COUNT(e.expense_id) AS cnt
+FROM trip AS t, expense AS e
+WHERE e.trip_id = t.trip_id AND t.deleted_at = 0
+GROUP BY t.trip_id
+ORDER BY cnt DESC, t.trip_id
+LIMIT ?`
+	statsPageCount = "PRAGMA page_count"
+	statsPageSize  = "PRAGMA page_size"
+)
+
+// TripActivity is the number of expenses entered for a trip
+type TripActivity struct {
+	// TripID is the primary key of the trip
+	TripID int64 `json:"trip_id"`
+	// Name is the name of the trip
+	Name string `json:"name"`
+	// Expenses is the number of expenses of the trip
+	Expenses int64 `json:"expenses"`
+}
+
+// Stats is a summary of the usage of the instance
+type Stats struct {
+	// Users is the number of registered users
+	Users int64 `json:"users"`
+	// Trips is the number of trips, the deleted ones left out like
+	// below
+	Trips int64 `json:"trips"`
+	// ActiveTrips is the number of trips not yet completed
+	ActiveTrips int64 `json:"active_trips"`
+	// Expenses is the number of expenses across all trips
+	Expenses int64 `json:"expenses"`
+	// DBSize is the size of the database in bytes
+	DBSize int64 `json:"db_size"`
+	// Busiest are the trips with the most expenses
+	Busiest []TripActivity `json:"busiest_trips"`
+}
+
+// LoadStats computes the usage statistics, with up to "busiest" trips
+// listed by their number of expenses
+func LoadStats(ctx context.Context, db *sql.DB, busiest int) (*Stats, error) {
+	rslt := new(Stats)
+	err := db.QueryRowContext(ctx, statsCountSelect).Scan(&rslt.Users, &rslt.Trips, &rslt.ActiveTrips, &rslt.Expenses)
+	if err != nil {
+		return nil, err
+	}
+
+	var pageCount, pageSize int64
+	err = db.QueryRowContext(ctx, statsPageCount).Scan(&pageCount)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRowContext(ctx, statsPageSize).Scan(&pageSize)
+	if err != nil {
+		return nil, err
+	}
+	rslt.DBSize = pageCount * pageSize
+
+	rows, err := db.QueryContext(ctx, statsBusiestSelect, busiest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt.Busiest = []TripActivity{}
+	for rows.Next() {
+		a := TripActivity{}
+		err = rows.Scan(&a.TripID, &a.Name, &a.Expenses)
+		if err != nil {
+			return nil, err
+		}
+		rslt.Busiest = append(rslt.Busiest, a)
+	}
+	return rslt, rows.Err()
+}
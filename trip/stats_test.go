@@ -0,0 +1,61 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the usage statistics.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestLoadStats checks the counts and the busiest trips
+func TestLoadStats(t *testing.T) {
+	ctx := context.Background()
+	sdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+
+	quiet := NewTrip("Quiet", alice, "", today, []string{bob})
+	busy := NewTrip("Busy", bob, "", today, []string{charlie, david})
+	for _, tr := range []*Trip{quiet, busy} {
+		err := tr.Save(ctx, sdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		err := busy.AddExpense(today, "snacks", []Participant{{bob, 0, 300}, {charlie, 0, 0}})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err := quiet.AddExpense(today, "snacks", []Participant{{alice, 0, 300}, {bob, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, tr := range []*Trip{quiet, busy} {
+		err = tr.Save(ctx, sdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := LoadStats(ctx, sdb, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Users != 4 || s.Trips != 2 || s.ActiveTrips != 2 || s.Expenses != 4 {
+		t.Errorf("Unexpected counts: %#v", *s)
+	}
+	if s.DBSize <= 0 {
+		t.Errorf("DB size should be positive: %d", s.DBSize)
+	}
+	if len(s.Busiest) != 1 || s.Busiest[0].TripID != busy.ID || s.Busiest[0].Expenses != 3 {
+		t.Errorf("Expect the busy trip to be the busiest: %#v", s.Busiest)
+	}
+}
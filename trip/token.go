@@ -0,0 +1,313 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the API tokens handed to integrations. A token is
+// scoped (read, write or admin), optionally restricted to a single trip,
+// and expires. Only the SHA-256 hash of the secret is stored.
+
+package trip
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	tokenInsert = `INSERT INTO api_token (user_id, trip_id, scope, token_hash, created_at, expires_at)
+VALUES (?, ?, ?, ?, ?, ?)`
+	tokenColumns = `SELECT k.token_id, u.email, k.trip_id, k.scope, k.created_at, k.expires_at, k.revoked_at
+FROM api_token AS k, tuser AS u
+WHERE k.user_id = u.user_id`
+	tokenByHashSelect = tokenColumns + " AND k.token_hash = ?"
+	tokenByIDSelect   = tokenColumns + " AND k.token_id = ?"
+	tokenByUserSelect = tokenColumns + " AND u.email = ? AND k.revoked_at = 0 ORDER BY k.token_id"
+	tokenRevoke       = "UPDATE api_token SET revoked_at = ? WHERE token_id = ? AND revoked_at = 0"
+	tokenRotateInsert = `INSERT INTO api_token (user_id, trip_id, scope, token_hash, created_at, expires_at)
+SELECT user_id, trip_id, scope, ?, ?, ? FROM api_token WHERE token_id = ?`
+	tokenParticipantSelect = `SELECT COUNT(*) FROM participant AS p, tuser AS u
+WHERE p.user_id = u.user_id AND p.trip_id = ? AND u.email = ?`
+)
+
+// Scope is the level of access granted by a Token. Each scope includes
+// the ones below it.
+type Scope string
+
+const (
+	// ScopeRead allows the GET requests
+	ScopeRead Scope = "read"
+	// ScopeWrite allows the requests changing trips and expenses
+	ScopeWrite Scope = "write"
+	// ScopeAdmin allows managing tokens and the instance-wide endpoints
+	ScopeAdmin Scope = "admin"
+)
+
+// scopeRank orders the scopes from the least to the most privileged
+var scopeRank = map[Scope]int{
+	ScopeRead:  1,
+	ScopeWrite: 2,
+	ScopeAdmin: 3,
+}
+
+// Valid tells whether the scope is one of the known scopes
+func (s Scope) Valid() bool {
+	return scopeRank[s] != 0
+}
+
+// Includes tells whether the scope grants the other scope
+func (s Scope) Includes(other Scope) bool {
+	return s.Valid() && scopeRank[s] >= scopeRank[other]
+}
+
+var (
+	// ErrTokenExpired is returned when looking up a token past its expiry
+	ErrTokenExpired = errors.New("token has expired")
+	// ErrTokenRevoked is returned when looking up a token that has been
+	// revoked or rotated
+	ErrTokenRevoked = errors.New("token has been revoked")
+)
+
+// Token is an API credential of a user
+type Token struct {
+	// ID is the primary key and is from a sequence
+	ID int64 `json:"token_id"`
+	// Email is the email address of the user the token was issued to
+	Email string `json:"user"`
+	// TripID restricts the token to a single trip, 0 means all trips
+	TripID int64 `json:"trip_id"`
+	// Scope is the level of access granted by the token
+	Scope Scope `json:"scope"`
+	// CreatedAt is when the token was issued
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the token stops being accepted
+	ExpiresAt time.Time `json:"expires_at"`
+	// Secret is the bearer credential, it's only known when the token
+	// is issued
+	Secret string `json:"secret,omitempty"`
+	// revokedAt is when the token was revoked, zeroTime if it's not
+	revokedAt time.Time
+}
+
+// Permits tells whether the token grants the scope on the given trip.
+// A tripID of 0 is for requests not about a specific trip, which are
+// only permitted to tokens not restricted to a trip. On a trip, the user
+// of the token must be one of its participants, unless the token has the
+// admin scope.
+func (tok *Token) Permits(ctx context.Context, db *sql.DB, tripID int64, scope Scope) (bool, error) {
+	if !tok.Scope.Includes(scope) || (tok.TripID != 0 && tok.TripID != tripID) {
+		return false, nil
+	}
+	if tripID == 0 || tok.Scope == ScopeAdmin {
+		return true, nil
+	}
+	var count int
+	err := db.QueryRowContext(ctx, tokenParticipantSelect, tripID, tok.Email).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// hashSecret returns the hex encoded SHA-256 hash of a token secret
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSecret generates a random token secret, see SetIDSource()
+func newSecret() (string, error) {
+	return NewID(32)
+}
+
+// IssueToken creates a token for the user, valid for the given duration.
+// The returned Token holds the secret, which isn't retrievable afterwards.
+func IssueToken(ctx context.Context, db *sql.DB, usr *User, tripID int64, scope Scope, ttl time.Duration) (*Token, error) {
+	if !scope.Valid() {
+		return nil, fmt.Errorf("invalid scope %q", scope)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("invalid token lifetime %v", ttl)
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := Now().UTC()
+	tok := &Token{
+		Email:     usr.Email,
+		TripID:    tripID,
+		Scope:     scope,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+		Secret:    secret,
+		revokedAt: zeroTime,
+	}
+	rslt, err := db.ExecContext(ctx, tokenInsert,
+		usr.ID, tripID, string(scope), hashSecret(secret), now.UnixMicro(), tok.ExpiresAt.UnixMicro())
+	if err != nil {
+		Logf(ctx, "ERROR: insert failed: %v\n", err)
+		return nil, err
+	}
+	tok.ID, err = rslt.LastInsertId()
+	if err != nil {
+		Logf(ctx, "ERROR: failed to get token_id: %v\n", err)
+		return nil, err
+	}
+	return tok, nil
+}
+
+// scanToken reads a Token from a row of one of the token queries
+func scanToken(row interface{ Scan(...any) error }) (*Token, error) {
+	tok := new(Token)
+	var scope string
+	var createdAt, expiresAt, revokedAt int64
+	err := row.Scan(&tok.ID, &tok.Email, &tok.TripID, &scope, &createdAt, &expiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	tok.Scope = Scope(scope)
+	tok.CreatedAt = time.UnixMicro(createdAt).UTC()
+	tok.ExpiresAt = time.UnixMicro(expiresAt).UTC()
+	tok.revokedAt = time.UnixMicro(revokedAt)
+	return tok, nil
+}
+
+// LookupToken returns the Token with the given secret. sql.ErrNoRows is
+// returned for an unknown secret, ErrTokenRevoked or ErrTokenExpired if
+// the token is no longer valid.
+func LookupToken(ctx context.Context, db *sql.DB, secret string) (*Token, error) {
+	tok, err := scanToken(db.QueryRowContext(ctx, tokenByHashSelect, hashSecret(secret)))
+	if err != nil {
+		return nil, err
+	}
+	if !isUnset(tok.revokedAt) {
+		return nil, ErrTokenRevoked
+	}
+	if !Now().Before(tok.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return tok, nil
+}
+
+// LoadToken returns the Token with the given ID, whether it's still valid or not
+func LoadToken(ctx context.Context, db *sql.DB, tokenID int64) (*Token, error) {
+	return scanToken(db.QueryRowContext(ctx, tokenByIDSelect, tokenID))
+}
+
+// LoadTokensByUser returns the tokens of a user that haven't been revoked,
+// including the expired ones
+func LoadTokensByUser(ctx context.Context, db *sql.DB, email string) ([]*Token, error) {
+	rows, err := db.QueryContext(ctx, tokenByUserSelect, normalizeEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := []*Token{}
+	for rows.Next() {
+		tok, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, tok)
+	}
+	return rslt, rows.Err()
+}
+
+// RevokeToken revokes the token with the given ID. sql.ErrNoRows is
+// returned if there is no such token, or it's already revoked.
+func RevokeToken(ctx context.Context, db *sql.DB, tokenID int64) error {
+	rslt, err := db.ExecContext(ctx, tokenRevoke, Now().UnixMicro(), tokenID)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RotateToken revokes the token and issues a new one to the same user,
+// with the same scope, trip restriction and lifetime. Both are done
+// within a transaction, so a failure leaves the old token untouched.
+func RotateToken(ctx context.Context, db *sql.DB, tokenID int64) (*Token, error) {
+	old, err := LoadToken(ctx, db, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if !isUnset(old.revokedAt) {
+		return nil, ErrTokenRevoked
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := Now().UTC()
+	tok := &Token{
+		Email:     old.Email,
+		TripID:    old.TripID,
+		Scope:     old.Scope,
+		CreatedAt: now,
+		ExpiresAt: now.Add(old.ExpiresAt.Sub(old.CreatedAt)),
+		Secret:    secret,
+		revokedAt: zeroTime,
+	}
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		Logf(ctx, "ERROR: Begin failed: %v\n", err)
+		return nil, err
+	}
+	var rslt sql.Result
+	var cnt int64
+	rslt, err = txn.ExecContext(ctx, tokenRevoke, now.UnixMicro(), tokenID)
+	if err != nil {
+		Logf(ctx, "ERROR: update failed: %v\n", err)
+		goto Rollback
+	}
+	cnt, err = rslt.RowsAffected()
+	if err != nil {
+		Logf(ctx, "ERROR: RowsAffected() failed: %v\n", err)
+		goto Rollback
+	}
+	if cnt == 0 {
+		// Revoked concurrently
+		err = ErrTokenRevoked
+		goto Rollback
+	}
+	rslt, err = txn.ExecContext(ctx, tokenRotateInsert,
+		hashSecret(secret), now.UnixMicro(), tok.ExpiresAt.UnixMicro(), tokenID)
+	if err != nil {
+		Logf(ctx, "ERROR: insert failed: %v\n", err)
+		goto Rollback
+	}
+	tok.ID, err = rslt.LastInsertId()
+	if err != nil {
+		Logf(ctx, "ERROR: failed to get token_id: %v\n", err)
+		goto Rollback
+	}
+	err = txn.Commit()
+	if err != nil {
+		Logf(ctx, "ERROR: commit failed: %v\n", err)
+		return nil, err
+	}
+	return tok, nil
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		// If rollback fails, we should just abort
+		fatalf(ctx, "ERROR: failed to rollback transaction on api_token %d: '%v'", tokenID, rollbackErr)
+	}
+	return nil, err
+}
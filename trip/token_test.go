@@ -0,0 +1,200 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the API tokens.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	apiTokenCreate = `CREATE TABLE IF NOT EXISTS api_token (
+token_id INTEGER CONSTRAINT api_token_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL DEFAULT 0,
+scope TEXT NOT NULL,
+token_hash TEXT NOT NULL CONSTRAINT api_token_hash_unique UNIQUE,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL,
+revoked_at INTEGER NOT NULL DEFAULT 0)`
+	apiTokenUserIndex = "CREATE INDEX IF NOT EXISTS api_token_user_index ON api_token(user_id)"
+	apiTokenDrop      = "DROP TABLE IF EXISTS api_token"
+)
+
+// TestScope checks the scopes include the less privileged ones
+func TestScope(t *testing.T) {
+	if !ScopeAdmin.Includes(ScopeWrite) || !ScopeWrite.Includes(ScopeRead) || !ScopeRead.Includes(ScopeRead) {
+		t.Error("A scope should include the less privileged ones")
+	}
+	if ScopeRead.Includes(ScopeWrite) || Scope("root").Includes(ScopeRead) {
+		t.Error("A scope shouldn't include the more privileged ones")
+	}
+}
+
+// TestPermits checks the tokens are only permitted on the trips of their
+// user, and the one they're restricted to
+func TestPermits(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	tr := NewTrip("Trip P", alice, "", NewDate(time.Now()), []string{bob})
+	err := tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		tok    Token
+		tripID int64
+		scope  Scope
+		want   bool
+	}{
+		{Token{Email: alice, TripID: tr.ID, Scope: ScopeWrite}, tr.ID, ScopeRead, true},
+		{Token{Email: alice, TripID: tr.ID, Scope: ScopeWrite}, tr.ID + 1, ScopeRead, false},
+		{Token{Email: alice, TripID: tr.ID, Scope: ScopeWrite}, 0, ScopeRead, false},
+		{Token{Email: alice, TripID: tr.ID, Scope: ScopeWrite}, tr.ID, ScopeAdmin, false},
+		{Token{Email: bob, Scope: ScopeRead}, tr.ID, ScopeRead, true},
+		{Token{Email: bob, Scope: ScopeRead}, tr.ID, ScopeWrite, false},
+		{Token{Email: bob, Scope: ScopeRead}, 0, ScopeRead, true},
+		// not a participant of the trip
+		{Token{Email: david, Scope: ScopeWrite}, tr.ID, ScopeRead, false},
+		{Token{Email: david, TripID: tr.ID, Scope: ScopeWrite}, tr.ID, ScopeRead, false},
+		{Token{Email: david, Scope: ScopeAdmin}, tr.ID, ScopeWrite, true},
+	} {
+		got, err := c.tok.Permits(ctx, pdb, c.tripID, c.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("Expect %v for the %s scope on trip %d, got %v with %#v", c.want, c.scope, c.tripID, got, c.tok)
+		}
+	}
+}
+
+// TestTokenLifecycle issues, looks up, rotates and revokes tokens
+func TestTokenLifecycle(t *testing.T) {
+	ctx := context.Background()
+	kdb := openTestDB(t)
+	usr, err := LoadOrCreateUser(ctx, kdb, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := IssueToken(ctx, kdb, usr, 7, ScopeWrite, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Secret == "" {
+		t.Fatal("The issued token should hold the secret")
+	}
+	_, err = IssueToken(ctx, kdb, usr, 0, Scope("root"), time.Hour)
+	if err == nil {
+		t.Error("Expect an error for an invalid scope")
+	}
+
+	found, err := LookupToken(ctx, kdb, tok.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != tok.ID || found.Email != alice || found.TripID != 7 || found.Scope != ScopeWrite || found.Secret != "" {
+		t.Errorf("Unexpected token: %#v", *found)
+	}
+	_, err = LookupToken(ctx, kdb, "bogus")
+	if err != sql.ErrNoRows {
+		t.Errorf("Expect sql.ErrNoRows for an unknown secret, got %v", err)
+	}
+
+	rotated, err := RotateToken(ctx, kdb, tok.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ID == tok.ID || rotated.Secret == tok.Secret || rotated.TripID != 7 || rotated.Scope != ScopeWrite {
+		t.Errorf("Unexpected rotated token: %#v", *rotated)
+	}
+	if rotated.ExpiresAt.Sub(rotated.CreatedAt) != time.Hour {
+		t.Errorf("The rotated token should keep the lifetime, got %v", rotated.ExpiresAt.Sub(rotated.CreatedAt))
+	}
+	_, err = LookupToken(ctx, kdb, tok.Secret)
+	if err != ErrTokenRevoked {
+		t.Errorf("Expect the rotated token to be revoked, got %v", err)
+	}
+	_, err = RotateToken(ctx, kdb, tok.ID)
+	if err != ErrTokenRevoked {
+		t.Errorf("Expect ErrTokenRevoked rotating a revoked token, got %v", err)
+	}
+	_, err = LookupToken(ctx, kdb, rotated.Secret)
+	if err != nil {
+		t.Error(err)
+	}
+
+	toks, err := LoadTokensByUser(ctx, kdb, "Alice@Test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toks) != 1 || toks[0].ID != rotated.ID {
+		t.Errorf("Expect only the rotated token to be listed: %v", toks)
+	}
+
+	_, err = kdb.ExecContext(ctx, "UPDATE api_token SET expires_at = ? WHERE token_id = ?",
+		time.Now().Add(-time.Minute).UnixMicro(), rotated.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LookupToken(ctx, kdb, rotated.Secret)
+	if err != ErrTokenExpired {
+		t.Errorf("Expect ErrTokenExpired, got %v", err)
+	}
+
+	err = RevokeToken(ctx, kdb, rotated.ID)
+	if err != nil {
+		t.Error(err)
+	}
+	err = RevokeToken(ctx, kdb, rotated.ID)
+	if err != sql.ErrNoRows {
+		t.Errorf("Expect sql.ErrNoRows revoking twice, got %v", err)
+	}
+}
+
+// TestTokenDeterministic issues a token with the fake clock and ID source,
+// its secret and times are known in advance
+func TestTokenDeterministic(t *testing.T) {
+	ctx := context.Background()
+	kdb := openTestDB(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Second).Now)
+	SetIDSource(&FakeIDSource{})
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetIDSource(nil)
+	})
+	usr, err := LoadOrCreateUser(ctx, kdb, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok, err := IssueToken(ctx, kdb, usr, 0, ScopeRead, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("0000000000000001", 4); tok.Secret != want {
+		t.Errorf("Expected the secret %s, got %s", want, tok.Secret)
+	}
+	if !tok.CreatedAt.Equal(start) || !tok.ExpiresAt.Equal(start.Add(time.Hour)) {
+		t.Errorf("Unexpected times of the token: %v, %v", tok.CreatedAt, tok.ExpiresAt)
+	}
+	id, err := NewID(4)
+	if err != nil || id != "00000002" {
+		t.Errorf("Expected the next ID to be 00000002, got %s, %v", id, err)
+	}
+	_, err = LookupToken(ctx, kdb, tok.Secret)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -10,8 +10,12 @@ package trip
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"regexp"
 	"sort"
 	"strings"
 	"time"
@@ -19,42 +23,90 @@ import (
 
 // Some global contants used to store SQL statements
 const (
-	tripByOwnerSelect = `SELECT t.trip_id, t.name, t.name_lower, t.created_at, t.start_date, t.end_date, t.description
+	tripByOwnerSelect = `SELECT t.trip_id, t.name, t.name_lower, t.created_at, t.start_date, t.end_date, t.description, t.version, t.archived_at, t.organizer_fee, t.approval_required
 FROM trip AS t, participant AS p, tuser AS u
 WHERE u.user_id = p.user_id
 AND p.trip_id = t.trip_id
 AND p.is_owner = true
 AND t.end_date = 0
+AND t.deleted_at = 0
 AND u.email = ?`
-	tripByIDSelet = `SELECT trip_id, name, name_lower, created_at, start_date, end_date, description
+	tripByOwnerNameOrder      = "\nORDER BY t.name_lower, t.trip_id"
+	tripByOwnerStartDateOrder = "\nORDER BY t.start_date DESC, t.trip_id DESC"
+	tripByOwnerActivitySelect = `SELECT t.trip_id, t.name, t.name_lower, t.created_at, t.start_date, t.end_date, t.description, t.version, t.archived_at, t.organizer_fee, t.approval_required
+FROM trip AS t
+JOIN participant AS p ON p.trip_id = t.trip_id
+JOIN tuser AS u ON u.user_id = p.user_id
+LEFT JOIN expense AS e ON e.trip_id = t.trip_id
+WHERE p.is_owner = true
+AND t.end_date = 0
+AND t.deleted_at = 0
+AND u.email = ?
+GROUP BY t.trip_id
+ORDER BY MAX(COALESCE(e.created_at, t.created_at)) DESC, t.trip_id DESC`
+	tripExistsSelect = "SELECT 1 FROM trip WHERE trip_id = ? AND deleted_at = 0"
+	tripByIDSelet    = `SELECT trip_id, name, name_lower, created_at, start_date, end_date, description, version, archived_at, organizer_fee, approval_required, deleted_at
 FROM trip WHERE trip_id = ?`
-	tripInsert = `INSERT INTO trip (name, name_lower, created_at, start_date, end_date, description)
-VALUES (?, ?, ?, ?, ?, ?)`
-	tripComplete = `UPDATE trip SET end_date = ?
+	tripInsert = `INSERT INTO trip (name, name_lower, created_at, start_date, end_date, description, organizer_fee, approval_required)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	tripComplete = `UPDATE trip SET end_date = ?, version = version + 1
+WHERE trip_id = ?`
+	tripUpdate = `UPDATE trip SET name = ?, name_lower = ?, start_date = ?, description = ?, organizer_fee = ?, approval_required = ?
 WHERE trip_id = ?`
 
 	peopleSelect = `
-SELECT u.user_id, u.email, u.verified, p.is_owner
+SELECT u.user_id, u.email, u.verified, u.display_name, u.avatar, p.is_owner, p.rsvp
 FROM tuser AS u, participant AS p
 WHERE u.user_id = p.user_id
 AND p.trip_id = ?`
-	peopleInsert = "INSERT INTO participant (trip_id, user_id, is_owner) VALUES (?, ?, ?)"
-
-	expenseSelect = `SELECT expense_id, txn_date, created_at, description
-FROM expense WHERE trip_id = ? ORDER BY created_at`
-	expenseInsert = `INSERT INTO expense (trip_id, txn_date, created_at, description)
+	peopleInsert = "INSERT INTO participant (trip_id, user_id, is_owner, rsvp) VALUES (?, ?, ?, ?)"
+	peopleDelete = `DELETE FROM participant
+WHERE trip_id = ? AND user_id = ? AND is_owner = false
+AND NOT EXISTS (
+SELECT 1 FROM expense AS e, expense_participant AS ep
+WHERE e.expense_id = ep.expense_id
+AND e.trip_id = participant.trip_id
+AND ep.user_id = participant.user_id)`
+
+	expenseSelect = `SELECT e.expense_id, e.txn_date, e.created_at, e.description, COALESCE(n.notes, ''),
+COALESCE(m.metadata, '')
+FROM expense AS e LEFT JOIN expense_note AS n ON n.expense_id = e.expense_id
+LEFT JOIN expense_metadata AS m ON m.expense_id = e.expense_id
+WHERE e.trip_id = ?`
+	expenseCreationOrder = "\nORDER BY e.created_at, e.expense_id"
+	expenseDateOrder     = "\nORDER BY e.txn_date, e.created_at, e.expense_id"
+	expenseInsert        = `INSERT INTO expense (trip_id, txn_date, created_at, description)
 VALUES (?, ?, ?, ?)`
+	expenseDelete = "DELETE FROM expense WHERE expense_id = ? AND trip_id = ?"
+	noteInsert    = "INSERT INTO expense_note (expense_id, notes) VALUES (?, ?)"
+	noteDelete    = "DELETE FROM expense_note WHERE expense_id = ?"
+	// the metadata isn't deleted with the expense, it's purged with the
+	// history, see LoadTripAsOf()
+	metadataInsert = "INSERT INTO expense_metadata (expense_id, metadata) VALUES (?, ?)"
 
 	participantSelect = `SELECT u.email, ep.user_id, ep.amount
 FROM expense_participant AS ep, tuser AS u
 WHERE ep.user_id = u.user_id
 AND ep.expense_id = ?`
 	participantInsert = "INSERT INTO expense_participant (expense_id, user_id, amount) VALUES (?, ?, ?)"
+	participantDelete = "DELETE FROM expense_participant WHERE expense_id = ?"
+
+	// pageClause limits a listing to a page, a LIMIT of -1 means no limit
+	pageClause = "\nLIMIT ? OFFSET ?"
 )
 
 var (
 	// zeroTime is the time.Time object that represent epoch 0 (apparently, it cannot be const)
 	zeroTime = time.UnixMicro(0)
+	// unsafeLink matches the start of the target of markdown links using
+	// a scripting or data scheme
+	unsafeLink = regexp.MustCompile(`(?i)\]\(\s*(javascript|vbscript|data):`)
+	// ErrParticipantInExpense is returned when removing a participant that
+	// is part of an expense of the trip
+	ErrParticipantInExpense = errors.New("participant is part of an expense of the trip")
+	// ErrUnknownParticipant is returned when a user given as a participant
+	// isn't part of the trip
+	ErrUnknownParticipant = errors.New("not part of the trip")
 )
 
 // Participant is a user that participated in an expenditure event.
@@ -68,7 +120,9 @@ type Participant struct {
 }
 
 // ByAmount is used for sorting the list of Participants by the amount Paid
-// The default order is the one who paid the most is at the top (index 0)
+// The default order is the one who paid the most is at the top (index 0),
+// by email address on a tie, so that the order doesn't depend on the one
+// of the Participants
 type ByAmount []Participant
 
 // Len is part of the sort.Interface
@@ -79,7 +133,10 @@ func (p ByAmount) Len() int {
 // Less is part of the sort.Interface
 func (p ByAmount) Less(i, j int) bool {
 	// Since this is a reverse order by Paid the comparison is ">" for Less()
-	return p[i].Paid > p[j].Paid
+	if p[i].Paid != p[j].Paid {
+		return p[i].Paid > p[j].Paid
+	}
+	return p[i].Email < p[j].Email
 }
 
 // Swap is part of the sort.Interface
@@ -121,13 +178,19 @@ func (d *Date) UnmarshalJSON(data []byte) error {
 // Expense records the details of an expenditure event
 type Expense struct {
 	// ID is the primary key of the table
-	ID int64 `json:expense_id`
+	ID int64 `json:"expense_id"`
 	// Date is the transaction date in `YYYY-MM-DD` format
 	Date Date `json:"date"`
 	// Description describes the expenditure event
-	Description string `json:description`
+	Description string `json:"description"`
 	// Participants is a list of the participating users
-	Participants []Participant `json:participants`
+	Participants []Participant `json:"participants"`
+	// Notes is a longer, markdown formatted, text about the expense.
+	// It's sanitized with SanitizeNotes() when set with SetNotes()
+	Notes string `json:"notes,omitempty"`
+	// Metadata are key/value pairs of an integration, e.g. its own
+	// reference of the expense, they're stored as given
+	Metadata map[string]string `json:"metadata,omitempty"`
 	// createdAt is the epoch timestamp of entry creation
 	createdAt time.Time
 	// amount is the sum of the amount paid
@@ -165,6 +228,27 @@ type Trip struct {
 	Participants []*User `json:"participants" binding:"required"`
 	// Expenses is a list of Expense instances incurred during the trip
 	Expenses []*Expense `json:"expenses"`
+	// Version is incremented by each change of the trip, see ETag()
+	Version int64 `json:"version"`
+	// Archived is set once a completed trip is archived, it can't be
+	// changed anymore, see ArchiveTrip()
+	Archived bool `json:"archived"`
+	// ForbiddenTransfers are the transfers the settlement must route
+	// around, see Settlement()
+	ForbiddenTransfers []TransferPair `json:"forbidden_transfers"`
+	// Households are the households of the people, by email address, the
+	// settlement can be netted within, see SetHouseholds()
+	Households map[string]string `json:"households"`
+	// RSVP are the answers of the participants to the invitation to the
+	// trip, by email address, see SetRSVP()
+	RSVP map[string]string `json:"rsvp"`
+	// OrganizerFee is credited to the owner for organizing the trip, and
+	// paid by the other participants in the settlement (in cent), see
+	// SetOrganizerFee()
+	OrganizerFee int `json:"organizer_fee"`
+	// ApprovalRequired is set when the settlement is only final once the
+	// participants approved the expenses, see SetApprovalRequired()
+	ApprovalRequired bool `json:"approval_required"`
 	// nameLower is the normalized version of "Name"
 	nameLower string
 	// createdAt is the Epoch timestamp in µs of the object creation
@@ -173,6 +257,29 @@ type Trip struct {
 	emailLookup map[string]int64
 	// totalExpense is the sum of all the expenses
 	totalExpense int
+	// detailsChanged is set when the name, description, start date or
+	// organizer fee of an existing trip are changed, so that Save() updates them
+	detailsChanged bool
+	// removed are the participants removed from an existing trip, deleted
+	// by Save()
+	removed []*User
+	// removedExpenses are the expenses removed from an existing trip,
+	// archived then deleted by Save()
+	removedExpenses []*Expense
+	// forbiddenChanged is set when the forbidden transfers are changed, so
+	// that Save() replaces them
+	forbiddenChanged bool
+	// householdsChanged is set when the households are changed, so that
+	// Save() writes them
+	householdsChanged bool
+	// rsvpChanged are the participants whose answer was changed, written
+	// by Save()
+	rsvpChanged map[string]bool
+	// released are the IDs of the expenses of the quarantine added to the
+	// trip, deleted from the quarantine by Save()
+	released []int64
+	// asOf is the time of the past view of LoadTripAsOf(), if set
+	asOf time.Time
 }
 
 // Payments register the payees and amounts a payer needs to make
@@ -190,6 +297,11 @@ func normalizeName(name string) string {
 	return strings.ToLower(name)
 }
 
+// isUnset returns true if t is either the zero value of time.Time or zeroTime
+func isUnset(t time.Time) bool {
+	return t.IsZero() || t.Equal(zeroTime)
+}
+
 // epochToDate returns a time.Time instance from the epoch values stored in DB
 func epochToDate(tstamp int64) Date {
 	r := time.Unix(int64(tstamp), 0).UTC()
@@ -210,11 +322,14 @@ func NewTrip(name, owner, description string, startDate Date, participants []str
 		createdAt:    zeroTime,
 		emailLookup:  make(map[string]int64),
 		totalExpense: 0,
+		RSVP:         make(map[string]string),
+		Households:   make(map[string]string),
 	}
 	for _, p := range participants {
 		u := NewUser(p)
 		if u.Email != trip.Owner.Email {
 			trip.Participants = append(trip.Participants, u)
+			trip.RSVP[u.Email] = RSVPInvited
 		} else {
 			log.Printf("WARNING: owner '%s' is also in the list of participants '%v', ignoring.\n", owner, participants)
 		}
@@ -222,68 +337,159 @@ func NewTrip(name, owner, description string, startDate Date, participants []str
 	return &trip
 }
 
-// LoadTripsByOwner returns all the Trip instances from the database,
-// given the owner email address
-func LoadTripsByOwner(ctx context.Context, db *sql.DB, owner string) (map[string]*Trip, error) {
-	stmt, err := db.PrepareContext(ctx, tripByOwnerSelect)
+// Clone returns a new trip with the name, the owner, the description and
+// the participants of the trip, starting at the given date, e.g. for the
+// yearly trip of the same crew. No DB operation will happen, the new trip
+// is written by Save()
+func (trip *Trip) Clone(name string, startDate Date) *Trip {
+	if name == "" {
+		name = trip.Name
+	}
+	participants := make([]string, 0, len(trip.Participants))
+	for _, p := range trip.Participants {
+		participants = append(participants, p.Email)
+	}
+	return NewTrip(name, trip.Owner.Email, trip.Description, startDate, participants)
+}
+
+// loadTrips runs the given trip query and returns the Trip instances
+// in the order of the result rows
+func loadTrips(ctx context.Context, db *sql.DB, query string, args ...any) ([]*Trip, error) {
+	stmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.QueryContext(ctx, normalizeEmail(owner))
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
-		log.Printf("ERROR: tripByOwnerSelect failed: %v\n", err)
+		Logf(ctx, "ERROR: trip query failed: %v\n", err)
 		return nil, err
 	}
 	defer rows.Close()
 
-	rslt := make(map[string]*Trip)
+	rslt := []*Trip{}
 	for rows.Next() {
-		var startDate, endDate, createdAt int64
+		var startDate, endDate, createdAt, archivedAt int64
 
 		trip := new(Trip)
 		trip.emailLookup = make(map[string]int64)
-		err = rows.Scan(&trip.ID, &trip.Name, &trip.nameLower, &createdAt, &startDate, &endDate, &trip.Description)
+		err = rows.Scan(&trip.ID, &trip.Name, &trip.nameLower, &createdAt, &startDate, &endDate, &trip.Description, &trip.Version, &archivedAt, &trip.OrganizerFee, &trip.ApprovalRequired)
 		if err != nil {
-			log.Printf("ERROR: failed to read in trip row with Scan '%v'\n", err)
+			Logf(ctx, "ERROR: failed to read in trip row with Scan '%v'\n", err)
 			return nil, err
 		}
 		trip.createdAt = time.UnixMicro(createdAt).UTC()
 		trip.StartDate = NewDate(time.Unix(startDate, 0).UTC())
 		trip.EndDate = time.Unix(endDate, 0).UTC()
+		trip.Archived = archivedAt != 0
 		err = trip.loadParts(ctx, db)
 		if err != nil {
 			return nil, err
 		}
-		rslt[trip.nameLower] = trip
+		rslt = append(rslt, trip)
 	}
 	err = rows.Err()
 	if err != nil {
-		log.Printf("ERROR: rows operation failed: %v\n", err)
+		Logf(ctx, "ERROR: rows operation failed: %v\n", err)
 		return nil, err
 	}
 	return rslt, nil
 }
 
-// LoadTripByID loads a single trip by the primary key
+// Page selects a part of a listing. A Limit of 0 means no limit.
+type Page struct {
+	// Offset is the number of items to skip
+	Offset int
+	// Limit is the maximum number of items returned
+	Limit int
+}
+
+// args returns the arguments of pageClause for the page
+func (p Page) args() []any {
+	limit := p.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	return []any{limit, p.Offset}
+}
+
+// TripSort is the order of a listing of trips
+type TripSort string
+
+const (
+	// TripsByName orders the trips by their name
+	TripsByName TripSort = "name"
+	// TripsByStartDate orders the trips by their start date, the latest first
+	TripsByStartDate TripSort = "start_date"
+	// TripsByActivity orders the trips by the most recent activity. The
+	// activity of a trip is the creation time of its latest expense, or
+	// that of the trip itself if there is no expense yet.
+	TripsByActivity TripSort = "activity"
+)
+
+// tripSortSelect maps the TripSort to the trip queries
+var tripSortSelect = map[TripSort]string{
+	TripsByName:      tripByOwnerSelect + tripByOwnerNameOrder,
+	TripsByStartDate: tripByOwnerSelect + tripByOwnerStartDateOrder,
+	TripsByActivity:  tripByOwnerActivitySelect,
+}
+
+// LoadTripsByOwner returns the active Trip instances from the database,
+// given the owner email address, keyed by their normalized name. The
+// page is taken in the order of the names.
+func LoadTripsByOwner(ctx context.Context, db *sql.DB, owner string, page Page) (map[string]*Trip, error) {
+	trips, err := LoadTripsByOwnerSorted(ctx, db, owner, TripsByName, page)
+	if err != nil {
+		return nil, err
+	}
+	rslt := make(map[string]*Trip)
+	for _, trip := range trips {
+		rslt[trip.nameLower] = trip
+	}
+	return rslt, nil
+}
+
+// LoadTripsByOwnerSorted returns a page of the active trips of the given
+// owner, in the given order
+func LoadTripsByOwnerSorted(ctx context.Context, db *sql.DB, owner string, sort TripSort, page Page) ([]*Trip, error) {
+	query, ok := tripSortSelect[sort]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sort order %q", sort)
+	}
+	return loadTrips(ctx, db, query+pageClause, append([]any{normalizeEmail(owner)}, page.args()...)...)
+}
+
+// LoadTripByID loads a single trip by the primary key, a deleted trip
+// isn't found
 func LoadTripByID(ctx context.Context, db *sql.DB, id int64) (*Trip, error) {
 	stmt, err := db.PrepareContext(ctx, tripByIDSelet)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
+	return scanTripByID(ctx, db, stmt.QueryRowContext(ctx, id), false)
+}
 
-	var startDate, endDate, createdAt int64
+// scanTripByID reads the trip of a row of tripByIDSelet, and loads the
+// rest of it. sql.ErrNoRows is returned if the trip doesn't exist, if
+// deleted is set and the trip isn't deleted, or if deleted isn't set and
+// the trip is deleted.
+func scanTripByID(ctx context.Context, db *sql.DB, row *sql.Row, deleted bool) (*Trip, error) {
+	var startDate, endDate, createdAt, archivedAt, deletedAt int64
 	trip := new(Trip)
 	trip.emailLookup = make(map[string]int64)
-	err = stmt.QueryRowContext(ctx, id).Scan(&trip.ID, &trip.Name, &trip.nameLower, &createdAt, &startDate, &endDate, &trip.Description)
+	err := row.Scan(&trip.ID, &trip.Name, &trip.nameLower, &createdAt, &startDate, &endDate, &trip.Description, &trip.Version, &archivedAt, &trip.OrganizerFee, &trip.ApprovalRequired, &deletedAt)
 	if err != nil {
 		return nil, err
 	}
+	if (deletedAt != 0) != deleted {
+		return nil, sql.ErrNoRows
+	}
 	trip.createdAt = time.UnixMicro(createdAt).UTC()
 	trip.StartDate = NewDate(time.Unix(startDate, 0).UTC())
 	trip.EndDate = time.Unix(endDate, 0).UTC()
+	trip.Archived = archivedAt != 0
 	err = trip.loadParts(ctx, db)
 	if err != nil {
 		return nil, err
@@ -301,26 +507,38 @@ func (trip *Trip) loadParts(ctx context.Context, db *sql.DB) error {
 
 	rows, err := stmt.QueryContext(ctx, trip.ID)
 	if err != nil {
-		log.Printf("ERROR: Query for participants of trip %d failed '%v'\n", trip.ID, err)
+		Logf(ctx, "ERROR: Query for participants of trip %d failed '%v'\n", trip.ID, err)
 		return err
 	}
 	defer rows.Close()
 
 	var isOwner bool
+	var rsvp, avatar string
+	trip.RSVP = make(map[string]string)
 	for rows.Next() {
 		usr := new(User)
-		err = rows.Scan(&usr.ID, &usr.Email, &usr.Verified, &isOwner)
+		err = rows.Scan(&usr.ID, &usr.Email, &usr.Verified, &usr.DisplayName, &avatar, &isOwner, &rsvp)
 		if err != nil {
-			log.Printf("ERROR: failed to read in participant with Scan '%v'\n", err)
+			Logf(ctx, "ERROR: failed to read in participant with Scan '%v'\n", err)
 			return err
 		}
+		usr.AvatarURL = avatarURL(avatar)
 		if isOwner {
 			trip.Owner = usr
 		} else {
 			trip.Participants = append(trip.Participants, usr)
+			trip.RSVP[usr.Email] = rsvp
 		}
 		trip.emailLookup[usr.Email] = usr.ID
 	}
+	trip.ForbiddenTransfers, err = queryForbiddenTransfers(ctx, db, trip.ID)
+	if err != nil {
+		return err
+	}
+	trip.Households, err = LoadHouseholds(ctx, db, trip.ID)
+	if err != nil {
+		return err
+	}
 	return trip.loadExpenses(ctx, db)
 }
 
@@ -367,6 +585,52 @@ func (trip *Trip) Equals(trip2 *Trip) bool {
 	return true
 }
 
+// insertExpense writes a new expense, with its notes, metadata and
+// participants, and adds it to the running balances. It's expected to be
+// executed within a transaction
+func (trip *Trip) insertExpense(ctx context.Context, txn *sql.Tx, e *Expense) error {
+	rslt, err := txn.ExecContext(ctx, expenseInsert, trip.ID, e.Date.Unix(), e.createdAt.UnixMicro(), e.Description)
+	if err != nil {
+		return err
+	}
+	e.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if e.Notes != "" {
+		_, err = txn.ExecContext(ctx, noteInsert, e.ID, e.Notes)
+		if err != nil {
+			return err
+		}
+	}
+	if len(e.Metadata) > 0 {
+		metadata, err := json.Marshal(e.Metadata)
+		if err != nil {
+			return err
+		}
+		_, err = txn.ExecContext(ctx, metadataInsert, e.ID, string(metadata))
+		if err != nil {
+			return err
+		}
+	}
+	for j, ep := range e.Participants {
+		if ep.UserID == 0 {
+			id, ok := trip.emailLookup[normalizeEmail(ep.Email)]
+			if !ok {
+				Logf(ctx, "ERROR: Expense participant '%s' not in the list of trip participants\n", ep.Email)
+				return fmt.Errorf("Expense participant '%s' %w", ep.Email, ErrUnknownParticipant)
+			}
+			// also update the UserID in the array
+			e.Participants[j].UserID = id
+		}
+		_, err = txn.ExecContext(ctx, participantInsert, e.ID, e.Participants[j].UserID, ep.Paid)
+		if err != nil {
+			return err
+		}
+	}
+	return trip.updateBalances(ctx, txn, e, 1)
+}
+
 // createTrip is used in Save() to make that function a bit more compact
 // It's expected to be executed within a transaction
 func (trip *Trip) createTrip(ctx context.Context, txn *sql.Tx, now time.Time) (err error) {
@@ -386,14 +650,14 @@ func (trip *Trip) createTrip(ctx context.Context, txn *sql.Tx, now time.Time) (e
 	defer pStmt.Close()
 
 	// Set createdAt, if necessary
-	if trip.createdAt.IsZero() {
+	if isUnset(trip.createdAt) {
 		trip.createdAt = now
 	}
 	rslt, err = tStmt.ExecContext(ctx,
 		trip.Name, trip.nameLower,
 		trip.createdAt.UnixMicro(),
 		trip.StartDate.Unix(), trip.EndDate.Unix(),
-		trip.Description)
+		trip.Description, trip.OrganizerFee, trip.ApprovalRequired)
 	if err != nil {
 		return err
 	}
@@ -403,12 +667,30 @@ func (trip *Trip) createTrip(ctx context.Context, txn *sql.Tx, now time.Time) (e
 		return err
 	}
 
-	rslt, err = pStmt.ExecContext(ctx, trip.ID, trip.Owner.ID, true)
+	rslt, err = pStmt.ExecContext(ctx, trip.ID, trip.Owner.ID, true, RSVPAccepted)
 	if err != nil {
 		return err
 	}
 	for _, p := range trip.Participants {
-		rslt, err = pStmt.ExecContext(ctx, trip.ID, p.ID, false)
+		rslt, err = pStmt.ExecContext(ctx, trip.ID, p.ID, false, trip.rsvp(p.Email))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertParticipants adds the given users as participants of an existing trip
+// It's expected to be executed within a transaction
+func (trip *Trip) insertParticipants(ctx context.Context, txn *sql.Tx, users []*User) error {
+	stmt, err := txn.PrepareContext(ctx, peopleInsert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, u := range users {
+		_, err = stmt.ExecContext(ctx, trip.ID, u.ID, false, trip.rsvp(u.Email))
 		if err != nil {
 			return err
 		}
@@ -416,136 +698,309 @@ func (trip *Trip) createTrip(ctx context.Context, txn *sql.Tx, now time.Time) (e
 	return nil
 }
 
-// Save writes the Trip instance to database
+// deleteParticipants deletes the participants removed from an existing trip
+// It's expected to be executed within a transaction
+func (trip *Trip) deleteParticipants(ctx context.Context, txn *sql.Tx) error {
+	for _, usr := range trip.removed {
+		if usr.ID == 0 {
+			continue
+		}
+		rslt, err := txn.ExecContext(ctx, peopleDelete, trip.ID, usr.ID)
+		if err != nil {
+			return err
+		}
+		cnt, err := rslt.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if cnt != 1 {
+			// An expense was added since the trip was loaded
+			return ErrParticipantInExpense
+		}
+	}
+	return nil
+}
+
+// Save writes the Trip instance to database, in a single transaction,
+// along with the expenses and the participants removed since it was
+// loaded or last saved. A FreezeError is returned, and nothing written,
+// if new expenses are added while the expense entry of the trip is frozen.
 func (trip *Trip) Save(ctx context.Context, db *sql.DB) (err error) {
-	now := time.Now()
-	// first we deal with the users
+	if !trip.asOf.IsZero() {
+		return ErrPastTrip
+	}
+	if trip.Archived {
+		return ErrTripArchived
+	}
+	now := Now()
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// added are the participants that are new to an existing trip
+	var added []*User
+	// newExpenses are the expenses inserted by this call
+	var newExpenses []*Expense
+	var alerts []SpendAlert
+	var envelopeAlerts []EnvelopeAlert
+	// prev is the trip before its details changed, for the audit log
+	var prev *auditTrip
+	// created is set for a new trip, queued is the number of events
+	// queued for the webhooks
+	created := trip.ID == 0
+	var queued, n int
+	var summary *TripSummary
+	// changed is set when the trip changes besides its new expenses, for
+	// the subscribers of its activity
+	changed := trip.detailsChanged || trip.forbiddenChanged || trip.householdsChanged || len(trip.removed) > 0 || len(trip.rsvpChanged) > 0
+
+	// first we deal with the users, new ones are created within the same transaction
 	if trip.Owner.ID == 0 {
-		trip.Owner, err = LoadOrCreateUser(ctx, db, trip.Owner.Email)
+		trip.Owner, err = loadOrCreateUserTx(ctx, txn, trip.Owner.Email)
 		if err != nil {
-			return err
+			goto Rollback
 		}
 	}
 	trip.emailLookup[trip.Owner.Email] = trip.Owner.ID
 	for i, p := range trip.Participants {
 		if p.ID == 0 {
-			trip.Participants[i], err = LoadOrCreateUser(ctx, db, p.Email)
+			trip.Participants[i], err = loadOrCreateUserTx(ctx, txn, p.Email)
 			if err != nil {
-				return err
+				goto Rollback
+			}
+			if trip.ID != 0 {
+				added = append(added, trip.Participants[i])
 			}
 		}
 		trip.emailLookup[trip.Participants[i].Email] = trip.Participants[i].ID
 	}
 
-	txn, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-
-	var rslt sql.Result
-	var eStmt, epStmt *sql.Stmt
-
 	// Do trip and participant insert only when trip.ID is 0
 	if trip.ID == 0 {
 		err = trip.createTrip(ctx, txn, now)
 		if err != nil {
 			goto Rollback
 		}
+	} else {
+		// the expenses first, the participants removed may be part of them
+		for _, e := range trip.removedExpenses {
+			err = trip.deleteExpense(ctx, txn, e, now)
+			if err != nil {
+				goto Rollback
+			}
+		}
+		err = trip.deleteParticipants(ctx, txn)
+		if err != nil {
+			goto Rollback
+		}
+		if len(added) > 0 {
+			err = trip.insertParticipants(ctx, txn, added)
+			if err != nil {
+				goto Rollback
+			}
+		}
+		if trip.detailsChanged {
+			prev, err = loadAuditTrip(ctx, txn, trip.ID)
+			if err != nil {
+				goto Rollback
+			}
+			_, err = txn.ExecContext(ctx, tripUpdate,
+				trip.Name, trip.nameLower, trip.StartDate.Unix(), trip.Description, trip.OrganizerFee, trip.ApprovalRequired, trip.ID)
+			if err != nil {
+				goto Rollback
+			}
+		}
+		err = trip.bumpVersion(ctx, txn)
+		if err != nil {
+			goto Rollback
+		}
 	}
-
-	// Deal with expenses
-	eStmt, err = txn.PrepareContext(ctx, expenseInsert)
-	if err != nil {
-		goto Rollback
+	if trip.forbiddenChanged {
+		err = trip.saveForbiddenTransfers(ctx, txn)
+		if err != nil {
+			goto Rollback
+		}
 	}
-	defer eStmt.Close()
-
-	epStmt, err = txn.PrepareContext(ctx, participantInsert)
-	if err != nil {
-		goto Rollback
+	if trip.householdsChanged {
+		err = trip.saveHouseholds(ctx, txn)
+		if err != nil {
+			goto Rollback
+		}
+	}
+	if len(trip.rsvpChanged) > 0 {
+		err = trip.saveRSVP(ctx, txn)
+		if err != nil {
+			goto Rollback
+		}
 	}
-	defer epStmt.Close()
 
+	// Deal with expenses
 	for _, e := range trip.Expenses {
 		if e.ID != 0 {
 			// This expense is already handled
 			continue
 		}
-		if e.createdAt.IsZero() {
+		if len(newExpenses) == 0 && !created {
+			err = trip.checkFreeze(ctx, txn, now)
+			if err != nil {
+				goto Rollback
+			}
+		}
+		if isUnset(e.createdAt) {
 			e.createdAt = now
 		}
-		rslt, err = eStmt.ExecContext(ctx, trip.ID, e.Date.Unix(), e.createdAt.UnixMicro(), e.Description)
+		err = trip.insertExpense(ctx, txn, e)
 		if err != nil {
 			goto Rollback
 		}
-		e.ID, err = rslt.LastInsertId()
+		newExpenses = append(newExpenses, e)
+	}
+	for _, id := range trip.released {
+		err = trip.deleteReleased(ctx, txn, id)
 		if err != nil {
 			goto Rollback
 		}
-		var ok bool
-		for j, ep := range e.Participants {
-			if ep.UserID == 0 {
-				ep.UserID, ok = trip.emailLookup[normalizeEmail(ep.Email)]
-				if !ok {
-					log.Printf("ERROR: Expense participant '%s' not in the list of trip participants\n", ep.Email)
-					goto Rollback
-				}
-				// also update the UserID in the array
-				e.Participants[j].UserID = ep.UserID
-			}
-			_, err = epStmt.ExecContext(ctx, e.ID, ep.UserID, ep.Paid)
-			if err != nil {
-				goto Rollback
-			}
+	}
+	alerts, err = trip.checkSpendCaps(ctx, txn, newExpenses)
+	if err != nil {
+		goto Rollback
+	}
+	envelopeAlerts, err = trip.checkEnvelopes(ctx, txn, newExpenses)
+	if err != nil {
+		goto Rollback
+	}
+	err = trip.auditSave(ctx, txn, now, created, added, prev, newExpenses)
+	if err != nil {
+		goto Rollback
+	}
+	if created || len(newExpenses) > 0 {
+		summary = trip.Summary()
+	}
+	if created {
+		queued, err = queueEvent(ctx, txn, trip.ID, EventTripCreated, trip.webhookData(), summary)
+		if err != nil {
+			goto Rollback
 		}
 	}
-	return txn.Commit()
+	for _, e := range newExpenses {
+		n, err = queueEvent(ctx, txn, trip.ID, EventExpenseAdded, e, summary)
+		if err != nil {
+			goto Rollback
+		}
+		queued += n
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	if trip.Version == 0 {
+		trip.Version = 1
+	} else {
+		trip.Version++
+	}
+	trip.detailsChanged = false
+	trip.forbiddenChanged = false
+	trip.householdsChanged = false
+	trip.removed = nil
+	trip.released = nil
+	trip.rsvpChanged = nil
+	for _, a := range alerts {
+		SpendAlertHook(ctx, trip, a)
+	}
+	for _, a := range envelopeAlerts {
+		EnvelopeAlertHook(ctx, trip, a)
+	}
+	for _, e := range newExpenses {
+		ExpenseHook(ctx, trip, e)
+	}
+	notifyWebhooks(queued)
+	if !created {
+		for _, e := range trip.removedExpenses {
+			trip.publishActivity(ActivityExpenseRemoved, map[string]int64{"expense_id": e.ID})
+		}
+		for _, e := range newExpenses {
+			trip.publishActivity(ActivityExpenseAdded, e)
+		}
+		if changed || len(added) > 0 {
+			trip.publishActivity(ActivityTripChanged, nil)
+		}
+	}
+	trip.removedExpenses = nil
+	return nil
 
 Rollback:
 	rollbackErr := txn.Rollback()
 	if rollbackErr != nil {
-		log.Fatalf("ERROR: trip.Save() failed to rollback transaction on trip '%v': '%v'\n", trip, rollbackErr)
+		fatalf(ctx, "ERROR: trip.Save() failed to rollback transaction on trip '%v': '%v'\n", trip, rollbackErr)
 	}
 	return err
 } // Save()
 
-// loadExpenses loads the Expenses attribute with a list of Expense objects for the trip
-func (trip *Trip) loadExpenses(ctx context.Context, db *sql.DB) error {
-	eStmt, err := db.PrepareContext(ctx, expenseSelect)
+// ExpenseSort is the order of a listing of expenses
+type ExpenseSort string
+
+const (
+	// ExpensesByCreation orders the expenses as they were entered
+	ExpensesByCreation ExpenseSort = "created"
+	// ExpensesByDate orders the expenses by their transaction date
+	ExpensesByDate ExpenseSort = "date"
+)
+
+// expenseSortSelect maps the ExpenseSort to the expense queries
+var expenseSortSelect = map[ExpenseSort]string{
+	ExpensesByCreation: expenseSelect + expenseCreationOrder,
+	ExpensesByDate:     expenseSelect + expenseDateOrder,
+}
+
+// queryExpenses runs the given expense query and returns the Expense
+// instances, with their participants, in the order of the result rows
+func queryExpenses(ctx context.Context, db *sql.DB, query string, args ...any) ([]*Expense, error) {
+	return queryExpensesFrom(ctx, db, participantSelect, query, args...)
+}
+
+// queryExpensesFrom is queryExpenses() with the query of the participants
+// of each expense, e.g. for the archived expenses
+func queryExpensesFrom(ctx context.Context, db *sql.DB, pQuery string, query string, args ...any) ([]*Expense, error) {
+	eStmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer eStmt.Close()
 
-	pStmt, err := db.PrepareContext(ctx, participantSelect)
+	pStmt, err := db.PrepareContext(ctx, pQuery)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer pStmt.Close()
 
-	eRows, err := eStmt.QueryContext(ctx, trip.ID)
-	switch {
-	case err == sql.ErrNoRows:
-		return nil
-	case err != nil:
-		return err
+	eRows, err := eStmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
 	}
 	defer eRows.Close()
 
+	rslt := []*Expense{}
 	var txnDate, createdAt int64
-	clear(trip.Expenses)
+	var metadata string
 	for eRows.Next() {
 		e := new(Expense)
-		err = eRows.Scan(&e.ID, &txnDate, &createdAt, &e.Description)
+		err = eRows.Scan(&e.ID, &txnDate, &createdAt, &e.Description, &e.Notes, &metadata)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if metadata != "" {
+			err = json.Unmarshal([]byte(metadata), &e.Metadata)
+			if err != nil {
+				return nil, err
+			}
 		}
 		e.Date = NewDate(time.Unix(txnDate, 0).UTC())
 		e.createdAt = time.UnixMicro(createdAt).UTC()
 
 		pRows, err := pStmt.QueryContext(ctx, e.ID)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		defer pRows.Close()
 
@@ -553,19 +1008,60 @@ func (trip *Trip) loadExpenses(ctx context.Context, db *sql.DB) error {
 			p := Participant{}
 			err = pRows.Scan(&p.Email, &p.UserID, &p.Paid)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			e.Participants = append(e.Participants, p)
 			e.amount += p.Paid
 		}
-		trip.Expenses = append(trip.Expenses, e)
+		rslt = append(rslt, e)
+	}
+	return rslt, eRows.Err()
+}
+
+// loadExpenses loads the Expenses attribute with a list of Expense objects for the trip
+func (trip *Trip) loadExpenses(ctx context.Context, db *sql.DB) error {
+	expenses, err := queryExpenses(ctx, db, expenseSortSelect[ExpensesByCreation], trip.ID)
+	if err != nil {
+		return err
+	}
+	trip.Expenses = expenses
+	trip.totalExpense = 0
+	for _, e := range expenses {
 		trip.totalExpense += e.amount
 	}
 	return nil
 }
 
+// LoadExpenses returns a page of the expenses of a trip, in the given
+// order, without loading the rest of the trip. sql.ErrNoRows is returned
+// if the trip doesn't exist.
+func LoadExpenses(ctx context.Context, db *sql.DB, tripID int64, sort ExpenseSort, page Page) ([]*Expense, error) {
+	query, ok := expenseSortSelect[sort]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sort order %q", sort)
+	}
+	var exists int
+	err := db.QueryRowContext(ctx, tripExistsSelect, tripID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	return queryExpenses(ctx, db, query+pageClause, append([]any{tripID}, page.args()...)...)
+}
+
 // AddExpense adds an Expense object to the Trip object
 func (trip *Trip) AddExpense(date Date, description string, participants []Participant) error {
+	expense, err := trip.newExpense(date, description, participants)
+	if err != nil {
+		return err
+	}
+	trip.Expenses = append(trip.Expenses, expense)
+	trip.totalExpense += expense.amount
+	return nil
+}
+
+// newExpense returns an Expense of the trip, checking its participants
+// are part of the trip, without adding it to the trip
+func (trip *Trip) newExpense(date Date, description string, participants []Participant) (*Expense, error) {
 	expense := Expense{
 		Date:         date,
 		Description:  description,
@@ -577,7 +1073,7 @@ func (trip *Trip) AddExpense(date Date, description string, participants []Parti
 		email := normalizeEmail(ep.Email)
 		id, ok := trip.emailLookup[email]
 		if !ok {
-			return fmt.Errorf("Expense participant '%s' not part of the trip", email)
+			return nil, fmt.Errorf("Expense participant '%s' %w", email, ErrUnknownParticipant)
 		}
 		p := Participant{
 			Email:  email,
@@ -587,11 +1083,147 @@ func (trip *Trip) AddExpense(date Date, description string, participants []Parti
 		expense.Participants = append(expense.Participants, p)
 		expense.amount += p.Paid
 	}
-	trip.Expenses = append(trip.Expenses, &expense)
-	trip.totalExpense += expense.amount
+	return &expense, nil
+}
+
+// RemoveExpense removes the expense, given its ID, from the trip, it's
+// archived then deleted along with its participants by Save().
+// sql.ErrNoRows is returned if the expense isn't part of the trip.
+func (trip *Trip) RemoveExpense(expenseID int64) error {
+	idx := -1
+	for i, e := range trip.Expenses {
+		if e.ID == expenseID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 || expenseID == 0 {
+		return sql.ErrNoRows
+	}
+	trip.totalExpense -= trip.Expenses[idx].amount
+	trip.removedExpenses = append(trip.removedExpenses, trip.Expenses[idx])
+	trip.Expenses = append(trip.Expenses[:idx], trip.Expenses[idx+1:]...)
 	return nil
 }
 
+// deleteExpense subtracts the expense from the running balances, archives
+// it at now for the past views of the trip, then deletes it along with its
+// participants. It's expected to be executed within a transaction
+func (trip *Trip) deleteExpense(ctx context.Context, txn *sql.Tx, e *Expense, now time.Time) error {
+	err := trip.updateBalances(ctx, txn, e, -1)
+	if err != nil {
+		return err
+	}
+	err = trip.archiveExpense(ctx, txn, e.ID, now)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, participantDelete, e.ID)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, noteDelete, e.ID)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, expenseDelete, e.ID, trip.ID)
+	return err
+}
+
+// IsParticipant returns true if the given email address belongs to
+// the owner or one of the participants of the trip
+func (trip *Trip) IsParticipant(email string) bool {
+	email = normalizeEmail(email)
+	if trip.Owner.Email == email {
+		return true
+	}
+	for _, p := range trip.Participants {
+		if p.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// people returns the email addresses of the owner and the participants
+func (trip *Trip) people() []string {
+	rslt := []string{trip.Owner.Email}
+	for _, p := range trip.Participants {
+		rslt = append(rslt, p.Email)
+	}
+	return rslt
+}
+
+// AddParticipant adds a user, by email address, to the list of participants
+// of the trip. The user, if new, and the participation are written to the
+// database by Save()
+func (trip *Trip) AddParticipant(email string) error {
+	usr := NewUser(email)
+	if trip.IsParticipant(usr.Email) {
+		return fmt.Errorf("'%s' is already part of the trip", usr.Email)
+	}
+	trip.Participants = append(trip.Participants, usr)
+	trip.emailLookup[usr.Email] = usr.ID
+	trip.setRSVP(usr.Email, RSVPInvited)
+	return nil
+}
+
+// RemoveParticipant removes a user, by email address, from the list of
+// participants of the trip, the participation is deleted by Save(). The
+// owner cannot be removed. sql.ErrNoRows is returned if the user isn't a
+// participant, and ErrParticipantInExpense if the user is part of any of
+// the expenses.
+func (trip *Trip) RemoveParticipant(email string) error {
+	email = normalizeEmail(email)
+	if trip.Owner.Email == email {
+		return fmt.Errorf("'%s' is the owner of the trip", email)
+	}
+	idx := -1
+	for i, p := range trip.Participants {
+		if p.Email == email {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return sql.ErrNoRows
+	}
+	err := trip.dropParticipant(idx)
+	if err != nil {
+		return err
+	}
+	trip.dropForbiddenTransfers(email)
+	trip.dropHousehold(email)
+	return nil
+}
+
+// SanitizeNotes makes markdown formatted notes safe for rendering: raw HTML
+// is escaped, links with scripting schemes are neutralized, and control
+// characters, other than new lines and tabs, are dropped.
+func SanitizeNotes(notes string) string {
+	var b strings.Builder
+	for _, r := range notes {
+		switch {
+		case r == '<':
+			b.WriteString("&lt;")
+		case r == '&':
+			b.WriteString("&amp;")
+		case r == '\n' || r == '\t':
+			b.WriteRune(r)
+		case r < ' ' || r == 0x7f:
+			// drop other control characters, including '\r'
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return unsafeLink.ReplaceAllString(b.String(), "](#")
+}
+
+// SetNotes sets the notes of the expense, after sanitizing them
+func (expense *Expense) SetNotes(notes string) {
+	expense.Notes = SanitizeNotes(notes)
+}
+
 // Equals evaluates if 2 Expense instances are Equals
 func (expense *Expense) Equals(expense2 *Expense) bool {
 	if expense.ID != expense2.ID {
@@ -603,6 +1235,12 @@ func (expense *Expense) Equals(expense2 *Expense) bool {
 	if expense.Description != expense2.Description {
 		return false
 	}
+	if expense.Notes != expense2.Notes {
+		return false
+	}
+	if !maps.Equal(expense.Metadata, expense2.Metadata) {
+		return false
+	}
 	if len(expense.Participants) != len(expense2.Participants) {
 		return false
 	}
@@ -616,7 +1254,10 @@ func (expense *Expense) Equals(expense2 *Expense) bool {
 	return true
 }
 
-// Settle computes the settlement for a single expenditure event
+// Settle computes the settlement for a single expenditure event. The
+// Participants are sorted ByAmount, so the same expense always yields the
+// same transfers, whatever the order of its Participants: the running
+// balances subtract exactly what they added when the expense is changed.
 func (expense Expense) Settle() Settlement {
 	rslt := make(Settlement)
 	n := len(expense.Participants)
@@ -664,9 +1305,11 @@ func (s Settlement) upsertAmount(payer, payee string, amount int, lookup map[str
 	lookup[key] = true
 }
 
-// Complete computes the full Settlement for the whole trip and sets the end_date
-func (trip *Trip) Complete(ctx context.Context, db *sql.DB) (Settlement, error) {
-	now := time.Now()
+// Settle computes the full Settlement for the whole trip, netting the
+// settlements of the individual expenses. Identical expenses yield an
+// identical Settlement, whatever the order of the expenses and of their
+// Participants.
+func (trip *Trip) Settle() Settlement {
 	rslt := make(Settlement)
 	// This is a lookup to catch A pays B and B pays A situation
 	lookup := make(map[string]bool)
@@ -698,8 +1341,43 @@ func (trip *Trip) Complete(ctx context.Context, db *sql.DB) (Settlement, error)
 			}
 		}
 	}
+	// drop the payers left with nothing to pay after the netting
+	for payer, payments := range rslt {
+		if len(payments) == 0 {
+			delete(rslt, payer)
+		}
+	}
+	return rslt
+}
+
+// ExpenseHook is called for every expense added to a trip, with the
+// context of the Save(), after it has been committed. The default does
+// nothing.
+var ExpenseHook = func(ctx context.Context, trip *Trip, e *Expense) {}
+
+// CompletionHook is called the first time a trip is completed, with the
+// context of the Complete(), after it has been committed. The default does
+// nothing.
+var CompletionHook = func(ctx context.Context, trip *Trip, s Settlement) {}
+
+// Complete computes the full Settlement for the whole trip and sets the end_date.
+// The first time a trip is completed, a Snapshot of the trip is also stored,
+// and CompletionHook is called.
+// ErrInfeasibleSettlement is returned, and the trip isn't completed, if the
+// settlement can't avoid the forbidden transfers.
+func (trip *Trip) Complete(ctx context.Context, db *sql.DB) (Settlement, error) {
+	now := Now()
+	rslt, err := trip.Settlement()
+	if err != nil {
+		return nil, err
+	}
+	var snap *Snapshot
+	var queued int
+	prevEndDate := trip.EndDate
+	trip.EndDate = time.Unix(now.Unix(), 0).UTC()
 	txn, err := db.BeginTx(ctx, nil)
 	if err != nil {
+		trip.EndDate = prevEndDate
 		return nil, err
 	}
 	stmt, err := txn.PrepareContext(ctx, tripComplete)
@@ -712,16 +1390,41 @@ func (trip *Trip) Complete(ctx context.Context, db *sql.DB) (Settlement, error)
 	if err != nil {
 		goto Rollback
 	}
+	err = recordAudit(ctx, txn, trip.ID, now, ActionTripCompleted, 0, nil, rslt)
+	if err != nil {
+		goto Rollback
+	}
+	if isUnset(prevEndDate) {
+		snap, err = trip.newSnapshot(rslt, now)
+		if err != nil {
+			goto Rollback
+		}
+		err = snap.save(ctx, txn)
+		if err != nil {
+			goto Rollback
+		}
+		queued, err = queueEvent(ctx, txn, trip.ID, EventTripCompleted, webhookSettlement{trip.EndDate, rslt}, trip.Summary())
+		if err != nil {
+			goto Rollback
+		}
+	}
 	err = txn.Commit()
 	if err != nil {
 		goto Rollback
 	}
+	trip.Version++
+	notifyWebhooks(queued)
+	trip.publishActivity(ActivityTripCompleted, nil)
+	if isUnset(prevEndDate) {
+		CompletionHook(ctx, trip, rslt)
+	}
 	return rslt, nil
 
 Rollback:
+	trip.EndDate = prevEndDate
 	rollbackErr := txn.Rollback()
 	if rollbackErr != nil {
-		log.Fatalf("ERROR: trip.Complete() failed to rollback transaction on trip '%v': '%v'\n", trip, rollbackErr)
+		fatalf(ctx, "ERROR: trip.Complete() failed to rollback transaction on trip '%v': '%v'\n", trip, rollbackErr)
 	}
 	return nil, err
 }
@@ -15,6 +15,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -29,13 +30,19 @@ name_lower VARCHAR(128) NOT NULL,
 created_at INTEGER NOT NULL,
 start_date INTEGER NOT NULL,
 end_date INTEGER DEFAULT 0,
-description VARCHAR(512))`
+description VARCHAR(512),
+version INTEGER NOT NULL DEFAULT 1,
+archived_at INTEGER DEFAULT 0,
+organizer_fee INTEGER NOT NULL DEFAULT 0,
+approval_required BOOLEAN NOT NULL DEFAULT FALSE,
+deleted_at INTEGER NOT NULL DEFAULT 0)`
 	tripDrop = "DROP TABLE IF EXISTS trip"
 
 	participantCreate = `CREATE TABLE IF NOT EXISTS participant (
 trip_id INTEGER NOT NULL,
 user_id INTEGER NOT NULL,
 is_owner BOOLEAN NOT NULL DEFAULT FALSE,
+rsvp VARCHAR(16) NOT NULL DEFAULT 'invited',
 CONSTRAINT participant_pkey PRIMARY KEY (trip_id, user_id))`
 	participantDrop = "DROP TABLE IF EXISTS participant"
 
@@ -55,6 +62,54 @@ user_id INTEGER NOT NULL,
 amount INTEGER NOT NULL,
 CONSTRAINT expense_participant_pkey PRIMARY KEY (expense_id, user_id))`
 	expenseParticipantDrop = "DROP TABLE IF EXISTS expense_participant"
+
+	expenseNoteCreate = `CREATE TABLE IF NOT EXISTS expense_note (
+expense_id INTEGER CONSTRAINT expense_note_pkey PRIMARY KEY,
+notes TEXT NOT NULL)`
+	expenseNoteDrop = "DROP TABLE IF EXISTS expense_note"
+
+	expenseMetadataCreate = `CREATE TABLE IF NOT EXISTS expense_metadata (
+expense_id INTEGER CONSTRAINT expense_metadata_pkey PRIMARY KEY,
+metadata TEXT NOT NULL)`
+
+	expenseReassignmentCreate = `CREATE TABLE IF NOT EXISTS expense_reassignment (
+expense_id INTEGER CONSTRAINT expense_reassignment_pkey PRIMARY KEY,
+trip_id INTEGER NOT NULL,
+replaced_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+target_id INTEGER NOT NULL DEFAULT 0,
+created_at INTEGER NOT NULL)`
+
+	receiptCreate = `CREATE TABLE IF NOT EXISTS receipt (
+receipt_id INTEGER CONSTRAINT receipt_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+expense_id INTEGER NOT NULL,
+sha256 CHAR(64) NOT NULL,
+content_type VARCHAR(128) NOT NULL,
+filename VARCHAR(256) NOT NULL,
+size INTEGER NOT NULL,
+uploaded_at INTEGER NOT NULL)`
+	receiptExpenseIndex = "CREATE INDEX IF NOT EXISTS receipt_expense_index ON receipt(trip_id, expense_id)"
+	receiptSHA256Index  = "CREATE INDEX IF NOT EXISTS receipt_sha256_index ON receipt(sha256)"
+
+	webhookCreate = `CREATE TABLE IF NOT EXISTS webhook (
+webhook_id INTEGER CONSTRAINT webhook_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL DEFAULT 0,
+url VARCHAR(2048) NOT NULL,
+events VARCHAR(256) NOT NULL,
+secret CHAR(64) NOT NULL,
+created_at INTEGER NOT NULL)`
+	webhookDeliveryCreate = `CREATE TABLE IF NOT EXISTS webhook_delivery (
+delivery_id INTEGER CONSTRAINT webhook_delivery_pkey PRIMARY KEY AUTOINCREMENT,
+webhook_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL,
+event VARCHAR(32) NOT NULL,
+payload TEXT NOT NULL,
+created_at INTEGER NOT NULL,
+attempts INTEGER NOT NULL DEFAULT 0,
+next_attempt_at INTEGER NOT NULL,
+last_error VARCHAR(512) NOT NULL DEFAULT '')`
+	webhookDeliveryIndex = "CREATE INDEX IF NOT EXISTS webhook_delivery_next_index ON webhook_delivery(next_attempt_at)"
 )
 
 var (
@@ -62,7 +117,7 @@ var (
 	trip1, trip2 *Trip
 )
 
-func setupSchema() {
+func setupSchema(db *sql.DB) {
 	ctx := context.Background()
 	_, err := db.ExecContext(ctx, tuserCreate)
 	if err != nil {
@@ -88,6 +143,117 @@ func setupSchema() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	_, err = db.ExecContext(ctx, expenseNoteCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, expenseMetadataCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, stmt := range []string{expenseReassignmentCreate, receiptCreate, receiptExpenseIndex, receiptSHA256Index,
+		webhookCreate, webhookDeliveryCreate, webhookDeliveryIndex} {
+		_, err = db.ExecContext(ctx, stmt)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	_, err = db.ExecContext(ctx, spendCapCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, snapshotCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, snapshotTripIndex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, apiTokenCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, apiTokenUserIndex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, tripSettlementCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, expenseDeletedCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, expenseDeletedTripIndex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, expenseParticipantDeletedCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, forbiddenTransferCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, costPreferenceCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, expenseApprovalCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, expenseQuarantineCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, expenseQuarantineTripIndex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, emailVerificationCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, approvalDelegationCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, tripMessageCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, tripMessageTripIndex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, householdMemberCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, tripSettingCreate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, stmt := range []string{pushDeviceCreate, pushDeviceIndex, pushDeliveryCreate, pushDeliveryIndex} {
+		_, err = db.ExecContext(ctx, stmt)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, stmt := range []string{recurringExpenseCreate, recurringExpenseIndex, featureFlagCreate, featureUserCreate,
+		googleAccountCreate, tripSheetCreate, tripSheetIndex, settlementPaymentCreate, settlementPaymentTripIndex,
+		expenseFreezeCreate, expenseReviewCreate, expenseReviewTripIndex, friendGroupCreate,
+		friendGroupMemberCreate, tripFederationCreate, voiceNoteCreate, voiceNoteExpenseIndex, voiceNoteSHA256Index,
+		tripEnvelopeCreate, auditLogCreate, auditLogTripIndex} {
+		_, err = db.ExecContext(ctx, stmt)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 // TestMain initializes the DB handle and schema
@@ -104,11 +270,23 @@ func TestMain(m *testing.M) {
 	defer db.Close()
 	os.Remove(dbFile)
 
-	setupSchema()
+	setupSchema(db)
 	rs := m.Run()
 	os.Exit(rs)
 }
 
+// openTestDB returns a handle to a new database with the schema set up,
+// for tests that need their own data set
+func openTestDB(t *testing.T) *sql.DB {
+	tdb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	t.Cleanup(func() { tdb.Close() })
+	setupSchema(tdb)
+	return tdb
+}
+
 func trip1Setup() {
 	startDate := epochToDate(time.Now().Unix())
 	trip1 = NewTrip(
@@ -157,7 +335,7 @@ func TestTripCreation(t *testing.T) {
 // TestLoadTripsByOwner test loading trips by owner
 func TestLoadTripsByOwner(t *testing.T) {
 	ctx := context.Background()
-	trips, err := LoadTripsByOwner(ctx, db, alice)
+	trips, err := LoadTripsByOwner(ctx, db, alice, Page{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -224,6 +402,22 @@ func TestAddExpense(t *testing.T) {
 	}
 }
 
+// TestLoadTripsByOwnerByActivity checks that Trip 2, which now has
+// expenses, is listed before Trip 1
+func TestLoadTripsByOwnerByActivity(t *testing.T) {
+	ctx := context.Background()
+	trips, err := LoadTripsByOwnerSorted(ctx, db, alice, TripsByActivity, Page{})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(trips) != 2 {
+		t.Fatalf("Expect 2 active trips, got %d", len(trips))
+	}
+	if trips[0].ID != trip2.ID || trips[1].ID != trip1.ID {
+		t.Errorf("Trips are not ordered by activity: %d, %d", trips[0].ID, trips[1].ID)
+	}
+}
+
 // TestComplete testing the settlement algorithm
 // For Trip 2, we have:
 //   - Alice paid for the 3 tickets for a total of $60 (6000 cents)
@@ -250,6 +444,28 @@ func TestComplete(t *testing.T) {
 	}
 }
 
+func TestSettleDeterministic(t *testing.T) {
+	participants := []Participant{
+		{Email: alice, Paid: 3000},
+		{Email: bob, Paid: 3000},
+		{Email: charlie},
+		{Email: david},
+	}
+	expected := Settlement{david: {alice: 1500}, charlie: {bob: 1500}}
+	for _, order := range [][]int{{0, 1, 2, 3}, {1, 0, 3, 2}, {3, 2, 1, 0}, {2, 1, 3, 0}} {
+		e := Expense{amount: 6000}
+		for _, i := range order {
+			e.Participants = append(e.Participants, participants[i])
+		}
+		if s := e.Settle(); !reflect.DeepEqual(s, expected) {
+			t.Errorf("Unexpected settlement %v for the order %v", s, order)
+		}
+		if !reflect.DeepEqual(e.Participants[0], participants[order[0]]) {
+			t.Errorf("Settle() reordered the participants %v", e.Participants)
+		}
+	}
+}
+
 // TestAddExpense2 this deal with Trip 1
 func TestAddExpense2(t *testing.T) {
 	ctx := context.Background()
@@ -393,3 +609,391 @@ func TestTrip1Complete(t *testing.T) {
 		t.Errorf("Greg is paying David too much: %d vs 4450", s[greg][david])
 	}
 }
+
+// TestAddParticipantWithExpense adds a brand-new user to a trip along
+// with an expense, and checks both are persisted
+func TestAddParticipantWithExpense(t *testing.T) {
+	ctx := context.Background()
+	trip3 := NewTrip("Trip 3", bob, "Trip 3 for testing", epochToDate(time.Now().Unix()), []string{charlie})
+	err := trip3.Save(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = trip3.AddParticipant(charlie)
+	if err == nil {
+		t.Error("Adding an existing participant should fail")
+	}
+	err = trip3.AddParticipant(henry)
+	if err != nil {
+		t.Error(err)
+	}
+	p := []Participant{
+		{bob, 0, 0},
+		{henry, 0, 2000},
+	}
+	err = trip3.AddExpense(NewDate(time.Now()), "taxi", p)
+	if err != nil {
+		t.Error(err)
+	}
+	err = trip3.Save(ctx, db)
+	if err != nil {
+		t.Error(err)
+	}
+	t3, err := LoadTripByID(ctx, db, trip3.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !t3.IsParticipant(henry) {
+		t.Error("Henry should be a participant of Trip 3")
+	}
+	for _, u := range t3.Participants {
+		if u.Email == henry && (u.ID == 0 || u.Verified) {
+			t.Errorf("Henry should be an unverified user with an ID: %#v", *u)
+		}
+	}
+	if len(t3.Expenses) != 1 || len(t3.Expenses[0].Participants) != 2 {
+		t.Errorf("Trip 3 should have one expense with 2 participants: %#v", t3.Expenses)
+	}
+}
+
+// TestRemoveExpense removes a duplicate expense and checks it's gone
+// from both the Trip instance and the DB
+func TestRemoveExpense(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	tr := NewTrip("Trip R", alice, "", epochToDate(time.Now().Unix()), []string{bob})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := []Participant{{alice, 0, 1000}, {bob, 0, 0}}
+	for i := 0; i < 2; i++ {
+		err = tr.AddExpense(NewDate(time.Now()), "lunch", p)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dup := tr.Expenses[1].ID
+	err = tr.RemoveExpense(dup)
+	if err != nil {
+		t.Error(err)
+	}
+	if tr2, _ := LoadTripByID(ctx, rdb, tr.ID); len(tr2.Expenses) != 2 {
+		t.Errorf("The expense should only be deleted by Save(), got %d expenses left", len(tr2.Expenses))
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Expenses) != 1 || tr.totalExpense != 1000 {
+		t.Errorf("Expect 1 expense of 1000c left, got %d for %dc", len(tr.Expenses), tr.totalExpense)
+	}
+	err = tr.RemoveExpense(dup)
+	if err != sql.ErrNoRows {
+		t.Errorf("Removing an unknown expense should return sql.ErrNoRows, got %v", err)
+	}
+	tr2, err := LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr2.Expenses) != 1 || tr2.Expenses[0].ID == dup {
+		t.Errorf("The duplicate expense is still in the DB: %#v", tr2.Expenses)
+	}
+	var cnt int
+	err = rdb.QueryRowContext(ctx, "SELECT COUNT(*) FROM expense_participant WHERE expense_id = ?", dup).Scan(&cnt)
+	if err != nil || cnt != 0 {
+		t.Errorf("Expense participants of the duplicate are left behind: %d, %v", cnt, err)
+	}
+}
+
+// TestRemoveParticipant adds participants to an existing trip, and removes
+// those that are not part of any expense
+func TestRemoveParticipant(t *testing.T) {
+	ctx := context.Background()
+	rdb := openTestDB(t)
+	tr := NewTrip("Trip P", alice, "", epochToDate(time.Now().Unix()), []string{bob})
+	err := tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{charlie, david} {
+		err = tr.AddParticipant(email)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "museum", []Participant{{alice, 0, 3000}, {charlie, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = tr.RemoveParticipant(alice)
+	if err == nil {
+		t.Error("The owner should not be removable")
+	}
+	err = tr.RemoveParticipant(charlie)
+	if err != ErrParticipantInExpense {
+		t.Errorf("Charlie is part of an expense, got %v", err)
+	}
+	err = tr.RemoveParticipant(elise)
+	if err != sql.ErrNoRows {
+		t.Errorf("Elise is not part of the trip, got %v", err)
+	}
+	err = tr.RemoveParticipant("DAVID@test.com")
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := LoadTripByID(ctx, rdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr2.Participants) != 2 || tr2.IsParticipant(david) || !tr2.IsParticipant(charlie) {
+		t.Errorf("Expect Bob and Charlie left in the trip: %v", tr2.Participants)
+	}
+}
+
+// TestSanitizeNotes checks raw HTML and script links are neutralized,
+// while the markdown is left alone
+func TestSanitizeNotes(t *testing.T) {
+	cases := map[string]string{
+		"**Fish & chips**\n> great":             "**Fish &amp; chips**\n> great",
+		"<script>alert(1)</script>":             "&lt;script>alert(1)&lt;/script>",
+		"[menu](JavaScript:alert(1))":           "[menu](#alert(1))",
+		"[menu](https://example.com/m.pdf)\r\n": "[menu](https://example.com/m.pdf)\n",
+	}
+	for in, want := range cases {
+		got := SanitizeNotes(in)
+		if got != want {
+			t.Errorf("SanitizeNotes(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// TestExpenseNotes checks the notes are saved, loaded and removed along
+// with the expense
+func TestExpenseNotes(t *testing.T) {
+	ctx := context.Background()
+	ndb := openTestDB(t)
+	tr := NewTrip("Trip N", alice, "", epochToDate(time.Now().Unix()), []string{bob})
+	err := tr.Save(ctx, ndb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "groceries", []Participant{{alice, 0, 4200}, {bob, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	tr.Expenses[0].SetNotes("- bread\n- <b>cheese</b>")
+	err = tr.AddExpense(NewDate(time.Now()), "water", []Participant{{alice, 0, 100}, {bob, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr.Save(ctx, ndb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := LoadTripByID(ctx, ndb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr2.Expenses[0].Notes != "- bread\n- &lt;b>cheese&lt;/b>" || tr2.Expenses[1].Notes != "" {
+		t.Errorf("Unexpected notes: %q, %q", tr2.Expenses[0].Notes, tr2.Expenses[1].Notes)
+	}
+	err = tr2.RemoveExpense(tr2.Expenses[0].ID)
+	if err != nil {
+		t.Error(err)
+	}
+	err = tr2.Save(ctx, ndb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cnt int
+	err = ndb.QueryRowContext(ctx, "SELECT COUNT(*) FROM expense_note").Scan(&cnt)
+	if err != nil || cnt != 0 {
+		t.Errorf("Notes of the removed expense are left behind: %d, %v", cnt, err)
+	}
+}
+
+// TestExpenseMetadata checks the metadata is saved and loaded with the
+// expense, and kept for the past views once the expense is removed
+func TestExpenseMetadata(t *testing.T) {
+	ctx := context.Background()
+	mdb := openTestDB(t)
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	SetClock(NewFakeClock(start, time.Second).Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	tr := NewTrip("Trip M", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, mdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(start), "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := map[string]string{"expensify_id": "E-1234", "bot": "slack"}
+	tr.Expenses[0].Metadata = metadata
+	err = tr.AddExpense(NewDate(start), "taxi", []Participant{{alice, 0, 0}, {bob, 0, 2000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, mdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr2, err := LoadTripByID(ctx, mdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tr2.Expenses[0].Metadata, metadata) || tr2.Expenses[1].Metadata != nil {
+		t.Errorf("Unexpected metadata: %v, %v", tr2.Expenses[0].Metadata, tr2.Expenses[1].Metadata)
+	}
+	before := Now()
+	err = tr2.RemoveExpense(tr2.Expenses[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr2.Save(ctx, mdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past, err := LoadTripAsOf(ctx, mdb, tr.ID, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(past.Expenses) != 2 || !reflect.DeepEqual(past.Expenses[0].Metadata, metadata) {
+		t.Errorf("Expected the metadata of the removed expense in the past view, got %+v", past.Expenses)
+	}
+}
+
+// TestPaging checks the trips and expenses are listed a page at a time,
+// in a stable order
+func TestPaging(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	names := []string{"Zermatt", "Arles", "Malaga"}
+	var trips []*Trip
+	for i, name := range names {
+		tr := NewTrip(name, alice, "", epochToDate(int64(i)*86400), []string{bob})
+		err := tr.Save(ctx, pdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trips = append(trips, tr)
+	}
+
+	byName, err := LoadTripsByOwnerSorted(ctx, pdb, alice, TripsByName, Page{Offset: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byName) != 1 || byName[0].Name != "Malaga" {
+		t.Errorf("Expect Malaga as the 2nd trip by name: %v", byName)
+	}
+	byDate, err := LoadTripsByOwnerSorted(ctx, pdb, alice, TripsByStartDate, Page{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byDate) != 2 || byDate[0].ID != trips[2].ID || byDate[1].ID != trips[1].ID {
+		t.Errorf("Expect the latest trips first: %v", byDate)
+	}
+	named, err := LoadTripsByOwner(ctx, pdb, alice, Page{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(named) != 2 || named["arles"] == nil || named["malaga"] == nil {
+		t.Errorf("Expect the first 2 trips by name: %v", named)
+	}
+	_, err = LoadTripsByOwnerSorted(ctx, pdb, alice, TripSort("bogus"), Page{})
+	if err == nil {
+		t.Error("Expect an error for an unsupported sort order")
+	}
+
+	tr := trips[0]
+	for i := 3; i > 0; i-- {
+		err = tr.AddExpense(epochToDate(int64(i)*86400), fmt.Sprintf("day %d", i), []Participant{{alice, 0, 100 * i}, {bob, 0, 0}})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = tr.Save(ctx, pdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entered, err := LoadExpenses(ctx, pdb, tr.ID, ExpensesByCreation, Page{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entered) != 2 || entered[0].Description != "day 3" || entered[1].Description != "day 2" {
+		t.Errorf("Expect the first 2 expenses entered: %v", entered)
+	}
+	dated, err := LoadExpenses(ctx, pdb, tr.ID, ExpensesByDate, Page{Offset: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dated) != 1 || dated[0].Description != "day 3" || len(dated[0].Participants) != 2 {
+		t.Errorf("Expect the latest expense last by date: %v", dated)
+	}
+	_, err = LoadExpenses(ctx, pdb, 4242, ExpensesByCreation, Page{})
+	if err != sql.ErrNoRows {
+		t.Errorf("Expect sql.ErrNoRows for an unknown trip, got %v", err)
+	}
+}
+
+// TestClone clones a completed trip with its participants into a new open
+// trip, without its expenses
+func TestClone(t *testing.T) {
+	ctx := context.Background()
+	cdb := openTestDB(t)
+	start := NewDate(time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC))
+	tr := NewTrip("Ski week", alice, "Yearly ski week", start, []string{bob, charlie})
+	err := tr.Save(ctx, cdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(start, "chalet", []Participant{{alice, 0, 90000}, {bob, 0, 0}, {charlie, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, cdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.Complete(ctx, cdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := NewDate(time.Date(2025, 2, 8, 0, 0, 0, 0, time.UTC))
+	clone := tr.Clone("", next)
+	err = clone.Save(ctx, cdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTripByID(ctx, cdb, clone.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID == tr.ID || loaded.Name != "Ski week" || loaded.Description != "Yearly ski week" ||
+		loaded.Owner.Email != alice || !loaded.StartDate.Equal(next.Time) || !isUnset(loaded.EndDate) {
+		t.Errorf("Unexpected clone %+v", loaded)
+	}
+	if len(loaded.Participants) != 2 || !loaded.IsParticipant(bob) || !loaded.IsParticipant(charlie) || len(loaded.Expenses) != 0 {
+		t.Errorf("expected the participants without the expenses, got %v and %d expenses", loaded.Participants, len(loaded.Expenses))
+	}
+	if renamed := tr.Clone("Ski week 2025", next); renamed.Name != "Ski week 2025" {
+		t.Errorf("expected the clone renamed, got %q", renamed.Name)
+	}
+}
@@ -0,0 +1,87 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit serializes the changes to a trip. SQLite has no row-level
+// locking, so two requests loading the same trip, then saving their
+// changes, would otherwise work from stale copies, e.g. both inserting
+// the same new participant.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// tripLock is the write lock of a trip, refs being the number of callers
+// of lockTrip() holding or waiting for it
+type tripLock struct {
+	sync.Mutex
+	refs int
+}
+
+var (
+	// tripLocksMu guards tripLocks
+	tripLocksMu sync.Mutex
+	// tripLocks holds the locks of the trips being written, by trip ID, a
+	// lock being dropped once nobody holds or waits for it. The writes are
+	// only serialized within the process, which is enough as the SQLite
+	// file is owned by a single server.
+	tripLocks = make(map[int64]*tripLock)
+)
+
+// lockTrip acquires the write lock of a trip, it returns the function
+// releasing it
+func lockTrip(tripID int64) func() {
+	tripLocksMu.Lock()
+	l := tripLocks[tripID]
+	if l == nil {
+		l = new(tripLock)
+		tripLocks[tripID] = l
+	}
+	l.refs++
+	tripLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		tripLocksMu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(tripLocks, tripID)
+		}
+		tripLocksMu.Unlock()
+	}
+}
+
+// UpdateTrip loads a trip, applies the update to it, then saves it, while
+// holding the write lock of the trip. Concurrent updates of the same trip
+// are applied one after the other, each seeing the changes of the previous
+// ones. The changes of the update, e.g. with RemoveExpense(), are all
+// written by Save(), in a single transaction, though a few changes write
+// to the database themselves, e.g. ReassignParticipant(). sql.ErrNoRows is
+// returned if the trip doesn't exist, and ErrTripArchived if it's archived.
+func UpdateTrip(ctx context.Context, db *sql.DB, tripID int64, update func(*Trip) error) (*Trip, error) {
+	unlock := lockTrip(tripID)
+	defer unlock()
+
+	trip, err := LoadTripByID(ctx, db, tripID)
+	if err != nil {
+		return nil, err
+	}
+	if trip.Archived {
+		// checked before the update, which may write to the database
+		return nil, ErrTripArchived
+	}
+	err = update(trip)
+	if err != nil {
+		return nil, err
+	}
+	err = trip.Save(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return trip, nil
+}
@@ -0,0 +1,82 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the serialized trip updates.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestConcurrentUpdates posts expenses to the same trip concurrently, each
+// adding the same new participant, and checks they're all saved
+func TestConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	udb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip U", alice, "", today, []string{bob})
+	err := tr.Save(ctx, udb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const posts = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, posts)
+	for i := 0; i < posts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := UpdateTrip(ctx, udb, tr.ID, func(t *Trip) error {
+				if !t.IsParticipant(david) {
+					err := t.AddParticipant(david)
+					if err != nil {
+						return err
+					}
+				}
+				return t.AddExpense(today, fmt.Sprintf("round %d", i), []Participant{{alice, 0, 100}, {david, 0, 0}})
+			})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	tr2, err := LoadTripByID(ctx, udb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr2.Expenses) != posts || len(tr2.Participants) != 2 {
+		t.Errorf("Expect %d expenses and 2 participants, got %d and %d", posts, len(tr2.Expenses), len(tr2.Participants))
+	}
+	s, err := LoadSettlement(ctx, udb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s[david][alice] != posts*50 {
+		t.Errorf("Unexpected settlement: %v", s)
+	}
+
+	if len(tripLocks) != 0 {
+		t.Errorf("Expect the locks of the trips to be dropped, got %d left", len(tripLocks))
+	}
+
+	_, err = UpdateTrip(ctx, udb, 4242, func(t *Trip) error { return nil })
+	if err != sql.ErrNoRows {
+		t.Errorf("Expect sql.ErrNoRows for an unknown trip, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit upgrades the schema of an existing database. The schema only
+// creates the tables missing, with CREATE TABLE IF NOT EXISTS, so the
+// columns added since to the tables already there are added here, with
+// ALTER TABLE, by the server at startup.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// schemaColumn is a column added to a table after its creation
+type schemaColumn struct {
+	table  string
+	column string
+	// definition is the one of the schema, a constant default being
+	// required to add a NOT NULL column to the rows already there
+	definition string
+}
+
+// schemaColumns are the columns added to the tables, in the order they were
+// added
+var schemaColumns = []schemaColumn{
+	{"trip", "version", "INTEGER NOT NULL DEFAULT 1"},
+	{"trip", "archived_at", "INTEGER DEFAULT 0"},
+	{"participant", "rsvp", "VARCHAR(16) NOT NULL DEFAULT 'invited'"},
+	{"trip", "organizer_fee", "INTEGER NOT NULL DEFAULT 0"},
+	{"trip", "approval_required", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"tuser", "display_name", "VARCHAR(128) NOT NULL DEFAULT ''"},
+	{"tuser", "avatar", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"tuser", "venmo", "VARCHAR(30) NOT NULL DEFAULT ''"},
+	{"tuser", "paypal_me", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"tuser", "iban", "VARCHAR(34) NOT NULL DEFAULT ''"},
+	{"trip", "deleted_at", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// probeSchema tells whether a statement, reading no row, runs
+func probeSchema(ctx context.Context, db *sql.DB, query string) bool {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// UpgradeSchema adds the columns missing from the tables of the database,
+// returning their number. The tables missing are left to the schema, which
+// creates them with all their columns, so the upgrade can run before or
+// after it.
+func UpgradeSchema(ctx context.Context, db *sql.DB) (int, error) {
+	added := 0
+	for _, c := range schemaColumns {
+		if !probeSchema(ctx, db, fmt.Sprintf("SELECT 1 FROM %s LIMIT 0", c.table)) ||
+			probeSchema(ctx, db, fmt.Sprintf("SELECT %s FROM %s LIMIT 0", c.column, c.table)) {
+			continue
+		}
+		_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition))
+		if err != nil {
+			Logf(ctx, "ERROR: failed to add the column %s.%s: %v\n", c.table, c.column, err)
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
@@ -0,0 +1,104 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the upgrade of the schema.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// baselineSchema are the first tables of the schema, without the columns
+// added since
+const baselineSchema = `CREATE TABLE tuser (
+user_id INTEGER CONSTRAINT user_pkey PRIMARY KEY AUTOINCREMENT,
+email VARCHAR(256) NOT NULL UNIQUE,
+verified BOOLEAN DEFAULT FALSE);
+
+CREATE TABLE trip (
+trip_id INTEGER CONSTRAINT trip_pkey PRIMARY KEY AUTOINCREMENT,
+name VARCHAR(128) NOT NULL,
+name_lower VARCHAR(128) NOT NULL,
+created_at INTEGER NOT NULL,
+start_date INTEGER NOT NULL,
+end_date INTEGER DEFAULT 0,
+description VARCHAR(512));
+
+CREATE TABLE participant (
+trip_id INTEGER NOT NULL,
+user_id INTEGER NOT NULL,
+is_owner BOOLEAN NOT NULL DEFAULT FALSE,
+CONSTRAINT participant_pkey PRIMARY KEY (trip_id, user_id));
+
+INSERT INTO tuser (email, verified) VALUES ('alice@example.com', TRUE), ('bob@example.com', TRUE);
+INSERT INTO trip (name, name_lower, created_at, start_date, description)
+VALUES ('Old trip', 'old trip', 1700000000, 19675, 'Created before the upgrade');
+INSERT INTO participant (trip_id, user_id, is_owner) VALUES (1, 1, TRUE), (1, 2, FALSE);`
+
+// TestUpgradeSchema checks the columns added to the tables of an old
+// database, and the trip created before loaded and saved afterwards
+func TestUpgradeSchema(t *testing.T) {
+	ctx := context.Background()
+	tdb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "old.db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer tdb.Close()
+	_, err = tdb.ExecContext(ctx, baselineSchema)
+	if err != nil {
+		t.Fatalf("Failed to create the baseline schema: %v", err)
+	}
+	// As entrypoint.sh does, the schema adds the tables missing first
+	err = CreateSchema(ctx, tdb)
+	if err != nil {
+		t.Fatalf("Failed to create the schema: %v", err)
+	}
+	added, err := UpgradeSchema(ctx, tdb)
+	if err != nil {
+		t.Fatalf("Failed to upgrade the schema: %v", err)
+	}
+	if added != len(schemaColumns) {
+		t.Errorf("UpgradeSchema() added %d columns, want %d", added, len(schemaColumns))
+	}
+	added, err = UpgradeSchema(ctx, tdb)
+	if err != nil || added != 0 {
+		t.Errorf("UpgradeSchema() again = %d, %v, want 0, nil", added, err)
+	}
+
+	old, err := LoadTripByID(ctx, tdb, 1)
+	if err != nil {
+		t.Fatalf("Failed to load the old trip: %v", err)
+	}
+	if old.Name != "Old trip" || old.Version != 1 {
+		t.Errorf("Old trip = %q version %d, want %q version 1", old.Name, old.Version, "Old trip")
+	}
+	if rsvp := old.RSVP["bob@example.com"]; rsvp != RSVPInvited {
+		t.Errorf("RSVP of bob = %q, want %q", rsvp, RSVPInvited)
+	}
+	old.Description = "Saved after the upgrade"
+	err = old.Save(ctx, tdb)
+	if err != nil {
+		t.Fatalf("Failed to save the old trip: %v", err)
+	}
+}
+
+// TestUpgradeSchemaEmpty checks the tables missing left to the schema
+func TestUpgradeSchemaEmpty(t *testing.T) {
+	ctx := context.Background()
+	tdb, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "empty.db"))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer tdb.Close()
+	added, err := UpgradeSchema(ctx, tdb)
+	if err != nil || added != 0 {
+		t.Errorf("UpgradeSchema() = %d, %v, want 0, nil", added, err)
+	}
+}
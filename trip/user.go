@@ -3,24 +3,100 @@
 // participants.
 //
 // This unit focuses on user data model. All participants in a trip
-// are necessarily users.
+// are necessarily users. Private instances can restrict the email domains
+// of the new users.
 
 package trip
 
 import (
 	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Some global constants used to store SQL statements
 const (
-	userSelect         = "SELECT user_id, verified FROM tuser WHERE email=?"
+	userSelect         = "SELECT user_id, verified, display_name FROM tuser WHERE email=?"
 	userInsert         = "INSERT INTO tuser (email, verified) VALUES (?, ?)"
 	userUpdateVerified = "UPDATE tuser SET verified = ? WHERE user_id = ?"
+	userUpdateName     = "UPDATE tuser SET display_name = ? WHERE email = ?"
+	userProfileSelect  = `SELECT u.user_id, u.verified, u.display_name, u.avatar,
+u.venmo, u.paypal_me, u.iban, COUNT(p.trip_id),
+COALESCE(SUM(CASE WHEN p.is_owner THEN 1 ELSE 0 END), 0)
+FROM tuser AS u LEFT JOIN participant AS p ON p.user_id = u.user_id
+WHERE u.email = ?
+GROUP BY u.user_id, u.verified, u.display_name, u.avatar, u.venmo, u.paypal_me, u.iban`
+	displayNamesSelect = `SELECT u.email, u.display_name
+FROM tuser AS u, participant AS p
+WHERE u.user_id = p.user_id
+AND p.trip_id = ?
+AND u.display_name <> ''`
 )
 
+// ErrEmailDomain is returned when creating a user whose email domain is
+// not allowed, or is blocked, see SetDomainPolicy()
+var ErrEmailDomain = errors.New("email domain not accepted")
+
+// allowedDomains and blockedDomains are the email domains of the policy,
+// an empty allowedDomains allows all the domains not blocked
+var allowedDomains, blockedDomains map[string]bool
+
+// SetDomainPolicy restricts the email domains of the new users to the
+// allowed ones, if any, minus the blocked ones. A domain also covers its
+// subdomains. It's meant to be called before serving any request, the
+// existing users aren't affected.
+func SetDomainPolicy(allowed, blocked []string) {
+	toSet := func(domains []string) map[string]bool {
+		rslt := make(map[string]bool)
+		for _, d := range domains {
+			d = strings.Trim(normalizeEmail(strings.TrimSpace(d)), ".")
+			if d != "" {
+				rslt[d] = true
+			}
+		}
+		return rslt
+	}
+	allowedDomains, blockedDomains = toSet(allowed), toSet(blocked)
+}
+
+// matchDomain tells whether the domain, or one of its parents, is in the set
+func matchDomain(set map[string]bool, domain string) bool {
+	for domain != "" {
+		if set[domain] {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return false
+}
+
+// checkEmailDomain returns an error wrapping ErrEmailDomain if a user
+// can't be created with the email address
+func checkEmailDomain(email string) error {
+	if isErased(email) {
+		return fmt.Errorf("%w: %s is reserved", ErrEmailDomain, erasedDomain)
+	}
+	if len(allowedDomains) == 0 && len(blockedDomains) == 0 {
+		return nil
+	}
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 || at == len(email)-1 {
+		return fmt.Errorf("%w: %q is not an email address", ErrEmailDomain, email)
+	}
+	domain := normalizeEmail(email[at+1:])
+	if matchDomain(blockedDomains, domain) {
+		return fmt.Errorf("%w: %s is blocked", ErrEmailDomain, domain)
+	}
+	if len(allowedDomains) > 0 && !matchDomain(allowedDomains, domain) {
+		return fmt.Errorf("%w: %s is not allowed on this instance", ErrEmailDomain, domain)
+	}
+	return nil
+}
+
 // User refers to a registered user of the program.
 // All participants of a trip, or an expenditure event
 // must be a user.
@@ -31,6 +107,90 @@ type User struct {
 	Email string `json:"email"`
 	// The boolean reflects whether the email address has been verified
 	Verified bool `json:"verified"`
+	// DisplayName is the name shown instead of the email address, empty
+	// if the user didn't set one, see UpdateDisplayName()
+	DisplayName string `json:"display_name"`
+	// AvatarURL is the URL of the picture of the user, empty if they
+	// didn't upload one, see SetAvatar()
+	AvatarURL string `json:"avatar_url"`
+	// PaymentHandles are where the user wants to be paid, see
+	// UpdatePaymentHandles()
+	PaymentHandles PaymentHandles `json:"payment_handles"`
+}
+
+// Profile is the public view of a user, for the clients to resolve the
+// participants of the trips
+type Profile struct {
+	*User
+	// Trips is the number of trips the user is a participant of, the
+	// ones they own included
+	Trips int `json:"trips"`
+	// OwnedTrips is the number of trips the user owns
+	OwnedTrips int `json:"owned_trips"`
+}
+
+// LoadProfile returns the profile of the user of the email address,
+// sql.ErrNoRows if there's none. Unlike LoadOrCreateUser(), the user isn't
+// created.
+func LoadProfile(ctx context.Context, db *sql.DB, email string) (*Profile, error) {
+	p := &Profile{User: NewUser(email)}
+	var avatar string
+	err := db.QueryRowContext(ctx, userProfileSelect, p.Email).Scan(&p.ID, &p.Verified, &p.DisplayName, &avatar,
+		&p.PaymentHandles.Venmo, &p.PaymentHandles.PayPalMe, &p.PaymentHandles.IBAN, &p.Trips, &p.OwnedTrips)
+	if err != nil {
+		return nil, err
+	}
+	p.AvatarURL = avatarURL(avatar)
+	return p, nil
+}
+
+// maxDisplayName is the maximum length of a display name, in characters
+const maxDisplayName = 128
+
+// UpdateDisplayName sets the name shown instead of the email address of
+// the user, an empty name removes it, and returns their profile.
+// sql.ErrNoRows is returned if there's no such user, they aren't created.
+func UpdateDisplayName(ctx context.Context, db *sql.DB, email, name string) (*Profile, error) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxDisplayName {
+		return nil, fmt.Errorf("display name longer than %d characters", maxDisplayName)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return nil, errors.New("display name with control characters")
+	}
+	rslt, err := db.ExecContext(ctx, userUpdateName, name, normalizeEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if cnt == 0 {
+		return nil, sql.ErrNoRows
+	}
+	Logf(ctx, "Set the display name of %s to %q\n", normalizeEmail(email), name)
+	return LoadProfile(ctx, db, email)
+}
+
+// LoadDisplayNames returns the display names of the owner and the
+// participants of the trip, by email address, the ones without aside
+func LoadDisplayNames(ctx context.Context, db *sql.DB, tripID int64) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, displayNamesSelect, tripID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := make(map[string]string)
+	for rows.Next() {
+		var email, name string
+		err = rows.Scan(&email, &name)
+		if err != nil {
+			return nil, err
+		}
+		rslt[email] = name
+	}
+	return rslt, rows.Err()
 }
 
 // Users is for supporting sorting of []*User
@@ -46,9 +206,9 @@ func (u Users) Less(i, j int) bool {
 }
 
 // Normalize an email address.
-// Here, all it does is return a lowercased version of the address
+// Here, all it does is return a trimmed and lowercased version of the address
 func normalizeEmail(email string) string {
-	return strings.ToLower(email)
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
 // NewUser just returns an instance of User on the heap, with the given email address.
@@ -58,11 +218,15 @@ func NewUser(email string) *User {
 		0,
 		normalizeEmail(email),
 		false,
+		"",
+		"",
+		PaymentHandles{},
 	}
 }
 
 // LoadOrCreateUser returns a User instance by querying the database with the given
-// email address. If the user doesn't exist, it'll create one.
+// email address. If the user doesn't exist, it'll create one, if its email
+// domain is accepted, see SetDomainPolicy().
 func LoadOrCreateUser(ctx context.Context, db *sql.DB, email string) (*User, error) {
 	stmt, err := db.PrepareContext(ctx, userSelect)
 	if err != nil {
@@ -71,7 +235,7 @@ func LoadOrCreateUser(ctx context.Context, db *sql.DB, email string) (*User, err
 	defer stmt.Close()
 
 	usr := NewUser(email)
-	err = stmt.QueryRowContext(ctx, usr.Email).Scan(&usr.ID, &usr.Verified)
+	err = stmt.QueryRowContext(ctx, usr.Email).Scan(&usr.ID, &usr.Verified, &usr.DisplayName)
 	switch {
 	case err == sql.ErrNoRows:
 		err = usr.Save(ctx, db)
@@ -84,13 +248,48 @@ func LoadOrCreateUser(ctx context.Context, db *sql.DB, email string) (*User, err
 	return usr, nil
 }
 
+// loadOrCreateUserTx is the same as LoadOrCreateUser, but runs within
+// the given transaction, so that the new user is only committed along
+// with the rest of the changes.
+func loadOrCreateUserTx(ctx context.Context, txn *sql.Tx, email string) (*User, error) {
+	usr := NewUser(email)
+	err := txn.QueryRowContext(ctx, userSelect, usr.Email).Scan(&usr.ID, &usr.Verified, &usr.DisplayName)
+	switch {
+	case err == sql.ErrNoRows:
+		err = checkEmailDomain(usr.Email)
+		if err != nil {
+			return nil, err
+		}
+		rslt, err := txn.ExecContext(ctx, userInsert, usr.Email, usr.Verified)
+		if err != nil {
+			Logf(ctx, "ERROR: insert failed: %v\n", err)
+			return nil, err
+		}
+		usr.ID, err = rslt.LastInsertId()
+		if err != nil {
+			Logf(ctx, "ERROR: failed to get user_id: %v\n", err)
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+	return usr, nil
+}
+
 // Save writes the User instance to the database.
 // If the "ID" field is non-zero, then it would be an UPDATE operation.
-// Otherwise, it will be an INSERT operation.
+// Otherwise, it will be an INSERT operation, refused with ErrEmailDomain if
+// the email domain isn't accepted.
 func (usr *User) Save(ctx context.Context, db *sql.DB) error {
+	if usr.ID == 0 {
+		err := checkEmailDomain(usr.Email)
+		if err != nil {
+			return err
+		}
+	}
 	txn, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("ERROR: Begin failed: %v\n", err)
+		Logf(ctx, "ERROR: Begin failed: %v\n", err)
 		return err
 	}
 
@@ -105,7 +304,7 @@ func (usr *User) Save(ctx context.Context, db *sql.DB) error {
 		stmt, err = txn.PrepareContext(ctx, userInsert)
 	}
 	if err != nil {
-		log.Printf("ERROR: PrepareContext failed: %v\n", err)
+		Logf(ctx, "ERROR: PrepareContext failed: %v\n", err)
 		goto Rollback
 	}
 	defer stmt.Close()
@@ -113,33 +312,33 @@ func (usr *User) Save(ctx context.Context, db *sql.DB) error {
 	if usr.ID != 0 {
 		rslt, err = stmt.ExecContext(ctx, usr.Verified, usr.ID)
 		if err != nil {
-			log.Printf("ERROR: update failed: %v\n", err)
+			Logf(ctx, "ERROR: update failed: %v\n", err)
 			goto Rollback
 		}
 		cnt, err := rslt.RowsAffected()
 		if err != nil {
-			log.Printf("ERROR: RowsAffected() failed: %v\n", err)
+			Logf(ctx, "ERROR: RowsAffected() failed: %v\n", err)
 			goto Rollback
 		}
 		if cnt != 1 {
-			log.Printf("ERROR: Update affecting more than one row (%d) for user_id %d\n", cnt, usr.ID)
+			Logf(ctx, "ERROR: Update affecting more than one row (%d) for user_id %d\n", cnt, usr.ID)
 			goto Rollback
 		}
 	} else {
 		rslt, err = stmt.ExecContext(ctx, usr.Email, usr.Verified)
 		if err != nil {
-			log.Printf("ERROR: insert failed: %v\n", err)
+			Logf(ctx, "ERROR: insert failed: %v\n", err)
 			goto Rollback
 		}
 		usr.ID, err = rslt.LastInsertId()
 		if err != nil {
-			log.Printf("ERROR: failed to get user_id: %v\n", err)
+			Logf(ctx, "ERROR: failed to get user_id: %v\n", err)
 			goto Rollback
 		}
 	}
 	err = txn.Commit()
 	if err != nil {
-		log.Printf("ERROR: commit failed: %v\n", err)
+		Logf(ctx, "ERROR: commit failed: %v\n", err)
 	}
 	return err
 
@@ -147,7 +346,7 @@ Rollback:
 	rollbackErr := txn.Rollback()
 	if rollbackErr != nil {
 		// If rollback fails, we should just abort
-		log.Fatalf("ERROR: failed to rollback transaction on tuser '%v': '%v'", usr, rollbackErr)
+		fatalf(ctx, "ERROR: failed to rollback transaction on tuser '%v': '%v'", usr, rollbackErr)
 	}
 	return err
 }
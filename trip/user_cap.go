@@ -0,0 +1,204 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit focuses on the spend caps users set for themselves, and the
+// alerts raised when their share of the expenses crosses those caps.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	capSelect = `SELECT trip_id, amount FROM spend_cap WHERE user_id = ?
+ORDER BY trip_id`
+	capSelectForTrip = `SELECT trip_id, amount FROM spend_cap
+WHERE user_id = ? AND trip_id IN (0, ?)`
+	capUpsert = `INSERT INTO spend_cap (user_id, trip_id, amount) VALUES (?, ?, ?)
+ON CONFLICT (user_id, trip_id) DO UPDATE SET amount = excluded.amount`
+	capDelete = "DELETE FROM spend_cap WHERE user_id = ? AND trip_id = ?"
+
+	// monthlySpentSelect sums up the shares of a user in all the expenses,
+	// across trips, the deleted ones aside, with a transaction date in the
+	// given range
+	monthlySpentSelect = `SELECT COALESCE(SUM(share), 0) FROM (
+SELECT CAST(ROUND(SUM(ep.amount) * 1.0 / COUNT(ep.user_id)) AS INTEGER) AS share
+FROM expense AS e, expense_participant AS ep, trip AS t
+WHERE e.expense_id = ep.expense_id AND t.trip_id = e.trip_id AND t.deleted_at = 0
+AND e.txn_date >= ? AND e.txn_date < ?
+AND e.expense_id IN (SELECT expense_id FROM expense_participant WHERE user_id = ?)
+GROUP BY e.expense_id)`
+)
+
+// SpendCap is a threshold a user sets on their share of the expenses.
+type SpendCap struct {
+	// TripID is the trip the cap applies to, 0 means it's a monthly cap across all trips
+	TripID int64 `json:"trip_id"`
+	// Amount is the threshold (in cent)
+	Amount int `json:"amount"`
+}
+
+// SpendAlert is raised when the share of a user crosses one of their SpendCap
+type SpendAlert struct {
+	// Email is the email address of the user
+	Email string `json:"user"`
+	// Cap is the threshold that has been crossed
+	Cap SpendCap `json:"cap"`
+	// Spent is the share of the user after the crossing expense (in cent)
+	Spent int `json:"spent"`
+}
+
+// SpendAlertHook is called for every SpendAlert raised, with the context of
+// the Save() and the trip of the expenses causing it, after they have been
+// committed. The default only logs a warning, the server notifies the user.
+var SpendAlertHook = func(ctx context.Context, trip *Trip, alert SpendAlert) {
+	Logf(ctx, "WARNING: %s has spent %d against a cap of %d (trip_id %d)\n",
+		alert.Email, alert.Spent, alert.Cap.Amount, alert.Cap.TripID)
+}
+
+// LoadSpendCaps returns the list of SpendCap set by the given user
+func LoadSpendCaps(ctx context.Context, db *sql.DB, usr *User) ([]SpendCap, error) {
+	rows, err := db.QueryContext(ctx, capSelect, usr.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rslt := []SpendCap{}
+	for rows.Next() {
+		c := SpendCap{}
+		err = rows.Scan(&c.TripID, &c.Amount)
+		if err != nil {
+			return nil, err
+		}
+		rslt = append(rslt, c)
+	}
+	return rslt, rows.Err()
+}
+
+// SaveSpendCap sets a SpendCap for the given user. An amount of 0 removes the cap.
+func SaveSpendCap(ctx context.Context, db *sql.DB, usr *User, c SpendCap) error {
+	var err error
+	if c.Amount == 0 {
+		_, err = db.ExecContext(ctx, capDelete, usr.ID, c.TripID)
+	} else {
+		_, err = db.ExecContext(ctx, capUpsert, usr.ID, c.TripID, c.Amount)
+	}
+	return err
+}
+
+// share returns the amount each participant is responsible for in the expense,
+// rounded the same way as in Settle()
+func (expense *Expense) share() int {
+	if len(expense.Participants) == 0 {
+		return 0
+	}
+	return int(float64(expense.amount)/float64(len(expense.Participants)) + 0.5)
+}
+
+// monthOf returns the epoch range of the month the given date is in
+func monthOf(d Date) (int64, int64) {
+	start := time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Unix(), start.AddDate(0, 1, 0).Unix()
+}
+
+// checkSpendCaps computes the alerts raised by the newly inserted expenses.
+// Only the caps crossed by these expenses are reported, so that the same
+// alert isn't raised again by later expenses.
+//
+// The shares are recomputed rather than kept as running totals: the share
+// in the trip from its expenses, already loaded, and the monthly share by
+// a single query, only for the participants with a monthly cap. Running
+// totals would have to follow every change of the expenses, deleted,
+// restored or reassigned, and of the trips, deleted or purged, for a check
+// only the few users with a cap need.
+// It's expected to be executed within a transaction
+func (trip *Trip) checkSpendCaps(ctx context.Context, txn *sql.Tx, added []*Expense) ([]SpendAlert, error) {
+	if len(added) == 0 {
+		return nil, nil
+	}
+	isNew := make(map[*Expense]bool)
+	for _, e := range added {
+		isNew[e] = true
+	}
+
+	var rslt []SpendAlert
+	checked := make(map[int64]bool)
+	for _, e := range added {
+		for _, p := range e.Participants {
+			if checked[p.UserID] {
+				continue
+			}
+			checked[p.UserID] = true
+
+			rows, err := txn.QueryContext(ctx, capSelectForTrip, p.UserID, trip.ID)
+			if err != nil {
+				return nil, err
+			}
+			caps := []SpendCap{}
+			for rows.Next() {
+				c := SpendCap{}
+				err = rows.Scan(&c.TripID, &c.Amount)
+				if err != nil {
+					rows.Close()
+					return nil, err
+				}
+				caps = append(caps, c)
+			}
+			rows.Close()
+
+			for _, c := range caps {
+				var before, after int
+				if c.TripID != 0 {
+					before, after = trip.spent(p.UserID, isNew)
+				} else {
+					start, end := monthOf(e.Date)
+					err = txn.QueryRowContext(ctx, monthlySpentSelect, start, end, p.UserID).Scan(&after)
+					if err != nil {
+						return nil, err
+					}
+					before = after
+					for _, a := range added {
+						if a.Date.Unix() >= start && a.Date.Unix() < end && a.hasUser(p.UserID) {
+							before -= a.share()
+						}
+					}
+				}
+				if before < c.Amount && after >= c.Amount {
+					rslt = append(rslt, SpendAlert{p.Email, c, after})
+				}
+			}
+		}
+	}
+	return rslt, nil
+}
+
+// hasUser returns true if the user is one of the participants of the expense
+func (expense *Expense) hasUser(userID int64) bool {
+	for _, p := range expense.Participants {
+		if p.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// spent returns the share of the user in the trip, before and after the
+// new expenses
+func (trip *Trip) spent(userID int64, isNew map[*Expense]bool) (before, after int) {
+	for _, e := range trip.Expenses {
+		if !e.hasUser(userID) {
+			continue
+		}
+		if !isNew[e] {
+			before += e.share()
+		}
+		after += e.share()
+	}
+	return before, after
+}
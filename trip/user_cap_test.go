@@ -0,0 +1,118 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the spend caps.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	spendCapCreate = `CREATE TABLE IF NOT EXISTS spend_cap (
+user_id INTEGER NOT NULL,
+trip_id INTEGER NOT NULL DEFAULT 0,
+amount INTEGER NOT NULL,
+CONSTRAINT spend_cap_pkey PRIMARY KEY (user_id, trip_id))`
+	spendCapDrop = "DROP TABLE IF EXISTS spend_cap"
+)
+
+// TestSpendCaps sets a trip cap and a monthly cap for Fred, and checks
+// the alerts are raised only once, by the expense crossing them
+func TestSpendCaps(t *testing.T) {
+	ctx := context.Background()
+	var alerts []SpendAlert
+	defer func(hook func(context.Context, *Trip, SpendAlert)) { SpendAlertHook = hook }(SpendAlertHook)
+	SpendAlertHook = func(_ context.Context, _ *Trip, a SpendAlert) { alerts = append(alerts, a) }
+
+	trip4 := NewTrip("Trip 4", greg, "Trip 4 for testing", epochToDate(time.Now().Unix()), []string{fred})
+	err := trip4.Save(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufred := trip4.Participants[0]
+	err = SaveSpendCap(ctx, db, ufred, SpendCap{trip4.ID, 3000})
+	if err != nil {
+		t.Error(err)
+	}
+	// Fred is already part of other trips this month, a high cap
+	// keeps it out of the way until the last expense
+	err = SaveSpendCap(ctx, db, ufred, SpendCap{0, 1000000})
+	if err != nil {
+		t.Error(err)
+	}
+	caps, err := LoadSpendCaps(ctx, db, ufred)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(caps) != 2 {
+		t.Errorf("Fred should have 2 caps, got %d", len(caps))
+	}
+
+	now := NewDate(time.Now())
+	// Fred's share is 2000c, below the cap
+	err = trip4.AddExpense(now, "dinner", []Participant{{greg, 0, 4000}, {fred, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = trip4.Save(ctx, db)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(alerts) != 0 {
+		t.Errorf("No alert expected yet: %#v", alerts)
+	}
+	// Fred's share is now 3500c, over the cap
+	err = trip4.AddExpense(now, "lunch", []Participant{{greg, 0, 3000}, {fred, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = trip4.Save(ctx, db)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(alerts) != 1 || alerts[0].Email != fred || alerts[0].Spent != 3500 {
+		t.Errorf("Expect one alert for Fred at 3500c: %#v", alerts)
+	}
+	// Still over the cap, but no new alert
+	err = trip4.AddExpense(now, "coffee", []Participant{{greg, 0, 1000}, {fred, 0, 0}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = trip4.Save(ctx, db)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(alerts) != 1 {
+		t.Errorf("The trip cap alert should only be raised once: %#v", alerts)
+	}
+	// Fred pays for a big one, his share crosses the monthly cap
+	err = trip4.AddExpense(now, "lodging", []Participant{{greg, 0, 0}, {fred, 0, 2000000}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = trip4.Save(ctx, db)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(alerts) != 2 || alerts[1].Cap.TripID != 0 {
+		t.Errorf("Expect the monthly cap alert for Fred: %#v", alerts)
+	}
+	err = SaveSpendCap(ctx, db, ufred, SpendCap{trip4.ID, 0})
+	if err != nil {
+		t.Error(err)
+	}
+	caps, err = LoadSpendCaps(ctx, db, ufred)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(caps) != 1 {
+		t.Errorf("Fred should only have the monthly cap left, got %#v", caps)
+	}
+}
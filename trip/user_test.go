@@ -8,7 +8,13 @@ package trip
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -17,7 +23,12 @@ const (
 	tuserCreate = `CREATE TABLE IF NOT EXISTS tuser (
 user_id INTEGER CONSTRAINT user_pkey PRIMARY KEY AUTOINCREMENT,
 email VARCHAR(256) NOT NULL UNIQUE,
-verified BOOLEAN DEFAULT FALSE)`
+verified BOOLEAN DEFAULT FALSE,
+display_name VARCHAR(128) NOT NULL DEFAULT '',
+avatar VARCHAR(64) NOT NULL DEFAULT '',
+venmo VARCHAR(30) NOT NULL DEFAULT '',
+paypal_me VARCHAR(64) NOT NULL DEFAULT '',
+iban VARCHAR(34) NOT NULL DEFAULT '')`
 	tuserDrop = "DROP TABLE IF EXISTS tuser"
 
 	alice   = "alice@test.com"
@@ -69,3 +80,337 @@ func TestSave(t *testing.T) {
 		t.Error("Save() failed to update: Verified mismatch")
 	}
 }
+
+// TestDomainPolicy checks the new users are restricted to the accepted
+// email domains, while the existing users are still loaded
+func TestDomainPolicy(t *testing.T) {
+	ctx := context.Background()
+	udb := openTestDB(t)
+	_, err := LoadOrCreateUser(ctx, udb, "old@mailinator.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetDomainPolicy([]string{"Test.com", "corp.example"}, []string{"mailinator.com", "temp.corp.example"})
+	t.Cleanup(func() { SetDomainPolicy(nil, nil) })
+
+	tests := []struct {
+		email string
+		ok    bool
+	}{
+		{alice, true},
+		{"Bob@TEST.COM", true},
+		{"carol@eu.corp.example", true},
+		{"dave@temp.corp.example", false},
+		{"erin@gmail.com", false},
+		{"frank@nottest.com", false},
+		{"no-domain@", false},
+		{"old@mailinator.com", true},
+		{"new@mailinator.com", false},
+	}
+	for _, tt := range tests {
+		_, err := LoadOrCreateUser(ctx, udb, tt.email)
+		if tt.ok && err != nil {
+			t.Errorf("LoadOrCreateUser(%q) failed: %v", tt.email, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrEmailDomain) {
+			t.Errorf("Expect ErrEmailDomain for %q, got %v", tt.email, err)
+		}
+	}
+
+	// new participants are checked when the trip is saved
+	tr := NewTrip("Private", alice, "", epochToDate(0), []string{"guest@gmail.com"})
+	err = tr.Save(ctx, udb)
+	if !errors.Is(err, ErrEmailDomain) {
+		t.Errorf("Expect ErrEmailDomain saving a trip with guest@gmail.com, got %v", err)
+	}
+
+	SetDomainPolicy(nil, []string{"mailinator.com"})
+	_, err = LoadOrCreateUser(ctx, udb, "erin@gmail.com")
+	if err != nil {
+		t.Errorf("Expect any domain not blocked without allowlist: %v", err)
+	}
+}
+
+// TestLoadProfile counts the trips of the users, without creating the
+// unknown ones
+func TestLoadProfile(t *testing.T) {
+	ctx := context.Background()
+	pdb := openTestDB(t)
+	today := NewDate(time.Now())
+	for _, tr := range []*Trip{
+		NewTrip("Trip P1", alice, "", today, []string{bob}),
+		NewTrip("Trip P2", bob, "", today, []string{alice, charlie}),
+	} {
+		err := tr.Save(ctx, pdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []struct {
+		email       string
+		trips, owns int
+	}{
+		{"Alice@test.com", 2, 1},
+		{bob, 2, 1},
+		{charlie, 1, 0},
+	} {
+		p, err := LoadProfile(ctx, pdb, c.email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Email != normalizeEmail(c.email) || p.ID == 0 || p.Trips != c.trips || p.OwnedTrips != c.owns {
+			t.Errorf("Unexpected profile %+v of %s", p, c.email)
+		}
+	}
+	if _, err := LoadProfile(ctx, pdb, david); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, got %v", err)
+	}
+	if _, err := LoadProfile(ctx, pdb, david); err != sql.ErrNoRows {
+		t.Errorf("expected david not to be created, got %v", err)
+	}
+}
+
+// TestUpdateDisplayName sets the display names of some users, and checks
+// they're loaded with the trip and by LoadDisplayNames()
+func TestUpdateDisplayName(t *testing.T) {
+	ctx := context.Background()
+	ndb := openTestDB(t)
+	tr := NewTrip("Trip N", alice, "", NewDate(time.Now()), []string{bob, charlie})
+	err := tr.Save(ctx, ndb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := UpdateDisplayName(ctx, ndb, "Alice@test.com", "  Alice  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.DisplayName != "Alice" || p.Trips != 1 {
+		t.Errorf("Unexpected profile %+v", p)
+	}
+	_, err = UpdateDisplayName(ctx, ndb, bob, "Bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{strings.Repeat("b", maxDisplayName+1), "Bob\nSmith"} {
+		if _, err = UpdateDisplayName(ctx, ndb, bob, name); err == nil {
+			t.Errorf("expected the display name %q to be refused", name)
+		}
+	}
+	if _, err = UpdateDisplayName(ctx, ndb, david, "David"); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+
+	tr, err = LoadTripByID(ctx, ndb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Owner.DisplayName != "Alice" || tr.Participants[0].DisplayName != "Bob" || tr.Participants[1].DisplayName != "" {
+		t.Errorf("Unexpected display names %+v %+v", tr.Owner, tr.Participants)
+	}
+	names, err := LoadDisplayNames(ctx, ndb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, map[string]string{alice: "Alice", bob: "Bob"}) {
+		t.Errorf("Unexpected display names %v", names)
+	}
+
+	// an empty name removes it
+	p, err = UpdateDisplayName(ctx, ndb, bob, "")
+	if err != nil || p.DisplayName != "" {
+		t.Errorf("expected bob's display name to be removed, got %+v: %v", p, err)
+	}
+}
+
+// TestAvatars sets the avatars of some users, checks they're loaded with
+// the trip and by LoadAvatarURLs(), and their files are removed once no
+// user refers to them
+func TestAvatars(t *testing.T) {
+	ctx := context.Background()
+	adb := openTestDB(t)
+	dir := t.TempDir()
+	SetAvatarStore(dir, "https://trips.test.com/v1/avatars/")
+	t.Cleanup(func() { SetAvatarStore("", "") })
+	tr := NewTrip("Trip A", alice, "", NewDate(time.Now()), []string{bob, charlie})
+	err := tr.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := SetAvatar(ctx, adb, "Alice@test.com", strings.NewReader("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceSum := strings.TrimPrefix(p.AvatarURL, "https://trips.test.com/v1/avatars/")
+	if !avatarHash.MatchString(aliceSum) {
+		t.Fatalf("Unexpected avatar URL %s", p.AvatarURL)
+	}
+	bobProfile, err := SetAvatar(ctx, adb, bob, strings.NewReader("bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SetAvatar(ctx, adb, david, strings.NewReader("david")); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+
+	tr, err = LoadTripByID(ctx, adb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Owner.AvatarURL != p.AvatarURL || tr.Participants[0].AvatarURL != bobProfile.AvatarURL || tr.Participants[1].AvatarURL != "" {
+		t.Errorf("Unexpected avatars %+v %+v", tr.Owner, tr.Participants)
+	}
+	urls, err := LoadAvatarURLs(ctx, adb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(urls, map[string]string{alice: p.AvatarURL, bob: bobProfile.AvatarURL}) {
+		t.Errorf("Unexpected avatar URLs %v", urls)
+	}
+	a, err := OpenAvatar(ctx, adb, aliceSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	if _, err = OpenAvatar(ctx, adb, "../receipts"); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an invalid hash, got %v", err)
+	}
+
+	// charlie sharing alice's picture keeps its file as alice replaces it
+	_, err = SetAvatar(ctx, adb, charlie, strings.NewReader("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SetAvatar(ctx, adb, alice, strings.NewReader("alice again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(storedPath(dir, aliceSum)); err != nil {
+		t.Errorf("expected the file still used by charlie, got %v", err)
+	}
+	p, err = DeleteAvatar(ctx, adb, charlie)
+	if err != nil || p.AvatarURL != "" {
+		t.Errorf("expected charlie's avatar to be removed, got %+v: %v", p, err)
+	}
+	if _, err = os.Stat(storedPath(dir, aliceSum)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the file removed, got %v", err)
+	}
+	if _, err = OpenAvatar(ctx, adb, aliceSum); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a removed avatar, got %v", err)
+	}
+
+	// erasing bob removes their avatar too
+	bobSum := strings.TrimPrefix(bobProfile.AvatarURL, "https://trips.test.com/v1/avatars/")
+	_, err = EraseUser(ctx, adb, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(storedPath(dir, bobSum)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the file of the erased user removed, got %v", err)
+	}
+}
+
+func TestPaymentHandles(t *testing.T) {
+	ctx := context.Background()
+	adb := openTestDB(t)
+	tr := NewTrip("Trip A", alice, "", NewDate(time.Now()), []string{bob, charlie})
+	err := tr.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := UpdatePaymentHandles(ctx, adb, "Alice@test.com", PaymentHandles{
+		Venmo:    "@alice-test",
+		PayPalMe: "www.PayPal.me/AliceTest/",
+		IBAN:     "gb82 west 1234 5698 7654 32",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceHandles := PaymentHandles{Venmo: "alice-test", PayPalMe: "https://paypal.me/AliceTest", IBAN: "GB82WEST12345698765432"}
+	if p.PaymentHandles != aliceHandles {
+		t.Errorf("Unexpected payment handles %+v", p.PaymentHandles)
+	}
+	_, err = UpdatePaymentHandles(ctx, adb, bob, PaymentHandles{PayPalMe: "https://paypal.me/bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UpdatePaymentHandles(ctx, adb, david, PaymentHandles{Venmo: "david"}); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+	for _, h := range []PaymentHandles{
+		{Venmo: "bob"},
+		{Venmo: "bob the builder"},
+		{PayPalMe: "https://example.com/bob"},
+		{PayPalMe: "paypal.me/bob/pay"},
+		{IBAN: "GB83WEST12345698765432"},
+		{IBAN: "GB82"},
+	} {
+		if _, err = UpdatePaymentHandles(ctx, adb, bob, h); err == nil {
+			t.Errorf("expected %+v to be refused", h)
+		}
+	}
+
+	handles, err := LoadPaymentHandles(ctx, adb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]PaymentHandles{alice: aliceHandles, bob: {PayPalMe: "https://paypal.me/bob"}}
+	if !reflect.DeepEqual(handles, expected) {
+		t.Errorf("Unexpected payment handles %v", handles)
+	}
+
+	// clearing the handles
+	p, err = UpdatePaymentHandles(ctx, adb, alice, PaymentHandles{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.PaymentHandles != (PaymentHandles{}) {
+		t.Errorf("expected no payment handles, got %+v", p.PaymentHandles)
+	}
+	s := Settlement{charlie: {bob: 10, alice: 0}}
+	if payees := s.Payees(); !reflect.DeepEqual(payees, []string{bob}) {
+		t.Errorf("Unexpected payees %v", payees)
+	}
+
+	other := NewTrip("Trip B", david, "", NewDate(time.Now()), []string{elise})
+	err = other.Save(ctx, adb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		email, other string
+		want         bool
+	}{
+		{charlie, "Alice@test.com", true},
+		{bob, charlie, true},
+		{david, alice, false},
+		{elise, david, true},
+		{"nobody@test.com", alice, false},
+	} {
+		shared, err := SharesTrip(ctx, adb, c.email, c.other)
+		if err != nil || shared != c.want {
+			t.Errorf("SharesTrip(%s, %s) = %v, %v, want %v", c.email, c.other, shared, err, c.want)
+		}
+	}
+}
+
+func TestSettlementPaymentLinks(t *testing.T) {
+	handles := map[string]PaymentHandles{
+		alice: {Venmo: "alice-test", PayPalMe: "https://paypal.me/AliceTest", IBAN: "GB82WEST12345698765432"},
+		bob:   {PayPalMe: "https://paypal.me/bob"},
+	}
+	s := Settlement{charlie: {alice: 2050, bob: 5, david: 100}, bob: {alice: 0}}
+	links := s.PaymentLinks(handles, "Ski & Sun")
+	expected := map[string]map[string]PaymentLinks{
+		charlie: {
+			alice: {
+				Venmo:  "venmo://paycharge?amount=20.50&note=Ski+%26+Sun&recipients=alice-test&txn=pay",
+				PayPal: "https://paypal.me/AliceTest/20.50",
+				Payto:  "payto://iban/GB82WEST12345698765432?message=Ski+%26+Sun",
+			},
+			bob: {PayPal: "https://paypal.me/bob/0.05"},
+		},
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("Unexpected payment links %v", links)
+	}
+}
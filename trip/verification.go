@@ -0,0 +1,143 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the verification of the email addresses of the
+// users. A secret is mailed to the address, and presenting it back before
+// it expires proves the user receives the emails of the address. Like for
+// the API tokens, only the SHA-256 hash of the secret is stored.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	verificationInsert = `INSERT INTO email_verification (token_hash, user_id, created_at, expires_at)
+VALUES (?, ?, ?, ?)`
+	verificationSelect = `SELECT v.user_id, u.email, v.expires_at
+FROM email_verification AS v, tuser AS u
+WHERE u.user_id = v.user_id AND v.token_hash = ?`
+	verificationDelete        = "DELETE FROM email_verification WHERE user_id = ?"
+	verificationExpiredDelete = "DELETE FROM email_verification WHERE expires_at <= ?"
+)
+
+var (
+	// ErrAlreadyVerified is returned when asking to verify an email
+	// address already verified
+	ErrAlreadyVerified = errors.New("email address already verified")
+	// ErrVerificationExpired is returned when verifying with a secret past
+	// its expiry
+	ErrVerificationExpired = errors.New("verification link has expired")
+)
+
+// Verification is a pending verification of the email address of a user
+type Verification struct {
+	Email string `json:"email"`
+	// Secret is what's mailed to the user, only known when issued
+	Secret    string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IssueVerification starts the verification of the email address of the
+// user, valid for the given duration, replacing the pending one if any.
+// sql.ErrNoRows is returned if there's no such user, they aren't created,
+// and ErrAlreadyVerified if the address is verified already.
+func IssueVerification(ctx context.Context, db *sql.DB, email string, ttl time.Duration) (*Verification, error) {
+	usr := NewUser(email)
+	err := db.QueryRowContext(ctx, userSelect, usr.Email).Scan(&usr.ID, &usr.Verified, &usr.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	if usr.Verified {
+		return nil, ErrAlreadyVerified
+	}
+	return issueVerification(ctx, db, usr, ttl)
+}
+
+// issueVerification issues a secret proving the user receives the emails
+// of their address, replacing the pending one if any
+func issueVerification(ctx context.Context, db *sql.DB, usr *User, ttl time.Duration) (*Verification, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	v := &Verification{Email: usr.Email, Secret: secret, ExpiresAt: now.Add(ttl)}
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = txn.ExecContext(ctx, verificationDelete, usr.ID)
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, verificationExpiredDelete, now.UnixMicro())
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, verificationInsert, hashSecret(secret), usr.ID, now.UnixMicro(), v.ExpiresAt.UnixMicro())
+	if err != nil {
+		goto Rollback
+	}
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Issued the verification of %s, expiring at %s\n", v.Email, v.ExpiresAt.Format(time.RFC3339))
+	return v, nil
+
+Rollback:
+	if rollbackErr := txn.Rollback(); rollbackErr != nil {
+		fatalf(ctx, "ERROR: IssueVerification() failed to rollback transaction: '%v'\n", rollbackErr)
+	}
+	return nil, err
+}
+
+// VerifyEmail marks the email address of the user the secret was issued
+// to as verified, and returns their profile. The secret can't be used again.
+// sql.ErrNoRows is returned for an unknown secret, and
+// ErrVerificationExpired for one past its expiry.
+func VerifyEmail(ctx context.Context, db *sql.DB, secret string) (*Profile, error) {
+	usr := new(User)
+	var expiresAt int64
+	err := db.QueryRowContext(ctx, verificationSelect, hashSecret(secret)).Scan(&usr.ID, &usr.Email, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if !Now().Before(time.UnixMicro(expiresAt)) {
+		return nil, ErrVerificationExpired
+	}
+	usr.Verified = true
+
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = txn.ExecContext(ctx, userUpdateVerified, usr.Verified, usr.ID)
+	if err != nil {
+		goto Rollback
+	}
+	_, err = txn.ExecContext(ctx, verificationDelete, usr.ID)
+	if err != nil {
+		goto Rollback
+	}
+	err = txn.Commit()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Verified the email address of %s\n", usr.Email)
+	return LoadProfile(ctx, db, usr.Email)
+
+Rollback:
+	if rollbackErr := txn.Rollback(); rollbackErr != nil {
+		fatalf(ctx, "ERROR: VerifyEmail() failed to rollback transaction: '%v'\n", rollbackErr)
+	}
+	return nil, err
+}
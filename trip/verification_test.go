@@ -0,0 +1,84 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the verification of the email
+// addresses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	emailVerificationCreate = `CREATE TABLE IF NOT EXISTS email_verification (
+token_hash CHAR(64) CONSTRAINT email_verification_pkey PRIMARY KEY,
+user_id INTEGER NOT NULL,
+created_at INTEGER NOT NULL,
+expires_at INTEGER NOT NULL)`
+)
+
+// TestVerifyEmail issues the verifications of an address, checks the
+// replaced and expired ones are refused, and verifies it
+func TestVerifyEmail(t *testing.T) {
+	ctx := context.Background()
+	vdb := openTestDB(t)
+	clock := NewFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), time.Second)
+	SetClock(clock.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	_, err := IssueVerification(ctx, vdb, "nobody@test.com", time.Hour)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown user, got %v", err)
+	}
+	_, err = LoadOrCreateUser(ctx, vdb, charlie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := IssueVerification(ctx, vdb, charlie, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	_, err = VerifyEmail(ctx, vdb, expired.Secret)
+	if err != ErrVerificationExpired {
+		t.Errorf("expected ErrVerificationExpired, got %v", err)
+	}
+
+	first, err := IssueVerification(ctx, vdb, "Charlie@test.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := IssueVerification(ctx, vdb, charlie, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Email != charlie || second.Secret == first.Secret {
+		t.Errorf("Unexpected verification %+v", second)
+	}
+	_, err = VerifyEmail(ctx, vdb, first.Secret)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for a replaced verification, got %v", err)
+	}
+	p, err := VerifyEmail(ctx, vdb, second.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Email != charlie || !p.Verified {
+		t.Errorf("Unexpected profile %+v", p.User)
+	}
+	_, err = VerifyEmail(ctx, vdb, second.Secret)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows verifying twice, got %v", err)
+	}
+	_, err = IssueVerification(ctx, vdb, charlie, time.Hour)
+	if err != ErrAlreadyVerified {
+		t.Errorf("expected ErrAlreadyVerified, got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit versions the trips for optimistic concurrency. Each change of
+// a trip increments its version, which is exposed as an entity tag, so
+// that a client can make a change conditional on the trip being as it saw
+// it, instead of silently overwriting the changes made in the meantime.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Some global constants used to store SQL statements
+const (
+	tripVersionUpdate = `UPDATE trip SET version = version + 1
+WHERE trip_id = ? AND version = ?`
+)
+
+// ErrTripModified is returned when a trip was changed since the version
+// the change was based on
+var ErrTripModified = errors.New("the trip was modified since it was read")
+
+// ETag returns the entity tag of the current version of the trip, as
+// used in the ETag and If-Match HTTP headers
+func (trip *Trip) ETag() string {
+	return `"` + strconv.FormatInt(trip.ID, 10) + "." + strconv.FormatInt(trip.Version, 10) + `"`
+}
+
+// MatchETag evaluates the value of an If-Match HTTP header against the
+// trip: "*" or any of the listed entity tags must be the one of the trip.
+// The weak entity tags never match, per RFC 9110.
+func (trip *Trip) MatchETag(ifMatch string) bool {
+	etag := trip.ETag()
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// bumpVersion increments the version of an existing trip, ErrTripModified
+// is returned if the trip isn't at the version it was loaded with anymore.
+// It's expected to be executed within the transaction changing the trip.
+func (trip *Trip) bumpVersion(ctx context.Context, txn *sql.Tx) error {
+	rslt, err := txn.ExecContext(ctx, tripVersionUpdate, trip.ID, trip.Version)
+	if err != nil {
+		return err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if cnt != 1 {
+		return ErrTripModified
+	}
+	return nil
+}
+
+// UpdateTripIfMatch is UpdateTrip() for a change based on a known version
+// of the trip, given as the value of an If-Match HTTP header. The update
+// isn't applied, and ErrTripModified is returned, if the trip doesn't
+// match. An empty ifMatch applies the update unconditionally.
+func UpdateTripIfMatch(ctx context.Context, db *sql.DB, tripID int64, ifMatch string, update func(*Trip) error) (*Trip, error) {
+	if ifMatch == "" {
+		return UpdateTrip(ctx, db, tripID, update)
+	}
+	return UpdateTrip(ctx, db, tripID, func(trip *Trip) error {
+		if !trip.MatchETag(ifMatch) {
+			return ErrTripModified
+		}
+		return update(trip)
+	})
+}
@@ -0,0 +1,85 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the trip versions.
+
+package trip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestTripVersion checks each change increments the version of a trip,
+// and the changes based on a stale version are rejected
+func TestTripVersion(t *testing.T) {
+	ctx := context.Background()
+	vdb := openTestDB(t)
+	today := epochToDate(time.Now().Unix())
+	tr := NewTrip("Trip V", alice, "", today, []string{bob})
+	err := tr.Save(ctx, vdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Version != 1 {
+		t.Fatalf("version of a new trip: expected 1, got %d", tr.Version)
+	}
+	stale, err := LoadTripByID(ctx, vdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := stale.ETag()
+
+	tr2, err := UpdateTripIfMatch(ctx, vdb, tr.ID, etag, func(t *Trip) error {
+		return t.AddExpense(today, "dinner", []Participant{{alice, 0, 100}, {bob, 0, 0}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr2.Version != 2 || tr2.ETag() == etag {
+		t.Errorf("version after a change: expected 2, got %d (%s)", tr2.Version, tr2.ETag())
+	}
+
+	_, err = UpdateTripIfMatch(ctx, vdb, tr.ID, etag, func(t *Trip) error {
+		return t.Rename("Trip W")
+	})
+	if err != ErrTripModified {
+		t.Errorf("change based on a stale version: expected ErrTripModified, got %v", err)
+	}
+	err = stale.Rename("Trip W")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stale.Save(ctx, vdb)
+	if err != ErrTripModified {
+		t.Errorf("save of a stale copy: expected ErrTripModified, got %v", err)
+	}
+
+	tr2, err = UpdateTripIfMatch(ctx, vdb, tr.ID, "*", func(t *Trip) error {
+		return t.SetDescription("any version")
+	})
+	if err != nil {
+		t.Fatalf("If-Match *: %v", err)
+	}
+	tr2, err = UpdateTripIfMatch(ctx, vdb, tr.ID, `"0.0", `+tr2.ETag(), func(t *Trip) error {
+		return t.SetDescription("listed version")
+	})
+	if err != nil {
+		t.Fatalf("If-Match with a list: %v", err)
+	}
+	_, err = tr2.Complete(ctx, vdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr3, err := LoadTripByID(ctx, vdb, tr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr3.Version != 5 || tr3.Version != tr2.Version || tr3.Name != "Trip V" {
+		t.Errorf("expected Trip V at version 5, got %s at version %d (in memory %d)", tr3.Name, tr3.Version, tr2.Version)
+	}
+}
@@ -0,0 +1,286 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the voice notes attached to the expenses, e.g. a
+// few words recorded at the table rather than typed. The audio files are
+// stored like the receipts, by the SHA-256 of their content, and a speech
+// to text provider may transcribe them. The expenses being immutable, the
+// transcript of a note attached later is kept with the note; a note
+// recorded first drafts the expense, see DictateExpense().
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Some global constants used to store SQL statements
+const (
+	voiceNoteInsert = `INSERT INTO voice_note (trip_id, expense_id, sha256, content_type, filename, size, transcript, uploaded_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	voiceNotesSelect = `SELECT voice_note_id, trip_id, expense_id, sha256, content_type, filename, size, transcript, uploaded_at
+FROM voice_note WHERE trip_id = ? AND expense_id = ?`
+	voiceNoteOrder = "\nORDER BY voice_note_id"
+	voiceNoteByID  = "\nAND voice_note_id = ?"
+	voiceNoteMove  = "UPDATE voice_note SET expense_id = ? WHERE trip_id = ? AND expense_id = ?"
+)
+
+// maxDictatedDescription is the length, in characters, of the description
+// of an expense dictated, the rest of the transcript is left to the notes
+const maxDictatedDescription = 80
+
+// ErrNoSpeech is returned when a voice note is to be transcribed but no
+// speech to text provider is set
+var ErrNoSpeech = errors.New("no speech to text provider to transcribe the voice notes")
+
+// SpeechToText transcribes the audio of a voice note
+type SpeechToText interface {
+	Transcribe(ctx context.Context, r io.Reader) (string, error)
+}
+
+// CommandSpeech is a speech to text provider running a command, with its
+// arguments, reading the audio on its standard input and writing the text
+// on its standard output, e.g. a wrapper of whisper.cpp:
+//
+//	CommandSpeech{"transcribe", "--language", "auto", "-"}
+type CommandSpeech []string
+
+// Transcribe is part of the SpeechToText interface
+func (cmd CommandSpeech) Transcribe(ctx context.Context, r io.Reader) (string, error) {
+	if len(cmd) == 0 {
+		return "", errors.New("no speech to text command")
+	}
+	var stdout, stderr bytes.Buffer
+	c := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	c.Stdin = r
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	err := c.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", cmd[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// speechToText is the provider transcribing the voice notes, see
+// SetSpeechToText()
+var speechToText SpeechToText
+
+// SetSpeechToText sets the provider transcribing the voice notes, nil turns
+// the transcription off. It's meant to be called before serving any
+// request.
+func SetSpeechToText(s SpeechToText) {
+	speechToText = s
+}
+
+// VoiceNote is an audio file attached to an expense
+type VoiceNote struct {
+	// ID is the primary key and is from a sequence
+	ID int64 `json:"voice_note_id"`
+	// TripID and ExpenseID are the expense the note is attached to
+	TripID    int64 `json:"trip_id"`
+	ExpenseID int64 `json:"expense_id"`
+	// SHA256 is the hex encoded hash of the content, which names the file
+	SHA256 string `json:"sha256"`
+	// ContentType is the media type of the content, e.g. audio/mpeg
+	ContentType string `json:"content_type"`
+	// Filename is the name of the file uploaded
+	Filename string `json:"filename"`
+	// Size is the size of the content in bytes
+	Size int64 `json:"size"`
+	// Transcript is the text of the note, empty if it wasn't transcribed
+	Transcript string `json:"transcript"`
+	// UploadedAt is when the note was attached
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// AttachVoiceNote stores the audio read from r, and attaches it to the
+// expense of the trip, transcribed if asked to. sql.ErrNoRows is returned
+// if the expense isn't one of the trip, ErrTripArchived if the trip is
+// archived, and ErrNoSpeech if it's to be transcribed without a provider.
+func AttachVoiceNote(ctx context.Context, db *sql.DB, tripID, expenseID int64, filename, contentType string, r io.Reader, transcribe bool) (*VoiceNote, error) {
+	if receiptDir == "" {
+		return nil, errors.New("no directory for the voice notes, see SetReceiptDir()")
+	}
+	if transcribe && speechToText == nil {
+		return nil, ErrNoSpeech
+	}
+	var archivedAt int64
+	err := db.QueryRowContext(ctx, receiptTripArchivedSelect, expenseID, tripID).Scan(&archivedAt)
+	if err != nil {
+		return nil, err
+	}
+	if archivedAt != 0 {
+		return nil, ErrTripArchived
+	}
+	vn := &VoiceNote{
+		TripID:      tripID,
+		ExpenseID:   expenseID,
+		ContentType: contentType,
+		Filename:    filepath.Base(filename),
+		UploadedAt:  Now().UTC().Truncate(time.Microsecond),
+	}
+	vn.SHA256, vn.Size, err = storeFile(receiptDir, r)
+	if err != nil {
+		return nil, err
+	}
+	if transcribe {
+		// the audio is transcribed from the file stored, the upload can't
+		// be read twice
+		vn.Transcript, err = vn.transcribe(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rslt, err := db.ExecContext(ctx, voiceNoteInsert, tripID, expenseID, vn.SHA256, vn.ContentType,
+		vn.Filename, vn.Size, vn.Transcript, vn.UploadedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	vn.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Attached voice note %d (%s, %d bytes) to expense %d of trip %d\n",
+		vn.ID, vn.SHA256, vn.Size, expenseID, tripID)
+	return vn, nil
+}
+
+// transcribe returns the text of the file of the note
+func (vn *VoiceNote) transcribe(ctx context.Context) (string, error) {
+	f, err := vn.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return speechToText.Transcribe(ctx, f)
+}
+
+// queryVoiceNotes runs the given voice note query
+func queryVoiceNotes(ctx context.Context, db *sql.DB, query string, args ...any) ([]*VoiceNote, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*VoiceNote{}
+	for rows.Next() {
+		vn := new(VoiceNote)
+		var uploadedAt int64
+		err = rows.Scan(&vn.ID, &vn.TripID, &vn.ExpenseID, &vn.SHA256, &vn.ContentType,
+			&vn.Filename, &vn.Size, &vn.Transcript, &uploadedAt)
+		if err != nil {
+			return nil, err
+		}
+		vn.UploadedAt = time.UnixMicro(uploadedAt).UTC()
+		rslt = append(rslt, vn)
+	}
+	return rslt, rows.Err()
+}
+
+// LoadVoiceNotes returns the voice notes of an expense, in the order they
+// were attached. Like the receipts, the notes of a deleted expense are
+// kept. sql.ErrNoRows is returned if the expense was never one of the
+// trip.
+func LoadVoiceNotes(ctx context.Context, db *sql.DB, tripID, expenseID int64) ([]*VoiceNote, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, receiptExpenseSelect, expenseID, tripID, expenseID, tripID).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	return queryVoiceNotes(ctx, db, voiceNotesSelect+voiceNoteOrder, tripID, expenseID)
+}
+
+// LoadVoiceNote returns a voice note of an expense. sql.ErrNoRows is
+// returned if there's no such note.
+func LoadVoiceNote(ctx context.Context, db *sql.DB, tripID, expenseID, voiceNoteID int64) (*VoiceNote, error) {
+	rslt, err := queryVoiceNotes(ctx, db, voiceNotesSelect+voiceNoteByID, tripID, expenseID, voiceNoteID)
+	if err != nil {
+		return nil, err
+	}
+	if len(rslt) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return rslt[0], nil
+}
+
+// Open opens the file of the voice note for reading
+func (vn *VoiceNote) Open() (*os.File, error) {
+	return os.Open(receiptPath(vn.SHA256))
+}
+
+// Dictation is what was heard in a voice note recorded to enter an
+// expense
+type Dictation struct {
+	// Transcript is the whole text of the note
+	Transcript string `json:"transcript"`
+	// Description is the first sentence of the note, shortened
+	Description string `json:"description"`
+	// Amount is the largest amount said, in cent, 0 if none
+	Amount int `json:"amount"`
+	// Date is the date said, zeroTime if none
+	Date Date `json:"date"`
+	// Confidence is how sure the dictation is of the amount and the date,
+	// in percent, see scanConfidence()
+	Confidence int `json:"confidence"`
+}
+
+// DictateExpense transcribes the audio of a voice note recorded to enter
+// an expense, and picks its description, its amount and its date, as
+// ScanReceipt() does for a picture. ErrNoSpeech is returned if no provider
+// is set.
+func DictateExpense(ctx context.Context, r io.Reader) (*Dictation, error) {
+	if speechToText == nil {
+		return nil, ErrNoSpeech
+	}
+	text, err := speechToText.Transcribe(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	amount, isTotal := scanReceiptAmount(text)
+	date := scanReceiptDate(text)
+	return &Dictation{
+		Transcript:  text,
+		Description: dictatedDescription(text),
+		Amount:      amount,
+		Date:        date,
+		Confidence:  scanConfidence(amount, isTotal, date),
+	}, nil
+}
+
+// dictatedDescription returns the first sentence, or line, of the text,
+// shortened to maxDictatedDescription characters
+func dictatedDescription(text string) string {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexAny(text, ".!?\n"); i > 0 {
+		// a decimal point isn't the end of a sentence
+		for i > 0 && text[i] == '.' && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9' {
+			j := strings.IndexAny(text[i+1:], ".!?\n")
+			if j < 0 {
+				i = -1
+				break
+			}
+			i += 1 + j
+		}
+		if i > 0 {
+			text = text[:i]
+		}
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > maxDictatedDescription {
+		text = strings.TrimSpace(string([]rune(text)[:maxDictatedDescription-1])) + "…"
+	}
+	return text
+}
@@ -0,0 +1,170 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the voice notes of the expenses.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	voiceNoteCreate = `CREATE TABLE IF NOT EXISTS voice_note (
+voice_note_id INTEGER CONSTRAINT voice_note_pkey PRIMARY KEY AUTOINCREMENT,
+trip_id INTEGER NOT NULL,
+expense_id INTEGER NOT NULL,
+sha256 CHAR(64) NOT NULL,
+content_type VARCHAR(128) NOT NULL,
+filename VARCHAR(256) NOT NULL,
+size INTEGER NOT NULL,
+transcript TEXT NOT NULL DEFAULT '',
+uploaded_at INTEGER NOT NULL)`
+	voiceNoteExpenseIndex = "CREATE INDEX IF NOT EXISTS voice_note_expense_index ON voice_note(trip_id, expense_id)"
+	voiceNoteSHA256Index  = "CREATE INDEX IF NOT EXISTS voice_note_sha256_index ON voice_note(sha256)"
+)
+
+// fakeSpeech transcribes the audio as its own text
+type fakeSpeech struct{}
+
+// Transcribe is part of the SpeechToText interface
+func (fakeSpeech) Transcribe(_ context.Context, r io.Reader) (string, error) {
+	b, err := io.ReadAll(r)
+	return strings.TrimSpace(strings.TrimPrefix(string(b), "RIFF")), err
+}
+
+// TestVoiceNotes attaches a voice note to an expense, transcribed or not,
+// checks the file is shared with a receipt of the same content, and
+// removed once the trip is purged
+func TestVoiceNotes(t *testing.T) {
+	ctx := context.Background()
+	vdb := openTestDB(t)
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	SetReceiptDir(t.TempDir())
+	t.Cleanup(func() {
+		SetClock(nil)
+		SetReceiptDir("")
+		SetSpeechToText(nil)
+	})
+
+	tr := NewTrip("Trip V", alice, "", NewDate(start), []string{bob})
+	err := tr.Save(ctx, vdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(start), "dinner", []Participant{{alice, 0, 4000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Save(ctx, vdb); err != nil {
+		t.Fatal(err)
+	}
+	e := tr.Expenses[0]
+	const content = "RIFF pizza for two, 40.00"
+	_, err = AttachVoiceNote(ctx, vdb, tr.ID, e.ID, "note.wav", "audio/wave", strings.NewReader(content), true)
+	if err != ErrNoSpeech {
+		t.Errorf("expected ErrNoSpeech, got %v", err)
+	}
+	plain, err := AttachVoiceNote(ctx, vdb, tr.ID, e.ID, "note.wav", "audio/wave", strings.NewReader(content), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSpeechToText(fakeSpeech{})
+	heard, err := AttachVoiceNote(ctx, vdb, tr.ID, e.ID, "../note.wav", "audio/wave", strings.NewReader(content), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Transcript != "" || heard.Transcript != "pizza for two, 40.00" || heard.Filename != "note.wav" || heard.SHA256 != plain.SHA256 {
+		t.Errorf("Unexpected voice notes: %+v, %+v", plain, heard)
+	}
+	if _, err = AttachVoiceNote(ctx, vdb, tr.ID+1, e.ID, "note.wav", "audio/wave", strings.NewReader(content), false); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an expense of another trip, got %v", err)
+	}
+	// a receipt of the same content shares the file
+	if _, err = AttachReceipt(ctx, vdb, tr.ID, e.ID, "note.wav", "audio/wave", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := LoadVoiceNotes(ctx, vdb, tr.ID, e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || *list[1] != *heard {
+		t.Errorf("Unexpected voice notes of expense %d: %v", e.ID, list)
+	}
+	vn, err := LoadVoiceNote(ctx, vdb, tr.ID, e.ID, plain.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := vn.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(got) != content {
+		t.Errorf("Unexpected content %q, %v", got, err)
+	}
+	if _, err = LoadVoiceNote(ctx, vdb, tr.ID, e.ID+1, plain.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for the note of another expense, got %v", err)
+	}
+
+	if _, err = tr.Complete(ctx, vdb); err != nil {
+		t.Fatal(err)
+	}
+	fc.Advance(3 * 365 * 24 * time.Hour)
+	plan, err := PlanPurge(ctx, vdb, RetentionPolicy{TripYears: 2, HistoryMonths: 6}, Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Purge(ctx, vdb, plan); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vn.Open(); !os.IsNotExist(err) {
+		t.Errorf("expected the voice note file to be removed, got %v", err)
+	}
+}
+
+// TestDictateExpense picks the description, the amount and the date of a
+// dictated expense
+func TestDictateExpense(t *testing.T) {
+	ctx := context.Background()
+	if _, err := DictateExpense(ctx, strings.NewReader("taxi")); err != ErrNoSpeech {
+		t.Errorf("expected ErrNoSpeech, got %v", err)
+	}
+	SetSpeechToText(fakeSpeech{})
+	t.Cleanup(func() { SetSpeechToText(nil) })
+
+	for _, c := range []struct {
+		said, description string
+		amount            int
+		date              string
+	}{
+		{"Taxi to the airport 32.50 on 2026-10-14. Bob was asleep.", "Taxi to the airport 32.50 on 2026-10-14", 3250, "2026-10-14"},
+		{"groceries\nbread, cheese and wine 18,20", "groceries", 1820, ""},
+		{strings.Repeat("very ", 20) + "long", strings.TrimSpace(strings.Repeat("very ", 16)) + "…", 0, ""},
+	} {
+		d, err := DictateExpense(ctx, strings.NewReader(c.said))
+		if err != nil {
+			t.Fatal(err)
+		}
+		date := ""
+		if !d.Date.Equal(zeroTime) {
+			date = d.Date.Format(time.DateOnly)
+		}
+		if d.Transcript != c.said || d.Description != c.description || d.Amount != c.amount || date != c.date {
+			t.Errorf("Unexpected dictation of %q: %+v", c.said, d)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements the webhooks: external systems subscribe to the
+// events of the trips, which are queued in the same transaction as the
+// change and POSTed to them by DeliverWebhooks(), until they're accepted.
+
+package trip
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Some global constants used to store SQL statements
+const (
+	webhookInsert = `INSERT INTO webhook (trip_id, url, events, secret, created_at)
+VALUES (?, ?, ?, ?, ?)`
+	webhooksSelect     = "SELECT webhook_id, trip_id, url, events, created_at FROM webhook ORDER BY webhook_id"
+	webhookDelete      = "DELETE FROM webhook WHERE webhook_id = ?"
+	webhookDeliveryDel = "DELETE FROM webhook_delivery WHERE webhook_id = ?"
+	webhooksOfTrip     = "SELECT webhook_id, events FROM webhook WHERE trip_id = 0 OR trip_id = ?"
+	deliveryInsert     = `INSERT INTO webhook_delivery (webhook_id, trip_id, event, payload, created_at, next_attempt_at)
+VALUES (?, ?, ?, ?, ?, ?)`
+	deliveriesDue = `SELECT d.delivery_id, d.event, d.payload, d.attempts, w.url, w.secret
+FROM webhook_delivery AS d, webhook AS w
+WHERE w.webhook_id = d.webhook_id
+AND d.next_attempt_at <= ?
+ORDER BY d.delivery_id
+LIMIT ?`
+	deliveryDelete = "DELETE FROM webhook_delivery WHERE delivery_id = ?"
+	deliveryRetry  = `UPDATE webhook_delivery SET attempts = ?, next_attempt_at = ?, last_error = ?
+WHERE delivery_id = ?`
+)
+
+// The events of the trips sent to the webhooks
+const (
+	EventTripCreated   = "trip.created"
+	EventExpenseAdded  = "expense.added"
+	EventTripCompleted = "trip.completed"
+)
+
+// Events are the events a webhook can subscribe to
+var Events = []string{EventTripCreated, EventExpenseAdded, EventTripCompleted, EventTripDigest}
+
+const (
+	// webhookAttempts is the number of attempts to deliver an event
+	// before giving up on it
+	webhookAttempts = 8
+	// webhookBackoff is the delay before the 2nd attempt, doubled for
+	// each attempt after
+	webhookBackoff = 30 * time.Second
+	// webhookBatch is the number of deliveries attempted by a pass of
+	// DeliverWebhooks()
+	webhookBatch = 100
+)
+
+// webhookQueued is signaled when events are queued, see WebhooksQueued()
+var webhookQueued = make(chan struct{}, 1)
+
+// Webhook is the subscription of a URL to events of the trips
+type Webhook struct {
+	// ID is the primary key and is from a sequence
+	ID int64 `json:"webhook_id"`
+	// TripID is the trip of the events, 0 for all the trips
+	TripID int64 `json:"trip_id"`
+	// URL is where the events are POSTed
+	URL string `json:"url"`
+	// Events are the names of the events subscribed to
+	Events []string `json:"events"`
+	// Secret is the key of the signature of the events, only returned by
+	// CreateWebhook()
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookEvent is the JSON body POSTed to a webhook
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	TripID    int64     `json:"trip_id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Data is a webhookTrip for trip.created, the Expense for
+	// expense.added, a webhookSettlement for trip.completed, and the
+	// TripDigest for trip.digest
+	Data any `json:"data"`
+	// Summary is where the trip stands after the change, for the receivers
+	// to tell it without calling back the API, the digests aside
+	Summary *TripSummary `json:"summary,omitempty"`
+}
+
+// CategoryKey is the key of the metadata of the expenses holding their
+// category, see TripSummary
+const CategoryKey = "category"
+
+// TripSummary is a compact summary of the expenses of a trip
+type TripSummary struct {
+	// Total is the total of the expenses (in cent)
+	Total int `json:"total"`
+	// Balances are the Net of the Balance of each participant, positive
+	// when they're owed money (in cent)
+	Balances map[string]int `json:"balances"`
+	// TopCategory is the category of the expenses with the largest
+	// total, from their metadata, empty if none has one
+	TopCategory string `json:"top_category,omitempty"`
+}
+
+// webhookTrip is the data of the trip.created events
+type webhookTrip struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	Owner        string   `json:"owner"`
+	Participants []string `json:"participants"`
+	StartDate    Date     `json:"start_date"`
+}
+
+// webhookSettlement is the data of the trip.completed events
+type webhookSettlement struct {
+	EndDate    time.Time  `json:"end_date"`
+	Settlement Settlement `json:"settlement"`
+}
+
+// CreateWebhook subscribes the URL to the events, of the trip or of all
+// the trips if tripID is 0. The secret of the signatures is generated.
+// sql.ErrNoRows is returned if there's no such trip.
+func CreateWebhook(ctx context.Context, db *sql.DB, tripID int64, rawURL string, events []string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL '%s', expecting an http or https URL", rawURL)
+	}
+	if len(events) == 0 {
+		return nil, fmt.Errorf("no events, expecting some of %s", strings.Join(Events, ", "))
+	}
+	subscribed := []string{}
+	for _, e := range events {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if !slices.Contains(Events, e) {
+			return nil, fmt.Errorf("unknown event '%s', expecting one of %s", e, strings.Join(Events, ", "))
+		}
+		if !slices.Contains(subscribed, e) {
+			subscribed = append(subscribed, e)
+		}
+	}
+	if tripID != 0 {
+		var exists int
+		err = db.QueryRowContext(ctx, tripExistsSelect, tripID).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+	}
+	secret, err := NewID(32)
+	if err != nil {
+		return nil, err
+	}
+	wh := &Webhook{
+		TripID:    tripID,
+		URL:       u.String(),
+		Events:    subscribed,
+		Secret:    secret,
+		CreatedAt: Now().UTC().Truncate(time.Microsecond),
+	}
+	rslt, err := db.ExecContext(ctx, webhookInsert, wh.TripID, wh.URL, strings.Join(wh.Events, ","), wh.Secret, wh.CreatedAt.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	wh.ID, err = rslt.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	Logf(ctx, "Created webhook %d of trip %d for %v\n", wh.ID, wh.TripID, wh.Events)
+	return wh, nil
+}
+
+// LoadWebhooks returns all the webhooks, without their secret
+func LoadWebhooks(ctx context.Context, db *sql.DB) ([]*Webhook, error) {
+	rows, err := db.QueryContext(ctx, webhooksSelect)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rslt := []*Webhook{}
+	for rows.Next() {
+		wh := new(Webhook)
+		var events string
+		var createdAt int64
+		err = rows.Scan(&wh.ID, &wh.TripID, &wh.URL, &events, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		wh.Events = strings.Split(events, ",")
+		wh.CreatedAt = time.UnixMicro(createdAt).UTC()
+		rslt = append(rslt, wh)
+	}
+	return rslt, rows.Err()
+}
+
+// DeleteWebhook deletes a webhook, and the events not delivered to it yet.
+// sql.ErrNoRows is returned if there's no such webhook.
+func DeleteWebhook(ctx context.Context, db *sql.DB, webhookID int64) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var rslt sql.Result
+	var cnt int64
+	_, err = txn.ExecContext(ctx, webhookDeliveryDel, webhookID)
+	if err != nil {
+		goto Rollback
+	}
+	rslt, err = txn.ExecContext(ctx, webhookDelete, webhookID)
+	if err != nil {
+		goto Rollback
+	}
+	cnt, err = rslt.RowsAffected()
+	if err != nil {
+		goto Rollback
+	}
+	if cnt == 0 {
+		err = sql.ErrNoRows
+		goto Rollback
+	}
+	return txn.Commit()
+
+Rollback:
+	rollbackErr := txn.Rollback()
+	if rollbackErr != nil {
+		fatalf(ctx, "ERROR: trip.DeleteWebhook() failed to rollback transaction on webhook %d: '%v'\n", webhookID, rollbackErr)
+	}
+	return err
+}
+
+// queueEvent queues the event of the trip for the webhooks subscribed to
+// it, and for the devices of its people, see queuePushes(), and returns
+// their number. It's expected to be executed within the transaction of the
+// change, see notifyWebhooks() once committed.
+func queueEvent(ctx context.Context, txn *sql.Tx, tripID int64, event string, data any, summary *TripSummary) (int, error) {
+	pushed, err := queuePushes(ctx, txn, tripID, event, data)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := txn.QueryContext(ctx, webhooksOfTrip, tripID)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var events string
+		err = rows.Scan(&id, &events)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if slices.Contains(strings.Split(events, ","), event) {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		return pushed, err
+	}
+	now := Now().UTC().Truncate(time.Microsecond)
+	payload, err := json.Marshal(WebhookEvent{Event: event, TripID: tripID, CreatedAt: now, Data: data, Summary: summary})
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		_, err = txn.ExecContext(ctx, deliveryInsert, id, tripID, event, string(payload), now.UnixMicro(), now.UnixMicro())
+		if err != nil {
+			return 0, err
+		}
+	}
+	return pushed + len(ids), nil
+}
+
+// notifyWebhooks signals the events queued, to the webhooks and the
+// devices, once committed
+func notifyWebhooks(queued int) {
+	if queued == 0 {
+		return
+	}
+	for _, ch := range []chan struct{}{webhookQueued, pushQueued} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// WebhooksQueued returns the channel signaled when events are queued, for
+// the worker calling DeliverWebhooks() to wake up
+func WebhooksQueued() <-chan struct{} {
+	return webhookQueued
+}
+
+// webhookData returns the data of the trip.created events
+func (trip *Trip) webhookData() webhookTrip {
+	return webhookTrip{
+		Name:         trip.Name,
+		Description:  trip.Description,
+		Owner:        trip.Owner.Email,
+		Participants: trip.people()[1:],
+		StartDate:    trip.StartDate,
+	}
+}
+
+// Summary returns the TripSummary of the trip as it stands
+func (trip *Trip) Summary() *TripSummary {
+	rslt := &TripSummary{Balances: make(map[string]int)}
+	byCategory := make(map[string]int)
+	for _, e := range trip.Expenses {
+		rslt.Total += e.amount
+		if c := strings.ToLower(e.Metadata[CategoryKey]); c != "" {
+			byCategory[c] += e.amount
+		}
+	}
+	for _, b := range trip.Balances() {
+		rslt.Balances[b.Email] = b.Net
+	}
+	for c, amount := range byCategory {
+		top := byCategory[rslt.TopCategory]
+		// the ties go to the first category in alphabetical order, so that
+		// the summary doesn't change between calls
+		if rslt.TopCategory == "" || amount > top || (amount == top && c < rslt.TopCategory) {
+			rslt.TopCategory = c
+		}
+	}
+	return rslt
+}
+
+// DeliverWebhooks POSTs the events due with the client, and returns the
+// number delivered. The body is signed by the header
+// X-Trip-Accountant-Signature, "sha256=" and the HMAC-SHA256 of the body
+// keyed with the secret of the webhook. An event not accepted with a 2xx
+// status is attempted again later, with an exponential backoff, until it
+// is given up on.
+func DeliverWebhooks(ctx context.Context, db *sql.DB, client *http.Client) (int, error) {
+	type delivery struct {
+		id             int64
+		event, payload string
+		attempts       int
+		url, secret    string
+	}
+	rows, err := db.QueryContext(ctx, deliveriesDue, Now().UnixMicro(), webhookBatch)
+	if err != nil {
+		return 0, err
+	}
+	var due []delivery
+	for rows.Next() {
+		var d delivery
+		err = rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, d := range due {
+		err = postWebhook(ctx, client, d.url, d.secret, d.id, d.event, []byte(d.payload))
+		d.attempts++
+		switch {
+		case err == nil:
+			delivered++
+			_, err = db.ExecContext(ctx, deliveryDelete, d.id)
+		case d.attempts >= webhookAttempts:
+			Logf(ctx, "ERROR: giving up on the delivery %d of %s to %s after %d attempts: %v\n",
+				d.id, d.event, d.url, d.attempts, err)
+			_, err = db.ExecContext(ctx, deliveryDelete, d.id)
+		default:
+			Logf(ctx, "WARNING: delivery %d of %s to %s failed, attempt %d: %v\n", d.id, d.event, d.url, d.attempts, err)
+			next := Now().Add(webhookBackoff << (d.attempts - 1))
+			lastErr := err.Error()
+			if len(lastErr) > 512 {
+				lastErr = lastErr[:512]
+			}
+			_, err = db.ExecContext(ctx, deliveryRetry, d.attempts, next.UnixMicro(), lastErr, d.id)
+		}
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// postWebhook POSTs the payload of a delivery, a status other than 2xx is
+// an error
+func postWebhook(ctx context.Context, client *http.Client, target, secret string, id int64, event string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "trip-accountant")
+	req.Header.Set("X-Trip-Accountant-Event", event)
+	req.Header.Set("X-Trip-Accountant-Delivery", strconv.FormatInt(id, 10))
+	req.Header.Set("X-Trip-Accountant-Signature", "sha256="+SignAudit([]byte(secret), payload))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the webhooks.
+
+package trip
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// webhookRecorder is a webhook recording the events POSTed to it, and
+// answering with its status
+type webhookRecorder struct {
+	mu     sync.Mutex
+	status int
+	events []WebhookEvent
+	bodies []string
+	sigs   []string
+}
+
+// ServeHTTP is part of the http.Handler interface
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var ev WebhookEvent
+	json.Unmarshal(body, &ev)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.events = append(wr.events, ev)
+	wr.bodies = append(wr.bodies, string(body))
+	wr.sigs = append(wr.sigs, r.Header.Get("X-Trip-Accountant-Signature"))
+	w.WriteHeader(wr.status)
+}
+
+// names returns the names of the events received
+func (wr *webhookRecorder) names() []string {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	rslt := []string{}
+	for _, ev := range wr.events {
+		rslt = append(rslt, ev.Event)
+	}
+	return rslt
+}
+
+// TestWebhooks subscribes 2 webhooks, one failing, and delivers the events
+// of a trip
+func TestWebhooks(t *testing.T) {
+	ctx := context.Background()
+	wdb := openTestDB(t)
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	fc := NewFakeClock(start, time.Second)
+	SetClock(fc.Now)
+	t.Cleanup(func() { SetClock(nil) })
+
+	ok := &webhookRecorder{status: http.StatusNoContent}
+	okSrv := httptest.NewServer(ok)
+	defer okSrv.Close()
+	failing := &webhookRecorder{status: http.StatusServiceUnavailable}
+	failingSrv := httptest.NewServer(failing)
+	defer failingSrv.Close()
+
+	_, err := CreateWebhook(ctx, wdb, 0, "ftp://example.com/", Events)
+	if err == nil {
+		t.Error("expected an ftp URL to be refused")
+	}
+	_, err = CreateWebhook(ctx, wdb, 0, okSrv.URL, []string{"trip.deleted"})
+	if err == nil {
+		t.Error("expected an unknown event to be refused")
+	}
+	_, err = CreateWebhook(ctx, wdb, 999, okSrv.URL, Events)
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows for an unknown trip, got %v", err)
+	}
+	wh, err := CreateWebhook(ctx, wdb, 0, okSrv.URL, Events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateWebhook(ctx, wdb, 0, failingSrv.URL, []string{EventExpenseAdded})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := NewTrip("Trip W", alice, "", NewDate(start), []string{bob})
+	err = tr.Save(ctx, wdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(start), "hotel", []Participant{{alice, 0, 9000}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Save(ctx, wdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-WebhooksQueued():
+	default:
+		t.Error("expected the worker to be woken up")
+	}
+	client := okSrv.Client()
+	n, err := DeliverWebhooks(ctx, wdb, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || !reflect.DeepEqual(ok.names(), []string{EventTripCreated, EventExpenseAdded}) {
+		t.Errorf("expected trip.created then expense.added delivered, got %d: %v", n, ok.names())
+	}
+	if ok.events[0].TripID != tr.ID || ok.sigs[0] != "sha256="+SignAudit([]byte(wh.Secret), []byte(ok.bodies[0])) {
+		t.Errorf("Unexpected event %s signed %s", ok.bodies[0], ok.sigs[0])
+	}
+	summary := &TripSummary{Total: 9000, Balances: map[string]int{alice: 4500, bob: -4500}}
+	if !reflect.DeepEqual(ok.events[1].Summary, summary) {
+		t.Errorf("expected the summary %+v, got %+v", summary, ok.events[1].Summary)
+	}
+
+	// the failing webhook is retried once the backoff is over, and given
+	// up on after webhookAttempts
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		n, err = DeliverWebhooks(ctx, wdb, client)
+		if err != nil || n != 0 {
+			t.Fatalf("attempt %d: %d delivered, %v", attempt, n, err)
+		}
+		fc.Advance(webhookBackoff << attempt)
+	}
+	if got := len(failing.names()); got != webhookAttempts {
+		t.Errorf("expected %d attempts, got %d", webhookAttempts, got)
+	}
+	var pending int
+	err = wdb.QueryRowContext(ctx, "SELECT COUNT(*) FROM webhook_delivery").Scan(&pending)
+	if err != nil || pending != 0 {
+		t.Errorf("expected no delivery left, got %d, %v", pending, err)
+	}
+
+	_, err = tr.Complete(ctx, wdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DeliverWebhooks(ctx, wdb, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := ok.names(); names[len(names)-1] != EventTripCompleted {
+		t.Errorf("expected trip.completed, got %v", names)
+	}
+	err = DeleteWebhook(ctx, wdb, wh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteWebhook(ctx, wdb, wh.ID); err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows deleting again, got %v", err)
+	}
+}
+
+// TestTripSummary checks the top category of the expenses of a trip, with
+// the ties going to the first one in alphabetical order
+func TestTripSummary(t *testing.T) {
+	sdb := openTestDB(t)
+	tr := NewTrip("Trip S", alice, "", NewDate(time.Now()), []string{bob, charlie})
+	err := tr.Save(context.Background(), sdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		description string
+		category    string
+		amount      int
+	}{
+		{"hotel", "Lodging", 6000},
+		{"dinner", "food", 3000},
+		{"lunch", "Food", 3000},
+		{"taxi", "", 900},
+	} {
+		err = tr.AddExpense(NewDate(time.Now()), e.description, []Participant{{alice, 0, e.amount}, {bob, 0, 0}, {charlie, 0, 0}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.category != "" {
+			tr.Expenses[len(tr.Expenses)-1].Metadata = map[string]string{CategoryKey: e.category}
+		}
+	}
+	summary := tr.Summary()
+	if summary.Total != 12900 || summary.TopCategory != "food" {
+		t.Errorf("expected 12900 with food on top, got %+v", summary)
+	}
+	if summary.Balances[alice] != 8600 || summary.Balances[bob] != -4300 {
+		t.Errorf("Unexpected balances %v", summary.Balances)
+	}
+}
@@ -0,0 +1,199 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit implements a minimal XLSX writer, only able to lay out sheets
+// of text and amounts, and the workbook of a trip built with it.
+
+package trip
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// xlsxParts are the fixed parts of a workbook, the sheets aside
+var xlsxParts = map[string]string{
+	"_rels/.rels": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`,
+	// the cell styles are: 0 the default, 1 the amounts, 2 the headers
+	"xl/styles.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>
+<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>
+<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>
+<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>
+<cellXfs count="3"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="2" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>
+</styleSheet>`,
+}
+
+// xlsxCents is an amount in cent, laid out as a number with 2 decimals in a sheet
+type xlsxCents int
+
+// xlsxSheet is a sheet of a workbook, its first row is the header. The
+// cells are strings, integers or xlsxCents.
+type xlsxSheet struct {
+	name string
+	rows [][]any
+}
+
+// xlsxColumn returns the name of the column of index i, from A
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// xlsxEscape escapes a text for the XML of a part
+func xlsxEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// sheetXML renders the cells of the sheet
+func (sh xlsxSheet) sheetXML() string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for r, row := range sh.rows {
+		fmt.Fprintf(&b, `<row r="%d">`, r+1)
+		for c, cell := range row {
+			ref := fmt.Sprintf("%s%d", xlsxColumn(c), r+1)
+			switch v := cell.(type) {
+			case xlsxCents:
+				fmt.Fprintf(&b, `<c r="%s" s="1"><v>%s</v></c>`, ref, formatCents(int(v)))
+			case int:
+				fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, v)
+			case int64:
+				fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, v)
+			default:
+				style := ""
+				if r == 0 {
+					style = ` s="2"`
+				}
+				fmt.Fprintf(&b, `<c r="%s" t="inlineStr"%s><is><t xml:space="preserve">%s</t></is></c>`,
+					ref, style, xlsxEscape(fmt.Sprint(v)))
+			}
+		}
+		b.WriteString("</row>")
+	}
+	b.WriteString("</sheetData></worksheet>")
+	return b.String()
+}
+
+// xlsxWorkbook packs the sheets into an XLSX document
+func xlsxWorkbook(sheets []xlsxSheet) ([]byte, error) {
+	parts := make(map[string]string, len(xlsxParts)+len(sheets)+3)
+	for name, part := range xlsxParts {
+		parts[name] = part
+	}
+	var types, workbook, rels strings.Builder
+	types.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>
+`)
+	workbook.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+`)
+	for i, sh := range sheets {
+		n := i + 1
+		parts[fmt.Sprintf("xl/worksheets/sheet%d.xml", n)] = sh.sheetXML()
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+`, n)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xlsxEscape(sh.name), n, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>
+`, n, n)
+	}
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+`, len(sheets)+1)
+	types.WriteString("</Types>")
+	workbook.WriteString("</sheets></workbook>")
+	rels.WriteString("</Relationships>")
+	parts["[Content_Types].xml"] = types.String()
+	parts["xl/workbook.xml"] = workbook.String()
+	parts["xl/_rels/workbook.xml.rels"] = rels.String()
+
+	// the parts are written in a stable order, the content types first
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write([]byte(parts[name]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WorkbookXLSX lays out the trip in an XLSX workbook with 3 sheets: the
+// participants with their balances, the expenses with one row per
+// participant, and the settlement
+func (trip *Trip) WorkbookXLSX(s Settlement) ([]byte, error) {
+	return xlsxWorkbook(trip.workbookSheets(s))
+}
+
+// workbookSheets returns the sheets of the workbook of the trip, see
+// WorkbookXLSX()
+func (trip *Trip) workbookSheets(s Settlement) []xlsxSheet {
+	participants := xlsxSheet{name: "Participants", rows: [][]any{{"user", "role", "paid", "share", "fee", "net"}}}
+	for i, b := range trip.Balances() {
+		role := "participant"
+		if i == 0 {
+			role = "owner"
+		}
+		participants.rows = append(participants.rows, []any{b.Email, role, xlsxCents(b.Paid), xlsxCents(b.Share), xlsxCents(b.Fee), xlsxCents(b.Net)})
+	}
+
+	expenses := xlsxSheet{name: "Expenses", rows: [][]any{{"expense_id", "date", "description", "user", "paid"}}}
+	for _, e := range trip.Expenses {
+		for _, p := range e.Participants {
+			expenses.rows = append(expenses.rows, []any{e.ID, e.Date.Format(time.DateOnly), e.Description, p.Email, xlsxCents(p.Paid)})
+		}
+	}
+
+	settlement := xlsxSheet{name: "Settlement", rows: [][]any{{"payer", "payee", "amount"}}}
+	payers := make([]string, 0, len(s))
+	for payer := range s {
+		payers = append(payers, payer)
+	}
+	sort.Strings(payers)
+	for _, payer := range payers {
+		payees := make([]string, 0, len(s[payer]))
+		for payee := range s[payer] {
+			payees = append(payees, payee)
+		}
+		sort.Strings(payees)
+		for _, payee := range payees {
+			settlement.rows = append(settlement.rows, []any{payer, payee, xlsxCents(s[payer][payee])})
+		}
+	}
+	return []xlsxSheet{participants, expenses, settlement}
+}
@@ -0,0 +1,91 @@
+// Package trip implements the data model for managing trip expenses
+// the key purpose is to compute the settlement of the expenses by the
+// participants.
+//
+// This unit runs some unit tests against the XLSX workbook of a trip.
+
+package trip
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestXLSXColumn checks the names of the columns past Z
+func TestXLSXColumn(t *testing.T) {
+	cases := map[int]string{0: "A", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"}
+	for i, want := range cases {
+		if got := xlsxColumn(i); got != want {
+			t.Errorf("xlsxColumn(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
+
+// TestWorkbookXLSX lays out a trip in a workbook, and checks its parts
+// are well-formed and hold the expenses and the settlement
+func TestWorkbookXLSX(t *testing.T) {
+	ctx := context.Background()
+	xdb := openTestDB(t)
+	tr := NewTrip("Trip X", alice, "", epochToDate(time.Now().Unix()), []string{bob})
+	err := tr.Save(ctx, xdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.AddExpense(NewDate(time.Now()), "fish & chips", []Participant{{alice, 0, 2500}, {bob, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tr.Settlement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	workbook, err := tr.WorkbookXLSX(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(workbook), int64(len(workbook)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := xml.NewDecoder(bytes.NewReader(b))
+		for err == nil {
+			_, err = d.Token()
+		}
+		if err != io.EOF {
+			t.Errorf("%s isn't well-formed: %v", f.Name, err)
+		}
+		parts[f.Name] = string(b)
+	}
+	if zr.File[0].Name != "[Content_Types].xml" || len(parts) != 8 {
+		t.Errorf("Unexpected parts: %v", zr.File)
+	}
+	if !strings.Contains(parts["xl/workbook.xml"], `<sheet name="Settlement" sheetId="3" r:id="rId3"/>`) {
+		t.Errorf("Settlement sheet missing: %s", parts["xl/workbook.xml"])
+	}
+	if !strings.Contains(parts["xl/worksheets/sheet2.xml"], "fish &amp; chips") {
+		t.Errorf("Expense missing: %s", parts["xl/worksheets/sheet2.xml"])
+	}
+	if !strings.Contains(parts["xl/worksheets/sheet3.xml"], `<c r="C2" s="1"><v>12.50</v></c>`) {
+		t.Errorf("Settlement amount missing: %s", parts["xl/worksheets/sheet3.xml"])
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// publicURL is the URL the server is reached at, for the links in the
+	// emails, the one of the request if empty
+	publicURL string
+	// verificationTTL is how long the link to verify an email address is
+	// valid
+	verificationTTL = 24 * time.Hour
+)
+
+// serverURL returns the URL the server is reached at, publicURL or the one
+// of the request
+func serverURL(r *http.Request) string {
+	if publicURL != "" {
+		return strings.TrimSuffix(publicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// postVerification mails a link to verify the email address of a user,
+// for the user only
+func postVerification(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	email := r.PathValue("email")
+	if !actsFor(r, email) {
+		jsonBail(w, r, http.StatusForbidden, fmt.Errorf("only %s can verify their email address", email))
+		return
+	}
+	ctx := requestContext(r)
+	v, err := trip.IssueVerification(ctx, db, email, verificationTTL)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrAlreadyVerified:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	link := serverURL(r) + "/v1/verify?token=" + url.QueryEscape(v.Secret)
+	body := fmt.Sprintf("Please follow this link to verify your email address on %s:\r\n\r\n%s\r\n\r\nThe link expires at %s.\r\n",
+		instanceName, link, v.ExpiresAt.Format(time.RFC1123))
+	err = sendMail(ctx, v.Email, "Verify your email address", body)
+	if err != nil {
+		trip.Logf(ctx, "ERROR: failed to mail the verification of %s: %v\n", v.Email, err)
+		jsonBail(w, r, http.StatusServiceUnavailable, errors.New("failed to send the verification email"))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, v)
+}
+
+// getVerify verifies the email address the link was mailed to, the secret
+// of the link being the proof
+func getVerify(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	secret := r.URL.Query().Get("token")
+	if secret == "" {
+		jsonBail(w, r, http.StatusBadRequest, errors.New("missing token"))
+		return
+	}
+	p, err := trip.VerifyEmail(requestContext(r), db, secret)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, errors.New("unknown verification link"))
+		return
+	case err == trip.ErrVerificationExpired:
+		jsonBail(w, r, http.StatusGone, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	writeJSON(w, http.StatusOK, p)
+}
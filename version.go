@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/dvusboy/trip-accountant/apierror"
+)
+
+const (
+	// defaultAPIVersion is the version of the requests without one, it
+	// must stay v1 so that the clients predating the versions keep working
+	defaultAPIVersion = "v1"
+	// acceptVersionHeader selects the version of an unprefixed request
+	acceptVersionHeader = "Accept-Version"
+	// apiVersionHeader tells the version that served the request
+	apiVersionHeader = "API-Version"
+)
+
+var (
+	// apiVersions are the versions of the API served, each under its
+	// own prefix, e.g. /v1/trips
+	apiVersions = map[string]bool{"v1": true}
+	// versionPrefix matches the version prefix of a path
+	versionPrefix = regexp.MustCompile(`^/(v[0-9]+)(/|$)`)
+)
+
+// versionNegotiation routes the requests without a version prefix to the
+// version of their Accept-Version header, or to defaultAPIVersion, by
+// prefixing their path before the router sees it. The version serving the
+// request is returned in the API-Version header.
+func versionNegotiation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := versionPrefix.FindStringSubmatch(r.URL.Path); m != nil {
+			w.Header().Set(apiVersionHeader, m[1])
+			next.ServeHTTP(w, r)
+			return
+		}
+		version := defaultAPIVersion
+		if v := r.Header.Get(acceptVersionHeader); v != "" {
+			version = v
+		}
+		if !apiVersions[version] {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(apierror.Envelope{
+				Code:    apierror.UnsupportedVersion,
+				Message: fmt.Sprintf("unsupported API version %q", version),
+			})
+			return
+		}
+		r.URL.Path = "/" + version + r.URL.Path
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = "/" + version + r.URL.RawPath
+		}
+		w.Header().Set(apiVersionHeader, version)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// maxVoiceNoteSize is the maximum size, in bytes, of the upload of a
+	// voice note, instead of maxBodySize
+	maxVoiceNoteSize int64 = 5 << 20
+	// speechCommand is the command transcribing the audio of a voice note,
+	// see trip.CommandSpeech, the transcription is off without it
+	speechCommand string
+)
+
+// audioTypes are the content types of the voice notes accepted, as
+// detected from the content. An M4A recording, e.g. of a phone, is
+// detected as video/mp4.
+var audioTypes = map[string]bool{
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"audio/aiff":      true,
+	"application/ogg": true,
+	"video/webm":      true,
+	"video/mp4":       true,
+}
+
+// postVoiceNote attaches the audio of the "file" field of a multipart
+// upload to an expense, transcribed if the query has transcribe=true
+func postVoiceNote(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, expenseID, err := expenseParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	u, status, err := openUpload(r, audioTypes)
+	if err != nil {
+		jsonBail(w, r, status, err)
+		return
+	}
+	defer u.Close()
+	transcribe := r.URL.Query().Get("transcribe") == "true"
+	vn, err := trip.AttachVoiceNote(requestContext(r), db, tripID, expenseID, u.filename, u.contentType, u, transcribe)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err == trip.ErrTripArchived:
+		jsonBail(w, r, http.StatusConflict, err)
+		return
+	case err == trip.ErrNoSpeech:
+		jsonBail(w, r, http.StatusNotImplemented, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, vn)
+}
+
+// draftVoiceExpense transcribes a voice note, the "file" of a multipart
+// upload, and returns the payload of an expense pre-filled with what was
+// said: its first sentence as the description, the whole transcript as
+// the notes, and the amount and the date said. Like draftExpense(),
+// nothing is written unless the query has review=true.
+func draftVoiceExpense(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.LoadTripByID(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	u, status, err := openUpload(r, audioTypes)
+	if err != nil {
+		jsonBail(w, r, status, err)
+		return
+	}
+	defer u.Close()
+	d, err := trip.DictateExpense(ctx, u)
+	switch {
+	case err == trip.ErrNoSpeech:
+		jsonBail(w, r, http.StatusNotImplemented, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	draft := expenseJSON{
+		Date:        trip.Now().Format(time.DateOnly),
+		Description: d.Description,
+		Amount:      d.Amount,
+		SplitAmong:  t.Sharers(),
+		Notes:       d.Transcript,
+	}
+	if d.Date.Unix() != 0 {
+		draft.Date = d.Date.Format(time.DateOnly)
+	}
+	if r.URL.Query().Get("review") == "true" {
+		queueForReview(w, r, db, t.ID, "voice", d.Confidence, draft)
+		return
+	}
+	writeJSON(w, http.StatusOK, draft)
+}
+
+// getVoiceNotes returns the list of voice notes of an expense
+func getVoiceNotes(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, expenseID, err := expenseParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	notes, err := trip.LoadVoiceNotes(requestContext(r), db, tripID, expenseID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, notes)
+}
+
+// getVoiceNote returns the audio file of a voice note
+func getVoiceNote(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, expenseID, err := expenseParams(r)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	voiceNoteID, err := strconv.ParseInt(r.PathValue("voice_note_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	vn, err := trip.LoadVoiceNote(requestContext(r), db, tripID, expenseID, voiceNoteID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	f, err := vn.Open()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("the file of voice note %d is missing", vn.ID)
+		}
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", strconv.Quote(vn.SHA256))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": vn.Filename}))
+	w.Header().Set("Content-Type", vn.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(vn.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, f)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+)
+
+var (
+	// webhookInterval is the interval between the passes delivering the
+	// events to the webhooks, besides the passes woken up by new events
+	webhookInterval = 30 * time.Second
+	// webhookTimeout is the time a webhook has to answer
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookJSON is used for POST to subscribe to events
+type webhookJSON struct {
+	URL    string   `json:"url" binding:"required,url"`
+	Events []string `json:"events" binding:"required,min=1"`
+	// TripID restricts the events to a trip, all the trips without it
+	TripID int64 `json:"trip_id" binding:"min=0"`
+}
+
+// runWebhooks delivers the events to the webhooks in the background, as
+// they're queued and every webhookInterval for the retries, until the
+// process ends
+func runWebhooks(db *sql.DB) {
+	if webhookInterval <= 0 {
+		log.Printf("The events aren't delivered to the webhooks\n")
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	go func() {
+		tick := time.Tick(webhookInterval)
+		for {
+			select {
+			case <-tick:
+			case <-trip.WebhooksQueued():
+			}
+			ctx := trip.WithRequestID(context.Background(), "webhooks")
+			_, err := trip.DeliverWebhooks(ctx, db, client)
+			if err != nil {
+				trip.Logf(ctx, "ERROR: failed to deliver the events to the webhooks: %v\n", err)
+			}
+		}
+	}()
+}
+
+// postWebhook subscribes a URL to the events of the trips
+func postWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var wj webhookJSON
+	err := decodeJSON(r, &wj)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	wh, err := trip.CreateWebhook(requestContext(r), db, wj.TripID, wj.URL, wj.Events)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, wh)
+}
+
+// getWebhooks lists the webhooks, without their secrets
+func getWebhooks(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	webhooks, err := trip.LoadWebhooks(requestContext(r), db)
+	if err != nil {
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+// deleteWebhook unsubscribes a webhook
+func deleteWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	webhookID, err := strconv.ParseInt(r.PathValue("webhook_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = trip.DeleteWebhook(requestContext(r), db, webhookID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
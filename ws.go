@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dvusboy/trip-accountant/trip"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// wsBuffer is the number of messages a client can be behind before
+	// missing some
+	wsBuffer = 32
+	// wsMaxStatus is the maximum length of the status of a client
+	wsMaxStatus = 100
+)
+
+// wsPresence is a user connected to the room of a trip
+type wsPresence struct {
+	User string `json:"user"`
+	// Status is set by the client, e.g. the expense being entered
+	Status string    `json:"status,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// wsMessage is the message exchanged over the WebSocket, its Type tells
+// which of the other fields is set
+type wsMessage struct {
+	// Type is "presence", "activity", "heartbeat" or "error" from the
+	// server, "presence" from the client
+	Type     string         `json:"type"`
+	Activity *trip.Activity `json:"activity,omitempty"`
+	Presence []wsPresence   `json:"presence,omitempty"`
+	Status   string         `json:"status,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// wsClient is a connection to the room of a trip
+type wsClient struct {
+	presence wsPresence
+	out      chan wsMessage
+}
+
+// wsRooms are the clients connected, by trip ID
+var wsRooms = struct {
+	mu    sync.Mutex
+	rooms map[int64]map[*wsClient]bool
+}{rooms: make(map[int64]map[*wsClient]bool)}
+
+// joinRoom adds a client to the room of a trip, and tells the room
+func joinRoom(tripID int64, client *wsClient) {
+	wsRooms.mu.Lock()
+	defer wsRooms.mu.Unlock()
+	if wsRooms.rooms[tripID] == nil {
+		wsRooms.rooms[tripID] = make(map[*wsClient]bool)
+	}
+	wsRooms.rooms[tripID][client] = true
+	broadcastPresence(tripID)
+}
+
+// leaveRoom removes a client from the room of a trip, and tells the room
+func leaveRoom(tripID int64, client *wsClient) {
+	wsRooms.mu.Lock()
+	defer wsRooms.mu.Unlock()
+	delete(wsRooms.rooms[tripID], client)
+	if len(wsRooms.rooms[tripID]) == 0 {
+		delete(wsRooms.rooms, tripID)
+		return
+	}
+	broadcastPresence(tripID)
+}
+
+// setStatus changes the status of a client, and tells the room
+func setStatus(tripID int64, client *wsClient, status string) {
+	if len(status) > wsMaxStatus {
+		status = status[:wsMaxStatus]
+	}
+	wsRooms.mu.Lock()
+	defer wsRooms.mu.Unlock()
+	client.presence.Status = status
+	broadcastPresence(tripID)
+}
+
+// broadcastPresence sends the users in the room of a trip to its clients,
+// without waiting for the ones not keeping up. wsRooms.mu must be held.
+func broadcastPresence(tripID int64) {
+	presence := []wsPresence{}
+	for client := range wsRooms.rooms[tripID] {
+		presence = append(presence, client.presence)
+	}
+	sort.Slice(presence, func(i, j int) bool {
+		if presence[i].User != presence[j].User {
+			return presence[i].User < presence[j].User
+		}
+		return presence[i].Since.Before(presence[j].Since)
+	})
+	msg := wsMessage{Type: "presence", Presence: presence}
+	for client := range wsRooms.rooms[tripID] {
+		select {
+		case client.out <- msg:
+		default:
+		}
+	}
+}
+
+// getTripWS joins the room of a trip over a WebSocket: the clients are told
+// of the changes of the trip, and of the participants connected, each one
+// setting a status shown to the others
+func getTripWS(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tripID, err := strconv.ParseInt(r.PathValue("trip_id"), 10, 64)
+	if err != nil {
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ctx := requestContext(r)
+	t, err := trip.LoadTripByID(ctx, db, tripID)
+	switch {
+	case err == sql.ErrNoRows:
+		jsonBail(w, r, http.StatusNotFound, err)
+		return
+	case err != nil:
+		jsonBail(w, r, http.StatusBadRequest, err)
+		return
+	}
+	user := r.URL.Query().Get("user")
+	if tok := requestToken(r); tok != nil && user == "" {
+		user = tok.Email
+	}
+	switch {
+	case user == "":
+		jsonBail(w, r, http.StatusBadRequest, errors.New("the user joining the trip is required"))
+		return
+	case !t.IsParticipant(user) || !actsFor(r, user):
+		jsonBail(w, r, http.StatusForbidden, errors.New("only the participants of the trip can join it"))
+		return
+	}
+
+	server := websocket.Server{
+		// the browsers of the participants are authorized by the token,
+		// whatever the origin of the page
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			// the connection outlives the timeouts of the server
+			err := ws.SetDeadline(time.Time{})
+			if err != nil {
+				trip.Logf(ctx, "WARNING: the WebSocket is cut by the timeouts: %v\n", err)
+			}
+			serveRoom(ws, tripID, strings.ToLower(user))
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// serveRoom relays the room of a trip to a WebSocket until either side
+// goes away
+func serveRoom(ws *websocket.Conn, tripID int64, user string) {
+	activity, unsubscribe := trip.SubscribeActivity(tripID)
+	defer unsubscribe()
+	client := &wsClient{
+		presence: wsPresence{User: user, Since: time.Now().UTC()},
+		out:      make(chan wsMessage, wsBuffer),
+	}
+	joinRoom(tripID, client)
+	defer leaveRoom(tripID, client)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var msg wsMessage
+			err := websocket.JSON.Receive(ws, &msg)
+			if err != nil {
+				return
+			}
+			switch msg.Type {
+			case "presence":
+				setStatus(tripID, client, msg.Status)
+			default:
+				select {
+				case client.out <- wsMessage{Type: "error", Error: "unknown message type '" + msg.Type + "'"}:
+				default:
+				}
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var msg wsMessage
+		select {
+		case a, ok := <-activity:
+			if !ok {
+				return
+			}
+			msg = wsMessage{Type: "activity", Activity: &a}
+		case msg = <-client.out:
+		case <-heartbeat.C:
+			msg = wsMessage{Type: "heartbeat"}
+		case <-done:
+			return
+		}
+		if websocket.JSON.Send(ws, msg) != nil {
+			return
+		}
+	}
+}